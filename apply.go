@@ -0,0 +1,158 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"testing/fstest"
+
+	"github.com/pkg/errors"
+	"golang.org/x/text/unicode/norm"
+)
+
+// ApplyOne applies a single migration read from content, such as a hotfix
+// piped in by a pipeline, recording it in meta as filename. Its statements
+// run with checkpoints as Migrate runs a file's, and it resumes from those of
+// an earlier attempt, but unlike Migrate it doesn't check the other
+// migrations recorded. It reports whether the migration ran, or false if it's
+// recorded as applied already.
+//
+// filename must be a migration's name, such as 0042_hotfix.sql, and should be
+// added to the migrations directory in the place it was applied, so later
+// runs agree with meta. A migration already recorded as filename with another
+// checksum is refused with an *ErrChecksumMismatch.
+func ApplyOne(
+	ctx context.Context,
+	db Store,
+	log Logger,
+	filename string,
+	content io.Reader,
+	opts ...Option,
+) (bool, error) {
+	filename = norm.NFC.String(filename)
+	if path.Base(filename) != filename || !isMigrationName(filename) {
+		return false, fmt.Errorf("invalid filename %q, which must start with a number and end in .sql",
+			filename)
+	}
+	byt, err := io.ReadAll(content)
+	if err != nil {
+		return false, errors.Wrap(err, "read content")
+	}
+	m, err := newMigrate(db, log, opts)
+	if err != nil {
+		return false, err
+	}
+	if err = m.refuseDryRun("ApplyOne"); err != nil {
+		return false, err
+	}
+	m.one = true
+	m.fsys = migrationFS(fstest.MapFS{filename: {Data: byt}})
+	info, err := fs.Stat(m.fsys, filename)
+	if err != nil {
+		return false, err
+	}
+	f := &file{Info: info, fullpath: filename}
+	m.Files = []*file{f}
+	if err = checkNames(m.Files); err != nil {
+		return false, err
+	}
+	if err = m.prepareMeta(ctx); err != nil {
+		return false, err
+	}
+
+	ctx, release, err := m.lock(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	// Read the migration's record once the lock is held, in case another
+	// run applied it in the meantime
+	mg, err := db.GetMigrationWithDown(ctx, filename)
+	switch {
+	case errors.Is(err, ErrMigrationNotFound):
+	case err != nil:
+		return false, errors.Wrap(err, "get migration")
+	case mg.Status == StatusRollbackFailed:
+		return false, &ErrRollbackFailed{Filename: filename, Err: mg.Error}
+	case mg.Status == StatusFailed && !m.resume:
+		return false, &ErrMigrationFailed{Filename: filename, Err: mg.Error}
+	case mg.Status == StatusApplied || mg.Status == StatusSkipped:
+		// An unfinished migration may have been edited to fix it, so
+		// only a finished one's checksum is checked
+		mg.fullpath = filename
+		if err = m.checkHash(mg); err != nil {
+			return false, errors.Wrap(err, "check hash")
+		}
+		m.log.Printf("%s is already %s\n", filename, mg.Status)
+		return false, nil
+	}
+	if err = m.applyFile(ctx, f); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Rerun runs the applied migration filename again from its file in dir, such
+// as one creating or replacing views, whether or not the file changed since
+// it was applied, then records it with the file's checksum and content. Its
+// statements run with checkpoints as Migrate runs a file's, but no other file
+// runs, pending or not.
+//
+// Files which should run again whenever they change can instead start with
+// the "-- migrate:rerun-always" directive, which Migrate runs again rather
+// than reporting an *ErrChecksumMismatch.
+func Rerun(
+	ctx context.Context,
+	db Store,
+	log Logger,
+	dbt DBType,
+	dir string,
+	filename string,
+	opts ...Option,
+) error {
+	fsys, err := dirFS(dir)
+	if err != nil {
+		return err
+	}
+	return RerunFS(ctx, db, log, dbt, fsys, filename, opts...)
+}
+
+// RerunFS is Rerun with the files at the root of fsys, as NewFS reads them.
+func RerunFS(
+	ctx context.Context,
+	db Store,
+	log Logger,
+	dbt DBType,
+	fsys fs.FS,
+	filename string,
+	opts ...Option,
+) error {
+	filename = norm.NFC.String(filename)
+	opts = append(opts[:len(opts):len(opts)],
+		func(m *Migrate) { m.rerun = filename })
+	m, err := NewFS(ctx, db, log, dbt, fsys, "", opts...)
+	if err != nil {
+		return err
+	}
+	if err = m.refuseDryRun("Rerun"); err != nil {
+		return err
+	}
+	ctx, release, err := m.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err = m.reloadMigrations(ctx); err != nil {
+		return errors.Wrap(err, "reload migrations")
+	}
+	if !m.reruns[filename] {
+		return fmt.Errorf("%s isn't applied, so can't be rerun", filename)
+	}
+	f := m.Files[m.fileIndexes()[filename]]
+	m.log.Printf("re-running %s\n", filename)
+	m.reconnects = 0
+	return m.applyFile(ctx, f)
+}
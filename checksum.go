@@ -0,0 +1,297 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// WithChecksumAlgo sets the algorithm migrations are recorded with, which is
+// ChecksumSHA256 by default. Those recorded already are checked with the
+// algorithm they were recorded with, whichever it is.
+func WithChecksumAlgo(algo string) Option {
+	return func(m *Migrate) { m.algo = algo }
+}
+
+// WithNormalizedChecksums checksums migrations without their comments, other
+// than directives, and with each run of whitespace outside quotes as one
+// space, so reformatting a file, such as reindenting it, wrapping its lines
+// or commenting it, doesn't change its checksum. Quoted strings still count
+// exactly. Migrations are recorded with the algorithm ending in +normalized,
+// such as sha256+normalized, and those recorded already are checked as they
+// were recorded until RehashChecksums records them again.
+func WithNormalizedChecksums() Option {
+	return func(m *Migrate) { m.normalizeChecksums = true }
+}
+
+// normalizedSuffix ends the algorithms of checksums computed over SQL
+// normalized by normalizeSQL.
+const normalizedSuffix = "+normalized"
+
+// checksumAlgo returns the algorithm set by WithChecksumAlgo, or the default,
+// normalized with WithNormalizedChecksums.
+func (m *Migrate) checksumAlgo() string {
+	algo := m.algo
+	if algo == "" {
+		algo = ChecksumSHA256
+	}
+	if m.normalizeChecksums && !strings.HasSuffix(algo, normalizedSuffix) {
+		algo += normalizedSuffix
+	}
+	return algo
+}
+
+// recordedAlgo returns the algorithm mg's checksum was computed with, which
+// for migrations recorded before meta version 3 is md5.
+func recordedAlgo(mg Migration) string {
+	if mg.ChecksumAlgo == "" {
+		return ChecksumMD5
+	}
+	return mg.ChecksumAlgo
+}
+
+// sameChecksum reports whether a and b were recorded with the same content,
+// by their checksums, or by b's content if they're by different algorithms.
+func sameChecksum(a, b Migration) bool {
+	if recordedAlgo(a) == recordedAlgo(b) {
+		return a.Checksum == b.Checksum
+	}
+	match, _, err := recordedMatch(a, []byte(b.Content))
+	return err == nil && match
+}
+
+// fileChecksumOf returns the checksum by algo of byt, a migration file's
+// content, with normalized line endings and without its tail as trimTail
+// trims it. The content recorded is the file's, tail and all.
+func fileChecksumOf(algo string, byt []byte) (string, error) {
+	return checksumOf(algo, trimTail(normalizeLineEndings(byt)))
+}
+
+// checksumOf returns the checksum of byt by algo, in hex. An empty algo is md5,
+// as for migrations recorded before meta version 3, and one ending in
+// normalizedSuffix checksums byt normalized.
+func checksumOf(algo string, byt []byte) (string, error) {
+	if base, ok := strings.CutSuffix(algo, normalizedSuffix); ok {
+		algo = base
+		byt = normalizeSQL(byt)
+	}
+	switch algo {
+	case ChecksumSHA256:
+		return fmt.Sprintf("%x", sha256.Sum256(byt)), nil
+	case ChecksumMD5, "":
+		return fmt.Sprintf("%x", md5.Sum(byt)), nil
+	}
+	return "", fmt.Errorf("unknown checksum algorithm %q", algo)
+}
+
+// fileChecksum returns the checksum of the file at name in fsys by algo.
+func fileChecksum(fsys fs.FS, name, algo string) (string, error) {
+	byt, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return "", err
+	}
+	return fileChecksumOf(algo, byt)
+}
+
+// RehashChecksums records again the checksums of the migrations in meta
+// recorded with another algorithm than WithChecksumAlgo's, sha256 by default,
+// such as md5 by earlier versions, computed by it from their files in dir. A
+// migration is only rehashed if its file still matches its checksum, or with
+// WithNormalizedChecksums, if the file normalized matches the content recorded
+// normalized, such as after it was reformatted. So one which was edited is
+// still reported as mismatched. It reports how many were rehashed, and needs
+// the meta tables at the current version.
+func RehashChecksums(
+	ctx context.Context,
+	db Store,
+	log Logger,
+	dbt DBType,
+	dir string,
+	opts ...Option,
+) (int, error) {
+	fsys, err := dirFS(dir)
+	if err != nil {
+		return 0, err
+	}
+	return RehashChecksumsFS(ctx, db, log, dbt, fsys, opts...)
+}
+
+// RehashChecksumsFS is RehashChecksums with the files at the root of fsys, as
+// NewFS reads them.
+func RehashChecksumsFS(
+	ctx context.Context,
+	db Store,
+	log Logger,
+	dbt DBType,
+	fsys fs.FS,
+	opts ...Option,
+) (int, error) {
+	m, err := newMigrate(db, log, opts)
+	if err != nil {
+		return 0, err
+	}
+	if err = m.refuseDryRun("RehashChecksums"); err != nil {
+		return 0, err
+	}
+	if fsys, err = m.withIgnore(fsys); err != nil {
+		return 0, err
+	}
+	if m.fsys, err = m.withGoMigrations(migrationFS(fsys)); err != nil {
+		return 0, err
+	}
+	if m.Files, err = m.readFiles(m.fsys, dbt); err != nil {
+		return 0, errors.Wrap(err, "get migrations")
+	}
+	v, exists, err := db.GetMetaVersion(ctx)
+	switch {
+	case err != nil:
+		return 0, errors.Wrap(err, "get meta version")
+	case !exists:
+		return 0, nil
+	case v > version:
+		return 0, &ErrVersionTooNew{Have: v, Want: version}
+	case v < version:
+		return 0, &ErrUpgradeRequired{Have: v, Want: version}
+	}
+
+	ctx, release, err := m.lock(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	ms, err := db.GetMigrations(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "get migrations")
+	}
+	normalizeFilenames(ms)
+	algo := m.checksumAlgo()
+	index := m.fileIndexes()
+	var n int
+	for _, mg := range ms {
+		j, ok := index[mg.Filename]
+		if !ok || (mg.Status != StatusApplied && mg.Status != StatusSkipped) {
+			continue
+		}
+		byt, err := fs.ReadFile(m.fsys, m.Files[j].fullpath)
+		if err != nil {
+			return n, err
+		}
+
+		// Those recorded by algo are rehashed only if they match as
+		// legacy, to record them with normalized line endings
+		if recordedAlgo(mg) == algo {
+			match, legacy, err := recordedMatch(mg, byt)
+			if err != nil {
+				return n, err
+			}
+			if !match || !legacy {
+				continue
+			}
+		}
+		match, err := rehashMatches(mg, byt, algo)
+		if err != nil {
+			return n, err
+		}
+		if !match {
+			m.log.Printf("%s doesn't match its checksum, so it's left as is\n",
+				mg.Filename)
+			continue
+		}
+
+		// GetMigrations leaves out the down migration, which upserting
+		// the row would clear
+		row, err := db.GetMigrationWithDown(ctx, mg.Filename)
+		if err != nil {
+			return n, errors.Wrap(err, "get migration")
+		}
+		row.Checksum, err = fileChecksumOf(algo, byt)
+		if err != nil {
+			return n, err
+		}
+		row.ChecksumAlgo = algo
+		row.Content = string(normalizeLineEndings([]byte(row.Content)))
+		if err = db.UpsertMigration(ctx, row); err != nil {
+			return n, errors.Wrap(err, "upsert migration")
+		}
+		n++
+	}
+	return n, nil
+}
+
+// rehashMatches reports whether the file content byt is the migration mg
+// recorded, so it may be rehashed by algo: either it matches mg as
+// recordedMatch reports, or mg's content, unchanged since it was recorded, has
+// the same checksum by algo, as reformatting leaves it with a normalized
+// algorithm.
+func rehashMatches(mg Migration, byt []byte, algo string) (bool, error) {
+	match, _, err := recordedMatch(mg, byt)
+	if err != nil || match {
+		return match, err
+	}
+	intact, _, err := recordedMatch(mg, []byte(mg.Content))
+	if err != nil || !intact {
+		return false, err
+	}
+	want, err := fileChecksumOf(algo, []byte(mg.Content))
+	if err != nil {
+		return false, err
+	}
+	got, err := fileChecksumOf(algo, byt)
+	return got == want, err
+}
+
+// utf8BOM is the byte order mark some Windows editors start files with.
+const utf8BOM = "\xef\xbb\xbf"
+
+// normalizeLineEndings returns byt without a leading byte order mark and with
+// CRLF line endings as LF, so converting a file's line endings, such as by
+// git's autocrlf, changes neither its checksum nor its statements.
+func normalizeLineEndings(byt []byte) []byte {
+	byt = bytes.TrimPrefix(byt, []byte(utf8BOM))
+	if !bytes.Contains(byt, []byte("\r\n")) {
+		return byt
+	}
+	return bytes.ReplaceAll(byt, []byte("\r\n"), []byte("\n"))
+}
+
+// recordedMatch reports whether byt, a migration file's content, matches the
+// migration mg recorded. It matches if its checksum by fileChecksumOf is mg's,
+// or if mg was recorded before tails were trimmed and either the whole of byt
+// with normalized line endings has mg's checksum, or mg's content has it and
+// is the same but for its tail. It matches as legacy if only the checksum of
+// byt as it is is mg's, or if mg's content is the same only once its line
+// endings are normalized. Legacy migrations were recorded before line endings
+// were normalized, with CRLF endings or a byte order mark as they were then.
+func recordedMatch(mg Migration, byt []byte) (match, legacy bool, err error) {
+	algo := recordedAlgo(mg)
+	check, err := fileChecksumOf(algo, byt)
+	if err != nil {
+		return false, false, err
+	}
+	if check == mg.Checksum {
+		return true, false, nil
+	}
+	clean := normalizeLineEndings(byt)
+	if whole, _ := checksumOf(algo, clean); whole == mg.Checksum {
+		return true, false, nil
+	}
+	if raw, _ := checksumOf(algo, byt); raw == mg.Checksum {
+		return true, true, nil
+	}
+	content := []byte(mg.Content)
+	if recorded, _ := checksumOf(algo, content); recorded != mg.Checksum {
+		return false, false, nil
+	}
+	cleanContent := normalizeLineEndings(content)
+	if !bytes.Equal(trimTail(cleanContent), trimTail(clean)) {
+		return false, false, nil
+	}
+	return true, !bytes.Equal(cleanContent, content), nil
+}
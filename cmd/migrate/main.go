@@ -1,54 +1,155 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 
 	"github.com/pkg/errors"
 	"github.com/thankful-ai/migrate"
+	"github.com/thankful-ai/migrate/cockroach"
+	"github.com/thankful-ai/migrate/mssql"
 	"github.com/thankful-ai/migrate/mysql"
+	"github.com/thankful-ai/migrate/oracle"
 	"github.com/thankful-ai/migrate/postgres"
+	"github.com/thankful-ai/migrate/snowflake"
+	"github.com/thankful-ai/migrate/spanner"
 	"github.com/thankful-ai/migrate/sqlite"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
+// exitStopped is the exit code after a signal stops the migration between
+// statements, which may be resumed by running migrate again.
+const exitStopped = 3
+
+// exitUnverified is the exit code after -verify finds an applied migration
+// modified or one partially applied, such as to fail a ci build.
+const exitUnverified = 4
+
+// errUnverified is returned after -verify finds a problem, which it's printed.
+var errUnverified = errors.New("verify failed")
+
 func main() {
 	if err := run(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
+		var mismatch *migrate.ErrChecksumMismatch
+		if errors.As(err, &mismatch) {
+			fmt.Fprint(os.Stderr, mismatch.Diff())
+		}
+		if errors.Is(err, migrate.ErrStopped) {
+			os.Exit(exitStopped)
+		}
+		if errors.Is(err, errUnverified) {
+			os.Exit(exitUnverified)
+		}
 		os.Exit(1)
 	}
 }
 
 func run() error {
-	migrationDir := flag.String("dir", ".", "migrations directory")
-	dbName := flag.String("db", "", "database name")
+	migrationDir := flag.String("dir", ".", "migrations directory, or a comma-separated list of directories to merge")
+	dbName := flag.String("db", "", "database name (service name for oracle, projects/P/instances/I/databases/D for spanner, a dsn for snowflake)")
 	dbUser := flag.String("u", "", "database user")
-	dbHost := flag.String("h", "127.0.0.1", "database host")
+	dbHost := flag.String("h", "127.0.0.1", "database host (or a unix socket path beginning with / for mysql)")
 	dbPort := flag.Int("p", 0, "database port")
-	dbType := flag.String("t", "mysql", "type of database (mysql, mariadb, postgres, sqlite)")
-	dry := flag.Bool("d", false, "dry run")
+	dbType := flag.String("t", "mysql", "type of database (mysql, mariadb, tidb, postgres, cockroach, mssql, oracle, spanner, snowflake, sqlite)")
+	dry := flag.Bool("d", false, "dry run: print what would run, with -down, -down-to or neither, after reading and checking everything the run would, without running or recording anything")
+	planJSON := flag.Bool("json", false, "with -d, print the plan as JSON")
 	sslKey := flag.String("ssl-key", "", "path to client key pem")
 	sslCert := flag.String("ssl-cert", "", "path to client cert pem")
 	sslCA := flag.String("ssl-ca", "", "path to server ca pem")
 	sslServerName := flag.String("ssl-server", "", "server name for ssl")
+	sslMode := flag.String("ssl-mode", "", "ssl mode for postgres and cockroach (disable, require, verify-ca, verify-full) or mssql (disable, false, true, strict)")
+	sslWallet := flag.String("ssl-wallet", "", "path to oracle wallet directory for tls")
+	sslCloudSQL := flag.Bool("ssl-cloudsql", false, "verify the certificate's common name rather than hostname, as cloud sql requires (mysql)")
 	skip := flag.String("skip", "", "skip up to this filename (inclusive)")
+	upTo := flag.String("to", "", "apply the pending migrations only up to and including this one, such as 0042_add_orders.sql, leaving those after it pending")
+	steps := flag.Int("steps", 0, "apply at most the next N pending migrations, such as 1 to apply one at a time, or roll back the last -N if negative as -down does, then exit")
+	timeout := flag.Duration("timeout", 0, "limit how long each statement may run, such as 10m, which files may override with -- migrate:timeout")
+	warnings := flag.Bool("warnings", false, "log warnings from each statement (mysql)")
+	strictWarnings := flag.Bool("strict-warnings", false, "stop on any warning, before recording the file as applied (mysql)")
+	tablePrefix := flag.String("table-prefix", "", "prefix for the names of the meta tables, so several services can share a database, such as billing_ (mysql)")
+	metaDB := flag.String("meta-db", "", "keep the meta tables in this database rather than the one being migrated (mysql)")
+	wait := flag.Duration("wait", 0, "wait up to this long for the database to accept connections, such as 1m (mysql)")
+	upgrade := flag.Bool("upgrade", false, "upgrade the meta tables of an existing database, after which older versions of migrate can't run")
+	appVersion := flag.String("app-version", "", "release of the application being deployed, such as v1.42.0+sha.abc123, recorded with each migration")
+	lockWait := flag.Duration("lock-wait", 0, "wait up to this long for another migrate to release its lock on the database, such as 5m, instead of failing at once. exits once the other has applied every file")
+	lockPoll := flag.Duration("lock-poll", migrate.DefaultLockPoll, "with -lock-wait, how often to try the lock and check whether the other migrate has finished")
+	lockStale := flag.Duration("lock-stale", migrate.DefaultLockStaleAfter, "take over a lock whose holder hasn't sent a heartbeat for this long, which must exceed the heartbeat of "+migrate.DefaultLockHeartbeat.String())
+	noLock := flag.Bool("no-lock", false, "take no lock on the database, when nothing else can migrate it at the same time, such as from a single ci job")
+	status := flag.Bool("status", false, "print which files are applied and pending without writing to the database, such as on a read replica, then exit")
+	verify := flag.Bool("verify", false, "check every applied migration still matches its file, and none is partially applied, without writing to the database, then exit. exits with 4 if any doesn't")
+	lockStatus := flag.Bool("lock-status", false, "print which migrate holds the lock on the database, if any, then exit")
+	forceUnlock := flag.Bool("force-unlock", false, "delete the lock left by a migrate which died, then exit. refuses if the holder sent a heartbeat recently, unless -force is set")
+	force := flag.Bool("force", false, "with -force-unlock, delete the lock even if its holder seems alive. with -repair, record files which change more than comments and whitespace")
+	allowOutOfOrder := flag.Bool("allow-out-of-order", false, "apply pending files which sort before the last applied, such as one merged late from a branch")
+	resume := flag.Bool("resume", false, "run a migration file again from its checkpoints after its last run failed")
+	oneFile := flag.String("file", "", "apply only this migration file, or - to read it from stdin, such as a hotfix, without reading -dir")
+	oneName := flag.String("name", "", "with -file, the filename to record the migration as, such as 0042_hotfix.sql. required with -file -")
+	ordering := flag.String("ordering", "numeric", "order to run files in: by the number they start with (numeric), requiring it be a timestamp like 20240611153000 (timestamp), or by their names byte by byte (lexicographic)")
+	gaps := flag.String("gaps", "allow", "what to do about gaps between sequence numbers, such as 0016_x.sql followed by 0018_y.sql (allow, warn, error)")
+	validate := flag.Bool("validate", false, "check the numbering of the migrations in -dir without connecting to a database, such as in ci, then exit")
+	subdirs := flag.Bool("subdirs", false, "read migrations from subdirectories of -dir too, such as 2024/0042_x.sql, recorded by their paths and run in order of their names")
+	renameMoved := flag.Bool("rename-moved", false, "with -subdirs, record an applied migration moved to another subdirectory by its new path rather than refusing to run")
+	env := flag.String("env", "", "the environment to run, such as staging: files tagged for another, like 0031_seed.production.sql, are left out")
+	envs := flag.String("envs", "", "comma-separated environments files may be tagged for, refusing any other, such as staging,production")
+	ignore := flag.String("ignore", "", "comma-separated patterns of files in -dir to ignore, as if added to its .migrateignore, such as notes/,*.bak")
+	strictFiles := flag.Bool("strict-files", false, "refuse files in -dir which aren't migrations, such as README.md, unless they're ignored")
+	debug := flag.Bool("debug", false, "with -status, also list the files .migrateignore and -ignore leave out")
+	allowRename := flag.Bool("allow-rename", false, "record an applied migration whose file was renamed, such as 12.sql to 0012_create_orders.sql, by its new name, matching them by checksum")
+	noMixedNumbering := flag.Bool("no-mixed-numbering", false, "refuse migrations numbered both sequentially, such as 0042_x.sql, and by timestamp, such as 20240611153000_y.sql")
+	checksum := flag.String("checksum", migrate.ChecksumSHA256, "algorithm to record the checksums of migrations with (sha256, md5). those recorded already are checked with their own")
+	normalizeChecksums := flag.Bool("normalize-checksums", false, "checksum migrations without their comments and with whitespace outside quotes collapsed, so reformatting a file doesn't change its checksum")
+	diffLines := flag.Int("diff-lines", migrate.DefaultDiffLines, "most lines of the diff printed when a file doesn't match its checksum, or 0 for none")
+	modified := flag.String("modified", "error", "what to do about an applied migration whose file was modified (error, warn to log it and continue, update-checksum to record the file again)")
+	production := flag.Bool("production", false, "flag the database as production, where -modified update-checksum and -auto-rollback are refused")
+	autoRollback := flag.Bool("auto-rollback", false, "roll back a migration which fails by running its .down.sql file, if it has one, and deleting it from meta, such as in CI. never use it in production")
+	rehash := flag.Bool("rehash", false, "record again the checksums of applied migrations recorded with another algorithm than -checksum, such as md5, where their files are unchanged, then exit")
+	clearCheckpoints := flag.String("clear-checkpoints", "", "delete the checkpoints of this migration file, which stopped partway, so -resume runs it from its first statement, such as after editing a statement which had run or recovering one whose auto-rollback failed, then exit")
+	rerun := flag.String("rerun", "", "run this applied migration file again, changed or not, such as one creating views, then record its checksum and exit")
+	down := flag.Int("down", 0, "roll back the last N applied migrations by running their .down.sql files, the latest first, and deleting them from meta, then exit")
+	fromStore := flag.Bool("from-store", false, "with -down, run the down migrations recorded in meta when each was applied rather than those in -dir, which isn't read")
+	downTo := flag.String("down-to", "", "roll back every migration applied after this one, as -down does, so it's left the latest applied, then exit. after a failure, run it again to roll back the rest")
+	verifyReversible := flag.Bool("verify-reversible", false, "for CI against a scratch database: apply the pending migrations, roll them back by their .down.sql files, and apply them again, failing if any step fails or differs, then print how long each step took and exit. refused with -production")
+	redo := flag.Bool("redo", false, "roll back the latest applied migration by its .down.sql file, then apply its file again, such as after editing it in development, then exit. refuses if any other file is pending")
+	genDown := flag.String("gen-down", "", "write a best-effort .down.sql beside this migration file, such as migrations/0042_add_users.sql, inverting the statements it can as -t writes them and leaving the rest as TODO comments to replace, then exit. refuses to overwrite one")
+	repair := flag.Bool("repair", false, "record again the checksums and content of the applied migrations named as arguments, or of every one whose file no longer matches if none are, after printing their diffs, then exit. refuses files which change more than comments and whitespace, unless -force is set")
+	transactions := flag.Bool("transactions", false, "run the statements of each file in one transaction, as if it started with -- migrate:transaction, other than -- migrate:multi files. mysql refuses files with statements which commit implicitly, such as most ddl")
+	verboseHistory := flag.Bool("verbose-history", false, "record every statement attempted in metahistory, not only each file")
 	pass := flag.String("pass", "", "password (optional flag, if not provided it will be requested)")
 	version := flag.Bool("v", false, "print the version and exit")
 	flag.Parse()
+	var stepsSet bool
+	flag.Visit(func(f *flag.Flag) { stepsSet = stepsSet || f.Name == "steps" })
 
 	if *version {
-		fmt.Println("v1.0.0rc5")
+		fmt.Println(migrate.ToolVersion)
 		return nil
 	}
+	if *genDown != "" {
+		// Writing the file needs to happen before restricting access to
+		// files below
+		return generateDown(*genDown, migrate.DBType(*dbType))
+	}
 
 	// Restrict this program to specific files (read-only) and greatly
 	// restrict its possible syscalls
-	paths := []string{*migrationDir}
-	if *sslKey != "" {
-		paths = append(paths, *sslKey, *sslCert, *sslCA)
-		fmt.Println(paths)
+	dirs := strings.Split(*migrationDir, ",")
+	paths := append([]string{}, dirs...)
+	if *oneFile != "" && *oneFile != "-" {
+		paths = append(paths, *oneFile)
+	}
+	for _, p := range []string{*sslKey, *sslCert, *sslCA, *sslWallet} {
+		if p != "" {
+			paths = append(paths, p)
+		}
 	}
 	if err := migrate.Unveil(paths); err != nil {
 		return errors.Wrap(err, "unveil")
@@ -57,12 +158,95 @@ func run() error {
 		return errors.Wrap(err, "pledge")
 	}
 
+	var fileOpts []migrate.Option
+	switch *ordering {
+	case "numeric":
+	case "timestamp":
+		fileOpts = append(fileOpts, migrate.WithOrdering(migrate.Timestamp{}))
+	case "lexicographic":
+		fileOpts = append(fileOpts,
+			migrate.WithOrdering(migrate.Lexicographic{}))
+	default:
+		return fmt.Errorf("unknown -ordering %s, which must be numeric, timestamp or lexicographic",
+			*ordering)
+	}
+	switch *gaps {
+	case "allow":
+	case "warn":
+		fileOpts = append(fileOpts, migrate.WithGapPolicy(migrate.GapsWarn))
+	case "error":
+		fileOpts = append(fileOpts,
+			migrate.WithGapPolicy(migrate.GapsRefused))
+	default:
+		return fmt.Errorf("unknown -gaps %s, which must be allow, warn or error",
+			*gaps)
+	}
+	if *noMixedNumbering {
+		fileOpts = append(fileOpts, migrate.WithoutMixedNumbering())
+	}
+	var modifiedPolicy migrate.ModifiedPolicy
+	switch *modified {
+	case "error":
+	case "warn":
+		modifiedPolicy = migrate.ModifiedWarn
+	case "update-checksum":
+		modifiedPolicy = migrate.ModifiedUpdateChecksum
+	default:
+		return fmt.Errorf("unknown -modified %s, which must be error, warn or update-checksum",
+			*modified)
+	}
+	if *subdirs {
+		fileOpts = append(fileOpts, migrate.WithSubdirectories())
+	}
+	if *renameMoved {
+		fileOpts = append(fileOpts, migrate.WithRenameMoved())
+	}
+	if *allowRename {
+		fileOpts = append(fileOpts, migrate.WithAllowRename())
+	}
+	if *env != "" {
+		fileOpts = append(fileOpts, migrate.WithEnvironment(*env))
+	}
+	if *envs != "" {
+		fileOpts = append(fileOpts,
+			migrate.WithEnvironments(strings.Split(*envs, ",")...))
+	}
+	if *ignore != "" {
+		fileOpts = append(fileOpts,
+			migrate.WithIgnore(strings.Split(*ignore, ",")...))
+	}
+	if *strictFiles {
+		fileOpts = append(fileOpts, migrate.WithStrictFiles())
+	}
+	if *validate {
+		fsys, err := migrate.MergeDirs(dirs...)
+		if err != nil {
+			return err
+		}
+		if err = migrate.ValidateFS(fsys, fileOpts...); err != nil {
+			return err
+		}
+		fmt.Println("valid")
+		return nil
+	}
+
 	if len(*dbName) == 0 {
 		return errors.New("database name cannot be empty. specify using the -db flag. run `migrate -h` for help")
 	}
 	if *dry && *skip != "" {
 		return errors.New("cannot skip ahead with dry mode")
 	}
+	if *sslCloudSQL && *dbType != "mysql" && *dbType != "mariadb" {
+		return errors.New("-ssl-cloudsql only applies to mysql")
+	}
+	if (*warnings || *strictWarnings) && *dbType != "mysql" &&
+		*dbType != "mariadb" && *dbType != "tidb" {
+		return errors.New("-warnings and -strict-warnings only apply to mysql")
+	}
+	if (*tablePrefix != "" || *metaDB != "") && *dbType != "mysql" &&
+		*dbType != "mariadb" && *dbType != "tidb" {
+		return errors.New("-table-prefix and -meta-db only apply to mysql")
+	}
 
 	// Validate flags for each type of database and set appropriate
 	// defaults
@@ -80,9 +264,31 @@ func run() error {
 		if *pass != "" {
 			return errors.New("sqlite does not support the -pass flag")
 		}
-		if *sslKey != "" || *sslCert != "" || *sslCA != "" || *sslServerName != "" {
+		if *sslKey != "" || *sslCert != "" || *sslCA != "" || *sslServerName != "" || *sslMode != "" {
 			return errors.New("sqlite does not support ssl")
 		}
+	case "spanner":
+		if *dbUser != "" || *pass != "" {
+			return errors.New("spanner uses application default credentials, not -u or -pass")
+		}
+		if *dbHost != "127.0.0.1" || *dbPort != 0 {
+			return errors.New("spanner does not support the -h or -p flags")
+		}
+		if *sslKey != "" || *sslCert != "" || *sslCA != "" || *sslServerName != "" || *sslMode != "" {
+			return errors.New("spanner does not support ssl flags")
+		}
+	case "snowflake":
+		// Snowflake is configured entirely through its DSN, including
+		// session parameters such as QUERY_TAG
+		if *dbUser != "" || *pass != "" {
+			return errors.New("snowflake takes credentials in the -db dsn, not -u or -pass")
+		}
+		if *dbHost != "127.0.0.1" || *dbPort != 0 {
+			return errors.New("snowflake does not support the -h or -p flags")
+		}
+		if *sslKey != "" || *sslCert != "" || *sslCA != "" || *sslServerName != "" || *sslMode != "" {
+			return errors.New("snowflake does not support ssl flags")
+		}
 	case "postgres":
 		if *dbUser == "" {
 			*dbUser = "postgres"
@@ -90,21 +296,57 @@ func run() error {
 		if *dbPort == 0 {
 			*dbPort = 5432
 		}
-	case "mysql", "mariadb":
+	case "cockroach":
+		if *dbUser == "" {
+			*dbUser = "root"
+		}
+		if *dbPort == 0 {
+			*dbPort = 26257
+		}
+	case "mssql":
+		if *sslKey != "" || *sslCert != "" {
+			return errors.New("mssql does not support client certs")
+		}
+		if *dbUser == "" {
+			*dbUser = "sa"
+		}
+		if *dbPort == 0 {
+			*dbPort = 1433
+		}
+	case "oracle":
+		if *sslKey != "" || *sslCert != "" || *sslCA != "" || *sslServerName != "" || *sslMode != "" {
+			return errors.New("oracle does not support ssl flags, use -ssl-wallet")
+		}
+		if *dbUser == "" {
+			return errors.New("oracle requires the -u flag")
+		}
+		if *dbPort == 0 {
+			*dbPort = 1521
+		}
+	case "mysql", "mariadb", "tidb":
+		if *sslMode != "" {
+			return errors.New("mysql does not support the -ssl-mode flag")
+		}
 		if *dbUser == "" {
 			*dbUser = "root"
 		}
 		if *dbPort == 0 {
 			*dbPort = 3306
+			if *dbType == "tidb" {
+				*dbPort = 4000
+			}
 		}
 	default:
-		return fmt.Errorf("unknown db type %q (mysql, postgres, sqlite allowed)", *dbType)
+		return fmt.Errorf("unknown db type %q (mysql, mariadb, tidb, postgres, cockroach, mssql, oracle, spanner, snowflake, sqlite allowed)", *dbType)
 	}
 
 	// Request database password if not provided as a flag argument
 	var password []byte
-	if *dbType != "sqlite" {
+	if *dbType != "sqlite" && *dbType != "spanner" && *dbType != "snowflake" {
 		if len(*pass) == 0 {
+			if *oneFile == "-" {
+				return errors.New("-file - reads the migration from stdin, so give the password with -pass")
+			}
 			fmt.Printf("%s database password: ", *dbName)
 			var err error
 			password, err = terminal.ReadPassword(int(syscall.Stdin))
@@ -122,26 +364,120 @@ func run() error {
 	switch *dbType {
 	case "mysql", "mariadb":
 		var err error
-		db, err = mysql.New(*dbUser, string(password), *dbHost,
-			*dbName, *dbPort, *sslKey, *sslCert, *sslCA,
-			*sslServerName)
+		if *sslKey != "" || *sslCert != "" || *sslCA != "" ||
+			*sslServerName != "" || *sslCloudSQL {
+			db, err = mysql.NewWithTLS(*dbUser, string(password),
+				*dbHost, *dbName, *dbPort, mysql.TLSOptions{
+					CAFile:         *sslCA,
+					ClientCertFile: *sslCert,
+					ClientKeyFile:  *sslKey,
+					ServerName:     *sslServerName,
+					CloudSQL:       *sslCloudSQL,
+				}, mysql.WithMultiStatements())
+		} else {
+			db, err = mysql.New(*dbUser, string(password), *dbHost,
+				*dbName, *dbPort, "", "", "", "",
+				mysql.WithMultiStatements())
+		}
 		if err != nil {
 			return errors.Wrap(err, "mysql new")
 		}
+	case "tidb":
+		var err error
+		db, err = mysql.NewTiDB(*dbUser, string(password), *dbHost,
+			*dbName, *dbPort, *sslKey, *sslCert, *sslCA,
+			*sslServerName, mysql.WithMultiStatements())
+		if err != nil {
+			return errors.Wrap(err, "tidb new")
+		}
 	case "sqlite":
 		db = sqlite.New(*dbName)
+	case "spanner":
+		var project, instance, database string
+		_, err := fmt.Sscanf(strings.ReplaceAll(*dbName, "/", " "),
+			"projects %s instances %s databases %s", &project,
+			&instance, &database)
+		if err != nil {
+			return fmt.Errorf("spanner -db must look like projects/P/instances/I/databases/D: %w", err)
+		}
+		db = spanner.New(project, instance, database, 0)
+	case "snowflake":
+		var err error
+		db, err = snowflake.New(*dbName, nil)
+		if err != nil {
+			return errors.Wrap(err, "snowflake new")
+		}
 	case "postgres":
-		db = postgres.New(*dbUser, string(password), *dbHost, *dbName,
-			*dbPort, *sslKey, *sslCert, *sslCA)
+		var err error
+		db, err = postgres.New(*dbUser, string(password), *dbHost,
+			*dbName, *dbPort, *sslMode, *sslKey, *sslCert, *sslCA)
+		if err != nil {
+			return errors.Wrap(err, "postgres new")
+		}
+	case "cockroach":
+		var err error
+		db, err = cockroach.New(*dbUser, string(password), *dbHost,
+			*dbName, *dbPort, *sslMode, *sslKey, *sslCert, *sslCA)
+		if err != nil {
+			return errors.Wrap(err, "cockroach new")
+		}
+	case "oracle":
+		db = oracle.New(*dbUser, string(password), *dbHost, *dbName,
+			*dbPort, *sslWallet)
+	case "mssql":
+		var err error
+		db, err = mssql.New(*dbUser, string(password), *dbHost,
+			*dbName, *dbPort, *sslMode, *sslCA, *sslServerName)
+		if err != nil {
+			return errors.Wrap(err, "mssql new")
+		}
 	default:
 		return fmt.Errorf("unknown db type: %s", *dbType)
 	}
-	if *sslKey != "" {
+	if mdb, ok := db.(*mysql.DB); ok {
+		mdb.SetWarnings(*warnings || *strictWarnings)
+		if err := mdb.SetTablePrefix(*tablePrefix); err != nil {
+			return err
+		}
+		if err := mdb.SetMetaDatabase(*metaDB); err != nil {
+			return err
+		}
+	}
+	if *sslKey != "" || *sslCA != "" || *sslWallet != "" {
 		fmt.Println("using tls")
 	}
-	if err := db.Open(); err != nil {
+	ctx := context.Background()
+	if *wait > 0 {
+		err := migrate.WaitForStore(ctx, db, migrate.StdLogger{}, *wait)
+		if err != nil {
+			return errors.Wrap(err, "open")
+		}
+	} else if err := db.Open(ctx); err != nil {
 		return errors.Wrap(err, "open")
 	}
+	if *lockStatus {
+		info, err := migrate.LockStatus(ctx, db)
+		if err != nil {
+			return err
+		}
+		printLock(info)
+		return nil
+	}
+	if *clearCheckpoints != "" {
+		err := migrate.ClearCheckpoints(ctx, db, *clearCheckpoints)
+		if err != nil {
+			return err
+		}
+		fmt.Println("cleared the checkpoints of", *clearCheckpoints)
+		return nil
+	}
+	if *forceUnlock {
+		if err := migrate.ForceUnlock(ctx, db, *force); err != nil {
+			return err
+		}
+		fmt.Println("unlocked")
+		return nil
+	}
 
 	var dbt migrate.DBType
 	switch *dbType {
@@ -149,8 +485,20 @@ func run() error {
 		dbt = migrate.DBTypeMySQL
 	case "mariadb":
 		dbt = migrate.DBTypeMariaDB
+	case "tidb":
+		dbt = migrate.DBTypeTiDB
 	case "postgres":
 		dbt = migrate.DBTypePostgres
+	case "cockroach":
+		dbt = migrate.DBTypeCockroach
+	case "mssql":
+		dbt = migrate.DBTypeMSSQL
+	case "oracle":
+		dbt = migrate.DBTypeOracle
+	case "spanner":
+		dbt = migrate.DBTypeSpanner
+	case "snowflake":
+		dbt = migrate.DBTypeSnowflake
 	case "sqlite":
 		dbt = migrate.DBTypeSQLite
 	default:
@@ -158,25 +506,234 @@ func run() error {
 	}
 
 	// Prepare our database for migrations and collect the relevant files.
-	m, err := migrate.New(db, migrate.StdLogger{}, dbt, *migrationDir,
-		*skip)
+	opts := []migrate.Option{
+		migrate.WithStatementTimeout(*timeout),
+		migrate.WithLockWait(*lockWait, *lockPoll),
+		migrate.WithLockLease(migrate.DefaultLockHeartbeat, *lockStale),
+	}
+	if *strictWarnings {
+		opts = append(opts, migrate.WithStrictWarnings())
+	}
+	if *appVersion != "" {
+		opts = append(opts, migrate.WithAppVersion(*appVersion))
+	}
+	if *resume {
+		opts = append(opts, migrate.WithResume())
+	}
+	if *allowOutOfOrder {
+		opts = append(opts, migrate.WithAllowOutOfOrder())
+	}
+	if *verboseHistory {
+		opts = append(opts, migrate.WithVerboseHistory())
+	}
+	if *transactions {
+		opts = append(opts, migrate.WithTransactions())
+	}
+	if *upgrade {
+		opts = append(opts, migrate.WithUpgrade())
+	}
+	if *noLock {
+		opts = append(opts, migrate.WithoutLocking())
+	}
+	opts = append(opts, migrate.WithChecksumAlgo(*checksum),
+		migrate.WithDiffLines(*diffLines),
+		migrate.WithModifiedPolicy(modifiedPolicy))
+	if *autoRollback {
+		opts = append(opts, migrate.WithAutoRollbackOnFailure())
+	}
+	if *production {
+		opts = append(opts, migrate.WithProduction())
+	}
+	if *normalizeChecksums {
+		opts = append(opts, migrate.WithNormalizedChecksums())
+	}
+	opts = append(opts, fileOpts...)
+	plan := &migrate.Plan{}
+	if *dry {
+		opts = append(opts, migrate.WithDryRun(plan))
+	}
+	if *upTo != "" {
+		opts = append(opts, migrate.WithUpTo(*upTo))
+	}
+
+	if *oneFile != "" {
+		if *dry || *status || *skip != "" {
+			return errors.New("-file can't be used with -d, -status or -skip")
+		}
+		return applyOne(ctx, db, *oneFile, *oneName, opts)
+	}
+	if *fromStore {
+		if *down == 0 {
+			return errors.New("-from-store can only be used with -down")
+		}
+		n, err := migrate.DownFromStore(ctx, db, migrate.StdLogger{},
+			*down, opts...)
+		if err != nil {
+			return err
+		}
+		if *dry {
+			return printPlan(plan, *planJSON)
+		}
+		fmt.Printf("rolled back %d migrations\n", n)
+		return nil
+	}
+
+	fsys, err := migrate.MergeDirs(dirs...)
 	if err != nil {
 		return err
 	}
-	if *dry {
-		if len(m.Migrations) == len(m.Files) {
-			fmt.Println("up to date")
-			return nil
+	if *rehash {
+		n, err := migrate.RehashChecksumsFS(ctx, db, migrate.StdLogger{},
+			dbt, fsys, opts...)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("rehashed %d checksums\n", n)
+		return nil
+	}
+	if *rerun != "" {
+		return migrate.RerunFS(ctx, db, migrate.StdLogger{}, dbt, fsys,
+			*rerun, opts...)
+	}
+	if *down != 0 && *downTo != "" {
+		return errors.New("-down and -down-to can't be used together")
+	}
+	if *upTo != "" && (*down != 0 || *downTo != "" || *redo) {
+		return errors.New("-to can't be used with -down, -down-to or -redo")
+	}
+	if stepsSet && (*down != 0 || *downTo != "" || *redo) {
+		return errors.New("-steps can't be used with -down, -down-to or -redo")
+	}
+	if *downTo != "" {
+		n, err := migrate.DownToFS(ctx, db, migrate.StdLogger{}, dbt,
+			fsys, *downTo, opts...)
+		if err != nil {
+			return err
+		}
+		if *dry {
+			return printPlan(plan, *planJSON)
+		}
+		fmt.Printf("rolled back %d migrations\n", n)
+		return nil
+	}
+	if *verifyReversible {
+		report, err := migrate.VerifyReversibleFS(ctx, db,
+			migrate.StdLogger{}, dbt, fsys, opts...)
+		if report != nil {
+			for _, f := range report.Files {
+				fmt.Printf("%s: up %s, down %s, up again %s\n", f.Filename,
+					f.Up, f.Down, f.UpAgain)
+			}
+		}
+		return err
+	}
+	if *redo {
+		return migrate.RedoFS(ctx, db, migrate.StdLogger{}, dbt, fsys,
+			opts...)
+	}
+	if stepsSet {
+		n, err := migrate.StepsFS(ctx, db, migrate.StdLogger{}, dbt, fsys,
+			*steps, opts...)
+		if err != nil {
+			return err
 		}
-		for i := len(m.Migrations); i < len(m.Files); i++ {
-			fmt.Println("would migrate", m.Files[i].Info.Name())
+		if *dry {
+			return printPlan(plan, *planJSON)
+		}
+		if *steps < 0 {
+			fmt.Printf("rolled back %d migrations\n", n)
+		} else {
+			fmt.Printf("applied %d migrations\n", n)
 		}
 		return nil
 	}
-	migrated, err := m.Migrate()
+	if *down != 0 {
+		n, err := migrate.DownFS(ctx, db, migrate.StdLogger{}, dbt, fsys,
+			*down, opts...)
+		if err != nil {
+			return err
+		}
+		if *dry {
+			return printPlan(plan, *planJSON)
+		}
+		fmt.Printf("rolled back %d migrations\n", n)
+		return nil
+	}
+	if *repair {
+		if *force {
+			opts = append(opts, migrate.WithForceRepair())
+		}
+		n, err := migrate.RepairFS(ctx, db, migrate.StdLogger{}, dbt,
+			fsys, flag.Args(), opts...)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("repaired %d migrations\n", n)
+		return nil
+	}
+	if *verify {
+		report, err := migrate.VerifyFS(ctx, db, dbt, fsys, opts...)
+		if err != nil {
+			return err
+		}
+		printVerify(report)
+		if !report.OK {
+			return errUnverified
+		}
+		return nil
+	}
+	if *status {
+		report, err := migrate.StatusFS(ctx, db, dbt, fsys, opts...)
+		if err != nil {
+			return err
+		}
+		printStatus(report, *debug)
+		return nil
+	}
+
+	m, err := migrate.NewFS(ctx, db, migrate.StdLogger{}, dbt, fsys, *skip,
+		opts...)
 	if err != nil {
 		return err
 	}
+	if *dry {
+		if !*noLock {
+			info, err := migrate.LockStatus(ctx, db)
+			if err != nil {
+				return err
+			}
+			if info != nil {
+				printLock(info)
+			}
+		}
+		if _, err = m.Migrate(ctx); err != nil {
+			return err
+		}
+		printModified(m.Modified)
+		return printPlan(plan, *planJSON)
+	}
+
+	// On the first signal, finish the statement in progress and record its
+	// checkpoint before exiting. A second signal aborts the statement.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		<-sigs
+		fmt.Fprintln(os.Stderr,
+			"stopping after the current statement. signal again to abort it")
+		m.Stop()
+		<-sigs
+		cancel()
+	}()
+
+	migrated, err := m.Migrate(ctx)
+	if err != nil {
+		return err
+	}
+	printModified(m.Modified)
 	if migrated {
 		fmt.Println("success")
 	} else {
@@ -184,3 +741,160 @@ func run() error {
 	}
 	return nil
 }
+
+// printPlan prints the plan of a dry run as a table, or as JSON if asJSON.
+// generateDown writes the down migration migrate.GenerateDown generates for
+// the migration at path, for dbt, beside it, listing the statements it
+// couldn't invert.
+func generateDown(path string, dbt migrate.DBType) error {
+	base := filepath.Base(path)
+	if !strings.HasSuffix(base, ".sql") || strings.HasSuffix(base, ".down.sql") {
+		return fmt.Errorf("%s isn't an up migration ending in .sql", path)
+	}
+	byt, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	down, err := migrate.GenerateDown(dbt, string(byt))
+	if err != nil {
+		return errors.Wrapf(err, "generate down for %s", base)
+	}
+	downPath := strings.TrimSuffix(path, ".sql") + ".down.sql"
+	f, err := os.OpenFile(downPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(down); err != nil {
+		_ = f.Close()
+		return errors.Wrapf(err, "write %s", downPath)
+	}
+	if err = f.Close(); err != nil {
+		return errors.Wrapf(err, "close %s", downPath)
+	}
+	fmt.Printf("wrote %s\n", downPath)
+	if n := strings.Count(down, "\n-- TODO: undo"); n > 0 {
+		fmt.Printf("couldn't invert %d of the statements: replace the TODO comments with what undoes them\n",
+			n)
+	}
+	return nil
+}
+
+func printPlan(plan *migrate.Plan, asJSON bool) error {
+	if !asJSON {
+		fmt.Print(plan)
+		return nil
+	}
+	byt, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(byt))
+	return nil
+}
+
+// printModified lists the modified migrations which -modified let migrate
+// continue past, with the policy, so the run's output records them.
+func printModified(modified []migrate.ModifiedFile) {
+	for _, mod := range modified {
+		fmt.Printf("modified %s (checksum %s, file %s) under -modified %s\n",
+			mod.Filename, mod.Stored, mod.Computed, mod.Policy)
+	}
+}
+
+// applyOne applies the migration at filename, or read from stdin if it's "-",
+// recording it as name, which defaults to the file's name. A signal aborts
+// the statement in progress.
+func applyOne(
+	ctx context.Context,
+	db migrate.Store,
+	filename, name string,
+	opts []migrate.Option,
+) error {
+	var r io.Reader = os.Stdin
+	if filename != "-" {
+		fi, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer fi.Close()
+		r = fi
+		if name == "" {
+			name = filepath.Base(filename)
+		}
+	}
+	if name == "" {
+		return errors.New("-name is required with -file -")
+	}
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	applied, err := migrate.ApplyOne(ctx, db, migrate.StdLogger{}, name, r,
+		opts...)
+	if err != nil {
+		return err
+	}
+	if applied {
+		fmt.Println("success")
+	} else {
+		fmt.Println("up to date")
+	}
+	return nil
+}
+
+// printStatus lists the files in the report from migrate.Status, and with
+// debug, those ignored.
+func printStatus(report *migrate.StatusReport, debug bool) {
+	fmt.Println(report)
+	if debug {
+		for _, f := range report.Ignored {
+			fmt.Println("ignored", f)
+		}
+	}
+	for _, f := range report.Mismatched {
+		fmt.Println("checksum mismatch", f)
+	}
+	for _, f := range report.Missing {
+		fmt.Println("missing", f)
+	}
+	late := make(map[string]bool, len(report.OutOfOrder))
+	for _, f := range report.OutOfOrder {
+		late[f] = true
+	}
+	for _, f := range report.Pending {
+		if late[f] {
+			fmt.Println("pending out of order", f)
+		} else {
+			fmt.Println("pending", f)
+		}
+	}
+}
+
+// printVerify lists the problems in the report from migrate.Verify.
+func printVerify(report *migrate.VerifyReport) {
+	fmt.Println(report)
+	for _, f := range report.Modified {
+		fmt.Printf("modified %s: %s %s recorded, %s now\n", f.Filename,
+			f.Algo, f.Stored, f.Computed)
+	}
+	for _, p := range report.PartiallyApplied {
+		fmt.Printf("partially applied %s: %d statements ran\n", p.Filename,
+			p.Checkpoints)
+	}
+	for _, f := range report.MissingOnDisk {
+		fmt.Println("missing", f)
+	}
+	for _, f := range report.MissingInDB {
+		fmt.Println("pending", f)
+	}
+}
+
+// printLock describes the lock reported by migrate.LockStatus.
+func printLock(info *migrate.LockInfo) {
+	if info == nil {
+		fmt.Println("not locked")
+		return
+	}
+	fmt.Println("locked by", info.MetaLock)
+	if info.Stale {
+		fmt.Println("the holder seems to have died. clear the lock with -force-unlock")
+	}
+}
@@ -0,0 +1,199 @@
+// Package cockroach implements a migrate.Store for CockroachDB. Cockroach
+// speaks the Postgres wire protocol, but it runs every transaction at
+// SERIALIZABLE isolation and asks clients to retry when transactions conflict,
+// and it won't run several schema changes inside one transaction. DB retries
+// its own statements which fail with a retryable serialization error, reports
+// the error as retryable for Migrate to retry those of migrations, and keeps
+// DDL out of explicit transactions.
+package cockroach
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/thankful-ai/migrate"
+	"github.com/thankful-ai/migrate/postgres"
+	"github.com/thankful-ai/migrate/sqlstore"
+)
+
+// errSerializationFailure is the SQLSTATE Cockroach reports when a
+// transaction conflicts with another and should be retried.
+const errSerializationFailure = pq.ErrorCode("40001")
+
+// maxRetries of a statement which failed with a serialization error. The
+// backoff between attempts doubles each time, starting at retryBackoff.
+const (
+	maxRetries   = 8
+	retryBackoff = 25 * time.Millisecond
+)
+
+type DB struct {
+	connURL string
+
+	// Embed the generic SQL store
+	*sqlstore.Store
+}
+
+// New prepares a connection to a CockroachDB cluster, taking the same
+// arguments as postgres.New.
+func New(
+	user, pass, host, dbName string,
+	port int,
+	sslMode, sslKey, sslCert, sslCA string,
+) (*DB, error) {
+	url, err := postgres.ConnURL(user, pass, host, dbName, port, sslMode,
+		sslKey, sslCert, sslCA)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{connURL: url}, nil
+}
+
+func (db *DB) Open(ctx context.Context) error {
+	var err error
+	db.Store, err = sqlstore.Open("postgres", db.connURL, Dialect{})
+	return err
+}
+
+// IsRetryable reports whether a statement failed with a serialization error,
+// so Migrate runs the statements of migrations again unless their file is
+// marked no-retry. The meta tables' statements are retried by the Dialect.
+func (db *DB) IsRetryable(err error) bool {
+	return postgres.IsError(err, errSerializationFailure)
+}
+
+// Dialect describes Cockroach's SQL to sqlstore. It shares most of its syntax
+// with Postgres.
+type Dialect struct {
+	postgres.Dialect
+}
+
+func (Dialect) Types() sqlstore.Types {
+	return sqlstore.Types{
+		String:    "STRING",
+		Text:      "STRING",
+		Integer:   "INT",
+		Timestamp: "TIMESTAMPTZ",
+		Now:       "now()",
+	}
+}
+
+// Retry fn with exponential backoff for as long as it fails with a
+// serialization error, up to maxRetries times or until ctx is done.
+func (Dialect) Retry(ctx context.Context, fn func() error) error {
+	return retry(ctx, fn)
+}
+
+// UpgradeToV1 migrates existing meta tables to the v1 format. Complete any
+// migrations before running this function; this will not succeed if have any
+// existing metacheckpoints.
+//
+// Cockroach rejects several schema changes in one transaction, so unlike the
+// other stores each step runs on its own and is written to be safe to re-run
+// if a previous upgrade failed partway through.
+func (Dialect) UpgradeToV1(
+	ctx context.Context,
+	db *sqlx.DB,
+	migrations []migrate.Migration,
+) error {
+	exec := func(q string) error {
+		return retry(ctx, func() error {
+			_, err := db.ExecContext(ctx, q)
+			return err
+		})
+	}
+
+	// Remove the uniqueness constraint from md5. Cockroach implements
+	// unique constraints as indexes, which must be dropped as such.
+	q := `DROP INDEX IF EXISTS meta@meta_md5_key CASCADE`
+	if err := exec(q); err != nil {
+		return errors.Wrap(err, "remove md5 unique")
+	}
+
+	// Add a content column to record the exact migration that ran
+	// alongside the md5, insert the appropriate data, then set not null
+	q = `ALTER TABLE meta ADD COLUMN IF NOT EXISTS content STRING`
+	if err := exec(q); err != nil {
+		return errors.Wrap(err, "add content column")
+	}
+	err := inTx(ctx, db, func(tx *sqlx.Tx) error {
+		for _, m := range migrations {
+			q := `UPDATE meta SET content=$1 WHERE filename=$2`
+			_, err := tx.ExecContext(ctx, q, m.Content, m.Filename)
+			if err != nil {
+				return errors.Wrap(err, "update meta content")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	q = `ALTER TABLE meta ALTER COLUMN content SET NOT NULL`
+	if err := exec(q); err != nil {
+		return errors.Wrap(err, "update meta content not null")
+	}
+
+	// Add the content column to metacheckpoints
+	q = `
+	ALTER TABLE metacheckpoints
+	ADD COLUMN IF NOT EXISTS content STRING NOT NULL`
+	if err := exec(q); err != nil {
+		return errors.Wrap(err, "add metacheckpoints content")
+	}
+
+	q = `CREATE TABLE IF NOT EXISTS metaversion (version INT NOT NULL)`
+	if err := exec(q); err != nil {
+		return errors.Wrap(err, "create metaversion table")
+	}
+	return inTx(ctx, db, func(tx *sqlx.Tx) error {
+		return sqlstore.SetVersion(ctx, tx, "metaversion", 0, 1)
+	})
+}
+
+// inTx runs fn in a transaction, retrying the whole transaction if it fails
+// with a serialization error. fn must not contain DDL.
+func inTx(
+	ctx context.Context,
+	db *sqlx.DB,
+	fn func(*sqlx.Tx) error,
+) error {
+	return retry(ctx, func() (err error) {
+		tx, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			return errors.Wrap(err, "begin tx")
+		}
+		defer func() {
+			if err != nil {
+				_ = tx.Rollback()
+				return
+			}
+			err = tx.Commit()
+		}()
+		return fn(tx)
+	})
+}
+
+// retry fn with exponential backoff for as long as it fails with a
+// serialization error, up to maxRetries times or until ctx is done.
+func retry(ctx context.Context, fn func() error) error {
+	backoff := retryBackoff
+	for i := 0; ; i++ {
+		err := fn()
+		if !postgres.IsError(err, errSerializationFailure) {
+			return err
+		}
+		if i == maxRetries {
+			return errors.Wrapf(err, "gave up after %d retries", i)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
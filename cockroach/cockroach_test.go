@@ -0,0 +1,436 @@
+package cockroach
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/thankful-ai/migrate"
+	"github.com/thankful-ai/migrate/sqlstore"
+	"github.com/thankful-ai/migrate/sqlstore/storetest"
+)
+
+var ctx = context.Background()
+
+const checkpointFile = "2.sql"
+
+func TestMain(m *testing.M) {
+	path := filepath.Join("..", "test.env")
+	err := parseEnv(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to parse %s: %s\n", path, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+func TestRetry(t *testing.T) {
+	serializationErr := &pq.Error{Code: errSerializationFailure}
+
+	// Serialization failures are retried until the statement succeeds
+	var calls int
+	err := retry(ctx, func() error {
+		calls++
+		if calls < 3 {
+			return errors.Wrap(serializationErr, "exec")
+		}
+		return nil
+	})
+	check(t, err)
+	if calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", calls)
+	}
+
+	// Other errors are returned immediately
+	calls = 0
+	err = retry(ctx, func() error {
+		calls++
+		return &pq.Error{Code: "42601"}
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+
+	// Cancelling the context stops the backoff rather than sleeping
+	// through every retry
+	cancelCtx, cancel := context.WithCancel(ctx)
+	calls = 0
+	err = retry(cancelCtx, func() error {
+		calls++
+		cancel()
+		return serializationErr
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+}
+
+func TestCreateMetaIfNotExists(t *testing.T) {
+	db := newDB(t)
+
+	err := db.CreateMetaIfNotExists(ctx)
+	check(t, err)
+
+	// Creating the tables is idempotent
+	err = db.CreateMetaIfNotExists(ctx)
+	check(t, err)
+
+	var tmp []int
+	err = db.DB.Select(&tmp, `SELECT 1 FROM meta`)
+	check(t, err)
+}
+
+func TestCreateMetaCheckpointsIfNotExists(t *testing.T) {
+	db := newDB(t)
+
+	err := db.CreateMetaCheckpointsIfNotExists(ctx)
+	check(t, err)
+
+	var tmp []int
+	err = db.DB.Select(&tmp, `SELECT 1 FROM metacheckpoints`)
+	check(t, err)
+}
+
+func TestCreateMetaVersionIfNotExists(t *testing.T) {
+	db := newDB(t)
+
+	v, err := db.CreateMetaVersionIfNotExists(ctx, 1)
+	check(t, err)
+	if v != 1 {
+		t.Fatalf("expected version 1, got %d", v)
+	}
+	v, err = db.CreateMetaVersionIfNotExists(ctx, 2)
+	check(t, err)
+	if v != 1 {
+		t.Fatalf("expected version 1, got %d", v)
+	}
+}
+
+func TestGetMigrations(t *testing.T) {
+	db := setupDBV1(t)
+
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 1 {
+		t.Fatalf("expected 1 migration, got %d", len(ms))
+	}
+}
+
+func TestGetMetaCheckpoints(t *testing.T) {
+	db := setupDBV1(t)
+
+	mcs, err := db.GetMetaCheckpoints(ctx, checkpointFile)
+	check(t, err)
+	if len(mcs) != 1 {
+		t.Fatal("expected 1 checkpoint")
+	}
+}
+
+func TestUpsertMigration(t *testing.T) {
+	db := setupDBV1(t)
+
+	// Test update
+	err := db.UpsertMigration(ctx, migrate.Migration{
+		Filename: "1.sql",
+		Content:  "SELECT 1;",
+		Checksum: "md5",
+	})
+	check(t, err)
+
+	// Test insert
+	err = db.UpsertMigration(ctx, migrate.Migration{
+		Filename: "3.sql",
+		Content:  "SELECT 3;",
+		Checksum: "md5",
+	})
+	check(t, err)
+
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(ms))
+	}
+}
+
+func TestInsertMetaCheckpoint(t *testing.T) {
+	db := setupDBV1(t)
+
+	err := db.InsertMetaCheckpoint(ctx, checkpointFile, "SELECT 3;", "md5", 1)
+	check(t, err)
+
+	mcs, err := db.GetMetaCheckpoints(ctx, checkpointFile)
+	check(t, err)
+	if len(mcs) != 2 {
+		t.Fatal("expected 2 checkpoints")
+	}
+}
+
+func TestDeleteMetaCheckpoints(t *testing.T) {
+	db := setupDBV1(t)
+
+	err := db.DeleteMetaCheckpoints(ctx)
+	check(t, err)
+
+	mcs, err := db.GetMetaCheckpoints(ctx, checkpointFile)
+	check(t, err)
+	if len(mcs) != 0 {
+		t.Fatal("expected 0 checkpoints")
+	}
+}
+
+func TestUpgradeToV1Rerun(t *testing.T) {
+	db := setupDBV1(t)
+
+	// Each step is idempotent, so a second upgrade after a partial failure
+	// doesn't trip over the changes already made
+	err := db.UpgradeToV1(ctx, []migrate.Migration{{
+		Filename: "1.sql",
+		Content:  "SELECT 1;",
+	}})
+	check(t, err)
+}
+
+// TestConcurrentMigrate runs several migrations of the same files at once,
+// each on its own connections, which contend on the meta tables and make
+// Cockroach abort transactions with serialization failures that must be
+// retried transparently. Exactly one run applies the files.
+func TestConcurrentMigrate(t *testing.T) {
+	db := newDB(t)
+	fsys := fstest.MapFS{
+		"1.sql": {Data: []byte(`CREATE TABLE runs (name STRING NOT NULL);`)},
+		"2.sql": {Data: []byte(`INSERT INTO runs (name) VALUES ('2');`)},
+		"3.sql": {Data: []byte(`INSERT INTO runs (name) VALUES ('3');`)},
+	}
+
+	const workers = 4
+	runs := make([]*migrate.Migrate, workers)
+	for i := range runs {
+		conn, err := sqlx.Open("postgres", dsnForDB("migrate_test"))
+		check(t, err)
+		defer conn.Close()
+		run := &DB{Store: sqlstore.New(conn.DB, Dialect{})}
+		m, err := migrate.NewFS(ctx, run, testLogger{t},
+			migrate.DBTypeCockroach, fsys, "",
+			migrate.WithLockWait(30*time.Second, 10*time.Millisecond))
+		check(t, err)
+		runs[i] = m
+	}
+
+	start := make(chan struct{})
+	type result struct {
+		migrated bool
+		err      error
+	}
+	results := make(chan result, workers)
+	var wg sync.WaitGroup
+	for _, m := range runs {
+		wg.Add(1)
+		go func(m *migrate.Migrate) {
+			defer wg.Done()
+			<-start
+			migrated, err := m.Migrate(ctx)
+			results <- result{migrated, err}
+		}(m)
+	}
+	close(start)
+	wg.Wait()
+	close(results)
+	var migrated int
+	for r := range results {
+		check(t, r.err)
+		if r.migrated {
+			migrated++
+		}
+	}
+	if migrated != 1 {
+		t.Fatalf("expected exactly one run to migrate, got %d", migrated)
+	}
+
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 3 {
+		t.Fatalf("expected 3 migrations, got %d", len(ms))
+	}
+	var rows int
+	err = db.DB.Get(&rows, `SELECT COUNT(*) FROM runs`)
+	check(t, err)
+	if rows != 2 {
+		t.Fatalf("expected 2 rows in runs, got %d", rows)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) migrate.Store {
+		return newDB(t)
+	})
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Printf(s string, vs ...interface{}) { l.t.Logf(s, vs...) }
+func (l testLogger) Println(vs ...interface{})          { l.t.Log(vs...) }
+
+func newDB(t *testing.T) *DB {
+	db := createDBAndOpen(t)
+	return &DB{Store: sqlstore.New(db.DB, Dialect{})}
+}
+
+func parseEnv(filename string) error {
+	fi, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	scn := bufio.NewScanner(fi)
+	for i := 1; scn.Scan(); i++ {
+		line := scn.Text()
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("bad line %d: %s", i, line)
+		}
+		if err = os.Setenv(parts[0], parts[1]); err != nil {
+			return errors.Wrap(err, "set env")
+		}
+	}
+	if err = scn.Err(); err != nil {
+		return errors.Wrap(err, "scan")
+	}
+	return nil
+}
+
+func createDBAndOpen(t *testing.T) *sqlx.DB {
+	db, err := sqlx.Open("postgres", dsnForDB(""))
+	check(t, err)
+
+	q := `DROP DATABASE IF EXISTS migrate_test CASCADE`
+	_, err = db.Exec(q)
+	check(t, err)
+
+	q = `CREATE DATABASE migrate_test`
+	_, err = db.Exec(q)
+	check(t, err)
+
+	err = db.Close()
+	check(t, err)
+
+	db, err = sqlx.Open("postgres", dsnForDB("migrate_test"))
+	check(t, err)
+
+	t.Cleanup(teardown(db))
+	return db
+}
+
+func dsnForDB(dbName string) string {
+	user := os.Getenv("COCKROACH_USER")
+	if user == "" {
+		panic("missing COCKROACH_USER")
+	}
+	host := os.Getenv("COCKROACH_HOST")
+	if host == "" {
+		panic("missing COCKROACH_HOST")
+	}
+
+	// Insecure clusters, such as the one started by
+	// `cockroach start-single-node --insecure`, take no password.
+	auth := user
+	if pass := os.Getenv("COCKROACH_PASSWORD"); pass != "" {
+		auth += ":" + pass
+	}
+	params := "sslmode=disable&connect_timeout=1"
+	return fmt.Sprintf("postgres://%s@%s/%s?%s", auth, host, dbName,
+		params)
+}
+
+func teardown(db *sqlx.DB) func() {
+	return func() {
+		if err := db.Close(); err != nil {
+			return
+		}
+
+		var err error
+		db, err = sqlx.Open("postgres", dsnForDB(""))
+		if err != nil {
+			return
+		}
+		defer db.Close()
+
+		q := `DROP DATABASE migrate_test CASCADE`
+		_, err = db.Exec(q)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func setupDBV1(t *testing.T) *DB {
+	db := setupDBV0(t)
+	err := db.UpgradeToV1(ctx, []migrate.Migration{{
+		Filename: "1.sql",
+		Checksum: "md5",
+		Content:  "SELECT 1;",
+	}})
+	check(t, err)
+
+	q := `
+		INSERT INTO metacheckpoints (idx, filename, content, md5)
+		VALUES ($1, $2, $3, $4)`
+	_, err = db.DB.Exec(q, 0, checkpointFile, "SELECT 2;", "md5")
+	check(t, err)
+
+	return db
+}
+
+func setupDBV0(t *testing.T) *DB {
+	db := newDB(t)
+
+	q := `CREATE TABLE IF NOT EXISTS meta (
+		filename STRING UNIQUE NOT NULL,
+		md5 STRING UNIQUE NOT NULL,
+		createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`
+	_, err := db.DB.Exec(q)
+	check(t, err)
+
+	q = `CREATE TABLE IF NOT EXISTS metacheckpoints (
+		filename STRING NOT NULL,
+		idx INT NOT NULL,
+		md5 STRING NOT NULL,
+		createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (filename, idx)
+	)`
+	_, err = db.DB.Exec(q)
+	check(t, err)
+
+	q = `INSERT INTO meta (filename, md5) VALUES ($1, $2)`
+	_, err = db.DB.Exec(q, "1.sql", "md5")
+	check(t, err)
+
+	return db
+}
@@ -0,0 +1,224 @@
+package migrate
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultDiffLines is the most lines of a diff an *ErrChecksumMismatch
+// includes unless WithDiffLines sets another limit.
+const DefaultDiffLines = 50
+
+// WithDiffLines sets the most lines of the diff an *ErrChecksumMismatch
+// includes, after which it's cut. 0 leaves the diff out.
+func WithDiffLines(n int) Option {
+	return func(m *Migrate) { m.diffLines = n }
+}
+
+// diffContext is how many unchanged lines a unified diff shows around each
+// change.
+const diffContext = 3
+
+// maxDiffCells bounds the table diffLines fills, so diffing two large files,
+// such as generated seeds, doesn't take more memory than it's worth.
+const maxDiffCells = 1 << 22
+
+// diffLine is a line of a diff: ' ' if it's in both a and b, '-' if only a,
+// or '+' if only b. a and b count the lines of each before it.
+type diffLine struct {
+	op   byte
+	text string
+	a, b int
+}
+
+// splitLines splits s after each newline, so the last line lacks one only if
+// s doesn't end in one.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the lines of a and b as a diff with as few changes as
+// possible, by their longest common subsequence. It reports false if what
+// remains after trimming the lines they start and end with is too large to
+// diff.
+func diffLines(a, b []string) ([]diffLine, bool) {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre &&
+		a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	ma, mb := a[pre:len(a)-suf], b[pre:len(b)-suf]
+	if (len(ma)+1)*(len(mb)+1) > maxDiffCells {
+		return nil, false
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of ma[i:]
+	// and mb[j:]
+	w := len(mb) + 1
+	lcs := make([]int32, (len(ma)+1)*w)
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			switch {
+			case ma[i] == mb[j]:
+				lcs[i*w+j] = lcs[(i+1)*w+j+1] + 1
+			case lcs[(i+1)*w+j] >= lcs[i*w+j+1]:
+				lcs[i*w+j] = lcs[(i+1)*w+j]
+			default:
+				lcs[i*w+j] = lcs[i*w+j+1]
+			}
+		}
+	}
+
+	lines := make([]diffLine, 0, len(a)+len(b))
+	for i := 0; i < pre; i++ {
+		lines = append(lines, diffLine{op: ' ', text: a[i], a: i, b: i})
+	}
+	i, j := 0, 0
+	for i < len(ma) || j < len(mb) {
+		switch {
+		case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+			lines = append(lines, diffLine{op: ' ', text: ma[i],
+				a: pre + i, b: pre + j})
+			i++
+			j++
+		case j == len(mb) || (i < len(ma) &&
+			lcs[(i+1)*w+j] >= lcs[i*w+j+1]):
+			lines = append(lines, diffLine{op: '-', text: ma[i],
+				a: pre + i, b: pre + j})
+			i++
+		default:
+			lines = append(lines, diffLine{op: '+', text: mb[j],
+				a: pre + i, b: pre + j})
+			j++
+		}
+	}
+	for k := 0; k < suf; k++ {
+		lines = append(lines, diffLine{op: ' ', text: a[len(a)-suf+k],
+			a: len(a) - suf + k, b: len(b) - suf + k})
+	}
+	return lines, true
+}
+
+// unifiedDiff returns the changes from a, called from, to b, called to, as a
+// unified diff like diff -u's, or an empty string if they're the same. It
+// reports false if they're too large to diff.
+func unifiedDiff(from, to string, a, b []byte) (string, bool) {
+	lines, ok := diffLines(splitLines(string(a)), splitLines(string(b)))
+	if !ok {
+		return "", false
+	}
+	var buf strings.Builder
+	for i := 0; i < len(lines); {
+		if lines[i].op == ' ' {
+			i++
+			continue
+		}
+
+		// A hunk runs until the gap to the next change is too long to
+		// show as context of both
+		end := i + 1
+		for j := end; j < len(lines) && j-end < 2*diffContext; j++ {
+			if lines[j].op != ' ' {
+				end = j + 1
+			}
+		}
+		start := max(i-diffContext, 0)
+		stop := min(end+diffContext, len(lines))
+		if buf.Len() == 0 {
+			fmt.Fprintf(&buf, "--- %s\n+++ %s\n", from, to)
+		}
+		writeHunk(&buf, lines[start:stop])
+		i = stop
+	}
+	return buf.String(), true
+}
+
+// writeHunk writes lines as a hunk of a unified diff.
+func writeHunk(buf *strings.Builder, lines []diffLine) {
+	var na, nb int
+	for _, l := range lines {
+		if l.op != '+' {
+			na++
+		}
+		if l.op != '-' {
+			nb++
+		}
+	}
+	fmt.Fprintf(buf, "@@ -%s +%s @@\n", hunkRange(lines[0].a, na),
+		hunkRange(lines[0].b, nb))
+	writeLines(buf, lines)
+}
+
+// writeLines writes lines as those of a hunk, each after its op.
+func writeLines(buf *strings.Builder, lines []diffLine) {
+	for _, l := range lines {
+		buf.WriteByte(l.op)
+		buf.WriteString(l.text)
+		if !strings.HasSuffix(l.text, "\n") {
+			buf.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// hunkRange formats the range of n lines after the first lines of a file for
+// a hunk's header. An empty range is numbered by the line before it.
+func hunkRange(first, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", first)
+	}
+	if n == 1 {
+		return fmt.Sprint(first + 1)
+	}
+	return fmt.Sprintf("%d,%d", first+1, n)
+}
+
+// changeDiff returns the changes from recorded, the content of the migration
+// called name in meta, to local, its file, as a unified diff. Files too large
+// to diff are reported by their first differing line, with the lines around
+// it in each.
+func changeDiff(name string, recorded, local []byte) string {
+	from, to := name+" (recorded)", name
+	if diff, ok := unifiedDiff(from, to, recorded, local); ok {
+		return diff
+	}
+	a, b := splitLines(string(recorded)), splitLines(string(local))
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", from, to)
+	fmt.Fprintf(&buf, "@@ first difference at line %d, too large to diff in full @@\n",
+		i+1)
+	var lines []diffLine
+	for k := max(i-diffContext, 0); k < i; k++ {
+		lines = append(lines, diffLine{op: ' ', text: a[k]})
+	}
+	for k := i; k < min(i+diffContext+1, len(a)); k++ {
+		lines = append(lines, diffLine{op: '-', text: a[k]})
+	}
+	for k := i; k < min(i+diffContext+1, len(b)); k++ {
+		lines = append(lines, diffLine{op: '+', text: b[k]})
+	}
+	writeLines(&buf, lines)
+	return buf.String()
+}
+
+// truncateDiff returns diff cut to its first n lines, noting how many more
+// there were, or diff as it is if it has no more than n.
+func truncateDiff(diff string, n int) string {
+	lines := splitLines(diff)
+	if len(lines) <= n {
+		return diff
+	}
+	return strings.Join(lines[:n], "") +
+		fmt.Sprintf("... %d more lines\n", len(lines)-n)
+}
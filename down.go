@@ -0,0 +1,621 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"golang.org/x/text/unicode/norm"
+)
+
+// WithAutoRollbackOnFailure rolls back a migration which fails partway
+// through, such as in a CI database, by running its down migration if it has
+// one, then deleting its row and checkpoints from meta, so the next run applies
+// it from the start. The error reported is an *ErrAutoRollback wrapping the
+// failure. If the rollback fails too, the migration is left with its
+// checkpoints, for recovering it by hand, as StatusRollbackFailed, which even
+// WithResume refuses until ClearCheckpoints. A migration none of whose
+// statements took effect, such as one failing on its first, isn't rolled back,
+// nor are Go migrations and transaction files, which roll back on their own,
+// multi files, and statements whose outcome is unknown. It's refused with
+// WithProduction.
+func WithAutoRollbackOnFailure() Option {
+	return func(m *Migrate) { m.autoRollback = true }
+}
+
+// Down rolls back the last steps migrations applied, in the order they run,
+// by running the down migration paired with each from dir, the latest first,
+// then deleting its row from meta along with its checkpoints, so the next
+// Migrate applies it again. It logs the plan before rolling back any, and
+// reports how many were rolled back.
+//
+// Migrations recorded as skipped never ran, so their rows are deleted without
+// running anything. If any other has no down migration, Down reports an
+// *ErrDownMissing listing them before rolling back any. Each row is deleted as
+// soon as its down migration succeeds, so after a failure those rolled back
+// stay rolled back. A down migration which fails partway leaves its migration
+// recorded as applied, and the statements before the one which failed may
+// have taken effect, so they run again if it's retried. It needs the meta
+// tables at the current version, and refuses to roll back while a migration is
+// unfinished.
+func Down(
+	ctx context.Context,
+	db Store,
+	log Logger,
+	dbt DBType,
+	dir string,
+	steps int,
+	opts ...Option,
+) (int, error) {
+	fsys, err := dirFS(dir)
+	if err != nil {
+		return 0, err
+	}
+	return DownFS(ctx, db, log, dbt, fsys, steps, opts...)
+}
+
+// DownFS is Down with the files at the root of fsys, as NewFS reads them.
+func DownFS(
+	ctx context.Context,
+	db Store,
+	log Logger,
+	dbt DBType,
+	fsys fs.FS,
+	steps int,
+	opts ...Option,
+) (int, error) {
+	m, err := newDownMigrate(db, log, dbt, fsys, opts)
+	if err != nil {
+		return 0, err
+	}
+	return m.down(ctx, lastSteps(steps), m.downFromFile)
+}
+
+// DownTo rolls back every migration applied after target, as Down does, so
+// target is left the latest applied. Since each is deleted from meta as soon
+// as it's rolled back, DownTo may be run again with the same target after a
+// failure to roll back the rest.
+func DownTo(
+	ctx context.Context,
+	db Store,
+	log Logger,
+	dbt DBType,
+	dir string,
+	target string,
+	opts ...Option,
+) (int, error) {
+	fsys, err := dirFS(dir)
+	if err != nil {
+		return 0, err
+	}
+	return DownToFS(ctx, db, log, dbt, fsys, target, opts...)
+}
+
+// DownToFS is DownTo with the files at the root of fsys, as NewFS reads them.
+func DownToFS(
+	ctx context.Context,
+	db Store,
+	log Logger,
+	dbt DBType,
+	fsys fs.FS,
+	target string,
+	opts ...Option,
+) (int, error) {
+	m, err := newDownMigrate(db, log, dbt, fsys, opts)
+	if err != nil {
+		return 0, err
+	}
+	target = norm.NFC.String(target)
+	return m.down(ctx, func(ms []Migration) (int, error) {
+		for i, mg := range ms {
+			if mg.Filename == target {
+				return len(ms) - 1 - i, nil
+			}
+		}
+		return 0, fmt.Errorf("%s isn't applied", target)
+	}, m.downFromFile)
+}
+
+// DownFromStore rolls back the last steps migrations applied, as Down does,
+// but runs the down migration recorded in meta.down_content when each was
+// applied rather than one from the migrations directory, such as when the
+// host rolling back has an older build without the latest down migrations. If
+// any applied migration has none recorded, it reports an *ErrDownMissing
+// before rolling back any.
+func DownFromStore(
+	ctx context.Context,
+	db Store,
+	log Logger,
+	steps int,
+	opts ...Option,
+) (int, error) {
+	m, err := newMigrate(db, log, opts)
+	if err != nil {
+		return 0, err
+	}
+	return m.down(ctx, lastSteps(steps), m.downFromStore)
+}
+
+// Redo rolls back the latest migration applied by its down migration from dir,
+// as Down does, then applies its file again, recording its checksum and
+// content anew, such as while editing a migration in development. It refuses
+// if any other file is pending, since which to redo would be ambiguous, or if
+// the migration has no down migration. The lock is released between rolling
+// back and applying again.
+func Redo(
+	ctx context.Context,
+	db Store,
+	log Logger,
+	dbt DBType,
+	dir string,
+	opts ...Option,
+) error {
+	fsys, err := dirFS(dir)
+	if err != nil {
+		return err
+	}
+	return RedoFS(ctx, db, log, dbt, fsys, opts...)
+}
+
+// RedoFS is Redo with the files at the root of fsys, as NewFS reads them.
+func RedoFS(
+	ctx context.Context,
+	db Store,
+	log Logger,
+	dbt DBType,
+	fsys fs.FS,
+	opts ...Option,
+) error {
+	m, err := newDownMigrate(db, log, dbt, fsys, opts)
+	if err != nil {
+		return err
+	}
+	if err = m.refuseDryRun("Redo"); err != nil {
+		return err
+	}
+	var latest string
+	_, err = m.down(ctx, func(ms []Migration) (int, error) {
+		if len(ms) == 0 {
+			return 0, errors.New("no migrations are applied")
+		}
+		mg := ms[len(ms)-1]
+		if mg.Status == StatusSkipped {
+			return 0, fmt.Errorf("%s was skipped, so can't be redone", mg.Filename)
+		}
+		recorded := make(map[string]bool, len(ms))
+		for _, mg := range ms {
+			recorded[mg.Filename] = true
+		}
+		for _, f := range m.Files {
+			if !recorded[f.Info.Name()] {
+				return 0, fmt.Errorf("%s is pending, so it's ambiguous which migration to redo",
+					f.Info.Name())
+			}
+		}
+		latest = mg.Filename
+		return 1, nil
+	}, m.downFromFile)
+	if err != nil {
+		return err
+	}
+
+	up, err := NewFS(ctx, db, log, dbt, fsys, "", opts...)
+	if err != nil {
+		return err
+	}
+	if _, err = up.Migrate(ctx); err != nil {
+		return err
+	}
+	m.log.Println("redid", latest)
+	return nil
+}
+
+// newDownMigrate returns a Migrate for rolling back with the migrations in
+// fsys.
+func newDownMigrate(
+	db Store,
+	log Logger,
+	dbt DBType,
+	fsys fs.FS,
+	opts []Option,
+) (*Migrate, error) {
+	m, err := newMigrate(db, log, opts)
+	if err != nil {
+		return nil, err
+	}
+	if fsys, err = m.withIgnore(fsys); err != nil {
+		return nil, err
+	}
+	if m.fsys, err = m.withGoMigrations(migrationFS(fsys)); err != nil {
+		return nil, err
+	}
+	if m.Files, err = m.readFiles(m.fsys, dbt); err != nil {
+		return nil, errors.Wrap(err, "get migrations")
+	}
+	return m, nil
+}
+
+// lastSteps returns how many of the applied migrations to roll back for
+// Down's steps.
+func lastSteps(steps int) func(ms []Migration) (int, error) {
+	return func(ms []Migration) (int, error) {
+		switch {
+		case steps < 1:
+			return 0, fmt.Errorf("can't roll back %d migrations", steps)
+		case steps > len(ms):
+			return 0, fmt.Errorf("can't roll back %d migrations, as only %d are applied",
+				steps, len(ms))
+		}
+		return steps, nil
+	}
+}
+
+// rollback is an applied migration to roll back by running the down
+// migration down, whose content is byt. A skipped migration has none.
+type rollback struct {
+	mg   Migration
+	f    *file
+	down *file
+	byt  []byte
+
+	// source is where down was read from, as a PlannedFile's Source.
+	source string
+}
+
+// down rolls back as many of the applied migrations, sorted in the order they
+// ran, as steps returns, with the down migrations downOf finds, as Down
+// describes. downOf reports a nil down for a migration which has none.
+func (m *Migrate) down(
+	ctx context.Context,
+	steps func(ms []Migration) (int, error),
+	downOf func(ctx context.Context, mg Migration) (*rollback, error),
+) (int, error) {
+	db := m.db
+	v, exists, err := db.GetMetaVersion(ctx)
+	switch {
+	case err != nil:
+		return 0, errors.Wrap(err, "get meta version")
+	case !exists:
+		return 0, errors.New("no migrations are applied")
+	case v > version:
+		return 0, &ErrVersionTooNew{Have: v, Want: version}
+	case v < version:
+		return 0, &ErrUpgradeRequired{Have: v, Want: version}
+	}
+
+	if m.plan == nil {
+		var release func()
+		ctx, release, err = m.lock(ctx)
+		if err != nil {
+			return 0, err
+		}
+		defer release()
+		m.createHistory(ctx)
+	}
+
+	// Read the migrations once the lock is held, in case another run
+	// applied more in the meantime
+	ms, err := db.GetMigrations(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "get migrations")
+	}
+	normalizeFilenames(ms)
+	m.sortMigrations(ms)
+	for _, mg := range ms {
+		if mg.Status != StatusApplied && mg.Status != StatusSkipped {
+			return 0, fmt.Errorf("%s is %s, so nothing can be rolled back until it's resumed or repaired",
+				mg.Filename, mg.Status)
+		}
+	}
+	n, err := steps(ms)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		m.log.Println("nothing to roll back")
+		return 0, nil
+	}
+
+	// Every down migration is found before any runs, so a missing one
+	// leaves the database as it was
+	var plan []rollback
+	var missing []string
+	verb := "rolling back"
+	if m.plan != nil {
+		verb = "would roll back"
+	}
+	m.log.Printf("%s %d migrations, in this order:\n", verb, n)
+	for i := len(ms) - 1; i >= len(ms)-n; i-- {
+		mg := ms[i]
+		if mg.Status == StatusSkipped {
+			m.log.Printf("  %s, which was skipped, so nothing runs\n",
+				mg.Filename)
+			plan = append(plan, rollback{mg: mg,
+				f: &file{Info: namedInfo{name: mg.Filename}}})
+			continue
+		}
+		r, err := downOf(ctx, mg)
+		if err != nil {
+			return 0, err
+		}
+		if r == nil {
+			m.log.Printf("  %s, which has no down migration\n", mg.Filename)
+			missing = append(missing, mg.Filename)
+			continue
+		}
+		m.log.Printf("  %s, by running %s\n", mg.Filename,
+			path.Base(r.down.Info.Name()))
+		plan = append(plan, *r)
+	}
+	if len(missing) > 0 {
+		slices.Reverse(missing)
+		return 0, &ErrDownMissing{Filenames: missing}
+	}
+	if m.plan != nil {
+		return 0, m.planDown(plan)
+	}
+
+	n = 0
+	for _, r := range plan {
+		if m.stopped() {
+			return n, ErrStopped
+		}
+		start := time.Now()
+		if r.down != nil {
+			err = m.runDown(ctx, r.down, r.byt)
+		}
+		if err == nil {
+			err = errors.Wrap(db.DeleteMigration(ctx, r.mg.Filename),
+				"delete migration")
+		}
+		m.recordHistory(ctx, r.f, StatementDown, start, err)
+		if err != nil {
+			return n, err
+		}
+		m.rollbacks = append(m.rollbacks, FileResult{
+			Filename:   r.mg.Filename,
+			Duration:   time.Since(start),
+			RolledBack: true,
+		})
+		m.log.Printf("rolled back %s\n", r.mg.Filename)
+		n++
+	}
+	return n, nil
+}
+
+// downFromFile returns the rollback of mg by the down migration paired with
+// its file, or nil if either is missing.
+func (m *Migrate) downFromFile(
+	ctx context.Context,
+	mg Migration,
+) (*rollback, error) {
+	j, ok := m.fileIndexes()[mg.Filename]
+	if !ok || m.Files[j].downpath == "" {
+		return nil, nil
+	}
+	f := m.Files[j]
+	info, err := fs.Stat(m.fsys, f.downpath)
+	if err != nil {
+		return nil, errors.Wrap(err, "read down migration")
+	}
+	byt, err := fs.ReadFile(m.fsys, f.downpath)
+	if err != nil {
+		return nil, errors.Wrap(err, "read down migration")
+	}
+	down := &file{
+		Info: namedInfo{FileInfo: info,
+			name: path.Join(path.Dir(f.Info.Name()), path.Base(f.downpath))},
+		fullpath: f.downpath,
+	}
+	return &rollback{mg: mg, f: f, down: down,
+		byt: normalizeLineEndings(byt), source: "file"}, nil
+}
+
+// downFromStore returns the rollback of mg by the down migration recorded
+// with it, or nil if none was.
+func (m *Migrate) downFromStore(
+	ctx context.Context,
+	mg Migration,
+) (*rollback, error) {
+	row, err := m.db.GetMigrationWithDown(ctx, mg.Filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "get migration")
+	}
+	if strings.TrimSpace(row.DownContent) == "" {
+		return nil, nil
+	}
+	return &rollback{
+		mg:     mg,
+		f:      &file{Info: namedInfo{name: mg.Filename}},
+		down:   &file{Info: namedInfo{name: migrationStem(mg.Filename) + downSuffix}},
+		byt:    normalizeLineEndings([]byte(row.DownContent)),
+		source: "store",
+	}, nil
+}
+
+// rollbackFailed rolls back f, whose content is byt and which failed with
+// failure after starting at start, by its down migration under
+// WithAutoRollbackOnFailure, reporting both. Only a file which failed partway
+// is rolled back, once it has checkpoints of statements which ran, as its down
+// migration could otherwise drop what it never created, such as a table which
+// existed before its CREATE TABLE failed. If the down migration fails, f is
+// recorded as StatusRollbackFailed, since it may have partly run.
+func (m *Migrate) rollbackFailed(
+	ctx context.Context,
+	f *file,
+	byt []byte,
+	start time.Time,
+	failure error,
+) error {
+	var unknown *ErrOutcomeUnknown
+	switch {
+	case goMigrationOf(f.Info) != nil:
+		return failure
+	case errors.As(failure, &unknown):
+		m.log.Printf("WARNING: not rolling back %s, as whether its statement ran is unknown\n",
+			f.Info.Name())
+		return failure
+	case m.Results[len(m.Results)-1].Mode == "transaction":
+		m.log.Printf("not rolling back %s, as none of its transaction took effect\n",
+			f.Info.Name())
+		return failure
+	case m.Results[len(m.Results)-1].Mode == "multi":
+		m.log.Printf("WARNING: not rolling back %s, as which of its statements ran before it failed is unknown\n",
+			f.Info.Name())
+		return failure
+	}
+	checkpoints, err := m.db.GetMetaCheckpoints(ctx, f.Info.Name())
+	switch {
+	case err != nil:
+		m.log.Printf("WARNING: not rolling back %s, as failed to read which of its statements ran: %v\n",
+			f.Info.Name(), err)
+		return failure
+	case len(checkpoints) == 0:
+		m.log.Printf("not rolling back %s, as none of its statements took effect\n",
+			f.Info.Name())
+		return failure
+	case f.downpath == "":
+		m.log.Printf("WARNING: %s has no down migration to roll it back\n",
+			f.Info.Name())
+		return failure
+	}
+	m.log.Printf("WARNING: rolling back %s by running %s, as auto-rollback is enabled\n",
+		f.Info.Name(), path.Base(f.downpath))
+	downStart := time.Now()
+	r, err := m.downFromFile(ctx, Migration{Filename: f.Info.Name()})
+	if err != nil {
+		m.recordHistory(ctx, f, StatementDown, downStart, err)
+		m.log.Printf("WARNING: not rolling back %s, as failed to read its down migration: %v\n",
+			f.Info.Name(), err)
+		return &ErrAutoRollback{Filename: f.Info.Name(), Err: failure,
+			RollbackErr: err}
+	}
+	err = m.runDown(ctx, r.down, r.byt)
+	if err == nil {
+		err = errors.Wrap(m.db.DeleteMigration(ctx, f.Info.Name()),
+			"delete migration")
+	}
+	m.recordHistory(ctx, f, StatementDown, downStart, err)
+	rollbackErr := &ErrAutoRollback{Filename: f.Info.Name(), Err: failure,
+		RollbackErr: err}
+	if err == nil {
+		m.Results[len(m.Results)-1].RolledBack = true
+		m.log.Println("rolled back", f.Info.Name())
+		return rollbackErr
+	}
+
+	// The down migration may have undone some of what the checkpoints
+	// record as run, so resuming from them could skip statements whose
+	// effects are gone
+	m.log.Printf("WARNING: rolling back %s failed, so it's recorded as %s with its checkpoints left for recovering it by hand: %v\n",
+		f.Info.Name(), StatusRollbackFailed, err)
+	recErr := m.recordMigration(context.WithoutCancel(ctx), f, byt, start,
+		StatusRollbackFailed, rollbackErr)
+	if recErr != nil {
+		m.log.Printf("WARNING: failed to record %s as %s: %v\n",
+			f.Info.Name(), StatusRollbackFailed, recErr)
+	}
+	return rollbackErr
+}
+
+// planDown fills the plan with the rollbacks of plan.
+func (m *Migrate) planDown(plan []rollback) error {
+	m.plan.Direction = "down"
+	m.plan.Files = nil
+	for _, r := range plan {
+		pf := PlannedFile{Filename: r.mg.Filename, Source: r.source}
+		if r.down != nil {
+			d, stmts, dirLines, err := m.downStatements(r.down, r.byt)
+			if err != nil {
+				return err
+			}
+			switch {
+			case d.multi:
+				pf.Mode = "multi"
+			case m.inTransaction(d):
+				pf.Mode = "transaction"
+				if err = m.checkTransaction(r.down, stmts,
+					dirLines); err != nil {
+					return err
+				}
+			case d.noSplit:
+				pf.Mode = "no-split"
+			}
+			pf.Statements = len(stmts)
+		}
+		m.plan.Files = append(m.plan.Files, pf)
+	}
+	return nil
+}
+
+// downStatements returns the directives and statements of the down migration
+// down, whose content is byt, and how many lines its directives take.
+func (m *Migrate) downStatements(
+	down *file,
+	byt []byte,
+) (directives, []Statement, int, error) {
+	d, body, err := parseDirectives(byt)
+	if err != nil {
+		return d, nil, 0, fmt.Errorf("%s: %w", down.Info.Name(), err)
+	}
+	dirLines := lineOf(string(byt), len(byt)-len(body)) - 1
+
+	// A down migration of one batch runs as one statement
+	if !d.multi && !d.noSplit {
+		stmts, err := m.split(body)
+		if err != nil {
+			return d, nil, 0, fmt.Errorf("%s: statements: %w",
+				down.Info.Name(), err)
+		}
+		return d, stmts, dirLines, nil
+	}
+	directive := multiDirective
+	if d.noSplit {
+		directive = noSplitDirective
+	}
+	if err = m.checkMultiStatements(down, directive, body); err != nil {
+		return d, nil, 0, err
+	}
+	lead := len(body) - len(bytes.TrimLeftFunc(body, unicode.IsSpace))
+	return d, []Statement{{SQL: strings.TrimSpace(string(body)),
+		Line: lineOf(string(body), lead)}}, dirLines, nil
+}
+
+// runDown runs the statements of the down migration down, whose content is
+// byt, as runFile runs a file's but without checkpoints, since a down
+// migration which fails isn't resumed.
+func (m *Migrate) runDown(ctx context.Context, down *file, byt []byte) error {
+	d, stmts, dirLines, err := m.downStatements(down, byt)
+	if err != nil {
+		return err
+	}
+	if m.inTransaction(d) {
+		return m.runTransaction(ctx, down, d, stmts, dirLines)
+	}
+	for i, stmt := range stmts {
+		line := dirLines + stmt.Line
+		m.log.Printf("> %s %s: %s\n", down.Info.Name(),
+			statementAt(i, line), m.shortSQL(stmt.SQL))
+		timeout := m.statementTimeout
+		if d.timeout != nil {
+			timeout = *d.timeout
+		}
+		if stmt.timeout != nil {
+			timeout = *stmt.timeout
+		}
+		err = m.execWithTimeout(ctx, stmt.SQL, timeout,
+			!d.noRetry && !d.multi && !d.noSplit)
+		if err != nil {
+			m.log.Println("failed on", m.redactSQL(stmt.SQL))
+			return m.statementErr(down, i, line, stmt.SQL, err)
+		}
+	}
+	return nil
+}
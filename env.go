@@ -0,0 +1,97 @@
+package migrate
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// regexEnv matches an environment tag, such as staging in
+// 0031_seed_test_users.staging.sql.
+var regexEnv = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+
+// WithEnvironment runs only the files for the environment called name, such as
+// staging, and those for every environment. A file is for one environment when
+// its name is tagged with it before the extension, like
+// 0031_seed_test_users.staging.sql, and for every environment when untagged.
+// Files and migrations recorded in meta tagged for another environment are
+// left out, so they're neither pending nor missing, and each environment's
+// meta records only what ran in it. Without it, tags mean nothing and every
+// file runs.
+func WithEnvironment(name string) Option {
+	return func(m *Migrate) { m.env = name }
+}
+
+// WithEnvironments refuses files tagged with an environment not in names, such
+// as a misspelt one which would otherwise never run anywhere, or a
+// WithEnvironment not in names.
+func WithEnvironments(names ...string) Option {
+	return func(m *Migrate) { m.envs = append(m.envs, names...) }
+}
+
+// envTag returns the environment the migration called name is tagged with, or
+// empty if it's untagged. Its down migration has the same tag.
+func envTag(name string) string {
+	stem := strings.TrimSuffix(migrationStem(path.Base(name)),
+		strings.TrimSuffix(downSuffix, ".sql"))
+	i := strings.LastIndexByte(stem, '.')
+	if i < 0 || !regexEnv.MatchString(stem[i+1:]) {
+		return ""
+	}
+	return stem[i+1:]
+}
+
+// otherEnv reports whether the migration called name is for an environment
+// other than WithEnvironment's.
+func (m *Migrate) otherEnv(name string) bool {
+	tag := envTag(name)
+	return m.env != "" && tag != "" && tag != m.env
+}
+
+// forEnvironment refuses files tagged with an environment not given to
+// WithEnvironments, if it was, and returns the others without those for
+// another environment.
+func (m *Migrate) forEnvironment(files []*file) ([]*file, error) {
+	if len(m.envs) > 0 {
+		if m.env != "" && !m.knownEnv(m.env) {
+			return nil, fmt.Errorf("unknown environment %s, which must be one of %s",
+				m.env, strings.Join(m.envs, ", "))
+		}
+		for _, f := range files {
+			tag := envTag(f.Info.Name())
+			if tag != "" && !m.knownEnv(tag) {
+				return nil, fmt.Errorf("%s is for unknown environment %s, which must be one of %s",
+					f.Info.Name(), tag, strings.Join(m.envs, ", "))
+			}
+		}
+	}
+	kept := files[:0]
+	for _, f := range files {
+		if !m.otherEnv(f.Info.Name()) {
+			kept = append(kept, f)
+		}
+	}
+	return kept, nil
+}
+
+func (m *Migrate) knownEnv(name string) bool {
+	for _, env := range m.envs {
+		if env == name {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutOtherEnvs returns ms without the migrations recorded for another
+// environment, such as when environments share a database.
+func (m *Migrate) withoutOtherEnvs(ms []Migration) []Migration {
+	kept := ms[:0]
+	for _, mg := range ms {
+		if !m.otherEnv(mg.Filename) {
+			kept = append(kept, mg)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,354 @@
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Connection errors are wrapped by stores so Migrate can reconnect.
+var (
+	// ErrConnectionFailed reports that the database can't be reached, or
+	// that a connection was lost before a statement was sent.
+	ErrConnectionFailed = errors.New("cannot reach database")
+
+	// ErrConnectionLost reports that a connection was lost while a
+	// statement ran, so it may or may not have taken effect.
+	ErrConnectionLost = errors.New("connection lost during statement")
+)
+
+// ErrStopped reports that Migrate stopped early because Stop was called. Every
+// statement which ran is checkpointed, so running migrate again resumes after
+// the last of them.
+var ErrStopped = errors.New("migration stopped")
+
+// ErrLocked reports that another run of migrate holds the lock in metalock, so
+// is likely applying the same files. Wait for it to finish, then check whether
+// anything remains to run.
+var ErrLocked = errors.New("another migration holds the lock")
+
+// ErrLockLost reports that Migrate stopped because its lock in metalock was
+// taken over, after its heartbeats stopped reaching the database for longer
+// than the lock's staleness threshold. The statement in progress was
+// interrupted as if by cancelling its context.
+var ErrLockLost = errors.New("lost the migration lock")
+
+// ErrLockHeld reports that ForceUnlock refused to delete a lock whose holder
+// recorded a heartbeat recently, so is likely still running.
+type ErrLockHeld struct {
+	Lock LockInfo
+}
+
+func (e *ErrLockHeld) Error() string {
+	return fmt.Sprintf("lock is held by %s: check it has died, then force the unlock",
+		e.Lock.MetaLock)
+}
+
+// ErrRepairUnsafe reports that Repair refused to record a migration's file
+// again because it changes more than the comments and whitespace of the
+// migration's recorded content, so the database may not have what the file
+// now says.
+type ErrRepairUnsafe struct {
+	Filename string
+}
+
+func (e *ErrRepairUnsafe) Error() string {
+	return fmt.Sprintf("%s changed more than comments and whitespace: check the database has what it now says, then force the repair",
+		e.Filename)
+}
+
+// ErrMigrationNotFound reports that no migration with a filename has been
+// recorded in the meta table.
+var ErrMigrationNotFound = errors.New("migration not found")
+
+// ErrChecksumMismatch reports that a migration file no longer matches the
+// checksum recorded when it ran. Statement is the index of the checkpointed
+// statement which changed, and Line the line of the file it now starts on, or
+// Statement is -1 if the mismatch is for the whole file.
+type ErrChecksumMismatch struct {
+	Filename  string
+	Statement int
+	Line      int
+	Stored    string
+	Computed  string
+
+	diff string
+}
+
+func (e *ErrChecksumMismatch) Error() string {
+	if e.Statement >= 0 {
+		return fmt.Sprintf(
+			"checksum does not equal checkpoint. has %s %s changed? revert it, or clear the file's checkpoints to run it from its first statement",
+			e.Filename, statementAt(e.Statement, e.Line))
+	}
+	return fmt.Sprintf("checksum does not match %s. has the file changed?",
+		e.Filename)
+}
+
+// Diff returns the changes since the file ran, as a unified diff of the
+// content recorded in meta against the file, or for a changed statement, of
+// the statement checkpointed against the file's, cut to the lines
+// WithDiffLines allows. It's empty if what ran can't be shown, such as if the
+// content recorded doesn't have the recorded checksum.
+func (e *ErrChecksumMismatch) Diff() string { return e.diff }
+
+// ErrPartiallyApplied reports that a migration file failed after some of its
+// statements ran. Those statements are checkpointed, so fixing the failed
+// statement and running migrate again resumes from it. Statement is the index
+// of the statement which failed, and Err describes the failure, typically as
+// an *ErrStatementFailed.
+type ErrPartiallyApplied struct {
+	Filename  string
+	Statement int
+	Err       error
+}
+
+func (e *ErrPartiallyApplied) Error() string {
+	return "partially applied: " + e.Err.Error()
+}
+
+func (e *ErrPartiallyApplied) Unwrap() error { return e.Err }
+
+// ErrOutcomeUnknown reports that the connection was lost while a statement
+// ran. The statement may have committed before the connection dropped, so
+// rather than run it again, Migrate stops: check whether it took effect before
+// running migrate again. Line is the line of the file the statement starts on.
+type ErrOutcomeUnknown struct {
+	Filename  string
+	Statement int
+	Line      int
+	Err       error
+}
+
+func (e *ErrOutcomeUnknown) Error() string {
+	return fmt.Sprintf("%s: %s may or may not have run, verify it manually: %s",
+		e.Filename, statementAt(e.Statement, e.Line), e.Err)
+}
+
+func (e *ErrOutcomeUnknown) Unwrap() error { return e.Err }
+
+// ErrImplicitCommit reports a file to run in a transaction with statements
+// which the database commits a transaction before running, such as most DDL
+// in MySQL, so the file couldn't be all or nothing. Nothing in it runs. Each
+// of Statements has the line of the file it starts on.
+type ErrImplicitCommit struct {
+	Filename   string
+	Statements []Statement
+}
+
+func (e *ErrImplicitCommit) Error() string {
+	stmts := make([]string, 0, len(e.Statements))
+	for _, stmt := range e.Statements {
+		stmts = append(stmts, statementAt(stmt.Index, stmt.Line))
+	}
+	return fmt.Sprintf("%s runs in a transaction, but %d statements would commit it implicitly: %s",
+		e.Filename, len(e.Statements), strings.Join(stmts, ", "))
+}
+
+// ErrWarnings reports that a statement succeeded with warnings while
+// WithStrictWarnings is set. The statement is checkpointed, but the file isn't
+// recorded as applied. Line is the line of the file the statement starts on.
+type ErrWarnings struct {
+	Filename  string
+	Statement int
+	Line      int
+	Warnings  []Warning
+}
+
+func (e *ErrWarnings) Error() string {
+	return fmt.Sprintf("%s: %s reported %d warnings, first: %s %d: %s",
+		e.Filename, statementAt(e.Statement, e.Line), len(e.Warnings),
+		e.Warnings[0].Level, e.Warnings[0].Code, e.Warnings[0].Message)
+}
+
+// ErrVersionTooNew reports that the meta tables were written by a newer
+// version of migrate than this one.
+type ErrVersionTooNew struct {
+	Have, Want int
+}
+
+func (e *ErrVersionTooNew) Error() string {
+	return fmt.Sprintf("meta version %d is newer than %d, must upgrade migrate: go get -u github.com/thankful-ai/migrate",
+		e.Have, e.Want)
+}
+
+// ErrVersionConflict reports that a store didn't change the meta version from
+// From to To, since another run changed it first, such as by upgrading the meta
+// tables at the same time. New reads the version again and continues from it.
+type ErrVersionConflict struct {
+	From, To int
+}
+
+func (e *ErrVersionConflict) Error() string {
+	return fmt.Sprintf("meta version is no longer %d, so was not set to %d: another migrate may have upgraded it",
+		e.From, e.To)
+}
+
+// ErrUpgradeRequired reports that the meta tables are from an older version of
+// migrate, and New wasn't given WithUpgrade to upgrade them.
+type ErrUpgradeRequired struct {
+	Have, Want int
+}
+
+func (e *ErrUpgradeRequired) Error() string {
+	return fmt.Sprintf("meta version %d must be upgraded to %d, after which older versions of migrate can't run: rerun with -upgrade or migrate.WithUpgrade",
+		e.Have, e.Want)
+}
+
+// ErrMigrationFailed reports that the last run of a migration file failed, so
+// New won't continue without WithResume. Err is the error recorded when it
+// failed.
+type ErrMigrationFailed struct {
+	Filename string
+	Err      string
+}
+
+func (e *ErrMigrationFailed) Error() string {
+	return fmt.Sprintf("%s failed on its last run: %s: fix it and rerun with -resume or migrate.WithResume, or skip it with -skip",
+		e.Filename, e.Err)
+}
+
+// ErrRollbackFailed reports that a migration file failed, then so did rolling
+// it back by its down migration under WithAutoRollbackOnFailure, which may
+// have undone part of what its checkpoints record as run. It isn't resumed,
+// even with WithResume, until ClearCheckpoints records it as failed again.
+type ErrRollbackFailed struct {
+	Filename string
+	Err      string
+}
+
+func (e *ErrRollbackFailed) Error() string {
+	return fmt.Sprintf("%s failed, and so did rolling it back, which may have partly run: %s: recover it by hand, then clear its checkpoints with -clear-checkpoints or migrate.ClearCheckpoints to rerun it whole with -resume",
+		e.Filename, e.Err)
+}
+
+// ErrOutOfOrder reports pending migration files which sort before Last, a
+// migration applied already, such as 0009_late.sql merged after 0010 and 0011
+// ran. New refuses to run them, since they may depend on the schema as it was
+// before Last, unless WithAllowOutOfOrder is given.
+type ErrOutOfOrder struct {
+	Filenames []string
+	Last      string
+}
+
+func (e *ErrOutOfOrder) Error() string {
+	return fmt.Sprintf("%s %s before %s, which is applied already: renumber to run last, or allow with -allow-out-of-order or migrate.WithAllowOutOfOrder",
+		strings.Join(e.Filenames, ", "), plural(len(e.Filenames), "sorts", "sort"),
+		e.Last)
+}
+
+// plural returns one if n is 1, and many otherwise.
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
+
+// ErrContentTooLarge reports that a migration file is larger than the meta
+// tables can store, as reported by a ContentLimiter. Nothing in the file has
+// run.
+type ErrContentTooLarge struct {
+	Filename  string
+	Size, Max int64
+}
+
+func (e *ErrContentTooLarge) Error() string {
+	return fmt.Sprintf("%s is %d bytes, more than the %d the meta tables can store: upgrade them with -upgrade or split the file",
+		e.Filename, e.Size, e.Max)
+}
+
+// ErrHistoryDiverged reports that ImportMeta would replace history which isn't
+// in the snapshot, such as a migration which differs from the snapshot's.
+type ErrHistoryDiverged struct {
+	Filename string
+	Reason   string
+}
+
+func (e *ErrHistoryDiverged) Error() string {
+	return fmt.Sprintf("history diverges from the snapshot: %s %s, import with overwrite to replace it",
+		e.Filename, e.Reason)
+}
+
+// ErrDownMissing reports the migrations Down would roll back which have no
+// down migration, before it rolls back any.
+type ErrDownMissing struct {
+	Filenames []string
+}
+
+func (e *ErrDownMissing) Error() string {
+	return fmt.Sprintf("no down migration for %s, so nothing was rolled back",
+		strings.Join(e.Filenames, ", "))
+}
+
+// ErrAutoRollback reports a migration which failed, then was rolled back by
+// its down migration under WithAutoRollbackOnFailure. Err is why it failed,
+// and RollbackErr why rolling it back failed too, or nil if it was rolled
+// back. Both unwrap, Err first.
+type ErrAutoRollback struct {
+	Filename    string
+	Err         error
+	RollbackErr error
+}
+
+func (e *ErrAutoRollback) Error() string {
+	if e.RollbackErr == nil {
+		return fmt.Sprintf("%v, so %s was rolled back", e.Err, e.Filename)
+	}
+	return fmt.Sprintf("%v, and rolling %s back failed too: %v", e.Err,
+		e.Filename, e.RollbackErr)
+}
+
+func (e *ErrAutoRollback) Unwrap() []error {
+	if e.RollbackErr == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Err, e.RollbackErr}
+}
+
+// ErrNotReversible reports a migration whose down migration didn't leave the
+// database as it was before the migration was applied, found by
+// VerifyReversible. Err is the error applying it again, if it failed.
+type ErrNotReversible struct {
+	Filename string
+	Reason   string
+	Err      error
+}
+
+func (e *ErrNotReversible) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%s isn't reversible: %s", e.Filename, e.Reason)
+	}
+	return fmt.Sprintf("%s isn't reversible: %s: %v", e.Filename, e.Reason,
+		e.Err)
+}
+
+func (e *ErrNotReversible) Unwrap() error { return e.Err }
+
+// ErrStatementFailed reports which statement in a migration file failed.
+// Index counts statements from 0, as checkpoints do, and Line is the line of
+// the file on which the statement starts. SQL is the statement after any
+// redaction, truncated to a few hundred bytes.
+type ErrStatementFailed struct {
+	Filename string
+	Index    int
+	Line     int
+	SQL      string
+	Err      error
+}
+
+func (e *ErrStatementFailed) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.Filename, statementAt(e.Index, e.Line),
+		e.Err)
+}
+
+// statementAt describes the statement at index i of a file, counting from 1
+// as people do, along with the line it starts on, if known.
+func statementAt(i, line int) string {
+	if line <= 0 {
+		return fmt.Sprintf("statement %d", i+1)
+	}
+	return fmt.Sprintf("statement %d (line %d)", i+1, line)
+}
+
+func (e *ErrStatementFailed) Unwrap() error { return e.Err }
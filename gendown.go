@@ -0,0 +1,243 @@
+package migrate
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// regexPart matches a part of a name, quoted or not, such as users, "Users",
+// `users` or [users].
+const regexPart = "(?:`[^`]+`|\"[^\"]+\"|\\[[^\\]]+\\]|[\\w$]+)"
+
+// regexName matches a name qualified by a schema or database or not, such as
+// users or `app`.`users`.
+const regexName = regexPart + `(?:\.` + regexPart + `)*`
+
+var (
+	regexQualified = regexp.MustCompile(`^((?:` + regexPart + `\.)*)(` +
+		regexPart + `)$`)
+	regexCreateTable = regexp.MustCompile(`(?is)^create\s+` +
+		`(?:(?:global\s+|local\s+)?(?:temp|temporary)\s+)?table\s+` +
+		`(?:if\s+not\s+exists\s+)?(` + regexName + `)`)
+	regexCreateIndex = regexp.MustCompile(`(?is)^create\s+(?:unique\s+)?` +
+		`index\s+(?:concurrently\s+)?(?:if\s+not\s+exists\s+)?` +
+		`(` + regexName + `)\s+on\s+(?:only\s+)?(` + regexName + `)`)
+	regexAlterTable = regexp.MustCompile(`(?is)^alter\s+table\s+` +
+		`(?:if\s+exists\s+)?(?:only\s+)?(` + regexName + `)\s+(.*)$`)
+	regexAddIndex = regexp.MustCompile(`(?is)^add\s+(?:unique\s+)?` +
+		`(?:index|key)\s+(` + regexName + `)\s*\(`)
+	regexAddColumn = regexp.MustCompile(`(?is)^add\s+(?:(column)\s+)?` +
+		`(?:if\s+not\s+exists\s+)?(` + regexName + `)\s+\S`)
+	regexRenameTo = regexp.MustCompile(`(?is)^rename\s+(?:to|as)\s+(` +
+		regexName + `)$`)
+	regexRenameInTable = regexp.MustCompile(`(?is)^rename\s+` +
+		`(?:(column|index|key|constraint)\s+)?(` + regexName + `)\s+to\s+(` +
+		regexName + `)$`)
+	regexAlterRename = regexp.MustCompile(`(?is)^alter\s+` +
+		`(index|view|sequence)\s+(?:if\s+exists\s+)?(` + regexName +
+		`)\s+rename\s+to\s+(` + regexName + `)$`)
+	regexRenameTable = regexp.MustCompile(`(?is)^rename\s+table\s+(` +
+		regexName + `)\s+to\s+(` + regexName + `)$`)
+)
+
+// addKeywords are the words after ADD in an ALTER TABLE which add something
+// other than a column, such as ADD CONSTRAINT.
+var addKeywords = map[string]bool{
+	"CONSTRAINT": true, "PRIMARY": true, "FOREIGN": true, "UNIQUE": true,
+	"CHECK": true, "INDEX": true, "KEY": true, "FULLTEXT": true,
+	"SPATIAL": true, "PARTITION": true, "COLUMNS": true,
+}
+
+// GenerateDown returns a best-effort down migration for upContent, the
+// content of an up migration for dbt, as a starting point to review rather
+// than one to commit as it is. It inverts the statements it recognizes, the
+// last first:
+//
+//   - CREATE TABLE t as DROP TABLE IF EXISTS t
+//   - CREATE INDEX i ON t as dbt drops an index: DROP INDEX i ON t for
+//     MySQL, MariaDB, TiDB and SQL Server, DROP INDEX IF EXISTS i for
+//     PostgreSQL, CockroachDB and SQLite, and DROP INDEX i for Oracle and
+//     Cloud Spanner. It's left as TODO for other databases
+//   - ALTER TABLE t ADD INDEX i as ALTER TABLE t DROP INDEX i
+//   - ALTER TABLE t ADD COLUMN c as ALTER TABLE t DROP COLUMN c
+//   - ALTER TABLE, INDEX, VIEW or SEQUENCE a RENAME TO b, RENAME TABLE a TO
+//     b, and ALTER TABLE t RENAME COLUMN a TO b by renaming b back to a
+//
+// Every other statement, including an ALTER TABLE making more than one
+// change, is left in the down migration as a comment marked TODO, where it
+// would be undone, and listed in the comment it starts with, so none is
+// dropped silently.
+func GenerateDown(dbt DBType, upContent string) (string, error) {
+	byt := normalizeLineEndings([]byte(upContent))
+	_, body, err := parseDirectives(byt)
+	if err != nil {
+		return "", err
+	}
+	stmts, err := splitStatements(body)
+	if err != nil {
+		return "", err
+	}
+	if len(stmts) == 0 {
+		return "", errors.New("no statements to invert")
+	}
+	dirLines := lineOf(string(byt), len(byt)-len(body)) - 1
+
+	var todos []string
+	downs := make([]string, 0, len(stmts))
+	for i := len(stmts) - 1; i >= 0; i-- {
+		s := stmts[i]
+		sql := strings.TrimSpace(skipComments(s.SQL))
+		sql = strings.TrimSpace(strings.TrimSuffix(sql, ";"))
+		if down, ok := invertStatement(dbt, sql); ok {
+			downs = append(downs, down+";")
+			continue
+		}
+		line := s.Line + dirLines
+		todos = append(todos, fmt.Sprintf("line %d: %s", line,
+			firstLine(sql)))
+		downs = append(downs, fmt.Sprintf(
+			"-- TODO: undo the statement on line %d of the up migration:\n%s",
+			line, commentOut(sql+";")))
+	}
+
+	var buf strings.Builder
+	buf.WriteString("-- Generated from the up migration, the last statement first. Review\n")
+	buf.WriteString("-- it before committing it.\n")
+	if len(todos) > 0 {
+		buf.WriteString("--\n-- TODO: these statements couldn't be inverted, so are left below as\n")
+		buf.WriteString("-- comments to replace with what undoes them:\n")
+		for _, todo := range todos {
+			fmt.Fprintf(&buf, "--   %s\n", todo)
+		}
+	}
+	for _, down := range downs {
+		buf.WriteString("\n" + down + "\n")
+	}
+	return buf.String(), nil
+}
+
+// invertStatement returns what undoes sql, a statement for dbt without its
+// trailing semicolon, or false if it isn't one GenerateDown recognizes.
+func invertStatement(dbt DBType, sql string) (string, bool) {
+	if topLevelComma(sql) && !regexCreateTable.MatchString(sql) &&
+		!regexCreateIndex.MatchString(sql) {
+		return "", false
+	}
+	if m := regexCreateTable.FindStringSubmatch(sql); m != nil {
+		return "DROP TABLE IF EXISTS " + m[1], true
+	}
+	if m := regexCreateIndex.FindStringSubmatch(sql); m != nil {
+		return dropIndex(dbt, m[1], m[2])
+	}
+	if m := regexRenameTable.FindStringSubmatch(sql); m != nil {
+		return "RENAME TABLE " + m[2] + " TO " + m[1], true
+	}
+	if m := regexAlterRename.FindStringSubmatch(sql); m != nil {
+		return renamedBack("ALTER "+strings.ToUpper(m[1]), m[2], m[3]), true
+	}
+	m := regexAlterTable.FindStringSubmatch(sql)
+	if m == nil {
+		return "", false
+	}
+	table, change := m[1], m[2]
+	alter := "ALTER TABLE " + table + " "
+	if m := regexRenameTo.FindStringSubmatch(change); m != nil {
+		return renamedBack("ALTER TABLE", table, m[1]), true
+	}
+	if m := regexRenameInTable.FindStringSubmatch(change); m != nil {
+		kind := strings.ToUpper(m[1])
+		if kind == "" {
+			kind = "COLUMN"
+		}
+		return alter + "RENAME " + kind + " " + m[3] + " TO " + m[2], true
+	}
+	if m := regexAddIndex.FindStringSubmatch(change); m != nil {
+		return alter + "DROP INDEX " + m[1], true
+	}
+	if m := regexAddColumn.FindStringSubmatch(change); m != nil &&
+		(m[1] != "" || !addKeywords[strings.ToUpper(m[2])]) {
+		return alter + "DROP COLUMN " + m[2], true
+	}
+	return "", false
+}
+
+// dropIndex returns the statement dropping index, created on table, as dbt
+// writes it, or false if GenerateDown doesn't know how it does.
+func dropIndex(dbt DBType, index, table string) (string, bool) {
+	switch dbt {
+	case DBTypeMySQL, DBTypeMariaDB, DBTypeTiDB, DBTypeMSSQL:
+		return "DROP INDEX " + index + " ON " + table, true
+	case DBTypePostgres, DBTypeCockroach, DBTypeSQLite:
+		// The index is created in its table's schema, so it's named in
+		// that schema to drop it
+		if m := regexQualified.FindStringSubmatch(index); m != nil &&
+			m[1] == "" {
+			if t := regexQualified.FindStringSubmatch(table); t != nil {
+				index = t[1] + index
+			}
+		}
+		return "DROP INDEX IF EXISTS " + index, true
+	case DBTypeOracle, DBTypeSpanner:
+		return "DROP INDEX " + index, true
+	}
+	return "", false
+}
+
+// renamedBack returns the statement starting alter which renames to back to
+// from, as ALTER ... RENAME TO names them: to is in from's schema, if from
+// names one, and from is named without it.
+func renamedBack(alter, from, to string) string {
+	schema, name := "", from
+	if m := regexQualified.FindStringSubmatch(from); m != nil {
+		schema, name = m[1], m[2]
+	}
+	if regexQualified.FindStringSubmatch(to)[1] != "" {
+		schema = ""
+	}
+	return alter + " " + schema + to + " RENAME TO " + name
+}
+
+// topLevelComma reports whether sql has a comma outside quotes, comments and
+// parentheses, such as between the changes of an ALTER TABLE.
+func topLevelComma(sql string) bool {
+	depth := 0
+	found := false
+	scanSQL(sql, func(kind tokenKind, s string) {
+		if kind != tokenCode {
+			return
+		}
+		for _, c := range s {
+			switch c {
+			case '(':
+				depth++
+			case ')':
+				depth--
+			case ',':
+				if depth == 0 {
+					found = true
+				}
+			}
+		}
+	})
+	return found
+}
+
+// firstLine returns the first line of s, with an ellipsis if it has more.
+func firstLine(s string) string {
+	if line, _, more := strings.Cut(s, "\n"); more {
+		return strings.TrimSpace(line) + " ..."
+	}
+	return s
+}
+
+// commentOut returns s with each of its lines made a -- comment.
+func commentOut(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight("-- "+line, " ")
+	}
+	return strings.Join(lines, "\n")
+}
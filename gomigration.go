@@ -0,0 +1,155 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"strings"
+	"sync"
+	"testing/fstest"
+	"time"
+)
+
+// GoMigrationFunc runs a Go migration in tx, which Migrate commits if it
+// returns nil and rolls back otherwise.
+type GoMigrationFunc func(ctx context.Context, tx *sql.Tx) error
+
+// goMigration is a registered Go migration, which is read as a file whose
+// content is its version.
+type goMigration struct {
+	version string
+	fn      GoMigrationFunc
+}
+
+var (
+	goMigrationsMu sync.Mutex
+	goMigrations   = map[string]*goMigration{}
+)
+
+// RegisterGoMigration adds a migration run by fn, for logic SQL can't express,
+// such as re-encrypting a column, to those of every Migrate. It's meant to be
+// called from init. name starts with a number, like a file's, and runs in
+// order with the files by it: "0042_backfill_keys" runs after 41_x.sql and
+// before 43_x.sql.
+//
+// The meta table records name as the migration's filename, and version as its
+// content, with a checksum of it, so changing version is reported as editing
+// the migration would be. Change it when fn changes in a way that matters.
+//
+// fn runs in a transaction, so the migration is all-or-nothing where the
+// database supports it, and has no checkpoints: if it fails, the whole of it
+// runs again on the next attempt. It needs a store implementing TxBeginner.
+// RegisterGoMigration panics if name isn't a valid name or was registered
+// already.
+func RegisterGoMigration(name, version string, fn GoMigrationFunc) {
+	goMigrationsMu.Lock()
+	defer goMigrationsMu.Unlock()
+	if err := validGoMigration(name, fn); err != nil {
+		panic(err)
+	}
+	if _, ok := goMigrations[name]; ok {
+		panic(fmt.Sprintf("migrate: go migration %s registered twice",
+			name))
+	}
+	goMigrations[name] = &goMigration{version: version, fn: fn}
+}
+
+// WithGoMigration adds a Go migration, as RegisterGoMigration does, to this
+// Migrate only, such as in tests. New reports an error if name isn't valid or
+// is registered already.
+func WithGoMigration(name, version string, fn GoMigrationFunc) Option {
+	return func(m *Migrate) {
+		if m.goMigrations == nil {
+			m.goMigrations = map[string]*goMigration{}
+		}
+		if _, ok := m.goMigrations[name]; ok {
+			m.goErr = fmt.Errorf("go migration %s added twice", name)
+			return
+		}
+		m.goMigrations[name] = &goMigration{version: version, fn: fn}
+	}
+}
+
+// validGoMigration reports an error if name can't be a migration's name.
+func validGoMigration(name string, fn GoMigrationFunc) error {
+	switch {
+	case fn == nil:
+		return fmt.Errorf("migrate: go migration %s has no func", name)
+	case !regexNum.MatchString(name) || !fs.ValidPath(name) ||
+		strings.Contains(name, "/") || isMigrationName(name):
+		return fmt.Errorf("migrate: invalid go migration name %q, which must start with a number, and be neither a path nor end in .sql or .sql.gz",
+			name)
+	}
+	return nil
+}
+
+// withGoMigrations adds the registered Go migrations, and those added with
+// WithGoMigration, to fsys as files named for them.
+func (m *Migrate) withGoMigrations(fsys fs.FS) (fs.FS, error) {
+	if m.goErr != nil {
+		return nil, m.goErr
+	}
+	gos := fstest.MapFS{}
+	goMigrationsMu.Lock()
+	for name, gm := range goMigrations {
+		gos[name] = &fstest.MapFile{Data: []byte(gm.version), Sys: gm}
+	}
+	goMigrationsMu.Unlock()
+	for name, gm := range m.goMigrations {
+		if err := validGoMigration(name, gm.fn); err != nil {
+			return nil, err
+		}
+		if _, ok := gos[name]; ok {
+			return nil, fmt.Errorf("go migration %s is registered already",
+				name)
+		}
+		gos[name] = &fstest.MapFile{Data: []byte(gm.version), Sys: gm}
+	}
+	if len(gos) == 0 {
+		return fsys, nil
+	}
+	return Merge(Source{Name: "go migrations", FS: gos},
+		Source{Name: "migrations", FS: fsys}), nil
+}
+
+// goMigrationOf reports the Go migration f is, or nil if it's a file.
+func goMigrationOf(info fs.FileInfo) *goMigration {
+	gm, _ := info.Sys().(*goMigration)
+	return gm
+}
+
+// migrateGo runs the Go migration gm, which f is, in a transaction. byt is
+// its version, which is recorded as its content.
+func (m *Migrate) migrateGo(
+	ctx context.Context,
+	f *file,
+	gm *goMigration,
+	byt []byte,
+	start time.Time,
+) error {
+	tb, ok := m.db.(TxBeginner)
+	if !ok {
+		return fmt.Errorf("%s: %T can't run go migrations, which need transactions",
+			f.Info.Name(), m.db)
+	}
+	if m.stopped() {
+		return fmt.Errorf("%s: %w", f.Info.Name(), ErrStopped)
+	}
+	m.log.Println("> go migration", f.Info.Name())
+	tx, err := tb.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%s: begin: %w", f.Info.Name(), err)
+	}
+	if err = gm.fn(ctx, tx); err != nil {
+		_ = tx.Rollback()
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s: %w", f.Info.Name(), ctx.Err())
+		}
+		return fmt.Errorf("%s: %w", f.Info.Name(), err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("%s: commit: %w", f.Info.Name(), err)
+	}
+	return m.recordMigration(ctx, f, byt, start, StatusApplied, nil)
+}
@@ -0,0 +1,77 @@
+package migrate
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// gzipSuffix ends the names of compressed migrations, such as large generated
+// seeds: 0005_seed.sql.gz is read as 0005_seed.sql would be.
+const gzipSuffix = ".sql.gz"
+
+// gunzipFS serves the .sql.gz files of fsys decompressed, so their content and
+// checksums are those of the SQL they hold, however it was compressed.
+type gunzipFS struct {
+	fsys fs.FS
+}
+
+func (g gunzipFS) Open(name string) (fs.File, error) {
+	f, err := g.fsys.Open(name)
+	if err != nil || !strings.HasSuffix(name, gzipSuffix) {
+		return f, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return g.fsys.Open(name)
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name,
+			Err: fmt.Errorf("decompress: %w", err)}
+	}
+	byt, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name,
+			Err: fmt.Errorf("decompress: %w", err)}
+	}
+	return newMemFile(info, byt), nil
+}
+
+// ReadDir lists the directory at name in fsys. The sizes of .sql.gz files in
+// it are compressed, unlike those Open reports.
+func (g gunzipFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(g.fsys, name)
+}
+
+// memFile is a file served from memory, such as a decompressed .sql.gz file.
+type memFile struct {
+	*bytes.Reader
+	info sizedInfo
+}
+
+// newMemFile returns a file of byt described by info, but for its size.
+func newMemFile(info fs.FileInfo, byt []byte) *memFile {
+	return &memFile{
+		Reader: bytes.NewReader(byt),
+		info:   sizedInfo{FileInfo: info, size: int64(len(byt))},
+	}
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Close() error               { return nil }
+
+// sizedInfo describes a file served from memory with the size of its content.
+type sizedInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (i sizedInfo) Size() int64 { return i.size }
@@ -0,0 +1,118 @@
+package migrate
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"time"
+)
+
+// History records one attempt to run a migration file, or with
+// WithVerboseHistory one of its statements, in the metahistory table. Unlike
+// meta, metahistory is only ever appended to, so it includes attempts which
+// failed and were never recorded as applied.
+type History struct {
+	// RunID identifies the invocation of Migrate which made the attempt.
+	RunID    string
+	Filename string
+
+	// Statement is the index of the statement attempted, -1 if the
+	// attempt was for the whole file, StatementRepair if it was Repair
+	// recording the file again, or StatementDown if it was Down rolling
+	// it back.
+	Statement int
+
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Success    bool
+
+	// Error describes why an attempt failed, after any redaction.
+	Error string
+
+	// Host is the hostname of the machine which ran migrate.
+	Host string
+}
+
+// StatementRepair is the Statement of History recorded by Repair, and
+// StatementDown that recorded by Down.
+const (
+	StatementRepair = -2
+	StatementDown   = -3
+)
+
+// WithVerboseHistory records an entry in metahistory for every statement
+// attempted, in addition to one for each file.
+func WithVerboseHistory() Option {
+	return func(m *Migrate) { m.verboseHistory = true }
+}
+
+// createHistory creates metahistory, if it doesn't exist, so attempts are
+// recorded in it. History is only an audit log, so migrations run without it
+// if its table can't be created.
+func (m *Migrate) createHistory(ctx context.Context) {
+	if err := m.db.CreateMetaHistoryIfNotExists(ctx); err != nil {
+		m.log.Printf("WARNING: failed to create metahistory, history won't be recorded: %v\n",
+			err)
+		return
+	}
+	m.history = true
+}
+
+// recordHistory appends an attempt started at start to metahistory, with
+// statement -1 for the whole file. History is best-effort: a failure to
+// record it is logged rather than stopping the migration.
+func (m *Migrate) recordHistory(
+	ctx context.Context,
+	f *file,
+	statement int,
+	start time.Time,
+	err error,
+) {
+	if !m.history {
+		return
+	}
+	h := History{
+		RunID:      m.runID,
+		Filename:   f.Info.Name(),
+		Statement:  statement,
+		StartedAt:  start.UTC(),
+		FinishedAt: time.Now().UTC(),
+		Success:    err == nil,
+		Host:       m.host,
+	}
+	if err != nil {
+		h.Error = m.redactSQL(err.Error())
+	}
+
+	// Record attempts interrupted by a cancelled ctx as well
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx),
+		killTimeout)
+	defer cancel()
+	if err = m.db.InsertHistory(ctx, h); err != nil {
+		m.log.Printf("WARNING: failed to record history for %s: %v\n",
+			h.Filename, err)
+	}
+}
+
+// newRunID returns a random version 4 UUID.
+func newRunID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10],
+		b[10:]), nil
+}
+
+// hostname reports the name of this machine, or an empty string if it's
+// unknown.
+func hostname() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return host
+}
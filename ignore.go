@@ -0,0 +1,220 @@
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ignoreFile lists files in the migrations directory to ignore, such as
+// notes, scripts and editor backups, one pattern per line as .gitignore does.
+const ignoreFile = ".migrateignore"
+
+// WithIgnore ignores the files in the migrations directory matching any of
+// patterns, after those in its .migrateignore, as if they were listed at the
+// end of it. See the package documentation of .migrateignore.
+func WithIgnore(patterns ...string) Option {
+	return func(m *Migrate) { m.ignore = append(m.ignore, patterns...) }
+}
+
+// WithStrictFiles refuses any file in the migrations directory which isn't a
+// migration, such as README.md, unless it's ignored, rather than skipping it.
+func WithStrictFiles() Option {
+	return func(m *Migrate) { m.strictFiles = true }
+}
+
+// ignorePattern is a line of .migrateignore. A pattern without a slash, other
+// than at its end, matches a name in any directory, and one with a slash
+// matches a path from the top of the migrations directory. One ending in a
+// slash matches only directories, and one starting with ! includes what an
+// earlier pattern ignored. * matches anything but a slash, ? one character but
+// a slash, and ** any number of directories.
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+	rooted  bool
+}
+
+// parseIgnore parses the patterns of lines, skipping blank lines and those
+// starting with #.
+func parseIgnore(lines []string) ([]ignorePattern, error) {
+	var patterns []ignorePattern
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var p ignorePattern
+		if p.negate = strings.HasPrefix(line, "!"); p.negate {
+			line = line[1:]
+		}
+		if p.dirOnly = strings.HasSuffix(line, "/"); p.dirOnly {
+			line = strings.TrimSuffix(line, "/")
+		}
+		p.rooted = strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		re, err := globRegexp(line)
+		if err != nil {
+			return nil, fmt.Errorf("bad ignore pattern %q: %w", line, err)
+		}
+		p.re = re
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// globRegexp compiles the glob pattern to a regexp matching the whole of a
+// name or path.
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if !strings.HasPrefix(pattern[i:], "**") {
+				b.WriteString("[^/]*")
+				continue
+			}
+			i++
+			if strings.HasPrefix(pattern[i+1:], "/") {
+				// **/ matches no directories or any number
+				i++
+				b.WriteString("(?:.*/)?")
+			} else {
+				b.WriteString(".*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, errors.New("unterminated [")
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// ignored reports whether patterns ignore the file or directory at name, a
+// path from the top of the migrations directory. The last pattern matching it
+// decides, and anything in an ignored directory is ignored.
+func ignored(patterns []ignorePattern, name string, isDir bool) bool {
+	if dir := path.Dir(name); dir != "." && ignored(patterns, dir, true) {
+		return true
+	}
+	var ignore bool
+	for _, p := range patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		subject := name
+		if !p.rooted {
+			subject = path.Base(name)
+		}
+		if p.re.MatchString(subject) {
+			ignore = !p.negate
+		}
+	}
+	return ignore
+}
+
+// ignoreFS leaves the files patterns ignore out of the directories of fsys,
+// recording them, and with strict, refuses the others which aren't
+// migrations.
+type ignoreFS struct {
+	fsys     fs.FS
+	patterns []ignorePattern
+	strict   bool
+
+	mu      sync.Mutex
+	skipped map[string]bool
+}
+
+// withIgnore returns fsys without the files its .migrateignore and WithIgnore
+// ignore.
+func (m *Migrate) withIgnore(fsys fs.FS) (fs.FS, error) {
+	byt, err := fs.ReadFile(fsys, ignoreFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("read %s: %w", ignoreFile, err)
+	}
+	lines := append(strings.Split(string(byt), "\n"), m.ignore...)
+	patterns, err := parseIgnore(lines)
+	if err != nil {
+		return nil, err
+	}
+	if len(patterns) == 0 && !m.strictFiles {
+		return fsys, nil
+	}
+	return &ignoreFS{
+		fsys:     fsys,
+		patterns: patterns,
+		strict:   m.strictFiles,
+		skipped:  map[string]bool{},
+	}, nil
+}
+
+func (f *ignoreFS) Open(name string) (fs.File, error) { return f.fsys.Open(name) }
+
+// ReadDir lists the directory at name in fsys without the files it ignores.
+func (f *ignoreFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(f.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	kept := make([]fs.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		p := path.Join(name, e.Name())
+		if p == ignoreFile {
+			continue
+		}
+		if ignored(f.patterns, p, e.IsDir()) {
+			f.mu.Lock()
+			f.skipped[p] = true
+			f.mu.Unlock()
+			continue
+		}
+		if f.strict && !e.IsDir() && !isMigrationName(e.Name()) {
+			return nil, fmt.Errorf("%s isn't a migration: remove it, or ignore it in %s",
+				p, ignoreFile)
+		}
+		kept = append(kept, e)
+	}
+	return kept, nil
+}
+
+// ignoredFiles returns the paths of the files and directories ignored in fsys
+// so far, sorted, if it's an ignoreFS.
+func ignoredFiles(fsys fs.FS) []string {
+	f, ok := fsys.(*ignoreFS)
+	if !ok {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := make([]string, 0, len(f.skipped))
+	for name := range f.skipped {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,128 @@
+package migrate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+)
+
+// maxIncludeDepth is the most includes can nest, so a fragment including
+// itself through many others is refused rather than expanded at length.
+const maxIncludeDepth = 10
+
+// includeFS serves the SQL files of fsys with each include directive replaced
+// by the content of the file it names, so a migration's content and checksum
+// are those of the SQL it runs, and change whenever one of its fragments does.
+// Paths are from the root of fsys, such as _fragments/grants.sql, and
+// fragments whose names don't start with a number aren't migrations
+// themselves.
+type includeFS struct {
+	fsys fs.FS
+}
+
+// migrationFS serves the files of fsys as Migrate reads them, with .sql.gz
+// files decompressed and the includes in each expanded.
+func migrationFS(fsys fs.FS) fs.FS {
+	return includeFS{fsys: gunzipFS{fsys: fsys}}
+}
+
+func (inc includeFS) Open(name string) (fs.File, error) {
+	f, err := inc.fsys.Open(name)
+	if err != nil || (!strings.HasSuffix(name, ".sql") &&
+		!strings.HasSuffix(name, gzipSuffix)) {
+		return f, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return inc.fsys.Open(name)
+	}
+	byt, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if byt, err = inc.expand(byt, []string{name}); err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return newMemFile(info, byt), nil
+}
+
+// ReadDir lists the directory at name in fsys. The sizes of files in it are
+// those before their includes are expanded, unlike those Open reports.
+func (inc includeFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(inc.fsys, name)
+}
+
+// expand returns byt, the content of the last file of stack, which each file
+// before it includes, with its includes expanded.
+func (inc includeFS) expand(byt []byte, stack []string) ([]byte, error) {
+	if !bytes.Contains(byt, []byte(includeDirective)) {
+		return byt, nil
+	}
+	var out bytes.Buffer
+	for i, line := range bytes.SplitAfter(byt, []byte("\n")) {
+		directive := string(bytes.TrimSpace(line))
+		if directive != includeDirective &&
+			!strings.HasPrefix(directive, includeDirective+" ") {
+			out.Write(line)
+			continue
+		}
+		content, err := inc.include(
+			strings.TrimSpace(directive[len(includeDirective):]), stack)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+
+		// The lines after the include stay on lines of their own
+		out.Write(content)
+		if len(content) > 0 && !bytes.HasSuffix(content, []byte("\n")) &&
+			bytes.HasSuffix(line, []byte("\n")) {
+			out.WriteByte('\n')
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// include returns the content of the file at name, which the last file of
+// stack includes, with its own includes expanded.
+func (inc includeFS) include(name string, stack []string) ([]byte, error) {
+	if name == "" {
+		return nil, fmt.Errorf("invalid directive %q, expected %s followed by a path",
+			includeDirective, includeDirective)
+	}
+	p := path.Clean(name)
+	switch {
+	case !fs.ValidPath(p):
+		return nil, fmt.Errorf("include %s: the path must be in the migrations directory",
+			name)
+	case slices.Contains(stack, p):
+		return nil, fmt.Errorf("include cycle: %s",
+			strings.Join(append(stack[:len(stack):len(stack)], p), " -> "))
+	case len(stack) > maxIncludeDepth:
+		return nil, fmt.Errorf("include %s: includes nest more than %d deep",
+			name, maxIncludeDepth)
+	}
+
+	// Errors don't wrap fs.ErrNotExist, which would report the including
+	// migration missing
+	byt, err := fs.ReadFile(inc.fsys, p)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return nil, fmt.Errorf("include %s: no such file", name)
+	case err != nil:
+		return nil, fmt.Errorf("include %s: %v", name, err)
+	}
+	byt, err = inc.expand(byt, append(stack[:len(stack):len(stack)], p))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	return byt, nil
+}
@@ -0,0 +1,415 @@
+package migrate
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// tokenKind is the kind of a run of SQL found by scanSQL.
+type tokenKind int
+
+const (
+	// tokenCode is SQL outside quotes and comments.
+	tokenCode tokenKind = iota
+
+	// tokenQuoted is a quoted string or identifier, including its quotes,
+	// such as 'it''s', "users" or `users`, or a dollar-quoted body such as
+	// $$ BEGIN ... END $$.
+	tokenQuoted
+
+	// tokenComment is a -- comment, without the newline ending it, or a
+	// /* */ comment.
+	tokenComment
+)
+
+// regexDollarTag matches the tag starting a dollar-quoted string, such as $$ or
+// $body$, but not a parameter such as $1.
+var regexDollarTag = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+// quoting is how quotes are read, as MySQL's sql_mode sets. Its zero value
+// reads them as MySQL does by default, with backslashes escaping the next
+// character in single and double quotes, which quote strings.
+type quoting struct {
+	// noBackslashEscapes reads backslashes as themselves, as
+	// NO_BACKSLASH_ESCAPES does
+	noBackslashEscapes bool
+
+	// ansiQuotes reads double quotes as quoting identifiers, in which
+	// backslashes are themselves, as ANSI_QUOTES does
+	ansiQuotes bool
+}
+
+// escapes reports whether a backslash escapes the next character in the quotes
+// q.
+func (qt quoting) escapes(q byte) bool {
+	switch q {
+	case '\'':
+		return !qt.noBackslashEscapes
+	case '"':
+		return !qt.noBackslashEscapes && !qt.ansiQuotes
+	}
+	return false
+}
+
+// scanSQL calls fn with each run of src in order, so joining them gives src
+// back. Quotes are read as MySQL reads them by default, whatever the sql_mode
+// the file is split for, so checksums don't depend on it, and a doubled quote
+// is an escaped quote. An unterminated quote or comment runs to the end of
+// src.
+func scanSQL(src string, fn func(kind tokenKind, s string)) {
+	start := 0
+	emit := func(kind tokenKind, end int) {
+		if end > start {
+			fn(kind, src[start:end])
+		}
+		start = end
+	}
+	for i := 0; i < len(src); {
+		kind, end, ok := tokenAt(src, i, quoting{})
+		if !ok {
+			i++
+			continue
+		}
+		emit(tokenCode, i)
+		emit(kind, end)
+		i = end
+	}
+	emit(tokenCode, len(src))
+}
+
+// tokenAt returns the kind and end of the quote or comment starting at i in
+// src, reading quotes by qt, or false if none does.
+func tokenAt(src string, i int, qt quoting) (tokenKind, int, bool) {
+	switch c := src[i]; {
+	case strings.HasPrefix(src[i:], "--"):
+		return tokenComment, i + strings.IndexByte(src[i:]+"\n", '\n'), true
+	case strings.HasPrefix(src[i:], "/*"):
+		if j := strings.Index(src[i+2:], "*/"); j >= 0 {
+			return tokenComment, i + 2 + j + 2, true
+		}
+		return tokenComment, len(src), true
+	case c == '\'' || c == '"' || c == '`':
+		return tokenQuoted, quoteEnd(src, i, qt), true
+	case c == '$' && (i == 0 || !isIdentByte(src[i-1])) &&
+		regexDollarTag.MatchString(src[i:]):
+		tag := regexDollarTag.FindString(src[i:])
+		if j := strings.Index(src[i+len(tag):], tag); j >= 0 {
+			return tokenQuoted, i + len(tag) + j + len(tag), true
+		}
+		return tokenQuoted, len(src), true
+	}
+	return 0, 0, false
+}
+
+// quoteEnd returns the offset just past the quote closing the one at i in src,
+// reading backslashes by qt.
+func quoteEnd(src string, i int, qt quoting) int {
+	q := src[i]
+	for j := i + 1; j < len(src); j++ {
+		switch {
+		case src[j] == '\\' && qt.escapes(q):
+			j++
+		case src[j] == q && j+1 < len(src) && src[j+1] == q:
+			j++
+		case src[j] == q:
+			return j + 1
+		}
+	}
+	return len(src)
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || isDigit(c) || ('a' <= c && c <= 'z') ||
+		('A' <= c && c <= 'Z')
+}
+
+// hashComment returns the end of the # comment starting at i in src, as MySQL
+// writes them, or false if none does. A # starts one only if it's the first
+// thing on its line or in its statement, which starts at start, so it isn't
+// taken for PostgreSQL's # operators, such as in data #> '{a}'.
+func hashComment(src string, start, i int) (int, bool) {
+	if src[i] != '#' {
+		return 0, false
+	}
+	line := max(start, strings.LastIndexByte(src[:i], '\n')+1)
+	if strings.TrimLeft(src[line:i], " \t") != "" {
+		return 0, false
+	}
+	return i + strings.IndexByte(src[i:]+"\n", '\n'), true
+}
+
+// lineCommentEnd returns the end of the -- or # comment s starts with, or
+// false if it doesn't start with one.
+func lineCommentEnd(s string) (int, bool) {
+	if strings.HasPrefix(s, "--") {
+		return strings.IndexByte(s+"\n", '\n'), true
+	}
+	if s == "" {
+		return 0, false
+	}
+	return hashComment(s, 0, 0)
+}
+
+// isExecutableComment reports whether s is a /* */ comment MySQL runs, either
+// version-conditional such as /*!40101 SET NAMES utf8 */, or MariaDB's /*M!
+// form, or an optimizer hint such as /*+ BKA(t) */.
+func isExecutableComment(s string) bool {
+	return strings.HasPrefix(s, "/*!") || strings.HasPrefix(s, "/*+") ||
+		strings.HasPrefix(s, "/*M!")
+}
+
+// hasSQL reports whether s has anything to run outside its comments, counting
+// executable comments as SQL.
+func hasSQL(s string) bool {
+	for i := 0; i < len(s); {
+		if end, ok := hashComment(s, 0, i); ok {
+			i = end
+			continue
+		}
+		kind, end, ok := tokenAt(s, i, quoting{})
+		switch {
+		case ok && kind == tokenComment && !isExecutableComment(s[i:end]):
+			i = end
+		case ok || !unicode.IsSpace(rune(s[i])):
+			return true
+		default:
+			i++
+		}
+	}
+	return false
+}
+
+// skipComments returns s from its first SQL, after the whitespace and comments
+// it starts with, other than executable ones.
+func skipComments(s string) string {
+	for {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		end, ok := lineCommentEnd(s)
+		if !ok && strings.HasPrefix(s, "/*") && !isExecutableComment(s) {
+			_, end, ok = tokenAt(s, 0, quoting{})
+		}
+		if !ok {
+			return s
+		}
+		s = s[end:]
+	}
+}
+
+// regexCompound matches the start of a statement defining a stored program,
+// whose body may be a BEGIN ... END block of statements ending in semicolons,
+// as MySQL, MariaDB and SQLite write them.
+var regexCompound = regexp.MustCompile(`(?is)^create\s+(or\s+replace\s+)?` +
+	`(definer\s*=\s*\S+\s+)?((temp|temporary|aggregate)\s+)?` +
+	`(procedure|function|trigger|event)\b`)
+
+// endsUncounted are the words after END which end a block blockDepth doesn't
+// count, such as END IF.
+var endsUncounted = map[string]bool{
+	"IF": true, "LOOP": true, "WHILE": true, "REPEAT": true, "FOR": true,
+}
+
+// blockDepth returns depth, how many BEGIN ... END and CASE ... END blocks are
+// open before s, after those s opens and ends, reading quotes by qt. IF, LOOP,
+// WHILE, REPEAT and FOR blocks end in their own END IF and so on, so aren't
+// counted, while a CASE ends in END whether it's a statement, ending in END
+// CASE, or an expression.
+func blockDepth(s string, depth int, qt quoting) int {
+	var prev string
+	for i := 0; i < len(s); {
+		if end, ok := hashComment(s, 0, i); ok {
+			i = end
+			continue
+		}
+		if _, end, ok := tokenAt(s, i, qt); ok {
+			i = end
+			continue
+		}
+		if !isIdentByte(s[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(s) && isIdentByte(s[j]) {
+			j++
+		}
+		word := strings.ToUpper(s[i:j])
+		i = j
+		switch {
+		case prev == "END" && word == "CASE":
+			// Ended already by its END
+		case prev == "END" && endsUncounted[word]:
+			// END IF and so on end no block counted, but the END
+			// before them was taken for one
+			depth++
+		case word == "BEGIN", word == "CASE":
+			depth++
+		case word == "END":
+			depth--
+		}
+		prev = word
+	}
+	return max(depth, 0)
+}
+
+// regexDelimiter matches a DELIMITER line, as the mysql client reads them,
+// such as DELIMITER // or DELIMITER ;, capturing the new delimiter.
+var regexDelimiter = regexp.MustCompile(`^(?i)[ \t]*delimiter[ \t]+(\S+)[^\n]*\n?`)
+
+// sqlPart is a part of src split by splitSQL, at off in src. delimited is set
+// if it was split by a DELIMITER line's delimiter rather than a semicolon.
+type sqlPart struct {
+	s         string
+	off       int
+	delimited bool
+}
+
+// splitSQL splits src at each semicolon outside quotes and comments, as
+// strings.Split would were there none in them. Quotes are read by qt, and
+// comments also include those hashComment finds, so no semicolon in a comment
+// splits, even an executable one's. After a DELIMITER line, as the mysql
+// client reads them, parts are split at its delimiter instead, so a trigger or
+// procedure with semicolons in its body is one part, until another sets it
+// back to a semicolon. DELIMITER lines themselves end the part before them and
+// are left out.
+func splitSQL(src string, qt quoting) []sqlPart {
+	parts := []sqlPart{}
+	delim := ";"
+	start := 0
+	split := func(end, next int) {
+		parts = append(parts, sqlPart{s: src[start:end], off: start,
+			delimited: delim != ";"})
+		start = next
+	}
+	for i := 0; i < len(src); {
+		if i == 0 || src[i-1] == '\n' {
+			if loc := regexDelimiter.FindStringSubmatchIndex(src[i:]); loc != nil {
+				split(i, i+loc[1])
+				delim = src[i+loc[2] : i+loc[3]]
+				i = start
+				continue
+			}
+		}
+
+		// The delimiter comes first, as one such as $$ would otherwise
+		// start a quote
+		if strings.HasPrefix(src[i:], delim) {
+			split(i, i+len(delim))
+			i = start
+			continue
+		}
+		if end, ok := hashComment(src, start, i); ok {
+			i = end
+			continue
+		}
+		if _, end, ok := tokenAt(src, i, qt); ok {
+			i = end
+			continue
+		}
+		i++
+	}
+	return append(parts, sqlPart{s: src[start:], off: start,
+		delimited: delim != ";"})
+}
+
+// normalizeSQL returns src without its comments, other than directives, with
+// each run of whitespace outside quotes as a single space, and without
+// whitespace at its start or whitespace and semicolons at its end, so
+// reformatting a migration
+// doesn't change its normalized checksum. Quoted strings are left as they are.
+// Executable comments are left out like any other, as they were when the
+// normalized checksums recorded already were.
+func normalizeSQL(src []byte) []byte {
+	return normalize(src, func(string) bool { return false })
+}
+
+// normalize is normalizeSQL, but also keeping the comments keep reports true
+// for.
+func normalize(src []byte, keep func(comment string) bool) []byte {
+	var b strings.Builder
+	space := false
+
+	// quoted is the end of the last quote or directive, which trimming
+	// the end mustn't reach into
+	quoted := 0
+	scanSQL(string(src), func(kind tokenKind, s string) {
+		switch kind {
+		case tokenComment:
+			if !strings.HasPrefix(s, directivePrefix) && !keep(s) {
+				space = true
+				return
+			}
+			s = strings.TrimSpace(s)
+		case tokenCode:
+			for _, r := range s {
+				if unicode.IsSpace(r) {
+					space = true
+					continue
+				}
+				if space && b.Len() > 0 {
+					b.WriteByte(' ')
+				}
+				space = false
+				b.WriteRune(r)
+			}
+			return
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteString(s)
+		quoted = b.Len()
+	})
+	s := b.String()
+	return []byte(s[:quoted] + strings.TrimRight(s[quoted:], "; "))
+}
+
+// cosmeticForm returns src normalized as normalizeSQL does, but keeping
+// executable comments and without the spaces next to parentheses, commas and
+// semicolons, so two migrations with the same form differ only in their
+// comments and whitespace, such as when one puts a column on each line.
+func cosmeticForm(src []byte) string {
+	s := string(normalize(src, isExecutableComment))
+	var b strings.Builder
+	scanSQL(s, func(kind tokenKind, t string) {
+		if kind != tokenCode {
+			b.WriteString(t)
+			return
+		}
+		for i := 0; i < len(t); i++ {
+			if t[i] == ' ' && (i > 0 && isTight(t[i-1]) ||
+				i+1 < len(t) && isTight(t[i+1])) {
+				continue
+			}
+			b.WriteByte(t[i])
+		}
+	})
+	return b.String()
+}
+
+// trimTail returns src without the whitespace, semicolons and comments after
+// its last statement, so ending a migration with another newline or an
+// -- end comment doesn't change its checksum.
+func trimTail(src []byte) []byte {
+	end, off := 0, 0
+	scanSQL(string(src), func(kind tokenKind, s string) {
+		off += len(s)
+		switch {
+		case kind == tokenQuoted,
+			kind == tokenComment && isExecutableComment(s):
+			end = off
+		case kind == tokenCode:
+			t := strings.TrimRightFunc(s, func(r rune) bool {
+				return r == ';' || unicode.IsSpace(r)
+			})
+			if t != "" {
+				end = off - len(s) + len(t)
+			}
+		}
+	})
+	return src[:end]
+}
+
+// isTight reports whether c is punctuation whose spacing never matters.
+func isTight(c byte) bool { return strings.IndexByte("(),;", c) >= 0 }
@@ -0,0 +1,315 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Defaults for WithLockLease. A run whose heartbeats stop for longer than
+// DefaultLockStaleAfter, such as one which crashed, may have its lock taken
+// over, so the threshold should comfortably exceed both the heartbeat and
+// any clock skew between the machines running migrate.
+const (
+	DefaultLockHeartbeat  = 10 * time.Second
+	DefaultLockStaleAfter = time.Minute
+)
+
+// DefaultLockPoll is how often Migrate tries again to take a held lock when
+// WithLockWait is given no poll interval.
+const DefaultLockPoll = 5 * time.Second
+
+// errUpToDate reports that another run applied every file while Migrate
+// waited for the lock.
+var errUpToDate = errors.New("up to date")
+
+// MetaLock is the row of metalock recording which run of migrate holds the
+// lock. Times are recorded by the machine running migrate, in UTC.
+type MetaLock struct {
+	// Holder is the RunID of the run holding the lock.
+	Holder   string
+	Hostname string
+	PID      int
+
+	// Filename is the migration file the holder is applying, or empty
+	// between files.
+	Filename string
+
+	AcquiredAt  time.Time
+	HeartbeatAt time.Time
+}
+
+func (l MetaLock) String() string {
+	s := fmt.Sprintf("run %s on %s (pid %d) since %s, last heartbeat %s",
+		l.Holder, l.Hostname, l.PID, l.AcquiredAt.Format(time.RFC3339),
+		l.HeartbeatAt.Format(time.RFC3339))
+	if l.Filename != "" {
+		s += ", applying " + l.Filename
+	}
+	return s
+}
+
+// LockInfo describes the lock in metalock, as LockStatus reports it.
+type LockInfo struct {
+	MetaLock
+
+	// Stale reports whether the holder's last heartbeat is older than
+	// DefaultLockStaleAfter, so it has likely died.
+	Stale bool
+}
+
+// WithLockWait sets how long Migrate waits for another run to release the lock
+// in metalock, trying again every pollInterval, or DefaultLockPoll if it's
+// zero. Between tries, Migrate checks whether the other run has applied every
+// file, in which case it reports that nothing was migrated without taking the
+// lock. Without WithLockWait, Migrate reports an error wrapping ErrLocked at
+// once.
+func WithLockWait(timeout, pollInterval time.Duration) Option {
+	return func(m *Migrate) {
+		m.lockTimeout = timeout
+		m.lockPoll = pollInterval
+		if m.lockPoll <= 0 {
+			m.lockPoll = DefaultLockPoll
+		}
+	}
+}
+
+// WithoutLocking disables the lock in metalock, for pipelines which guarantee
+// only one run migrates a database at a time, such as a dedicated CI job.
+// Migrate neither creates metalock nor takes the lock, but still decides again
+// which files are pending before it applies any, and logs a warning each run.
+// Two runs without the lock may apply the same file twice.
+func WithoutLocking() Option {
+	return func(m *Migrate) { m.noLock = true }
+}
+
+// WithLockLease sets how often Migrate records a heartbeat on the lock it
+// holds, and how long after the last heartbeat another run may take the lock
+// over, replacing DefaultLockHeartbeat and DefaultLockStaleAfter. staleAfter
+// must be longer than heartbeat.
+func WithLockLease(heartbeat, staleAfter time.Duration) Option {
+	return func(m *Migrate) {
+		m.lockHeartbeat = heartbeat
+		m.lockStaleAfter = staleAfter
+	}
+}
+
+// LockStatus reports the lock in metalock, or nil if no run holds it.
+func LockStatus(ctx context.Context, db Store) (*LockInfo, error) {
+	if err := db.CreateMetaLockIfNotExists(ctx); err != nil {
+		return nil, errors.Wrap(err, "create meta lock table")
+	}
+	lock, err := db.GetMetaLock(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get meta lock")
+	}
+	if lock == nil {
+		return nil, nil
+	}
+	return &LockInfo{
+		MetaLock: *lock,
+		Stale:    time.Since(lock.HeartbeatAt) > DefaultLockStaleAfter,
+	}, nil
+}
+
+// ForceUnlock deletes the lock in metalock, such as one left by a run which
+// crashed, rather than waiting for another run to take it over. Unless force
+// is set, it reports an *ErrLockHeld if the lock isn't stale, since its holder
+// is likely still running. A holder which is still alive stops with
+// ErrLockLost at its next heartbeat.
+func ForceUnlock(ctx context.Context, db Store, force bool) error {
+	info, err := LockStatus(ctx, db)
+	if err != nil || info == nil {
+		return err
+	}
+	switch {
+	case force:
+		err = db.DeleteMetaLock(ctx)
+	case !info.Stale:
+		return &ErrLockHeld{Lock: *info}
+	default:
+		// Leave a lock which another run has taken since
+		err = db.ReleaseMetaLock(ctx, info.Holder)
+	}
+	if err != nil {
+		return errors.Wrap(err, "delete meta lock")
+	}
+	return nil
+}
+
+// lock holds the lock in metalock as holdLock does, or with WithoutLocking
+// warns that nothing stops another run instead. release is always safe to
+// call, and must be called once the run is done.
+func (m *Migrate) lock(ctx context.Context) (context.Context, func(), error) {
+	if m.noLock {
+		m.log.Println("WARNING: locking is disabled, so nothing stops another run migrating this database at the same time")
+		return ctx, func() {}, nil
+	}
+	ctx, release, err := m.holdLock(ctx)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "lock")
+	}
+	return ctx, release, nil
+}
+
+// holdLock takes the lock in metalock, then records heartbeats on it until
+// release is called. The returned context is cancelled with an error wrapping
+// ErrLockLost if the lock is lost. Releasing stops the heartbeats and deletes
+// the lock, even once ctx is cancelled.
+func (m *Migrate) holdLock(
+	ctx context.Context,
+) (context.Context, func(), error) {
+	if m.lockHeartbeat <= 0 || m.lockStaleAfter <= m.lockHeartbeat {
+		return nil, nil, fmt.Errorf("lock staleness of %s must be longer than the heartbeat of %s",
+			m.lockStaleAfter, m.lockHeartbeat)
+	}
+	if err := m.acquireLock(ctx); err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.heartbeat(ctx, cancel, stop)
+	}()
+	release := func() {
+		close(stop)
+		<-done
+		cancel(nil)
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx),
+			killTimeout)
+		defer cancel()
+		if err := m.db.ReleaseMetaLock(ctx, m.runID); err != nil {
+			m.log.Printf("WARNING: failed to release lock: %v\n", err)
+		}
+	}
+	return ctx, release, nil
+}
+
+// acquireLock tries to take the lock every lockPoll until the lock timeout,
+// reporting errUpToDate if another run applies every file in the meantime.
+func (m *Migrate) acquireLock(ctx context.Context) error {
+	start := time.Now()
+	deadline := start.Add(m.lockTimeout)
+	for {
+		now := time.Now().UTC()
+		lock := MetaLock{
+			Holder:      m.runID,
+			Hostname:    m.host,
+			PID:         os.Getpid(),
+			AcquiredAt:  now,
+			HeartbeatAt: now,
+		}
+		ok, err := m.db.AcquireMetaLock(ctx, lock,
+			now.Add(-m.lockStaleAfter))
+		if err != nil {
+			return errors.Wrap(err, "acquire meta lock")
+		}
+		if ok {
+			return nil
+		}
+		if time.Now().Add(m.lockPoll).After(deadline) {
+			return m.lockedErr(ctx)
+		}
+		m.log.Printf("waiting for the lock, %s so far: %v\n",
+			time.Since(start).Round(time.Second), m.lockedErr(ctx))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(m.lockPoll):
+		}
+		if err = m.checkApplied(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// checkApplied reads the meta tables again while another run holds the lock,
+// reporting errUpToDate once it has applied every file.
+func (m *Migrate) checkApplied(ctx context.Context) error {
+	v, err := m.db.CreateMetaVersionIfNotExists(ctx, version)
+	if err != nil {
+		return errors.Wrap(err, "get meta version")
+	}
+	if v > version {
+		return &ErrVersionTooNew{Have: v, Want: version}
+	}
+	if m.one || m.rerun != "" {
+		return nil
+	}
+	if err = m.reloadMigrations(ctx); err != nil {
+		return errors.Wrap(err, "reload migrations")
+	}
+	if len(m.Migrations) >= len(m.Files) && len(m.reruns) == 0 ||
+		m.upTo != "" && len(m.toRun()) == 0 {
+		return errUpToDate
+	}
+	return nil
+}
+
+// lockedErr reports ErrLocked with the run holding the lock, if it can be
+// read.
+func (m *Migrate) lockedErr(ctx context.Context) error {
+	lock, err := m.db.GetMetaLock(ctx)
+	if err != nil || lock == nil {
+		return ErrLocked
+	}
+	return fmt.Errorf("%w: held by %s", ErrLocked, lock)
+}
+
+// setLockFilename records the file Migrate is applying in the lock, so
+// LockStatus can report it. It's only informational, so a failure is logged.
+func (m *Migrate) setLockFilename(ctx context.Context, filename string) {
+	if m.noLock {
+		return
+	}
+	err := m.db.SetMetaLockFilename(ctx, m.runID, filename)
+	if err != nil {
+		m.log.Printf("WARNING: failed to record %s in lock: %v\n", filename,
+			err)
+	}
+}
+
+// heartbeat records a heartbeat on the lock every lockHeartbeat until stop is
+// closed. Failed heartbeats are tried again, unless the lock would become
+// stale before the next, when the run is cancelled before another can take
+// the lock over.
+func (m *Migrate) heartbeat(
+	ctx context.Context,
+	cancel context.CancelCauseFunc,
+	stop <-chan struct{},
+) {
+	ticker := time.NewTicker(m.lockHeartbeat)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		held, err := m.db.HeartbeatMetaLock(ctx, m.runID, now.UTC())
+		switch {
+		case err == nil && held:
+			last = now
+		case err == nil:
+			cancel(fmt.Errorf("%w: it was taken over or force unlocked",
+				ErrLockLost))
+			return
+		case now.Sub(last)+m.lockHeartbeat >= m.lockStaleAfter:
+			cancel(fmt.Errorf("%w: no heartbeat for %s: %w", ErrLockLost,
+				now.Sub(last).Round(time.Millisecond), err))
+			return
+		default:
+			m.log.Printf("WARNING: failed to record lock heartbeat: %v\n",
+				err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package migrate
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"testing/fstest"
+)
+
+// MemorySource serves files, by filename, as an FS for NewFS, such as to test
+// an application's migrations with a SQLite store and no directory of files.
+// Files in a subdirectory named for a database, such as "mysql/2.sql",
+// override those for it as usual. Their checksums are just as they'd be from
+// a directory.
+//
+// Reading the FS fails for a filename which would be skipped from a
+// directory, such as one without a leading number or a .sql extension, so a
+// test can't pass without running it.
+func MemorySource(files map[string]string) fs.FS {
+	fsys := memoryFS{files: fstest.MapFS{}}
+	for name, content := range files {
+		if !fs.ValidPath(name) || name == "." ||
+			!isMigrationName(path.Base(name)) {
+			fsys.err = fmt.Errorf("%s is not a migration filename, which must start with a number and end in .sql", name)
+			break
+		}
+		fsys.files[name] = &fstest.MapFile{Data: []byte(content)}
+	}
+	return fsys
+}
+
+// MemoryBuilder builds a MemorySource from migrations added in order. The
+// zero value is empty and ready to use:
+//
+//	fsys := new(migrate.MemoryBuilder).
+//		Add("create_users", "CREATE TABLE users (id INT)").
+//		Add("", "INSERT INTO users VALUES (1)").
+//		Source()
+type MemoryBuilder struct {
+	files map[string]string
+}
+
+// Add adds a migration of content after those already added, numbering it
+// from 1. A name describes it in its filename, such as "2_create_users.sql".
+func (b *MemoryBuilder) Add(name, content string) *MemoryBuilder {
+	if b.files == nil {
+		b.files = map[string]string{}
+	}
+	filename := fmt.Sprintf("%d.sql", len(b.files)+1)
+	if name != "" {
+		filename = fmt.Sprintf("%d_%s.sql", len(b.files)+1, name)
+	}
+	b.files[filename] = content
+	return b
+}
+
+// Source serves the migrations added so far.
+func (b *MemoryBuilder) Source() fs.FS { return MemorySource(b.files) }
+
+// memoryFS serves files, or err if a filename was invalid.
+type memoryFS struct {
+	files fstest.MapFS
+	err   error
+}
+
+func (m memoryFS) Open(name string) (fs.File, error) {
+	if m.err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: m.err}
+	}
+	return m.files.Open(name)
+}
@@ -0,0 +1,102 @@
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+)
+
+// Source is a named FS of migration files for Merge, such as a directory. Its
+// name describes it in errors.
+type Source struct {
+	Name string
+	FS   fs.FS
+}
+
+// MergeDirs merges the migrations directories dirs, as Merge does.
+func MergeDirs(dirs ...string) (fs.FS, error) {
+	sources := make([]Source, 0, len(dirs))
+	for _, dir := range dirs {
+		fsys, err := dirFS(dir)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, Source{Name: dir, FS: fsys})
+	}
+	return Merge(sources...), nil
+}
+
+// Merge merges the files of sources, such as directories of schema and data
+// migrations and those of a shared library, into one FS for NewFS. Their
+// files are ordered together by the usual rules, and recorded by their bare
+// filenames, so they may later move between sources. Subdirectories of the
+// same name merge too, so each source may override files for a database.
+//
+// A migration in more than one source is an error naming both when the
+// files are read. Other files, such as a README in each, are taken from the
+// first source holding them.
+func Merge(sources ...Source) fs.FS {
+	return mergedFS(sources)
+}
+
+type mergedFS []Source
+
+// Open opens name from the first source holding it.
+func (m mergedFS) Open(name string) (fs.File, error) {
+	for _, src := range m {
+		f, err := src.FS.Open(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		return f, err
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// ReadDir lists the directory at name in every source holding it, sorted by
+// name.
+func (m mergedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	type found struct {
+		entry  fs.DirEntry
+		source string
+	}
+	byName := map[string]found{}
+	var exists bool
+	for _, src := range m {
+		entries, err := fs.ReadDir(src.FS, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", src.Name, err)
+		}
+		exists = true
+		for _, e := range entries {
+			prev, ok := byName[e.Name()]
+			switch {
+			case !ok:
+				byName[e.Name()] = found{entry: e, source: src.Name}
+			case prev.entry.IsDir() && e.IsDir():
+			case isMigrationName(e.Name()):
+				file := path.Join(name, e.Name())
+				return nil, fmt.Errorf("%s is in both %s and %s",
+					e.Name(), path.Join(prev.source, file),
+					path.Join(src.Name, file))
+			}
+		}
+	}
+	if !exists {
+		return nil, &fs.PathError{Op: "readdir", Path: name,
+			Err: fs.ErrNotExist}
+	}
+	entries := make([]fs.DirEntry, 0, len(byName))
+	for _, f := range byName {
+		entries = append(entries, f.entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
@@ -2,23 +2,90 @@ package migrate
 
 import (
 	"bytes"
-	"crypto/md5"
+	"context"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
+	"os/user"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
-	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/pkg/errors"
 )
 
 // version of the migrate tool's database schema.
-const version = 1
+const version = 6
+
+// ToolVersion is the version of migrate, which is recorded alongside each
+// migration it applies.
+const ToolVersion = "v1.0.0rc5"
+
+// maxErrSQL is the most SQL included in an ErrStatementFailed.
+const maxErrSQL = 300
+
+// Directives change how a migration file runs. They must be on the file's
+// first lines, one per line.
+const (
+	// multiDirective marks a file whose content must run as a single
+	// batch rather than statement by statement.
+	multiDirective = "-- migrate:multi"
+
+	// noSplitDirective marks a file whose content runs as a single
+	// statement, with one checkpoint, rather than being split. Unlike a
+	// multi file, it resumes from its checkpoint.
+	noSplitDirective = "-- migrate:no-split"
+
+	// noRetryDirective marks a file whose statements aren't safe to run
+	// again after a transient error.
+	noRetryDirective = "-- migrate:no-retry"
+
+	// timeoutDirective overrides the statement timeout, such as with
+	// "-- migrate:timeout 30m", or disables it with "off". At the start of
+	// a file it applies to every statement, otherwise to the statement
+	// which follows.
+	timeoutDirective = "-- migrate:timeout"
+
+	// includeDirective, on a line of its own anywhere in a file, is
+	// replaced by the content of the file it names, such as with
+	// "-- migrate:include _fragments/grants.sql", before the file is
+	// checksummed or split.
+	includeDirective = "-- migrate:include"
+
+	// rerunAlwaysDirective marks a file which runs again whenever it
+	// changes after it was applied, such as one creating or replacing
+	// views, rather than being reported as mismatched.
+	rerunAlwaysDirective = "-- migrate:rerun-always"
+
+	// transactionDirective marks a file whose statements run in one
+	// transaction, all or nothing, without checkpoints.
+	transactionDirective = "-- migrate:transaction"
+
+	directivePrefix = "-- migrate:"
+)
+
+// Defaults for retrying statements which fail with transient errors, such as
+// deadlocks. The backoff doubles after each attempt.
+const (
+	DefaultRetryAttempts = 3
+	DefaultRetryBackoff  = 100 * time.Millisecond
+)
+
+// killTimeout bounds asking the store to kill a statement which ran out of
+// time.
+const killTimeout = 10 * time.Second
+
+// DefaultReconnectAttempts is how many times Migrate reconnects in one run
+// after losing its connection to the database.
+const DefaultReconnectAttempts = 3
 
 var (
 	spaces    = regexp.MustCompile(`\s+`)
@@ -29,307 +96,1956 @@ type Migrate struct {
 	Migrations []Migration
 	Files      []*file
 
-	db  Store
-	log Logger
-	idx int
+	// Results describes each file Migrate ran, including one which
+	// failed.
+	Results []FileResult
+
+	// Modified are the applied migrations whose files were modified,
+	// which New continued past under WithModifiedPolicy.
+	Modified []ModifiedFile
+
+	db   Store
+	log  Logger
+	idx  int
+	fsys fs.FS
+
+	retryAttempts int
+	retryBackoff  time.Duration
+	redact        func(string) string
+
+	reconnectAttempts int
+	reconnects        int
+
+	statementTimeout time.Duration
+	strictWarnings   bool
+	appliedBy        string
+	appVersion       string
+	upgrade          bool
+	resume           bool
+
+	// concurrency, continueOnError and storeNames configure MigrateAll.
+	concurrency     int
+	continueOnError bool
+	storeNames      []string
+
+	// lockTimeout, lockPoll, lockHeartbeat and lockStaleAfter configure
+	// the lock in metalock
+	lockTimeout    time.Duration
+	lockPoll       time.Duration
+	lockHeartbeat  time.Duration
+	lockStaleAfter time.Duration
+
+	// noLock is set by WithoutLocking.
+	noLock bool
+
+	// ordering is set by WithOrdering. See order.
+	ordering Ordering
+
+	// splitter is set by WithSplitter. See split.
+	splitter Splitter
+
+	// env is set by WithEnvironment, and envs by WithEnvironments.
+	env  string
+	envs []string
+
+	// ignore is set by WithIgnore, and strictFiles by WithStrictFiles.
+	ignore      []string
+	strictFiles bool
+
+	// subdirs is set by WithSubdirectories, and renameMoved by
+	// WithRenameMoved.
+	subdirs     bool
+	renameMoved bool
+
+	// allowRename is set by WithAllowRename, and forceRepair by
+	// WithForceRepair.
+	allowRename bool
+	forceRepair bool
+
+	// diffLines is set by WithDiffLines.
+	diffLines int
+
+	// modifiedPolicy is set by WithModifiedPolicy, and production by
+	// WithProduction.
+	modifiedPolicy ModifiedPolicy
+	production     bool
+
+	// algo is set by WithChecksumAlgo, and normalizeChecksums by
+	// WithNormalizedChecksums. See checksumAlgo.
+	algo               string
+	normalizeChecksums bool
+
+	// allowOutOfOrder is set by WithAllowOutOfOrder.
+	allowOutOfOrder bool
+
+	// noMixedNumbering is set by WithoutMixedNumbering, and gaps by
+	// WithGapPolicy.
+	noMixedNumbering bool
+	gaps             GapPolicy
+
+	// one is set by ApplyOne, whose only file needn't follow the others
+	// recorded.
+	one bool
+
+	// reruns are the applied files to run again: rerun-always files which
+	// changed, and rerun, the file Rerun runs.
+	reruns map[string]bool
+	rerun  string
+
+	// transactions is set by WithTransactions.
+	transactions bool
+
+	// upTo is the last file to run, set by WithUpTo.
+	upTo string
+
+	// steps is the most files to run, if limitSteps is set by Steps.
+	steps      int
+	limitSteps bool
+
+	// goMigrations are added by WithGoMigration, which sets goErr if one
+	// was added twice.
+	goMigrations map[string]*goMigration
+	goErr        error
+
+	// maxContent is the ContentLimiter's limit, or zero if there's none.
+	maxContent int64
+
+	// autoRollback is set by WithAutoRollbackOnFailure.
+	autoRollback bool
+
+	// rollbacks describes each migration the last rollback rolled back.
+	rollbacks []FileResult
+
+	// plan is set by WithDryRun, and noMeta once a dry run finds the meta
+	// tables don't exist yet.
+	plan   *Plan
+	noMeta bool
+
+	// history is set once metahistory exists. runID and host are
+	// recorded with each entry.
+	history        bool
+	verboseHistory bool
+	runID          string
+	host           string
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Option configures Migrate.
+type Option func(*Migrate)
+
+// WithRetry sets how many times a statement may run when it fails with an
+// error the Store reports as retryable, and how long to wait before the
+// first retry. One attempt disables retries.
+func WithRetry(attempts int, backoff time.Duration) Option {
+	return func(m *Migrate) {
+		m.retryAttempts = attempts
+		m.retryBackoff = backoff
+	}
+}
+
+// WithReconnect sets how many times Migrate reconnects in one run after losing
+// its connection, such as when a proxy times out a long ALTER. Zero disables
+// reconnecting.
+func WithReconnect(attempts int) Option {
+	return func(m *Migrate) { m.reconnectAttempts = attempts }
+}
+
+// WithStatementTimeout limits how long each statement may run, which files
+// may override with a "-- migrate:timeout" directive. Zero, the default,
+// disables the limit.
+func WithStatementTimeout(timeout time.Duration) Option {
+	return func(m *Migrate) { m.statementTimeout = timeout }
+}
+
+// WithStrictWarnings stops Migrate after a statement which succeeds with
+// warnings, before its file is recorded as applied. Warnings are only
+// reported by stores implementing WarningReporter.
+func WithStrictWarnings() Option {
+	return func(m *Migrate) { m.strictWarnings = true }
+}
+
+// WithAppliedBy sets who is recorded as applying each migration, replacing
+// the default of the current user and hostname, such as "deploy@ci-42".
+func WithAppliedBy(appliedBy string) Option {
+	return func(m *Migrate) { m.appliedBy = appliedBy }
+}
+
+// WithAppVersion sets the release of the application deploying the
+// migrations, such as "v1.42.0+sha.abc123", which is recorded with each one.
+// Nothing is recorded by default.
+func WithAppVersion(appVersion string) Option {
+	return func(m *Migrate) { m.appVersion = appVersion }
+}
+
+// WithUpgrade allows New to upgrade the meta tables of an existing database to
+// the current meta version. Older versions of migrate refuse to run against
+// upgraded tables, so upgrade only once they're no longer in use. Without it,
+// New reports an *ErrUpgradeRequired.
+func WithUpgrade() Option {
+	return func(m *Migrate) { m.upgrade = true }
+}
+
+// WithResume allows New to continue from a migration file whose last run
+// failed, running it again from its checkpoints. Without it, New reports an
+// *ErrMigrationFailed.
+func WithResume() Option {
+	return func(m *Migrate) { m.resume = true }
+}
+
+// WithAllowOutOfOrder allows New to apply pending files which sort before the
+// last migration applied, such as one merged late from a long-lived branch,
+// recording them as any other. Without it, New reports an *ErrOutOfOrder.
+func WithAllowOutOfOrder() Option {
+	return func(m *Migrate) { m.allowOutOfOrder = true }
+}
+
+// WithRedact sets a function applied to SQL before it's logged or included
+// in an ErrStatementFailed, such as to hide the password in a CREATE USER
+// statement. Nothing is redacted by default.
+func WithRedact(fn func(sql string) string) Option {
+	return func(m *Migrate) { m.redact = fn }
+}
+
+// FileResult is the outcome of running a migration file.
+type FileResult struct {
+	Filename string    `json:"filename"`
+	Warnings []Warning `json:"warnings,omitempty"`
+
+	// Applied reports whether the file ran to completion, and Duration
+	// how long it ran for.
+	Applied  bool          `json:"applied"`
+	Duration time.Duration `json:"duration"`
+
+	// Mode is "multi" or "no-split" for a file which ran as one batch by
+	// its directive, "transaction" for one run in a transaction, or empty
+	// for one run statement by statement.
+	Mode string `json:"mode,omitempty"`
+
+	// RolledBack reports whether the file failed and was rolled back by
+	// its down migration, under WithAutoRollbackOnFailure.
+	RolledBack bool `json:"rolled_back,omitempty"`
 }
 
 type file struct {
-	Info     os.FileInfo
+	Info os.FileInfo
+
+	// fullpath is the file's path in the migrations FS, and downpath its
+	// down migration's, or empty if it has none.
 	fullpath string
+	downpath string
 }
 
+// downSuffix ends the names of down migrations, which pair with the up
+// migration of the same name: 0002_add_users.down.sql undoes 0002_add_users.sql.
+const downSuffix = ".down.sql"
+
+// Migration is a row of meta. It marshals to JSON as part of a MetaSnapshot.
 type Migration struct {
-	Filename string
-	Checksum string
-	Content  string
+	Filename string `json:"filename"`
+	Checksum string `json:"checksum"`
+	Content  string `json:"content"`
+
+	// Duration, AppliedBy and ToolVersion describe the run which applied
+	// the migration. They're recorded from meta version 2, so are empty for
+	// migrations applied before it.
+	Duration    time.Duration `json:"duration"`
+	AppliedBy   string        `json:"applied_by"`
+	ToolVersion string        `json:"tool_version"`
+
+	// ChecksumAlgo is the algorithm Checksum was computed with, and Status
+	// whether the migration ran or was skipped. They're recorded from meta
+	// version 3, and migrations applied before it are reported as md5 and
+	// applied.
+	ChecksumAlgo string `json:"checksum_algo"`
+	Status       string `json:"status"`
+
+	// Error describes why a failed migration failed. It's recorded from
+	// meta version 5.
+	Error string `json:"error_text"`
+
+	// AppVersion is the release of the application which applied the
+	// migration, if it was set with WithAppVersion. It's recorded from
+	// meta version 6.
+	AppVersion string `json:"app_version"`
+
+	// DownContent is the content of the migration's down migration when
+	// it was applied, or empty if it had none. It's recorded from meta
+	// version 4, and of the Store's methods only GetMigrationWithDown and
+	// MetaSnapshotter's report it.
+	DownContent string `json:"down_content,omitempty"`
+
 	fullpath string
 }
 
-var regexNum = regexp.MustCompile(`^\d+`)
+// Algorithms a Migration's Checksum may be computed with. Migrate records
+// migrations with ChecksumSHA256 unless WithChecksumAlgo sets another, and
+// checks each against its file with its own, so those recorded with md5 by
+// earlier versions still match.
+const (
+	ChecksumMD5    = "md5"
+	ChecksumSHA256 = "sha256"
+)
+
+// Statuses of a Migration.
+const (
+	// StatusApplied migrations ran to completion.
+	StatusApplied = "applied"
+
+	// StatusSkipped migrations were recorded with -skip without running.
+	StatusSkipped = "skipped"
+
+	// StatusInProgress migrations are running, or were interrupted, such
+	// as by Stop, before they finished.
+	StatusInProgress = "in_progress"
+
+	// StatusFailed migrations stopped with an error, which Error records.
+	StatusFailed = "failed"
+
+	// StatusRollbackFailed migrations failed, then so did their down
+	// migration under WithAutoRollbackOnFailure, which may have undone part
+	// of what their checkpoints record as run. Error records both errors.
+	StatusRollbackFailed = "rollback_failed"
+)
+
+var regexNum = regexp.MustCompile(`^\d+`)
+
+type DBType string
+
+const (
+	DBTypeMySQL     DBType = "mysql"
+	DBTypeMariaDB   DBType = "mariadb"
+	DBTypeTiDB      DBType = "tidb"
+	DBTypePostgres  DBType = "postgres"
+	DBTypeCockroach DBType = "cockroach"
+	DBTypeMSSQL     DBType = "mssql"
+	DBTypeSpanner   DBType = "spanner"
+	DBTypeSnowflake DBType = "snowflake"
+	DBTypeOracle    DBType = "oracle"
+	DBTypeSQLite    DBType = "sqlite"
+)
+
+// New prepares to migrate db with the files in dir, creating and upgrading the
+// meta tables as needed. ctx bounds this setup, not later calls to Migrate.
+func New(
+	ctx context.Context,
+	db Store,
+	log Logger,
+	dbt DBType,
+	dir, skip string,
+	opts ...Option,
+) (*Migrate, error) {
+	fsys, err := dirFS(dir)
+	if err != nil {
+		return nil, err
+	}
+	return NewFS(ctx, db, log, dbt, fsys, skip, opts...)
+}
+
+// NewFS is New with the files at the root of fsys, such as an embed.FS. Use
+// fs.Sub for files in a subdirectory of it:
+//
+//	//go:embed migrations/*.sql
+//	var migrations embed.FS
+//
+//	fsys, err := fs.Sub(migrations, "migrations")
+//	m, err := migrate.NewFS(ctx, db, log, dbt, fsys, "")
+func NewFS(
+	ctx context.Context,
+	db Store,
+	log Logger,
+	dbt DBType,
+	fsys fs.FS,
+	skip string,
+	opts ...Option,
+) (*Migrate, error) {
+	m, err := newMigrate(db, log, opts)
+	if err != nil {
+		return nil, err
+	}
+	fsys, err = m.withIgnore(fsys)
+	if err != nil {
+		return nil, err
+	}
+	m.fsys, err = m.withGoMigrations(migrationFS(fsys))
+	if err != nil {
+		return nil, err
+	}
+	fsys = m.fsys
+
+	// Get files in migration dir and sort them
+	m.Files, err = m.readFiles(fsys, dbt)
+	if err != nil {
+		return nil, errors.Wrap(err, "get migrations")
+	}
+	if err = sortFiles(m.Files, m.order()); err != nil {
+		return nil, errors.Wrap(err, "sort")
+	}
+	if err = m.checkNumbering(m.Files); err != nil {
+		return nil, err
+	}
+	if err = m.prepareMeta(ctx); err != nil {
+		return nil, err
+	}
+
+	// If skip, then we record the migrations but do not perform them. This
+	// enables you to start using this package on an existing database
+	if skip != "" && m.plan != nil {
+		return nil, errors.New("can't skip ahead in a dry run")
+	}
+	if skip != "" {
+		m.idx, err = m.skip(ctx, skip)
+		if err != nil {
+			return nil, errors.Wrap(err, "skip ahead")
+		}
+		m.log.Println("skipped ahead")
+	}
+
+	// Get all migrations
+	if !m.noMeta {
+		m.Migrations, err = db.GetMigrations(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "get migrations")
+		}
+	}
+
+	normalizeFilenames(m.Migrations)
+	m.Migrations = m.withoutOtherEnvs(m.Migrations)
+	if err = m.renameMovedFiles(ctx); err != nil {
+		return nil, err
+	}
+	if err = m.renameFiles(ctx); err != nil {
+		return nil, err
+	}
+	m.Migrations, err = m.finished(m.Migrations)
+	if err != nil {
+		return nil, err
+	}
+	m.sortMigrations(m.Migrations)
+
+	// Fill in migration fullpath field from the file, which is its
+	// override for the db type if it has one.
+	index := m.fileIndexes()
+	for i, mg := range m.Migrations {
+		if j, ok := index[mg.Filename]; ok {
+			m.Migrations[i].fullpath = m.Files[j].fullpath
+		} else {
+			m.Migrations[i].fullpath = mg.Filename
+		}
+	}
+	if err = m.validHistory(); err != nil {
+		return nil, err
+	}
+	if err = m.checkUpTo(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// newMigrate configures a Migrate of db with opts.
+func newMigrate(db Store, log Logger, opts []Option) (*Migrate, error) {
+	m := &Migrate{
+		db:            db,
+		log:           log,
+		retryAttempts: DefaultRetryAttempts,
+		retryBackoff:  DefaultRetryBackoff,
+
+		reconnectAttempts: DefaultReconnectAttempts,
+
+		lockPoll:       DefaultLockPoll,
+		lockHeartbeat:  DefaultLockHeartbeat,
+		lockStaleAfter: DefaultLockStaleAfter,
+
+		diffLines: DefaultDiffLines,
+
+		stop:      make(chan struct{}),
+		appliedBy: defaultAppliedBy(),
+		host:      hostname(),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if _, err := checksumOf(m.checksumAlgo(), nil); err != nil {
+		return nil, err
+	}
+	if err := m.checkModifiedPolicy(); err != nil {
+		return nil, err
+	}
+	if m.autoRollback && m.production {
+		return nil, errors.New("can't roll back failed migrations automatically in production")
+	}
+	var err error
+	m.runID, err = newRunID()
+	if err != nil {
+		return nil, errors.Wrap(err, "new run id")
+	}
+	return m, nil
+}
+
+// prepareMeta creates the meta tables if they're missing, and upgrades them to
+// the current version if they predate it and WithUpgrade was given. A dry run
+// only reads them, as readMeta does.
+func (m *Migrate) prepareMeta(ctx context.Context) error {
+	db := m.db
+	if m.plan != nil {
+		return m.readMeta(ctx)
+	}
+
+	// Create meta tables if we need to, so we can store the migration
+	// state in the db itself
+	if err := db.CreateMetaIfNotExists(ctx); err != nil {
+		return errors.Wrap(err, "create meta table")
+	}
+	if err := db.CreateMetaCheckpointsIfNotExists(ctx); err != nil {
+		return errors.Wrap(err, "create meta checkpoints table")
+	}
+	curVersion, err := db.CreateMetaVersionIfNotExists(ctx, version)
+	if err != nil {
+		return errors.Wrap(err, "create meta version table")
+	}
+
+	if !m.noLock {
+		err = db.CreateMetaLockIfNotExists(ctx)
+		if err != nil {
+			return errors.Wrap(err, "create meta lock table")
+		}
+	}
+
+	m.createHistory(ctx)
+
+	// Migrate the database schema to match the tool's expectations
+	// automatically
+	if curVersion > version {
+		return &ErrVersionTooNew{Have: curVersion, Want: version}
+	}
+	if curVersion < version && !m.upgrade {
+		return &ErrUpgradeRequired{Have: curVersion, Want: version}
+	}
+	for curVersion < version {
+		next := curVersion + 1
+		err = m.upgradeTo(ctx, next)
+		var conflict *ErrVersionConflict
+		if errors.As(err, &conflict) {
+			curVersion, err = m.rereadVersion(ctx, conflict)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "upgrade to v%d", next)
+		}
+		curVersion = next
+	}
+	if cl, ok := db.(ContentLimiter); ok {
+		m.maxContent, err = cl.MaxContentSize(ctx)
+		if err != nil {
+			return errors.Wrap(err, "max content size")
+		}
+	}
+
+	return nil
+}
+
+// upgradeTo upgrades the meta tables from the version before v to v.
+func (m *Migrate) upgradeTo(ctx context.Context, v int) error {
+	switch v {
+	case 1:
+		tmpMigrations, err := migrationsFromFiles(m)
+		if err != nil {
+			return errors.Wrap(err, "migrations from files")
+		}
+		return m.db.UpgradeToV1(ctx, tmpMigrations)
+	case 2:
+		return m.db.UpgradeToV2(ctx)
+	case 3:
+		return m.db.UpgradeToV3(ctx)
+	case 4:
+		return m.db.UpgradeToV4(ctx)
+	case 5:
+		return m.db.UpgradeToV5(ctx)
+	case 6:
+		return m.db.UpgradeToV6(ctx)
+	}
+	return fmt.Errorf("no upgrade to meta version %d", v)
+}
+
+// rereadVersion reads the meta version after an upgrade conflicted with
+// another run's, so the upgrade continues from wherever the other run left it.
+// A version no later than the one the upgrade expected, such as with no row in
+// metaversion, is reported as the conflict rather than tried again.
+func (m *Migrate) rereadVersion(
+	ctx context.Context,
+	conflict *ErrVersionConflict,
+) (int, error) {
+	v, _, err := m.db.GetMetaVersion(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "get meta version")
+	}
+	if v > version {
+		return 0, &ErrVersionTooNew{Have: v, Want: version}
+	}
+	if v <= conflict.From {
+		return 0, conflict
+	}
+	m.log.Printf("meta tables are at version %d after another run upgraded them\n",
+		v)
+	return v, nil
+}
+
+// Migrate all files in the directory. This function reports whether any
+// migration took place.
+//
+// Cancelling ctx interrupts the statement in progress. Statements which had
+// completed are checkpointed, so the next run resumes from the interrupted
+// statement, and the returned error wraps ctx.Err().
+//
+// Migrate holds the lock in metalock while it runs, and reports an error
+// wrapping ErrLocked if another run holds it, unless WithLockWait is given.
+// Which files are pending is decided again once it holds the lock, so files
+// another run applied since New are skipped, and each file's checkpoints are
+// read only when it runs. If the lock is lost, the
+// statement in progress is interrupted as if ctx were cancelled, and the
+// returned error wraps ErrLockLost. With WithoutLocking, no lock is taken.
+func (m *Migrate) Migrate(ctx context.Context) (bool, error) {
+	if m.plan != nil {
+		return false, m.planUp(ctx)
+	}
+	if m.autoRollback {
+		m.log.Println("WARNING: auto-rollback is enabled, so a migration which fails is rolled back by running its down migration")
+	}
+	ctx, release, err := m.lock(ctx)
+	if errors.Is(err, errUpToDate) {
+		m.log.Println("already up to date, migrated by another run")
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	if err := m.reloadMigrations(ctx); err != nil {
+		return false, errors.Wrap(err, "reload migrations")
+	}
+	if err := m.updateModified(ctx); err != nil {
+		return false, errors.Wrap(err, "update modified")
+	}
+
+	var migrated bool
+	m.reconnects = 0
+	run := m.toRun()
+	left := m.pending()[len(run):]
+	if err := m.checkTransactionFiles(run); err != nil {
+		return false, err
+	}
+	for _, fi := range run {
+		if m.stopped() {
+			return migrated, ErrStopped
+		}
+		if m.reruns[fi.Info.Name()] {
+			m.log.Printf("re-running %s, which is rerun-always and changed since it was applied\n",
+				fi.Info.Name())
+		}
+		if err := m.applyFile(ctx, fi); err != nil {
+			return false, err
+		}
+		migrated = true
+	}
+	m.logLeftPending(left)
+	m.logSteps(left)
+	return migrated, nil
+}
+
+// applyFile migrates fi, adding its result to Results and recording the
+// attempt in metahistory.
+func (m *Migrate) applyFile(ctx context.Context, fi *file) error {
+	m.Results = append(m.Results, FileResult{Filename: fi.Info.Name()})
+	m.setLockFilename(ctx, fi.Info.Name())
+	start := time.Now()
+	err := m.migrateFile(ctx, fi)
+	res := &m.Results[len(m.Results)-1]
+	res.Applied = err == nil
+	res.Duration = time.Since(start)
+	m.recordHistory(ctx, fi, -1, start, err)
+	if cause := context.Cause(ctx); errors.Is(cause, ErrLockLost) {
+		return fmt.Errorf("%w: %w", cause, err)
+	}
+	if err != nil {
+		return errors.Wrap(err, "migrate file")
+	}
+	if m.reruns[fi.Info.Name()] {
+		delete(m.reruns, fi.Info.Name())
+		m.log.Println("re-ran", fi.Info.Name())
+		return nil
+	}
+	m.log.Println("migrated", fi.Info.Name())
+	return nil
+}
+
+// finished leaves out of ms those which are unfinished. Each runs again from
+// its checkpoints, and may have been edited to fix it, so it's left out of the
+// history checked against the files. One whose last run failed is reported as
+// an *ErrMigrationFailed, unless WithResume was given, and one whose rollback
+// failed as an *ErrRollbackFailed, even if it was.
+func (m *Migrate) finished(ms []Migration) ([]Migration, error) {
+	done := make([]Migration, 0, len(ms))
+	for _, mg := range ms {
+		switch mg.Status {
+		case StatusRollbackFailed:
+			return nil, &ErrRollbackFailed{
+				Filename: mg.Filename,
+				Err:      mg.Error,
+			}
+		case StatusFailed:
+			if !m.resume {
+				return nil, &ErrMigrationFailed{
+					Filename: mg.Filename,
+					Err:      mg.Error,
+				}
+			}
+		case StatusInProgress:
+		default:
+			done = append(done, mg)
+		}
+	}
+	return done, nil
+}
+
+// reloadMigrations adds the migrations which another run applied since New
+// read the meta table, such as while Migrate waited for its lock, checking
+// them against the files as New does.
+func (m *Migrate) reloadMigrations(ctx context.Context) error {
+	if m.noMeta {
+		return nil
+	}
+	ms, err := m.db.GetMigrations(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get migrations")
+	}
+	normalizeFilenames(ms)
+	ms = m.withoutOtherEnvs(ms)
+	if ms, err = m.finished(ms); err != nil {
+		return err
+	}
+	m.sortMigrations(ms)
+	known := make(map[string]string, len(m.Migrations))
+	for _, mg := range m.Migrations {
+		known[mg.Filename] = mg.Checksum
+	}
+	index := m.fileIndexes()
+	for i := range ms {
+		mg := &ms[i]
+		j, ok := index[mg.Filename]
+		if !ok {
+			return fmt.Errorf("missing already-run migration %q", mg.Filename)
+		}
+		mg.fullpath = m.Files[j].fullpath
+		if checksum, ok := known[mg.Filename]; ok {
+			// A rerun-always file recorded again ran in another run
+			if m.reruns[mg.Filename] && mg.Filename != m.rerun &&
+				mg.Checksum != checksum {
+				delete(m.reruns, mg.Filename)
+			}
+			continue
+		}
+		if err = m.checkHash(*mg); err != nil {
+			return errors.Wrap(err, "check hash")
+		}
+		m.log.Printf("skipping %s, %s by another run\n", mg.Filename,
+			mg.Status)
+	}
+	m.Migrations = ms
+	return m.checkOrder()
+}
+
+func (m *Migrate) validHistory() error {
+	index := m.fileIndexes()
+	var missing bool
+	for _, mg := range m.Migrations {
+		if _, ok := index[mg.Filename]; !ok {
+			m.log.Printf("missing already-run migration %q\n", mg.Filename)
+			missing = true
+		}
+	}
+	if missing {
+		return errors.New("cannot continue with missing migrations")
+	}
+	if err := m.checkOrder(); err != nil {
+		return err
+	}
+	if late, last := outOfOrder(m.Files, m.Migrations); len(late) > 0 {
+		m.log.Printf("applying %s out of order, before %s\n",
+			strings.Join(late, ", "), last)
+	}
+	for _, mg := range m.Migrations {
+		// Files up to skip were recorded from their content just now
+		if index[mg.Filename] < m.idx {
+			continue
+		}
+		if err := m.checkRecorded(mg); err != nil {
+			return errors.Wrap(err, "check hash")
+		}
+	}
+	return nil
+}
+
+// checkRecorded checks mg against its file as checkHash does, but marks it to
+// run again instead if it's the file Rerun runs, or a file with the
+// rerun-always directive which changed since it was applied.
+func (m *Migrate) checkRecorded(mg Migration) error {
+	if mg.Filename == m.rerun {
+		m.markRerun(mg.Filename)
+		return nil
+	}
+	err := m.checkHash(mg)
+	var mismatch *ErrChecksumMismatch
+	if !errors.As(err, &mismatch) {
+		return err
+	}
+	byt, err := fs.ReadFile(m.fsys, mg.fullpath)
+	if err != nil {
+		return err
+	}
+	d, _, err := parseDirectives(normalizeLineEndings(byt))
+	if err != nil {
+		return fmt.Errorf("%s: %w", mg.Filename, err)
+	}
+	switch {
+	case d.rerunAlways:
+		m.markRerun(mg.Filename)
+	case !m.allowModified(mg, mismatch):
+		return mismatch
+	}
+	return nil
+}
+
+// markRerun marks the applied file called name to run again.
+func (m *Migrate) markRerun(name string) {
+	if m.reruns == nil {
+		m.reruns = map[string]bool{}
+	}
+	m.reruns[name] = true
+}
+
+// fileIndexes maps the name of each file to its index in m.Files.
+func (m *Migrate) fileIndexes() map[string]int {
+	index := make(map[string]int, len(m.Files))
+	for i, fi := range m.Files {
+		index[fi.Info.Name()] = i
+	}
+	return index
+}
+
+// pending returns the files which aren't recorded in m.Migrations, along with
+// those to run again, in the order they run.
+func (m *Migrate) pending() []*file {
+	recorded := make(map[string]bool, len(m.Migrations))
+	for _, mg := range m.Migrations {
+		recorded[mg.Filename] = !m.reruns[mg.Filename]
+	}
+	var files []*file
+	for _, fi := range m.Files {
+		if !recorded[fi.Info.Name()] {
+			files = append(files, fi)
+		}
+	}
+	return files
+}
+
+// toRun returns the pending files Migrate runs, the first of those pending:
+// those up to and including the target of WithUpTo, if it was given, and at
+// most the steps of Steps.
+func (m *Migrate) toRun() []*file {
+	run := m.pending()
+	if m.upTo != "" {
+		run = m.upToTarget(run)
+	}
+	if m.limitSteps && len(run) > m.steps {
+		run = run[:m.steps]
+	}
+	return run
+}
+
+// Pending returns the names of the files Migrate would run, in order: with
+// WithUpTo or Steps, only those up to the target or within the steps, not
+// every file which isn't applied.
+func (m *Migrate) Pending() []string {
+	var names []string
+	for _, fi := range m.toRun() {
+		names = append(names, fi.Info.Name())
+	}
+	return names
+}
+
+// checkOrder reports an *ErrOutOfOrder for pending files which sort before
+// the last recorded migration, unless WithAllowOutOfOrder was given.
+func (m *Migrate) checkOrder() error {
+	late, last := outOfOrder(m.Files, m.Migrations)
+	if len(late) > 0 && !m.allowOutOfOrder {
+		return &ErrOutOfOrder{Filenames: late, Last: last}
+	}
+	return nil
+}
+
+// outOfOrder returns the names of files, sorted, which aren't recorded in ms
+// but sort before the last which is, and the name of that last one.
+func outOfOrder(files []*file, ms []Migration) ([]string, string) {
+	recorded := make(map[string]bool, len(ms))
+	for _, mg := range ms {
+		recorded[mg.Filename] = true
+	}
+	lastIdx := -1
+	for i, fi := range files {
+		if recorded[fi.Info.Name()] {
+			lastIdx = i
+		}
+	}
+	var late []string
+	for _, fi := range files[:lastIdx+1] {
+		if !recorded[fi.Info.Name()] {
+			late = append(late, fi.Info.Name())
+		}
+	}
+	if len(late) == 0 {
+		return nil, ""
+	}
+	return late, files[lastIdx].Info.Name()
+}
+
+func (m *Migrate) checkHash(mg Migration) error {
+	byt, err := fs.ReadFile(m.fsys, mg.fullpath)
+	if err != nil {
+		return err
+	}
+	match, legacy, err := recordedMatch(mg, byt)
+	if err != nil {
+		return err
+	}
+	if legacy {
+		m.log.Printf("%s matches its checksum only with the CRLF line endings or byte order mark it was recorded with. run migrate -rehash to record it without them\n",
+			mg.Filename)
+	}
+	if !match {
+		check, err := fileChecksumOf(recordedAlgo(mg), byt)
+		if err != nil {
+			return err
+		}
+		m.log.Println("comparing", check, mg.Checksum)
+		return &ErrChecksumMismatch{
+			Filename:  mg.Filename,
+			Statement: -1,
+			Stored:    mg.Checksum,
+			Computed:  check,
+			diff:      m.mismatchDiff(mg, byt),
+		}
+	}
+	return nil
+}
+
+// mismatchDiff returns the diff of mg's recorded content against byt, its
+// file's, cut to WithDiffLines, or an empty string if the content recorded
+// doesn't have mg's checksum.
+func (m *Migrate) mismatchDiff(mg Migration, byt []byte) string {
+	if m.diffLines <= 0 {
+		return ""
+	}
+	intact, _, err := recordedMatch(mg, []byte(mg.Content))
+	if err != nil || !intact {
+		return ""
+	}
+	recorded := m.redactSQL(string(normalizeLineEndings([]byte(mg.Content))))
+	local := m.redactSQL(string(normalizeLineEndings(byt)))
+	diff := changeDiff(mg.Filename, []byte(recorded), []byte(local))
+	return truncateDiff(diff, m.diffLines)
+}
+
+// emptyCheckpoints reports whether the checkpoints of f from n on are of
+// statements with nothing to run, such as the comments after a file's last
+// semicolon, which versions splitting files otherwise may have run. Those
+// recorded empty are known by their checksum, and others only if the store
+// can report their content.
+func (m *Migrate) emptyCheckpoints(
+	ctx context.Context,
+	f *file,
+	checkpoints []string,
+	n int,
+) (bool, error) {
+	_, empty, err := computeChecksum(strings.NewReader(""), ChecksumMD5)
+	if err != nil {
+		return false, err
+	}
+	var contents []string
+	if cr, ok := m.db.(CheckpointReader); ok {
+		contents, err = cr.GetMetaCheckpointContents(ctx, f.Info.Name())
+		if err != nil {
+			return false, errors.Wrap(err, "get checkpoint contents")
+		}
+	}
+	for i := n; i < len(checkpoints); i++ {
+		if checkpoints[i] == empty {
+			continue
+		}
+		if i >= len(contents) || hasSQL(contents[i]) {
+			return false, nil
+		}
+
+		// The content shows what ran only if it has the checkpoint's
+		// checksum
+		_, checksum, err := computeChecksum(strings.NewReader(contents[i]),
+			ChecksumMD5)
+		if err != nil {
+			return false, err
+		}
+		if checksum != checkpoints[i] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// checkpointMismatch reports that the statement of f at index i, cmd, which
+// starts on line, has another checksum than its checkpoint's, stored, with
+// the diff of the statement which ran against cmd if the store can report it.
+func (m *Migrate) checkpointMismatch(
+	ctx context.Context,
+	f *file,
+	i, line int,
+	cmd, stored, computed string,
+) error {
+	err := &ErrChecksumMismatch{
+		Filename:  f.Info.Name(),
+		Statement: i,
+		Line:      line,
+		Stored:    stored,
+		Computed:  computed,
+	}
+	cr, ok := m.db.(CheckpointReader)
+	if !ok || m.diffLines <= 0 {
+		return err
+	}
+	contents, cerr := cr.GetMetaCheckpointContents(ctx, f.Info.Name())
+	if cerr != nil || i >= len(contents) {
+		return err
+	}
+	diff := changeDiff(f.Info.Name()+" "+statementAt(i, line),
+		[]byte(m.redactSQL(contents[i])+"\n"), []byte(m.redactSQL(cmd)+"\n"))
+	err.diff = truncateDiff(diff, m.diffLines)
+	return err
+}
+
+func Statements(byt []byte) ([]string, error) {
+	stmts, err := splitStatements(byt)
+	if err != nil {
+		return nil, err
+	}
+	cmds := make([]string, 0, len(stmts))
+	for _, s := range stmts {
+		cmds = append(cmds, s.SQL)
+	}
+	return cmds, nil
+}
+
+// splitStatements splits byt as DefaultSplitter does, reading quotes as MySQL
+// does by default.
+func splitStatements(byt []byte) ([]Statement, error) {
+	return splitStatementsQuoting(byt, quoting{})
+}
+
+// splitStatementsQuoting splits byt as DefaultSplitter does, reading quotes
+// by qt.
+func splitStatementsQuoting(byt []byte, qt quoting) ([]Statement, error) {
+	// Split commands at semicolons, or the delimiter DELIMITER lines set,
+	// outside quotes and comments, and leave out the line comments before
+	// each
+	src := string(byt)
+	cmds := splitSQL(src, qt)
+
+	// For postgresql specifically, some statements may have multiple `;`
+	// such as when creating functions with unquoted bodies. Join those
+	// together, as well as the statements in the BEGIN ... END body of a
+	// stored program. Track where each command starts in src to report its
+	// line. Those split by another delimiter are whole already.
+	type chunk struct {
+		s   string
+		off int
+	}
+	newCmds := []chunk{}
+	var keepGoing bool
+
+	// depth is how many blocks of the last command are open
+	var depth int
+	unended := func() error {
+		last := newCmds[len(newCmds)-1]
+		return fmt.Errorf("line %d: BEGIN without a matching END",
+			lineOf(src, last.off+len(last.s)-len(skipComments(last.s))))
+	}
+	for _, c := range cmds {
+		lowC := strings.ToLower(c.s)
+
+		if depth > 0 {
+			if c.delimited {
+				return nil, unended()
+			}
+			newCmds[len(newCmds)-1].s += ";" + c.s
+			depth = blockDepth(c.s, depth, qt)
+			continue
+		}
+
+		if !c.delimited && fnReturns.MatchString(lowC) &&
+			!strings.Contains(lowC, "plpgsql") {
+			keepGoing = true
+			newCmds = append(newCmds, chunk{c.s + ";", c.off})
+			continue
+		}
+		if keepGoing {
+			newCmds[len(newCmds)-1].s += c.s
+			if !strings.Contains(lowC, "plpgsql") {
+				newCmds[len(newCmds)-1].s += ";"
+				continue
+			}
+			keepGoing = false
+			continue
+		}
+		if !c.delimited && regexCompound.MatchString(skipComments(c.s)) {
+			depth = blockDepth(c.s, 0, qt)
+		}
+		newCmds = append(newCmds, chunk{c.s, c.off})
+	}
+	if keepGoing {
+		return nil, errors.New("unexpected exit, missing 'plpgsql'")
+	}
+	if depth > 0 {
+		return nil, unended()
+	}
+
+	filteredCmds := []Statement{}
+	for _, c := range newCmds {
+		stmt := Statement{Index: len(filteredCmds)}
+		s, off := c.s, c.off
+		for {
+			trimmed := strings.TrimLeftFunc(s, unicode.IsSpace)
+			off += len(s) - len(trimmed)
+			s = trimmed
+			if strings.HasPrefix(s, timeoutDirective) {
+				directive, rest, _ := strings.Cut(s, "\n")
+				timeout, err := parseTimeout(strings.TrimSpace(directive))
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w",
+						lineOf(src, off), err)
+				}
+				stmt.timeout = &timeout
+				off += len(s) - len(rest)
+				s = rest
+				continue
+			}
+
+			// Line comments before a statement are left out of it,
+			// but block comments are kept, since MySQL runs some
+			end, ok := lineCommentEnd(s)
+			if !ok {
+				break
+			}
+			off += end
+			s = s[end:]
+		}
+		cmd := strings.TrimSpace(s)
+		if !hasSQL(cmd) {
+			continue
+		}
+		stmt.SQL = cmd
+		stmt.Line = lineOf(src, off)
+		filteredCmds = append(filteredCmds, stmt)
+	}
+	return filteredCmds, nil
+}
+
+// lineOf returns the line, counting from 1, of the byte at off in s.
+func lineOf(s string, off int) int {
+	return strings.Count(s[:off], "\n") + 1
+}
+
+type directives struct {
+	multi       bool
+	noSplit     bool
+	noRetry     bool
+	rerunAlways bool
+	transaction bool
+	timeout     *time.Duration
+}
+
+// parseDirectives reads the directives at the start of a file, returning them
+// along with the rest of the file.
+func parseDirectives(byt []byte) (directives, []byte, error) {
+	var d directives
+	rest := byt
+	for {
+		line, next, _ := bytes.Cut(bytes.TrimLeft(rest, " \t\r\n"),
+			[]byte("\n"))
+		directive := string(bytes.TrimSpace(line))
+		if !strings.HasPrefix(directive, directivePrefix) {
+			if d.multi && d.noSplit {
+				return d, nil, fmt.Errorf("%s and %s can't both be given",
+					multiDirective, noSplitDirective)
+			}
+			if d.multi && d.transaction {
+				return d, nil, fmt.Errorf("%s and %s can't both be given",
+					multiDirective, transactionDirective)
+			}
+			return d, rest, nil
+		}
+		name, _, _ := strings.Cut(directive[len(directivePrefix):], " ")
+		switch directivePrefix + name {
+		case multiDirective:
+			d.multi = true
+		case noSplitDirective:
+			d.noSplit = true
+		case noRetryDirective:
+			d.noRetry = true
+		case rerunAlwaysDirective:
+			d.rerunAlways = true
+		case transactionDirective:
+			d.transaction = true
+		case timeoutDirective:
+			timeout, err := parseTimeout(directive)
+			if err != nil {
+				return d, nil, err
+			}
+			d.timeout = &timeout
+		default:
+			return d, nil, fmt.Errorf("unknown directive %q", directive)
+		}
+		rest = next
+	}
+}
+
+// parseTimeout reads the duration from a timeout directive, where "off" is
+// zero.
+func parseTimeout(directive string) (time.Duration, error) {
+	arg, ok := strings.CutPrefix(directive, timeoutDirective+" ")
+	arg = strings.TrimSpace(arg)
+	if !ok || arg == "" {
+		return 0, fmt.Errorf("invalid directive %q, expected %s followed by a duration or off",
+			directive, timeoutDirective)
+	}
+	if arg == "off" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(arg)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", directive, err)
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("%s: negative timeout", directive)
+	}
+	return timeout, nil
+}
+
+// migrateFile records f as in progress while it runs, then as applied or
+// failed. Files interrupted by Stop or ctx stay in progress, since running
+// migrate again resumes them without WithResume.
+func (m *Migrate) migrateFile(ctx context.Context, f *file) error {
+	start := time.Now()
+	byt, err := fs.ReadFile(m.fsys, f.fullpath)
+	if err != nil {
+		return err
+	}
+	byt = normalizeLineEndings(byt)
+	if err = m.checkContentSize(f, byt); err != nil {
+		return err
+	}
+
+	// A file which can't run in its transaction is refused before it's
+	// recorded, as none of it has run
+	if err = m.checkTransactionFile(f, byt); err != nil {
+		return err
+	}
+	err = m.recordMigration(ctx, f, byt, start, StatusInProgress, nil)
+	if err != nil {
+		return errors.Wrap(err, "record in progress")
+	}
+	if gm := goMigrationOf(f.Info); gm != nil {
+		err = m.migrateGo(ctx, f, gm, byt, start)
+	} else {
+		err = m.runFile(ctx, f, byt, start)
+	}
+	if err == nil || errors.Is(err, ErrStopped) || ctx.Err() != nil {
+		return err
+	}
+	recErr := m.recordMigration(context.WithoutCancel(ctx), f, byt, start,
+		StatusFailed, err)
+	if recErr != nil {
+		m.log.Printf("WARNING: failed to record %s as failed: %v\n",
+			f.Info.Name(), recErr)
+	}
+	if m.autoRollback {
+		return m.rollbackFailed(ctx, f, byt, start, err)
+	}
+	return err
+}
+
+func (m *Migrate) runFile(
+	ctx context.Context,
+	f *file,
+	byt []byte,
+	start time.Time,
+) error {
+	d, body, err := parseDirectives(byt)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.Info.Name(), err)
+	}
+	if d.multi {
+		return m.migrateMultiStatementFile(ctx, f, d, byt, body, start)
+	}
+
+	// Directives are stripped from body, so count the lines they took to
+	// report lines in the file
+	dirLines := lineOf(string(byt), len(byt)-len(body)) - 1
+
+	filteredCmds, err := m.statementsOf(f, d, body)
+	if err != nil {
+		return err
+	}
+	if d.noSplit {
+		m.Results[len(m.Results)-1].Mode = "no-split"
+		m.log.Println(">", noSplitDirective, f.Info.Name())
+	}
+
+	// A file of only comments, such as a placeholder, has nothing to run,
+	// so it's recorded as applied without any checkpoints
+	if len(filteredCmds) == 0 {
+		m.log.Printf("%s has no statements to run\n", f.Info.Name())
+	}
+
+	// A file run in a transaction takes effect all at once, so it has no
+	// checkpoints to resume from. It's only in transaction mode once any
+	// checkpoints of an earlier run outside of one are ruled out, as those
+	// took effect
+	if m.inTransaction(d) {
+		if err = m.checkNoCheckpoints(ctx, f); err != nil {
+			return err
+		}
+		m.Results[len(m.Results)-1].Mode = "transaction"
+		err = m.runTransaction(ctx, f, d, filteredCmds, dirLines)
+		if err != nil {
+			return err
+		}
+		return m.recordMigration(ctx, f, byt, start, StatusApplied, nil)
+	}
+
+	checkpoints, err := m.verifiedCheckpoints(ctx, f, filteredCmds, dirLines)
+	if err != nil {
+		return err
+	}
+	switch n := len(checkpoints); {
+	case n == 0:
+	case n == len(filteredCmds):
+		m.log.Printf("found %d checkpoints, so every statement has run\n", n)
+	case n > 0:
+		m.log.Printf("found %d checkpoints, resuming from %s\n", n,
+			statementAt(n, dirLines+filteredCmds[n].Line))
+	}
+
+	for i := 0; i < len(filteredCmds); i++ {
+		stmt := filteredCmds[i]
+		cmd := stmt.SQL
+		line := dirLines + stmt.Line
+
+		// Statements checkpointed have run already
+		if i < len(checkpoints) {
+			continue
+		}
 
-type DBType string
+		if m.stopped() {
+			return fmt.Errorf("%s: %w", f.Info.Name(), ErrStopped)
+		}
 
-const (
-	DBTypeMySQL    DBType = "mysql"
-	DBTypeMariaDB  DBType = "mariadb"
-	DBTypePostgres DBType = "postgres"
-	DBTypeSQLite   DBType = "sqlite"
-)
+		// Print the commands we're executing to give progress updates
+		// on large migrations
+		m.log.Printf("> %s: %s\n", statementAt(i, line), m.shortSQL(cmd))
 
-func New(
-	db Store,
-	log Logger,
-	dbt DBType,
-	dir, skip string,
-) (*Migrate, error) {
-	m := &Migrate{db: db, log: log}
+		// Execute non-checkpointed commands one by one
+		timeout := m.statementTimeout
+		if d.timeout != nil {
+			timeout = *d.timeout
+		}
+		if stmt.timeout != nil {
+			timeout = *stmt.timeout
+		}
+		stmtStart := time.Now()
+		err := m.execWithTimeout(ctx, cmd, timeout,
+			!d.noRetry && !d.noSplit)
+		if m.verboseHistory {
+			m.recordHistory(ctx, f, i, stmtStart, err)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("%s: %w", f.Info.Name(), ctx.Err())
+			}
+			if errors.Is(err, ErrConnectionLost) {
+				m.log.Printf("WARNING: lost the connection while running %s %s, which may have taken effect. verify it manually before running migrate again.\n",
+					f.Info.Name(), statementAt(i, line))
+				return &ErrOutcomeUnknown{
+					Filename:  f.Info.Name(),
+					Statement: i,
+					Line:      line,
+					Err:       err,
+				}
+			}
+			if m.canReconnect(err) {
+				// The statement wasn't sent, so it's safe to run
+				// again once the checkpoints confirm where we are
+				checkpoints, err = m.reconnect(ctx, f)
+				if err != nil {
+					return err
+				}
+				if len(checkpoints) != i {
+					return fmt.Errorf("%s: expected %d checkpoints after reconnecting, found %d",
+						f.Info.Name(), i, len(checkpoints))
+				}
+				i--
+				continue
+			}
+			m.log.Println("failed on", m.redactSQL(cmd))
+			err = m.statementErr(f, i, line, cmd, err)
+			if i > 0 {
+				return &ErrPartiallyApplied{
+					Filename:  f.Info.Name(),
+					Statement: i,
+					Err:       err,
+				}
+			}
+			return err
+		}
 
-	// Get files in migration dir and sort them
-	var err error
-	m.Files, err = readDir(dir, dbt)
-	if err != nil {
-		return nil, errors.Wrap(err, "get migrations")
+		// Save a checkpoint. The statement has already run, so record it
+		// even if ctx was cancelled in the meantime.
+		_, checksum, err := computeChecksum(strings.NewReader(cmd),
+			ChecksumMD5)
+		if err != nil {
+			return errors.Wrap(err, "compute checksum")
+		}
+		err = m.insertCheckpoint(context.WithoutCancel(ctx), f, cmd,
+			checksum, i)
+		if err != nil {
+			return errors.Wrap(err, "insert checkpoint")
+		}
+		if err = m.checkWarnings(f, i, line); err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return fmt.Errorf("%s: %w", f.Info.Name(), err)
+		}
 	}
-	if err = sortFiles(m.Files); err != nil {
-		return nil, errors.Wrap(err, "sort")
+
+	// We've successfully finished migrating the file, so we delete the
+	// temporary progress in metacheckpoints and save the migration
+	if err = m.db.DeleteMetaCheckpoints(ctx); err != nil {
+		return errors.Wrap(err, "delete checkpoints")
 	}
 
-	// Create meta tables if we need to, so we can store the migration
-	// state in the db itself
-	if err = db.CreateMetaIfNotExists(); err != nil {
-		return nil, errors.Wrap(err, "create meta table")
+	return m.recordMigration(ctx, f, byt, start, StatusApplied, nil)
+}
+
+// statementsOf returns the statements of body, the content of f after its
+// directives d: one for the whole of a no-split file, unless it has no SQL,
+// or those the Splitter splits it into.
+func (m *Migrate) statementsOf(
+	f *file,
+	d directives,
+	body []byte,
+) ([]Statement, error) {
+	if !d.noSplit {
+		stmts, err := m.split(body)
+		if err != nil {
+			return nil, fmt.Errorf("statements: %w", err)
+		}
+		return stmts, nil
 	}
-	if err = db.CreateMetaCheckpointsIfNotExists(); err != nil {
-		return nil, errors.Wrap(err, "create meta checkpoints table")
+	if err := m.checkMultiStatements(f, noSplitDirective, body); err != nil {
+		return nil, err
 	}
-	curVersion, err := db.CreateMetaVersionIfNotExists(version)
-	if err != nil {
-		return nil, errors.Wrap(err, "create meta version table")
+	cmd := strings.TrimSpace(string(body))
+	if !hasSQL(cmd) {
+		return nil, nil
 	}
+	lead := len(body) - len(bytes.TrimLeftFunc(body, unicode.IsSpace))
+	return []Statement{{SQL: cmd, Line: lineOf(string(body), lead)}}, nil
+}
 
-	// Migrate the database schema to match the tool's expectations
-	// automatically
-	if curVersion > version {
-		return nil, errors.New("must upgrade migrate: go get -u github.com/thankful-ai/migrate")
+// verifiedCheckpoints returns the checkpoints of f, whose statements are
+// stmts after dirLines lines of directives, once each is confirmed to match
+// the statement it checkpointed. Those after the last statement are left out
+// if they checkpointed nothing, as after its empty fragments were removed.
+func (m *Migrate) verifiedCheckpoints(
+	ctx context.Context,
+	f *file,
+	stmts []Statement,
+	dirLines int,
+) ([]string, error) {
+	if m.noMeta {
+		return nil, nil
 	}
-	if curVersion < 1 {
-		tmpMigrations, err := migrationsFromFiles(m)
+	checkpoints, err := m.db.GetMetaCheckpoints(ctx, f.Info.Name())
+	if err != nil {
+		return nil, errors.Wrap(err, "get checkpoints")
+	}
+
+	// Ensure commands weren't deleted from the file after we migrated them.
+	// Every one may be checkpointed if the file failed to be recorded after
+	// its last ran.
+	if len(checkpoints) > len(stmts) {
+		empty, err := m.emptyCheckpoints(ctx, f, checkpoints, len(stmts))
 		if err != nil {
-			return nil, errors.Wrap(err, "migrations from files")
+			return nil, err
 		}
-		if err = db.UpgradeToV1(tmpMigrations); err != nil {
-			return nil, errors.Wrap(err, "upgrade to v1")
+		if !empty {
+			return nil, fmt.Errorf("len(checkpoints) %d > len(cmds) %d",
+				len(checkpoints), len(stmts))
 		}
-		curVersion = 1
+		m.log.Printf("ignoring %d checkpoints of %s with nothing to run\n",
+			len(checkpoints)-len(stmts), f.Info.Name())
+		checkpoints = checkpoints[:len(stmts)]
 	}
 
-	// If skip, then we record the migrations but do not perform them. This
-	// enables you to start using this package on an existing database
-	if skip != "" {
-		m.idx, err = m.skip(skip)
+	// Confirm the file up to our checkpoint has not changed. Checkpoints
+	// have no algorithm recorded, so are always md5.
+	for i, checkpoint := range checkpoints {
+		cmd := stmts[i].SQL
+		_, checksum, err := computeChecksum(strings.NewReader(cmd),
+			ChecksumMD5)
 		if err != nil {
-			return nil, errors.Wrap(err, "skip ahead")
+			return nil, errors.Wrap(err, "compute checkpoint checksum")
+		}
+		if checksum != checkpoint {
+			return nil, m.checkpointMismatch(ctx, f, i,
+				dirLines+stmts[i].Line, cmd, checkpoint, checksum)
 		}
-		m.log.Println("skipped ahead")
 	}
+	return checkpoints, nil
+}
 
-	// Get all migrations
-	m.Migrations, err = db.GetMigrations()
-	if err != nil {
-		return nil, errors.Wrap(err, "get migrations")
+// checkMultiStatements reports an error if body, the content of f after its
+// directives, has several statements to run as one Exec by directive, but the
+// store's connection doesn't allow it. Otherwise the database would reject
+// them, or the driver run only the first.
+func (m *Migrate) checkMultiStatements(
+	f *file,
+	directive string,
+	body []byte,
+) error {
+	mc, ok := m.db.(MultiStatementChecker)
+	if !ok || mc.MultiStatements() {
+		return nil
 	}
+	stmts, err := splitStatements(body)
+	if err == nil && len(stmts) <= 1 {
+		return nil
+	}
+	return fmt.Errorf("%s starts with %s, so it runs as one Exec, but the connection doesn't allow several statements in one: open it with multiStatements=true, such as with mysql.WithMultiStatements",
+		f.Info.Name(), directive)
+}
 
-	// Fill in migration fullpath field based on the db type.
-	overrides, err := getOverrideSet(dir, dbt)
-	if err != nil {
-		return nil, fmt.Errorf("get override set: %w", err)
+// migrateMultiStatementFile executes the file's entire content in one call,
+// for files such as stored procedure definitions or those relying on session
+// state like SET @var, which break when split across pooled connections.
+//
+// No checkpoints are saved, so the file is all-or-nothing: if it fails, the
+// whole file runs again on the next attempt. Statements the database commits
+// as they run, such as DDL in MySQL, are not rolled back and should be safe
+// to re-run. For the same reason the file isn't retried after transient
+// errors.
+func (m *Migrate) migrateMultiStatementFile(
+	ctx context.Context,
+	f *file,
+	d directives,
+	byt, body []byte,
+	start time.Time,
+) error {
+	if err := m.checkMultiFile(ctx, f, body); err != nil {
+		return err
 	}
-	for i, mg := range m.Migrations {
-		override, exist := overrides[mg.Filename]
-		if exist {
-			m.Migrations[i].fullpath = override.fullpath
-		} else {
-			m.Migrations[i].fullpath = filepath.Join(dir, mg.Filename)
-		}
+	if m.stopped() {
+		return fmt.Errorf("%s: %w", f.Info.Name(), ErrStopped)
 	}
-	if err = m.validHistory(); err != nil {
-		return nil, err
+	m.Results[len(m.Results)-1].Mode = "multi"
+	m.log.Println(">", multiDirective, f.Info.Name())
+	timeout := m.statementTimeout
+	if d.timeout != nil {
+		timeout = *d.timeout
 	}
-	return m, nil
+	stmtStart := time.Now()
+	err := m.execWithTimeout(ctx, string(byt), timeout, false)
+	if m.verboseHistory {
+		m.recordHistory(ctx, f, 0, stmtStart, err)
+	}
+	lead := len(byt) - len(bytes.TrimLeftFunc(body, unicode.IsSpace))
+	line := lineOf(string(byt), lead)
+	if err != nil {
+		m.log.Println("failed on", f.Info.Name())
+		return m.statementErr(f, 0, line, string(bytes.TrimSpace(body)),
+			err)
+	}
+	if err = m.checkWarnings(f, 0, line); err != nil {
+		return err
+	}
+
+	return m.recordMigration(ctx, f, byt, start, StatusApplied, nil)
 }
 
-// Migrate all files in the directory. This function reports whether any
-// migration took place.
-func (m *Migrate) Migrate() (bool, error) {
-	var migrated bool
-	for i := len(m.Migrations); i < len(m.Files); i++ {
-		fi := m.Files[i]
-		if err := m.migrateFile(fi); err != nil {
-			return false, errors.Wrap(err, "migrate file")
+// checkMultiFile reports an error if the multi-statement file f, whose
+// content after its directive is body, can't run as one batch.
+func (m *Migrate) checkMultiFile(ctx context.Context, f *file, body []byte) error {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return fmt.Errorf("no sql statements in file: %s", f.Info.Name())
+	}
+
+	// Checkpoints would be left from running the file statement by
+	// statement before the directive was added, and can't be resumed
+	if !m.noMeta {
+		checkpoints, err := m.db.GetMetaCheckpoints(ctx, f.Info.Name())
+		if err != nil {
+			return errors.Wrap(err, "get checkpoints")
+		}
+		if len(checkpoints) > 0 {
+			return fmt.Errorf("%s has %d checkpoints, but %s files can't resume from checkpoints",
+				f.Info.Name(), len(checkpoints), multiDirective)
 		}
-		m.log.Println("migrated", fi.Info.Name())
-		migrated = true
 	}
-	return migrated, nil
+	return m.checkMultiStatements(f, multiDirective, body)
 }
 
-func (m *Migrate) validHistory() error {
-	for i := len(m.Files); i < len(m.Migrations); i++ {
-		m.log.Printf("missing already-run migration %q\n", m.Migrations[i])
+// Stop asks Migrate to stop before its next statement. The statement in
+// progress runs to completion and is checkpointed, then Migrate returns
+// ErrStopped. To abort the statement in progress instead, cancel the context
+// passed to Migrate. Stop is safe to call from other goroutines, and more than
+// once.
+func (m *Migrate) Stop() {
+	m.stopOnce.Do(func() { close(m.stop) })
+}
+
+func (m *Migrate) stopped() bool {
+	select {
+	case <-m.stop:
+		return true
+	default:
+		return false
 	}
-	if len(m.Files) < len(m.Migrations) {
-		return errors.New("cannot continue with missing migrations")
+}
+
+// checkContentSize reports an *ErrContentTooLarge if the meta tables can't
+// store f, whose content is byt, or its down migration.
+func (m *Migrate) checkContentSize(f *file, byt []byte) error {
+	if m.maxContent <= 0 {
+		return nil
 	}
-	for i := m.idx; i < len(m.Migrations); i++ {
-		mg := m.Migrations[i]
-		if mg.Filename != m.Files[i].Info.Name() {
-			m.log.Printf("\n%s was added to history before %s.\n",
-				m.Files[i].Info.Name(), mg.Filename)
-			return errors.New("failed to migrate. migrations must be appended")
+	if size := int64(len(byt)); size > m.maxContent {
+		return &ErrContentTooLarge{
+			Filename: f.Info.Name(),
+			Size:     size,
+			Max:      m.maxContent,
 		}
-		if err := m.checkHash(mg); err != nil {
-			return errors.Wrap(err, "check hash")
+	}
+	if f.downpath == "" {
+		return nil
+	}
+	fi, err := fs.Stat(m.fsys, f.downpath)
+	if err != nil {
+		return errors.Wrap(err, "stat down migration")
+	}
+	if fi.Size() > m.maxContent {
+		return &ErrContentTooLarge{
+			Filename: fi.Name(),
+			Size:     fi.Size(),
+			Max:      m.maxContent,
 		}
 	}
 	return nil
 }
 
-func (m *Migrate) checkHash(mg Migration) error {
-	fi, err := os.Open(mg.fullpath)
+// recordMigration records f with status, along with how long it had run
+// since start and, if it failed, runErr.
+func (m *Migrate) recordMigration(
+	ctx context.Context,
+	f *file,
+	byt []byte,
+	start time.Time,
+	status string,
+	runErr error,
+) error {
+	checksum, err := fileChecksumOf(m.checksumAlgo(), byt)
 	if err != nil {
-		return err
+		return errors.Wrap(err, "compute file checksum")
 	}
-	defer fi.Close()
-	_, check, err := computeChecksum(fi)
+	down, err := f.downContent(m.fsys)
 	if err != nil {
 		return err
 	}
-	if check != mg.Checksum {
-		m.log.Println("comparing", check, mg.Checksum)
-		return fmt.Errorf("checksum does not match %s. has the file changed?",
-			mg.Filename)
+	mg := Migration{
+		Filename:     f.Info.Name(),
+		Content:      string(byt),
+		Checksum:     checksum,
+		DownContent:  down,
+		Duration:     time.Since(start),
+		AppliedBy:    m.appliedBy,
+		ToolVersion:  ToolVersion,
+		AppVersion:   m.appVersion,
+		ChecksumAlgo: m.checksumAlgo(),
+		Status:       status,
+	}
+	if runErr != nil {
+		mg.Error = m.redactSQL(runErr.Error())
+	}
+	if err = m.db.UpsertMigration(ctx, mg); err != nil {
+		return errors.Wrap(err, "upsert migration")
 	}
 	return nil
 }
 
-func Statements(byt []byte) ([]string, error) {
-	// Split commands and remove comments at the start of lines
-	cmds := strings.Split(string(byt), ";")
-
-	// For postgresql specifically, some statements may have multiple `;`
-	// such as when creating functions. Join those together.
-	newCmds := []string{}
-	var keepGoing bool
-	for _, c := range cmds {
-		lowC := strings.ToLower(c)
+// defaultAppliedBy describes the current user and host, leaving out either
+// if it's unknown.
+func defaultAppliedBy() string {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	switch {
+	case err != nil || host == "":
+		return name
+	case name == "":
+		return host
+	}
+	return name + "@" + host
+}
 
-		if fnReturns.MatchString(lowC) {
-			keepGoing = true
-			newCmds = append(newCmds, c+";")
-			continue
-		}
-		if keepGoing {
-			newCmds[len(newCmds)-1] += c
-			if !strings.Contains(lowC, "plpgsql") {
-				newCmds[len(newCmds)-1] += ";"
-				continue
-			}
-			keepGoing = false
-			continue
-		}
-		newCmds = append(newCmds, c)
+// checkWarnings logs the warnings from the statement at idx in f, starting on
+// line, adding them to its result. With strict warnings, any warning is an
+// error.
+func (m *Migrate) checkWarnings(f *file, idx, line int) error {
+	wr, ok := m.db.(WarningReporter)
+	if !ok {
+		return nil
 	}
-	if keepGoing {
-		return nil, errors.New("unexpected exit, missing 'plpgsql'")
+	ws := wr.Warnings()
+	if len(ws) == 0 {
+		return nil
+	}
+	for i := range ws {
+		ws[i].Statement = idx
+		ws[i].Line = line
+		m.log.Printf("%s %s: %s %d: %s\n", f.Info.Name(),
+			statementAt(idx, line), ws[i].Level, ws[i].Code,
+			ws[i].Message)
 	}
-	cmds = newCmds
+	res := &m.Results[len(m.Results)-1]
+	res.Warnings = append(res.Warnings, ws...)
+	if m.strictWarnings {
+		return &ErrWarnings{
+			Filename:  f.Info.Name(),
+			Statement: idx,
+			Line:      line,
+			Warnings:  ws,
+		}
+	}
+	return nil
+}
 
-	filteredCmds := []string{}
-	for _, cmd := range cmds {
-		cmd = strings.TrimSpace(cmd)
-		if len(cmd) == 0 {
-			continue
+// insertCheckpoint records that the statement at idx in f ran, reconnecting
+// if the connection is lost. The checkpoint may have been written before the
+// connection dropped, so it's only inserted again if it's missing.
+func (m *Migrate) insertCheckpoint(
+	ctx context.Context,
+	f *file,
+	cmd, checksum string,
+	idx int,
+) error {
+	for {
+		err := m.db.InsertMetaCheckpoint(ctx, f.Info.Name(), cmd,
+			checksum, idx)
+		if err == nil || !m.canReconnect(err) {
+			return err
+		}
+		checkpoints, err := m.reconnect(ctx, f)
+		if err != nil {
+			return err
 		}
-		if !strings.HasPrefix(cmd, "--") && !strings.HasPrefix(cmd, "/*") {
-			filteredCmds = append(filteredCmds, cmd)
+		if len(checkpoints) > idx {
+			return nil
 		}
 	}
-	return filteredCmds, nil
 }
 
-func (m *Migrate) migrateFile(f *file) error {
-	byt, err := ioutil.ReadFile(f.fullpath)
+// ClearCheckpoints deletes the checkpoints of filename, a migration which
+// stopped partway, so it runs from its first statement when it's resumed,
+// such as after editing a statement which had run. The statements which ran
+// run again, so they must be safe to. It reports an error if filename has no
+// checkpoints. Only one migration is left partway at a time, so every
+// checkpoint is deleted. Run it only while no migration is running.
+//
+// A migration whose rollback failed, StatusRollbackFailed, is then recorded as
+// failed again, so resuming it runs it whole. Run it once what its down
+// migration left is recovered by hand.
+func ClearCheckpoints(ctx context.Context, db Store, filename string) error {
+	checkpoints, err := db.GetMetaCheckpoints(ctx, filename)
 	if err != nil {
-		return err
-	}
-	filteredCmds, err := Statements(byt)
-	if err != nil {
-		return fmt.Errorf("statements: %w", err)
+		return errors.Wrap(err, "get checkpoints")
 	}
-
-	// Ensure that commands are present
-	if len(filteredCmds) == 0 {
-		return fmt.Errorf("no sql statements in file: %s", f.Info.Name())
+	mg, err := db.GetMigrationWithDown(ctx, filename)
+	if err != nil && !errors.Is(err, ErrMigrationNotFound) {
+		return errors.Wrap(err, "get migration")
 	}
-
-	// Get our checkpoints, if any
-	checkpoints, err := m.db.GetMetaCheckpoints(f.Info.Name())
-	if err != nil {
-		return errors.Wrap(err, "get checkpoints")
+	rollbackFailed := err == nil && mg.Status == StatusRollbackFailed
+	if len(checkpoints) == 0 && !rollbackFailed {
+		return fmt.Errorf("%s has no checkpoints", filename)
 	}
 	if len(checkpoints) > 0 {
-		m.log.Printf("found %d checkpoints\n", len(checkpoints))
+		if err = db.DeleteMetaCheckpoints(ctx); err != nil {
+			return errors.Wrap(err, "delete checkpoints")
+		}
 	}
-
-	// Ensure commands weren't deleted from the file after we migrated them
-	if len(checkpoints) >= len(filteredCmds) {
-		return fmt.Errorf("len(checkpoints) %d >= len(cmds) %d",
-			len(checkpoints), len(filteredCmds))
+	if !rollbackFailed {
+		return nil
 	}
+	mg.Status = StatusFailed
+	return errors.Wrap(db.UpsertMigration(ctx, mg), "upsert migration")
+}
 
-	for i, cmd := range filteredCmds {
-		// Confirm the file up to our checkpoint has not changed
-		if i < len(checkpoints) {
-			r := strings.NewReader(cmd)
-			_, checksum, err := computeChecksum(r)
-			if err != nil {
-				return errors.Wrap(err, "compute checkpoint checksum")
-			}
-			if checksum != checkpoints[i] {
-				return fmt.Errorf(
-					"checksum does not equal checkpoint. has %s (cmd %d) changed?",
-					f.Info.Name(), i)
-			}
-			continue
-		}
+// canReconnect reports whether err is a lost connection and Migrate may
+// reconnect again.
+func (m *Migrate) canReconnect(err error) bool {
+	return (errors.Is(err, ErrConnectionFailed) ||
+		errors.Is(err, ErrConnectionLost)) &&
+		m.reconnects < m.reconnectAttempts
+}
 
-		// Print the commands we're executing to give progress updates
-		// on large migrations
-		shortCmd := cmd
-		shortCmd = strings.ReplaceAll(shortCmd, "\n", " ")
-		shortCmd = spaces.ReplaceAllString(shortCmd, " ")
-		if len(shortCmd) >= 78 {
-			shortCmd = shortCmd[:74] + "..."
-		}
-		m.log.Println(">", shortCmd)
+// reconnect replaces the store's connection, returning the checkpoints
+// recorded for f.
+func (m *Migrate) reconnect(ctx context.Context, f *file) ([]string, error) {
+	m.reconnects++
+	m.log.Printf("lost the connection, reconnecting (attempt %d of %d)\n",
+		m.reconnects, m.reconnectAttempts)
+	var err error
+	if r, ok := m.db.(Reconnecter); ok {
+		err = r.Reconnect(ctx)
+	} else {
+		_ = m.db.Close()
+		err = m.db.Open(ctx)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reconnect")
+	}
 
-		// Execute non-checkpointed commands one by one
-		_, err := m.db.Exec(cmd)
-		if err != nil {
-			m.log.Println("failed on", cmd)
-			return fmt.Errorf("%s: %s", f.Info.Name(), err)
-		}
+	// Stores learn the meta version, which decides the columns they
+	// write, when they report it
+	if _, err = m.db.CreateMetaVersionIfNotExists(ctx, version); err != nil {
+		return nil, errors.Wrap(err, "get meta version")
+	}
+	checkpoints, err := m.db.GetMetaCheckpoints(ctx, f.Info.Name())
+	if err != nil {
+		return nil, errors.Wrap(err, "get checkpoints")
+	}
+	return checkpoints, nil
+}
 
-		// Save a checkpoint
-		_, checksum, err := computeChecksum(strings.NewReader(cmd))
-		if err != nil {
-			return errors.Wrap(err, "compute checksum")
-		}
-		err = m.db.InsertMetaCheckpoint(f.Info.Name(), cmd, checksum, i)
-		if err != nil {
-			return errors.Wrap(err, "insert checkpoint")
+// statementErr describes the failure of the statement at idx in f, which
+// starts on line.
+func (m *Migrate) statementErr(
+	f *file,
+	idx, line int,
+	cmd string,
+	err error,
+) error {
+	cmd = m.redactSQL(cmd)
+	if len(cmd) > maxErrSQL {
+		cut := maxErrSQL
+		for cut > 0 && !utf8.RuneStart(cmd[cut]) {
+			cut--
 		}
+		cmd = cmd[:cut] + "..."
+	}
+	return &ErrStatementFailed{
+		Filename: f.Info.Name(),
+		Index:    idx,
+		Line:     line,
+		SQL:      cmd,
+		Err:      err,
 	}
+}
 
-	// We've successfully finished migrating the file, so we delete the
-	// temporary progress in metacheckpoints and save the migration
-	if err = m.db.DeleteMetaCheckpoints(); err != nil {
-		return errors.Wrap(err, "delete checkpoints")
+// shortSQL returns cmd redacted and on one line, cut to fit a line of the log.
+func (m *Migrate) shortSQL(cmd string) string {
+	short := m.redactSQL(cmd)
+	short = strings.ReplaceAll(short, "\n", " ")
+	short = spaces.ReplaceAllString(short, " ")
+	if len(short) >= 78 {
+		short = short[:74] + "..."
 	}
+	return short
+}
 
-	_, checksum, err := computeChecksum(bytes.NewReader(byt))
-	if err != nil {
-		return errors.Wrap(err, "compute file checksum")
+func (m *Migrate) redactSQL(cmd string) string {
+	if m.redact == nil {
+		return cmd
 	}
-	err = m.db.InsertMigration(f.Info.Name(), string(byt), checksum)
-	if err != nil {
-		return errors.Wrap(err, "insert migration")
+	return m.redact(cmd)
+}
+
+// execWithTimeout runs a statement, limited to timeout if it's non-zero. The
+// store is asked to kill a statement which runs out of time, since cancelling
+// its context may not stop it on the server.
+func (m *Migrate) execWithTimeout(
+	ctx context.Context,
+	cmd string,
+	timeout time.Duration,
+	retry bool,
+) error {
+	if timeout == 0 {
+		return m.exec(ctx, cmd, retry)
+	}
+	stmtCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := m.exec(stmtCtx, cmd, retry)
+	if err == nil || ctx.Err() != nil ||
+		!errors.Is(stmtCtx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	if k, ok := m.db.(QueryKiller); ok {
+		killCtx, cancel := context.WithTimeout(
+			context.WithoutCancel(ctx), killTimeout)
+		defer cancel()
+		if err := k.KillQuery(killCtx); err != nil {
+			m.log.Printf("WARNING: failed to kill the statement, which may still be running: %s\n",
+				err)
+		}
+	}
+	return fmt.Errorf("exceeded its %s timeout: %w", timeout,
+		context.DeadlineExceeded)
+}
+
+// exec runs a statement, retrying it with exponential backoff while it fails
+// with errors the store reports as retryable.
+func (m *Migrate) exec(ctx context.Context, cmd string, retry bool) error {
+	rc, ok := m.db.(RetryChecker)
+	retry = retry && ok
+	backoff := m.retryBackoff
+	for attempt := 1; ; attempt++ {
+		_, err := m.db.Exec(ctx, cmd)
+		if err == nil || !retry || attempt >= m.retryAttempts ||
+			!rc.IsRetryable(err) {
+			return err
+		}
+		m.log.Printf("attempt %d of %d failed, retrying in %s: %s\n",
+			attempt, m.retryAttempts, backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
 	}
-	return nil
 }
 
-func (m *Migrate) skip(toFile string) (int, error) {
+func (m *Migrate) skip(ctx context.Context, toFile string) (int, error) {
 	// Get just the filename if skip is a directory
 	_, toFile = filepath.Split(toFile)
 
@@ -345,44 +2061,82 @@ func (m *Migrate) skip(toFile string) (int, error) {
 		return 0, fmt.Errorf("%s does not exist", toFile)
 	}
 	for i := 0; i <= index; i++ {
-		fi, err := os.Open(m.Files[i].fullpath)
+		byt, err := fs.ReadFile(m.fsys, m.Files[i].fullpath)
 		if err != nil {
 			return -1, err
 		}
-		content, checksum, err := computeChecksum(fi)
+		byt = normalizeLineEndings(byt)
+		checksum, err := fileChecksumOf(m.checksumAlgo(), byt)
 		if err != nil {
-			fi.Close()
 			return -1, err
 		}
-		name := m.Files[i].Info.Name()
-		err = m.db.UpsertMigration(name, content, checksum)
+		if err = m.checkContentSize(m.Files[i], byt); err != nil {
+			return -1, err
+		}
+		down, err := m.Files[i].downContent(m.fsys)
 		if err != nil {
-			fi.Close()
 			return -1, err
 		}
-		if err = fi.Close(); err != nil {
+		err = m.db.UpsertMigration(ctx, Migration{
+			Filename:     m.Files[i].Info.Name(),
+			Content:      string(byt),
+			Checksum:     checksum,
+			DownContent:  down,
+			AppliedBy:    m.appliedBy,
+			ToolVersion:  ToolVersion,
+			AppVersion:   m.appVersion,
+			ChecksumAlgo: m.checksumAlgo(),
+			Status:       StatusSkipped,
+		})
+		if err != nil {
 			return -1, err
 		}
 	}
 	return index, nil
 }
 
-func computeChecksum(r io.Reader) (content string, checksum string, err error) {
-	h := md5.New()
+func computeChecksum(r io.Reader, algo string) (content string, checksum string, err error) {
 	byt, err := ioutil.ReadAll(r)
 	if err != nil {
 		return "", "", errors.Wrap(err, "read all")
 	}
-	if _, err := io.Copy(h, bytes.NewReader(byt)); err != nil {
+	byt = normalizeLineEndings(byt)
+	checksum, err = checksumOf(algo, byt)
+	if err != nil {
 		return "", "", err
 	}
-	return string(byt), fmt.Sprintf("%x", h.Sum(nil)), nil
+	return string(byt), checksum, nil
 }
 
-// readDir collects file infos from the migration directory.
-func readDir(dir string, dbt DBType) ([]*file, error) {
+// downContent reads f's down migration from fsys, if it has one.
+func (f *file) downContent(fsys fs.FS) (string, error) {
+	if f.downpath == "" {
+		return "", nil
+	}
+	byt, err := fs.ReadFile(fsys, f.downpath)
+	if err != nil {
+		return "", errors.Wrap(err, "read down migration")
+	}
+	return string(normalizeLineEndings(byt)), nil
+}
+
+// readDir collects file infos from the migration directory dir in fsys,
+// pairing each migration with its down migration.
+func readDir(fsys fs.FS, dir string, dbt DBType) ([]*file, error) {
+	files, err := readDirFiles(fsys, dir, dbt)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no sql migration files found (might be the wrong -dir)")
+	}
+	return files, nil
+}
+
+// readDirFiles is readDir, but reports no files in dir without an error.
+func readDirFiles(fsys fs.FS, dir string, dbt DBType) ([]*file, error) {
 	files := []*file{}
-	tmp, err := ioutil.ReadDir(dir)
+	tmp, err := readDirInfo(fsys, dir)
 	if err != nil {
 		return nil, errors.Wrap(err, "read dir")
 	}
@@ -398,60 +2152,87 @@ func readDir(dir string, dbt DBType) ([]*file, error) {
 	// name of the DB used. If "migrate -t maria-db" then we'll look for
 	// the `maria-db` folder and prefer identical migration filenames in
 	// that folder over the other one.
+	downs := map[string]string{}
 	for _, fi := range tmp {
-		fullpath := filepath.Join(dir, fi.Name())
+		fullpath := path.Join(dir, fi.Name())
 
 		// Skip directories.
 		if fi.IsDir() {
 			continue
 		}
+		if err = checkSpace(fi.Name()); err != nil {
+			return nil, err
+		}
+		fi = normalizedInfo(fi)
 
-		// Skip any non-sql files.
-		if filepath.Ext(fi.Name()) != ".sql" {
+		// Skip any non-sql files, and any which aren't prefixed by a
+		// number, including hidden files. Go migrations have no
+		// extension.
+		if goMigrationOf(fi) == nil && !isMigrationName(fi.Name()) {
 			continue
 		}
 
-		// Skip any files which aren't prefixed by a number, including
-		// hidden files.
-		if !unicode.IsDigit(rune(fi.Name()[0])) {
+		// Down migrations are paired with their up migrations below
+		// rather than run themselves, whether either is compressed.
+		if up, ok := strings.CutSuffix(strings.TrimSuffix(fi.Name(), ".gz"),
+			downSuffix); ok {
+			downs[up] = fullpath
 			continue
 		}
 		files = append(files, &file{Info: fi, fullpath: fullpath})
 	}
-	if len(files) == 0 {
-		return nil, errors.New("no sql migration files found (might be the wrong -dir)")
+	for _, fi := range files {
+		up := migrationStem(fi.Info.Name())
+		fi.downpath = downs[up]
+		delete(downs, up)
+	}
+	for up, down := range downs {
+		return nil, fmt.Errorf("%s has no migration %s.sql to undo",
+			path.Base(down), up)
 	}
 
 	// Prioritize our specific database over the set in the main migration
 	// directory.
-	overrideSet, err := getOverrideSet(dir, dbt)
+	overrideSet, err := getOverrideSet(fsys, dir, dbt)
 	if err != nil {
 		return nil, fmt.Errorf("get override set: %w", err)
 	}
 	for i, fi := range files {
 		if override, exist := overrideSet[fi.Info.Name()]; exist {
+			// An override without its own down migration keeps
+			// the main directory's.
+			if override.downpath == "" {
+				override.downpath = fi.downpath
+			}
 			files[i] = override
 			fmt.Println("OVERRIDING", override.Info.Name())
 		}
 	}
+	if err = checkNames(files); err != nil {
+		return nil, err
+	}
 	return files, nil
 }
 
-func getOverrideSet(dir string, dbt DBType) (map[string]*file, error) {
-	tmp, err := ioutil.ReadDir(dir)
+func getOverrideSet(
+	fsys fs.FS,
+	dir string,
+	dbt DBType,
+) (map[string]*file, error) {
+	tmp, err := readDirInfo(fsys, dir)
 	if err != nil {
 		return nil, errors.Wrap(err, "read dir")
 	}
 	overrides := []*file{}
 	for _, fi := range tmp {
-		fullpath := filepath.Join(dir, fi.Name())
+		fullpath := path.Join(dir, fi.Name())
 		if !fi.IsDir() || fi.Name() != string(dbt) {
 			continue
 		}
 
 		// The empty DBType prevents recursive descent into structures
 		// like ./mariadb/mariadb/mariadb/...
-		overrides, err = readDir(fullpath, DBType(""))
+		overrides, err = readDir(fsys, fullpath, DBType(""))
 		if err != nil {
 			return nil, fmt.Errorf("read dir %s: %w",
 				fi.Name(), err)
@@ -464,42 +2245,98 @@ func getOverrideSet(dir string, dbt DBType) (map[string]*file, error) {
 	return overrideSet, nil
 }
 
-// sortFiles by name, ensuring that something like 1.sql, 2.sql, 10.sql is
-// ordered correctly.
-func sortFiles(files []*file) error {
-	var nameErr error
-	sort.Slice(files, func(i, j int) bool {
-		if nameErr != nil {
-			return false
-		}
-		fiName1 := regexNum.FindString(files[i].Info.Name())
-		fiName2 := regexNum.FindString(files[j].Info.Name())
-		fiNum1, err := strconv.ParseUint(fiName1, 10, 64)
+// isMigrationName reports whether the file called name is read as a
+// migration, rather than skipped.
+func isMigrationName(name string) bool {
+	return (path.Ext(name) == ".sql" || strings.HasSuffix(name, gzipSuffix)) &&
+		unicode.IsDigit(rune(name[0]))
+}
+
+// migrationStem is the name of a migration without its extension, by which
+// its down migration is paired with it.
+func migrationStem(name string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ".sql")
+}
+
+// readDirInfo reads the file infos in dir, sorted by name.
+func readDirInfo(fsys fs.FS, dir string) ([]os.FileInfo, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		fi, err := e.Info()
 		if err != nil {
-			nameErr = errors.Wrapf(err, "parse uint in file %s",
-				files[i].Info.Name())
-			return false
+			return nil, err
 		}
-		fiNum2, err := strconv.ParseUint(fiName2, 10, 64)
-		if err != nil {
-			nameErr = errors.Wrapf(err, "parse uint in file %s",
-				files[i].Info.Name())
-			return false
+		infos = append(infos, fi)
+	}
+	return infos, nil
+}
+
+// dirFS opens the migrations directory dir, or the working directory if it's
+// empty. It checks dir exists, since errors from the FS name only paths within
+// it.
+func dirFS(dir string) (fs.FS, error) {
+	if dir == "" {
+		dir = "."
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return nil, errors.Wrap(err, "get migrations")
+	}
+	return os.DirFS(dir), nil
+}
+
+// sortFiles by o, ensuring that something like 1.sql, 2.sql, 10.sql is
+// ordered correctly, and refusing files o puts in the same place. Files are
+// sorted by CompareFilenames first, so ties are reported in the same order
+// whatever order they were read in.
+func sortFiles(files []*file, o Ordering) error {
+	checker, _ := o.(NameChecker)
+	for _, f := range files {
+		base := path.Base(f.Info.Name())
+		if !regexNum.MatchString(base) {
+			return fmt.Errorf("%s must start with a number",
+				f.Info.Name())
+		}
+		if checker == nil {
+			continue
 		}
-		if fiNum1 == fiNum2 {
-			nameErr = fmt.Errorf("cannot have duplicate timestamp: %d", fiNum1)
-			return false
+		if err := checker.CheckName(base); err != nil {
+			return err
 		}
-		return fiNum1 < fiNum2
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return CompareFilenames(path.Base(files[i].Info.Name()),
+			path.Base(files[j].Info.Name())) < 0
 	})
-	return nameErr
+	sort.SliceStable(files, func(i, j int) bool {
+		return o.Less(path.Base(files[i].Info.Name()),
+			path.Base(files[j].Info.Name()))
+	})
+	for i := 1; i < len(files); i++ {
+		name1, name2 := files[i-1].Info.Name(), files[i].Info.Name()
+		base1, base2 := path.Base(name1), path.Base(name2)
+		if o.Less(base1, base2) {
+			continue
+		}
+		num1 := regexNum.FindString(base1)
+		if compareDigits(num1, regexNum.FindString(base2)) == 0 {
+			return fmt.Errorf("cannot have duplicate number %s: %s and %s",
+				trimZeros(num1), name1, name2)
+		}
+		return fmt.Errorf("cannot have %s and %s in the same place",
+			name1, name2)
+	}
+	return nil
 }
 
 func migrationsFromFiles(m *Migrate) ([]Migration, error) {
 	ms := make([]Migration, len(m.Files))
 	for i, fi := range m.Files {
 		fmt.Println("FULLPATH", fi.fullpath)
-		byt, err := ioutil.ReadFile(fi.fullpath)
+		byt, err := fs.ReadFile(m.fsys, fi.fullpath)
 		if err != nil {
 			return nil, errors.Wrap(err, "read file")
 		}
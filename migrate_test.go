@@ -0,0 +1,6114 @@
+package migrate
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+	"unicode/utf8"
+)
+
+//go:embed testdata/migrations
+var testMigrations embed.FS
+
+var (
+	ctx          = context.Background()
+	errTransient = errors.New("transient")
+)
+
+var update = flag.Bool("update", false, "rewrite golden files in testdata")
+
+// fakeStore keeps migrations in memory and fails each statement with
+// errTransient the first failures[stmt] times it runs. Statements in slow
+// block until their context is done. A non-zero version is reported as the
+// existing meta version. Open returns each of openErrs in turn. Statements in
+// drops fail once with their error without running, like a lost connection,
+// and dropCheckpoint fails the next checkpoint after writing it. Statements in
+// held run once their hold is released. KillQuery counts its calls in kills.
+// Warnings reports warnings[stmt] for the last statement run. Each UpgradeToVn
+// from UpgradeToV2 counts its calls in upgrades, returning onUpgrade's error if
+// it's set. SetMetaVersion swaps version. InsertHistory appends to history, or
+// fails with historyErr. MaxContentSize reports maxContent. GetMetaVersion
+// reports the meta tables exist once CreateMetaIfNotExists sets created. The
+// lease methods keep the lock in lock, guarded by lockMu since heartbeats run
+// concurrently, calling beforeAcquire on each attempt to acquire the lock and
+// onLock when it succeeds. HeartbeatMetaLock fails with heartbeatErrs[holder]
+// and counts its calls in heartbeats.
+type fakeStore struct {
+	version        int
+	upgrades       int
+	onUpgrade      func(to int) error
+	openErrs       []error
+	opens          int
+	drops          map[string]error
+	dropCheckpoint error
+	failures       map[string]int
+	execs          map[string]int
+	slow           map[string]chan struct{}
+	held           map[string]hold
+	kills          int
+	warnings       map[string][]Warning
+	last           string
+	migrations     []Migration
+	checkpoints    map[string][]string
+	contents       map[string][]string
+	history        []History
+	historyErr     error
+	maxContent     int64
+	created        bool
+
+	lockMu        sync.Mutex
+	lock          *MetaLock
+	beforeAcquire func()
+	onLock        func()
+	heartbeatErrs map[string]error
+	heartbeats    int
+}
+
+// hold pauses a statement in fakeStore, closing started when it begins and
+// running it when release is closed.
+type hold struct {
+	started, release chan struct{}
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		failures:    map[string]int{},
+		execs:       map[string]int{},
+		drops:       map[string]error{},
+		warnings:    map[string][]Warning{},
+		slow:        map[string]chan struct{}{},
+		held:        map[string]hold{},
+		checkpoints: map[string][]string{},
+		contents:    map[string][]string{},
+
+		heartbeatErrs: map[string]error{},
+	}
+}
+
+func (s *fakeStore) Open(ctx context.Context) error {
+	s.opens++
+	if len(s.openErrs) == 0 {
+		return nil
+	}
+	err := s.openErrs[0]
+	s.openErrs = s.openErrs[1:]
+	return err
+}
+
+func (s *fakeStore) Close() error { return nil }
+
+func (s *fakeStore) Exec(
+	ctx context.Context,
+	q string,
+	args ...interface{},
+) (sql.Result, error) {
+	if started, ok := s.slow[q]; ok {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if h, ok := s.held[q]; ok {
+		close(h.started)
+		<-h.release
+	}
+	if err, ok := s.drops[q]; ok {
+		delete(s.drops, q)
+		return nil, err
+	}
+	s.execs[q]++
+	s.last = q
+	if s.execs[q] <= s.failures[q] {
+		return nil, errTransient
+	}
+	return nil, nil
+}
+
+func (s *fakeStore) Warnings() []Warning {
+	return append([]Warning(nil), s.warnings[s.last]...)
+}
+
+func (s *fakeStore) KillQuery(context.Context) error {
+	s.kills++
+	return nil
+}
+
+func (s *fakeStore) IsRetryable(err error) bool {
+	return errors.Is(err, errTransient)
+}
+
+func (s *fakeStore) CreateMetaVersionIfNotExists(
+	ctx context.Context,
+	v int,
+) (int, error) {
+	if s.version != 0 {
+		return s.version, nil
+	}
+	return v, nil
+}
+
+func (s *fakeStore) CreateMetaIfNotExists(context.Context) error {
+	s.created = true
+	return nil
+}
+
+func (s *fakeStore) GetMetaVersion(context.Context) (int, bool, error) {
+	if !s.created {
+		return 0, false, nil
+	}
+	if s.version != 0 {
+		return s.version, true, nil
+	}
+	return version, true, nil
+}
+
+func (s *fakeStore) CreateMetaCheckpointsIfNotExists(context.Context) error {
+	return nil
+}
+
+func (s *fakeStore) GetMigrations(context.Context) ([]Migration, error) {
+	ms := append([]Migration{}, s.migrations...)
+	SortMigrations(ms)
+	return ms, nil
+}
+
+func (s *fakeStore) InsertMigration(ctx context.Context, m Migration) error {
+	s.migrations = append(s.migrations, m)
+	return nil
+}
+
+func (s *fakeStore) RenameMigration(ctx context.Context, from, to string) error {
+	for i, mg := range s.migrations {
+		if mg.Filename == from {
+			s.migrations[i].Filename = to
+		}
+	}
+	return nil
+}
+
+func (s *fakeStore) DeleteMigration(ctx context.Context, filename string) error {
+	for i, mg := range s.migrations {
+		if mg.Filename == filename {
+			s.migrations = append(s.migrations[:i], s.migrations[i+1:]...)
+			break
+		}
+	}
+	delete(s.checkpoints, filename)
+	delete(s.contents, filename)
+	return nil
+}
+
+func (s *fakeStore) UpsertMigration(ctx context.Context, m Migration) error {
+	for i, mg := range s.migrations {
+		if mg.Filename == m.Filename {
+			s.migrations[i] = m
+			return nil
+		}
+	}
+	return s.InsertMigration(ctx, m)
+}
+
+func (s *fakeStore) GetMetaCheckpoints(
+	ctx context.Context,
+	filename string,
+) ([]string, error) {
+	return s.checkpoints[filename], nil
+}
+
+func (s *fakeStore) InsertMetaCheckpoint(
+	ctx context.Context,
+	filename, content, checksum string,
+	idx int,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.checkpoints[filename] = append(s.checkpoints[filename], checksum)
+	s.contents[filename] = append(s.contents[filename], content)
+	if err := s.dropCheckpoint; err != nil {
+		s.dropCheckpoint = nil
+		return err
+	}
+	return nil
+}
+
+func (s *fakeStore) DeleteMetaCheckpoints(context.Context) error {
+	s.checkpoints = map[string][]string{}
+	s.contents = map[string][]string{}
+	return nil
+}
+
+func (s *fakeStore) GetMetaCheckpointContents(
+	ctx context.Context,
+	filename string,
+) ([]string, error) {
+	return s.contents[filename], nil
+}
+
+func (s *fakeStore) SetMetaVersion(ctx context.Context, from, to int) error {
+	if s.version != from && s.version != to {
+		return &ErrVersionConflict{From: from, To: to}
+	}
+	s.version = to
+	return nil
+}
+
+func (s *fakeStore) UpgradeToV1(context.Context, []Migration) error {
+	return nil
+}
+
+func (s *fakeStore) upgrade(to int) error {
+	s.upgrades++
+	if s.onUpgrade != nil {
+		return s.onUpgrade(to)
+	}
+	return nil
+}
+
+func (s *fakeStore) UpgradeToV2(context.Context) error {
+	return s.upgrade(2)
+}
+
+func (s *fakeStore) UpgradeToV3(context.Context) error {
+	return s.upgrade(3)
+}
+
+func (s *fakeStore) UpgradeToV4(context.Context) error {
+	return s.upgrade(4)
+}
+
+func (s *fakeStore) UpgradeToV5(context.Context) error {
+	return s.upgrade(5)
+}
+
+func (s *fakeStore) UpgradeToV6(context.Context) error {
+	return s.upgrade(6)
+}
+
+func (s *fakeStore) GetMigrationWithDown(
+	ctx context.Context,
+	filename string,
+) (Migration, error) {
+	for _, m := range s.migrations {
+		if m.Filename == filename {
+			return m, nil
+		}
+	}
+	return Migration{}, ErrMigrationNotFound
+}
+
+func (s *fakeStore) MaxContentSize(context.Context) (int64, error) {
+	return s.maxContent, nil
+}
+
+func (s *fakeStore) CreateMetaLockIfNotExists(context.Context) error {
+	return nil
+}
+
+func (s *fakeStore) AcquireMetaLock(
+	ctx context.Context,
+	lock MetaLock,
+	staleBefore time.Time,
+) (bool, error) {
+	s.lockMu.Lock()
+	defer s.lockMu.Unlock()
+	if s.beforeAcquire != nil {
+		s.beforeAcquire()
+	}
+	if s.lock != nil && s.lock.Holder != lock.Holder &&
+		!s.lock.HeartbeatAt.Before(staleBefore) {
+		return false, nil
+	}
+	s.lock = &lock
+	if s.onLock != nil {
+		s.onLock()
+	}
+	return true, nil
+}
+
+func (s *fakeStore) HeartbeatMetaLock(
+	ctx context.Context,
+	holder string,
+	at time.Time,
+) (bool, error) {
+	s.lockMu.Lock()
+	defer s.lockMu.Unlock()
+	s.heartbeats++
+	if err := s.heartbeatErrs[holder]; err != nil {
+		return false, err
+	}
+	if s.lock == nil || s.lock.Holder != holder {
+		return false, nil
+	}
+	s.lock.HeartbeatAt = at
+	return true, nil
+}
+
+func (s *fakeStore) ReleaseMetaLock(ctx context.Context, holder string) error {
+	s.lockMu.Lock()
+	defer s.lockMu.Unlock()
+	if s.lock != nil && s.lock.Holder == holder {
+		s.lock = nil
+	}
+	return nil
+}
+
+func (s *fakeStore) DeleteMetaLock(context.Context) error {
+	s.lockMu.Lock()
+	defer s.lockMu.Unlock()
+	s.lock = nil
+	return nil
+}
+
+func (s *fakeStore) GetMetaLock(context.Context) (*MetaLock, error) {
+	s.lockMu.Lock()
+	defer s.lockMu.Unlock()
+	if s.lock == nil {
+		return nil, nil
+	}
+	lock := *s.lock
+	return &lock, nil
+}
+
+func (s *fakeStore) SetMetaLockFilename(
+	ctx context.Context,
+	holder, filename string,
+) error {
+	s.lockMu.Lock()
+	defer s.lockMu.Unlock()
+	if s.lock != nil && s.lock.Holder == holder {
+		s.lock.Filename = filename
+	}
+	return nil
+}
+
+func (s *fakeStore) CreateMetaHistoryIfNotExists(context.Context) error {
+	return nil
+}
+
+func (s *fakeStore) InsertHistory(ctx context.Context, h History) error {
+	if s.historyErr != nil {
+		return s.historyErr
+	}
+	s.history = append(s.history, h)
+	return nil
+}
+
+func (s *fakeStore) GetHistory(
+	ctx context.Context,
+	filename string,
+	limit int,
+) ([]History, error) {
+	var history []History
+	for i := len(s.history) - 1; i >= 0; i-- {
+		h := s.history[i]
+		if filename != "" && h.Filename != filename {
+			continue
+		}
+		if limit > 0 && len(history) == limit {
+			break
+		}
+		history = append(history, h)
+	}
+	return history, nil
+}
+
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Printf(s string, vs ...interface{}) { l.t.Logf(s, vs...) }
+func (l testLogger) Println(vs ...interface{})          { l.t.Log(vs...) }
+
+// recordLogger records what's logged, as well as logging it to t.
+type recordLogger struct {
+	testLogger
+	buf *strings.Builder
+}
+
+func (l recordLogger) Printf(s string, vs ...interface{}) {
+	l.testLogger.Printf(s, vs...)
+	fmt.Fprintf(l.buf, s, vs...)
+}
+
+func (l recordLogger) Println(vs ...interface{}) {
+	l.testLogger.Println(vs...)
+	fmt.Fprintln(l.buf, vs...)
+}
+
+func TestRetry(t *testing.T) {
+	const stmt = "UPDATE users SET name = 'a'"
+	tests := []struct {
+		name      string
+		content   string
+		failures  int
+		wantErr   bool
+		wantExecs int
+	}{
+		{
+			name:      "succeeds after retries",
+			content:   stmt + ";",
+			failures:  2,
+			wantExecs: 3,
+		},
+		{
+			name:      "attempt limit",
+			content:   stmt + ";",
+			failures:  5,
+			wantErr:   true,
+			wantExecs: 3,
+		},
+		{
+			name:      "no retry directive",
+			content:   noRetryDirective + "\n" + stmt + ";",
+			failures:  1,
+			wantErr:   true,
+			wantExecs: 1,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFile(t, dir, "1.sql", tc.content)
+			db := newFakeStore()
+			db.failures[stmt] = tc.failures
+
+			m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+				WithRetry(3, time.Millisecond))
+			check(t, err)
+			_, err = m.Migrate(ctx)
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("expected error %t, got %v", tc.wantErr, err)
+			}
+			if db.execs[stmt] != tc.wantExecs {
+				t.Fatalf("expected %d execs, got %d", tc.wantExecs,
+					db.execs[stmt])
+			}
+		})
+	}
+}
+
+func TestMigrateCancel(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);\n"+
+		"UPDATE a SET id = 1;\nCREATE TABLE b (id INT);")
+	db := newFakeStore()
+	started := make(chan struct{})
+	db.slow["UPDATE a SET id = 1"] = started
+
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "")
+	check(t, err)
+	cancelCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		<-started
+		cancel()
+	}()
+	_, err = m.Migrate(cancelCtx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// The statement before the slow one is checkpointed
+	if n := len(db.checkpoints["1.sql"]); n != 1 {
+		t.Fatalf("expected 1 checkpoint, got %d", n)
+	}
+	if len(db.migrations) != 1 ||
+		db.migrations[0].Status != StatusInProgress {
+		t.Fatalf("expected the file to be in progress, got %+v",
+			db.migrations)
+	}
+
+	// Resuming skips the checkpointed statement
+	delete(db.slow, "UPDATE a SET id = 1")
+	m, err = New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if n := db.execs["CREATE TABLE a (id INT)"]; n != 1 {
+		t.Fatalf("expected first statement to run once, ran %d times", n)
+	}
+	if len(db.migrations) != 1 || len(db.checkpoints) != 0 {
+		t.Fatal("expected the file to be recorded")
+	}
+}
+
+func TestErrChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);")
+	db := newFakeStore()
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+
+	writeFile(t, dir, "1.sql", "CREATE TABLE b (id INT);")
+	_, err = New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "")
+	var mismatch *ErrChecksumMismatch
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	if mismatch.Filename != "1.sql" || mismatch.Statement != -1 ||
+		mismatch.Stored != db.migrations[0].Checksum ||
+		mismatch.Computed == mismatch.Stored {
+		t.Fatalf("unexpected mismatch %+v", mismatch)
+	}
+}
+
+func TestErrChecksumMismatchCheckpoint(t *testing.T) {
+	const stmt = "UPDATE a SET id = 1"
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);\n"+stmt+";")
+	db := newFakeStore()
+	db.failures[stmt] = 1
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+		WithRetry(1, 0))
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	// Change the checkpointed statement
+	writeFile(t, dir, "1.sql", "CREATE TABLE b (id INT);\n"+stmt+";")
+	m, err = New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+		WithResume())
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	var mismatch *ErrChecksumMismatch
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	if mismatch.Statement != 0 {
+		t.Fatalf("expected cmd 0, got %d", mismatch.Statement)
+	}
+}
+
+func TestErrPartiallyApplied(t *testing.T) {
+	const stmt = "UPDATE a SET id = 1"
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);\n"+stmt+";")
+	db := newFakeStore()
+	db.failures[stmt] = 1
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+		WithRetry(1, 0))
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	var partial *ErrPartiallyApplied
+	if !errors.As(err, &partial) {
+		t.Fatalf("expected partially applied, got %v", err)
+	}
+	if partial.Filename != "1.sql" || partial.Statement != 1 {
+		t.Fatalf("unexpected error %+v", partial)
+	}
+	if !errors.Is(err, errTransient) {
+		t.Fatal("expected the statement's error to be wrapped")
+	}
+
+	// A failure on the first statement leaves nothing applied
+	db = newFakeStore()
+	db.failures["CREATE TABLE a (id INT)"] = 1
+	m, err = New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+		WithRetry(1, 0))
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	if err == nil || errors.As(err, &partial) {
+		t.Fatalf("expected an error which isn't partially applied, got %v",
+			err)
+	}
+}
+
+func TestErrVersionTooNew(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);")
+	db := newFakeStore()
+	db.version = version + 1
+	_, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "")
+	var tooNew *ErrVersionTooNew
+	if !errors.As(err, &tooNew) {
+		t.Fatalf("expected version too new, got %v", err)
+	}
+	if tooNew.Have != version+1 || tooNew.Want != version {
+		t.Fatalf("unexpected versions %+v", tooNew)
+	}
+}
+
+func TestUpgradeConflict(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);")
+	db := newFakeStore()
+	db.version = 2
+
+	// Another run upgrades to v5 while this one upgrades to v3, so only
+	// the upgrade to v6 remains
+	db.onUpgrade = func(to int) error {
+		if to != 3 {
+			return db.SetMetaVersion(ctx, to-1, to)
+		}
+		db.version = 5
+		return &ErrVersionConflict{From: 2, To: 3}
+	}
+	_, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+		WithUpgrade())
+	check(t, err)
+	if db.upgrades != 2 || db.version != version {
+		t.Fatalf("expected to upgrade from v5, got %d upgrades to v%d",
+			db.upgrades, db.version)
+	}
+
+	// A conflict which leaves the version where it was isn't tried again
+	db.version = 2
+	db.upgrades = 0
+	db.onUpgrade = func(to int) error {
+		return &ErrVersionConflict{From: to - 1, To: to}
+	}
+	_, err = New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+		WithUpgrade())
+	var conflict *ErrVersionConflict
+	if !errors.As(err, &conflict) || conflict.From != 2 {
+		t.Fatalf("expected a conflict from v2, got %v", err)
+	}
+	if db.upgrades != 1 {
+		t.Fatalf("expected 1 upgrade, got %d", db.upgrades)
+	}
+}
+
+func TestMigrationMetadata(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);")
+	db := newFakeStore()
+	db.version = 1
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+		WithAppliedBy("deploy@ci"), WithAppVersion("v1.42.0+sha.abc123"),
+		WithUpgrade())
+	check(t, err)
+	if db.upgrades != 5 {
+		t.Fatalf("expected 5 upgrades from v1, got %d", db.upgrades)
+	}
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if len(db.migrations) != 1 {
+		t.Fatalf("expected 1 migration, got %d", len(db.migrations))
+	}
+	got := db.migrations[0]
+	if got.AppliedBy != "deploy@ci" || got.ToolVersion != ToolVersion ||
+		got.AppVersion != "v1.42.0+sha.abc123" ||
+		got.Duration < 0 || got.ChecksumAlgo != ChecksumSHA256 ||
+		got.Status != StatusApplied {
+		t.Fatalf("unexpected metadata %+v", got)
+	}
+}
+
+func TestDownMigrations(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);")
+	writeFile(t, dir, "1.down.sql", "DROP TABLE a;")
+	writeFile(t, dir, "2.sql", "CREATE TABLE b (id INT);")
+	db := newFakeStore()
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "")
+	check(t, err)
+	if len(m.Files) != 2 {
+		t.Fatalf("expected 2 files, got %d", len(m.Files))
+	}
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if db.execs["DROP TABLE a"] != 0 {
+		t.Fatal("expected the down migration not to run")
+	}
+	got, err := db.GetMigrationWithDown(ctx, "1.sql")
+	check(t, err)
+	if got.DownContent != "DROP TABLE a;" {
+		t.Fatalf("unexpected down content %q", got.DownContent)
+	}
+	got, err = db.GetMigrationWithDown(ctx, "2.sql")
+	check(t, err)
+	if got.DownContent != "" {
+		t.Fatalf("expected no down content, got %q", got.DownContent)
+	}
+}
+
+func TestDownMigrationWithoutUp(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);")
+	writeFile(t, dir, "2.down.sql", "DROP TABLE b;")
+	_, err := New(ctx, newFakeStore(), testLogger{t}, DBTypeMySQL, dir, "")
+	if err == nil || !strings.Contains(err.Error(), "2.down.sql") {
+		t.Fatalf("expected an error naming 2.down.sql, got %v", err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	const stmt = "CREATE TABLE a (id INT)"
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", stmt+";")
+	db := newFakeStore()
+	db.failures[stmt] = 1
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+		WithRetry(1, 0))
+	check(t, err)
+	if _, err = m.Migrate(ctx); err == nil {
+		t.Fatal("expected the first run to fail")
+	}
+	m, err = New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+		WithResume())
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+
+	history, err := db.GetHistory(ctx, "1.sql", 0)
+	check(t, err)
+	if len(history) != 2 {
+		t.Fatalf("expected 2 attempts, got %+v", history)
+	}
+	ok, failed := history[0], history[1]
+	if !ok.Success || ok.Error != "" || ok.Statement != -1 {
+		t.Fatalf("unexpected successful attempt %+v", ok)
+	}
+	if failed.Success || !strings.Contains(failed.Error, "transient") {
+		t.Fatalf("unexpected failed attempt %+v", failed)
+	}
+	if ok.RunID == failed.RunID || len(ok.RunID) != 36 {
+		t.Fatalf("expected distinct run ids, got %s and %s", ok.RunID,
+			failed.RunID)
+	}
+	if ok.FinishedAt.Before(ok.StartedAt) {
+		t.Fatalf("finished before starting: %+v", ok)
+	}
+}
+
+func TestVerboseHistory(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);\nUPDATE a SET id = 1;")
+	db := newFakeStore()
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+		WithVerboseHistory())
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if len(db.history) != 3 {
+		t.Fatalf("expected 2 statements and the file, got %+v", db.history)
+	}
+	for i, want := range []int{0, 1, -1} {
+		if db.history[i].Statement != want {
+			t.Fatalf("expected statement %d, got %+v", want,
+				db.history[i])
+		}
+	}
+}
+
+func TestHistoryBestEffort(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);")
+	db := newFakeStore()
+	db.historyErr = errors.New("metahistory is read only")
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if len(db.migrations) != 1 {
+		t.Fatal("expected the migration to be applied")
+	}
+}
+
+func TestErrMigrationFailed(t *testing.T) {
+	const stmt = "UPDATE a SET id = 1"
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);")
+	writeFile(t, dir, "2.sql", "CREATE TABLE b (id INT);\n"+stmt+";")
+	writeFile(t, dir, "3.sql", "CREATE TABLE c (id INT);")
+	db := newFakeStore()
+	db.failures[stmt] = 1
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+		WithRetry(1, 0))
+	check(t, err)
+	if _, err = m.Migrate(ctx); err == nil {
+		t.Fatal("expected the first run to fail")
+	}
+	if len(db.migrations) != 2 {
+		t.Fatalf("expected 2 migrations, got %+v", db.migrations)
+	}
+	if got := db.migrations[1]; got.Status != StatusFailed ||
+		!strings.Contains(got.Error, "transient") {
+		t.Fatalf("expected 2.sql to be failed, got %+v", got)
+	}
+
+	_, err = New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "")
+	var failed *ErrMigrationFailed
+	if !errors.As(err, &failed) {
+		t.Fatalf("expected migration failed, got %v", err)
+	}
+	if failed.Filename != "2.sql" {
+		t.Fatalf("unexpected filename %s", failed.Filename)
+	}
+
+	// Resuming runs the failed statement from its checkpoint
+	m, err = New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+		WithResume())
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if db.execs["CREATE TABLE b (id INT)"] != 1 {
+		t.Fatal("expected the checkpointed statement not to run again")
+	}
+	for _, mg := range db.migrations {
+		if mg.Status != StatusApplied || mg.Error != "" {
+			t.Fatalf("expected every migration applied, got %+v", mg)
+		}
+	}
+}
+
+func TestLargeMigration(t *testing.T) {
+	dir := t.TempDir()
+	content := "INSERT INTO a VALUES ('" + strings.Repeat("x", 1<<20) + "');"
+	writeFile(t, dir, "1.sql", content)
+	db := newFakeStore()
+	db.maxContent = 1<<24 - 1
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if db.migrations[0].Content != content {
+		t.Fatal("expected the content to be recorded intact")
+	}
+
+	// The recorded checksum still matches the file
+	_, err = New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "")
+	check(t, err)
+}
+
+func TestErrContentTooLarge(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);")
+	writeFile(t, dir, "2.sql", "CREATE TABLE b (id INT, name TEXT);")
+	db := newFakeStore()
+	db.maxContent = 30
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	var tooLarge *ErrContentTooLarge
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("expected content too large, got %v", err)
+	}
+	if tooLarge.Filename != "2.sql" || tooLarge.Max != 30 {
+		t.Fatalf("unexpected error %+v", tooLarge)
+	}
+	if len(db.migrations) != 1 ||
+		db.execs["CREATE TABLE b (id INT, name TEXT)"] != 0 {
+		t.Fatal("expected 2.sql not to run or be recorded")
+	}
+}
+
+func TestLock(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);")
+	writeFile(t, dir, "2.sql", "CREATE TABLE b (id INT);")
+	db := newFakeStore()
+	db.failures["CREATE TABLE b (id INT)"] = DefaultRetryAttempts
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "")
+	check(t, err)
+	var holder MetaLock
+	db.onLock = func() { holder = *db.lock }
+	if _, err = m.Migrate(ctx); err == nil {
+		t.Fatal("expected error")
+	}
+	if holder.Holder == "" || holder.PID != os.Getpid() ||
+		holder.Hostname != hostname() {
+		t.Fatalf("expected the lock to identify this run, got %+v", holder)
+	}
+
+	// The lock is released after a failure as well
+	if db.lock != nil {
+		t.Fatalf("expected the lock to be released, got %+v", db.lock)
+	}
+}
+
+func TestLockContended(t *testing.T) {
+	const stmt = "CREATE TABLE a (id INT)"
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", stmt+";")
+	db := newFakeStore()
+	h := hold{started: make(chan struct{}), release: make(chan struct{})}
+	db.held[stmt] = h
+	first, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "")
+	check(t, err)
+	second, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "")
+	check(t, err)
+
+	errs := make(chan error)
+	go func() {
+		_, err := first.Migrate(ctx)
+		errs <- err
+	}()
+	<-h.started
+
+	// The second run can't take the lock while the first runs, so
+	// nothing runs twice
+	_, err = second.Migrate(ctx)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected locked, got %v", err)
+	}
+	close(h.release)
+	check(t, <-errs)
+	if db.execs[stmt] != 1 {
+		t.Fatalf("expected 1.sql to run once, got %d", db.execs[stmt])
+	}
+
+	// Once the first has finished, the second finds nothing to run
+	delete(db.held, stmt)
+	migrated, err := second.Migrate(ctx)
+	check(t, err)
+	if migrated || db.execs[stmt] != 1 {
+		t.Fatal("expected no migration")
+	}
+}
+
+func TestLockReloadsMigrations(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);")
+	writeFile(t, dir, "2.sql", "CREATE TABLE b (id INT);")
+	db := newFakeStore()
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "")
+	check(t, err)
+
+	// Another run applies 1.sql while this one waits for the lock
+	db.onLock = func() {
+		content, checksum, err := computeChecksum(
+			strings.NewReader("CREATE TABLE a (id INT);"), ChecksumMD5)
+		check(t, err)
+		db.migrations = append(db.migrations, Migration{
+			Filename: "1.sql",
+			Content:  content,
+			Checksum: checksum,
+			Status:   StatusApplied,
+		})
+	}
+	migrated, err := m.Migrate(ctx)
+	check(t, err)
+	if !migrated {
+		t.Fatal("expected migration")
+	}
+	if db.execs["CREATE TABLE a (id INT)"] != 0 ||
+		db.execs["CREATE TABLE b (id INT)"] != 1 {
+		t.Fatalf("expected only 2.sql to run, got %v", db.execs)
+	}
+	if len(m.Results) != 1 || m.Results[0].Filename != "2.sql" {
+		t.Fatalf("expected a result for 2.sql, got %+v", m.Results)
+	}
+}
+
+func TestLockTakeover(t *testing.T) {
+	const stmt = "UPDATE a SET id = 1"
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);\n"+stmt+";")
+	db := newFakeStore()
+	started := make(chan struct{})
+	db.slow[stmt] = started
+
+	// The first run's heartbeats fail, but it carries on since its
+	// threshold is far off
+	crashed, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+		WithLockLease(10*time.Millisecond, time.Hour))
+	check(t, err)
+	db.heartbeatErrs[crashed.runID] = errTransient
+	errs := make(chan error)
+	go func() {
+		_, err := crashed.Migrate(ctx)
+		errs <- err
+	}()
+	<-started
+	delete(db.slow, stmt)
+
+	// To another run with a shorter threshold, the lock is stale, so it
+	// takes it over and resumes after the checkpointed statement
+	time.Sleep(50 * time.Millisecond)
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+		WithLockLease(10*time.Millisecond, 40*time.Millisecond))
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if db.execs["CREATE TABLE a (id INT)"] != 1 || db.execs[stmt] != 1 ||
+		db.migrations[0].Status != StatusApplied {
+		t.Fatalf("expected each statement to run once, got %v", db.execs)
+	}
+
+	// Once its heartbeats reach the database again, the first run finds
+	// it lost the lock and stops rather than run the statement again
+	db.lockMu.Lock()
+	delete(db.heartbeatErrs, crashed.runID)
+	db.lockMu.Unlock()
+	if err = <-errs; !errors.Is(err, ErrLockLost) {
+		t.Fatalf("expected lock lost, got %v", err)
+	}
+	if db.execs[stmt] != 1 || db.migrations[0].Status != StatusApplied {
+		t.Fatal("expected the statement not to run again")
+	}
+}
+
+func TestLockHeartbeatFails(t *testing.T) {
+	const stmt = "CREATE TABLE a (id INT)"
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", stmt+";")
+	db := newFakeStore()
+	db.slow[stmt] = make(chan struct{})
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+		WithLockLease(10*time.Millisecond, 50*time.Millisecond))
+	check(t, err)
+	db.heartbeatErrs[m.runID] = errTransient
+
+	// Another run could take the lock over before the next heartbeat, so
+	// the statement is interrupted
+	_, err = m.Migrate(ctx)
+	if !errors.Is(err, ErrLockLost) {
+		t.Fatalf("expected lock lost, got %v", err)
+	}
+	if db.heartbeats < 2 {
+		t.Fatalf("expected heartbeats to be retried, got %d", db.heartbeats)
+	}
+	if db.migrations[0].Status != StatusInProgress {
+		t.Fatalf("expected 1.sql to be in progress, got %s",
+			db.migrations[0].Status)
+	}
+}
+
+func TestErrLocked(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);")
+	db := newFakeStore()
+	db.lock = &MetaLock{Holder: "other", HeartbeatAt: time.Now().UTC()}
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected locked, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "held by run other") {
+		t.Fatalf("expected the error to name the holder, got %v", err)
+	}
+	if db.execs["CREATE TABLE a (id INT)"] != 0 || len(db.migrations) != 0 {
+		t.Fatal("expected nothing to run")
+	}
+
+	// An operator clears the lock of a run they know has died
+	check(t, ForceUnlock(ctx, db, true))
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if len(db.migrations) != 1 {
+		t.Fatal("expected 1.sql to run")
+	}
+}
+
+func TestLockStatus(t *testing.T) {
+	const stmt = "CREATE TABLE b (id INT)"
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);")
+	writeFile(t, dir, "2.sql", stmt+";")
+	db := newFakeStore()
+	h := hold{started: make(chan struct{}), release: make(chan struct{})}
+	db.held[stmt] = h
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "")
+	check(t, err)
+	info, err := LockStatus(ctx, db)
+	check(t, err)
+	if info != nil {
+		t.Fatalf("expected no lock, got %+v", info)
+	}
+
+	errs := make(chan error)
+	go func() {
+		_, err := m.Migrate(ctx)
+		errs <- err
+	}()
+	<-h.started
+	info, err = LockStatus(ctx, db)
+	check(t, err)
+	if info == nil || info.Holder != m.runID || info.Hostname != hostname() ||
+		info.PID != os.Getpid() || info.Filename != "2.sql" || info.Stale {
+		t.Fatalf("expected the lock to describe this run, got %+v", info)
+	}
+	close(h.release)
+	check(t, <-errs)
+	info, err = LockStatus(ctx, db)
+	check(t, err)
+	if info != nil {
+		t.Fatalf("expected the lock to be released, got %+v", info)
+	}
+}
+
+func TestForceUnlock(t *testing.T) {
+	db := newFakeStore()
+	check(t, ForceUnlock(ctx, db, false))
+
+	// A holder with a recent heartbeat is likely alive
+	now := time.Now().UTC()
+	db.lock = &MetaLock{Holder: "other", PID: 7, AcquiredAt: now,
+		HeartbeatAt: now}
+	err := ForceUnlock(ctx, db, false)
+	var held *ErrLockHeld
+	if !errors.As(err, &held) || held.Lock.Holder != "other" {
+		t.Fatalf("expected lock held, got %v", err)
+	}
+	if db.lock == nil {
+		t.Fatal("expected the lock to be kept")
+	}
+	check(t, ForceUnlock(ctx, db, true))
+	if db.lock != nil {
+		t.Fatal("expected the lock to be deleted")
+	}
+
+	// A stale lock is deleted without force
+	stale := now.Add(-2 * DefaultLockStaleAfter)
+	db.lock = &MetaLock{Holder: "other", AcquiredAt: stale,
+		HeartbeatAt: stale}
+	info, err := LockStatus(ctx, db)
+	check(t, err)
+	if !info.Stale {
+		t.Fatal("expected the lock to be stale")
+	}
+	check(t, ForceUnlock(ctx, db, false))
+	if db.lock != nil {
+		t.Fatal("expected the stale lock to be deleted")
+	}
+}
+
+func TestLockWait(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);")
+	db := newFakeStore()
+	now := time.Now().UTC()
+	db.lock = &MetaLock{Holder: "other", AcquiredAt: now, HeartbeatAt: now}
+
+	// The other run releases the lock without applying anything
+	var attempts int
+	db.beforeAcquire = func() {
+		if attempts++; attempts == 3 {
+			db.lock = nil
+		}
+	}
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+		WithLockWait(time.Minute, time.Millisecond))
+	check(t, err)
+	migrated, err := m.Migrate(ctx)
+	check(t, err)
+	if !migrated || attempts != 3 {
+		t.Fatalf("expected to migrate after 3 attempts, got %d", attempts)
+	}
+}
+
+func TestLockWaitUpToDate(t *testing.T) {
+	const stmt = "CREATE TABLE a (id INT)"
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", stmt+";")
+	db := newFakeStore()
+	now := time.Now().UTC()
+	db.lock = &MetaLock{Holder: "other", AcquiredAt: now, HeartbeatAt: now}
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+		WithLockWait(time.Minute, time.Millisecond))
+	check(t, err)
+
+	// The other run applies 1.sql but still holds the lock
+	var attempts int
+	db.beforeAcquire = func() {
+		if attempts++; attempts == 2 {
+			content, checksum, err := computeChecksum(
+				strings.NewReader(stmt+";"), ChecksumMD5)
+			check(t, err)
+			db.migrations = append(db.migrations, Migration{
+				Filename: "1.sql",
+				Content:  content,
+				Checksum: checksum,
+				Status:   StatusApplied,
+			})
+		}
+	}
+	db.onLock = func() { t.Fatal("expected not to take the lock") }
+	migrated, err := m.Migrate(ctx)
+	check(t, err)
+	if migrated || db.execs[stmt] != 0 {
+		t.Fatal("expected no migration")
+	}
+	if db.lock == nil || db.lock.Holder != "other" {
+		t.Fatalf("expected the other run to keep the lock, got %+v", db.lock)
+	}
+}
+
+func TestLockWaitTimeout(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);")
+	writeFile(t, dir, "2.sql", "CREATE TABLE b (id INT);")
+	db := newFakeStore()
+	now := time.Now().UTC()
+	db.lock = &MetaLock{Holder: "other", AcquiredAt: now, HeartbeatAt: now}
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+		WithLockWait(20*time.Millisecond, time.Millisecond))
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected locked, got %v", err)
+	}
+
+	// Another run which upgrades the meta tables stops the wait
+	db.beforeAcquire = func() { db.version = version + 1 }
+	_, err = m.Migrate(ctx)
+	var tooNew *ErrVersionTooNew
+	if !errors.As(err, &tooNew) {
+		t.Fatalf("expected version too new, got %v", err)
+	}
+}
+
+func TestWithLockLease(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);")
+	db := newFakeStore()
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+		WithLockLease(time.Minute, time.Minute))
+	check(t, err)
+	if _, err = m.Migrate(ctx); err == nil {
+		t.Fatal("expected error for staleness no longer than the heartbeat")
+	}
+}
+
+func TestErrUpgradeRequired(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);")
+	db := newFakeStore()
+	db.version = 2
+	_, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "")
+	var required *ErrUpgradeRequired
+	if !errors.As(err, &required) {
+		t.Fatalf("expected upgrade required, got %v", err)
+	}
+	if required.Have != 2 || required.Want != version {
+		t.Fatalf("unexpected versions %+v", required)
+	}
+	if db.upgrades != 0 {
+		t.Fatal("expected the tables not to be upgraded")
+	}
+}
+
+func TestErrStatementFailed(t *testing.T) {
+	const stmt = "CREATE USER bob IDENTIFIED BY 'secret'"
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", noRetryDirective+"\n"+
+		"CREATE TABLE a (id INT);\n\n"+
+		"UPDATE a\nSET id = 1;\n"+stmt+";")
+	db := newFakeStore()
+	db.failures[stmt] = 1
+	redact := func(sql string) string {
+		return strings.ReplaceAll(sql, "secret", "***")
+	}
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+		WithRedact(redact))
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	var failed *ErrStatementFailed
+	if !errors.As(err, &failed) {
+		t.Fatalf("expected statement failed, got %v", err)
+	}
+	if failed.Filename != "1.sql" || failed.Index != 2 || failed.Line != 6 {
+		t.Fatalf("unexpected error %+v", failed)
+	}
+	if failed.SQL != "CREATE USER bob IDENTIFIED BY '***'" {
+		t.Fatalf("expected redacted sql, got %q", failed.SQL)
+	}
+	if !errors.Is(err, errTransient) {
+		t.Fatal("expected the statement's error to be wrapped")
+	}
+	want := "partially applied: 1.sql: statement 3 (line 6): transient"
+	if !strings.HasSuffix(err.Error(), want) {
+		t.Fatalf("expected %q, got %q", want, err)
+	}
+}
+
+func TestErrStatementFailedTruncates(t *testing.T) {
+	stmt := "SELECT '" + strings.Repeat("é", maxErrSQL) + "'"
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", stmt+";")
+	db := newFakeStore()
+	db.failures[stmt] = 1
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+		WithRetry(1, 0))
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	var failed *ErrStatementFailed
+	if !errors.As(err, &failed) {
+		t.Fatalf("expected statement failed, got %v", err)
+	}
+	if len(failed.SQL) > maxErrSQL+len("...") ||
+		!strings.HasSuffix(failed.SQL, "...") ||
+		!utf8.ValidString(failed.SQL) {
+		t.Fatalf("unexpected sql %q", failed.SQL)
+	}
+}
+
+func TestSplitStatementsLines(t *testing.T) {
+	stmts, err := splitStatements([]byte("CREATE TABLE a (id INT);\n" +
+		"CREATE FUNCTION f() RETURNS trigger AS $$\nBEGIN\n" +
+		"  RETURN NULL;\nEND;\n$$ LANGUAGE plpgsql;\n\n\n" +
+		"  DROP TABLE a;"))
+	check(t, err)
+	var lines []int
+	for _, s := range stmts {
+		lines = append(lines, s.Line)
+	}
+	if want := []int{1, 2, 9}; !reflect.DeepEqual(lines, want) {
+		t.Fatalf("expected lines %v, got %v", want, lines)
+	}
+
+	// Timeout directives apply to the statement which follows
+	stmts, err = splitStatements([]byte("SELECT 1;\n" +
+		"-- migrate:timeout off\nALTER TABLE a ADD b INT;"))
+	check(t, err)
+	if len(stmts) != 2 || stmts[0].timeout != nil ||
+		stmts[1].timeout == nil || *stmts[1].timeout != 0 {
+		t.Fatalf("unexpected statements %+v", stmts)
+	}
+	if stmts[1].SQL != "ALTER TABLE a ADD b INT" || stmts[1].Line != 3 {
+		t.Fatalf("unexpected statement %+v", stmts[1])
+	}
+
+	// Semicolons in quotes and comments don't end statements
+	stmts, err = splitStatements([]byte("INSERT INTO a VALUES ('x;y');\n" +
+		"SELECT 'a'';b', `c;d` /* e;f */;"))
+	check(t, err)
+	var sqls []string
+	for _, s := range stmts {
+		sqls = append(sqls, s.SQL)
+	}
+	want := []string{"INSERT INTO a VALUES ('x;y')",
+		"SELECT 'a'';b', `c;d` /* e;f */"}
+	if !reflect.DeepEqual(sqls, want) {
+		t.Fatalf("expected %q, got %q", want, sqls)
+	}
+}
+
+func TestWaitForStore(t *testing.T) {
+	refused := fmt.Errorf("%w: connection refused", ErrConnectionFailed)
+	denied := errors.New("ping: Error 1045: Access denied")
+	tests := []struct {
+		name      string
+		errs      []error
+		timeout   time.Duration
+		wantErr   error
+		wantOpens int
+	}{
+		{
+			name:      "eventual success",
+			errs:      []error{refused},
+			timeout:   time.Minute,
+			wantOpens: 2,
+		},
+		{
+			name:      "access denied fails fast",
+			errs:      []error{denied},
+			timeout:   time.Minute,
+			wantErr:   denied,
+			wantOpens: 1,
+		},
+		{
+			name:      "timeout",
+			errs:      []error{refused, refused, refused},
+			timeout:   100 * time.Millisecond,
+			wantErr:   ErrConnectionFailed,
+			wantOpens: 1,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db := newFakeStore()
+			db.openErrs = tc.errs
+			err := WaitForStore(ctx, db, testLogger{t}, tc.timeout)
+			if tc.wantErr == nil {
+				check(t, err)
+			} else if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("expected %v, got %v", tc.wantErr, err)
+			}
+			if db.opens != tc.wantOpens {
+				t.Fatalf("expected %d opens, got %d", tc.wantOpens,
+					db.opens)
+			}
+		})
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	const stmt = "UPDATE a SET id = 1"
+	notSent := fmt.Errorf("%w: bad connection", ErrConnectionFailed)
+	lost := fmt.Errorf("%w: invalid connection", ErrConnectionLost)
+	tests := []struct {
+		name       string
+		drop       error
+		reconnects int
+		wantErr    error
+		wantOpens  int
+		wantExecs  int
+	}{
+		{
+			name:       "statement not sent",
+			drop:       notSent,
+			reconnects: 1,
+			wantOpens:  1,
+			wantExecs:  1,
+		},
+		{
+			name:       "lost during statement",
+			drop:       lost,
+			reconnects: 1,
+			wantErr:    &ErrOutcomeUnknown{},
+		},
+		{
+			name:    "reconnects exhausted",
+			drop:    notSent,
+			wantErr: &ErrStatementFailed{},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFile(t, dir, "1.sql",
+				"CREATE TABLE a (id INT);\n"+stmt+";")
+			db := newFakeStore()
+			db.drops[stmt] = tc.drop
+			m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+				WithReconnect(tc.reconnects))
+			check(t, err)
+			_, err = m.Migrate(ctx)
+			switch want := tc.wantErr.(type) {
+			case nil:
+				check(t, err)
+			case *ErrOutcomeUnknown:
+				if !errors.As(err, &want) || want.Statement != 1 {
+					t.Fatalf("expected outcome unknown, got %v", err)
+				}
+			case *ErrStatementFailed:
+				if !errors.As(err, &want) ||
+					!errors.Is(err, ErrConnectionFailed) {
+					t.Fatalf("expected statement failed, got %v", err)
+				}
+			}
+			if db.opens != tc.wantOpens {
+				t.Fatalf("expected %d opens, got %d", tc.wantOpens,
+					db.opens)
+			}
+			if db.execs[stmt] != tc.wantExecs {
+				t.Fatalf("expected %d execs, got %d", tc.wantExecs,
+					db.execs[stmt])
+			}
+		})
+	}
+}
+
+func TestReconnectCheckpoint(t *testing.T) {
+	const stmt = "CREATE TABLE a (id INT)"
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", stmt+";\nCREATE TABLE b (id INT);")
+	db := newFakeStore()
+	db.dropCheckpoint = fmt.Errorf("%w: invalid connection",
+		ErrConnectionLost)
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+
+	// The checkpoint was written before the connection dropped, so the
+	// statement isn't run again
+	if db.opens != 1 || db.execs[stmt] != 1 {
+		t.Fatalf("expected 1 open and exec, got %d and %d", db.opens,
+			db.execs[stmt])
+	}
+	if len(db.migrations) != 1 {
+		t.Fatal("expected the file to be recorded")
+	}
+}
+
+func TestStop(t *testing.T) {
+	const stmt = "UPDATE a SET id = 1"
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);\n"+stmt+";\n"+
+		"CREATE TABLE b (id INT);")
+	writeFile(t, dir, "2.sql", "CREATE TABLE c (id INT);")
+	db := newFakeStore()
+	h := hold{started: make(chan struct{}), release: make(chan struct{})}
+	db.held[stmt] = h
+
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "")
+	check(t, err)
+	errs := make(chan error)
+	go func() {
+		_, err := m.Migrate(ctx)
+		errs <- err
+	}()
+	<-h.started
+	m.Stop()
+	m.Stop()
+	close(h.release)
+	if err = <-errs; !errors.Is(err, ErrStopped) {
+		t.Fatalf("expected ErrStopped, got %v", err)
+	}
+
+	// The statement in progress finishes and is checkpointed, but
+	// nothing after it runs
+	if n := len(db.checkpoints["1.sql"]); n != 2 {
+		t.Fatalf("expected 2 checkpoints, got %d", n)
+	}
+	if db.execs["CREATE TABLE b (id INT)"] != 0 ||
+		db.migrations[0].Status != StatusInProgress {
+		t.Fatal("expected no more statements to run")
+	}
+
+	// Running again resumes after the checkpoints
+	delete(db.held, stmt)
+	m, err = New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if db.execs[stmt] != 1 || len(db.migrations) != 2 {
+		t.Fatal("expected to resume after the checkpoints")
+	}
+}
+
+func TestStatementTimeout(t *testing.T) {
+	const stmt = "UPDATE a SET id = 1"
+	tests := []struct {
+		name    string
+		content string
+		opts    []Option
+	}{
+		{
+			name:    "option",
+			content: "CREATE TABLE a (id INT);\n" + stmt + ";",
+			opts:    []Option{WithStatementTimeout(20 * time.Millisecond)},
+		},
+		{
+			name: "statement directive",
+			content: "CREATE TABLE a (id INT);\n" +
+				"-- migrate:timeout 20ms\n" + stmt + ";",
+			opts: []Option{WithStatementTimeout(time.Hour)},
+		},
+		{
+			name: "file directive",
+			content: "-- migrate:timeout 20ms\n" +
+				"CREATE TABLE a (id INT);\n" + stmt + ";",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFile(t, dir, "1.sql", tc.content)
+			db := newFakeStore()
+			db.slow[stmt] = make(chan struct{})
+			m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+				tc.opts...)
+			check(t, err)
+			_, err = m.Migrate(ctx)
+			var failed *ErrStatementFailed
+			if !errors.As(err, &failed) || failed.Index != 1 ||
+				!errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("expected statement 1 to time out, got %v", err)
+			}
+			if db.kills != 1 {
+				t.Fatalf("expected 1 kill, got %d", db.kills)
+			}
+
+			// The statement before it is checkpointed to resume from
+			if n := len(db.checkpoints["1.sql"]); n != 1 {
+				t.Fatalf("expected 1 checkpoint, got %d", n)
+			}
+		})
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	const stmt = "INSERT INTO a VALUES ('abc')"
+	truncated := Warning{Level: "Warning", Code: 1265,
+		Message: "Data truncated for column 'id' at row 1"}
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict %t", strict), func(t *testing.T) {
+			dir := t.TempDir()
+			writeFile(t, dir, "1.sql", "CREATE TABLE a (id CHAR(1));\n"+
+				stmt+";\nCREATE TABLE b (id INT);")
+			db := newFakeStore()
+			db.warnings[stmt] = []Warning{truncated}
+			var opts []Option
+			if strict {
+				opts = append(opts, WithStrictWarnings())
+			}
+			m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "",
+				opts...)
+			check(t, err)
+			_, err = m.Migrate(ctx)
+			if len(m.Results) != 1 {
+				t.Fatalf("expected 1 result, got %d", len(m.Results))
+			}
+			want := truncated
+			want.Statement, want.Line = 1, 2
+			ws := m.Results[0].Warnings
+			if len(ws) != 1 || ws[0] != want {
+				t.Fatalf("unexpected warnings %+v", ws)
+			}
+			if !strict {
+				check(t, err)
+				return
+			}
+
+			// The statement ran, so it's checkpointed, but the file
+			// isn't recorded
+			var werr *ErrWarnings
+			if !errors.As(err, &werr) || werr.Statement != 1 {
+				t.Fatalf("expected warnings error, got %v", err)
+			}
+			if n := len(db.checkpoints["1.sql"]); n != 2 {
+				t.Fatalf("expected 2 checkpoints, got %d", n)
+			}
+			if db.migrations[0].Status != StatusFailed ||
+				db.execs["CREATE TABLE b (id INT)"] != 0 {
+				t.Fatal("expected migrate to stop")
+			}
+		})
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	tests := []struct {
+		directive string
+		want      time.Duration
+		wantErr   bool
+	}{
+		{"-- migrate:timeout 30m", 30 * time.Minute, false},
+		{"-- migrate:timeout  1h30m ", 90 * time.Minute, false},
+		{"-- migrate:timeout off", 0, false},
+		{"-- migrate:timeout", 0, true},
+		{"-- migrate:timeout soon", 0, true},
+		{"-- migrate:timeout -1s", 0, true},
+		{"-- migrate:timeouts 1s", 0, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.directive, func(t *testing.T) {
+			got, err := parseTimeout(tc.directive)
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("expected error %t, got %v", tc.wantErr, err)
+			}
+			if got != tc.want {
+				t.Fatalf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestParseDirectives(t *testing.T) {
+	d, body, err := parseDirectives([]byte(
+		"\n-- migrate:no-retry\n-- migrate:multi\nSELECT 1;"))
+	check(t, err)
+	if !d.multi || !d.noRetry {
+		t.Fatalf("expected both directives, got %+v", d)
+	}
+	if string(body) != "SELECT 1;" {
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	// Files without directives are left as they are
+	content := "-- a comment\nSELECT 1;"
+	_, body, err = parseDirectives([]byte(content))
+	check(t, err)
+	if string(body) != content {
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	d, _, err = parseDirectives([]byte(
+		"-- migrate:timeout 2h\nALTER TABLE a ADD b INT;"))
+	check(t, err)
+	if d.timeout == nil || *d.timeout != 2*time.Hour {
+		t.Fatalf("expected a 2h timeout, got %v", d.timeout)
+	}
+
+	d, body, err = parseDirectives([]byte(
+		"-- migrate:no-split\nSELECT 1; SELECT 2;"))
+	check(t, err)
+	if !d.noSplit || d.multi || string(body) != "SELECT 1; SELECT 2;" {
+		t.Fatalf("expected no-split, got %+v and %q", d, body)
+	}
+
+	_, _, err = parseDirectives([]byte(
+		"-- migrate:no-split\n-- migrate:multi\nSELECT 1;"))
+	if err == nil {
+		t.Fatal("expected no-split and multi to be refused together")
+	}
+
+	_, _, err = parseDirectives([]byte("-- migrate:unknown\nSELECT 1;"))
+	if err == nil {
+		t.Fatal("expected unknown directive error")
+	}
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+	check(t, err)
+}
+
+// mapFile returns a file of an fstest.MapFS holding content.
+func mapFile(content string) *fstest.MapFile {
+	return &fstest.MapFile{Data: []byte(content)}
+}
+
+func TestMigrateAll(t *testing.T) {
+	const stmt = "CREATE TABLE b (id INT)"
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);")
+	writeFile(t, dir, "2.sql", stmt+";")
+	stores := []*fakeStore{newFakeStore(), newFakeStore(), newFakeStore()}
+	stores[1].failures[stmt] = DefaultRetryAttempts
+	dbs := make([]Store, len(stores))
+	for i, s := range stores {
+		dbs[i] = s
+	}
+
+	report, err := MigrateAll(ctx, dbs, testLogger{t}, DBTypeMySQL, dir,
+		WithConcurrency(2), WithContinueOnError(), WithRetry(1, 0))
+	if err == nil || !strings.Contains(err.Error(), "store 1: ") {
+		t.Fatalf("expected store 1 to fail, got %v", err)
+	}
+	if failed := report.Failed(); len(failed) != 1 || failed[0].Index != 1 {
+		t.Fatalf("expected only store 1 to fail, got %+v", failed)
+	}
+	for _, i := range []int{0, 2} {
+		if n := len(stores[i].migrations); n != 2 {
+			t.Fatalf("expected store %d to be migrated, got %d migrations",
+				i, n)
+		}
+	}
+	if res := report.Stores[1].Files; len(res) != 2 || !res[0].Applied ||
+		res[1].Applied {
+		t.Fatalf("expected only 1.sql to be applied on store 1, got %+v",
+			res)
+	}
+
+	var table strings.Builder
+	check(t, report.WriteTable(&table))
+	rows := strings.Split(strings.TrimSpace(table.String()), "\n")
+	if len(rows) != 4 || !strings.Contains(rows[1], "1.sql,2.sql") ||
+		!strings.Contains(rows[2], "failed") {
+		t.Fatalf("unexpected table:\n%s", table.String())
+	}
+	byt, err := json.Marshal(report)
+	check(t, err)
+	var decoded struct {
+		Stores []struct {
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		} `json:"stores"`
+	}
+	check(t, json.Unmarshal(byt, &decoded))
+	if len(decoded.Stores) != 3 || decoded.Stores[1].Status != "failed" ||
+		decoded.Stores[1].Error == "" || decoded.Stores[0].Status != "ok" {
+		t.Fatalf("unexpected json: %s", byt)
+	}
+
+	// The failed store resumes on its own meta tables, leaving the others
+	// as they were
+	delete(stores[1].failures, stmt)
+	report, err = MigrateAll(ctx, dbs, testLogger{t}, DBTypeMySQL, dir,
+		WithResume())
+	check(t, err)
+	if res := report.Stores[1].Files; len(res) != 1 ||
+		res[0].Filename != "2.sql" || !res[0].Applied {
+		t.Fatalf("expected store 1 to resume from 2.sql, got %+v", res)
+	}
+	if res := report.Stores[0].Files; len(res) != 0 {
+		t.Fatalf("expected store 0 to be up to date, got %+v", res)
+	}
+}
+
+func TestMigrateAllStopsOnError(t *testing.T) {
+	const stmt = "CREATE TABLE a (id INT)"
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", stmt+";")
+	stores := []*fakeStore{newFakeStore(), newFakeStore(), newFakeStore()}
+	stores[0].failures[stmt] = DefaultRetryAttempts
+	dbs := []Store{stores[0], stores[1], stores[2]}
+
+	report, err := MigrateAll(ctx, dbs, testLogger{t}, DBTypeMySQL, dir,
+		WithConcurrency(1), WithRetry(1, 0))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for i := 1; i < len(stores); i++ {
+		if !report.Stores[i].Skipped || len(stores[i].migrations) != 0 {
+			t.Fatalf("expected store %d to be skipped, got %+v", i,
+				report.Stores[i])
+		}
+	}
+
+	if _, err = MigrateAll(ctx, dbs, testLogger{t}, DBTypeMySQL, dir,
+		WithConcurrency(0)); err == nil {
+		t.Fatal("expected error for concurrency 0")
+	}
+}
+
+// readOnlyStore fails the test if anything writes to its fakeStore.
+type readOnlyStore struct {
+	*fakeStore
+	t *testing.T
+}
+
+func (s readOnlyStore) write(method string) error {
+	s.t.Helper()
+	s.t.Errorf("unexpected %s on a read-only store", method)
+	return errors.New("read-only")
+}
+
+func (s readOnlyStore) Exec(
+	context.Context,
+	string,
+	...interface{},
+) (sql.Result, error) {
+	return nil, s.write("Exec")
+}
+
+func (s readOnlyStore) CreateMetaIfNotExists(context.Context) error {
+	return s.write("CreateMetaIfNotExists")
+}
+
+func (s readOnlyStore) CreateMetaCheckpointsIfNotExists(context.Context) error {
+	return s.write("CreateMetaCheckpointsIfNotExists")
+}
+
+func (s readOnlyStore) CreateMetaVersionIfNotExists(
+	context.Context,
+	int,
+) (int, error) {
+	return 0, s.write("CreateMetaVersionIfNotExists")
+}
+
+func (s readOnlyStore) CreateMetaLockIfNotExists(context.Context) error {
+	return s.write("CreateMetaLockIfNotExists")
+}
+
+func (s readOnlyStore) CreateMetaHistoryIfNotExists(context.Context) error {
+	return s.write("CreateMetaHistoryIfNotExists")
+}
+
+func (s readOnlyStore) AcquireMetaLock(
+	context.Context,
+	MetaLock,
+	time.Time,
+) (bool, error) {
+	return false, s.write("AcquireMetaLock")
+}
+
+func (s readOnlyStore) InsertMigration(context.Context, Migration) error {
+	return s.write("InsertMigration")
+}
+
+func (s readOnlyStore) UpsertMigration(context.Context, Migration) error {
+	return s.write("UpsertMigration")
+}
+
+// lockFreeStore fails the test if anything uses the lock in its fakeStore.
+type lockFreeStore struct {
+	*fakeStore
+	t *testing.T
+}
+
+func (s lockFreeStore) lock(method string) error {
+	s.t.Helper()
+	s.t.Errorf("unexpected %s without locking", method)
+	return errors.New("locking disabled")
+}
+
+func (s lockFreeStore) CreateMetaLockIfNotExists(context.Context) error {
+	return s.lock("CreateMetaLockIfNotExists")
+}
+
+func (s lockFreeStore) AcquireMetaLock(
+	context.Context,
+	MetaLock,
+	time.Time,
+) (bool, error) {
+	return false, s.lock("AcquireMetaLock")
+}
+
+func (s lockFreeStore) HeartbeatMetaLock(
+	context.Context,
+	string,
+	time.Time,
+) (bool, error) {
+	return false, s.lock("HeartbeatMetaLock")
+}
+
+func (s lockFreeStore) ReleaseMetaLock(context.Context, string) error {
+	return s.lock("ReleaseMetaLock")
+}
+
+func (s lockFreeStore) DeleteMetaLock(context.Context) error {
+	return s.lock("DeleteMetaLock")
+}
+
+func (s lockFreeStore) GetMetaLock(context.Context) (*MetaLock, error) {
+	return nil, s.lock("GetMetaLock")
+}
+
+func (s lockFreeStore) SetMetaLockFilename(context.Context, string, string) error {
+	return s.lock("SetMetaLockFilename")
+}
+
+func TestWithoutLocking(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);")
+	writeFile(t, dir, "2.sql", "CREATE TABLE b (id INT);")
+	db := newFakeStore()
+	store := lockFreeStore{db, t}
+
+	var logs strings.Builder
+	log := recordLogger{testLogger{t}, &logs}
+	m, err := New(ctx, store, log, DBTypeMySQL, dir, "", WithoutLocking(),
+		WithLockLease(0, 0))
+	check(t, err)
+
+	// Another run applies 1.sql after New read the meta tables, which
+	// Migrate notices before applying anything
+	other, err := New(ctx, store, testLogger{t}, DBTypeMySQL, dir, "",
+		WithoutLocking())
+	check(t, err)
+	other.Files = other.Files[:1]
+	_, err = other.Migrate(ctx)
+	check(t, err)
+
+	migrated, err := m.Migrate(ctx)
+	check(t, err)
+	if !migrated || len(m.Results) != 1 || len(db.execs) != 2 {
+		t.Fatalf("expected only 2.sql to run, got %v", db.execs)
+	}
+	for q, n := range db.execs {
+		if n != 1 {
+			t.Fatalf("expected %q to run once, ran %d times", q, n)
+		}
+	}
+	if !strings.Contains(logs.String(), "locking is disabled") {
+		t.Fatalf("expected a warning that locking is disabled, got %q",
+			logs.String())
+	}
+
+	report, err := Status(ctx, readOnlyStore{db, t}, DBTypeMySQL, dir,
+		WithoutLocking())
+	check(t, err)
+	if !report.LockingDisabled || !report.UpToDate() ||
+		report.String() != "2 files applied, 0 pending, locking disabled" {
+		t.Fatalf("expected locking disabled noted, got %q", report)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id INT);")
+	writeFile(t, dir, "2.sql", "CREATE TABLE b (id INT);")
+	db := newFakeStore()
+
+	report, err := Status(ctx, readOnlyStore{db, t}, DBTypeMySQL, dir)
+	check(t, err)
+	if report.Initialized || len(report.Pending) != 2 {
+		t.Fatalf("expected 2 files pending, got %+v", report)
+	}
+	if got := report.String(); got != "uninitialized, 2 files pending" {
+		t.Fatalf("unexpected status %q", got)
+	}
+
+	// Apply 1.sql, then add 3.sql and edit 1.sql
+	check(t, os.Rename(filepath.Join(dir, "2.sql"),
+		filepath.Join(dir, "2.sql.bak")))
+	m, err := New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	check(t, os.Rename(filepath.Join(dir, "2.sql.bak"),
+		filepath.Join(dir, "2.sql")))
+	report, err = Status(ctx, readOnlyStore{db, t}, DBTypeMySQL, dir)
+	check(t, err)
+	want := &StatusReport{
+		Initialized: true,
+		Version:     version,
+		Applied:     []string{"1.sql"},
+		Pending:     []string{"2.sql"},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("expected %+v, got %+v", want, report)
+	}
+	if report.UpToDate() {
+		t.Fatal("expected pending files not to be up to date")
+	}
+
+	writeFile(t, dir, "1.sql", "CREATE TABLE a (id BIGINT);")
+	check(t, os.Remove(filepath.Join(dir, "2.sql")))
+	db.migrations = append(db.migrations, Migration{Filename: "2.sql",
+		Status: StatusFailed})
+	report, err = Status(ctx, readOnlyStore{db, t}, DBTypeMySQL, dir)
+	check(t, err)
+	if len(report.Mismatched) != 1 || report.Mismatched[0] != "1.sql" ||
+		report.Unfinished != "2.sql" {
+		t.Fatalf("expected 1.sql mismatched and 2.sql unfinished, got %+v",
+			report)
+	}
+
+	db.migrations[1].Status = StatusApplied
+	report, err = Status(ctx, readOnlyStore{db, t}, DBTypeMySQL, dir)
+	check(t, err)
+	if len(report.Missing) != 1 || report.Missing[0] != "2.sql" {
+		t.Fatalf("expected 2.sql missing, got %+v", report)
+	}
+}
+
+func TestNewFS(t *testing.T) {
+	embedded, err := fs.Sub(testMigrations, "testdata/migrations")
+	check(t, err)
+	mapFS := fstest.MapFS{}
+	check(t, fs.WalkDir(embedded, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		byt, err := fs.ReadFile(embedded, p)
+		mapFS[p] = &fstest.MapFile{Data: byt}
+		mapFS["db/"+p] = &fstest.MapFile{Data: byt}
+		return err
+	}))
+	nested, err := fs.Sub(mapFS, "db")
+	check(t, err)
+
+	// Migrate from each FS, failing 2.sql part way through, then resume
+	type result struct {
+		execs       map[string]int
+		checkpoints []string
+		migrations  []Migration
+	}
+	run := func(t *testing.T, newM func(*fakeStore, ...Option) (*Migrate, error)) result {
+		db := newFakeStore()
+		db.failures["UPDATE b SET id = 1"] = 1
+		m, err := newM(db, WithRetry(1, 0))
+		check(t, err)
+		if _, err = m.Migrate(ctx); err == nil {
+			t.Fatal("expected 2.sql to fail")
+		}
+		res := result{checkpoints: db.checkpoints["2.sql"]}
+		m, err = newM(db, WithResume())
+		check(t, err)
+		_, err = m.Migrate(ctx)
+		check(t, err)
+		res.execs = db.execs
+		for _, mg := range db.migrations {
+			res.migrations = append(res.migrations, Migration{
+				Filename:    mg.Filename,
+				Checksum:    mg.Checksum,
+				Content:     mg.Content,
+				DownContent: mg.DownContent,
+				Status:      mg.Status,
+			})
+		}
+		return res
+	}
+	want := run(t, func(db *fakeStore, opts ...Option) (*Migrate, error) {
+		return New(ctx, db, testLogger{t}, DBTypeMySQL,
+			filepath.Join("testdata", "migrations"), "", opts...)
+	})
+	var names []string
+	for _, mg := range want.migrations {
+		names = append(names, mg.Filename)
+	}
+	if !reflect.DeepEqual(names, []string{"1.sql", "2.sql", "10.sql"}) ||
+		want.migrations[1].DownContent == "" ||
+		want.execs["CREATE TABLE e (id INT)"] != 1 ||
+		want.execs["CREATE TABLE b (id INT)"] != 1 ||
+		len(want.checkpoints) != 1 {
+		t.Fatalf("unexpected migration from the directory: %+v", want)
+	}
+
+	for name, fsys := range map[string]fs.FS{
+		"embed":  embedded,
+		"map":    mapFS,
+		"nested": nested,
+	} {
+		t.Run(name, func(t *testing.T) {
+			got := run(t, func(db *fakeStore, opts ...Option) (*Migrate, error) {
+				return NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys,
+					"", opts...)
+			})
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("expected %+v, got %+v", want, got)
+			}
+			report, err := StatusFS(ctx, readOnlyStore{newFakeStore(), t},
+				DBTypeMySQL, fsys)
+			check(t, err)
+			if len(report.Pending) != 3 {
+				t.Fatalf("expected 3 files pending, got %+v", report)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	schema := fstest.MapFS{
+		"1_users.sql":         {Data: []byte("CREATE TABLE users (id INT)")},
+		"10_orders.sql":       {Data: []byte("CREATE TABLE orders (id INT)")},
+		"mysql/10_orders.sql": {Data: []byte("CREATE TABLE orders (id BIGINT)")},
+		"README.md":           {Data: []byte("schema")},
+	}
+	data := fstest.MapFS{
+		"2_seed_users.sql":   {Data: []byte("INSERT INTO users VALUES (1)")},
+		"11_seed_orders.sql": {Data: []byte("INSERT INTO orders VALUES (1)")},
+		"README.md":          {Data: []byte("data")},
+	}
+	empty := fstest.MapFS{}
+	fsys := Merge(Source{"schema", schema}, Source{"data", data},
+		Source{"empty", empty})
+
+	// Files interleave by number, and are recorded by their bare names
+	db := newFakeStore()
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	var names []string
+	for _, mg := range db.migrations {
+		names = append(names, mg.Filename)
+	}
+	want := []string{"1_users.sql", "2_seed_users.sql", "10_orders.sql",
+		"11_seed_orders.sql"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("expected %v, got %v", want, names)
+	}
+	if db.execs["CREATE TABLE orders (id BIGINT)"] != 1 {
+		t.Fatalf("expected the mysql override, got %v", db.execs)
+	}
+
+	// The same files laid out differently are already migrated
+	moved := fstest.MapFS{}
+	for name, f := range schema {
+		moved[name] = f
+	}
+	for name, f := range data {
+		moved[name] = f
+	}
+	report, err := StatusFS(ctx, db, DBTypeMySQL, moved)
+	check(t, err)
+	if len(report.Pending) != 0 || len(report.Applied) != 4 {
+		t.Fatalf("expected everything applied, got %+v", report)
+	}
+
+	// A migration in two sources
+	data["10_orders.sql"] = &fstest.MapFile{Data: []byte("SELECT 1")}
+	_, err = NewFS(ctx, newFakeStore(), testLogger{t}, DBTypeMySQL, fsys, "")
+	if err == nil || !strings.Contains(err.Error(),
+		"10_orders.sql is in both schema/10_orders.sql and data/10_orders.sql") {
+		t.Fatalf("expected a duplicate error, got %v", err)
+	}
+	delete(data, "10_orders.sql")
+	data["mysql/10_orders.sql"] = &fstest.MapFile{Data: []byte("SELECT 1")}
+	_, err = NewFS(ctx, newFakeStore(), testLogger{t}, DBTypeMySQL, fsys, "")
+	if err == nil || !strings.Contains(err.Error(),
+		"schema/mysql/10_orders.sql and data/mysql/10_orders.sql") {
+		t.Fatalf("expected a duplicate error, got %v", err)
+	}
+
+	// Directories on disk, one of them empty
+	dir := t.TempDir()
+	for _, d := range []string{"schema", "data", "empty"} {
+		check(t, os.Mkdir(filepath.Join(dir, d), 0o755))
+	}
+	writeFile(t, filepath.Join(dir, "schema"), "1_users.sql",
+		"CREATE TABLE users (id INT)")
+	writeFile(t, filepath.Join(dir, "data"), "2_seed_users.sql",
+		"INSERT INTO users VALUES (1)")
+	fsys, err = MergeDirs(filepath.Join(dir, "schema"),
+		filepath.Join(dir, "data"), filepath.Join(dir, "empty"))
+	check(t, err)
+	report, err = StatusFS(ctx, newFakeStore(), DBTypeMySQL, fsys)
+	check(t, err)
+	if len(report.Pending) != 2 {
+		t.Fatalf("expected 2 files pending, got %+v", report)
+	}
+	_, err = MergeDirs(filepath.Join(dir, "missing"))
+	if err == nil {
+		t.Fatal("expected an error for a missing directory")
+	}
+}
+
+func TestMemorySource(t *testing.T) {
+	files := map[string]string{
+		"1_users.sql":      "CREATE TABLE users (id INT)",
+		"2_seed.sql":       "INSERT INTO users VALUES (1)",
+		"2_seed.down.sql":  "DELETE FROM users",
+		"mysql/2_seed.sql": "INSERT IGNORE INTO users VALUES (1)",
+		"10_orders.sql":    "CREATE TABLE orders (id INT)",
+	}
+	dir := t.TempDir()
+	check(t, os.Mkdir(filepath.Join(dir, "mysql"), 0o755))
+	for name, content := range files {
+		writeFile(t, dir, name, content)
+	}
+	migrations := func(newM func(db *fakeStore) (*Migrate, error)) []Migration {
+		db := newFakeStore()
+		m, err := newM(db)
+		check(t, err)
+		_, err = m.Migrate(ctx)
+		check(t, err)
+		var ms []Migration
+		for _, mg := range db.migrations {
+			ms = append(ms, Migration{
+				Filename:    mg.Filename,
+				Checksum:    mg.Checksum,
+				Content:     mg.Content,
+				DownContent: mg.DownContent,
+			})
+		}
+		return ms
+	}
+	want := migrations(func(db *fakeStore) (*Migrate, error) {
+		return New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "")
+	})
+	got := migrations(func(db *fakeStore) (*Migrate, error) {
+		return NewFS(ctx, db, testLogger{t}, DBTypeMySQL,
+			MemorySource(files), "")
+	})
+	if len(want) != 3 || !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+
+	// Names the loader would skip or reject
+	for _, name := range []string{"users.sql", "1_users.txt", ".1.sql",
+		"mysql/users.sql", "../1.sql"} {
+		_, err := NewFS(ctx, newFakeStore(), testLogger{t}, DBTypeMySQL,
+			MemorySource(map[string]string{name: "SELECT 1"}), "")
+		if err == nil || !strings.Contains(err.Error(),
+			"not a migration filename") {
+			t.Fatalf("expected %s rejected, got %v", name, err)
+		}
+	}
+	_, err := NewFS(ctx, newFakeStore(), testLogger{t}, DBTypeMySQL,
+		MemorySource(map[string]string{
+			"1_a.sql":  "SELECT 1",
+			"01_b.sql": "SELECT 2",
+		}), "")
+	if err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Fatalf("expected a duplicate number rejected, got %v", err)
+	}
+
+	// The builder numbers migrations in the order they're added
+	b := new(MemoryBuilder)
+	for i := 0; i < 11; i++ {
+		b.Add("", fmt.Sprintf("CREATE TABLE t%d (id INT)", i))
+	}
+	b.Add("last", "SELECT 1")
+	db := newFakeStore()
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, b.Source(), "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if len(db.migrations) != 12 || db.migrations[1].Filename != "2.sql" ||
+		db.migrations[10].Filename != "11.sql" ||
+		db.migrations[11].Filename != "12_last.sql" ||
+		db.migrations[10].Content != "CREATE TABLE t10 (id INT)" {
+		t.Fatalf("unexpected migrations %+v", db.migrations)
+	}
+}
+
+func TestGoMigration(t *testing.T) {
+	defer func(old map[string]*goMigration) { goMigrations = old }(goMigrations)
+	goMigrations = map[string]*goMigration{}
+	noop := func(context.Context, *sql.Tx) error { return nil }
+
+	for _, name := range []string{"backfill", "2_backfill.sql", "mysql/2_x",
+		"../2_x", ""} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected %q to panic", name)
+				}
+			}()
+			RegisterGoMigration(name, "v1", noop)
+		}()
+	}
+	RegisterGoMigration("2_backfill", "v1", noop)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected registering twice to panic")
+			}
+		}()
+		RegisterGoMigration("2_backfill", "v2", noop)
+	}()
+
+	// Registered migrations are read with the files, in order
+	fsys := MemorySource(map[string]string{
+		"1.sql":  "CREATE TABLE a (id INT)",
+		"10.sql": "CREATE TABLE b (id INT)",
+	})
+	report, err := StatusFS(ctx, readOnlyStore{newFakeStore(), t},
+		DBTypeMySQL, fsys, WithGoMigration("3_other", "v1", noop))
+	check(t, err)
+	want := []string{"1.sql", "2_backfill", "3_other", "10.sql"}
+	if !reflect.DeepEqual(report.Pending, want) {
+		t.Fatalf("expected %v pending, got %v", want, report.Pending)
+	}
+	for _, opts := range [][]Option{
+		{WithGoMigration("2_backfill", "v1", noop)},
+		{WithGoMigration("10_x", "v1", noop)},
+		{WithGoMigration("x", "v1", noop)},
+		{WithGoMigration("3_x", "v1", noop), WithGoMigration("3_x", "v1",
+			noop)},
+	} {
+		_, err = NewFS(ctx, newFakeStore(), testLogger{t}, DBTypeMySQL,
+			fsys, "", opts...)
+		if err == nil {
+			t.Fatal("expected an invalid go migration to fail")
+		}
+	}
+
+	// The store must begin transactions
+	db := newFakeStore()
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	if err == nil || !strings.Contains(err.Error(), "can't run go migrations") {
+		t.Fatalf("expected the store to be refused, got %v", err)
+	}
+	if len(db.migrations) != 2 || db.migrations[1].Status != StatusFailed {
+		t.Fatalf("expected 2_backfill failed, got %+v", db.migrations)
+	}
+}
+
+func TestGzip(t *testing.T) {
+	gz := func(s string, level int) *fstest.MapFile {
+		var buf bytes.Buffer
+		w, err := gzip.NewWriterLevel(&buf, level)
+		check(t, err)
+		_, err = w.Write([]byte(s))
+		check(t, err)
+		check(t, w.Close())
+		return &fstest.MapFile{Data: buf.Bytes()}
+	}
+	seed := "INSERT INTO users VALUES (1); INSERT INTO users VALUES (2)"
+	plain := fstest.MapFS{
+		"1_users.sql":     {Data: []byte("CREATE TABLE users (id INT)")},
+		"5_seed.sql":      {Data: []byte(seed)},
+		"5_seed.down.sql": {Data: []byte("DELETE FROM users")},
+		"10_orders.sql":   {Data: []byte("CREATE TABLE orders (id INT)")},
+	}
+	compressed := fstest.MapFS{
+		"1_users.sql":        plain["1_users.sql"],
+		"5_seed.sql.gz":      gz(seed, gzip.BestCompression),
+		"5_seed.down.sql.gz": gz("DELETE FROM users", 1),
+		"10_orders.sql":      plain["10_orders.sql"],
+	}
+
+	// Compressed files run in order, recording the SQL they hold and its
+	// checksum
+	migrations := func(db *fakeStore) []Migration {
+		var ms []Migration
+		for _, mg := range db.migrations {
+			ms = append(ms, Migration{
+				Checksum:    mg.Checksum,
+				Content:     mg.Content,
+				DownContent: mg.DownContent,
+			})
+		}
+		return ms
+	}
+	want := newFakeStore()
+	m, err := NewFS(ctx, want, testLogger{t}, DBTypeMySQL, plain, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	db := newFakeStore()
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, compressed, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if !reflect.DeepEqual(migrations(db), migrations(want)) ||
+		db.migrations[1].Filename != "5_seed.sql.gz" ||
+		db.execs["INSERT INTO users VALUES (2)"] != 1 {
+		t.Fatalf("expected %+v, got %+v", want.migrations, db.migrations)
+	}
+
+	// Compressing it differently isn't a change
+	compressed["5_seed.sql.gz"] = gz(seed, gzip.BestSpeed)
+	_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, compressed, "")
+	check(t, err)
+	report, err := StatusFS(ctx, db, DBTypeMySQL, compressed)
+	check(t, err)
+	if len(report.Mismatched) != 0 || len(report.Pending) != 0 {
+		t.Fatalf("expected nothing changed, got %+v", report)
+	}
+
+	// Both forms of a migration
+	compressed["5_seed.sql"] = plain["5_seed.sql"]
+	_, err = NewFS(ctx, newFakeStore(), testLogger{t}, DBTypeMySQL,
+		compressed, "")
+	if err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Fatalf("expected both forms rejected, got %v", err)
+	}
+	delete(compressed, "5_seed.sql")
+
+	// Content which isn't gzip
+	compressed["11_bad.sql.gz"] = &fstest.MapFile{Data: []byte(seed)}
+	db = newFakeStore()
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, compressed, "")
+	check(t, err)
+	if _, err = m.Migrate(ctx); err == nil ||
+		!strings.Contains(err.Error(), "decompress") {
+		t.Fatalf("expected a decompression error, got %v", err)
+	}
+}
+
+func TestApplyOne(t *testing.T) {
+	db := newFakeStore()
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, MemorySource(
+		map[string]string{"1.sql": "CREATE TABLE a (id INT)"}), "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+
+	// A statement fails, leaving a checkpoint to resume from
+	hotfix := "UPDATE a SET id = 1; UPDATE a SET id = 2"
+	db.failures["UPDATE a SET id = 2"] = 1
+	_, err = ApplyOne(ctx, db, testLogger{t}, "2_hotfix.sql",
+		strings.NewReader(hotfix), WithRetry(1, 0))
+	if err == nil {
+		t.Fatal("expected the hotfix to fail")
+	}
+	_, err = ApplyOne(ctx, db, testLogger{t}, "2_hotfix.sql",
+		strings.NewReader(hotfix))
+	var failed *ErrMigrationFailed
+	if !errors.As(err, &failed) {
+		t.Fatalf("expected the failure reported, got %v", err)
+	}
+	applied, err := ApplyOne(ctx, db, testLogger{t}, "2_hotfix.sql",
+		strings.NewReader(hotfix), WithResume())
+	check(t, err)
+	if !applied || db.execs["UPDATE a SET id = 1"] != 1 ||
+		db.execs["UPDATE a SET id = 2"] != 2 {
+		t.Fatalf("expected the hotfix resumed, got %v", db.execs)
+	}
+	if len(db.migrations) != 2 || db.migrations[1].Filename != "2_hotfix.sql" ||
+		db.migrations[1].Status != StatusApplied ||
+		db.migrations[1].Content != hotfix {
+		t.Fatalf("unexpected migrations %+v", db.migrations)
+	}
+
+	// Once applied, it's not run again, and can't be changed
+	applied, err = ApplyOne(ctx, db, testLogger{t}, "2_hotfix.sql",
+		strings.NewReader(hotfix))
+	check(t, err)
+	if applied || db.execs["UPDATE a SET id = 1"] != 1 {
+		t.Fatalf("expected no migration, got %v", db.execs)
+	}
+	_, err = ApplyOne(ctx, db, testLogger{t}, "2_hotfix.sql",
+		strings.NewReader("UPDATE a SET id = 3"))
+	var mismatch *ErrChecksumMismatch
+	if !errors.As(err, &mismatch) || mismatch.Filename != "2_hotfix.sql" {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+
+	// The directory agrees with meta once the file is added to it
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, MemorySource(
+		map[string]string{
+			"1.sql":        "CREATE TABLE a (id INT)",
+			"2_hotfix.sql": hotfix,
+		}), "")
+	check(t, err)
+	if len(m.Migrations) != 2 {
+		t.Fatalf("expected 2 migrations, got %+v", m.Migrations)
+	}
+
+	for _, name := range []string{"hotfix.sql", "2_hotfix.txt", "x/2.sql"} {
+		_, err = ApplyOne(ctx, db, testLogger{t}, name,
+			strings.NewReader(hotfix))
+		if err == nil || !strings.Contains(err.Error(), "invalid filename") {
+			t.Fatalf("expected %s rejected, got %v", name, err)
+		}
+	}
+}
+
+func TestCompareFilenames(t *testing.T) {
+	// Each name sorts before the next
+	names := []string{"1_init.sql", "01_x.sql", "2.sql", "10.sql",
+		"0011_a.sql", "0100_c.sql", "2021-06-01_init.sql",
+		"2021-06-02_seed.sql", "2021-12-01_more.sql",
+		"20240611153000_x.sql", "20240611153001_y.sql",
+		"123456789012345678901234567890_big.sql", "V2__add_users.sql",
+		"V10__add_posts.sql", "V10__add_posts.sql.gz"}
+	for i, a := range names {
+		for j, b := range names {
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			if got := CompareFilenames(a, b); got != want {
+				t.Fatalf("compare %s and %s: expected %d, got %d", a, b,
+					want, got)
+			}
+		}
+	}
+
+	// The loader runs files in the order meta is sorted in
+	ms := make([]Migration, 0, len(names))
+	for i := len(names) - 1; i >= 0; i-- {
+		ms = append(ms, Migration{Filename: names[i]})
+	}
+	SortMigrations(ms)
+	for i, mg := range ms {
+		if mg.Filename != names[i] {
+			t.Fatalf("expected %s at %d, got %s", names[i], i, mg.Filename)
+		}
+	}
+	fsys := fstest.MapFS{}
+	var want []string
+	for _, name := range names {
+		// Leaving out those sharing a numeric prefix with another
+		if isMigrationName(name) && !strings.HasPrefix(name, "2021-") &&
+			!strings.HasPrefix(name, "01_") {
+			fsys[name] = &fstest.MapFile{Data: []byte("SELECT 1;")}
+			want = append(want, name)
+		}
+	}
+	m, err := NewFS(ctx, newFakeStore(), testLogger{t}, DBTypeMySQL, fsys,
+		"")
+	check(t, err)
+	var got []string
+	for _, f := range m.Files {
+		got = append(got, f.Info.Name())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	// Files with the same numeric prefix are refused, however they're
+	// padded
+	fsys["0002_again.sql"] = &fstest.MapFile{Data: []byte("SELECT 1;")}
+	_, err = NewFS(ctx, newFakeStore(), testLogger{t}, DBTypeMySQL, fsys, "")
+	if err == nil || !strings.Contains(err.Error(), "duplicate number 2: 2.sql and 0002_again.sql") {
+		t.Fatalf("expected a duplicate error, got %v", err)
+	}
+}
+
+func TestTimestampNumbering(t *testing.T) {
+	sql := &fstest.MapFile{Data: []byte("SELECT 1;")}
+	timestamps := fstest.MapFS{
+		"20240611153000_add_index.sql": sql,
+		"20240101000000_init.sql":      sql,
+		"20240611090000_add_users.sql": sql,
+	}
+	want := []string{"20240101000000_init.sql",
+		"20240611090000_add_users.sql", "20240611153000_add_index.sql"}
+	names := func(t *testing.T, db *fakeStore, fsys fs.FS,
+		opts ...Option) []string {
+		t.Helper()
+		m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+			opts...)
+		check(t, err)
+		_, err = m.Migrate(ctx)
+		check(t, err)
+		var names []string
+		for _, mg := range db.migrations {
+			names = append(names, mg.Filename)
+		}
+		return names
+	}
+	db := newFakeStore()
+	if got := names(t, db, timestamps, WithoutMixedNumbering()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	// Meta agrees with the files when they're read again, and a later
+	// timestamp runs after them
+	timestamps["20240612000000_more.sql"] = sql
+	want = append(want, "20240612000000_more.sql")
+	if got := names(t, db, timestamps); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	// Sequence numbers run before timestamps, as when a project switches
+	// from one to the other
+	mixed := fstest.MapFS{
+		"20240101000000_init.sql": sql,
+		"0002_b.sql":              sql,
+		"10_c.sql":                sql,
+		"1_a.sql":                 sql,
+	}
+	want = []string{"1_a.sql", "0002_b.sql", "10_c.sql",
+		"20240101000000_init.sql"}
+	if got := names(t, newFakeStore(), mixed); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	_, err := NewFS(ctx, newFakeStore(), testLogger{t}, DBTypeMySQL, mixed,
+		"", WithoutMixedNumbering())
+	if err == nil || !strings.Contains(err.Error(),
+		"1_a.sql is numbered sequentially but 20240101000000_init.sql by timestamp") {
+		t.Fatalf("expected a mixed numbering error, got %v", err)
+	}
+	_, err = StatusFS(ctx, newFakeStore(), DBTypeMySQL, mixed,
+		WithoutMixedNumbering())
+	if err == nil || !strings.Contains(err.Error(), "mixed numbering") {
+		t.Fatalf("expected a mixed numbering error, got %v", err)
+	}
+
+	// 14 digits which aren't a time are a sequence number
+	mixed = fstest.MapFS{
+		"1_a.sql":                 sql,
+		"99999999999999_huge.sql": sql,
+	}
+	_, err = NewFS(ctx, newFakeStore(), testLogger{t}, DBTypeMySQL, mixed,
+		"", WithoutMixedNumbering())
+	check(t, err)
+
+	at := time.Date(2024, 6, 11, 17, 30, 0, 0, time.FixedZone("", 2*3600))
+	if got := TimestampPrefix(at); got != "20240611153000" {
+		t.Fatalf("expected 20240611153000, got %s", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	write := func(t *testing.T, names ...string) string {
+		t.Helper()
+		dir := t.TempDir()
+		for _, name := range names {
+			check(t, os.WriteFile(filepath.Join(dir, name),
+				[]byte("SELECT 1;"), 0o644))
+		}
+		return dir
+	}
+
+	// Numbers used twice are refused however they're padded, naming
+	// both files, before anything runs
+	dir := write(t, "0016_a.sql", "0017_users.sql", "17_orders.sql")
+	err := Validate(dir)
+	if err == nil || !strings.Contains(err.Error(),
+		"duplicate number 17: 17_orders.sql and 0017_users.sql") {
+		t.Fatalf("expected a duplicate error, got %v", err)
+	}
+	db := newFakeStore()
+	_, err = New(ctx, db, testLogger{t}, DBTypeMySQL, dir, "")
+	if err == nil || !strings.Contains(err.Error(), "duplicate number 17") {
+		t.Fatalf("expected a duplicate error, got %v", err)
+	}
+	if len(db.migrations) != 0 || len(db.execs) != 0 {
+		t.Fatalf("expected nothing run, got %v", db.execs)
+	}
+	if err = Validate(t.TempDir()); err == nil {
+		t.Fatal("expected an error for no migrations")
+	}
+
+	// Gaps are allowed by default, and may be warned of or refused
+	dir = write(t, "0016_a.sql", "0017_b.sql", "0019_c.sql",
+		"20240611153000_d.sql", "20240612000000_e.sql")
+	check(t, Validate(dir))
+	check(t, Validate(dir, WithGapPolicy(GapsWarn)))
+	err = Validate(dir, WithGapPolicy(GapsRefused))
+	if err == nil || !strings.Contains(err.Error(),
+		"0017_b.sql is followed by 0019_c.sql, expected 0018 next") {
+		t.Fatalf("expected a gap error, got %v", err)
+	}
+	var buf strings.Builder
+	_, err = New(ctx, newFakeStore(), recordLogger{testLogger{t}, &buf},
+		DBTypeMySQL, dir, "", WithGapPolicy(GapsWarn))
+	check(t, err)
+	if !strings.Contains(buf.String(), "WARNING: gap in numbering") {
+		t.Fatalf("expected a gap warning, got %q", buf.String())
+	}
+	_, err = New(ctx, newFakeStore(), testLogger{t}, DBTypeMySQL, dir, "",
+		WithGapPolicy(GapsRefused))
+	if err == nil || !strings.Contains(err.Error(), "expected 0018 next") {
+		t.Fatalf("expected a gap error, got %v", err)
+	}
+
+	// Numbers roll over to a wider one
+	dir = write(t, "9_a.sql", "10_b.sql", "99_c.sql", "100_d.sql")
+	err = Validate(dir, WithGapPolicy(GapsRefused))
+	if err == nil || !strings.Contains(err.Error(),
+		"10_b.sql is followed by 99_c.sql, expected 11 next") {
+		t.Fatalf("expected a gap error, got %v", err)
+	}
+	check(t, os.Remove(filepath.Join(dir, "99_c.sql")))
+	check(t, os.Remove(filepath.Join(dir, "100_d.sql")))
+	check(t, Validate(dir, WithGapPolicy(GapsRefused)))
+	if got := nextNumber("0999"); got != "1000" {
+		t.Fatalf("expected 1000, got %s", got)
+	}
+	if got := nextNumber("99"); got != "100" {
+		t.Fatalf("expected 100, got %s", got)
+	}
+}
+
+func TestOutOfOrder(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0008_a.sql": mapFile("SELECT 8"),
+		"0010_b.sql": mapFile("SELECT 10"),
+	}
+	db := newFakeStore()
+	migrate := func(t *testing.T, opts ...Option) []string {
+		t.Helper()
+		m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+			opts...)
+		check(t, err)
+		pending := m.Pending()
+		_, err = m.Migrate(ctx)
+		check(t, err)
+		return pending
+	}
+	migrate(t)
+
+	// Files appended after the last applied run as usual
+	fsys["0011_c.sql"] = mapFile("SELECT 11")
+	if got := migrate(t); !reflect.DeepEqual(got, []string{"0011_c.sql"}) {
+		t.Fatalf("expected 0011_c.sql pending, got %v", got)
+	}
+
+	// A file merged late is refused, naming it, before anything runs
+	fsys["0009_late.sql"] = mapFile("SELECT 9")
+	fsys["0012_d.sql"] = mapFile("SELECT 12")
+	_, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	var orderErr *ErrOutOfOrder
+	if !errors.As(err, &orderErr) ||
+		!reflect.DeepEqual(orderErr.Filenames, []string{"0009_late.sql"}) ||
+		orderErr.Last != "0011_c.sql" {
+		t.Fatalf("expected 0009_late.sql out of order, got %v", err)
+	}
+	if !strings.Contains(err.Error(),
+		"0009_late.sql sorts before 0011_c.sql, which is applied already") {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if db.execs["SELECT 9"] != 0 || db.execs["SELECT 12"] != 0 {
+		t.Fatalf("expected nothing run, got %v", db.execs)
+	}
+	report, err := StatusFS(ctx, db, DBTypeMySQL, fsys)
+	check(t, err)
+	if !reflect.DeepEqual(report.OutOfOrder, []string{"0009_late.sql"}) ||
+		!reflect.DeepEqual(report.Pending,
+			[]string{"0009_late.sql", "0012_d.sql"}) {
+		t.Fatalf("expected 0009_late.sql out of order, got %+v", report)
+	}
+	if !strings.Contains(report.String(), "1 out of order") {
+		t.Fatalf("expected out of order files noted, got %q", report)
+	}
+
+	// With the flag, it runs first, and is recorded as any other
+	got := migrate(t, WithAllowOutOfOrder())
+	if want := []string{"0009_late.sql", "0012_d.sql"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v pending, got %v", want, got)
+	}
+	if db.execs["SELECT 9"] != 1 || db.execs["SELECT 12"] != 1 {
+		t.Fatalf("expected both run, got %v", db.execs)
+	}
+	var names []string
+	for _, mg := range db.migrations {
+		if mg.Status != StatusApplied {
+			t.Fatalf("expected %s applied, got %s", mg.Filename, mg.Status)
+		}
+		names = append(names, mg.Filename)
+	}
+	want := []string{"0008_a.sql", "0010_b.sql", "0011_c.sql",
+		"0009_late.sql", "0012_d.sql"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("expected %v, got %v", want, names)
+	}
+	if got := migrate(t); len(got) != 0 {
+		t.Fatalf("expected nothing pending, got %v", got)
+	}
+	report, err = StatusFS(ctx, db, DBTypeMySQL, fsys)
+	check(t, err)
+	if len(report.OutOfOrder) != 0 || !report.UpToDate() {
+		t.Fatalf("expected up to date, got %+v", report)
+	}
+}
+
+// indexOrdering runs files in the order of an explicit list, as a custom
+// Ordering might read from an index file.
+type indexOrdering map[string]int
+
+func (o indexOrdering) Less(a, b string) bool { return o[a] < o[b] }
+
+func (o indexOrdering) CheckName(name string) error {
+	if _, ok := o[name]; !ok {
+		return fmt.Errorf("%s isn't in the index", name)
+	}
+	return nil
+}
+
+func TestOrdering(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	names := map[string]func(i int) string{
+		"numeric": func(i int) string {
+			return fmt.Sprintf("%0*d_%d.sql", rnd.Intn(5), i*7+rnd.Intn(7), i)
+		},
+		"timestamp": func(i int) string {
+			at := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).
+				Add(time.Duration(i*100000+rnd.Intn(100000)) * time.Second)
+			return TimestampPrefix(at) + "_x.sql"
+		},
+		"lexicographic": func(i int) string {
+			return fmt.Sprintf("%d_%d.sql", rnd.Intn(1000), i)
+		},
+		"index": func(i int) string {
+			return fmt.Sprintf("%d_%d.sql", rnd.Intn(1000), i)
+		},
+	}
+	for _, tc := range []struct {
+		name     string
+		ordering func(names []string) Ordering
+	}{
+		{"numeric", func([]string) Ordering { return NumericPrefix{} }},
+		{"timestamp", func([]string) Ordering { return Timestamp{} }},
+		{"lexicographic", func([]string) Ordering { return Lexicographic{} }},
+		{"index", func(names []string) Ordering {
+			o := indexOrdering{}
+			for i, j := range rnd.Perm(len(names)) {
+				o[names[j]] = i
+			}
+			return o
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for iter := 0; iter < 50; iter++ {
+				var all []string
+				fsys := fstest.MapFS{}
+				for i := 0; i < 1+rnd.Intn(20); i++ {
+					name := names[tc.name](i)
+					if _, ok := fsys[name]; ok {
+						continue
+					}
+					all = append(all, name)
+					fsys[name] = &fstest.MapFile{Data: []byte("SELECT " + name)}
+				}
+				o := tc.ordering(all)
+				db := newFakeStore()
+				m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys,
+					"", WithOrdering(o))
+				check(t, err)
+				var files []string
+				for i, f := range m.Files {
+					files = append(files, f.Info.Name())
+					if i > 0 && !o.Less(files[i-1], files[i]) {
+						t.Fatalf("%s loaded before %s", files[i-1],
+							files[i])
+					}
+				}
+				_, err = m.Migrate(ctx)
+				check(t, err)
+
+				// However the store orders meta, migrations are compared
+				// with the files in the same order
+				rnd.Shuffle(len(db.migrations), func(i, j int) {
+					db.migrations[i], db.migrations[j] =
+						db.migrations[j], db.migrations[i]
+				})
+				m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys,
+					"", WithOrdering(o))
+				check(t, err)
+				var recorded []string
+				for _, mg := range m.Migrations {
+					recorded = append(recorded, mg.Filename)
+				}
+				if !reflect.DeepEqual(recorded, files) {
+					t.Fatalf("expected %v, got %v", files, recorded)
+				}
+				if len(m.Pending()) != 0 {
+					t.Fatalf("expected nothing pending, got %v",
+						m.Pending())
+				}
+			}
+		})
+	}
+
+	// Timestamp refuses sequence numbers, and NumericPrefix ties
+	fsys := fstest.MapFS{
+		"20240611153000_a.sql": {Data: []byte("SELECT 1")},
+		"2_b.sql":              {Data: []byte("SELECT 2")},
+		"0002_c.sql":           {Data: []byte("SELECT 3")},
+	}
+	_, err := NewFS(ctx, newFakeStore(), testLogger{t}, DBTypeMySQL, fsys,
+		"", WithOrdering(Timestamp{}))
+	if err == nil || !strings.Contains(err.Error(),
+		"must start with a timestamp") {
+		t.Fatalf("expected a timestamp error, got %v", err)
+	}
+	_, err = NewFS(ctx, newFakeStore(), testLogger{t}, DBTypeMySQL, fsys, "")
+	if err == nil || !strings.Contains(err.Error(),
+		"duplicate number 2: 2_b.sql and 0002_c.sql") {
+		t.Fatalf("expected a duplicate error, got %v", err)
+	}
+	m, err := NewFS(ctx, newFakeStore(), testLogger{t}, DBTypeMySQL, fsys,
+		"", WithOrdering(Lexicographic{}))
+	check(t, err)
+	if got, want := m.Pending(), []string{"0002_c.sql", "20240611153000_a.sql",
+		"2_b.sql"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestFilenames(t *testing.T) {
+	sql := &fstest.MapFile{Data: []byte("SELECT 1")}
+	long := "1_" + strings.Repeat("a", 250) + ".sql"
+	for _, tc := range []struct {
+		name string
+		fsys fstest.MapFS
+		want string
+	}{
+		{"long", fstest.MapFS{long: sql},
+			long + " is 256 bytes, but names may be at most 255"},
+		{"case", fstest.MapFS{"1_users.sql": sql, "1_Users.sql": sql},
+			"1_Users.sql and 1_users.sql differ only by case"},
+		{"leading space", fstest.MapFS{" 2_b.sql": sql},
+			`" 2_b.sql" starts or ends with whitespace`},
+		{"trailing space", fstest.MapFS{"1_a.sql": sql, "2_b.sql ": sql},
+			`"2_b.sql " starts or ends with whitespace`},
+		{"separator", fstest.MapFS{`1_a\b.sql`: sql},
+			`"1_a\\b.sql" contains a path separator`},
+	} {
+		_, err := NewFS(ctx, newFakeStore(), testLogger{t}, DBTypeMySQL,
+			tc.fsys, "")
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("%s: expected %q, got %v", tc.name, tc.want, err)
+		}
+	}
+	ok := fstest.MapFS{long[:255-len(".sql")] + ".sql": sql}
+	_, err := NewFS(ctx, newFakeStore(), testLogger{t}, DBTypeMySQL, ok, "")
+	check(t, err)
+
+	// A name decomposed, as macOS writes it, is recorded composed, so it
+	// matches the same name written on Linux
+	const nfd, nfc = "1_cafe\u0301.sql", "1_caf\u00e9.sql"
+	db := newFakeStore()
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL,
+		fstest.MapFS{nfd: sql}, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if len(db.migrations) != 1 || db.migrations[0].Filename != nfc {
+		t.Fatalf("expected %q recorded, got %+v", nfc, db.migrations)
+	}
+	for _, fsys := range []fstest.MapFS{{nfc: sql}, {nfd: sql}} {
+		report, err := StatusFS(ctx, db, DBTypeMySQL, fsys)
+		check(t, err)
+		if !report.UpToDate() {
+			t.Fatalf("expected up to date, got %+v", report)
+		}
+	}
+
+	// As does one recorded decomposed before names were normalized
+	db.migrations[0].Filename = nfd
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fstest.MapFS{nfc: sql},
+		"")
+	check(t, err)
+	if len(m.Pending()) != 0 {
+		t.Fatalf("expected nothing pending, got %v", m.Pending())
+	}
+}
+
+func TestSubdirectories(t *testing.T) {
+	fsys := fstest.MapFS{
+		"2023/0001_init.sql":        mapFile("SELECT 1"),
+		"2023/0010_users.sql":       mapFile("SELECT 10"),
+		"2024/0002_orders.sql":      mapFile("SELECT 2"),
+		"2024/0002_orders.down.sql": mapFile("SELECT -2"),
+		"2024/q3/0011_index.sql":    mapFile("SELECT 11"),
+		"2024/mysql/0011_x.sql":     mapFile("SELECT 0"),
+		"2024/mysql/0002_orders.sql": mapFile(
+			"SELECT 2 /* mysql */"),
+		"0012_flat.sql":    mapFile("SELECT 12"),
+		"docs/README.md":   mapFile("not a migration"),
+		"mysql/0001_x.sql": mapFile("SELECT 0"),
+	}
+	recorded := func(db *fakeStore) []string {
+		var names []string
+		for _, mg := range db.migrations {
+			names = append(names, mg.Filename)
+		}
+		return names
+	}
+
+	// Files run by their base names, recorded by their paths
+	db := newFakeStore()
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithSubdirectories())
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	want := []string{"2023/0001_init.sql", "2024/0002_orders.sql",
+		"2023/0010_users.sql", "2024/q3/0011_index.sql", "0012_flat.sql"}
+	if got := recorded(db); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if db.execs["SELECT 2 /* mysql */"] != 1 || db.execs["SELECT 2"] != 0 {
+		t.Fatalf("expected the mysql override, got %v", db.execs)
+	}
+	if db.migrations[1].DownContent != "SELECT -2" {
+		t.Fatalf("expected the down migration, got %+v", db.migrations[1])
+	}
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithSubdirectories())
+	check(t, err)
+	if len(m.Pending()) != 0 {
+		t.Fatalf("expected nothing pending, got %v", m.Pending())
+	}
+
+	// Without the option, only the top directory is read
+	m, err = NewFS(ctx, newFakeStore(), testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	if got := m.Pending(); !reflect.DeepEqual(got, []string{"0012_flat.sql"}) {
+		t.Fatalf("expected only 0012_flat.sql, got %v", got)
+	}
+
+	// A file moved after it was applied is refused, naming the move, and
+	// recorded by its new path with WithRenameMoved
+	fsys["2024/0010_users.sql"] = fsys["2023/0010_users.sql"]
+	delete(fsys, "2023/0010_users.sql")
+	fsys["2024/0012_flat.sql"] = fsys["0012_flat.sql"]
+	delete(fsys, "0012_flat.sql")
+	_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithSubdirectories())
+	if err == nil || !strings.Contains(err.Error(),
+		"2023/0010_users.sql to 2024/0010_users.sql, 0012_flat.sql to 2024/0012_flat.sql") {
+		t.Fatalf("expected a moved error, got %v", err)
+	}
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithSubdirectories(), WithRenameMoved())
+	check(t, err)
+	if len(m.Pending()) != 0 {
+		t.Fatalf("expected nothing pending, got %v", m.Pending())
+	}
+	want = []string{"2023/0001_init.sql", "2024/0002_orders.sql",
+		"2024/0010_users.sql", "2024/q3/0011_index.sql", "2024/0012_flat.sql"}
+	if got := recorded(db); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if db.execs["SELECT 10"] != 1 {
+		t.Fatalf("expected the moved file not run again, got %v", db.execs)
+	}
+
+	// An edited file isn't taken for a moved one
+	fsys["2025/0001_init.sql"] = mapFile("SELECT /* edited */ 1")
+	delete(fsys, "2023/0001_init.sql")
+	_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithSubdirectories(), WithRenameMoved())
+	if err == nil || !strings.Contains(err.Error(), "missing migrations") {
+		t.Fatalf("expected a missing migration, got %v", err)
+	}
+
+	// Files in different directories can't have the same name
+	dup := fstest.MapFS{
+		"2023/0005_x.sql": mapFile("SELECT 1"),
+		"2024/0005_x.sql": mapFile("SELECT 2"),
+	}
+	_, err = NewFS(ctx, newFakeStore(), testLogger{t}, DBTypeMySQL, dup, "",
+		WithSubdirectories())
+	if err == nil || !strings.Contains(err.Error(),
+		"2023/0005_x.sql and 2024/0005_x.sql have the same name") {
+		t.Fatalf("expected a duplicate name error, got %v", err)
+	}
+	err = ValidateFS(dup, WithSubdirectories())
+	if err == nil || !strings.Contains(err.Error(), "have the same name") {
+		t.Fatalf("expected a duplicate name error, got %v", err)
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	tcs := []struct {
+		patterns []string
+		name     string
+		isDir    bool
+		want     bool
+	}{
+		{[]string{"*.bak"}, "0001_init.sql.bak", false, true},
+		{[]string{"*.bak"}, "mysql/0001_init.sql.bak", false, true},
+		{[]string{"*.bak"}, "0001_init.sql", false, false},
+		{[]string{"?_scratch.sql"}, "9_scratch.sql", false, true},
+		{[]string{"?_scratch.sql"}, "10_scratch.sql", false, false},
+		{[]string{"[0-9]_tmp*"}, "7_tmp_x.sql", false, true},
+		{[]string{"[!0-9]*"}, "README.md", false, true},
+		{[]string{"[!0-9]*"}, "1.sql", false, false},
+		{[]string{"/0001_init.sql"}, "0001_init.sql", false, true},
+		{[]string{"/0001_init.sql"}, "mysql/0001_init.sql", false, false},
+		{[]string{"mysql/*.sql"}, "mysql/0001_x.sql", false, true},
+		{[]string{"mysql/*.sql"}, "2024/mysql/0001_x.sql", false, false},
+		{[]string{"**/mysql/*.sql"}, "2024/mysql/0001_x.sql", false, true},
+		{[]string{"**/mysql/*.sql"}, "mysql/0001_x.sql", false, true},
+		{[]string{"notes/"}, "notes", true, true},
+		{[]string{"notes/"}, "notes", false, false},
+		{[]string{"notes/"}, "2024/notes/1_x.sql", false, true},
+		{[]string{"*.sql", "!0001_*.sql"}, "0001_init.sql", false, false},
+		{[]string{"*.sql", "!0001_*.sql"}, "0002_users.sql", false, true},
+		{[]string{"!0001_*.sql", "*.sql"}, "0001_init.sql", false, true},
+		{[]string{"# *.sql", "", `\#1.sql`}, "#1.sql", false, true},
+		{[]string{"# *.sql"}, "1.sql", false, false},
+	}
+	for _, tc := range tcs {
+		patterns, err := parseIgnore(tc.patterns)
+		check(t, err)
+		if got := ignored(patterns, tc.name, tc.isDir); got != tc.want {
+			t.Errorf("%q: expected %s ignored %t, got %t", tc.patterns,
+				tc.name, tc.want, got)
+		}
+	}
+	if _, err := parseIgnore([]string{"[0-9"}); err == nil {
+		t.Fatal("expected an error for an unterminated [")
+	}
+
+	fsys := fstest.MapFS{
+		".migrateignore": mapFile("# scratch work\n*_scratch.sql\n" +
+			"!0003_scratch.sql\nnotes/\n"),
+		"0001_init.sql":        mapFile("SELECT 1"),
+		"0002_scratch.sql":     mapFile("SELECT 'scratch'"),
+		"0003_scratch.sql":     mapFile("SELECT 3"),
+		"0004_users.sql":       mapFile("SELECT 4"),
+		"notes/1_draft.sql":    mapFile("SELECT 'draft'"),
+		"mysql/0004_users.sql": mapFile("SELECT 4 /* mysql */"),
+		"mysql/0004_users.sql.orig": mapFile(
+			"SELECT 'orig'"),
+		"README.md": mapFile("migrations"),
+	}
+
+	// Ignored files aren't run, and negated ones are
+	db := newFakeStore()
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithSubdirectories())
+	check(t, err)
+	want := []string{"0001_init.sql", "0003_scratch.sql", "0004_users.sql"}
+	if got := m.Pending(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	// WithIgnore adds to .migrateignore, overriding it
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithIgnore("/0004_*", "!0002_scratch.sql"))
+	check(t, err)
+	want = []string{"0001_init.sql", "0002_scratch.sql", "0003_scratch.sql"}
+	if got := m.Pending(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	// Status lists what was ignored
+	report, err := StatusFS(ctx, db, DBTypeMySQL, fsys)
+	check(t, err)
+	want = []string{"0002_scratch.sql", "notes"}
+	if !reflect.DeepEqual(report.Ignored, want) {
+		t.Fatalf("expected %v ignored, got %v", want, report.Ignored)
+	}
+
+	// Strict, files which aren't migrations are refused unless ignored
+	_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithStrictFiles())
+	if err == nil || !strings.Contains(err.Error(), "README.md isn't a migration") {
+		t.Fatalf("expected README.md refused, got %v", err)
+	}
+	_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithStrictFiles(), WithIgnore("README.md"))
+	if err == nil || !strings.Contains(err.Error(),
+		"mysql/0004_users.sql.orig isn't a migration") {
+		t.Fatalf("expected the .orig refused, got %v", err)
+	}
+	check(t, ValidateFS(fsys, WithStrictFiles(),
+		WithIgnore("README.md", "*.orig")))
+}
+
+func TestEnvironments(t *testing.T) {
+	for name, want := range map[string]string{
+		"0031_seed_test_users.staging.sql":      "staging",
+		"0031_seed_test_users.staging.down.sql": "staging",
+		"0031_seed.staging.sql.gz":              "staging",
+		"2024/0031_partition.production.sql":    "production",
+		"0031_seed_test_users.sql":              "",
+		"0031_seed.down.sql":                    "",
+		"0031_v1.2.sql":                         "",
+	} {
+		if got := envTag(name); got != want {
+			t.Errorf("%s: expected tag %q, got %q", name, want, got)
+		}
+	}
+
+	fsys := fstest.MapFS{
+		"0001_init.sql":                 mapFile("SELECT 1"),
+		"0002_users.sql":                mapFile("SELECT 2"),
+		"0003_seed.staging.sql":         mapFile("SELECT 3"),
+		"0003_seed.staging.down.sql":    mapFile("SELECT -3"),
+		"0004_partition.production.sql": mapFile("SELECT 4"),
+	}
+
+	// Each environment runs its own files and the untagged ones
+	db := newFakeStore()
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithEnvironment("staging"))
+	check(t, err)
+	want := []string{"0001_init.sql", "0002_users.sql", "0003_seed.staging.sql"}
+	if got := m.Pending(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if db.migrations[2].DownContent != "SELECT -3" {
+		t.Fatalf("expected the down migration, got %+v", db.migrations[2])
+	}
+
+	// Migrations recorded for another environment are neither pending nor
+	// missing, so environments may share a database
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithEnvironment("production"))
+	check(t, err)
+	want = []string{"0004_partition.production.sql"}
+	if got := m.Pending(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	report, err := StatusFS(ctx, db, DBTypeMySQL, fsys,
+		WithEnvironment("staging"))
+	check(t, err)
+	if !report.UpToDate() {
+		t.Fatalf("expected staging up to date, got %s", report)
+	}
+
+	// Without an environment, tags mean nothing
+	m, err = NewFS(ctx, newFakeStore(), testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	if got := m.Pending(); len(got) != 4 {
+		t.Fatalf("expected all 4 files pending, got %v", got)
+	}
+
+	// With a list of environments, unknown tags are refused
+	envs := WithEnvironments("staging", "production")
+	check(t, ValidateFS(fsys, envs))
+	_, err = NewFS(ctx, newFakeStore(), testLogger{t}, DBTypeMySQL, fsys, "",
+		envs, WithEnvironment("dev"))
+	if err == nil || !strings.Contains(err.Error(), "unknown environment dev") {
+		t.Fatalf("expected dev refused, got %v", err)
+	}
+	fsys["0005_x.stagign.sql"] = mapFile("SELECT 5")
+	err = ValidateFS(fsys, envs)
+	if err == nil || !strings.Contains(err.Error(),
+		"0005_x.stagign.sql is for unknown environment stagign") {
+		t.Fatalf("expected stagign refused, got %v", err)
+	}
+}
+
+func TestAllowRename(t *testing.T) {
+	db := newFakeStore()
+	fsys := fstest.MapFS{
+		"1.sql": mapFile("SELECT 1"),
+		"2.sql": mapFile("SELECT 2"),
+		"3.sql": mapFile("SELECT 3"),
+	}
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	rename := func(from, to string) {
+		fsys[to] = fsys[from]
+		delete(fsys, from)
+	}
+
+	// A renamed file is missing without the option, and recorded by its
+	// new name with it
+	rename("1.sql", "0001_init.sql")
+	_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	if err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Fatalf("expected 1.sql missing, got %v", err)
+	}
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithAllowRename())
+	check(t, err)
+	if len(m.Pending()) != 0 {
+		t.Fatalf("expected nothing pending, got %v", m.Pending())
+	}
+	if got := db.migrations[0].Filename; got != "0001_init.sql" {
+		t.Fatalf("expected 0001_init.sql recorded, got %s", got)
+	}
+
+	// A file renamed and edited doesn't match
+	rename("2.sql", "0002_users.sql")
+	fsys["0002_users.sql"] = mapFile("SELECT 2 AS users")
+	_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithAllowRename())
+	if err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Fatalf("expected 2.sql missing, got %v", err)
+	}
+	fsys["0002_users.sql"] = mapFile("SELECT 2")
+
+	// A checksum shared by two files is reported, renaming nothing
+	rename("3.sql", "0003_orders.sql")
+	fsys["0004_orders_again.sql"] = mapFile("SELECT 3")
+	_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithAllowRename())
+	if err == nil || !strings.Contains(err.Error(),
+		"3.sql to 0003_orders.sql or 0004_orders_again.sql") {
+		t.Fatalf("expected an ambiguous rename, got %v", err)
+	}
+	if got := db.migrations[1].Filename; got != "2.sql" {
+		t.Fatalf("expected 2.sql still recorded, got %s", got)
+	}
+	delete(fsys, "0004_orders_again.sql")
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithAllowRename())
+	check(t, err)
+	if len(m.Pending()) != 0 {
+		t.Fatalf("expected nothing pending, got %v", m.Pending())
+	}
+
+	// As is one shared by two recorded migrations
+	db = newFakeStore()
+	fsys = fstest.MapFS{
+		"1.sql": mapFile("SELECT 1"),
+		"2.sql": mapFile("SELECT 1"),
+	}
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	rename("1.sql", "0001_a.sql")
+	rename("2.sql", "0002_b.sql")
+	_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithAllowRename())
+	if err == nil || !strings.Contains(err.Error(),
+		"1.sql or 2.sql to 0001_a.sql or 0002_b.sql") {
+		t.Fatalf("expected an ambiguous rename, got %v", err)
+	}
+}
+
+func TestChecksumAlgorithms(t *testing.T) {
+	db := newFakeStore()
+	fsys := fstest.MapFS{
+		"1.sql":      mapFile("SELECT 1"),
+		"1.down.sql": mapFile("SELECT -1"),
+		"2.sql":      mapFile("SELECT 2"),
+	}
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithChecksumAlgo(ChecksumMD5))
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+
+	// New migrations are recorded with sha256 by default, and those
+	// recorded with md5 still match
+	fsys["3.sql"] = mapFile("SELECT 3")
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	algos := func() []string {
+		var algos []string
+		for _, mg := range db.migrations {
+			algos = append(algos, mg.ChecksumAlgo)
+		}
+		return algos
+	}
+	want := []string{ChecksumMD5, ChecksumMD5, ChecksumSHA256}
+	if got := algos(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if got, want := db.migrations[2].Checksum,
+		fmt.Sprintf("%x", sha256.Sum256([]byte("SELECT 3"))); got != want {
+		t.Fatalf("expected checksum %s, got %s", want, got)
+	}
+	_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+
+	// An edit is found whichever the algorithm
+	for _, name := range []string{"1.sql", "3.sql"} {
+		orig := fsys[name]
+		fsys[name] = mapFile("SELECT 'edited'")
+		_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+		var mismatch *ErrChecksumMismatch
+		if !errors.As(err, &mismatch) || mismatch.Filename != name {
+			t.Fatalf("expected %s mismatched, got %v", name, err)
+		}
+		report, err := StatusFS(ctx, db, DBTypeMySQL, fsys)
+		check(t, err)
+		if !reflect.DeepEqual(report.Mismatched, []string{name}) {
+			t.Fatalf("expected %s mismatched, got %v", name,
+				report.Mismatched)
+		}
+		fsys[name] = orig
+	}
+
+	// Rehashing upgrades those which still match their files, keeping
+	// the rest of their rows
+	fsys["2.sql"] = mapFile("SELECT 'edited'")
+	n, err := RehashChecksumsFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys)
+	check(t, err)
+	if n != 1 {
+		t.Fatalf("expected 1 rehashed, got %d", n)
+	}
+	want = []string{ChecksumSHA256, ChecksumMD5, ChecksumSHA256}
+	if got := algos(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if db.migrations[0].DownContent != "SELECT -1" {
+		t.Fatalf("expected the down migration kept, got %+v",
+			db.migrations[0])
+	}
+	fsys["2.sql"] = mapFile("SELECT 2")
+	n, err = RehashChecksumsFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys)
+	check(t, err)
+	if n != 1 {
+		t.Fatalf("expected 1 rehashed, got %d", n)
+	}
+	_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+
+	_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithChecksumAlgo("crc32"))
+	if err == nil || !strings.Contains(err.Error(), `unknown checksum algorithm "crc32"`) {
+		t.Fatalf("expected crc32 refused, got %v", err)
+	}
+}
+
+func TestNormalizeSQL(t *testing.T) {
+	tcs := []struct{ in, want string }{
+		{"SELECT 1;", "SELECT 1"},
+		{"  SELECT\t1 ;\n\n", "SELECT 1"},
+		{"CREATE TABLE a (\n\tid INT,\n\tname TEXT\n);\n",
+			"CREATE TABLE a ( id INT, name TEXT )"},
+		{"-- users\nSELECT 1; -- one\n/* two\n */SELECT 2;",
+			"SELECT 1; SELECT 2"},
+		{"SELECT 'a  b', \"c\td\", `e  f`;", "SELECT 'a  b', \"c\td\", `e  f`"},
+		{"SELECT 'it''s -- not a comment';", "SELECT 'it''s -- not a comment'"},
+		{`SELECT 'it\'s /* not */ a comment';`,
+			`SELECT 'it\'s /* not */ a comment'`},
+		{"-- migrate:timeout 30m\nSELECT 1;", "-- migrate:timeout 30m SELECT 1"},
+		{"CREATE FUNCTION f() RETURNS int AS $$\n  SELECT  1;\n$$ LANGUAGE sql;",
+			"CREATE FUNCTION f() RETURNS int AS $$\n  SELECT  1;\n$$ LANGUAGE sql"},
+		{"SELECT $1,  $2;", "SELECT $1, $2"},
+		{"SELECT 'unterminated  ;", "SELECT 'unterminated  ;"},
+	}
+	for _, tc := range tcs {
+		if got := string(normalizeSQL([]byte(tc.in))); got != tc.want {
+			t.Errorf("%q: expected %q, got %q", tc.in, tc.want, got)
+		}
+	}
+}
+
+func TestNormalizedChecksums(t *testing.T) {
+	db := newFakeStore()
+	fsys := fstest.MapFS{
+		"1.sql": mapFile("CREATE TABLE a (id INT, name TEXT DEFAULT 'x  y');"),
+		"2.sql": mapFile("INSERT INTO a VALUES (1, 'one');"),
+	}
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithNormalizedChecksums())
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if got := db.migrations[0].ChecksumAlgo; got != "sha256+normalized" {
+		t.Fatalf("expected sha256+normalized, got %s", got)
+	}
+
+	// Reformatting a file doesn't change its checksum, but editing a
+	// string does, whether normalizing or not
+	fsys["1.sql"] = mapFile("-- the a table\nCREATE TABLE   a (id INT,\n" +
+		"\tname TEXT /* a default */\n\tDEFAULT 'x  y');\n\n")
+	_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	fsys["2.sql"] = mapFile("INSERT INTO a VALUES (1, 'one ');")
+	_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithNormalizedChecksums())
+	var mismatch *ErrChecksumMismatch
+	if !errors.As(err, &mismatch) || mismatch.Filename != "2.sql" {
+		t.Fatalf("expected 2.sql mismatched, got %v", err)
+	}
+	fsys["2.sql"] = mapFile("INSERT INTO a VALUES (1, 'one');")
+
+	// A file recorded without normalizing and then reformatted is
+	// mismatched until its checksum is rehashed normalized
+	fsys["3.sql"] = mapFile("SELECT 3;")
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	fsys["3.sql"] = mapFile("SELECT\n\t3; -- three\n")
+	_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithNormalizedChecksums())
+	if !errors.As(err, &mismatch) || mismatch.Filename != "3.sql" {
+		t.Fatalf("expected 3.sql mismatched, got %v", err)
+	}
+	n, err := RehashChecksumsFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys,
+		WithNormalizedChecksums())
+	check(t, err)
+	if n != 1 || db.migrations[2].ChecksumAlgo != "sha256+normalized" {
+		t.Fatalf("expected 3.sql rehashed, got %d %+v", n, db.migrations[2])
+	}
+	_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+}
+
+func TestLineEndings(t *testing.T) {
+	const (
+		crlf  = "CREATE TABLE a (\r\n  id INT\r\n);\r\n"
+		mixed = "SELECT 1;\r\nSELECT 2;\nSELECT 3;\r\n"
+	)
+	db := newFakeStore()
+	fsys := fstest.MapFS{
+		"1.sql": mapFile(crlf),
+		"2.sql": mapFile(utf8BOM + "SELECT 'bom';\n"),
+		"3.sql": mapFile(mixed),
+	}
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+
+	// Files run and are recorded without CRLF endings or a byte order
+	// mark, so converting them is no change
+	for _, stmt := range []string{"CREATE TABLE a (\n  id INT\n)",
+		"SELECT 'bom'", "SELECT 1", "SELECT 2", "SELECT 3"} {
+		if db.execs[stmt] != 1 {
+			t.Fatalf("expected %q run, got %v", stmt, db.execs)
+		}
+	}
+	if got := db.migrations[1].Content; got != "SELECT 'bom';\n" {
+		t.Fatalf("expected the byte order mark left out, got %q", got)
+	}
+	fsys["1.sql"] = mapFile(strings.ReplaceAll(crlf, "\r\n", "\n"))
+	fsys["2.sql"] = mapFile("SELECT 'bom';\r\n")
+	fsys["3.sql"] = mapFile("SELECT 1;\r\nSELECT 2;\r\nSELECT 3;\r\n")
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	if len(m.Pending()) != 0 {
+		t.Fatalf("expected nothing pending, got %v", m.Pending())
+	}
+
+	// Migrations recorded with CRLF endings by earlier versions still
+	// match, whether the file still has them or not, until rehashed
+	db = newFakeStore()
+	db.migrations = []Migration{{
+		Filename:     "1.sql",
+		Content:      crlf,
+		Checksum:     fmt.Sprintf("%x", md5.Sum([]byte(crlf))),
+		ChecksumAlgo: ChecksumMD5,
+		Status:       StatusApplied,
+	}}
+	for _, content := range []string{crlf,
+		strings.ReplaceAll(crlf, "\r\n", "\n")} {
+		fsys = fstest.MapFS{"1.sql": mapFile(content)}
+		var logs strings.Builder
+		_, err = NewFS(ctx, db, recordLogger{testLogger{t}, &logs},
+			DBTypeMySQL, fsys, "", WithChecksumAlgo(ChecksumMD5))
+		check(t, err)
+		if !strings.Contains(logs.String(), "run migrate -rehash") {
+			t.Fatalf("expected a suggestion to rehash, got %q", logs.String())
+		}
+		report, err := StatusFS(ctx, db, DBTypeMySQL, fsys)
+		check(t, err)
+		if !report.UpToDate() {
+			t.Fatalf("expected up to date, got %s", report)
+		}
+	}
+	fsys["1.sql"] = mapFile("CREATE TABLE b (\n  id INT\n);\n")
+	_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	var mismatch *ErrChecksumMismatch
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected a mismatch, got %v", err)
+	}
+	fsys["1.sql"] = mapFile(crlf)
+	n, err := RehashChecksumsFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys,
+		WithChecksumAlgo(ChecksumMD5))
+	check(t, err)
+	want := fmt.Sprintf("%x", md5.Sum([]byte("CREATE TABLE a (\n  id INT\n)")))
+	if got := db.migrations[0]; n != 1 || got.Checksum != want ||
+		strings.Contains(got.Content, "\r") {
+		t.Fatalf("expected 1.sql rehashed, got %d %+v", n, got)
+	}
+	var logs strings.Builder
+	_, err = NewFS(ctx, db, recordLogger{testLogger{t}, &logs}, DBTypeMySQL,
+		fsys, "")
+	check(t, err)
+	if strings.Contains(logs.String(), "rehash") {
+		t.Fatalf("expected no suggestion to rehash, got %q", logs.String())
+	}
+}
+
+func TestVerify(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1.sql": mapFile("SELECT 1;"),
+		"2.sql": mapFile("SELECT 2;"),
+		"3.sql": mapFile("SELECT 3;\nSELECT 'boom';"),
+	}
+	db := newFakeStore()
+	report, err := VerifyFS(ctx, db, DBTypeMySQL, fsys)
+	check(t, err)
+	want := []string{"1.sql", "2.sql", "3.sql"}
+	if !report.OK || !reflect.DeepEqual(report.MissingInDB, want) {
+		t.Fatalf("expected %v pending, got %+v", want, report)
+	}
+
+	db.failures["SELECT 'boom'"] = 100
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	if _, err = m.Migrate(ctx); err == nil {
+		t.Fatal("expected 3.sql to fail")
+	}
+	stored := db.migrations[0].Checksum
+	fsys["1.sql"] = mapFile("SELECT 1 + 0;")
+	delete(fsys, "2.sql")
+	fsys["4.sql"] = mapFile("SELECT 4;")
+
+	execs := len(db.execs)
+	rows := fmt.Sprintf("%+v", db.migrations)
+	report, err = VerifyFS(ctx, db, DBTypeMySQL, fsys)
+	check(t, err)
+	if len(db.execs) != execs || fmt.Sprintf("%+v", db.migrations) != rows {
+		t.Fatal("expected verifying to write nothing")
+	}
+	computed := fmt.Sprintf("%x", sha256.Sum256([]byte("SELECT 1 + 0")))
+	wantReport := &VerifyReport{
+		Matched: []string{},
+		Modified: []ModifiedFile{{Filename: "1.sql", Algo: ChecksumSHA256,
+			Stored: stored, Computed: computed}},
+		MissingOnDisk: []string{"2.sql"},
+		MissingInDB:   []string{"3.sql", "4.sql"},
+		PartiallyApplied: []PartialMigration{{Filename: "3.sql",
+			Status: StatusFailed, Checkpoints: 1}},
+	}
+	if !reflect.DeepEqual(report, wantReport) {
+		t.Fatalf("expected %+v, got %+v", wantReport, report)
+	}
+
+	// Only modified or partially applied migrations fail the check
+	fsys["1.sql"] = mapFile("SELECT 1;")
+	report, err = VerifyFS(ctx, db, DBTypeMySQL, fsys)
+	check(t, err)
+	if report.OK || len(report.Modified) != 0 {
+		t.Fatalf("expected only 3.sql to fail the check, got %+v", report)
+	}
+	db.checkpoints = map[string][]string{}
+	report, err = VerifyFS(ctx, db, DBTypeMySQL, fsys)
+	check(t, err)
+	if !report.OK || !reflect.DeepEqual(report.Matched, []string{"1.sql"}) {
+		t.Fatalf("expected ok, got %+v", report)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm\n"
+	b := "a\nb\nc\nd\nE\nf\ng\nh\ni\nj\nk\nl\nm\nn"
+	diff, ok := unifiedDiff("old", "new", []byte(a), []byte(b))
+	want := `--- old
++++ new
+@@ -2,7 +2,7 @@
+ b
+ c
+ d
+-e
++E
+ f
+ g
+ h
+@@ -11,3 +11,4 @@
+ k
+ l
+ m
++n
+\ No newline at end of file
+`
+	if !ok || diff != want {
+		t.Fatalf("expected\n%s\ngot\n%s", want, diff)
+	}
+	if diff, _ = unifiedDiff("old", "new", []byte(a), []byte(a)); diff != "" {
+		t.Fatalf("expected no diff, got\n%s", diff)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1.sql": mapFile("CREATE TABLE users (id INT); -- add users\n"),
+		"2.sql": mapFile("SELECT 2;\n"),
+	}
+	db := newFakeStore()
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+
+	// Fixing a comment and reindenting are repaired without force
+	fsys["1.sql"] = mapFile("CREATE TABLE users (\n\tid INT\n); -- Add users.\n")
+	log := &recordLogger{testLogger: testLogger{t}, buf: &strings.Builder{}}
+	n, err := RepairFS(ctx, db, log, DBTypeMySQL, fsys, nil)
+	check(t, err)
+	if n != 1 {
+		t.Fatalf("expected 1 repaired, got %d", n)
+	}
+	if !strings.Contains(log.buf.String(), "--- 1.sql (recorded)\n+++ 1.sql\n") ||
+		!strings.Contains(log.buf.String(), "+); -- Add users.\n") {
+		t.Fatalf("expected a diff, got %q", log.buf.String())
+	}
+	mg := db.migrations[0]
+	if mg.Content != string(fsys["1.sql"].Data) ||
+		mg.Checksum != fmt.Sprintf("%x", sha256.Sum256(trimTail(fsys["1.sql"].Data))) {
+		t.Fatalf("expected 1.sql recorded again, got %+v", mg)
+	}
+	last := db.history[len(db.history)-1]
+	if last.Filename != "1.sql" || last.Statement != StatementRepair ||
+		!last.Success {
+		t.Fatalf("expected the repair in history, got %+v", last)
+	}
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+
+	// Changing a statement is refused without force, leaving both
+	// files as they were recorded
+	fsys["1.sql"] = mapFile("CREATE TABLE users (id BIGINT); -- Add users.\n")
+	fsys["2.sql"] = mapFile("SELECT\n  2;\n")
+	rows := fmt.Sprintf("%+v", db.migrations)
+	_, err = RepairFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, nil)
+	var unsafe *ErrRepairUnsafe
+	if !errors.As(err, &unsafe) || unsafe.Filename != "1.sql" {
+		t.Fatalf("expected 1.sql refused, got %v", err)
+	}
+	if fmt.Sprintf("%+v", db.migrations) != rows {
+		t.Fatal("expected nothing recorded")
+	}
+
+	// Only the files named are repaired
+	n, err = RepairFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys,
+		[]string{"2.sql"})
+	check(t, err)
+	if n != 1 || db.migrations[0].Content == string(fsys["1.sql"].Data) {
+		t.Fatalf("expected only 2.sql repaired, got %d", n)
+	}
+	_, err = RepairFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys,
+		[]string{"3.sql"})
+	if err == nil {
+		t.Fatal("expected 3.sql refused as not applied")
+	}
+
+	n, err = RepairFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, nil,
+		WithForceRepair())
+	check(t, err)
+	if n != 1 || db.migrations[0].Content != string(fsys["1.sql"].Data) {
+		t.Fatalf("expected 1.sql forced, got %d", n)
+	}
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+}
+
+func TestRerun(t *testing.T) {
+	view := "CREATE OR REPLACE VIEW v AS SELECT 1"
+	fsys := fstest.MapFS{
+		"1.sql": mapFile("CREATE TABLE t (id INT);"),
+		"2.sql": mapFile("-- migrate:rerun-always\n" + view + ";"),
+	}
+	db := newFakeStore()
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+
+	// A rerun-always file which hasn't changed is skipped
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	migrated, err := m.Migrate(ctx)
+	check(t, err)
+	if migrated || db.execs[view] != 1 {
+		t.Fatalf("expected 2.sql skipped, ran it %d times", db.execs[view])
+	}
+
+	// One which changed runs again, rather than being mismatched
+	view2 := "CREATE OR REPLACE VIEW v AS SELECT 1, 2"
+	fsys["2.sql"] = mapFile("-- migrate:rerun-always\n" + view2 + ";")
+	log := &recordLogger{testLogger: testLogger{t}, buf: &strings.Builder{}}
+	m, err = NewFS(ctx, db, log, DBTypeMySQL, fsys, "")
+	check(t, err)
+	if got := m.Pending(); !reflect.DeepEqual(got, []string{"2.sql"}) {
+		t.Fatalf("expected 2.sql pending, got %v", got)
+	}
+	migrated, err = m.Migrate(ctx)
+	check(t, err)
+	if !migrated || db.execs[view2] != 1 {
+		t.Fatalf("expected 2.sql run again, ran it %d times",
+			db.execs[view2])
+	}
+	if !strings.Contains(log.buf.String(), "re-running 2.sql, which is rerun-always") ||
+		!strings.Contains(log.buf.String(), "re-ran 2.sql") {
+		t.Fatalf("expected the rerun logged, got %q", log.buf.String())
+	}
+	if mg := db.migrations[1]; mg.Content != string(fsys["2.sql"].Data) {
+		t.Fatalf("expected 2.sql recorded again, got %+v", mg)
+	}
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	if migrated, err = m.Migrate(ctx); err != nil || migrated {
+		t.Fatalf("expected nothing to run, got %t, %v", migrated, err)
+	}
+
+	// Other files are still mismatched, unless rerun
+	fsys["1.sql"] = mapFile("CREATE TABLE t (id BIGINT);")
+	_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	var mismatch *ErrChecksumMismatch
+	if !errors.As(err, &mismatch) || mismatch.Filename != "1.sql" {
+		t.Fatalf("expected 1.sql mismatched, got %v", err)
+	}
+	err = RerunFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "1.sql")
+	check(t, err)
+	if db.execs["CREATE TABLE t (id BIGINT)"] != 1 {
+		t.Fatal("expected 1.sql run again")
+	}
+	err = RerunFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "1.sql")
+	check(t, err)
+	if db.execs["CREATE TABLE t (id BIGINT)"] != 2 || db.execs[view2] != 1 {
+		t.Fatal("expected only 1.sql run again, unchanged")
+	}
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	if got := m.Pending(); len(got) != 0 {
+		t.Fatalf("expected nothing pending, got %v", got)
+	}
+	err = RerunFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "3.sql")
+	if err == nil {
+		t.Fatal("expected 3.sql refused as not applied")
+	}
+}
+
+func TestChecksumMismatchDiff(t *testing.T) {
+	tcs := []struct {
+		name     string
+		from, to string
+		opts     []Option
+		wantDiff string
+	}{
+		{
+			name: "added lines",
+			from: "SELECT 1;\nSELECT 3;\n",
+			to:   "SELECT 1;\nSELECT 2;\nSELECT 3;\n",
+			wantDiff: `--- 1.sql (recorded)
++++ 1.sql
+@@ -1,2 +1,3 @@
+ SELECT 1;
++SELECT 2;
+ SELECT 3;
+`,
+		},
+		{
+			name: "removed lines",
+			from: "SELECT 1;\nSELECT 2;\nSELECT 3;\n",
+			to:   "SELECT 1;\nSELECT 3;\n",
+			wantDiff: `--- 1.sql (recorded)
++++ 1.sql
+@@ -1,3 +1,2 @@
+ SELECT 1;
+-SELECT 2;
+ SELECT 3;
+`,
+		},
+		{
+			name: "whitespace",
+			from: "SELECT 1;\n",
+			to:   "SELECT  1;\n",
+			wantDiff: `--- 1.sql (recorded)
++++ 1.sql
+@@ -1 +1 @@
+-SELECT 1;
++SELECT  1;
+`,
+		},
+		{
+			name: "truncated",
+			from: "SELECT 1;\n",
+			to:   "SELECT 2;\n",
+			opts: []Option{WithDiffLines(3)},
+			wantDiff: `--- 1.sql (recorded)
++++ 1.sql
+@@ -1 +1 @@
+... 2 more lines
+`,
+		},
+		{
+			name: "no diff",
+			from: "SELECT 1;\n",
+			to:   "SELECT 2;\n",
+			opts: []Option{WithDiffLines(0)},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			fsys := fstest.MapFS{"1.sql": {Data: []byte(tc.from)}}
+			db := newFakeStore()
+			m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+			check(t, err)
+			_, err = m.Migrate(ctx)
+			check(t, err)
+			fsys["1.sql"] = &fstest.MapFile{Data: []byte(tc.to)}
+			_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+				tc.opts...)
+			var mismatch *ErrChecksumMismatch
+			if !errors.As(err, &mismatch) {
+				t.Fatalf("expected a mismatch, got %v", err)
+			}
+			if mismatch.Diff() != tc.wantDiff {
+				t.Fatalf("expected diff\n%s\ngot\n%s", tc.wantDiff,
+					mismatch.Diff())
+			}
+		})
+	}
+
+	// Files too large to diff report their first difference
+	var a, b strings.Builder
+	for i := 0; i < 3000; i++ {
+		fmt.Fprintf(&a, "SELECT %d;\n", i)
+		if i == 5 || i == 2999 {
+			fmt.Fprintf(&b, "SELECT -%d;\n", i)
+			continue
+		}
+		fmt.Fprintf(&b, "SELECT %d;\n", i)
+	}
+	diff := changeDiff("1.sql", []byte(a.String()), []byte(b.String()))
+	want := `--- 1.sql (recorded)
++++ 1.sql
+@@ first difference at line 6, too large to diff in full @@
+ SELECT 2;
+ SELECT 3;
+ SELECT 4;
+-SELECT 5;
+-SELECT 6;
+-SELECT 7;
+-SELECT 8;
++SELECT -5;
++SELECT 6;
++SELECT 7;
++SELECT 8;
+`
+	if diff != want {
+		t.Fatalf("expected\n%s\ngot\n%s", want, diff)
+	}
+}
+
+func TestResumeEditedFile(t *testing.T) {
+	const content = "SELECT 1;\nSELECT 2;\nSELECT 'boom';\nSELECT 4;"
+	tcs := []struct {
+		name     string
+		edited   string
+		wantStmt int
+		wantDiff string
+	}{
+		{
+			name:     "edit before the checkpoints",
+			edited:   "SELECT 1;\nSELECT 22;\nSELECT 'boom';\nSELECT 4;",
+			wantStmt: 1,
+			wantDiff: "-SELECT 2\n+SELECT 22\n",
+		},
+		{
+			name:     "edit after the checkpoints",
+			edited:   "SELECT 1;\nSELECT 2;\nSELECT 'fixed';\nSELECT 4;",
+			wantStmt: -1,
+		},
+		{
+			name:     "inserted statement",
+			edited:   "SELECT 0;\n" + content,
+			wantStmt: 0,
+			wantDiff: "-SELECT 1\n+SELECT 0\n",
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			fsys := fstest.MapFS{"1.sql": {Data: []byte(content)}}
+			db := newFakeStore()
+			db.failures["SELECT 'boom'"] = 100
+			m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+			check(t, err)
+			if _, err = m.Migrate(ctx); err == nil {
+				t.Fatal("expected 1.sql to fail")
+			}
+
+			fsys["1.sql"] = &fstest.MapFile{Data: []byte(tc.edited)}
+			m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+				WithResume())
+			check(t, err)
+			_, err = m.Migrate(ctx)
+			if tc.wantStmt < 0 {
+				check(t, err)
+				if db.execs["SELECT 1"] != 1 || db.execs["SELECT 4"] != 1 {
+					t.Fatalf("expected 1.sql resumed, ran %v", db.execs)
+				}
+				return
+			}
+			var mismatch *ErrChecksumMismatch
+			if !errors.As(err, &mismatch) ||
+				mismatch.Statement != tc.wantStmt ||
+				mismatch.Line != tc.wantStmt+1 {
+				t.Fatalf("expected cmd %d mismatched, got %v",
+					tc.wantStmt, err)
+			}
+			want := fmt.Sprintf("1.sql statement %d (line %d)",
+				tc.wantStmt+1, tc.wantStmt+1)
+			if !strings.Contains(err.Error(), want) ||
+				!strings.Contains(mismatch.Diff(), "--- "+want) ||
+				!strings.Contains(mismatch.Diff(), tc.wantDiff) {
+				t.Fatalf("expected the file, cmd and both versions, got %v\n%s",
+					err, mismatch.Diff())
+			}
+
+			// Clearing the checkpoints runs the file from the start
+			check(t, ClearCheckpoints(ctx, db, "1.sql"))
+			m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+				WithResume())
+			check(t, err)
+			if _, err = m.Migrate(ctx); err == nil {
+				t.Fatal("expected 1.sql to fail again")
+			}
+			if db.execs["SELECT 1"] != 2 {
+				t.Fatalf("expected 1.sql run from the start, ran %v",
+					db.execs)
+			}
+			db.checkpoints = map[string][]string{}
+			if err = ClearCheckpoints(ctx, db, "1.sql"); err == nil {
+				t.Fatal("expected no checkpoints to clear")
+			}
+		})
+	}
+}
+
+func TestModifiedPolicy(t *testing.T) {
+	setup := func(t *testing.T) (*fakeStore, fstest.MapFS) {
+		fsys := fstest.MapFS{
+			"1.sql": {Data: []byte("SELECT 1;")},
+			"2.sql": {Data: []byte("SELECT 2;")},
+		}
+		db := newFakeStore()
+		m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+		check(t, err)
+		_, err = m.Migrate(ctx)
+		check(t, err)
+		fsys["1.sql"] = &fstest.MapFile{Data: []byte("SELECT 1 + 0;")}
+		fsys["3.sql"] = &fstest.MapFile{Data: []byte("SELECT 3;")}
+		return db, fsys
+	}
+	modified := []ModifiedFile{{
+		Filename: "1.sql",
+		Algo:     ChecksumSHA256,
+		Stored:   fmt.Sprintf("%x", sha256.Sum256([]byte("SELECT 1"))),
+		Computed: fmt.Sprintf("%x", sha256.Sum256([]byte("SELECT 1 + 0"))),
+	}}
+
+	t.Run("error", func(t *testing.T) {
+		db, fsys := setup(t)
+		_, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+			WithModifiedPolicy(ModifiedError))
+		var mismatch *ErrChecksumMismatch
+		if !errors.As(err, &mismatch) || mismatch.Filename != "1.sql" {
+			t.Fatalf("expected 1.sql mismatched, got %v", err)
+		}
+	})
+
+	t.Run("warn", func(t *testing.T) {
+		db, fsys := setup(t)
+		m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+			WithModifiedPolicy(ModifiedWarn))
+		check(t, err)
+		want := []ModifiedFile{modified[0]}
+		want[0].Policy = "warn"
+		if !reflect.DeepEqual(m.Modified, want) {
+			t.Fatalf("expected %+v, got %+v", want, m.Modified)
+		}
+		_, err = m.Migrate(ctx)
+		check(t, err)
+		if db.execs["SELECT 1 + 0"] != 0 || db.execs["SELECT 3"] != 1 {
+			t.Fatalf("expected only 3.sql to run, ran %v", db.execs)
+		}
+		if db.migrations[0].Checksum != modified[0].Stored {
+			t.Fatal("expected 1.sql left as it was recorded")
+		}
+	})
+
+	t.Run("update checksum", func(t *testing.T) {
+		db, fsys := setup(t)
+		_, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+			WithModifiedPolicy(ModifiedUpdateChecksum), WithProduction())
+		if err == nil {
+			t.Fatal("expected updating checksums refused in production")
+		}
+		m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+			WithModifiedPolicy(ModifiedUpdateChecksum))
+		check(t, err)
+		if len(m.Modified) != 1 || m.Modified[0].Policy != "update-checksum" {
+			t.Fatalf("expected 1.sql listed, got %+v", m.Modified)
+		}
+		_, err = m.Migrate(ctx)
+		check(t, err)
+		if db.execs["SELECT 1 + 0"] != 0 || db.execs["SELECT 3"] != 1 {
+			t.Fatalf("expected only 3.sql to run, ran %v", db.execs)
+		}
+		mg := db.migrations[0]
+		if mg.Checksum != modified[0].Computed ||
+			mg.Content != "SELECT 1 + 0;" {
+			t.Fatalf("expected 1.sql recorded again, got %+v", mg)
+		}
+		var repaired bool
+		for _, h := range db.history {
+			repaired = repaired || h.Filename == "1.sql" &&
+				h.Statement == StatementRepair
+		}
+		if !repaired {
+			t.Fatalf("expected the update in history, got %+v", db.history)
+		}
+		_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+		check(t, err)
+	})
+}
+
+func TestTrimTail(t *testing.T) {
+	tcs := []struct{ in, want string }{
+		{"SELECT 1;", "SELECT 1"},
+		{"SELECT 1;\n\n", "SELECT 1"},
+		{"SELECT 1; -- end\n", "SELECT 1"},
+		{"SELECT 1;\n/* done */\n-- end", "SELECT 1"},
+		{"-- users\nSELECT 1 -- one\n;", "-- users\nSELECT 1"},
+		{"SELECT ';'", "SELECT ';'"},
+		{"SELECT $$;$$;\n", "SELECT $$;$$"},
+		{"-- nothing", ""},
+		{"SELECT 1;\n/*!40101 SET NAMES utf8 */;\n/* end */", "SELECT 1;\n/*!40101 SET NAMES utf8 */"},
+	}
+	for _, tc := range tcs {
+		if got := string(trimTail([]byte(tc.in))); got != tc.want {
+			t.Errorf("%q: expected %q, got %q", tc.in, tc.want, got)
+		}
+	}
+}
+
+func TestTrailingChanges(t *testing.T) {
+	db := newFakeStore()
+	fsys := fstest.MapFS{"1.sql": mapFile("CREATE TABLE a (id INT);")}
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+
+	// A final newline or comment leaves the migration matching, and
+	// the content recorded as it was
+	for _, content := range []string{
+		"CREATE TABLE a (id INT);\n",
+		"CREATE TABLE a (id INT);\n\n-- end\n",
+		"CREATE TABLE a (id INT)\n/* done */",
+	} {
+		fsys["1.sql"] = mapFile(content)
+		m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+		check(t, err)
+		if len(m.Pending()) != 0 {
+			t.Fatalf("%q: expected nothing pending, got %v", content,
+				m.Pending())
+		}
+	}
+	if got := db.migrations[0].Content; got != "CREATE TABLE a (id INT);" {
+		t.Fatalf("expected the content recorded raw, got %q", got)
+	}
+
+	// More SQL after the comment is still a change
+	fsys["1.sql"] = mapFile("CREATE TABLE a (id INT);\n-- end\nDROP TABLE a;\n")
+	_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	var mismatch *ErrChecksumMismatch
+	if !errors.As(err, &mismatch) || mismatch.Filename != "1.sql" {
+		t.Fatalf("expected 1.sql mismatched, got %v", err)
+	}
+
+	// Migrations recorded by the checksum of the whole file still
+	// match, with or without a new tail, and aren't suggested a rehash
+	db = newFakeStore()
+	recorded := "SELECT 1;\n"
+	db.migrations = []Migration{{
+		Filename:     "1.sql",
+		Content:      recorded,
+		Checksum:     fmt.Sprintf("%x", sha256.Sum256([]byte(recorded))),
+		ChecksumAlgo: ChecksumSHA256,
+		Status:       StatusApplied,
+	}}
+	for _, content := range []string{recorded, "SELECT 1; -- end\n"} {
+		fsys = fstest.MapFS{"1.sql": mapFile(content)}
+		log := &recordLogger{testLogger: testLogger{t}, buf: &strings.Builder{}}
+		m, err = NewFS(ctx, db, log, DBTypeMySQL, fsys, "")
+		check(t, err)
+		if len(m.Pending()) != 0 {
+			t.Fatalf("%q: expected nothing pending, got %v", content,
+				m.Pending())
+		}
+		if strings.Contains(log.buf.String(), "rehash") {
+			t.Fatalf("%q: expected no rehash suggested, got %q", content,
+				log.buf.String())
+		}
+	}
+	fsys["1.sql"] = mapFile("SELECT 1;\nSELECT 2;\n")
+	_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected a mismatch, got %v", err)
+	}
+}
+
+// checkSplitGolden checks the statements splitStatements finds in each file
+// in testdata/dir against its golden file, which -update rewrites.
+func checkSplitGolden(t *testing.T, dir string) {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join("testdata", dir, "*.sql"))
+	check(t, err)
+	if len(paths) == 0 {
+		t.Fatal("expected golden files")
+	}
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			byt, err := os.ReadFile(path)
+			check(t, err)
+			stmts, err := splitStatements(byt)
+			check(t, err)
+			var b strings.Builder
+			for _, s := range stmts {
+				fmt.Fprintf(&b, "-- line %d\n%s\n\n", s.Line, s.SQL)
+			}
+			golden := strings.TrimSuffix(path, ".sql") + ".golden"
+			if *update {
+				check(t, os.WriteFile(golden, []byte(b.String()), 0o644))
+			}
+			want, err := os.ReadFile(golden)
+			check(t, err)
+			if got := b.String(); got != string(want) {
+				t.Fatalf("expected\n%s\ngot\n%s", want, got)
+			}
+		})
+	}
+}
+
+// checkCheckpointedWhole migrates the file at path, failing its last
+// statement, and checks each statement before it ran once and was
+// checkpointed as one.
+func checkCheckpointedWhole(t *testing.T, path string) {
+	t.Helper()
+	byt, err := os.ReadFile(path)
+	check(t, err)
+	stmts, err := splitStatements(byt)
+	check(t, err)
+	db := newFakeStore()
+	db.failures[stmts[len(stmts)-1].SQL] = 100
+	fsys := fstest.MapFS{"1.sql": &fstest.MapFile{Data: byt}}
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	if _, err = m.Migrate(ctx); err == nil {
+		t.Fatal("expected the last statement to fail")
+	}
+	if n := len(db.checkpoints["1.sql"]); n != len(stmts)-1 {
+		t.Fatalf("expected %d checkpoints, got %d", len(stmts)-1, n)
+	}
+	for _, s := range stmts[:len(stmts)-1] {
+		if db.execs[s.SQL] != 1 {
+			t.Fatalf("expected %q run once, got %v", s.SQL, db.execs)
+		}
+	}
+}
+
+func TestSplitStatementsDelimiter(t *testing.T) {
+	checkSplitGolden(t, "delimiter")
+
+	// Each statement under a delimiter is checkpointed as one
+	checkCheckpointedWhole(t, filepath.Join("testdata", "delimiter", "switch.sql"))
+}
+
+func TestSplitStatements(t *testing.T) {
+	tcs := []struct {
+		name string
+		in   string
+		want []string
+	}{
+		{"empty", "", nil},
+		{"only semicolons", ";;\n;", nil},
+		{"no final semicolon", "SELECT 1;\nSELECT 2", []string{"SELECT 1", "SELECT 2"}},
+		{"semicolon in string", "INSERT INTO notes (body) VALUES ('step 1; step 2');",
+			[]string{"INSERT INTO notes (body) VALUES ('step 1; step 2')"}},
+		{"doubled quote", "SELECT 'it''s; fine'; SELECT 2",
+			[]string{"SELECT 'it''s; fine'", "SELECT 2"}},
+		{"backslash escape", `SELECT 'it\'s; fine'; SELECT 2`,
+			[]string{`SELECT 'it\'s; fine'`, "SELECT 2"}},
+		{"escaped backslash", `SELECT 'a\\'; SELECT 2`,
+			[]string{`SELECT 'a\\'`, "SELECT 2"}},
+		{"double quotes", `SELECT "a;b", "c"";d"; SELECT 2`,
+			[]string{`SELECT "a;b", "c"";d"`, "SELECT 2"}},
+		{"backticks", "SELECT `a;b` FROM `t``;`; SELECT 2",
+			[]string{"SELECT `a;b` FROM `t``;`", "SELECT 2"}},
+		{"line comment", "SELECT 1 -- TODO; fix later\n; SELECT 2",
+			[]string{"SELECT 1 -- TODO; fix later", "SELECT 2"}},
+		{"leading line comment", "-- TODO; fix later\nSELECT 1;",
+			[]string{"SELECT 1"}},
+		{"block comment", "SELECT /* a; b */ 1; /* c;\nd */ SELECT 2;",
+			[]string{"SELECT /* a; b */ 1", "/* c;\nd */ SELECT 2"}},
+		{"hash comment", "# TODO; fix later\nSELECT 1; # one; two\nSELECT 2;",
+			[]string{"SELECT 1", "SELECT 2"}},
+		{"indented hash comment", "SELECT 1;\n  # a; b\nSELECT 2;",
+			[]string{"SELECT 1", "SELECT 2"}},
+		{"hash operator", "SELECT data #> '{a}' FROM t; SELECT 5 # 3;",
+			[]string{"SELECT data #> '{a}' FROM t", "SELECT 5 # 3"}},
+		{"only comments", "-- a;\n/* b; */\n# c;\n", nil},
+		{"dollar quote", "CREATE FUNCTION f() RETURNS int AS $$ BEGIN RETURN 1; END $$ LANGUAGE plpgsql;",
+			[]string{"CREATE FUNCTION f() RETURNS int AS $$ BEGIN RETURN 1; END $$ LANGUAGE plpgsql"}},
+		{"tagged dollar quote", "SELECT $a$ $$; $a$; SELECT 2",
+			[]string{"SELECT $a$ $$; $a$", "SELECT 2"}},
+		{"parameter", "SELECT $1; SELECT $2",
+			[]string{"SELECT $1", "SELECT $2"}},
+		{"quote in comment", "-- it's\nSELECT 1; SELECT 2",
+			[]string{"SELECT 1", "SELECT 2"}},
+		{"comment in quote", "SELECT '-- a; /* b'; SELECT 2",
+			[]string{"SELECT '-- a; /* b'", "SELECT 2"}},
+		{"nested comment opener", "SELECT /* /* */ 1; SELECT 2",
+			[]string{"SELECT /* /* */ 1", "SELECT 2"}},
+		{"unterminated quote", "SELECT 'a; SELECT 2", []string{"SELECT 'a; SELECT 2"}},
+		{"unterminated comment", "SELECT 1; /* a; SELECT 2", []string{"SELECT 1"}},
+		{"unterminated dollar quote", "SELECT $$ a; b",
+			[]string{"SELECT $$ a; b"}},
+		{"trailing backslash", `SELECT 'a\`, []string{`SELECT 'a\`}},
+		{"quotes back to back", `SELECT 'a''b'"c;"';';`,
+			[]string{`SELECT 'a''b'"c;"';'`}},
+		{"crlf", "SELECT 1;\r\n-- a; b\r\nSELECT 2;\r\n",
+			[]string{"SELECT 1", "SELECT 2"}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			cmds, err := Statements([]byte(tc.in))
+			check(t, err)
+			if len(cmds) == 0 && len(tc.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(cmds, tc.want) {
+				t.Fatalf("expected %q, got %q", tc.want, cmds)
+			}
+		})
+	}
+
+	// Line numbers count from the statement, after any comments before it
+	stmts, err := splitStatements([]byte("SELECT 1; -- one;\n" +
+		"# two;\n\nSELECT 'a;\nb';\n/* three;\n */ SELECT 3"))
+	check(t, err)
+	var lines []int
+	for _, s := range stmts {
+		lines = append(lines, s.Line)
+	}
+	if want := []int{1, 4, 6}; !reflect.DeepEqual(lines, want) {
+		t.Fatalf("expected lines %v, got %v", want, lines)
+	}
+}
+
+func FuzzSplitSQL(f *testing.F) {
+	for _, s := range []string{
+		"SELECT 1; SELECT 2",
+		"INSERT INTO notes (body) VALUES ('step 1; step 2');",
+		"SELECT 1 -- TODO; fix later\n;",
+		"# a; b\nSELECT `c;d`, \"e;f\" /* g; h */;",
+		`SELECT 'it\'s; ''fine''';`,
+		"SELECT $a$ ; $a$ #> 1;",
+		"DELIMITER //\nCREATE TRIGGER t BEGIN SELECT 1; END //\nDELIMITER ;\nSELECT 2;",
+		"'unterminated; /* ; --",
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		parts := splitSQL(src, quoting{})
+		end := 0
+		for _, p := range parts {
+			if p.off < end || p.off+len(p.s) > len(src) ||
+				src[p.off:p.off+len(p.s)] != p.s {
+				t.Fatalf("%q: part %+v out of place", src, p)
+			}
+			end = p.off + len(p.s)
+		}
+		if end != len(src) {
+			t.Fatalf("%q: parts end at %d", src, end)
+		}
+
+		// Without DELIMITER lines the parts are separated by exactly
+		// the semicolons split at
+		var joined []string
+		for _, p := range parts {
+			joined = append(joined, p.s)
+		}
+		if !strings.Contains(strings.ToLower(src), "delimiter") &&
+			strings.Join(joined, ";") != src {
+			t.Fatalf("%q: rejoined as %q", src, strings.Join(joined, ";"))
+		}
+
+		stmts, err := splitStatements([]byte(src))
+		if err != nil {
+			return
+		}
+		for _, s := range stmts {
+			if !strings.Contains(src, s.SQL) {
+				t.Fatalf("%q: statement %q isn't in it", src, s.SQL)
+			}
+		}
+	})
+}
+
+func TestSplitStatementsBlockComments(t *testing.T) {
+	// A long header comment, semicolons and all, is kept with the
+	// statement after it
+	var header strings.Builder
+	header.WriteString("/*\n")
+	for i := 1; i <= 50; i++ {
+		fmt.Fprintf(&header, " * line %d; see DROP TABLE users;\n", i)
+	}
+	header.WriteString(" */\n")
+	stmts, err := splitStatements([]byte(header.String() +
+		"CREATE TABLE users (id INT);\nSELECT 2;"))
+	check(t, err)
+	if len(stmts) != 2 ||
+		stmts[0].SQL != header.String()+"CREATE TABLE users (id INT)" ||
+		stmts[0].Line != 1 || stmts[1].SQL != "SELECT 2" || stmts[1].Line != 54 {
+		t.Fatalf("unexpected statements %+v", stmts)
+	}
+
+	tcs := []struct {
+		name string
+		in   string
+		want []string
+	}{
+		{"conditional statement",
+			"/*!40101 SET @OLD_CHARACTER_SET_CLIENT=@@CHARACTER_SET_CLIENT */;\n" +
+				"/*!40101 SET NAMES utf8mb4; */;\nSELECT 1;",
+			[]string{"/*!40101 SET @OLD_CHARACTER_SET_CLIENT=@@CHARACTER_SET_CLIENT */",
+				"/*!40101 SET NAMES utf8mb4; */", "SELECT 1"}},
+		{"mariadb conditional", "/*M!100100 SET sql_mode = 'ANSI' */;",
+			[]string{"/*M!100100 SET sql_mode = 'ANSI' */"}},
+		{"conditional inside", "CREATE TABLE t (id INT) /*!50100 ENGINE=InnoDB; */;",
+			[]string{"CREATE TABLE t (id INT) /*!50100 ENGINE=InnoDB; */"}},
+		{"hint", "SELECT /*+ MAX_EXECUTION_TIME(1000); */ * FROM t; SELECT 2",
+			[]string{"SELECT /*+ MAX_EXECUTION_TIME(1000); */ * FROM t", "SELECT 2"}},
+		{"hint after a comment", "-- slow\n/*+ SET_VAR(sort_buffer_size = 16M) */ SELECT 1;",
+			[]string{"/*+ SET_VAR(sort_buffer_size = 16M) */ SELECT 1"}},
+		{"nested-looking", "/* /* */ SELECT 1; /* /* ; */ SELECT 2 /* */ */;",
+			[]string{"/* /* */ SELECT 1", "/* /* ; */ SELECT 2 /* */ */"}},
+		{"spanning statements", "SELECT 1 /* starts;\nSELECT 2;\nends */;\nSELECT 3;",
+			[]string{"SELECT 1 /* starts;\nSELECT 2;\nends */", "SELECT 3"}},
+		{"only plain comments", "/* a; */ /* b;\n */ -- c;\n", nil},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			cmds, err := Statements([]byte(tc.in))
+			check(t, err)
+			if len(cmds) == 0 && len(tc.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(cmds, tc.want) {
+				t.Fatalf("expected %q, got %q", tc.want, cmds)
+			}
+		})
+	}
+
+	// Changing an executable comment is more than cosmetic, unlike
+	// changing a plain one
+	if cosmeticForm([]byte("SELECT /*+ BKA(t) */ 1")) ==
+		cosmeticForm([]byte("SELECT /*+ NO_BKA(t) */ 1")) {
+		t.Fatal("expected a changed hint to be more than cosmetic")
+	}
+	if cosmeticForm([]byte("SELECT /* a */ 1")) !=
+		cosmeticForm([]byte("SELECT /* b */ 1")) {
+		t.Fatal("expected a changed comment to be cosmetic")
+	}
+}
+
+func TestSplitStatementsCompound(t *testing.T) {
+	checkSplitGolden(t, "compound")
+
+	// Each definition is checkpointed as one statement
+	for _, name := range []string{"procedure.sql", "trigger.sql"} {
+		checkCheckpointedWhole(t, filepath.Join("testdata", "compound", name))
+	}
+
+	tcs := []struct {
+		name string
+		in   string
+		want []string
+	}{
+		{"no body block", "CREATE PROCEDURE p() SELECT 1; SELECT 2",
+			[]string{"CREATE PROCEDURE p() SELECT 1", "SELECT 2"}},
+		{"empty block", "CREATE PROCEDURE p() BEGIN END; SELECT 2",
+			[]string{"CREATE PROCEDURE p() BEGIN END", "SELECT 2"}},
+		{"case expression", "CREATE FUNCTION f(x INT) RETURNS INT DETERMINISTIC\n" +
+			"BEGIN RETURN CASE x WHEN 1 THEN 2 END; END; SELECT 2",
+			[]string{"CREATE FUNCTION f(x INT) RETURNS INT DETERMINISTIC\n" +
+				"BEGIN RETURN CASE x WHEN 1 THEN 2 END; END", "SELECT 2"}},
+		{"sqlite trigger", "CREATE TEMP TRIGGER t AFTER INSERT ON a BEGIN\n" +
+			"  UPDATE b SET n = n + 1;\n  DELETE FROM c;\nEND;\nSELECT 2;",
+			[]string{"CREATE TEMP TRIGGER t AFTER INSERT ON a BEGIN\n" +
+				"  UPDATE b SET n = n + 1;\n  DELETE FROM c;\nEND", "SELECT 2"}},
+		{"words in quotes and comments", "CREATE PROCEDURE p() BEGIN\n" +
+			"  SELECT 'end'; -- end\n  # end\n  SELECT `begin`; /* BEGIN */\nEND; SELECT 2",
+			[]string{"CREATE PROCEDURE p() BEGIN\n  SELECT 'end'; -- end\n" +
+				"  # end\n  SELECT `begin`; /* BEGIN */\nEND", "SELECT 2"}},
+		{"begin outside a definition", "BEGIN; SELECT 1; COMMIT;",
+			[]string{"BEGIN", "SELECT 1", "COMMIT"}},
+		{"end label", "CREATE PROCEDURE p() lbl: BEGIN SELECT 1; END lbl; SELECT 2",
+			[]string{"CREATE PROCEDURE p() lbl: BEGIN SELECT 1; END lbl", "SELECT 2"}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			cmds, err := Statements([]byte(tc.in))
+			check(t, err)
+			if !reflect.DeepEqual(cmds, tc.want) {
+				t.Fatalf("expected %q, got %q", tc.want, cmds)
+			}
+		})
+	}
+
+	_, err := Statements([]byte("SELECT 1;\nCREATE PROCEDURE p()\nBEGIN\n  SELECT 1;"))
+	if err == nil || !strings.Contains(err.Error(), "line 2: BEGIN without a matching END") {
+		t.Fatalf("expected an unended BEGIN, got %v", err)
+	}
+}
+
+// paragraphSplitter splits files at blank lines, semicolons and all.
+type paragraphSplitter struct{ offset int }
+
+func (s paragraphSplitter) Split(content string) ([]Statement, error) {
+	var stmts []Statement
+	line := 1
+	for _, p := range strings.Split(content, "\n\n") {
+		stmts = append(stmts, Statement{SQL: strings.TrimSpace(p),
+			Line: line, Index: len(stmts) + s.offset})
+		line += strings.Count(p, "\n") + 2
+	}
+	return stmts, nil
+}
+
+// splitterStore is a store which prefers splitter.
+type splitterStore struct {
+	*fakeStore
+	splitter Splitter
+}
+
+func (s splitterStore) Splitter() Splitter { return s.splitter }
+
+func TestSplitter(t *testing.T) {
+	const content = "SELECT 1; SELECT 2\n\nSELECT 'boom'\n\nSELECT 4; SELECT 5"
+	fsys := fstest.MapFS{"1.sql": {Data: []byte(content)}}
+
+	// A failed migration split by WithSplitter resumes after the
+	// statements it checkpointed
+	db := newFakeStore()
+	db.failures["SELECT 'boom'"] = 100
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithSplitter(paragraphSplitter{}))
+	check(t, err)
+	if _, err = m.Migrate(ctx); err == nil {
+		t.Fatal("expected 1.sql to fail")
+	}
+	if n := len(db.checkpoints["1.sql"]); n != 1 {
+		t.Fatalf("expected 1 checkpoint, got %d", n)
+	}
+	if !strings.Contains(err.Error(), "line 3") {
+		t.Fatalf("expected the line of the statement, got %v", err)
+	}
+	delete(db.failures, "SELECT 'boom'")
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithSplitter(paragraphSplitter{}), WithResume())
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if db.execs["SELECT 1; SELECT 2"] != 1 || db.execs["SELECT 4; SELECT 5"] != 1 {
+		t.Fatalf("expected 1.sql resumed, ran %v", db.execs)
+	}
+
+	// The store's splitter is used unless WithSplitter overrides it
+	sdb := splitterStore{fakeStore: newFakeStore(),
+		splitter: paragraphSplitter{}}
+	m, err = NewFS(ctx, sdb, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if sdb.execs["SELECT 1; SELECT 2"] != 1 {
+		t.Fatalf("expected the store's splitter, ran %v", sdb.execs)
+	}
+	sdb = splitterStore{fakeStore: newFakeStore(),
+		splitter: paragraphSplitter{}}
+	m, err = NewFS(ctx, sdb, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithSplitter(DefaultSplitter{}))
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if sdb.execs["SELECT 1"] != 1 || sdb.execs["SELECT 5"] != 1 {
+		t.Fatalf("expected the default splitter, ran %v", sdb.execs)
+	}
+
+	// Statements must be indexed by their place in the file
+	m, err = NewFS(ctx, newFakeStore(), testLogger{t}, DBTypeMySQL, fsys, "",
+		WithSplitter(paragraphSplitter{offset: 1}))
+	check(t, err)
+	if _, err = m.Migrate(ctx); err == nil ||
+		!strings.Contains(err.Error(), "statement 0 has index 1") {
+		t.Fatalf("expected a misindexed statement, got %v", err)
+	}
+}
+
+func TestSplitOnGO(t *testing.T) {
+	tcs := []struct {
+		name  string
+		in    string
+		want  []string
+		lines []int
+	}{
+		{"no GO lines", "SELECT 1;\nSELECT 2;",
+			[]string{"SELECT 1", "SELECT 2"}, []int{1, 2}},
+		{"batches", "CREATE TABLE a (id INT);\nINSERT INTO a VALUES (1);\nGO\n" +
+			"CREATE PROCEDURE p AS\nBEGIN\n  SELECT 1;\nEND\ngo\n",
+			[]string{"CREATE TABLE a (id INT);\nINSERT INTO a VALUES (1);",
+				"CREATE PROCEDURE p AS\nBEGIN\n  SELECT 1;\nEND"}, []int{1, 4}},
+		{"spaced and commented", "SELECT 1\n  Go  -- one\n\nSELECT 2\n",
+			[]string{"SELECT 1", "SELECT 2"}, []int{1, 4}},
+		{"empty batches", "GO\n-- nothing\nGO\nSELECT 1\nGO\nGO",
+			[]string{"SELECT 1"}, []int{4}},
+		{"not a GO line", "SELECT 1 AS go\nGOTO done\nGO",
+			[]string{"SELECT 1 AS go\nGOTO done"}, []int{1}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			stmts, err := SplitOnGO{}.Split(tc.in)
+			check(t, err)
+			var sqls []string
+			var lines []int
+			for i, s := range stmts {
+				if s.Index != i {
+					t.Fatalf("expected index %d, got %+v", i, s)
+				}
+				sqls = append(sqls, s.SQL)
+				lines = append(lines, s.Line)
+			}
+			if !reflect.DeepEqual(sqls, tc.want) ||
+				!reflect.DeepEqual(lines, tc.lines) {
+				t.Fatalf("expected %q at %v, got %q at %v", tc.want,
+					tc.lines, sqls, lines)
+			}
+		})
+	}
+}
+
+// multiStore is a store whose connection allows several statements in one
+// Exec only if multi is set.
+type multiStore struct {
+	*fakeStore
+	multi bool
+}
+
+func (s multiStore) MultiStatements() bool { return s.multi }
+
+func TestNoSplit(t *testing.T) {
+	const stmt = "CREATE TABLE a (id INT);\nINSERT INTO a VALUES (1);"
+	fsys := fstest.MapFS{"1.sql": {Data: []byte(
+		"-- migrate:no-split\n\n" + stmt + "\n")}}
+
+	// The whole file runs as statement 0, whose checkpoint is written
+	// before the file fails to be recorded
+	db := newFakeStore()
+	db.dropCheckpoint = errors.New("disk full")
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	if _, err = m.Migrate(ctx); err == nil {
+		t.Fatal("expected the checkpoint error")
+	}
+	if db.execs[stmt] != 1 || len(db.checkpoints["1.sql"]) != 1 {
+		t.Fatalf("expected 1 exec and checkpoint, got %d and %d",
+			db.execs[stmt], len(db.checkpoints["1.sql"]))
+	}
+	if m.Results[0].Mode != "no-split" {
+		t.Fatalf("expected no-split mode, got %q", m.Results[0].Mode)
+	}
+
+	// Resuming finds the statement checkpointed, so doesn't run it again
+	rec := recordLogger{testLogger: testLogger{t}, buf: &strings.Builder{}}
+	m, err = NewFS(ctx, db, rec, DBTypeMySQL, fsys, "", WithResume())
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if db.execs[stmt] != 1 || db.migrations[0].Status != StatusApplied {
+		t.Fatalf("expected the file applied without running again, got %d execs",
+			db.execs[stmt])
+	}
+	if !strings.Contains(rec.buf.String(), "> -- migrate:no-split 1.sql") {
+		t.Fatalf("expected the mode logged, got %q", rec.buf.String())
+	}
+
+	// A connection without multiStatements is refused before anything
+	// runs, but a file of one statement doesn't need it
+	for _, tc := range []struct {
+		content string
+		wantErr bool
+	}{
+		{"-- migrate:no-split\n" + stmt, true},
+		{"-- migrate:multi\n" + stmt, true},
+		{"-- migrate:no-split\nCREATE TABLE a (id INT);", false},
+	} {
+		db := multiStore{fakeStore: newFakeStore()}
+		fsys := fstest.MapFS{"1.sql": {Data: []byte(tc.content)}}
+		m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+		check(t, err)
+		_, err = m.Migrate(ctx)
+		if !tc.wantErr {
+			check(t, err)
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), "multiStatements") {
+			t.Fatalf("expected a multiStatements error, got %v", err)
+		}
+		if len(db.execs) != 0 {
+			t.Fatalf("expected nothing to run, got %v", db.execs)
+		}
+
+		db.multi = true
+		m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+			WithResume())
+		check(t, err)
+		_, err = m.Migrate(ctx)
+		check(t, err)
+	}
+}
+
+// TestStatementLines migrates each file in testdata/lines, failing its
+// SELECT 'boom' before resuming it, and compares the lines reported for each
+// statement with its golden file, whichever line endings the file has.
+func TestStatementLines(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "lines", "*.sql"))
+	check(t, err)
+	if len(paths) == 0 {
+		t.Fatal("expected golden files")
+	}
+	for _, path := range paths {
+		byt, err := os.ReadFile(path)
+		check(t, err)
+		golden := strings.TrimSuffix(path, ".sql") + ".golden"
+		for _, tc := range []struct {
+			name    string
+			content []byte
+		}{
+			{"lf", byt},
+			{"crlf", bytes.ReplaceAll(byt, []byte("\n"), []byte("\r\n"))},
+		} {
+			t.Run(filepath.Base(path)+"/"+tc.name, func(t *testing.T) {
+				got := migrateLines(t, tc.content)
+				if *update && tc.name == "lf" {
+					check(t, os.WriteFile(golden, []byte(got), 0o644))
+				}
+				want, err := os.ReadFile(golden)
+				check(t, err)
+				if got != string(want) {
+					t.Fatalf("expected\n%s\ngot\n%s", want, got)
+				}
+			})
+		}
+	}
+}
+
+// migrateLines migrates content as 1.sql, failing its SELECT 'boom' then
+// resuming it, and returns the statements it logged, the one which failed,
+// and where it resumed.
+func migrateLines(t *testing.T, content []byte) string {
+	t.Helper()
+	const boom = "SELECT 'boom'"
+	fsys := fstest.MapFS{"1.sql": {Data: content}}
+	db := newFakeStore()
+	db.failures[boom] = 100
+	rec := recordLogger{testLogger: testLogger{t}, buf: &strings.Builder{}}
+	m, err := NewFS(ctx, db, rec, DBTypeMySQL, fsys, "", WithRetry(1, 0))
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	var failed *ErrStatementFailed
+	if !errors.As(err, &failed) || failed.SQL != boom {
+		t.Fatalf("expected %s to fail, got %v", boom, err)
+	}
+	fmt.Fprintf(rec.buf, "failed: %s\n",
+		statementAt(failed.Index, failed.Line))
+
+	delete(db.failures, boom)
+	m, err = NewFS(ctx, db, rec, DBTypeMySQL, fsys, "", WithResume(),
+		WithRetry(1, 0))
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+
+	var b strings.Builder
+	for _, l := range splitLines(rec.buf.String()) {
+		if strings.HasPrefix(l, "> ") || strings.HasPrefix(l, "found ") ||
+			strings.HasPrefix(l, "failed: ") {
+			b.WriteString(l)
+		}
+	}
+	return b.String()
+}
+
+func TestSplitterQuoting(t *testing.T) {
+	standard := DefaultSplitter{}
+	noEscapes := DefaultSplitter{NoBackslashEscapes: true}
+	ansi := DefaultSplitter{ANSIQuotes: true}
+	tcs := []struct {
+		name     string
+		splitter DefaultSplitter
+		content  string
+		want     []string
+	}{
+		{
+			name:     "escaped quote",
+			splitter: standard,
+			content:  `SELECT 'it\'s; here'; SELECT 2`,
+			want:     []string{`SELECT 'it\'s; here'`, "SELECT 2"},
+		},
+		{
+			name:     "escaped quote without backslash escapes",
+			splitter: noEscapes,
+			content:  `SELECT 'it\'; SELECT 's'; SELECT 2`,
+			want:     []string{`SELECT 'it\'`, "SELECT 's'", "SELECT 2"},
+		},
+		{
+			name:     "trailing backslash without backslash escapes",
+			splitter: noEscapes,
+			content:  `INSERT INTO paths VALUES ('C:\'); SELECT 2`,
+			want:     []string{`INSERT INTO paths VALUES ('C:\')`, "SELECT 2"},
+		},
+		{
+			name:     "doubled quote",
+			splitter: standard,
+			content:  "SELECT 'it''s; here'; SELECT 2",
+			want:     []string{"SELECT 'it''s; here'", "SELECT 2"},
+		},
+		{
+			name:     "doubled quote without backslash escapes",
+			splitter: noEscapes,
+			content:  "SELECT 'it''s; here'; SELECT 2",
+			want:     []string{"SELECT 'it''s; here'", "SELECT 2"},
+		},
+		{
+			name:     "double quoted string",
+			splitter: standard,
+			content:  `SELECT "double; quoted \"x\""; SELECT 2`,
+			want:     []string{`SELECT "double; quoted \"x\""`, "SELECT 2"},
+		},
+		{
+			name:     "double quoted identifier with ansi quotes",
+			splitter: ansi,
+			content:  `SELECT "double; quoted" FROM "a\"; SELECT 2`,
+			want:     []string{`SELECT "double; quoted" FROM "a\"`, "SELECT 2"},
+		},
+		{
+			name:     "backtick identifier",
+			splitter: standard,
+			content:  "CREATE TABLE `a;b\\` (id INT); SELECT 2",
+			want:     []string{"CREATE TABLE `a;b\\` (id INT)", "SELECT 2"},
+		},
+		{
+			name:     "backtick identifier with ansi quotes",
+			splitter: DefaultSplitter{NoBackslashEscapes: true, ANSIQuotes: true},
+			content:  "CREATE TABLE `a;b` (id INT); SELECT 2",
+			want:     []string{"CREATE TABLE `a;b` (id INT)", "SELECT 2"},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			stmts, err := tc.splitter.Split(tc.content)
+			check(t, err)
+			var got []string
+			for _, s := range stmts {
+				got = append(got, s.SQL)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+
+	for mode, want := range map[string]DefaultSplitter{
+		"":                                       standard,
+		"STRICT_TRANS_TABLES,ONLY_FULL_GROUP_BY": standard,
+		"no_backslash_escapes":                   noEscapes,
+		"ANSI_QUOTES":                            ansi,
+		"REAL_AS_FLOAT,PIPES_AS_CONCAT,ANSI_QUOTES,IGNORE_SPACE,ONLY_FULL_GROUP_BY,ANSI": ansi,
+		"ANSI_QUOTES, NO_BACKSLASH_ESCAPES": {
+			NoBackslashEscapes: true,
+			ANSIQuotes:         true,
+		},
+	} {
+		if got := SplitterForSQLMode(mode); got != want {
+			t.Fatalf("expected %+v for %q, got %+v", want, mode, got)
+		}
+	}
+}
+
+func TestEmptyStatements(t *testing.T) {
+	tcs := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"doubled semicolons", "SELECT 1;;\n;SELECT 2;;", []string{"SELECT 1", "SELECT 2"}},
+		{"trailing comment", "SELECT 1;\n-- done;\n", []string{"SELECT 1"}},
+		{"trailing block comment", "SELECT 1; /* done */", []string{"SELECT 1"}},
+		{"only comments", "-- nothing yet\n/* maybe; later */\n# or never\n", nil},
+		{"empty", "", nil},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			db := newFakeStore()
+			db.dropCheckpoint = errors.New("disk full")
+			fsys := fstest.MapFS{"1.sql": {Data: []byte(tc.content)}}
+			m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+			check(t, err)
+			_, err = m.Migrate(ctx)
+			if len(tc.want) == 0 {
+				// Nothing ran to be checkpointed
+				check(t, err)
+				if len(db.execs) != 0 || len(db.checkpoints["1.sql"]) != 0 {
+					t.Fatalf("expected nothing run, ran %v", db.execs)
+				}
+				if db.migrations[0].Status != StatusApplied {
+					t.Fatalf("expected 1.sql applied, got %s",
+						db.migrations[0].Status)
+				}
+				return
+			}
+
+			// Each statement is checkpointed by its index, the first
+			// before the checkpoint fails
+			if err == nil {
+				t.Fatal("expected the checkpoint error")
+			}
+			if n := len(db.checkpoints["1.sql"]); n != 1 {
+				t.Fatalf("expected 1 checkpoint, got %d", n)
+			}
+			m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+				WithResume())
+			check(t, err)
+			_, err = m.Migrate(ctx)
+			check(t, err)
+			for _, stmt := range tc.want {
+				if db.execs[stmt] != 1 {
+					t.Fatalf("expected %s run once, ran %v", stmt,
+						db.execs)
+				}
+			}
+			if len(db.execs) != len(tc.want) {
+				t.Fatalf("expected %d statements run, ran %v",
+					len(tc.want), db.execs)
+			}
+		})
+	}
+}
+
+func TestEmptyCheckpoints(t *testing.T) {
+	const content = "SELECT 1;\nSELECT 2;\n-- done\n"
+	tcs := []struct {
+		name    string
+		extra   []string
+		wantErr bool
+	}{
+		{"empty", []string{""}, false},
+		{"comments", []string{"-- done", "# and done"}, false},
+		{"sql", []string{"SELECT 3"}, true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			db := newFakeStore()
+			db.dropCheckpoint = errors.New("disk full")
+			fsys := fstest.MapFS{"1.sql": {Data: []byte(content)}}
+			m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+			check(t, err)
+			if _, err = m.Migrate(ctx); err == nil {
+				t.Fatal("expected the checkpoint error")
+			}
+
+			// Record checkpoints of the rest, and those after them an
+			// earlier split would have added
+			for i, stmt := range append([]string{"SELECT 2"}, tc.extra...) {
+				_, sum, err := computeChecksum(strings.NewReader(stmt),
+					ChecksumMD5)
+				check(t, err)
+				check(t, db.InsertMetaCheckpoint(ctx, "1.sql", stmt, sum,
+					i+1))
+			}
+			m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+				WithResume())
+			check(t, err)
+			_, err = m.Migrate(ctx)
+			if tc.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "len(checkpoints)") {
+					t.Fatalf("expected too many checkpoints, got %v", err)
+				}
+				return
+			}
+			check(t, err)
+			if db.execs["SELECT 1"] != 1 || db.execs["SELECT 2"] != 0 ||
+				db.migrations[0].Status != StatusApplied {
+				t.Fatalf("expected 1.sql applied without running again, ran %v",
+					db.execs)
+			}
+		})
+	}
+}
+
+func TestInclude(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1.sql": {Data: []byte("CREATE TABLE a (id INT);\n" +
+			"-- migrate:include _fragments/audit.sql\n" +
+			"SELECT 3;\n")},
+		"2.sql": {Data: []byte("CREATE TABLE b (id INT);\n")},
+		"_fragments/audit.sql": {Data: []byte(
+			"CREATE TRIGGER a_audit AFTER UPDATE ON a FOR EACH ROW INSERT INTO audit VALUES (1);\n" +
+				"  -- migrate:include  _fragments/../_fragments/grants.sql\n")},
+		"_fragments/grants.sql": {Data: []byte("GRANT SELECT ON a TO app;")},
+	}
+	const expanded = "CREATE TABLE a (id INT);\n" +
+		"CREATE TRIGGER a_audit AFTER UPDATE ON a FOR EACH ROW INSERT INTO audit VALUES (1);\n" +
+		"GRANT SELECT ON a TO app;\n" +
+		"SELECT 3;\n"
+
+	// Nested includes are expanded in the content recorded and run, while
+	// a file without includes is checksummed as it was
+	db := newFakeStore()
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if db.migrations[0].Content != expanded {
+		t.Fatalf("expected expanded content, got %q", db.migrations[0].Content)
+	}
+	for _, stmt := range []string{
+		"CREATE TABLE a (id INT)", "GRANT SELECT ON a TO app", "SELECT 3",
+	} {
+		if db.execs[stmt] != 1 {
+			t.Fatalf("expected %s run, ran %v", stmt, db.execs)
+		}
+	}
+	want, err := fileChecksumOf(db.migrations[0].ChecksumAlgo,
+		[]byte(expanded))
+	check(t, err)
+	if db.migrations[0].Checksum != want {
+		t.Fatalf("expected the checksum of the expanded file, got %s",
+			db.migrations[0].Checksum)
+	}
+	want, err = fileChecksumOf(db.migrations[1].ChecksumAlgo,
+		fsys["2.sql"].Data)
+	check(t, err)
+	if db.migrations[1].Checksum != want {
+		t.Fatalf("expected 2.sql's checksum unchanged, got %s",
+			db.migrations[1].Checksum)
+	}
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+
+	// Changing a fragment modifies the migrations including it
+	fsys["_fragments/grants.sql"] = &fstest.MapFile{
+		Data: []byte("GRANT SELECT, INSERT ON a TO app;")}
+	_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	var mismatch *ErrChecksumMismatch
+	if !errors.As(err, &mismatch) || mismatch.Filename != "1.sql" {
+		t.Fatalf("expected 1.sql modified, got %v", err)
+	}
+
+	deep := fstest.MapFS{"1.sql": {Data: []byte("-- migrate:include _f/0.sql")}}
+	for i := 0; i < 12; i++ {
+		deep[fmt.Sprintf("_f/%d.sql", i)] = &fstest.MapFile{Data: []byte(
+			fmt.Sprintf("SELECT %d;\n-- migrate:include _f/%d.sql\n", i, i+1))}
+	}
+	tcs := []struct {
+		name string
+		fsys fstest.MapFS
+		want string
+	}{
+		{
+			name: "cycle",
+			fsys: fstest.MapFS{
+				"1.sql":    {Data: []byte("SELECT 1;\n-- migrate:include _f/a.sql")},
+				"_f/a.sql": {Data: []byte("-- migrate:include _f/b.sql")},
+				"_f/b.sql": {Data: []byte("SELECT 2;\n\n-- migrate:include _f/a.sql")},
+			},
+			want: "open 1.sql: line 2: _f/a.sql: line 1: _f/b.sql: line 3: include cycle: 1.sql -> _f/a.sql -> _f/b.sql -> _f/a.sql",
+		},
+		{
+			name: "itself",
+			fsys: fstest.MapFS{
+				"1.sql": {Data: []byte("-- migrate:include 1.sql")},
+			},
+			want: "include cycle: 1.sql -> 1.sql",
+		},
+		{
+			name: "too deep",
+			fsys: deep,
+			want: "include _f/10.sql: includes nest more than 10 deep",
+		},
+		{
+			name: "missing",
+			fsys: fstest.MapFS{
+				"1.sql": {Data: []byte("SELECT 1;\n-- migrate:include _f/none.sql\n")},
+			},
+			want: "open 1.sql: line 2: include _f/none.sql: no such file",
+		},
+		{
+			name: "outside",
+			fsys: fstest.MapFS{
+				"1.sql": {Data: []byte("-- migrate:include ../secrets.sql")},
+			},
+			want: "the path must be in the migrations directory",
+		},
+		{
+			name: "no path",
+			fsys: fstest.MapFS{
+				"1.sql": {Data: []byte("-- migrate:include \nSELECT 1;")},
+			},
+			want: "expected -- migrate:include followed by a path",
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			db := newFakeStore()
+			m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, tc.fsys, "")
+			check(t, err)
+			_, err = m.Migrate(ctx)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("expected %q, got %v", tc.want, err)
+			}
+			if errors.Is(err, fs.ErrNotExist) || len(db.execs) != 0 {
+				t.Fatalf("expected nothing run for a bad include, ran %v",
+					db.execs)
+			}
+		})
+	}
+}
+
+func TestDown(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1.sql":      mapFile("CREATE TABLE a (id INT);\n"),
+		"1.down.sql": mapFile("DROP TABLE a;\n"),
+		"2.sql":      mapFile("CREATE TABLE b (id INT);\n"),
+		"3.sql":      mapFile("CREATE TABLE c (id INT);\n"),
+		"3.down.sql": mapFile("DROP TABLE c;\n"),
+	}
+	db := newFakeStore()
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+
+	// A missing down migration is reported before any runs
+	_, err = DownFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, 2)
+	var missing *ErrDownMissing
+	if !errors.As(err, &missing) || len(missing.Filenames) != 1 ||
+		missing.Filenames[0] != "2.sql" {
+		t.Fatalf("expected 2.sql missing its down migration, got %v", err)
+	}
+	if db.execs["DROP TABLE c"] != 0 || len(db.migrations) != 3 {
+		t.Fatalf("expected nothing rolled back, got %v", db.execs)
+	}
+	for _, steps := range []int{0, 4} {
+		if _, err = DownFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys,
+			steps); err == nil {
+			t.Fatalf("expected an error rolling back %d", steps)
+		}
+	}
+
+	// Rolling back runs the down migrations latest first and deletes their
+	// rows and checkpoints
+	fsys["2.down.sql"] = mapFile("DROP TABLE b;\n")
+	check(t, db.InsertMetaCheckpoint(ctx, "3.sql", "", "x", 0))
+	log := &recordLogger{testLogger: testLogger{t}, buf: &strings.Builder{}}
+	n, err := DownFS(ctx, db, log, DBTypeMySQL, fsys, 2)
+	check(t, err)
+	if n != 2 {
+		t.Fatalf("expected 2 rolled back, got %d", n)
+	}
+	out := log.buf.String()
+	if i, j := strings.Index(out, "rolled back 3.sql"),
+		strings.Index(out, "rolled back 2.sql"); i < 0 || j < i {
+		t.Fatalf("expected 3.sql rolled back before 2.sql, got %q", out)
+	}
+	if db.execs["DROP TABLE c"] != 1 || db.execs["DROP TABLE b"] != 1 ||
+		db.execs["DROP TABLE a"] != 0 {
+		t.Fatalf("expected the down migrations of 2.sql and 3.sql, got %v",
+			db.execs)
+	}
+	if len(db.migrations) != 1 || db.migrations[0].Filename != "1.sql" ||
+		len(db.checkpoints["3.sql"]) != 0 {
+		t.Fatalf("expected only 1.sql recorded, got %+v", db.migrations)
+	}
+	last := db.history[len(db.history)-1]
+	if last.Filename != "2.sql" || last.Statement != StatementDown ||
+		!last.Success {
+		t.Fatalf("expected the rollback in history, got %+v", last)
+	}
+
+	// The migrations rolled back run again
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if db.execs["CREATE TABLE b (id INT)"] != 2 ||
+		db.execs["CREATE TABLE c (id INT)"] != 2 || len(db.migrations) != 3 {
+		t.Fatalf("expected 2.sql and 3.sql applied again, got %v", db.execs)
+	}
+
+	// A down migration which fails leaves its migration applied
+	db.failures["DROP TABLE c"] = 100
+	_, err = DownFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, 1,
+		WithRetry(1, 0))
+	var failed *ErrStatementFailed
+	if !errors.As(err, &failed) || failed.Filename != "3.down.sql" {
+		t.Fatalf("expected 3.down.sql to fail, got %v", err)
+	}
+	if len(db.migrations) != 3 {
+		t.Fatalf("expected 3.sql still recorded, got %+v", db.migrations)
+	}
+}
+
+func TestDownTo(t *testing.T) {
+	fsys := fstest.MapFS{}
+	for i := 1; i <= 4; i++ {
+		fsys[fmt.Sprintf("%d.sql", i)] = &fstest.MapFile{
+			Data: []byte(fmt.Sprintf("CREATE TABLE t%d (id INT);\n", i))}
+		fsys[fmt.Sprintf("%d.down.sql", i)] = &fstest.MapFile{
+			Data: []byte(fmt.Sprintf("DROP TABLE t%d;\n", i))}
+	}
+	db := newFakeStore()
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+
+	if _, err = DownToFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys,
+		"5.sql"); err == nil {
+		t.Fatal("expected an error rolling back to a migration not applied")
+	}
+	n, err := DownToFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "4.sql")
+	check(t, err)
+	if n != 0 || len(db.migrations) != 4 {
+		t.Fatalf("expected nothing rolled back, got %d", n)
+	}
+
+	// The plan is logged before it runs, and a failure partway leaves
+	// those rolled back deleted
+	db.failures["DROP TABLE t3"] = 100
+	log := &recordLogger{testLogger: testLogger{t}, buf: &strings.Builder{}}
+	n, err = DownToFS(ctx, db, log, DBTypeMySQL, fsys, "1.sql",
+		WithRetry(1, 0))
+	if err == nil {
+		t.Fatal("expected 3.down.sql to fail")
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 rolled back, got %d", n)
+	}
+	const plan = "rolling back 3 migrations, in this order:\n" +
+		"  4.sql, by running 4.down.sql\n" +
+		"  3.sql, by running 3.down.sql\n" +
+		"  2.sql, by running 2.down.sql\n" +
+		"> 4.down.sql statement 1 (line 1): DROP TABLE t4\n"
+	if !strings.Contains(log.buf.String(), plan) {
+		t.Fatalf("expected the plan logged first, got %q", log.buf.String())
+	}
+	if len(db.migrations) != 3 || db.execs["DROP TABLE t2"] != 0 {
+		t.Fatalf("expected only 4.sql rolled back, got %+v", db.migrations)
+	}
+
+	// Running it again rolls back the rest
+	delete(db.failures, "DROP TABLE t3")
+	n, err = DownToFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "1.sql")
+	check(t, err)
+	if n != 2 {
+		t.Fatalf("expected 2 rolled back, got %d", n)
+	}
+	if len(db.migrations) != 1 || db.migrations[0].Filename != "1.sql" ||
+		db.execs["DROP TABLE t4"] != 1 || db.execs["DROP TABLE t2"] != 1 {
+		t.Fatalf("expected only 1.sql left, got %+v %v", db.migrations,
+			db.execs)
+	}
+}
+
+func TestDownFromStore(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1.sql":      {Data: []byte("CREATE TABLE a (id INT);\n")},
+		"2.sql":      {Data: []byte("CREATE TABLE b (id INT);\n")},
+		"2.down.sql": {Data: []byte("DROP TABLE b;\n")},
+		"3.sql":      {Data: []byte("CREATE TABLE c (id INT);\n")},
+		"3.down.sql": {Data: []byte("DROP TABLE c;\nDROP TABLE c_log;\n")},
+	}
+	db := newFakeStore()
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+
+	// Nothing runs if any migration has no down migration recorded
+	_, err = DownFromStore(ctx, db, testLogger{t}, 3)
+	var missing *ErrDownMissing
+	if !errors.As(err, &missing) ||
+		fmt.Sprint(missing.Filenames) != "[1.sql]" {
+		t.Fatalf("expected 1.sql missing its down migration, got %v", err)
+	}
+	if db.execs["DROP TABLE c"] != 0 {
+		t.Fatalf("expected nothing rolled back, got %v", db.execs)
+	}
+
+	// The recorded down migrations run without the files
+	n, err := DownFromStore(ctx, db, testLogger{t}, 2)
+	check(t, err)
+	if n != 2 {
+		t.Fatalf("expected 2 rolled back, got %d", n)
+	}
+	if db.execs["DROP TABLE c"] != 1 || db.execs["DROP TABLE c_log"] != 1 ||
+		db.execs["DROP TABLE b"] != 1 {
+		t.Fatalf("expected the recorded down migrations, got %v", db.execs)
+	}
+	if len(db.migrations) != 1 || db.migrations[0].Filename != "1.sql" {
+		t.Fatalf("expected only 1.sql recorded, got %+v", db.migrations)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1.sql":      mapFile("CREATE TABLE a (id INT);\n"),
+		"1.down.sql": mapFile("DROP TABLE a;\n"),
+		"2.sql":      mapFile("SELECT 1;\nSELECT 2;\nSELECT 3;\n"),
+		"3.sql":      mapFile("-- migrate:no-split\nSELECT 4;\n"),
+	}
+	db := newFakeStore()
+	dryRun := func(opts ...Option) (*Plan, error) {
+		plan := &Plan{}
+		opts = append(opts, WithDryRun(plan))
+		m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+			opts...)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = m.Migrate(ctx); err != nil {
+			return nil, err
+		}
+		return plan, nil
+	}
+
+	// A database without meta plans every file, without creating it
+	plan, err := dryRun()
+	check(t, err)
+	if len(plan.Files) != 3 || plan.Direction != "up" || db.created ||
+		len(db.execs) != 0 {
+		t.Fatalf("expected every file planned and nothing run, got %+v",
+			plan)
+	}
+
+	// A file which failed partway resumes from its checkpoints
+	db.failures["SELECT 2"] = 100
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithRetry(1, 0))
+	check(t, err)
+	if _, err = m.Migrate(ctx); err == nil {
+		t.Fatal("expected 2.sql to fail")
+	}
+	execs := fmt.Sprint(db.execs)
+	migrations := fmt.Sprintf("%+v", db.migrations)
+	plan, err = dryRun(WithResume())
+	check(t, err)
+	want := []PlannedFile{
+		{Filename: "2.sql", Statements: 3, Resume: true, Checkpoints: 1},
+		{Filename: "3.sql", Statements: 1, Mode: "no-split"},
+	}
+	if !reflect.DeepEqual(plan.Files, want) {
+		t.Fatalf("expected %+v, got %+v", want, plan.Files)
+	}
+	if fmt.Sprint(db.execs) != execs ||
+		fmt.Sprintf("%+v", db.migrations) != migrations {
+		t.Fatalf("expected nothing run or recorded, got %v", db.execs)
+	}
+	const table = "FILE   STATEMENTS  MODE      RESUME\n" +
+		"2.sql  3           -         from statement 2\n" +
+		"3.sql  1           no-split  -\n"
+	if plan.String() != table {
+		t.Fatalf("expected the table\n%s\ngot\n%s", table, plan)
+	}
+	byt, err := json.Marshal(plan)
+	check(t, err)
+	if !strings.Contains(string(byt), `{"filename":"2.sql","statements":3,"resume":true,"checkpoints":1}`) {
+		t.Fatalf("unexpected json %s", byt)
+	}
+
+	// An edited checkpointed statement fails the dry run as it would the
+	// run
+	fsys["2.sql"] = mapFile("SELECT 10;\nSELECT 2;\nSELECT 3;\n")
+	_, err = dryRun(WithResume())
+	var mismatch *ErrChecksumMismatch
+	if !errors.As(err, &mismatch) || mismatch.Statement != 0 {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+
+	// So does an edited migration applied already
+	fsys["2.sql"] = mapFile("SELECT 1;\nSELECT 2;\nSELECT 3;\n")
+	delete(db.failures, "SELECT 2")
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithResume())
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	fsys["1.sql"] = mapFile("CREATE TABLE a (id BIGINT);\n")
+	if _, err = dryRun(); !errors.As(err, &mismatch) {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+	fsys["1.sql"] = mapFile("CREATE TABLE a (id INT);\n")
+
+	// Rollbacks are planned with where their down migrations are read
+	// from
+	execs = fmt.Sprint(db.execs)
+	plan = &Plan{}
+	_, err = DownFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, 3,
+		WithDryRun(plan))
+	var missing *ErrDownMissing
+	if !errors.As(err, &missing) {
+		t.Fatalf("expected down migrations missing, got %v", err)
+	}
+	fsys["2.down.sql"] = mapFile("SELECT -2;\n")
+	fsys["3.down.sql"] = mapFile("SELECT -3;\nSELECT -4;\n")
+	n, err := DownFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, 3,
+		WithDryRun(plan))
+	check(t, err)
+	want = []PlannedFile{
+		{Filename: "3.sql", Statements: 2, Source: "file"},
+		{Filename: "2.sql", Statements: 1, Source: "file"},
+		{Filename: "1.sql", Statements: 1, Source: "file"},
+	}
+	if n != 0 || plan.Direction != "down" ||
+		!reflect.DeepEqual(plan.Files, want) {
+		t.Fatalf("expected %+v, got %+v", want, plan.Files)
+	}
+	for i := range db.migrations {
+		if db.migrations[i].DownContent == "" {
+			db.migrations[i].DownContent = "SELECT -5;\n"
+		}
+	}
+	_, err = DownFromStore(ctx, db, testLogger{t}, 2, WithDryRun(plan))
+	check(t, err)
+	want = []PlannedFile{
+		{Filename: "3.sql", Statements: 1, Source: "store"},
+		{Filename: "2.sql", Statements: 1, Source: "store"},
+	}
+	if !reflect.DeepEqual(plan.Files, want) {
+		t.Fatalf("expected %+v, got %+v", want, plan.Files)
+	}
+	if fmt.Sprint(db.execs) != execs || len(db.migrations) != 3 {
+		t.Fatalf("expected nothing rolled back, got %v", db.execs)
+	}
+
+	if _, err = RepairFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, nil,
+		WithDryRun(plan)); err == nil {
+		t.Fatal("expected Repair to refuse a dry run")
+	}
+}
+
+func TestAutoRollback(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1.sql":      mapFile("CREATE TABLE a (id INT);\n"),
+		"2.sql":      mapFile("CREATE TABLE b (id INT);\nSELECT boom;\n"),
+		"2.down.sql": mapFile("DROP TABLE b;\n"),
+	}
+	db := newFakeStore()
+	db.failures["SELECT boom"] = 100
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithRetry(1, 0), WithAutoRollbackOnFailure())
+	check(t, err)
+	_, err = m.Migrate(ctx)
+
+	// The failure is reported, and 2.sql is rolled back without needing
+	// WithResume to run again
+	var rolledBack *ErrAutoRollback
+	var failed *ErrStatementFailed
+	if !errors.As(err, &rolledBack) || rolledBack.RollbackErr != nil ||
+		!errors.As(err, &failed) || failed.SQL != "SELECT boom" {
+		t.Fatalf("expected 2.sql rolled back after failing, got %v", err)
+	}
+	if db.execs["DROP TABLE b"] != 1 || len(db.checkpoints["2.sql"]) != 0 ||
+		len(db.migrations) != 1 || !m.Results[1].RolledBack {
+		t.Fatalf("expected 2.sql rolled back, got %v %+v", db.execs,
+			db.migrations)
+	}
+	delete(db.failures, "SELECT boom")
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if db.execs["CREATE TABLE b (id INT)"] != 2 || len(db.migrations) != 2 {
+		t.Fatalf("expected 2.sql applied from the start, got %v", db.execs)
+	}
+
+	// A rollback which fails is reported after the failure, leaving the
+	// checkpoints, with the file recorded as its rollback failed
+	fsys["3.sql"] = mapFile("CREATE TABLE c (id INT);\nSELECT boom;\n")
+	fsys["3.down.sql"] = mapFile("DROP TABLE c;\n")
+	db.failures["SELECT boom"] = 100
+	db.failures["DROP TABLE c"] = 100
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithRetry(1, 0), WithAutoRollbackOnFailure())
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	if !errors.As(err, &rolledBack) || rolledBack.RollbackErr == nil ||
+		!errors.As(err, &failed) || failed.SQL != "SELECT boom" {
+		t.Fatalf("expected both failures, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "rolling 3.sql back failed too") {
+		t.Fatalf("expected the rollback's failure, got %v", err)
+	}
+	if len(db.checkpoints["3.sql"]) != 1 || len(db.migrations) != 3 ||
+		db.migrations[2].Status != StatusRollbackFailed ||
+		!strings.Contains(db.migrations[2].Error, "rolling 3.sql back") {
+		t.Fatalf("expected 3.sql left with its checkpoints, got %+v",
+			db.migrations)
+	}
+
+	// A down migration which fails partway may have undone statements the
+	// checkpoints record as run, so resuming is refused until they're
+	// cleared, then the file runs again whole
+	db = newFakeStore()
+	fsys = fstest.MapFS{
+		"1.sql": mapFile("CREATE TABLE a (id INT);\n" +
+			"INSERT INTO nope VALUES (1);\n"),
+		"1.down.sql": mapFile("DROP TABLE a;\nDROP TABLE zz;\n"),
+	}
+	db.failures["INSERT INTO nope VALUES (1)"] = 100
+	db.failures["DROP TABLE zz"] = 100
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithRetry(1, 0), WithAutoRollbackOnFailure())
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	if !errors.As(err, &rolledBack) || rolledBack.RollbackErr == nil {
+		t.Fatalf("expected the rollback's failure, got %v", err)
+	}
+	if db.execs["DROP TABLE a"] != 1 || len(db.migrations) != 1 ||
+		db.migrations[0].Status != StatusRollbackFailed {
+		t.Fatalf("expected 1.sql's rollback failed, got %v %+v", db.execs,
+			db.migrations)
+	}
+	delete(db.failures, "INSERT INTO nope VALUES (1)")
+	_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithResume())
+	var rollbackFailed *ErrRollbackFailed
+	if !errors.As(err, &rollbackFailed) || rollbackFailed.Filename != "1.sql" {
+		t.Fatalf("expected resuming 1.sql refused, got %v", err)
+	}
+	if db.execs["CREATE TABLE a (id INT)"] != 1 {
+		t.Fatalf("expected nothing run, got %v", db.execs)
+	}
+	check(t, ClearCheckpoints(ctx, db, "1.sql"))
+	if len(db.checkpoints["1.sql"]) != 0 ||
+		db.migrations[0].Status != StatusFailed {
+		t.Fatalf("expected 1.sql failed without checkpoints, got %+v",
+			db.migrations)
+	}
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithResume())
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if db.execs["CREATE TABLE a (id INT)"] != 2 ||
+		db.migrations[0].Status != StatusApplied {
+		t.Fatalf("expected 1.sql applied from the start, got %v", db.execs)
+	}
+
+	// A file whose first statement fails took no effect, so its down
+	// migration isn't run, as it could drop a table which existed before
+	db = newFakeStore()
+	fsys = fstest.MapFS{
+		"1.sql":      mapFile("CREATE TABLE a (id INT);\nSELECT 2;\n"),
+		"1.down.sql": mapFile("DROP TABLE a;\n"),
+	}
+	db.failures["CREATE TABLE a (id INT)"] = 100
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithRetry(1, 0), WithAutoRollbackOnFailure())
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	if err == nil || errors.As(err, &rolledBack) {
+		t.Fatalf("expected 1.sql to fail without a rollback, got %v", err)
+	}
+	if db.execs["DROP TABLE a"] != 0 || m.Results[0].RolledBack ||
+		len(db.migrations) != 1 || db.migrations[0].Status != StatusFailed {
+		t.Fatalf("expected 1.sql left failed, got %v %+v", db.execs,
+			db.migrations)
+	}
+
+	_, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithAutoRollbackOnFailure(), WithProduction())
+	if err == nil {
+		t.Fatal("expected auto-rollback refused in production")
+	}
+}
+
+func TestRedo(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1.sql": mapFile("CREATE TABLE a (id INT);\n"),
+		"2.sql": mapFile("CREATE TABLE b (id INT);\n"),
+	}
+	db := newFakeStore()
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+
+	// The latest migration needs a down migration to be redone
+	fsys["2.sql"] = mapFile("CREATE TABLE b (id BIGINT);\n")
+	err = RedoFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys)
+	var missing *ErrDownMissing
+	if !errors.As(err, &missing) {
+		t.Fatalf("expected 2.sql missing its down migration, got %v", err)
+	}
+
+	fsys["2.down.sql"] = mapFile("DROP TABLE b;\n")
+	check(t, RedoFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys))
+	if db.execs["DROP TABLE b"] != 1 ||
+		db.execs["CREATE TABLE b (id BIGINT)"] != 1 {
+		t.Fatalf("expected 2.sql rolled back and applied again, got %v",
+			db.execs)
+	}
+	if len(db.migrations) != 2 {
+		t.Fatalf("expected 2 migrations, got %+v", db.migrations)
+	}
+	want, err := fileChecksumOf(db.migrations[1].ChecksumAlgo,
+		fsys["2.sql"].Data)
+	check(t, err)
+	if db.migrations[1].Checksum != want {
+		t.Fatalf("expected the checksum of the edited 2.sql, got %+v",
+			db.migrations)
+	}
+
+	// A pending file makes which migration to redo ambiguous
+	fsys["3.sql"] = mapFile("CREATE TABLE c (id INT);\n")
+	if err = RedoFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys); err == nil ||
+		!strings.Contains(err.Error(), "3.sql is pending") {
+		t.Fatalf("expected 3.sql pending, got %v", err)
+	}
+	if db.execs["DROP TABLE b"] != 1 {
+		t.Fatalf("expected nothing rolled back, got %v", db.execs)
+	}
+}
+
+func TestVerifyReversible(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1.sql": mapFile("CREATE TABLE a (id INT);\n"),
+		"2.sql": mapFile("CREATE TABLE b (id INT);\n"),
+		"3.sql": mapFile("CREATE TABLE c (id INT);\n"),
+	}
+	db := newFakeStore()
+	_, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "1.sql")
+	check(t, err)
+
+	// Every pending migration needs a down migration before any runs
+	fsys["3.down.sql"] = mapFile("DROP TABLE c;\n")
+	_, err = VerifyReversibleFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys)
+	var missing *ErrDownMissing
+	if !errors.As(err, &missing) ||
+		fmt.Sprint(missing.Filenames) != "[2.sql]" {
+		t.Fatalf("expected 2.sql missing its down migration, got %v", err)
+	}
+	if len(db.execs) != 0 {
+		t.Fatalf("expected nothing run, got %v", db.execs)
+	}
+
+	fsys["2.down.sql"] = mapFile("DROP TABLE b;\n")
+	report, err := VerifyReversibleFS(ctx, db, testLogger{t}, DBTypeMySQL,
+		fsys)
+	check(t, err)
+	if len(report.Files) != 2 || report.Files[0].Filename != "2.sql" ||
+		report.Files[1].Filename != "3.sql" {
+		t.Fatalf("expected 2.sql and 3.sql verified, got %+v", report.Files)
+	}
+	if db.execs["CREATE TABLE b (id INT)"] != 2 || db.execs["DROP TABLE c"] != 1 ||
+		db.execs["CREATE TABLE a (id INT)"] != 0 || len(db.migrations) != 3 {
+		t.Fatalf("expected 2.sql and 3.sql applied twice, got %v", db.execs)
+	}
+	_, err = VerifyReversibleFS(ctx, newFakeStore(), testLogger{t},
+		DBTypeMySQL, fsys, WithProduction())
+	if err == nil {
+		t.Fatal("expected VerifyReversible refused in production")
+	}
+}
+
+func TestInvertStatement(t *testing.T) {
+	tcs := []struct{ in, want string }{
+		{"CREATE TABLE users (id INT, name TEXT)", "DROP TABLE IF EXISTS users"},
+		{"create table if not exists `app`.`users` (id int)",
+			"DROP TABLE IF EXISTS `app`.`users`"},
+		{"CREATE TEMPORARY TABLE t AS SELECT a, b FROM u",
+			"DROP TABLE IF EXISTS t"},
+		{"CREATE INDEX users_name ON users (name)",
+			"DROP INDEX users_name ON users"},
+		{"CREATE UNIQUE INDEX `Users_Email` ON `app`.`users` (email)",
+			"DROP INDEX `Users_Email` ON `app`.`users`"},
+		{"ALTER TABLE users ADD INDEX users_email (email)",
+			"ALTER TABLE users DROP INDEX users_email"},
+		{"ALTER TABLE users ADD UNIQUE KEY users_email (email)",
+			"ALTER TABLE users DROP INDEX users_email"},
+		{"ALTER TABLE users ADD COLUMN email TEXT DEFAULT 'a, b'",
+			"ALTER TABLE users DROP COLUMN email"},
+		{"ALTER TABLE users ADD price DECIMAL(10, 2)",
+			"ALTER TABLE users DROP COLUMN price"},
+		{"ALTER TABLE users RENAME TO customers",
+			"ALTER TABLE customers RENAME TO users"},
+		{"ALTER TABLE app.users RENAME TO customers",
+			"ALTER TABLE app.customers RENAME TO users"},
+		{"ALTER TABLE users RENAME COLUMN name TO full_name",
+			"ALTER TABLE users RENAME COLUMN full_name TO name"},
+		{"ALTER TABLE users RENAME INDEX a TO b",
+			"ALTER TABLE users RENAME INDEX b TO a"},
+		{"ALTER INDEX a RENAME TO b", "ALTER INDEX b RENAME TO a"},
+		{"RENAME TABLE users TO customers", "RENAME TABLE customers TO users"},
+
+		// Left as TODO
+		{"UPDATE users SET name = 'x'", ""},
+		{"DROP TABLE users", ""},
+		{"CREATE INDEX ON users (name)", ""},
+		{"ALTER TABLE users ADD CONSTRAINT fk FOREIGN KEY (a) REFERENCES b (id)", ""},
+		{"ALTER TABLE users ADD PRIMARY KEY (id)", ""},
+		{"ALTER TABLE users ADD COLUMN a INT, ADD COLUMN b INT", ""},
+		{"ALTER TABLE users DROP COLUMN name", ""},
+		{"RENAME TABLE a TO b, c TO d", ""},
+	}
+	for _, tc := range tcs {
+		got, ok := invertStatement(DBTypeMySQL, tc.in)
+		if ok != (tc.want != "") || got != tc.want {
+			t.Errorf("%q: expected %q, got %q (%t)", tc.in, tc.want, got, ok)
+		}
+	}
+
+	// Indexes are dropped as each database writes it
+	indexes := []struct {
+		dbt      DBType
+		in, want string
+	}{
+		{DBTypeMSSQL, "CREATE INDEX users_name ON users (name)",
+			"DROP INDEX users_name ON users"},
+		{DBTypePostgres, "CREATE INDEX users_name ON users (name)",
+			"DROP INDEX IF EXISTS users_name"},
+		{DBTypePostgres, "CREATE UNIQUE INDEX CONCURRENTLY IF NOT EXISTS \"Users_Email\" ON ONLY app.users (email)",
+			"DROP INDEX IF EXISTS app.\"Users_Email\""},
+		{DBTypeSQLite, "CREATE INDEX main.users_name ON users (name)",
+			"DROP INDEX IF EXISTS main.users_name"},
+		{DBTypeOracle, "CREATE INDEX users_name ON users (name)",
+			"DROP INDEX users_name"},
+		{DBTypeSnowflake, "CREATE INDEX users_name ON users (name)", ""},
+		{"", "CREATE INDEX users_name ON users (name)", ""},
+	}
+	for _, tc := range indexes {
+		got, ok := invertStatement(tc.dbt, tc.in)
+		if ok != (tc.want != "") || got != tc.want {
+			t.Errorf("%s %q: expected %q, got %q (%t)", tc.dbt, tc.in,
+				tc.want, got, ok)
+		}
+	}
+}
+
+func TestGenerateDown(t *testing.T) {
+	const up = "-- migrate:no-retry\n" +
+		"-- The users table\n" +
+		"CREATE TABLE users (id INT, name TEXT);\r\n" +
+		"UPDATE users\nSET name = 'x';\n" +
+		"ALTER TABLE users ADD COLUMN email TEXT;\n"
+	down, err := GenerateDown(DBTypeMySQL, up)
+	check(t, err)
+	const want = `-- Generated from the up migration, the last statement first. Review
+-- it before committing it.
+--
+-- TODO: these statements couldn't be inverted, so are left below as
+-- comments to replace with what undoes them:
+--   line 4: UPDATE users ...
+
+ALTER TABLE users DROP COLUMN email;
+
+-- TODO: undo the statement on line 4 of the up migration:
+-- UPDATE users
+-- SET name = 'x';
+
+DROP TABLE IF EXISTS users;
+`
+	if down != want {
+		t.Fatalf("expected:\n%s\ngot:\n%s", want, down)
+	}
+
+	// A down migration with nothing to do is flagged only as generated
+	down, err = GenerateDown(DBTypeMySQL, "CREATE TABLE a (id INT);")
+	check(t, err)
+	if strings.Contains(down, "TODO") {
+		t.Fatalf("expected no TODO, got:\n%s", down)
+	}
+	if _, err = GenerateDown(DBTypeMySQL, "-- nothing\n"); err == nil {
+		t.Fatal("expected an error for content without statements")
+	}
+}
+
+func TestUpTo(t *testing.T) {
+	fsys := fstest.MapFS{
+		"10.sql": mapFile("CREATE TABLE a (id INT);\n"),
+		"20.sql": mapFile("CREATE TABLE b (id INT);\n"),
+		"30.sql": mapFile("CREATE TABLE c (id INT);\n"),
+		"40.sql": mapFile("CREATE TABLE d (id INT);\n"),
+	}
+	db := newFakeStore()
+
+	// An unknown target is refused before anything runs
+	_, err := UpToFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "50.sql")
+	if err == nil || !strings.Contains(err.Error(), "50.sql isn't a migration") {
+		t.Fatalf("expected 50.sql unknown, got %v", err)
+	}
+	if len(db.execs) != 0 {
+		t.Fatalf("expected nothing run, got %v", db.execs)
+	}
+
+	// Only the files up to the target are pending
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithUpTo("20.sql"))
+	check(t, err)
+	if got := m.Pending(); !reflect.DeepEqual(got, []string{"10.sql", "20.sql"}) {
+		t.Fatalf("expected 10.sql and 20.sql pending, got %v", got)
+	}
+
+	log := recordLogger{testLogger: testLogger{t}, buf: &strings.Builder{}}
+	migrated, err := UpToFS(ctx, db, log, DBTypeMySQL, fsys, "20.sql")
+	check(t, err)
+	if !migrated || len(db.migrations) != 2 || db.execs["CREATE TABLE c (id INT)"] != 0 {
+		t.Fatalf("expected 10.sql and 20.sql applied, got %+v", db.migrations)
+	}
+	if !strings.Contains(log.buf.String(),
+		"left 2 migrations pending after 20.sql:\n  30.sql\n  40.sql\n") {
+		t.Fatalf("expected 30.sql and 40.sql logged as pending, got %q",
+			log.buf.String())
+	}
+
+	// Running it again is up to date, as is a target applied already
+	for _, target := range []string{"20.sql", "10.sql"} {
+		migrated, err = UpToFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys,
+			target)
+		check(t, err)
+		if migrated || len(db.migrations) != 2 {
+			t.Fatalf("%s: expected nothing applied, got %+v", target,
+				db.migrations)
+		}
+	}
+
+	// A dry run plans only up to the target
+	plan := &Plan{}
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithUpTo("30.sql"), WithDryRun(plan))
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	if len(plan.Files) != 1 || plan.Files[0].Filename != "30.sql" {
+		t.Fatalf("expected only 30.sql planned, got %+v", plan.Files)
+	}
+
+	// A target applied while a file before it is pending would leave that
+	// file out
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	fsys["15.sql"] = mapFile("CREATE TABLE e (id INT);\n")
+	_, err = UpToFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "20.sql",
+		WithAllowOutOfOrder())
+	if err == nil || !strings.Contains(err.Error(),
+		"20.sql is applied already, but 15.sql before it is pending") {
+		t.Fatalf("expected 15.sql pending before 20.sql, got %v", err)
+	}
+	if db.execs["CREATE TABLE e (id INT)"] != 0 {
+		t.Fatalf("expected 15.sql not run, got %v", db.execs)
+	}
+}
+
+func TestSteps(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1.sql":      mapFile("CREATE TABLE a (id INT);\n"),
+		"2.sql":      mapFile("CREATE TABLE b (id INT);\nINSERT INTO b VALUES (1);\n"),
+		"3.sql":      mapFile("CREATE TABLE c (id INT);\n"),
+		"3.down.sql": mapFile("DROP TABLE c;\n"),
+	}
+	db := newFakeStore()
+
+	// Zero steps applies nothing, but still reports what's pending
+	log := recordLogger{testLogger: testLogger{t}, buf: &strings.Builder{}}
+	n, err := StepsFS(ctx, db, log, DBTypeMySQL, fsys, 0)
+	check(t, err)
+	if n != 0 || len(db.execs) != 0 {
+		t.Fatalf("expected nothing applied, got %d: %v", n, db.execs)
+	}
+	if !strings.Contains(log.buf.String(),
+		"applied 0 of at most 0 migrations, leaving 3 pending\n  1.sql\n  2.sql\n  3.sql\n") {
+		t.Fatalf("expected the summary logged, got %q", log.buf.String())
+	}
+
+	// A file failing partway counts as a step when it resumes
+	db.failures["INSERT INTO b VALUES (1)"] = 100
+	n, err = StepsFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, 2,
+		WithRetry(1, 0))
+	if err == nil || n != 1 {
+		t.Fatalf("expected 2.sql to fail after 1.sql, got %d: %v", n, err)
+	}
+	delete(db.failures, "INSERT INTO b VALUES (1)")
+	log.buf.Reset()
+	n, err = StepsFS(ctx, db, log, DBTypeMySQL, fsys, 1, WithResume())
+	check(t, err)
+	if n != 1 || db.execs["CREATE TABLE b (id INT)"] != 1 ||
+		db.execs["CREATE TABLE c (id INT)"] != 0 {
+		t.Fatalf("expected only 2.sql resumed, got %d: %v", n, db.execs)
+	}
+	if !strings.Contains(log.buf.String(),
+		"applied 1 of at most 1 migrations, leaving 1 pending\n  3.sql\n") {
+		t.Fatalf("expected 3.sql left pending, got %q", log.buf.String())
+	}
+
+	// More steps than are pending applies the rest
+	n, err = StepsFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, 10)
+	check(t, err)
+	if n != 1 || len(db.migrations) != 3 {
+		t.Fatalf("expected 3.sql applied, got %d: %+v", n, db.migrations)
+	}
+
+	// Negative steps roll back
+	n, err = StepsFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, -1)
+	check(t, err)
+	if n != 1 || db.execs["DROP TABLE c"] != 1 || len(db.migrations) != 2 {
+		t.Fatalf("expected 3.sql rolled back, got %d: %+v", n, db.migrations)
+	}
+}
+
+// implicitStore is a fakeStore whose database commits a transaction
+// implicitly before DDL, as MySQL does.
+type implicitStore struct{ *fakeStore }
+
+func (implicitStore) CommitsImplicitly(stmt string) bool {
+	return strings.HasPrefix(stmt, "CREATE ")
+}
+
+// txStore is a fakeStore which passes as a TxBeginner, for files refused
+// before their transaction begins.
+type txStore struct{ *fakeStore }
+
+func (txStore) BeginTx(context.Context, *sql.TxOptions) (*sql.Tx, error) {
+	return nil, errors.New("no transactions")
+}
+
+func TestTransactionFiles(t *testing.T) {
+
+	// A transaction can't be one batch as well
+	fsys := fstest.MapFS{"1.sql": mapFile("-- migrate:multi\n" +
+		"-- migrate:transaction\nSELECT 1;\n")}
+	db := newFakeStore()
+	m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	if _, err = m.Migrate(ctx); err == nil ||
+		!strings.Contains(err.Error(), "can't both be given") {
+		t.Fatalf("expected the directives refused together, got %v", err)
+	}
+
+	// A store without transactions refuses the file before it runs
+	fsys = fstest.MapFS{"1.sql": mapFile("-- migrate:transaction\n" +
+		"INSERT INTO a VALUES (1);\nINSERT INTO a VALUES (2);\n")}
+	db = newFakeStore()
+	m, err = NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	if _, err = m.Migrate(ctx); err == nil ||
+		!strings.Contains(err.Error(), "can't run a file in a transaction") {
+		t.Fatalf("expected the transaction refused, got %v", err)
+	}
+	if len(db.execs) != 0 || len(db.checkpoints) != 0 {
+		t.Fatalf("expected nothing run, got %v", db.execs)
+	}
+
+	// Statements which would commit the transaction implicitly are listed,
+	// with or without the directive, in a dry run too
+	fsys = fstest.MapFS{"1.sql": mapFile("INSERT INTO a VALUES (1);\n" +
+		"CREATE TABLE b (id INT);\nCREATE INDEX b_id ON b (id);\n")}
+	for _, opts := range [][]Option{
+		{WithTransactions()},
+		{WithTransactions(), WithDryRun(&Plan{})},
+	} {
+		db := implicitStore{newFakeStore()}
+		m, err := NewFS(ctx, db, testLogger{t}, DBTypeMySQL, fsys, "",
+			opts...)
+		check(t, err)
+		_, err = m.Migrate(ctx)
+		var implicit *ErrImplicitCommit
+		if !errors.As(err, &implicit) || len(implicit.Statements) != 2 ||
+			implicit.Statements[0].Line != 2 ||
+			implicit.Statements[1].Line != 3 {
+			t.Fatalf("expected statements 2 and 3 listed, got %v", err)
+		}
+		if !strings.Contains(err.Error(),
+			"statement 2 (line 2), statement 3 (line 3)") {
+			t.Fatalf("expected the statements named, got %v", err)
+		}
+		if len(db.execs) != 0 {
+			t.Fatalf("expected nothing run, got %v", db.execs)
+		}
+	}
+
+	// A later file which can't run in its transaction is refused before
+	// those ahead of it run, and isn't recorded as failed
+	fsys = fstest.MapFS{
+		"1.sql": mapFile("INSERT INTO a VALUES (1);\n"),
+		"2.sql": mapFile("INSERT INTO a VALUES (2);\n"),
+		"3.sql": mapFile("-- migrate:transaction\n" +
+			"INSERT INTO a VALUES (3);\nCREATE TABLE b (id INT);\n"),
+	}
+	idb := implicitStore{newFakeStore()}
+	m, err = NewFS(ctx, idb, testLogger{t}, DBTypeMySQL, fsys, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	var implicit *ErrImplicitCommit
+	if !errors.As(err, &implicit) || implicit.Filename != "3.sql" {
+		t.Fatalf("expected 3.sql refused, got %v", err)
+	}
+	if len(idb.execs) != 0 || len(idb.migrations) != 0 {
+		t.Fatalf("expected nothing run or recorded, got %v %v",
+			idb.execs, idb.migrations)
+	}
+
+	// A file moved into a transaction with checkpoints of an earlier run
+	// outside of one partly took effect, so auto-rollback runs its down
+	// migration
+	fsys = fstest.MapFS{
+		"1.sql":      mapFile("CREATE TABLE a (id INT);\nSELECT boom;\n"),
+		"1.down.sql": mapFile("DROP TABLE a;\n"),
+	}
+	tdb := txStore{newFakeStore()}
+	tdb.failures["SELECT boom"] = 100
+	m, err = NewFS(ctx, tdb, testLogger{t}, DBTypeMySQL, fsys, "",
+		WithRetry(1, 0))
+	check(t, err)
+	if _, err = m.Migrate(ctx); err == nil {
+		t.Fatal("expected 1.sql to fail")
+	}
+	fsys["1.sql"] = mapFile("-- migrate:transaction\n" +
+		"CREATE TABLE a (id INT);\nSELECT boom;\n")
+	log := recordLogger{testLogger: testLogger{t}, buf: &strings.Builder{}}
+	m, err = NewFS(ctx, tdb, log, DBTypeMySQL, fsys, "", WithResume(),
+		WithAutoRollbackOnFailure())
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	var rolledBack *ErrAutoRollback
+	if !errors.As(err, &rolledBack) ||
+		!strings.Contains(err.Error(), "has 1 checkpoints of an earlier run") {
+		t.Fatalf("expected the checkpoints refused and rolled back, got %v",
+			err)
+	}
+	if tdb.execs["DROP TABLE a"] != 1 || m.Results[0].Mode == "transaction" ||
+		strings.Contains(log.buf.String(), "none of its transaction") {
+		t.Fatalf("expected 1.sql rolled back, got %v\n%s", tdb.execs,
+			log.buf.String())
+	}
+}
@@ -0,0 +1,141 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ModifiedPolicy is what New and Migrate do about an applied migration whose
+// file no longer matches its checksum, such as one edited in a development
+// database which is rebuilt often anyway.
+type ModifiedPolicy int
+
+const (
+	// ModifiedError reports an *ErrChecksumMismatch, as by default.
+	ModifiedError ModifiedPolicy = iota
+
+	// ModifiedWarn logs the migration and continues, without running it
+	// again.
+	ModifiedWarn
+
+	// ModifiedUpdateChecksum records the file's checksum and content as
+	// the migration's once Migrate holds the lock, as Repair with
+	// WithForceRepair would, without running it again. It's refused with
+	// WithProduction.
+	ModifiedUpdateChecksum
+)
+
+func (p ModifiedPolicy) String() string {
+	switch p {
+	case ModifiedError:
+		return "error"
+	case ModifiedWarn:
+		return "warn"
+	case ModifiedUpdateChecksum:
+		return "update-checksum"
+	}
+	return fmt.Sprintf("ModifiedPolicy(%d)", int(p))
+}
+
+// WithModifiedPolicy sets what to do about applied migrations whose files
+// were modified. Each one the policy lets Migrate continue past is listed in
+// Modified with the policy.
+func WithModifiedPolicy(p ModifiedPolicy) Option {
+	return func(m *Migrate) { m.modifiedPolicy = p }
+}
+
+// WithProduction flags the database as production, where checksums are never
+// updated to match modified files, so WithModifiedPolicy's
+// ModifiedUpdateChecksum is refused.
+func WithProduction() Option {
+	return func(m *Migrate) { m.production = true }
+}
+
+// checkModifiedPolicy reports an error if the policy is unknown, or is
+// ModifiedUpdateChecksum in production.
+func (m *Migrate) checkModifiedPolicy() error {
+	switch m.modifiedPolicy {
+	case ModifiedError, ModifiedWarn:
+	case ModifiedUpdateChecksum:
+		if m.production {
+			return errors.New("can't update the checksums of modified migrations in production")
+		}
+	default:
+		return fmt.Errorf("unknown modified policy %s", m.modifiedPolicy)
+	}
+	return nil
+}
+
+// allowModified reports whether the policy continues past mismatch, the
+// mismatch of the applied migration mg, adding it to Modified if so.
+func (m *Migrate) allowModified(
+	mg Migration,
+	mismatch *ErrChecksumMismatch,
+) bool {
+	switch m.modifiedPolicy {
+	case ModifiedWarn:
+		m.log.Printf("WARNING: %s was modified since it was %s, continuing without running it again as the modified policy is %s\n",
+			mg.Filename, mg.Status, m.modifiedPolicy)
+	case ModifiedUpdateChecksum:
+		m.log.Printf("WARNING: %s was modified since it was %s, so its checksum will be updated as the modified policy is %s\n",
+			mg.Filename, mg.Status, m.modifiedPolicy)
+	default:
+		return false
+	}
+	m.Modified = append(m.Modified, ModifiedFile{
+		Filename: mg.Filename,
+		Algo:     recordedAlgo(mg),
+		Stored:   mismatch.Stored,
+		Computed: mismatch.Computed,
+		Policy:   m.modifiedPolicy.String(),
+	})
+	return true
+}
+
+// updateModified records again each of Modified from its file, under
+// ModifiedUpdateChecksum, as Repair does.
+func (m *Migrate) updateModified(ctx context.Context) error {
+	if m.modifiedPolicy != ModifiedUpdateChecksum {
+		return nil
+	}
+	index := m.fileIndexes()
+	for _, mod := range m.Modified {
+		f := m.Files[index[mod.Filename]]
+		byt, err := fs.ReadFile(m.fsys, f.fullpath)
+		if err != nil {
+			return err
+		}
+		if err = m.recordAgain(ctx, f, normalizeLineEndings(byt)); err != nil {
+			return err
+		}
+		m.log.Printf("updated the checksum of %s\n", mod.Filename)
+	}
+	return nil
+}
+
+// recordAgain records the applied migration f with the checksum and content
+// of byt, its file with normalized line endings, keeping the rest of its row,
+// and adds the repair to metahistory.
+func (m *Migrate) recordAgain(ctx context.Context, f *file, byt []byte) error {
+	start := time.Now()
+
+	// GetMigrations leaves out the down migration, which upserting the row
+	// would clear
+	row, err := m.db.GetMigrationWithDown(ctx, f.Info.Name())
+	if err != nil {
+		return errors.Wrap(err, "get migration")
+	}
+	row.Checksum, err = fileChecksumOf(m.checksumAlgo(), byt)
+	if err != nil {
+		return err
+	}
+	row.ChecksumAlgo = m.checksumAlgo()
+	row.Content = string(byt)
+	err = m.db.UpsertMigration(ctx, row)
+	m.recordHistory(ctx, f, StatementRepair, start, err)
+	return errors.Wrap(err, "upsert migration")
+}
@@ -0,0 +1,232 @@
+// Package mssql implements a migrate.Store for Microsoft SQL Server.
+package mssql
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/thankful-ai/migrate"
+	"github.com/thankful-ai/migrate/sqlstore"
+
+	_ "github.com/microsoft/go-mssqldb"
+)
+
+// errObjectExists is the error number SQL Server reports when creating a
+// table whose name is already taken.
+const errObjectExists = 2714
+
+// errInvalidObject is the error number SQL Server reports when selecting from
+// a table which doesn't exist.
+const errInvalidObject = 208
+
+type DB struct {
+	connURL string
+
+	// Embed the generic SQL store
+	*sqlstore.Store
+}
+
+// New prepares a connection to a SQL Server database. encrypt is passed
+// through to the driver and may be one of disable, false, true or strict. When
+// sslCA is provided the server certificate is verified against it.
+func New(
+	user, pass, host, dbName string,
+	port int,
+	encrypt, sslCA, sslServerName string,
+) (*DB, error) {
+	switch encrypt {
+	case "", "disable", "false", "true", "strict":
+	default:
+		return nil, fmt.Errorf("unknown encrypt mode %q", encrypt)
+	}
+	if encrypt == "disable" && sslCA != "" {
+		return nil, errors.New("ssl ca provided but encryption is disabled")
+	}
+
+	params := url.Values{}
+	params.Set("database", dbName)
+	if encrypt != "" {
+		params.Set("encrypt", encrypt)
+	}
+	if sslCA != "" {
+		params.Set("certificate", sslCA)
+	}
+	if sslServerName != "" {
+		params.Set("hostNameInCertificate", sslServerName)
+	}
+	u := &url.URL{
+		Scheme:   "sqlserver",
+		User:     url.UserPassword(user, pass),
+		Host:     host + ":" + strconv.Itoa(port),
+		RawQuery: params.Encode(),
+	}
+	return &DB{connURL: u.String()}, nil
+}
+
+func (db *DB) Open(ctx context.Context) error {
+	var err error
+	db.Store, err = sqlstore.Open("sqlserver", db.connURL, Dialect{})
+	return err
+}
+
+// Splitter splits migrations into the batches between GO lines, as SQL
+// Server's tools do, so a file may create a procedure in a batch of its own.
+func (db *DB) Splitter() migrate.Splitter { return migrate.SplitOnGO{} }
+
+// Dialect describes SQL Server's SQL to sqlstore.
+type Dialect struct{}
+
+func (Dialect) BindType() int { return sqlx.AT }
+
+func (Dialect) Types() sqlstore.Types {
+	return sqlstore.Types{
+		String:     "NVARCHAR(255)",
+		Text:       "NVARCHAR(MAX)",
+		Integer:    "INT",
+		BigInteger: "BIGINT",
+		Timestamp:  "DATETIME2(6)",
+		Now:        "SYSUTCDATETIME()",
+	}
+}
+
+// CreateTableIfNotExists guards CREATE TABLE with OBJECT_ID, since SQL Server
+// has no IF NOT EXISTS clause for tables.
+func (Dialect) CreateTableIfNotExists(table string, defs []string) string {
+	return fmt.Sprintf("IF OBJECT_ID(N'%s', N'U') IS NULL\n"+
+		"CREATE TABLE %s (\n\t%s\n)", table, table,
+		strings.Join(defs, ",\n\t"))
+}
+
+// AddColumn omits the COLUMN keyword, which SQL Server doesn't accept.
+func (Dialect) AddColumn(table, def string) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD %s", table, def)
+}
+
+func (Dialect) IsTableExists(err error) bool {
+	return isMSSQLErr(err, errObjectExists)
+}
+
+func (Dialect) IsTableMissing(err error) bool {
+	return isMSSQLErr(err, errInvalidObject)
+}
+
+func (Dialect) UpsertMigration(table string, cols []string) string {
+	return fmt.Sprintf(`
+		MERGE %s WITH (HOLDLOCK) AS t
+		USING (SELECT %s) AS s
+		ON t.filename = s.filename
+		WHEN MATCHED THEN
+			UPDATE SET %s
+		WHEN NOT MATCHED THEN
+			INSERT (%s)
+			VALUES (%s);`, table, sqlstore.JoinColumns(cols, "? AS %s"),
+		sqlstore.JoinColumns(cols[1:], "%[1]s=s.%[1]s"),
+		strings.Join(cols, ", "), sqlstore.JoinColumns(cols, "s.%s"))
+}
+
+// RenameColumn uses sp_rename, since SQL Server has no RENAME COLUMN.
+func (Dialect) RenameColumn(table, from, to, def string) string {
+	return fmt.Sprintf("EXEC sp_rename N'%s.%s', N'%s', N'COLUMN'", table,
+		from, to)
+}
+
+// UpgradeToV1 migrates existing meta tables to the v1 format. Complete any
+// migrations before running this function; this will not succeed if have any
+// existing metacheckpoints.
+func (Dialect) UpgradeToV1(
+	ctx context.Context,
+	db *sqlx.DB,
+	migrations []migrate.Migration,
+) (err error) {
+	// Begin Tx
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	// Remove the uniqueness constraint from md5. SQL Server generates the
+	// constraint's name, so look it up first.
+	q := `
+	DECLARE @name SYSNAME;
+	SELECT @name = kc.name
+	FROM sys.key_constraints kc
+	JOIN sys.index_columns ic
+		ON ic.object_id = kc.parent_object_id
+		AND ic.index_id = kc.unique_index_id
+	JOIN sys.columns c
+		ON c.object_id = ic.object_id AND c.column_id = ic.column_id
+	WHERE kc.parent_object_id = OBJECT_ID(N'meta')
+		AND kc.type = 'UQ' AND c.name = 'md5';
+	IF @name IS NOT NULL
+		EXEC('ALTER TABLE meta DROP CONSTRAINT ' + QUOTENAME(@name));`
+	if _, err = tx.ExecContext(ctx, q); err != nil {
+		err = errors.Wrap(err, "remove md5 unique")
+		return
+	}
+
+	// Add a content column to record the exact migration that ran
+	// alongside the md5, insert the appropriate data, then set not null
+	q = `ALTER TABLE meta ADD content NVARCHAR(MAX)`
+	if _, err = tx.ExecContext(ctx, q); err != nil {
+		err = errors.Wrap(err, "add content column")
+		return
+	}
+	for _, m := range migrations {
+		q = `UPDATE meta SET content=@p1 WHERE filename=@p2`
+		_, err = tx.ExecContext(ctx, q, m.Content, m.Filename)
+		if err != nil {
+			err = errors.Wrap(err, "update meta content")
+			return
+		}
+	}
+	q = `ALTER TABLE meta ALTER COLUMN content NVARCHAR(MAX) NOT NULL`
+	if _, err = tx.ExecContext(ctx, q); err != nil {
+		err = errors.Wrap(err, "update meta content not null")
+		return
+	}
+
+	// Add the content column to metacheckpoints
+	q = `
+	IF COL_LENGTH(N'metacheckpoints', N'content') IS NULL
+	ALTER TABLE metacheckpoints ADD content NVARCHAR(MAX) NOT NULL`
+	if _, err = tx.ExecContext(ctx, q); err != nil {
+		err = errors.Wrap(err, "add metacheckpoints content")
+		return
+	}
+
+	q = `
+	IF OBJECT_ID(N'metaversion', N'U') IS NULL
+	CREATE TABLE metaversion (version INT NOT NULL)`
+	if _, err = tx.ExecContext(ctx, q); err != nil {
+		err = errors.Wrap(err, "create metaversion table")
+		return
+	}
+	return sqlstore.SetVersion(ctx, tx, "metaversion", 0, 1)
+}
+
+// isMSSQLErr reports whether err is a SQL Server error with one of the given
+// error numbers.
+func isMSSQLErr(err error, numbers ...int32) bool {
+	var msErr interface{ SQLErrorNumber() int32 }
+	if !errors.As(err, &msErr) {
+		return false
+	}
+	for _, n := range numbers {
+		if msErr.SQLErrorNumber() == n {
+			return true
+		}
+	}
+	return false
+}
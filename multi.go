@@ -0,0 +1,268 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// DefaultConcurrency is how many stores MigrateAll migrates at once when
+// WithConcurrency isn't given.
+const DefaultConcurrency = 4
+
+// WithConcurrency sets how many stores MigrateAll migrates at once. It has no
+// effect on a single Migrate.
+func WithConcurrency(n int) Option {
+	return func(m *Migrate) { m.concurrency = n }
+}
+
+// WithContinueOnError makes MigrateAll migrate every store even after one
+// fails. By default it starts no more stores once one fails, leaving those it
+// has started to finish. It has no effect on a single Migrate.
+func WithContinueOnError() Option {
+	return func(m *Migrate) { m.continueOnError = true }
+}
+
+// WithStoreNames names the stores given to MigrateAll, such as after the shards
+// or tenants they hold, in its report and logs. names must be as long as
+// stores. It has no effect on a single Migrate.
+func WithStoreNames(names []string) Option {
+	return func(m *Migrate) { m.storeNames = names }
+}
+
+// MultiReport is the outcome of MigrateAll, with a StoreReport for each store
+// in the order they were given. It marshals to JSON, and WriteTable renders it
+// for a terminal.
+type MultiReport struct {
+	Stores []StoreReport `json:"stores"`
+}
+
+// StoreReport is the outcome of migrating one store in MigrateAll.
+type StoreReport struct {
+	// Index is the position of the store in the stores given to
+	// MigrateAll.
+	Index int `json:"index"`
+
+	// Name is the store's name from WithStoreNames, or empty.
+	Name string `json:"name,omitempty"`
+
+	// Files describes each file which ran, including one which failed.
+	Files    []FileResult  `json:"files"`
+	Duration time.Duration `json:"duration"`
+
+	// Skipped reports that the store wasn't migrated since another
+	// failed first.
+	Skipped bool `json:"skipped,omitempty"`
+
+	// Err is why the store failed, or nil. It marshals to JSON as Error.
+	Err   error  `json:"-"`
+	Error string `json:"error,omitempty"`
+}
+
+// Status summarizes the report in a word: ok, failed or skipped.
+func (r StoreReport) Status() string {
+	switch {
+	case r.Failed():
+		return "failed"
+	case r.Skipped:
+		return "skipped"
+	}
+	return "ok"
+}
+
+// Failed reports whether the store failed, including in a report read back
+// from JSON, which has only Error.
+func (r StoreReport) Failed() bool {
+	return r.Err != nil || r.Error != ""
+}
+
+// String names the store by its Name, or else its Index.
+func (r StoreReport) String() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return fmt.Sprintf("store %d", r.Index)
+}
+
+// MarshalJSON adds each store's Status.
+func (r StoreReport) MarshalJSON() ([]byte, error) {
+	type report StoreReport
+	return json.Marshal(struct {
+		report
+		Status string `json:"status"`
+	}{report(r), r.Status()})
+}
+
+// WriteTable writes a row for each store to w, listing the files it applied.
+func (r *MultiReport) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STORE\tSTATUS\tDURATION\tAPPLIED\tERROR")
+	for _, s := range r.Stores {
+		files := make([]string, 0, len(s.Files))
+		for _, f := range s.Files {
+			if f.Applied {
+				files = append(files, f.Filename)
+			}
+		}
+		applied := strings.Join(files, ",")
+		if applied == "" {
+			applied = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", s, s.Status(),
+			s.Duration.Round(time.Millisecond), applied, s.Error)
+	}
+	return tw.Flush()
+}
+
+// Failed reports the stores which failed.
+func (r *MultiReport) Failed() []StoreReport {
+	var failed []StoreReport
+	for _, s := range r.Stores {
+		if s.Failed() {
+			failed = append(failed, s)
+		}
+	}
+	return failed
+}
+
+// MigrateAll runs the migrations in dir against each of stores, as New and
+// Migrate would, migrating up to WithConcurrency stores at once. Each store
+// keeps its own meta tables and lock, so running MigrateAll again after a
+// failure resumes each store from where it stopped. Each store is opened and
+// closed by MigrateAll, and its logs are prefixed with its name or index.
+//
+// The report describes every store, and the returned error joins the errors
+// of those which failed, each prefixed with the store's name or index.
+func MigrateAll(
+	ctx context.Context,
+	stores []Store,
+	log Logger,
+	dbt DBType,
+	dir string,
+	opts ...Option,
+) (*MultiReport, error) {
+	fsys, err := dirFS(dir)
+	if err != nil {
+		return nil, err
+	}
+	return MigrateAllFS(ctx, stores, log, dbt, fsys, opts...)
+}
+
+// MigrateAllFS is MigrateAll with the files at the root of fsys, as NewFS
+// reads them.
+func MigrateAllFS(
+	ctx context.Context,
+	stores []Store,
+	log Logger,
+	dbt DBType,
+	fsys fs.FS,
+	opts ...Option,
+) (*MultiReport, error) {
+	conf := &Migrate{concurrency: DefaultConcurrency}
+	for _, opt := range opts {
+		opt(conf)
+	}
+	if err := conf.refuseDryRun("MigrateAll"); err != nil {
+		return nil, err
+	}
+	if conf.concurrency < 1 {
+		return nil, fmt.Errorf("concurrency %d must be at least 1",
+			conf.concurrency)
+	}
+	if conf.storeNames != nil && len(conf.storeNames) != len(stores) {
+		return nil, fmt.Errorf("%d store names for %d stores",
+			len(conf.storeNames), len(stores))
+	}
+
+	report := &MultiReport{Stores: make([]StoreReport, len(stores))}
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed bool
+	)
+	sem := make(chan struct{}, conf.concurrency)
+	for i, db := range stores {
+		report.Stores[i].Index = i
+		if conf.storeNames != nil {
+			report.Stores[i].Name = conf.storeNames[i]
+		}
+		sem <- struct{}{}
+		mu.Lock()
+		stop := failed && !conf.continueOnError
+		mu.Unlock()
+		if stop || ctx.Err() != nil {
+			<-sem
+			report.Stores[i].Skipped = true
+			continue
+		}
+		wg.Add(1)
+		go func(i int, db Store) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			rep := &report.Stores[i]
+			start := time.Now()
+			rep.Files, rep.Err = migrateStore(ctx, db,
+				prefixLogger{log: log, prefix: rep.String() + ": "},
+				dbt, fsys, opts)
+			rep.Duration = time.Since(start)
+			if rep.Err != nil {
+				rep.Error = rep.Err.Error()
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+			}
+		}(i, db)
+	}
+	wg.Wait()
+
+	var errs []error
+	for _, s := range report.Stores {
+		if s.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s, s.Err))
+		}
+	}
+	return report, errors.Join(errs...)
+}
+
+// migrateStore opens db and migrates it, reporting the files which ran.
+func migrateStore(
+	ctx context.Context,
+	db Store,
+	log Logger,
+	dbt DBType,
+	fsys fs.FS,
+	opts []Option,
+) ([]FileResult, error) {
+	if err := db.Open(ctx); err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	defer db.Close()
+	m, err := NewFS(ctx, db, log, dbt, fsys, "", opts...)
+	if err != nil {
+		return nil, fmt.Errorf("new: %w", err)
+	}
+	_, err = m.Migrate(ctx)
+	return m.Results, err
+}
+
+// prefixLogger prefixes each line logged to log.
+type prefixLogger struct {
+	log    Logger
+	prefix string
+}
+
+func (l prefixLogger) Printf(s string, vs ...interface{}) {
+	l.log.Printf(l.prefix+s, vs...)
+}
+
+func (l prefixLogger) Println(vs ...interface{}) {
+	l.log.Println(append([]interface{}{strings.TrimSpace(l.prefix)},
+		vs...)...)
+}
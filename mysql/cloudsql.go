@@ -0,0 +1,59 @@
+package mysql
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"cloud.google.com/go/cloudsqlconn"
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+)
+
+// cloudSQLNets counts the networks registered with the driver, so each
+// NewCloudSQL gets its own dialer.
+var cloudSQLNets int64
+
+// cloudSQLDialer is the part of *cloudsqlconn.Dialer used by the store.
+type cloudSQLDialer interface {
+	Dial(ctx context.Context, icn string,
+		opts ...cloudsqlconn.DialOption) (net.Conn, error)
+	Close() error
+}
+
+// NewCloudSQL prepares a connection to a Cloud SQL instance through the
+// Cloud SQL Go Connector, which handles TLS certificates and, with
+// cloudsqlconn.WithIAMAuthN, IAM authentication. instanceConnectionName looks
+// like project:region:instance. Self-managed MySQL servers should use New
+// with certificate files instead.
+func NewCloudSQL(
+	instanceConnectionName, user, dbName string,
+	opts ...cloudsqlconn.Option,
+) (*DB, error) {
+	d, err := cloudsqlconn.NewDialer(context.Background(), opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "new cloud sql dialer")
+	}
+	return newCloudSQL(instanceConnectionName, user, dbName, d), nil
+}
+
+func newCloudSQL(icn, user, dbName string, d cloudSQLDialer) *DB {
+	netName := fmt.Sprintf("cloudsql-%d", atomic.AddInt64(&cloudSQLNets, 1))
+	mysql.RegisterDialContext(netName,
+		func(ctx context.Context, addr string) (net.Conn, error) {
+			return d.Dial(ctx, addr)
+		})
+
+	cfg := newConfig(user, "", netName, icn, dbName, nil)
+
+	// IAM authentication sends its token as a cleartext password. The
+	// connector encrypts the connection itself.
+	cfg.AllowCleartextPasswords = true
+
+	return &DB{
+		connURL: cfg.FormatDSN(),
+		timeout: cfg.Timeout,
+		dialer:  d,
+	}
+}
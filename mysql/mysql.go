@@ -1,173 +1,342 @@
 package mysql
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
-	"os"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 	"github.com/thankful-ai/migrate"
+	"github.com/thankful-ai/migrate/sqlstore"
 )
 
+const (
+	// errTableExists is ER_TABLE_EXISTS_ERROR, reported by both MySQL and
+	// TiDB when creating a table that already exists.
+	errTableExists = 1050
+
+	// errBadDB and errNoSuchTable are ER_BAD_DB_ERROR and
+	// ER_NO_SUCH_TABLE, reported when selecting from a table whose
+	// database or itself doesn't exist.
+	errBadDB       = 1049
+	errNoSuchTable = 1146
+
+	// errDupFieldName is ER_DUP_FIELDNAME, reported when adding a column
+	// that already exists.
+	errDupFieldName = 1060
+
+	// errLockWaitTimeout and errLockDeadlock are ER_LOCK_WAIT_TIMEOUT and
+	// ER_LOCK_DEADLOCK, reported when a statement competes for locks with
+	// other sessions.
+	errLockWaitTimeout = 1205
+	errLockDeadlock    = 1213
+
+	// errDBAccessDenied and errTableAccessDenied are
+	// ER_DBACCESS_DENIED_ERROR and ER_TABLEACCESS_DENIED_ERROR, reported
+	// when the user lacks a privilege on a database or table.
+	errDBAccessDenied    = 1044
+	errTableAccessDenied = 1142
+
+	// errServerGone and errServerLost are CR_SERVER_GONE_ERROR and
+	// CR_SERVER_LOST, reported by proxies in front of MySQL when the
+	// server's connection drops.
+	errServerGone = 2006
+	errServerLost = 2013
+)
+
+// maxIdentifier is the longest table name MySQL accepts.
+const maxIdentifier = 64
+
 type DB struct {
 	connURL   string
 	tlsConfig *tlsConfig
+	tidb      bool
+	pool      sqlstore.PoolConfig
+
+	// tablePrefix is prepended to the names of the meta tables, which are
+	// kept in metaDatabase if it's set
+	tablePrefix  string
+	metaDatabase string
+
+	// timeout bounds the Ping in Open, falling back to DefaultDialTimeout
+	timeout time.Duration
+
+	// connector, when set, dials instead of connURL
+	connector driver.Connector
+
+	// dialer is closed with the database, if set
+	dialer io.Closer
 
-	// Embed the sqlx DB struct
-	*sqlx.DB
+	// connID is the connection id of the last statement run with a
+	// deadline, for KillQuery
+	connID atomic.Int64
+
+	// warnings enables SHOW WARNINGS after each statement, recording
+	// them in lastWarnings
+	warnings     bool
+	lastWarnings []migrate.Warning
+
+	// sqlMode is the session's sql_mode, read by Open, which Splitter
+	// reads quotes by
+	sqlMode string
+
+	// Embed the generic SQL store
+	*sqlstore.Store
 }
 
+// Default character set and collation of connections, so migrations
+// containing 4-byte UTF-8 such as emoji survive intact.
+const (
+	DefaultCharset   = "utf8mb4"
+	DefaultCollation = "utf8mb4_unicode_ci"
+)
+
+// DefaultDialTimeout bounds how long connecting to the database may take.
+// Reads and writes have no timeout by default, so long-running DDL isn't
+// cut off.
+const DefaultDialTimeout = 10 * time.Second
+
+// Option configures the connection built by New and NewUnixSocket.
+type Option func(*mysql.Config)
+
+// WithCharset sets the character set and collation of the connection,
+// replacing DefaultCharset and DefaultCollation.
+func WithCharset(charset, collation string) Option {
+	return func(cfg *mysql.Config) {
+		cfg.Params["charset"] = charset
+		cfg.Collation = collation
+	}
+}
+
+// WithTimeouts sets the dial, read and write timeouts of the connection,
+// replacing DefaultDialTimeout. Zero disables a timeout. A read timeout must
+// be longer than the slowest statement in any migration.
+func WithTimeouts(dial, read, write time.Duration) Option {
+	return func(cfg *mysql.Config) {
+		cfg.Timeout = dial
+		cfg.ReadTimeout = read
+		cfg.WriteTimeout = write
+	}
+}
+
+// WithMultiStatements allows several statements in one Exec, which
+// migrations beginning with "-- migrate:multi" or "-- migrate:no-split"
+// require, since they run as a single batch.
+func WithMultiStatements() Option {
+	return func(cfg *mysql.Config) {
+		cfg.MultiStatements = true
+	}
+}
+
+// New prepares a TCP connection to a MySQL database. TLS is used if sslKey is
+// provided, in which case sslCert, sslCA and sslServerName are required.
+//
+// If host begins with a /, it's treated as the path to a unix socket as with
+// NewUnixSocket, and port is ignored.
 func New(
 	user, pass, host, dbName string,
 	port int,
 	sslKey, sslCert, sslCA, sslServerName string,
+	opts ...Option,
 ) (*DB, error) {
-	db := &DB{}
-	db.connURL = fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true", user,
-		pass, host, port, dbName)
-	if sslKey != "" {
-		if sslServerName == "" {
-			return nil, errors.New("ssl server name required if ssl key is provided")
-		}
-		if sslCert == "" {
-			return nil, errors.New("client ssl cert is required if ssl key is provided")
-		}
-		if sslCA == "" {
-			return nil, errors.New("server ca cert is required if ssl key is provided")
+	if strings.HasPrefix(host, "/") {
+		if sslKey != "" || sslCert != "" || sslCA != "" ||
+			sslServerName != "" {
+			return nil, errors.New("ssl does not apply to unix socket connections")
 		}
+		return NewUnixSocket(user, pass, host, dbName, opts...)
+	}
 
-		db.connURL = fmt.Sprintf("%s&tls=%s", db.connURL, sslServerName)
-		var err error
-		db.tlsConfig, err = newTLSConfig(dbName, sslKey,
-			sslCert, sslCA, sslServerName)
-		if err != nil {
-			return nil, errors.Wrap(err, "new tls config")
+	cfg := newConfig(user, pass, "tcp",
+		net.JoinHostPort(host, strconv.Itoa(port)), dbName, opts)
+	var files *TLSFiles
+	if sslKey != "" {
+		files = &TLSFiles{
+			Key:        sslKey,
+			Cert:       sslCert,
+			CA:         sslCA,
+			ServerName: sslServerName,
 		}
 	}
-	return db, nil
+	return NewFromConfig(cfg, files)
 }
 
-func (db *DB) CreateMetaVersionIfNotExists(schemaVersion int) (int, error) {
-	created := true
-	q := `CREATE TABLE metaversion (
-		version INTEGER NOT NULL
-	)`
-	_, err := db.Exec(q)
-	if err != nil {
-		// Check if the table already existed
-		if !strings.Contains(err.Error(), "Error 1050:") {
-			return 0, errors.Wrap(err, "create metaversion table")
-		}
-		created = false
+// NewUnixSocket prepares a connection over a unix socket, such as the one the
+// Cloud SQL auth proxy listens on at /cloudsql/project:region:instance.
+func NewUnixSocket(
+	user, pass, socketPath, dbName string,
+	opts ...Option,
+) (*DB, error) {
+	cfg := newConfig(user, pass, "unix", socketPath, dbName, opts)
+	return NewFromConfig(cfg, nil)
+}
+
+// newConfig returns the driver config shared by the constructors, with
+// opts applied.
+func newConfig(
+	user, pass, network, addr, dbName string,
+	opts []Option,
+) *mysql.Config {
+	cfg := mysql.NewConfig()
+	cfg.User = user
+	cfg.Passwd = pass
+	cfg.Net = network
+	cfg.Addr = addr
+	cfg.DBName = dbName
+	cfg.ParseTime = true
+	cfg.Params = map[string]string{"charset": DefaultCharset}
+	cfg.Collation = DefaultCollation
+	cfg.Timeout = DefaultDialTimeout
+	for _, opt := range opts {
+		opt(cfg)
 	}
+	return cfg
+}
 
-	var version int
-	q = `SELECT version FROM metaversion`
-	err = db.Get(&version, q)
-	switch {
-	case err == sql.ErrNoRows:
-		if !created {
-			schemaVersion = 0
-		}
-		q = `INSERT INTO metaversion (version) VALUES (?)`
-		if _, err := db.Exec(q, schemaVersion); err != nil {
-			return 0, errors.Wrap(err, "insert version")
-		}
-		return schemaVersion, nil
-	case err != nil:
-		return 0, errors.Wrap(err, "get version")
+// NewFromConfig prepares a connection from a go-sql-driver config, which can
+// express any of the driver's options. When files is provided, the
+// connection uses TLS and any TLSConfig in cfg is replaced.
+func NewFromConfig(cfg *mysql.Config, files *TLSFiles) (*DB, error) {
+	cfg = cfg.Clone()
+
+	// The driver escapes the database name in the DSN but not the
+	// credentials. Passwords may contain anything, since the DSN is split
+	// on the last '@', but the user name ends at the first ':'.
+	if strings.ContainsRune(cfg.User, ':') {
+		return nil, errors.New("user must not contain ':'")
 	}
-	return version, nil
+	if files == nil {
+		return &DB{connURL: cfg.FormatDSN(), timeout: cfg.Timeout}, nil
+	}
+	if files.ServerName == "" {
+		return nil, errors.New("ssl server name required if ssl key is provided")
+	}
+	if files.Cert == "" {
+		return nil, errors.New("client ssl cert is required if ssl key is provided")
+	}
+	if files.CA == "" {
+		return nil, errors.New("server ca cert is required if ssl key is provided")
+	}
+	return newWithTLS(cfg, TLSOptions{
+		CAFile:         files.CA,
+		ClientCertFile: files.Cert,
+		ClientKeyFile:  files.Key,
+		ServerName:     files.ServerName,
+	})
 }
 
-func (db *DB) CreateMetaIfNotExists() error {
-	q := `CREATE TABLE IF NOT EXISTS meta (
-		filename VARCHAR(255) UNIQUE NOT NULL,
-		md5 VARCHAR(255) NOT NULL,
-		content TEXT NOT NULL,
-		createdat DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)
-	)`
-	if _, err := db.Exec(q); err != nil {
-		return errors.Wrap(err, "create meta table")
+// NewFromDSN prepares a connection from a go-sql-driver data source name,
+// such as user:pass@tcp(host:3306)/db?parseTime=true.
+func NewFromDSN(dsn string) (*DB, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse dsn")
 	}
-	return nil
+	return NewFromConfig(cfg, nil)
 }
 
-func (db *DB) CreateMetaCheckpointsIfNotExists() error {
-	q := `CREATE TABLE IF NOT EXISTS metacheckpoints (
-		filename VARCHAR(255) NOT NULL,
-		idx INTEGER NOT NULL,
-		md5 VARCHAR(255) NOT NULL,
-		content TEXT NOT NULL,
-		createdat DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
-		PRIMARY KEY (filename, idx)
-	)`
-	if _, err := db.Exec(q); err != nil {
-		return errors.Wrap(err, "create metacheckpoints table")
+// Dialect describes MySQL's SQL to sqlstore.
+type Dialect struct {
+	// tablePrefix is prepended to the names of the meta tables, which are
+	// qualified with metaDatabase if it's set
+	tablePrefix  string
+	metaDatabase string
+}
+
+// Tables names the meta tables with the dialect's prefix and database,
+// quoted.
+func (d Dialect) Tables() sqlstore.Tables {
+	return sqlstore.Tables{
+		Meta:        d.table("meta"),
+		Checkpoints: d.table("metacheckpoints"),
+		Version:     d.table("metaversion"),
+		History:     d.table("metahistory"),
+		Lock:        d.table("metalock"),
 	}
-	return nil
 }
 
-func (db *DB) GetMigrations() ([]migrate.Migration, error) {
-	migrations := []migrate.Migration{}
-	q := `
-	SELECT filename, content, md5 AS checksum
-	FROM meta
-	ORDER BY filename * 1`
-	err := db.Select(&migrations, q)
-	return migrations, err
+func (d Dialect) table(name string) string {
+	name = quoteIdentifier(d.tablePrefix + name)
+	if d.metaDatabase == "" {
+		return name
+	}
+	return quoteIdentifier(d.metaDatabase) + "." + name
+}
+
+// quoteIdentifier quotes a name checked by sqlstore.ValidateIdentifier, so it
+// can't contain a backtick.
+func quoteIdentifier(name string) string { return "`" + name + "`" }
+
+func (Dialect) BindType() int { return sqlx.QUESTION }
 
+func (Dialect) Types() sqlstore.Types {
+	return sqlstore.Types{
+		String:     "VARCHAR(255)",
+		Text:       "MEDIUMTEXT",
+		Integer:    "INTEGER",
+		BigInteger: "BIGINT",
+		Timestamp:  "DATETIME(6)",
+		Now:        "CURRENT_TIMESTAMP(6)",
+	}
 }
 
-func (db *DB) GetMetaCheckpoints(filename string) ([]string, error) {
-	checkpoints := []string{}
-	q := `SELECT md5 FROM metacheckpoints WHERE filename=? ORDER BY idx`
-	err := db.Select(&checkpoints, q, filename)
-	return checkpoints, err
+// CreateTableIfNotExists sets the table's character set explicitly rather
+// than inheriting the database default, which may not hold 4-byte UTF-8.
+func (Dialect) CreateTableIfNotExists(table string, defs []string) string {
+	return sqlstore.CreateTableIfNotExists(table, defs) +
+		" DEFAULT CHARSET=" + DefaultCharset
 }
 
-func (db *DB) UpsertMigration(filename, content, checksum string) error {
-	q := `
-		INSERT INTO meta (filename, content, md5) VALUES (?, ?, ?)
-		ON DUPLICATE KEY UPDATE md5=?, content=?`
-	_, err := db.Exec(q, filename, content, checksum, checksum, content)
-	return err
+func (Dialect) IsTableExists(err error) bool {
+	return isMySQLErr(err, errTableExists)
 }
 
-func (db *DB) InsertMetaCheckpoint(
-	filename, content, checksum string,
-	idx int,
-) error {
-	q := `
-		INSERT INTO metacheckpoints (filename, content, idx, md5)
-		VALUES (?, ?, ?, ?)`
-	_, err := db.Exec(q, filename, content, idx, checksum)
-	return err
+// IsTableMissing covers a missing meta database too, since SetMetaDatabase's
+// database is only created along with the meta tables.
+func (Dialect) IsTableMissing(err error) bool {
+	return isMySQLErr(err, errBadDB, errNoSuchTable)
 }
 
-func (db *DB) InsertMigration(filename, content, checksum string) error {
-	q := `INSERT INTO meta (filename, content, md5) VALUES (?, ?, ?)`
-	_, err := db.Exec(q, filename, content, checksum)
-	return err
+func (Dialect) UpsertMigration(table string, cols []string) string {
+	return fmt.Sprintf(`
+		INSERT INTO %s (%s) VALUES (%s)
+		ON DUPLICATE KEY UPDATE %s`, table, strings.Join(cols, ", "),
+		sqlstore.Placeholders(len(cols)),
+		sqlstore.JoinColumns(cols[1:], "%[1]s=VALUES(%[1]s)"))
 }
 
-func (db *DB) DeleteMetaCheckpoints() error {
-	q := `DELETE FROM metacheckpoints`
-	_, err := db.Exec(q)
-	return err
+// RenameColumn restates the column with CHANGE COLUMN, since MySQL before 8.0
+// has no RENAME COLUMN.
+func (Dialect) RenameColumn(table, from, to, def string) string {
+	return fmt.Sprintf("ALTER TABLE %s CHANGE COLUMN %s %s", table, from, def)
+}
+
+// ModifyColumn widens content from the TEXT columns of meta tables created
+// before v4, which are limited to 64KB, to MEDIUMTEXT.
+func (Dialect) ModifyColumn(table, def string) string {
+	return fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s", table, def)
 }
 
 // UpgradeToV1 migrates existing meta tables to the v1 format. Complete any
 // migrations before running this function; this will not succeed if have any
 // existing metacheckpoints.
-func (db *DB) UpgradeToV1(migrations []migrate.Migration) (err error) {
+func (d Dialect) UpgradeToV1(
+	ctx context.Context,
+	db *sqlx.DB,
+	migrations []migrate.Migration,
+) (err error) {
 	// Begin Tx
-	tx, err := db.Beginx()
+	tx, err := db.BeginTxx(ctx, nil)
 	if err != nil {
 		return errors.Wrap(err, "begin tx")
 	}
@@ -179,135 +348,449 @@ func (db *DB) UpgradeToV1(migrations []migrate.Migration) (err error) {
 		err = tx.Commit()
 	}()
 
+	t := d.Tables()
+
 	// Remove the uniqueness constraint from md5
-	q := `ALTER TABLE meta DROP INDEX md5`
-	if _, err = tx.Exec(q); err != nil {
+	q := `ALTER TABLE ` + t.Meta + ` DROP INDEX md5`
+	if _, err = tx.ExecContext(ctx, q); err != nil {
 		err = errors.Wrap(err, "remove md5 unique")
 		return
 	}
 
 	// Add a content column to record the exact migration that ran
 	// alongside the md5, insert the appropriate data, then set not null
-	q = `ALTER TABLE meta ADD COLUMN content TEXT`
-	if _, err = tx.Exec(q); err != nil {
+	q = `ALTER TABLE ` + t.Meta + ` ADD COLUMN content TEXT`
+	if _, err = tx.ExecContext(ctx, q); err != nil {
 		err = errors.Wrap(err, "add content column")
 		return
 	}
 	for _, m := range migrations {
-		q = `UPDATE meta SET content=? WHERE filename=?`
-		if _, err = tx.Exec(q, m.Content, m.Filename); err != nil {
+		q = `UPDATE ` + t.Meta + ` SET content=? WHERE filename=?`
+		_, err = tx.ExecContext(ctx, q, m.Content, m.Filename)
+		if err != nil {
 			err = errors.Wrap(err, "update meta content")
 			return
 		}
 	}
-	q = `ALTER TABLE meta MODIFY COLUMN content TEXT NOT NULL`
-	if _, err = tx.Exec(q); err != nil {
+	q = `ALTER TABLE ` + t.Meta + ` MODIFY COLUMN content TEXT NOT NULL`
+	if _, err = tx.ExecContext(ctx, q); err != nil {
 		err = errors.Wrap(err, "update meta content not null")
 		return
 	}
 
 	// Add the content column to metacheckpoints
-	q = `
-	ALTER TABLE metacheckpoints
-	ADD COLUMN content TEXT NOT NULL`
-	_, err = tx.Exec(q)
+	q = `ALTER TABLE ` + t.Checkpoints + ` ADD COLUMN content TEXT NOT NULL`
+	_, err = tx.ExecContext(ctx, q)
 	if err != nil {
 		// Ignore duplicate column errors
-		if !strings.Contains(err.Error(), "Duplicate column name") {
+		if !isMySQLErr(err, errDupFieldName) {
 			err = errors.Wrap(err, "add metacheckpoints content")
 			return
 		}
 	}
 
-	q = `
-	CREATE TABLE IF NOT EXISTS metaversion (version INTEGER NOT NULL)`
-	if _, err = tx.Exec(q); err != nil {
+	q = `CREATE TABLE IF NOT EXISTS ` + t.Version +
+		` (version INTEGER NOT NULL)`
+	if _, err = tx.ExecContext(ctx, q); err != nil {
 		err = errors.Wrap(err, "create metaversion table")
 		return
 	}
-	q = `DELETE FROM metaversion`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "delete metaversion")
-		return
-	}
-	q = `INSERT INTO metaversion (version) VALUES (1)`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "insert metaversion")
-		return
-	}
-	return nil
+	return sqlstore.SetVersion(ctx, tx, t.Version, 0, 1)
 }
 
-func (db *DB) Close() error { return db.DB.Close() }
-
-func (db *DB) Open() error {
+// Open the database, returning an error if it can't be reached within
+// ctx's deadline or the dial timeout.
+func (db *DB) Open(ctx context.Context) error {
 	if db.tlsConfig != nil {
-		err := mysql.RegisterTLSConfig(db.tlsConfig.ServerName,
+		err := mysql.RegisterTLSConfig(db.tlsConfig.Name,
 			db.tlsConfig.Config)
 		if err != nil {
 			return errors.Wrap(err, "register tls config")
 		}
 	}
+	var d sqlstore.Dialect = db.dialect()
+	if db.tidb {
+		d = TiDBDialect{db.dialect()}
+	}
+	if db.connector != nil {
+		db.Store = sqlstore.New(sql.OpenDB(db.connector), d)
+	} else {
+		var err error
+		db.Store, err = sqlstore.Open("mysql", db.connURL, d)
+		if err != nil {
+			return err
+		}
+	}
+	db.pool.Apply(db.DB.DB)
+
+	// Connections are made lazily, so check the database is reachable
+	// now rather than on the first migration
+	timeout := db.timeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := db.DB.PingContext(ctx); err != nil {
+		_ = db.Close()
+		return pingErr(err)
+	}
+
+	// If the mode can't be read, files are split as MySQL reads quotes by
+	// default
+	db.sqlMode = ""
+	_ = db.GetContext(ctx, &db.sqlMode, "SELECT @@SESSION.sql_mode")
+	return nil
+}
+
+func (db *DB) dialect() Dialect {
+	return Dialect{
+		tablePrefix:  db.tablePrefix,
+		metaDatabase: db.metaDatabase,
+	}
+}
+
+// pingErr wraps failures to connect at all in migrate.ErrConnectionFailed. A
+// MySQL error means the server answered, such as to deny access, so isn't
+// worth waiting on in migrate.WaitForStore.
+func pingErr(err error) error {
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		return errors.Wrap(err, "ping")
+	}
+	return fmt.Errorf("%w: %w", migrate.ErrConnectionFailed, err)
+}
+
+// Close the database and any dialer it owns.
+func (db *DB) Close() error {
 	var err error
-	db.DB, err = sqlx.Open("mysql", db.connURL)
+	if db.Store != nil {
+		err = db.Store.Close()
+	}
+	if db.dialer != nil {
+		if dErr := db.dialer.Close(); err == nil {
+			err = dErr
+		}
+	}
+	return err
+}
+
+// Exec a statement. Lost connections wrap migrate's connection errors. With
+// TiDB, a DDL job which TiDB cancelled after repeated failures is reported
+// with a clearer error, since the driver's message doesn't say why the
+// statement failed.
+//
+// If ctx has a deadline, the statement runs on a connection whose id is
+// recorded first, so KillQuery can stop it on the server. Warnings are read
+// from the same connection.
+func (db *DB) Exec(
+	ctx context.Context,
+	q string,
+	args ...interface{},
+) (sql.Result, error) {
+	var res sql.Result
+	var err error
+	db.lastWarnings = nil
+	if _, ok := ctx.Deadline(); ok || db.warnings {
+		res, err = db.execOnConn(ctx, q, args...)
+	} else {
+		res, err = db.Store.Exec(ctx, q, args...)
+	}
+	err = translateErr(err)
+	if db.tidb {
+		err = wrapTiDBErr(err)
+	}
+	return res, err
+}
+
+func (db *DB) execOnConn(
+	ctx context.Context,
+	q string,
+	args ...interface{},
+) (sql.Result, error) {
+	conn, err := db.DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var id int64
+	err = conn.QueryRowContext(ctx, `SELECT CONNECTION_ID()`).Scan(&id)
+	if err != nil {
+		return nil, errors.Wrap(err, "get connection id")
+	}
+	db.connID.Store(id)
+	res, err := conn.ExecContext(ctx, q, args...)
+	if err != nil || !db.warnings {
+		return res, err
+	}
+	db.lastWarnings, err = showWarnings(ctx, conn)
+	if err != nil {
+		return nil, errors.Wrap(err, "show warnings")
+	}
+	return res, nil
+}
+
+func showWarnings(
+	ctx context.Context,
+	conn *sql.Conn,
+) ([]migrate.Warning, error) {
+	rows, err := conn.QueryContext(ctx, `SHOW WARNINGS`)
 	if err != nil {
-		return errors.Wrap(err, "open db connection")
+		return nil, err
+	}
+	defer rows.Close()
+	var ws []migrate.Warning
+	for rows.Next() {
+		var w migrate.Warning
+		if err = rows.Scan(&w.Level, &w.Code, &w.Message); err != nil {
+			return nil, err
+		}
+		ws = append(ws, w)
+	}
+	return ws, rows.Err()
+}
+
+// SetWarnings enables reading MySQL's warnings after each statement, which
+// migrate logs and, with migrate.WithStrictWarnings, treats as errors. Each
+// statement reserves a connection from the pool to run SHOW WARNINGS on.
+func (db *DB) SetWarnings(enabled bool) { db.warnings = enabled }
+
+// Warnings from the last statement Exec ran, if SetWarnings is enabled.
+func (db *DB) Warnings() []migrate.Warning { return db.lastWarnings }
+
+// Splitter splits migrations into statements as the session's sql_mode reads
+// quotes, such as with NO_BACKSLASH_ESCAPES or ANSI_QUOTES, or as MySQL does by
+// default if it couldn't be read.
+func (db *DB) Splitter() migrate.Splitter {
+	return migrate.SplitterForSQLMode(db.sqlMode)
+}
+
+// MultiStatements reports whether the connection was opened with
+// multiStatements, as WithMultiStatements sets.
+func (db *DB) MultiStatements() bool {
+	cfg, err := mysql.ParseDSN(db.connURL)
+	return err == nil && cfg.MultiStatements
+}
+
+// regexImplicitCommit matches the start of a statement which MySQL commits
+// the transaction in progress before running: DDL, other than of temporary
+// tables, statements changing users and privileges, locking, transaction
+// control and administration.
+var regexImplicitCommit = regexp.MustCompile(`(?is)^` +
+	`(?:\s*/\*[^!].*?\*/|\s*(?:--|#)[^\n]*\n)*\s*(` +
+	`(alter|create|drop|rename)\s+` +
+	`(?:(?:or\s+replace|unique|online|offline|fulltext|spatial|aggregate|` +
+	`definer\s*=\s*\S+|algorithm\s*=\s*\S+|sql\s+security\s+\S+)\s+)*` +
+	`(database|schema|event|function|index|procedure|server|table|` +
+	`tablespace|trigger|view|user|role|logfile|spatial|resource|` +
+	`instance|sequence)\b|` +
+	`truncate|grant|revoke|set\s+password|set\s+default\s+role|` +
+	`set\s+(?:@@(?:session\.)?)?autocommit|` +
+	`lock\s+(tables?|instance)|unlock\s+(tables?|instance)|` +
+	`begin|start\s+transaction|commit|rollback|` +
+	`analyze|cache\s+index|check\s+table|flush|load\s+index|optimize|` +
+	`repair|reset|install|uninstall|change\s+(master|replication)|` +
+	`start\s+(slave|replica|group_replication)|` +
+	`stop\s+(slave|replica|group_replication))\b`)
+
+// CommitsImplicitly reports whether MySQL commits the transaction in progress
+// before running stmt, such as most DDL, other than creating or dropping a
+// temporary table.
+func (db *DB) CommitsImplicitly(stmt string) bool {
+	return regexImplicitCommit.MatchString(strings.TrimSpace(stmt))
+}
+
+// KillQuery stops the last statement Exec ran with a deadline. The driver
+// only closes the connection when ctx expires, which MySQL may not notice
+// until a long ALTER finishes.
+func (db *DB) KillQuery(ctx context.Context) error {
+	id := db.connID.Load()
+	if id == 0 {
+		return errors.New("no statement to kill")
+	}
+	_, err := db.DB.ExecContext(ctx, fmt.Sprintf("KILL QUERY %d", id))
+	return err
+}
+
+// Reconnect replaces the database's connections, keeping any Cloud SQL dialer
+// which Close would release.
+func (db *DB) Reconnect(ctx context.Context) error {
+	if db.Store != nil {
+		_ = db.Store.Close()
+	}
+	return db.Open(ctx)
+}
+
+// SetTablePrefix prepends prefix to the names of the meta tables, so several
+// services can each track their own migrations in one database. The prefix
+// takes effect when the database is opened, and may contain only letters,
+// digits and underscores.
+func (db *DB) SetTablePrefix(prefix string) error {
+	if err := sqlstore.ValidateIdentifier(prefix); err != nil {
+		return errors.Wrap(err, "table prefix")
+	}
+	if n := len(prefix + "metacheckpoints"); n > maxIdentifier {
+		return fmt.Errorf("table prefix %q makes table names %d characters, over mysql's limit of %d",
+			prefix, n, maxIdentifier)
 	}
+	db.tablePrefix = prefix
 	return nil
 }
 
-type tlsConfig struct {
-	ServerName string
-	Config     *tls.Config
+// SetMetaDatabase keeps the meta tables in another database on the same
+// server, such as to leave them out of dumps of the application's database.
+// Migrations still run against the database the connection names. The meta
+// database is created with the meta tables if it doesn't exist, which needs
+// the CREATE privilege on it. It takes effect when the database is opened,
+// and may contain only letters, digits and underscores.
+func (db *DB) SetMetaDatabase(name string) error {
+	if err := sqlstore.ValidateIdentifier(name); err != nil {
+		return errors.Wrap(err, "meta database")
+	}
+	if len(name) > maxIdentifier {
+		return fmt.Errorf("meta database %q is over mysql's limit of %d characters",
+			name, maxIdentifier)
+	}
+	db.metaDatabase = name
+	return nil
 }
 
-func newTLSConfig(
-	dbName, keyPath, certPath, caPath, serverName string,
-) (*tlsConfig, error) {
-	rootCertPool := x509.NewCertPool()
-	pem, err := os.ReadFile(caPath)
-	if err != nil {
-		return nil, errors.Wrap(err, "read sql server cert file")
+func (db *DB) CreateMetaIfNotExists(ctx context.Context) error {
+	if err := db.createMetaDatabase(ctx); err != nil {
+		return err
+	}
+	return db.metaAccessErr(db.Store.CreateMetaIfNotExists(ctx))
+}
+
+func (db *DB) CreateMetaCheckpointsIfNotExists(ctx context.Context) error {
+	if err := db.createMetaDatabase(ctx); err != nil {
+		return err
+	}
+	return db.metaAccessErr(db.Store.CreateMetaCheckpointsIfNotExists(ctx))
+}
+
+func (db *DB) CreateMetaHistoryIfNotExists(ctx context.Context) error {
+	if err := db.createMetaDatabase(ctx); err != nil {
+		return err
+	}
+	return db.metaAccessErr(db.Store.CreateMetaHistoryIfNotExists(ctx))
+}
+
+func (db *DB) CreateMetaLockIfNotExists(ctx context.Context) error {
+	if err := db.createMetaDatabase(ctx); err != nil {
+		return err
+	}
+	return db.metaAccessErr(db.Store.CreateMetaLockIfNotExists(ctx))
+}
+
+func (db *DB) CreateMetaVersionIfNotExists(
+	ctx context.Context,
+	schemaVersion int,
+) (int, error) {
+	if err := db.createMetaDatabase(ctx); err != nil {
+		return 0, err
+	}
+	v, err := db.Store.CreateMetaVersionIfNotExists(ctx, schemaVersion)
+	return v, db.metaAccessErr(err)
+}
+
+func (db *DB) GetMetaVersion(ctx context.Context) (int, bool, error) {
+	v, exists, err := db.Store.GetMetaVersion(ctx)
+	return v, exists, db.metaAccessErr(err)
+}
+
+// createMetaDatabase creates the meta database if one is set and it doesn't
+// exist yet. Checking first lets users without the CREATE privilege use a
+// database made for them.
+func (db *DB) createMetaDatabase(ctx context.Context) error {
+	if db.metaDatabase == "" {
+		return nil
+	}
+	var n int
+	q := `SELECT COUNT(*) FROM information_schema.schemata
+		WHERE schema_name = ?`
+	if err := db.GetContext(ctx, &n, q, db.metaDatabase); err != nil {
+		return errors.Wrap(err, "check meta database")
 	}
-	if ok := rootCertPool.AppendCertsFromPEM(pem); !ok {
-		return nil, errors.New("failed to append to pem")
+	if n > 0 {
+		return nil
 	}
-	certs, err := tls.LoadX509KeyPair(certPath, keyPath)
+	q = `CREATE DATABASE IF NOT EXISTS ` + quoteIdentifier(db.metaDatabase) +
+		` DEFAULT CHARSET=` + DefaultCharset
+	if _, err := db.DB.ExecContext(ctx, q); err != nil {
+		if isMySQLErr(err, errDBAccessDenied) {
+			return fmt.Errorf("cannot create meta database %s, create it or GRANT CREATE ON `%s`.* to the migrating user: %w",
+				db.metaDatabase, db.metaDatabase, err)
+		}
+		return errors.Wrap(err, "create meta database")
+	}
+	return nil
+}
+
+// metaAccessErr explains errors from lacking privileges on a separate meta
+// database, which the grants for the application's database don't cover.
+func (db *DB) metaAccessErr(err error) error {
+	if db.metaDatabase == "" ||
+		!isMySQLErr(err, errDBAccessDenied, errTableAccessDenied) {
+		return err
+	}
+	return fmt.Errorf("missing privileges on meta database %s, GRANT CREATE, ALTER, SELECT, INSERT, UPDATE, DELETE ON `%s`.* to the migrating user: %w",
+		db.metaDatabase, db.metaDatabase, err)
+}
+
+// MaxContentSize reports the size of the smaller of the content columns of
+// meta and metacheckpoints, which is 64KB for the TEXT columns of tables from
+// before meta version 4, and 16MB for MEDIUMTEXT.
+func (db *DB) MaxContentSize(ctx context.Context) (int64, error) {
+	var size sql.NullInt64
+	q := `SELECT MIN(character_octet_length) FROM information_schema.columns
+		WHERE table_schema = COALESCE(NULLIF(?, ''), DATABASE())
+		AND table_name IN (?, ?) AND column_name = 'content'`
+	err := db.GetContext(ctx, &size, q, db.metaDatabase,
+		db.tablePrefix+"meta", db.tablePrefix+"metacheckpoints")
 	if err != nil {
-		return nil, errors.Wrap(err, "load x509 key pair")
-	}
-	clientCert := []tls.Certificate{certs}
-	conf := &tlsConfig{
-		ServerName: serverName,
-		Config: &tls.Config{
-			RootCAs:      rootCertPool,
-			Certificates: clientCert,
-			ServerName:   serverName,
-
-			// This is taken from
-			// https://github.com/golang/go/issues/40748#issuecomment-673612108
-			// as a workaround from Google issuing invalid TLS
-			// certs in Cloud SQL.
-			//
-			// Set InsecureSkipVerify to skip the default validation we are
-			// replacing. This will not disable VerifyConnection.
-			InsecureSkipVerify: true,
-			VerifyConnection: func(cs tls.ConnectionState) error {
-				commonName := cs.PeerCertificates[0].Subject.CommonName
-				if commonName != cs.ServerName {
-					return fmt.Errorf("invalid certificate name %q, expected %q", commonName, cs.ServerName)
-				}
-				opts := x509.VerifyOptions{
-					Roots:         rootCertPool,
-					Intermediates: x509.NewCertPool(),
-				}
-				for _, cert := range cs.PeerCertificates[1:] {
-					opts.Intermediates.AddCert(cert)
-				}
-				_, err := cs.PeerCertificates[0].Verify(opts)
-				return err
-			},
-		},
-	}
-	return conf, nil
+		return 0, errors.Wrap(err, "get content column size")
+	}
+	return size.Int64, nil
+}
+
+// SetPool configures the connection pool, which is applied when the database
+// is opened. Use sqlstore.SingleConnection to run every migration on one
+// session.
+func (db *DB) SetPool(p sqlstore.PoolConfig) { db.pool = p }
+
+// IsRetryable reports whether a statement failed on a deadlock or lock wait
+// timeout. These roll back the statement, so migrate can run it again.
+func (db *DB) IsRetryable(err error) bool {
+	return isMySQLErr(err, errLockWaitTimeout, errLockDeadlock)
+}
+
+// translateErr wraps lost connections in migrate's connection errors, so
+// callers can tell them apart from errors in the statement itself. The driver
+// reports driver.ErrBadConn only when nothing was sent, so other lost
+// connections may have run the statement.
+func translateErr(err error) error {
+	switch {
+	case errors.Is(err, driver.ErrBadConn):
+		return fmt.Errorf("%w: %w", migrate.ErrConnectionFailed, err)
+	case errors.Is(err, mysql.ErrInvalidConn),
+		isMySQLErr(err, errServerGone, errServerLost):
+		return fmt.Errorf("%w: %w", migrate.ErrConnectionLost, err)
+	}
+	return err
+}
+
+// isMySQLErr reports whether err is a MySQL or TiDB error with one of the
+// given error numbers.
+func isMySQLErr(err error, numbers ...uint16) bool {
+	var myErr *mysql.MySQLError
+	if !errors.As(err, &myErr) {
+		return false
+	}
+	for _, n := range numbers {
+		if myErr.Number == n {
+			return true
+		}
+	}
+	return false
 }
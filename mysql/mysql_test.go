@@ -2,18 +2,35 @@ package mysql
 
 import (
 	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql/driver"
+	"encoding/pem"
 	"fmt"
+	"math/big"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/thankful-ai/migrate"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/thankful-ai/migrate/sqlstore"
+	"github.com/thankful-ai/migrate/sqlstore/storetest"
+	"cloud.google.com/go/cloudsqlconn"
+	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 )
 
+var ctx = context.Background()
+
 const checkpointFile = "2.sql"
 
 func TestMain(m *testing.M) {
@@ -26,11 +43,661 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
+func TestNew(t *testing.T) {
+	db, err := New("user", "p@ss/w:rd", "localhost", "db", 3306, "", "",
+		"", "")
+	check(t, err)
+	want := "user:p@ss/w:rd@tcp(localhost:3306)/db" +
+		"?collation=utf8mb4_unicode_ci&parseTime=true&timeout=10s" +
+		"&charset=utf8mb4"
+	if db.connURL != want {
+		t.Fatalf("expected %q, got %q", want, db.connURL)
+	}
+
+	// The driver must parse the password back out intact
+	cfg, err := mysql.ParseDSN(db.connURL)
+	check(t, err)
+	if cfg.Passwd != "p@ss/w:rd" || cfg.DBName != "db" {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+
+	_, err = New("user", "pass", "localhost", "db", 3306, "key.pem", "",
+		"", "")
+	if err == nil {
+		t.Fatal("expected error for ssl key without server name")
+	}
+}
+
+func TestNewEscaping(t *testing.T) {
+	key, cert, ca := writeTestCerts(t)
+	tests := []struct {
+		name             string
+		user, pass, db   string
+		key, cert, caPEM string
+		serverName       string
+	}{
+		{name: "plain", user: "user", pass: "pass", db: "db"},
+		{name: "password", user: "user", pass: "p@ss/w%rd", db: "db"},
+		{name: "colon", user: "user", pass: "a:b@c", db: "db"},
+		{name: "spaces", user: "my user", pass: "my pass", db: "my db"},
+		{name: "db name", user: "user", pass: "pass", db: "my/db?x=1"},
+		{
+			name: "tls", user: "user", pass: "p@ss/w%rd", db: "my db",
+			key: key, cert: cert, caPEM: ca,
+			serverName: "db.example.com",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db, err := New(tc.user, tc.pass, "localhost", tc.db,
+				3306, tc.key, tc.cert, tc.caPEM, tc.serverName)
+			check(t, err)
+
+			// ParseDSN looks up the tls config by name, as the driver
+			// does once Open has registered it
+			if db.tlsConfig != nil {
+				err = mysql.RegisterTLSConfig(tc.serverName,
+					db.tlsConfig.Config)
+				check(t, err)
+			}
+			cfg, err := mysql.ParseDSN(db.connURL)
+			check(t, err)
+			if cfg.User != tc.user || cfg.Passwd != tc.pass ||
+				cfg.DBName != tc.db {
+				t.Fatalf("credentials changed in %q", db.connURL)
+			}
+			if cfg.Addr != "localhost:3306" {
+				t.Fatalf("unexpected addr %s", cfg.Addr)
+			}
+			if !cfg.ParseTime {
+				t.Fatalf("expected parseTime in %q", db.connURL)
+			}
+			if cfg.TLSConfig != tc.serverName {
+				t.Fatalf("expected tls=%s in %q", tc.serverName,
+					db.connURL)
+			}
+		})
+	}
+
+	// The driver can't express a ':' in the user name
+	_, err := New("us:er", "pass", "localhost", "db", 3306, "", "", "", "")
+	if err == nil {
+		t.Fatal("expected error for ':' in user")
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	key, cert, ca := writeTestCerts(t)
+	tests := []struct {
+		name    string
+		opts    TLSOptions
+		wantErr bool
+		check   func(*testing.T, *tls.Config)
+	}{
+		{
+			name: "ca only",
+			opts: TLSOptions{CAFile: ca, ServerName: "db"},
+			check: func(t *testing.T, c *tls.Config) {
+				if c.RootCAs == nil || len(c.Certificates) != 0 {
+					t.Fatal("expected ca without client certs")
+				}
+				if c.InsecureSkipVerify || c.VerifyConnection != nil {
+					t.Fatal("expected default verification")
+				}
+			},
+		},
+		{
+			name: "system roots",
+			opts: TLSOptions{ServerName: "db", MinVersion: tls.VersionTLS12},
+			check: func(t *testing.T, c *tls.Config) {
+				if c.RootCAs == nil {
+					t.Fatal("expected system roots")
+				}
+				if c.MinVersion != tls.VersionTLS12 {
+					t.Fatalf("unexpected min version %d", c.MinVersion)
+				}
+			},
+		},
+		{
+			name: "mutual",
+			opts: TLSOptions{
+				CAFile:         ca,
+				ClientCertFile: cert,
+				ClientKeyFile:  key,
+				ServerName:     "db",
+			},
+			check: func(t *testing.T, c *tls.Config) {
+				if len(c.Certificates) != 1 {
+					t.Fatal("expected client cert")
+				}
+			},
+		},
+		{
+			name:    "cert without key",
+			opts:    TLSOptions{ClientCertFile: cert, ServerName: "db"},
+			wantErr: true,
+		},
+		{
+			name: "skip verify",
+			opts: TLSOptions{SkipVerify: true, ServerName: "db"},
+			check: func(t *testing.T, c *tls.Config) {
+				if !c.InsecureSkipVerify || c.RootCAs != nil {
+					t.Fatal("expected verification to be skipped")
+				}
+			},
+		},
+		{
+			name: "cloud sql",
+			opts: TLSOptions{CAFile: ca, ServerName: "db", CloudSQL: true},
+			check: func(t *testing.T, c *tls.Config) {
+				if c.VerifyConnection == nil {
+					t.Fatal("expected common name verification")
+				}
+			},
+		},
+		{
+			name: "cloud sql skip verify",
+			opts: TLSOptions{
+				ServerName: "db",
+				SkipVerify: true,
+				CloudSQL:   true,
+			},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			conf, err := newTLSConfig(tc.opts)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			check(t, err)
+			tc.check(t, conf.Config)
+		})
+	}
+}
+
+func TestNewWithTLS(t *testing.T) {
+	// The server name defaults to the host
+	db, err := NewWithTLS("user", "pass", "db.example.com", "db", 3306,
+		TLSOptions{})
+	check(t, err)
+	if db.tlsConfig.Name != "db.example.com" ||
+		db.tlsConfig.Config.ServerName != "db.example.com" {
+		t.Fatalf("unexpected server name %q", db.tlsConfig.Name)
+	}
+	if !strings.Contains(db.connURL, "tls=db.example.com") {
+		t.Fatalf("expected tls param in %q", db.connURL)
+	}
+}
+
+func TestWithCharset(t *testing.T) {
+	db, err := New("user", "pass", "localhost", "db", 3306, "", "", "",
+		"", WithCharset("latin1", "latin1_swedish_ci"))
+	check(t, err)
+	cfg, err := mysql.ParseDSN(db.connURL)
+	check(t, err)
+	if cfg.Params["charset"] != "latin1" ||
+		cfg.Collation != "latin1_swedish_ci" {
+		t.Fatalf("unexpected charset in %q", db.connURL)
+	}
+}
+
+func TestWithTimeouts(t *testing.T) {
+	db, err := New("user", "pass", "localhost", "db", 3306, "", "", "",
+		"", WithTimeouts(time.Second, 2*time.Second, 3*time.Second))
+	check(t, err)
+	cfg, err := mysql.ParseDSN(db.connURL)
+	check(t, err)
+	if cfg.Timeout != time.Second || cfg.ReadTimeout != 2*time.Second ||
+		cfg.WriteTimeout != 3*time.Second {
+		t.Fatalf("unexpected timeouts in %q", db.connURL)
+	}
+}
+
+func TestOpenUnreachable(t *testing.T) {
+	// 10.255.255.1 is unrouted, so connecting either fails at once or
+	// blackholes until the dial timeout
+	const timeout = 500 * time.Millisecond
+	db, err := New("user", "pass", "10.255.255.1", "db", 3306, "", "", "",
+		"", WithTimeouts(timeout, 0, 0))
+	check(t, err)
+
+	start := time.Now()
+	err = db.Open(ctx)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !errors.Is(err, migrate.ErrConnectionFailed) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if d := time.Since(start); d > 4*timeout {
+		t.Fatalf("open took %s with a %s timeout", d, timeout)
+	}
+}
+
+func TestWithMultiStatements(t *testing.T) {
+	db, err := New("user", "pass", "localhost", "db", 3306, "", "", "",
+		"", WithMultiStatements())
+	check(t, err)
+	cfg, err := mysql.ParseDSN(db.connURL)
+	check(t, err)
+	if !cfg.MultiStatements {
+		t.Fatalf("expected multiStatements in %q", db.connURL)
+	}
+}
+
+func TestCommitsImplicitly(t *testing.T) {
+	db := &DB{}
+	for stmt, want := range map[string]bool{
+		"CREATE TABLE users (id INT)":                      true,
+		"create unique index users_name on users (name)":   true,
+		"ALTER TABLE users ADD COLUMN email TEXT":          true,
+		"DROP TABLE IF EXISTS users":                       true,
+		"TRUNCATE users":                                   true,
+		"CREATE DEFINER=`app`@`%` PROCEDURE p() SELECT 1":  true,
+		"CREATE OR REPLACE VIEW v AS SELECT 1":             true,
+		"/* why */ RENAME TABLE a TO b":                    true,
+		"GRANT SELECT ON app.* TO 'ro'":                    true,
+		"LOCK TABLES users WRITE":                          true,
+		"INSERT INTO users VALUES (1)":                     false,
+		"UPDATE users SET name = 'CREATE TABLE'":           false,
+		"DELETE FROM users":                                false,
+		"CREATE TEMPORARY TABLE t (id INT)":                false,
+		"DROP TEMPORARY TABLE t":                           false,
+		"SET @created = NOW()":                             false,
+		"INSERT INTO tables_created SELECT * FROM created": false,
+	} {
+		if got := db.CommitsImplicitly(stmt); got != want {
+			t.Errorf("%q: expected %t, got %t", stmt, want, got)
+		}
+	}
+}
+
+func TestSplitter(t *testing.T) {
+	const content = `INSERT INTO paths VALUES ('C:\'); SELECT 2;`
+	for mode, want := range map[string]int{
+		"":                    1,
+		"STRICT_TRANS_TABLES": 1,
+		"STRICT_TRANS_TABLES,NO_BACKSLASH_ESCAPES": 2,
+	} {
+		db := &DB{sqlMode: mode}
+		stmts, err := db.Splitter().Split(content)
+		check(t, err)
+		if len(stmts) != want {
+			t.Fatalf("expected %d statements with %q, got %+v", want,
+				mode, stmts)
+		}
+	}
+}
+
+func TestUTF8MB4RoundTrip(t *testing.T) {
+	db := newDB(t)
+	defer teardown(t, db)
+
+	// The meta tables must not inherit a database default which can't
+	// hold 4-byte characters
+	_, err := db.DB.Exec(`ALTER DATABASE migrate_test CHARACTER SET latin1`)
+	check(t, err)
+	check(t, db.CreateMetaIfNotExists(ctx))
+
+	const content = "INSERT INTO posts (body) VALUES ('🚀 launch');"
+	check(t, db.InsertMigration(ctx, migrate.Migration{
+		Filename: "1.sql",
+		Content:  content,
+		Checksum: "md5",
+	}))
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 1 || ms[0].Content != content {
+		t.Fatalf("expected %q, got %+v", content, ms)
+	}
+}
+
+func TestNewUnixSocket(t *testing.T) {
+	const want = "user:pass@unix(/cloudsql/project:region:instance)/db" +
+		"?collation=utf8mb4_unicode_ci&parseTime=true&timeout=10s" +
+		"&charset=utf8mb4"
+	db, err := NewUnixSocket("user", "pass",
+		"/cloudsql/project:region:instance", "db")
+	check(t, err)
+	if db.connURL != want {
+		t.Fatalf("expected %q, got %q", want, db.connURL)
+	}
+
+	// New detects socket paths and ignores the port
+	db, err = New("user", "pass", "/cloudsql/project:region:instance",
+		"db", 3306, "", "", "", "")
+	check(t, err)
+	if db.connURL != want {
+		t.Fatalf("expected %q, got %q", want, db.connURL)
+	}
+
+	_, err = New("user", "pass", "/var/run/mysqld/mysqld.sock", "db", 0,
+		"key.pem", "cert.pem", "ca.pem", "db.example.com")
+	if err == nil {
+		t.Fatal("expected error for ssl over a unix socket")
+	}
+}
+
+func TestNewFromConfig(t *testing.T) {
+	cfg := mysql.NewConfig()
+	cfg.User = "user"
+	cfg.Net = "tcp"
+	cfg.Addr = "[::1]:3307"
+	cfg.DBName = "db"
+	cfg.Collation = "utf8mb4_unicode_ci"
+	cfg.AllowNativePasswords = false
+	db, err := NewFromConfig(cfg, nil)
+	check(t, err)
+	want := "user@tcp([::1]:3307)/db?allowNativePasswords=false" +
+		"&collation=utf8mb4_unicode_ci"
+	if db.connURL != want {
+		t.Fatalf("expected %q, got %q", want, db.connURL)
+	}
+}
+
+func TestNewFromDSN(t *testing.T) {
+	db, err := NewFromDSN("user:pass@tcp(db:3306)/app?loc=UTC&timeout=5s")
+	check(t, err)
+	want := "user:pass@tcp(db:3306)/app?timeout=5s"
+	if db.connURL != want {
+		t.Fatalf("expected %q, got %q", want, db.connURL)
+	}
+
+	if _, err = NewFromDSN("user:pass@tcp(db:3306)"); err == nil {
+		t.Fatal("expected error for invalid dsn")
+	}
+}
+
+func TestSetPool(t *testing.T) {
+	dsn := fmt.Sprintf("%s:%s@tcp(%s)/", os.Getenv("MYSQL_USER"),
+		os.Getenv("MYSQL_PASSWORD"), os.Getenv("MYSQL_HOST"))
+	db, err := NewFromDSN(dsn)
+	check(t, err)
+	db.SetPool(sqlstore.PoolConfig{
+		MaxOpenConns:    1,
+		MaxIdleConns:    1,
+		ConnMaxLifetime: time.Minute,
+		ConnMaxIdleTime: time.Second,
+	})
+	check(t, db.Open(ctx))
+	defer db.Close()
+
+	if n := db.DB.Stats().MaxOpenConnections; n != 1 {
+		t.Fatalf("expected 1 max open connection, got %d", n)
+	}
+}
+
+func TestSetTablePrefix(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		wantErr bool
+	}{
+		{prefix: ""},
+		{prefix: "billing_"},
+		{prefix: "Svc2_"},
+		{prefix: "billing-", wantErr: true},
+		{prefix: "a`; DROP TABLE users; --", wantErr: true},
+		{prefix: strings.Repeat("a", 50), wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.prefix, func(t *testing.T) {
+			db := &DB{}
+			err := db.SetTablePrefix(tc.prefix)
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("expected error %t, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestDialectTables(t *testing.T) {
+	tables := Dialect{tablePrefix: "billing_",
+		metaDatabase: "migrate_meta"}.Tables()
+	want := "`migrate_meta`.`billing_meta`"
+	if tables.Meta != want {
+		t.Fatalf("expected %s, got %s", want, tables.Meta)
+	}
+	want = "`migrate_meta`.`billing_metahistory`"
+	if tables.History != want {
+		t.Fatalf("expected %s, got %s", want, tables.History)
+	}
+	if got := (Dialect{}).Tables().Version; got != "`metaversion`" {
+		t.Fatalf("expected unqualified metaversion, got %s", got)
+	}
+}
+
+func TestSetMetaDatabase(t *testing.T) {
+	db := &DB{}
+	check(t, db.SetMetaDatabase("migrate_meta"))
+	if err := db.SetMetaDatabase("migrate.meta"); err == nil {
+		t.Fatal("expected an invalid name to be rejected")
+	}
+}
+
+func TestMetaAccessErr(t *testing.T) {
+	db := &DB{metaDatabase: "migrate_meta"}
+	denied := &mysql.MySQLError{Number: errTableAccessDenied,
+		Message: "CREATE command denied to user 'app'@'%' for table 'meta'"}
+	err := db.metaAccessErr(denied)
+	if !errors.Is(err, denied) ||
+		!strings.Contains(err.Error(), "ON `migrate_meta`.*") {
+		t.Fatalf("expected the missing grant to be explained, got %v", err)
+	}
+	other := &mysql.MySQLError{Number: errTableExists}
+	if err = db.metaAccessErr(other); err != other {
+		t.Fatalf("expected other errors unchanged, got %v", err)
+	}
+}
+
+func TestMetaDatabase(t *testing.T) {
+	conn := createDBAndOpen(t)
+	db := &DB{metaDatabase: "migrate_test_meta", Store: sqlstore.New(
+		conn.DB, Dialect{metaDatabase: "migrate_test_meta"})}
+	defer teardown(t, db)
+	_, err := conn.Exec(`DROP DATABASE IF EXISTS migrate_test_meta`)
+	check(t, err)
+	defer func() {
+		_, err := conn.Exec(`DROP DATABASE migrate_test_meta`)
+		check(t, err)
+	}()
+
+	check(t, db.CreateMetaIfNotExists(ctx))
+	check(t, db.CreateMetaCheckpointsIfNotExists(ctx))
+	_, err = db.CreateMetaVersionIfNotExists(ctx, 1)
+	check(t, err)
+	check(t, db.InsertMigration(ctx, migrate.Migration{
+		Filename: "1.sql",
+		Content:  "SELECT 1;",
+		Checksum: "md5",
+	}))
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 1 {
+		t.Fatalf("expected 1 migration, got %+v", ms)
+	}
+
+	// The application's database holds none of the meta tables
+	var n int
+	q := `SELECT COUNT(*) FROM information_schema.tables
+		WHERE table_schema = ? AND table_name LIKE 'meta%'`
+	check(t, conn.Get(&n, q, "migrate_test"))
+	if n != 0 {
+		t.Fatalf("expected no meta tables in migrate_test, got %d", n)
+	}
+	check(t, conn.Get(&n, q, "migrate_test_meta"))
+	if n != 3 {
+		t.Fatalf("expected 3 meta tables in migrate_test_meta, got %d", n)
+	}
+}
+
+func TestTablePrefix(t *testing.T) {
+	conn := createDBAndOpen(t)
+	billing := &DB{Store: sqlstore.New(conn.DB,
+		Dialect{tablePrefix: "billing_"})}
+	defer teardown(t, billing)
+	search := &DB{Store: sqlstore.New(conn.DB,
+		Dialect{tablePrefix: "search_"})}
+
+	// The billing service predates v1, so its tables are upgraded under
+	// their prefixed names
+	q := `CREATE TABLE billing_meta (
+		filename VARCHAR(255) UNIQUE NOT NULL,
+		md5 VARCHAR(255) UNIQUE NOT NULL,
+		createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`
+	_, err := conn.Exec(q)
+	check(t, err)
+	q = `CREATE TABLE billing_metacheckpoints (
+		filename VARCHAR(255) NOT NULL,
+		idx INTEGER NOT NULL,
+		md5 VARCHAR(255) NOT NULL,
+		createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (filename, idx)
+	)`
+	_, err = conn.Exec(q)
+	check(t, err)
+	check(t, billing.UpgradeToV1(ctx, nil))
+
+	for _, db := range []*DB{billing, search} {
+		check(t, db.CreateMetaIfNotExists(ctx))
+		check(t, db.CreateMetaCheckpointsIfNotExists(ctx))
+		_, err = db.CreateMetaVersionIfNotExists(ctx, 1)
+		check(t, err)
+	}
+	check(t, billing.InsertMigration(ctx, migrate.Migration{
+		Filename: "1.sql",
+		Content:  "SELECT 1;",
+		Checksum: "md5",
+	}))
+	check(t, search.InsertMetaCheckpoint(ctx, "1.sql", "SELECT 1;",
+		"md5", 0))
+
+	ms, err := search.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 0 {
+		t.Fatalf("expected no search migrations, got %+v", ms)
+	}
+	ms, err = billing.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 1 {
+		t.Fatalf("expected 1 billing migration, got %+v", ms)
+	}
+	mcs, err := billing.GetMetaCheckpoints(ctx, "1.sql")
+	check(t, err)
+	if len(mcs) != 0 {
+		t.Fatalf("expected no billing checkpoints, got %v", mcs)
+	}
+}
+
+func TestIAMAuthRefreshesToken(t *testing.T) {
+	var tokens []string
+	fake := func(ctx context.Context) (string, error) {
+		tok := fmt.Sprintf("token-%d", len(tokens))
+		tokens = append(tokens, tok)
+		return tok, nil
+	}
+	timeout := func(cfg *mysql.Config) { cfg.Timeout = 100 * time.Millisecond }
+
+	// Nothing listens on port 1, so each connection fails after the token
+	// is generated
+	db, err := newIAMAuth("user", "127.0.0.1:1", "db", []Option{timeout},
+		fake)
+	check(t, err)
+	if err = db.Open(ctx); err == nil {
+		t.Fatal("expected open error")
+	}
+	if _, err = db.connector.Connect(context.Background()); err == nil {
+		t.Fatal("expected connect error")
+	}
+	if len(tokens) != 2 {
+		t.Fatalf("expected a new token per connection, got %v", tokens)
+	}
+
+	cfg, err := mysql.ParseDSN(db.connURL)
+	check(t, err)
+	if !cfg.AllowCleartextPasswords || cfg.TLSConfig != "true" {
+		t.Fatalf("expected cleartext passwords over tls, got %q",
+			db.connURL)
+	}
+}
+
+func TestIAMAuthTokenError(t *testing.T) {
+	fail := func(ctx context.Context) (string, error) {
+		return "", errors.New("no credentials")
+	}
+	db, err := newIAMAuth("user", "127.0.0.1:1", "db", nil, fail)
+	check(t, err)
+	_, err = db.connector.Connect(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "no credentials") {
+		t.Fatalf("expected token error, got %v", err)
+	}
+
+	_, err = NewWithIAMAuth("user", "host", "db", 3306, "", nil)
+	if err == nil {
+		t.Fatal("expected error without a region")
+	}
+}
+
+type fakeDialer struct {
+	dialed []string
+	closed bool
+}
+
+func (d *fakeDialer) Dial(
+	ctx context.Context,
+	icn string,
+	opts ...cloudsqlconn.DialOption,
+) (net.Conn, error) {
+	d.dialed = append(d.dialed, icn)
+	return nil, errors.New("fake dial")
+}
+
+func (d *fakeDialer) Close() error {
+	d.closed = true
+	return nil
+}
+
+func TestCloudSQL(t *testing.T) {
+	const icn = "project:region:instance"
+	d := &fakeDialer{}
+	db := newCloudSQL(icn, "user", "db", d)
+	cfg, err := mysql.ParseDSN(db.connURL)
+	check(t, err)
+	if cfg.Addr != icn || cfg.User != "user" || cfg.DBName != "db" ||
+		cfg.TLSConfig != "" {
+		t.Fatalf("unexpected dsn %q", db.connURL)
+	}
+
+	// Connections go through the registered dialer, which is closed
+	// when the database can't be reached
+	err = db.Open(ctx)
+	if err == nil || !strings.Contains(err.Error(), "fake dial") {
+		t.Fatalf("expected fake dial error, got %v", err)
+	}
+	if len(d.dialed) == 0 || d.dialed[0] != icn {
+		t.Fatalf("expected dial to %s, got %v", icn, d.dialed)
+	}
+	if !d.closed {
+		t.Fatal("expected dialer to be closed")
+	}
+
+	// Each store registers its own network
+	other := newCloudSQL(icn, "user", "db", &fakeDialer{})
+	if other.connURL == db.connURL {
+		t.Fatal("expected a distinct network per store")
+	}
+}
+
 func TestCreateMetaIfNotExists(t *testing.T) {
 	db := newDB(t)
 	defer teardown(t, db)
 
-	err := db.CreateMetaIfNotExists()
+	err := db.CreateMetaIfNotExists(ctx)
 	check(t, err)
 
 	var tmp []int
@@ -38,11 +705,24 @@ func TestCreateMetaIfNotExists(t *testing.T) {
 	check(t, err)
 }
 
+func TestMaxContentSize(t *testing.T) {
+	db := newDB(t)
+	defer teardown(t, db)
+
+	check(t, db.CreateMetaIfNotExists(ctx))
+	check(t, db.CreateMetaCheckpointsIfNotExists(ctx))
+	size, err := db.MaxContentSize(ctx)
+	check(t, err)
+	if size != 1<<24-1 {
+		t.Fatalf("expected MEDIUMTEXT's size, got %d", size)
+	}
+}
+
 func TestCreateMetaCheckpointsIfNotExists(t *testing.T) {
 	db := newDB(t)
 	defer teardown(t, db)
 
-	err := db.CreateMetaCheckpointsIfNotExists()
+	err := db.CreateMetaCheckpointsIfNotExists(ctx)
 	check(t, err)
 
 	var tmp []int
@@ -54,7 +734,7 @@ func TestGetMigrations(t *testing.T) {
 	db := setupDBV1(t)
 	defer teardown(t, db)
 
-	ms, err := db.GetMigrations()
+	ms, err := db.GetMigrations(ctx)
 	check(t, err)
 	if len(ms) != 1 {
 		t.Fatal("expected 1 migration")
@@ -65,7 +745,7 @@ func TestGetMetaCheckpoints(t *testing.T) {
 	db := setupDBV1(t)
 	defer teardown(t, db)
 
-	mcs, err := db.GetMetaCheckpoints(checkpointFile)
+	mcs, err := db.GetMetaCheckpoints(ctx, checkpointFile)
 	check(t, err)
 	if len(mcs) != 1 {
 		t.Fatal("expected 1 checkpoint")
@@ -77,28 +757,56 @@ func TestUpsertMigration(t *testing.T) {
 	defer teardown(t, db)
 
 	// Test update
-	err := db.UpsertMigration("1.sql", "SELECT 1;", "md5")
+	err := db.UpsertMigration(ctx, migrate.Migration{
+		Filename: "1.sql",
+		Content:  "SELECT 1;",
+		Checksum: "md5",
+	})
 	check(t, err)
 
 	// Test insert
-	err = db.UpsertMigration("3.sql", "SELECT 3;", "md5")
+	err = db.UpsertMigration(ctx, migrate.Migration{
+		Filename: "3.sql",
+		Content:  "SELECT 3;",
+		Checksum: "md5",
+	})
 	check(t, err)
 
-	ms, err := db.GetMigrations()
+	ms, err := db.GetMigrations(ctx)
 	check(t, err)
 	if len(ms) != 2 {
 		t.Fatalf("expected 2 migrations, got %d", len(ms))
 	}
 }
 
+func TestWarnings(t *testing.T) {
+	db := newDB(t)
+	defer teardown(t, db)
+	db.SetWarnings(true)
+
+	_, err := db.Exec(ctx, `DROP TABLE IF EXISTS missing`)
+	check(t, err)
+	ws := db.Warnings()
+	if len(ws) != 1 || ws[0].Level != "Note" || ws[0].Code != 1051 {
+		t.Fatalf("expected unknown table note, got %+v", ws)
+	}
+
+	// Warnings are cleared by the next statement
+	_, err = db.Exec(ctx, `SELECT 1`)
+	check(t, err)
+	if ws = db.Warnings(); len(ws) != 0 {
+		t.Fatalf("expected no warnings, got %+v", ws)
+	}
+}
+
 func TestInsertMetaCheckpoint(t *testing.T) {
 	db := setupDBV1(t)
 	defer teardown(t, db)
 
-	err := db.InsertMetaCheckpoint(checkpointFile, "SELECT 3;", "md5", 1)
+	err := db.InsertMetaCheckpoint(ctx, checkpointFile, "SELECT 3;", "md5", 1)
 	check(t, err)
 
-	mcs, err := db.GetMetaCheckpoints(checkpointFile)
+	mcs, err := db.GetMetaCheckpoints(ctx, checkpointFile)
 	check(t, err)
 	if len(mcs) != 2 {
 		t.Fatal("expected 2 checkpoints")
@@ -109,10 +817,14 @@ func TestInsertMigration(t *testing.T) {
 	db := setupDBV1(t)
 	defer teardown(t, db)
 
-	err := db.InsertMigration("3.sql", "SELECT 3;", "md5")
+	err := db.InsertMigration(ctx, migrate.Migration{
+		Filename: "3.sql",
+		Content:  "SELECT 3;",
+		Checksum: "md5",
+	})
 	check(t, err)
 
-	ms, err := db.GetMigrations()
+	ms, err := db.GetMigrations(ctx)
 	check(t, err)
 	if len(ms) != 2 {
 		t.Fatal("expected 2 migrations")
@@ -123,16 +835,172 @@ func TestDeleteMetaCheckpoints(t *testing.T) {
 	db := setupDBV1(t)
 	defer teardown(t, db)
 
-	err := db.DeleteMetaCheckpoints()
+	err := db.DeleteMetaCheckpoints(ctx)
 	check(t, err)
 
-	mcs, err := db.GetMetaCheckpoints(checkpointFile)
+	mcs, err := db.GetMetaCheckpoints(ctx, checkpointFile)
 	check(t, err)
 	if len(mcs) != 0 {
 		t.Fatal("expected 0 checkpoints")
 	}
 }
 
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) migrate.Store {
+		db := newDB(t)
+		t.Cleanup(func() { teardown(t, db) })
+		return db
+	})
+}
+
+func TestWrapTiDBErr(t *testing.T) {
+	if wrapTiDBErr(nil) != nil {
+		t.Fatal("expected nil")
+	}
+	other := &mysql.MySQLError{Number: 1064, Message: "syntax"}
+	if err := wrapTiDBErr(other); err != other {
+		t.Fatalf("expected other errors unchanged, got %v", err)
+	}
+	cancelled := &mysql.MySQLError{Number: errCancelledDDLJob,
+		Message: "Cancelled DDL job"}
+	err := wrapTiDBErr(errors.Wrap(cancelled, "exec"))
+	if err == cancelled || !strings.Contains(err.Error(),
+		"tidb_ddl_error_count_limit") {
+		t.Fatalf("expected explained error, got %v", err)
+	}
+	var myErr *mysql.MySQLError
+	if !errors.As(err, &myErr) {
+		t.Fatal("expected wrapped error to unwrap to the driver error")
+	}
+}
+
+func TestIsTableExists(t *testing.T) {
+	err := &mysql.MySQLError{Number: errTableExists, SQLState: [5]byte{
+		'4', '2', 'S', '0', '1'}}
+	if !(Dialect{}).IsTableExists(errors.Wrap(err, "create")) {
+		t.Fatal("expected table exists error")
+	}
+	if (Dialect{}).IsTableExists(errors.New("Error 1050: x")) {
+		t.Fatal("expected only driver errors to match")
+	}
+}
+
+func TestIsMySQLErr(t *testing.T) {
+	dup := errors.Wrap(&mysql.MySQLError{Number: errDupFieldName}, "alter")
+	tests := []struct {
+		name  string
+		err   error
+		codes []uint16
+		want  bool
+	}{
+		{"match", dup, []uint16{errDupFieldName}, true},
+		{"any code", dup, []uint16{errTableExists, errDupFieldName}, true},
+		{"other code", dup, []uint16{errTableExists}, false},
+		{"no codes", dup, nil, false},
+		{"message only", errors.New("Duplicate column name 'content'"),
+			[]uint16{errDupFieldName}, false},
+		{"nil", nil, []uint16{errDupFieldName}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isMySQLErr(tc.err, tc.codes...); got != tc.want {
+				t.Fatalf("expected %t, got %t", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	db := &DB{}
+	for _, n := range []uint16{errLockWaitTimeout, errLockDeadlock} {
+		err := errors.Wrap(&mysql.MySQLError{Number: n}, "exec")
+		if !db.IsRetryable(err) {
+			t.Fatalf("expected %d to be retryable", n)
+		}
+	}
+	if db.IsRetryable(&mysql.MySQLError{Number: errTableExists}) {
+		t.Fatal("expected table exists not to be retryable")
+	}
+}
+
+func TestPingErr(t *testing.T) {
+	err := pingErr(&mysql.MySQLError{Number: 1045,
+		Message: "Access denied for user 'user'"})
+	if errors.Is(err, migrate.ErrConnectionFailed) {
+		t.Fatal("expected access denied not to be a connection failure")
+	}
+	err = pingErr(&net.OpError{Op: "dial", Err: errors.New("refused")})
+	if !errors.Is(err, migrate.ErrConnectionFailed) {
+		t.Fatalf("expected connection failed, got %v", err)
+	}
+}
+
+func TestTranslateErr(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"bad conn", driver.ErrBadConn, migrate.ErrConnectionFailed},
+		{"invalid conn", mysql.ErrInvalidConn, migrate.ErrConnectionLost},
+		{"server gone", &mysql.MySQLError{Number: errServerGone},
+			migrate.ErrConnectionLost},
+		{"server lost", &mysql.MySQLError{Number: errServerLost},
+			migrate.ErrConnectionLost},
+		{"table exists", &mysql.MySQLError{Number: errTableExists}, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := errors.Wrap(translateErr(tc.err), "exec")
+			for _, target := range []error{
+				migrate.ErrConnectionFailed,
+				migrate.ErrConnectionLost,
+			} {
+				if errors.Is(err, target) != (target == tc.want) {
+					t.Fatalf("unexpected match of %v with %v",
+						err, target)
+				}
+			}
+		})
+	}
+}
+
+func TestTiDBConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) migrate.Store {
+		db := newTiDB(t)
+		t.Cleanup(func() { teardown(t, db) })
+		return db
+	})
+}
+
+func TestTiDBUpgradeToV1Rerun(t *testing.T) {
+	db := newTiDB(t)
+	defer teardown(t, db)
+	createV0Tables(t, db)
+
+	migrations := []migrate.Migration{{
+		Filename: "1.sql",
+		Checksum: "md5",
+		Content:  "SELECT 1;",
+	}}
+	check(t, db.UpgradeToV1(ctx, migrations))
+
+	// Each schema change commits as it runs, so a failed upgrade must be
+	// safe to retry from the start
+	check(t, db.UpgradeToV1(ctx, migrations))
+
+	v, err := db.CreateMetaVersionIfNotExists(ctx, 1)
+	check(t, err)
+	if v != 1 {
+		t.Fatalf("expected version 1, got %d", v)
+	}
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 1 || ms[0].Content != "SELECT 1;" {
+		t.Fatalf("unexpected migrations %+v", ms)
+	}
+}
+
 func check(t *testing.T, err error) {
 	t.Helper()
 	if err != nil {
@@ -143,9 +1011,54 @@ func check(t *testing.T, err error) {
 func must(err error) {
 }
 
+// writeTestCerts writes a self-signed certificate and its key, returning the
+// paths to the key, the certificate, and the certificate again as the CA.
+func writeTestCerts(t *testing.T) (key, cert, ca string) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	check(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "db.example.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl,
+		&priv.PublicKey, priv)
+	check(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	check(t, err)
+
+	dir := t.TempDir()
+	key = filepath.Join(dir, "key.pem")
+	cert = filepath.Join(dir, "cert.pem")
+	err = os.WriteFile(key, pem.EncodeToMemory(&pem.Block{
+		Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	check(t, err)
+	err = os.WriteFile(cert, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: der}), 0o600)
+	check(t, err)
+	return key, cert, cert
+}
+
 func newDB(t *testing.T) *DB {
 	db := createDBAndOpen(t)
-	return &DB{DB: db}
+	return &DB{Store: sqlstore.New(db.DB, Dialect{})}
+}
+
+// newTiDB connects to the TiDB server in TIDB_HOST. TiDB's root user has no
+// password by default, so TIDB_PASSWORD may be empty.
+func newTiDB(t *testing.T) *DB {
+	user := os.Getenv("TIDB_USER")
+	if user == "" {
+		panic("missing TIDB_USER")
+	}
+	host := os.Getenv("TIDB_HOST")
+	if host == "" {
+		panic("missing TIDB_HOST")
+	}
+	db := createDBAndOpenAt(t, user, os.Getenv("TIDB_PASSWORD"), host)
+	return &DB{tidb: true, Store: sqlstore.New(db.DB, TiDBDialect{})}
 }
 
 func parseEnv(filename string) error {
@@ -188,7 +1101,10 @@ func createDBAndOpen(t *testing.T) *sqlx.DB {
 	if host == "" {
 		panic("missing MYSQL_HOST")
 	}
+	return createDBAndOpenAt(t, user, pass, host)
+}
 
+func createDBAndOpenAt(t *testing.T, user, pass, host string) *sqlx.DB {
 	dsn := fmt.Sprintf("%s:%s@tcp(%s)/?timeout=1s", user, pass, host)
 	db, err := sqlx.Open("mysql", dsn)
 	check(t, err)
@@ -204,8 +1120,9 @@ func createDBAndOpen(t *testing.T) *sqlx.DB {
 	err = db.Close()
 	check(t, err)
 
-	dsn = fmt.Sprintf("%s:%s@tcp(%s)/migrate_test?timeout=1s", user, pass,
-		host)
+	dsn = fmt.Sprintf("%s:%s@tcp(%s)/migrate_test?timeout=1s"+
+		"&charset=%s&collation=%s", user, pass, host, DefaultCharset,
+		DefaultCollation)
 	db, err = sqlx.Open("mysql", dsn)
 	check(t, err)
 
@@ -214,13 +1131,13 @@ func createDBAndOpen(t *testing.T) *sqlx.DB {
 
 func teardown(t *testing.T, db *DB) {
 	q := `DROP DATABASE migrate_test`
-	_, err := db.Exec(q)
+	_, err := db.Exec(ctx, q)
 	check(t, err)
 }
 
 func setupDBV1(t *testing.T) *DB {
 	db := setupDBV0(t)
-	err := db.UpgradeToV1([]migrate.Migration{{
+	err := db.UpgradeToV1(ctx, []migrate.Migration{{
 		Filename: "1.sql",
 		Checksum: "md5",
 		Content:  "SELECT 1;",
@@ -238,7 +1155,11 @@ func setupDBV1(t *testing.T) *DB {
 
 func setupDBV0(t *testing.T) *DB {
 	db := newDB(t)
+	createV0Tables(t, db)
+	return db
+}
 
+func createV0Tables(t *testing.T, db *DB) {
 	q := `CREATE TABLE IF NOT EXISTS meta (
 		filename VARCHAR(255) UNIQUE NOT NULL,
 		md5 VARCHAR(255) UNIQUE NOT NULL,
@@ -260,6 +1181,4 @@ func setupDBV0(t *testing.T) *DB {
 	q = `INSERT INTO meta (filename, md5) VALUES (?, ?)`
 	_, err = db.DB.Exec(q, "1.sql", "md5")
 	check(t, err)
-
-	return db
 }
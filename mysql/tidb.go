@@ -0,0 +1,113 @@
+package mysql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/thankful-ai/migrate"
+	"github.com/thankful-ai/migrate/sqlstore"
+)
+
+// errCancelledDDLJob is reported by TiDB when it gives up on a DDL job, such
+// as after it fails tidb_ddl_error_count_limit times.
+const errCancelledDDLJob = 8214
+
+// NewTiDB prepares a connection to a TiDB cluster. TiDB speaks the MySQL
+// protocol, so it takes the same arguments as New, but the store orders
+// migrations without relying on MySQL's implicit casts and upgrades the meta
+// tables one schema change at a time.
+func NewTiDB(
+	user, pass, host, dbName string,
+	port int,
+	sslKey, sslCert, sslCA, sslServerName string,
+	opts ...Option,
+) (*DB, error) {
+	db, err := New(user, pass, host, dbName, port, sslKey, sslCert, sslCA,
+		sslServerName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	db.tidb = true
+	return db, nil
+}
+
+// TiDBDialect describes TiDB's SQL to sqlstore.
+type TiDBDialect struct {
+	Dialect
+}
+
+// UpgradeToV1 migrates existing meta tables to the v1 format. Complete any
+// migrations before running this function; this will not succeed if have any
+// existing metacheckpoints.
+//
+// TiDB commits each DDL statement as it runs and restricts how many schema
+// changes one ALTER may make, so each change runs on its own and is safe to
+// re-run if a previous upgrade failed partway through.
+func (d TiDBDialect) UpgradeToV1(
+	ctx context.Context,
+	db *sqlx.DB,
+	migrations []migrate.Migration,
+) error {
+	exec := func(q string, args ...interface{}) error {
+		_, err := db.ExecContext(ctx, q, args...)
+		return wrapTiDBErr(err)
+	}
+
+	t := d.Tables()
+
+	// Remove the uniqueness constraint from md5
+	q := `ALTER TABLE ` + t.Meta + ` DROP INDEX IF EXISTS md5`
+	if err := exec(q); err != nil {
+		return errors.Wrap(err, "remove md5 unique")
+	}
+
+	// Add a content column to record the exact migration that ran
+	// alongside the md5, insert the appropriate data, then set not null
+	q = `ALTER TABLE ` + t.Meta + ` ADD COLUMN IF NOT EXISTS content TEXT`
+	if err := exec(q); err != nil {
+		return errors.Wrap(err, "add content column")
+	}
+	for _, m := range migrations {
+		q = `UPDATE ` + t.Meta + ` SET content=? WHERE filename=?`
+		if err := exec(q, m.Content, m.Filename); err != nil {
+			return errors.Wrap(err, "update meta content")
+		}
+	}
+	q = `ALTER TABLE ` + t.Meta + ` MODIFY COLUMN content TEXT NOT NULL`
+	if err := exec(q); err != nil {
+		return errors.Wrap(err, "update meta content not null")
+	}
+
+	// Add the content column to metacheckpoints
+	q = `ALTER TABLE ` + t.Checkpoints +
+		` ADD COLUMN IF NOT EXISTS content TEXT NOT NULL`
+	if err := exec(q); err != nil {
+		return errors.Wrap(err, "add metacheckpoints content")
+	}
+
+	q = `CREATE TABLE IF NOT EXISTS ` + t.Version +
+		` (version INTEGER NOT NULL)`
+	if err := exec(q); err != nil {
+		return errors.Wrap(err, "create metaversion table")
+	}
+	return sqlstore.SetVersion(ctx, db, t.Version, 0, 1)
+}
+
+// wrapTiDBErr explains errors from DDL jobs which TiDB cancelled, leaving
+// other errors as they are.
+func wrapTiDBErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if !isMySQLErr(err, errCancelledDDLJob) &&
+		!strings.Contains(err.Error(), "tidb_ddl_error_count_limit") {
+		return err
+	}
+	return fmt.Errorf("tidb cancelled the ddl job after repeated failures; "+
+		"check the tidb logs for the underlying error, and "+
+		"tidb_ddl_error_count_limit for how many attempts it makes: %w",
+		err)
+}
@@ -0,0 +1,183 @@
+package mysql
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+)
+
+// TLSFiles are the paths to the certificates used to connect over TLS, and
+// the server name to verify. See TLSOptions for more choices.
+type TLSFiles struct {
+	Key, Cert, CA string
+	ServerName    string
+}
+
+// TLSOptions configures a TLS connection. Only the fields a setup needs must
+// be set: with none but ServerName, the server is verified against the system
+// roots and no client certificate is sent.
+type TLSOptions struct {
+	// CAFile is the path to the CA certificates which signed the server's
+	// certificate. If empty, the system roots are used.
+	CAFile string
+
+	// ClientCertFile and ClientKeyFile are the paths to the client
+	// certificate and key for mutual TLS. Either both or neither must be
+	// set.
+	ClientCertFile, ClientKeyFile string
+
+	// ServerName is verified against the server's certificate. It defaults
+	// to the host being connected to.
+	ServerName string
+
+	// MinVersion is the minimum TLS version accepted, such as
+	// tls.VersionTLS12. It defaults to crypto/tls's minimum.
+	MinVersion uint16
+
+	// UseSystemRoots trusts the system roots in addition to CAFile.
+	UseSystemRoots bool
+
+	// SkipVerify encrypts the connection without verifying the server's
+	// certificate. This is vulnerable to man-in-the-middle attacks, so
+	// it's only suitable for trusted networks.
+	SkipVerify bool
+
+	// CloudSQL verifies that the certificate's common name matches
+	// ServerName rather than checking the hostname, which Cloud SQL's
+	// server certificates don't include. Prefer NewCloudSQL where
+	// possible, which doesn't need certificate files at all.
+	CloudSQL bool
+}
+
+// tlsConfig is registered with the driver under Name when the database
+// opens.
+type tlsConfig struct {
+	Name   string
+	Config *tls.Config
+}
+
+// NewWithTLS prepares a TCP connection to a MySQL database over TLS.
+func NewWithTLS(
+	user, pass, host, dbName string,
+	port int,
+	tlsOpts TLSOptions,
+	opts ...Option,
+) (*DB, error) {
+	cfg := newConfig(user, pass, "tcp",
+		net.JoinHostPort(host, strconv.Itoa(port)), dbName, opts)
+	return newWithTLS(cfg, tlsOpts)
+}
+
+func newWithTLS(cfg *mysql.Config, opts TLSOptions) (*DB, error) {
+	if opts.ServerName == "" {
+		host, _, err := net.SplitHostPort(cfg.Addr)
+		if err != nil {
+			return nil, errors.Wrap(err, "split host port")
+		}
+		opts.ServerName = host
+	}
+	conf, err := newTLSConfig(opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "new tls config")
+	}
+	cfg.TLSConfig = conf.Name
+	return &DB{
+		connURL:   cfg.FormatDSN(),
+		timeout:   cfg.Timeout,
+		tlsConfig: conf,
+	}, nil
+}
+
+func newTLSConfig(opts TLSOptions) (*tlsConfig, error) {
+	if (opts.ClientCertFile == "") != (opts.ClientKeyFile == "") {
+		return nil, errors.New("client cert and key must be provided together")
+	}
+	if opts.SkipVerify && opts.CloudSQL {
+		return nil, errors.New("skip verify and cloud sql verification are exclusive")
+	}
+
+	conf := &tls.Config{
+		ServerName:         opts.ServerName,
+		MinVersion:         opts.MinVersion,
+		InsecureSkipVerify: opts.SkipVerify,
+	}
+	if opts.ClientCertFile != "" {
+		certs, err := tls.LoadX509KeyPair(opts.ClientCertFile,
+			opts.ClientKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load x509 key pair")
+		}
+		conf.Certificates = []tls.Certificate{certs}
+	}
+	if !opts.SkipVerify {
+		var err error
+		conf.RootCAs, err = rootCertPool(opts.CAFile, opts.UseSystemRoots)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.CloudSQL {
+		rootCertPool := conf.RootCAs
+
+		// This is taken from
+		// https://github.com/golang/go/issues/40748#issuecomment-673612108
+		// as a workaround from Google issuing invalid TLS certs in Cloud
+		// SQL.
+		//
+		// Set InsecureSkipVerify to skip the default validation we are
+		// replacing. This will not disable VerifyConnection.
+		conf.InsecureSkipVerify = true
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			commonName := cs.PeerCertificates[0].Subject.CommonName
+			if commonName != cs.ServerName {
+				return fmt.Errorf("invalid certificate name %q, expected %q", commonName, cs.ServerName)
+			}
+			opts := x509.VerifyOptions{
+				Roots:         rootCertPool,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		}
+	}
+	return &tlsConfig{Name: opts.ServerName, Config: conf}, nil
+}
+
+// rootCertPool loads the certificates in caPath, falling back to the system
+// roots if there's no caPath.
+func rootCertPool(caPath string, withSystem bool) (*x509.CertPool, error) {
+	if caPath == "" || withSystem {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, errors.Wrap(err, "system cert pool")
+		}
+		if caPath == "" {
+			return pool, nil
+		}
+		return appendCertsFromFile(pool, caPath)
+	}
+	return appendCertsFromFile(x509.NewCertPool(), caPath)
+}
+
+func appendCertsFromFile(
+	pool *x509.CertPool,
+	caPath string,
+) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "read sql server cert file")
+	}
+	if ok := pool.AppendCertsFromPEM(pem); !ok {
+		return nil, errors.New("failed to append to pem")
+	}
+	return pool, nil
+}
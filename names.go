@@ -0,0 +1,74 @@
+package migrate
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxFilenameLen is the most bytes meta's filename column holds.
+const maxFilenameLen = 255
+
+// namedInfo reports a file by the name it's recorded with in meta, such as its
+// path under a subdirectory, or its name normalized to NFC, so a name macOS
+// decomposed matches the same name written on Linux.
+type namedInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (i namedInfo) Name() string { return i.name }
+
+// normalizedInfo returns fi with its name in NFC.
+func normalizedInfo(fi fs.FileInfo) fs.FileInfo {
+	if norm.NFC.IsNormalString(fi.Name()) {
+		return fi
+	}
+	return namedInfo{FileInfo: fi, name: norm.NFC.String(fi.Name())}
+}
+
+// normalizeFilenames normalizes the filenames of ms to NFC, as those of files
+// are, in case they were recorded before names were normalized.
+func normalizeFilenames(ms []Migration) {
+	for i := range ms {
+		ms[i].Filename = norm.NFC.String(ms[i].Filename)
+	}
+}
+
+// checkNames refuses names which meta can't record faithfully: those longer
+// than its filename column, with backslashes, which some systems read as path
+// separators, or differing from another only by case, which a
+// case-insensitive collation treats as the same. Names only have slashes under
+// WithSubdirectories, which separate the directories in them.
+func checkNames(files []*file) error {
+	lower := make(map[string]string, len(files))
+	for _, f := range files {
+		name := f.Info.Name()
+		switch {
+		case len(name) > maxFilenameLen:
+			return fmt.Errorf("%s is %d bytes, but names may be at most %d",
+				name, len(name), maxFilenameLen)
+		case strings.Contains(name, `\`):
+			return fmt.Errorf("%q contains a path separator", name)
+		}
+		key := strings.ToLower(name)
+		if other, ok := lower[key]; ok {
+			return fmt.Errorf("%s and %s differ only by case", other, name)
+		}
+		lower[key] = name
+	}
+	return nil
+}
+
+// checkSpace refuses a name which would be a migration's but for whitespace
+// at its start or end, which is likely a mistake and may be trimmed by the
+// database.
+func checkSpace(name string) error {
+	trimmed := strings.TrimSpace(name)
+	if trimmed != name && isMigrationName(trimmed) {
+		return fmt.Errorf("%q starts or ends with whitespace", name)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package migrate
+
+import (
+	"fmt"
+	"path"
+	"time"
+)
+
+// TimestampFormat is the layout of a timestamp prefix in UTC, such as the
+// 20240611153000 of 20240611153000_add_index.sql. Numbering migrations by when
+// they were written, rather than 1, 2, 3, spares branches written at the same
+// time from renumbering theirs when they're merged.
+const TimestampFormat = "20060102150405"
+
+// TimestampPrefix returns the number of a migration created at t, such as to
+// name a new file.
+func TimestampPrefix(t time.Time) string {
+	return t.UTC().Format(TimestampFormat)
+}
+
+// isTimestamp reports whether num, the number a filename starts with, is a
+// timestamp in TimestampFormat rather than a sequence number.
+func isTimestamp(num string) bool {
+	if len(num) != len(TimestampFormat) {
+		return false
+	}
+	_, err := time.Parse(TimestampFormat, num)
+	return err == nil
+}
+
+// WithoutMixedNumbering refuses migrations numbered both sequentially, such as
+// 0042_x.sql, and by timestamp, such as 20240611153000_y.sql. By default both
+// run in order of their numbers, which puts every sequence number below
+// 10000000000000 before the timestamps, as when a project switches from one to
+// the other.
+func WithoutMixedNumbering() Option {
+	return func(m *Migrate) { m.noMixedNumbering = true }
+}
+
+// checkNumbering checks the numbering of files, sorted, for gaps and, if
+// WithoutMixedNumbering refuses it, a mix of sequence numbers and timestamps.
+func (m *Migrate) checkNumbering(files []*file) error {
+	if err := m.checkGaps(files); err != nil {
+		return err
+	}
+	if !m.noMixedNumbering {
+		return nil
+	}
+	var seq, ts string
+	for _, f := range files {
+		switch {
+		case isTimestamp(regexNum.FindString(path.Base(f.Info.Name()))):
+			if ts == "" {
+				ts = f.Info.Name()
+			}
+		case seq == "":
+			seq = f.Info.Name()
+		}
+	}
+	if seq != "" && ts != "" {
+		return fmt.Errorf("mixed numbering: %s is numbered sequentially but %s by timestamp",
+			seq, ts)
+	}
+	return nil
+}
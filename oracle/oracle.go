@@ -0,0 +1,292 @@
+// Package oracle implements a migrate.Store for Oracle Database. Oracle has no
+// CREATE TABLE IF NOT EXISTS, so tables are created from PL/SQL blocks which
+// check user_tables first, and it commits every DDL statement on its own, so
+// UpgradeToV1 runs as a series of steps which are safe to re-run.
+//
+// Oracle uppercases unquoted identifiers. Columns read back into Go structs
+// are aliased with quoted lowercase names to match their db tags.
+//
+// Migrations are split on semicolons, so PL/SQL blocks can't yet be used in
+// migration files.
+package oracle
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	go_ora "github.com/sijms/go-ora/v2"
+	"github.com/sijms/go-ora/v2/network"
+	"github.com/thankful-ai/migrate"
+	"github.com/thankful-ai/migrate/sqlstore"
+)
+
+const (
+	// errNameInUse is ORA-00955, reported when creating a table whose
+	// name is already taken.
+	errNameInUse = 955
+
+	// errNoTable is ORA-00942, reported when selecting from a table which
+	// doesn't exist.
+	errNoTable = 942
+
+	// errAlreadyNotNull is ORA-01442, reported when setting NOT NULL on a
+	// column which is already NOT NULL.
+	errAlreadyNotNull = 1442
+)
+
+type DB struct {
+	connURL string
+
+	// Embed the generic SQL store
+	*sqlstore.Store
+}
+
+// New prepares a connection to an Oracle database identified by its service
+// name. When wallet is provided, the connection uses TLS with the
+// certificates in that Oracle wallet directory.
+func New(user, pass, host, service string, port int, wallet string) *DB {
+	opts := map[string]string{}
+	if wallet != "" {
+		opts["SSL"] = "enable"
+		opts["WALLET"] = wallet
+	}
+	return &DB{connURL: go_ora.BuildUrl(host, port, service, user, pass,
+		opts)}
+}
+
+func (db *DB) Open(ctx context.Context) error {
+	var err error
+	db.Store, err = sqlstore.Open("oracle", db.connURL, Dialect{})
+	return err
+}
+
+// regexImplicitCommit matches the start of a statement which Oracle commits
+// the transaction in progress before and after running: DDL of any kind,
+// including of temporary tables, and transaction control.
+var regexImplicitCommit = regexp.MustCompile(`(?is)^` +
+	`(?:\s*/\*.*?\*/|\s*--[^\n]*\n)*\s*(` +
+	`create|alter|drop|truncate|rename|comment|grant|revoke|audit|` +
+	`noaudit|analyze|associate|disassociate|purge|flashback|commit|` +
+	`rollback)\b`)
+
+// regexAlterSession matches ALTER SESSION and ALTER SYSTEM, which Oracle runs
+// without committing.
+var regexAlterSession = regexp.MustCompile(`(?is)^` +
+	`(?:\s*/\*.*?\*/|\s*--[^\n]*\n)*\s*alter\s+(session|system)\b`)
+
+// CommitsImplicitly reports whether Oracle commits the transaction in
+// progress when running stmt, as it does for every DDL statement.
+func (db *DB) CommitsImplicitly(stmt string) bool {
+	stmt = strings.TrimSpace(stmt)
+	return regexImplicitCommit.MatchString(stmt) &&
+		!regexAlterSession.MatchString(stmt)
+}
+
+// Dialect describes Oracle's SQL to sqlstore.
+type Dialect struct{}
+
+// BindType is unused, since Dialect implements sqlstore.Rebinder.
+func (Dialect) BindType() int { return sqlx.UNKNOWN }
+
+// Rebind ? placeholders to Oracle's :1, :2, and so on. The queries sqlstore
+// issues never contain a literal ?, so there's no need to parse strings.
+func (Dialect) Rebind(q string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range q {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+		n++
+		b.WriteString(":" + strconv.Itoa(n))
+	}
+	return b.String()
+}
+
+func (Dialect) Types() sqlstore.Types {
+	return sqlstore.Types{
+		String:     "VARCHAR2(255)",
+		Text:       "CLOB",
+		Integer:    "NUMBER(10)",
+		BigInteger: "NUMBER(19)",
+		Timestamp:  "TIMESTAMP(6) WITH TIME ZONE",
+		Now:        "SYSTIMESTAMP",
+	}
+}
+
+// CreateTableIfNotExists checks user_tables from a PL/SQL block, since Oracle
+// has no IF NOT EXISTS clause for tables.
+func (Dialect) CreateTableIfNotExists(table string, defs []string) string {
+	ddl := fmt.Sprintf("CREATE TABLE %s (%s)", table,
+		strings.Join(defs, ", "))
+	return fmt.Sprintf(`
+	DECLARE
+		n NUMBER;
+	BEGIN
+		SELECT COUNT(*) INTO n FROM user_tables
+		WHERE table_name = UPPER('%s');
+		IF n = 0 THEN
+			EXECUTE IMMEDIATE '%s';
+		END IF;
+	END;`, table, strings.ReplaceAll(ddl, "'", "''"))
+}
+
+// AddColumn wraps the definition in parentheses, which Oracle requires in
+// place of the COLUMN keyword.
+func (Dialect) AddColumn(table, def string) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD (%s)", table, def)
+}
+
+func (Dialect) IsTableExists(err error) bool {
+	return isOracleErr(err, errNameInUse)
+}
+
+func (Dialect) IsTableMissing(err error) bool {
+	return isOracleErr(err, errNoTable)
+}
+
+func (Dialect) UpsertMigration(table string, cols []string) string {
+	return fmt.Sprintf(`
+		MERGE INTO %s t
+		USING (SELECT %s FROM dual) s
+		ON (t.filename = s.filename)
+		WHEN MATCHED THEN
+			UPDATE SET %s
+		WHEN NOT MATCHED THEN
+			INSERT (%s)
+			VALUES (%s)`, table, sqlstore.JoinColumns(cols, "? AS %s"),
+		sqlstore.JoinColumns(cols[1:], "t.%[1]s=s.%[1]s"),
+		strings.Join(cols, ", "), sqlstore.JoinColumns(cols, "s.%s"))
+}
+
+// UpgradeToV1 migrates existing meta tables to the v1 format. Complete any
+// migrations before running this function; this will not succeed if have any
+// existing metacheckpoints.
+//
+// Oracle commits each DDL statement as it runs, so a failed upgrade can't be
+// rolled back. Instead each step is safe to re-run.
+func (d Dialect) UpgradeToV1(
+	ctx context.Context,
+	db *sqlx.DB,
+	migrations []migrate.Migration,
+) error {
+	// Remove the uniqueness constraint from md5. Oracle generates the
+	// constraint's name, so look it up first.
+	q := `
+	BEGIN
+		FOR c IN (
+			SELECT uc.constraint_name
+			FROM user_constraints uc
+			JOIN user_cons_columns cc
+				ON cc.constraint_name = uc.constraint_name
+			WHERE uc.table_name = 'META'
+				AND uc.constraint_type = 'U'
+				AND cc.column_name = 'MD5'
+		) LOOP
+			EXECUTE IMMEDIATE
+				'ALTER TABLE meta DROP CONSTRAINT ' || c.constraint_name;
+		END LOOP;
+	END;`
+	if _, err := db.ExecContext(ctx, q); err != nil {
+		return errors.Wrap(err, "remove md5 unique")
+	}
+
+	// Add a content column to record the exact migration that ran
+	// alongside the md5, insert the appropriate data, then set not null
+	q = addColumnIfNotExists("meta", "content", "CLOB")
+	if _, err := db.ExecContext(ctx, q); err != nil {
+		return errors.Wrap(err, "add content column")
+	}
+	err := inTx(ctx, db, func(tx *sqlx.Tx) error {
+		for _, m := range migrations {
+			q := `UPDATE meta SET content=:1 WHERE filename=:2`
+			_, err := tx.ExecContext(ctx, q, m.Content, m.Filename)
+			if err != nil {
+				return errors.Wrap(err, "update meta content")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	q = `ALTER TABLE meta MODIFY (content NOT NULL)`
+	if _, err := db.ExecContext(ctx, q); err != nil {
+		if !isOracleErr(err, errAlreadyNotNull) {
+			return errors.Wrap(err, "update meta content not null")
+		}
+	}
+
+	// Add the content column to metacheckpoints
+	q = addColumnIfNotExists("metacheckpoints", "content", "CLOB NOT NULL")
+	if _, err := db.ExecContext(ctx, q); err != nil {
+		return errors.Wrap(err, "add metacheckpoints content")
+	}
+
+	q = d.CreateTableIfNotExists("metaversion", []string{
+		"version NUMBER(10) NOT NULL",
+	})
+	if _, err := db.ExecContext(ctx, q); err != nil {
+		return errors.Wrap(err, "create metaversion table")
+	}
+	return inTx(ctx, db, func(tx *sqlx.Tx) error {
+		return sqlstore.SetVersion(ctx, tx, "metaversion", 0, 1)
+	})
+}
+
+// addColumnIfNotExists returns a PL/SQL block adding a column to table unless
+// user_tab_columns shows it's already there.
+func addColumnIfNotExists(table, column, def string) string {
+	return fmt.Sprintf(`
+	DECLARE
+		n NUMBER;
+	BEGIN
+		SELECT COUNT(*) INTO n FROM user_tab_columns
+		WHERE table_name = UPPER('%s') AND column_name = UPPER('%s');
+		IF n = 0 THEN
+			EXECUTE IMMEDIATE 'ALTER TABLE %s ADD (%s %s)';
+		END IF;
+	END;`, table, column, table, column, def)
+}
+
+// inTx runs fn in a transaction. fn must not contain DDL, which Oracle would
+// commit immediately.
+func inTx(
+	ctx context.Context,
+	db *sqlx.DB,
+	fn func(*sqlx.Tx) error,
+) (err error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+	return fn(tx)
+}
+
+// isOracleErr reports whether err is an Oracle error with one of the given
+// ORA- numbers.
+func isOracleErr(err error, codes ...int) bool {
+	var oraErr *network.OracleError
+	if !errors.As(err, &oraErr) {
+		return false
+	}
+	for _, c := range codes {
+		if oraErr.ErrCode == c {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,333 @@
+package oracle
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	go_ora "github.com/sijms/go-ora/v2"
+	"github.com/sijms/go-ora/v2/network"
+	"github.com/thankful-ai/migrate"
+	"github.com/thankful-ai/migrate/sqlstore"
+	"github.com/thankful-ai/migrate/sqlstore/storetest"
+)
+
+var ctx = context.Background()
+
+const checkpointFile = "2.sql"
+
+func TestMain(m *testing.M) {
+	path := filepath.Join("..", "test.env")
+	err := parseEnv(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to parse %s: %s\n", path, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+func TestRebind(t *testing.T) {
+	got := Dialect{}.Rebind(`INSERT INTO t (a, b) VALUES (?, ?)`)
+	want := `INSERT INTO t (a, b) VALUES (:1, :2)`
+	if got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestCreateTableIfNotExists(t *testing.T) {
+	q := Dialect{}.CreateTableIfNotExists("meta", []string{
+		"filename VARCHAR2(255) NOT NULL",
+		"note VARCHAR2(255) DEFAULT 'x' NOT NULL",
+	})
+	if !strings.Contains(q, "table_name = UPPER('meta')") {
+		t.Fatalf("expected user_tables check, got %s", q)
+	}
+
+	// Quotes in the DDL must be escaped inside EXECUTE IMMEDIATE
+	if !strings.Contains(q, "DEFAULT ''x'' NOT NULL") {
+		t.Fatalf("expected escaped quotes, got %s", q)
+	}
+}
+
+func TestCommitsImplicitly(t *testing.T) {
+	var db migrate.ImplicitCommitter = &DB{}
+	for stmt, want := range map[string]bool{
+		"CREATE TABLE users (id NUMBER)":                     true,
+		"create global temporary table t (id number)":        true,
+		"ALTER TABLE users ADD (email VARCHAR2(255))":        true,
+		"DROP INDEX users_name":                              true,
+		"TRUNCATE TABLE users":                               true,
+		"-- why\nCOMMENT ON TABLE users IS 'people'":         true,
+		"GRANT SELECT ON users TO ro":                        true,
+		"INSERT INTO users VALUES (1)":                       false,
+		"UPDATE users SET name = 'CREATE TABLE'":             false,
+		"ALTER SESSION SET NLS_DATE_FORMAT = 'YYYY-MM-DD'":   false,
+		"INSERT INTO tables_created SELECT * FROM created_t": false,
+	} {
+		if got := db.CommitsImplicitly(stmt); got != want {
+			t.Errorf("%q: expected %t, got %t", stmt, want, got)
+		}
+	}
+}
+
+func TestIsOracleErr(t *testing.T) {
+	err := errors.Wrap(&network.OracleError{ErrCode: errNameInUse}, "exec")
+	if !isOracleErr(err, errNameInUse) {
+		t.Fatal("expected name in use error")
+	}
+	if isOracleErr(err, errAlreadyNotNull) {
+		t.Fatal("unexpected match on different code")
+	}
+	if isOracleErr(errors.New("ORA-00955"), errNameInUse) {
+		t.Fatal("unexpected match on plain error")
+	}
+}
+
+func TestCreateMetaIfNotExists(t *testing.T) {
+	db := newDB(t)
+
+	err := db.CreateMetaIfNotExists(ctx)
+	check(t, err)
+
+	// Oracle has no CREATE TABLE IF NOT EXISTS, so make sure the
+	// user_tables guard works
+	err = db.CreateMetaIfNotExists(ctx)
+	check(t, err)
+
+	var tmp []int
+	err = db.DB.Select(&tmp, `SELECT 1 FROM meta`)
+	check(t, err)
+}
+
+func TestCreateMetaVersionIfNotExists(t *testing.T) {
+	db := newDB(t)
+
+	v, err := db.CreateMetaVersionIfNotExists(ctx, 1)
+	check(t, err)
+	if v != 1 {
+		t.Fatalf("expected version 1, got %d", v)
+	}
+	v, err = db.CreateMetaVersionIfNotExists(ctx, 2)
+	check(t, err)
+	if v != 1 {
+		t.Fatalf("expected version 1, got %d", v)
+	}
+}
+
+func TestGetMigrations(t *testing.T) {
+	db := setupDBV1(t)
+
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 1 {
+		t.Fatalf("expected 1 migration, got %d", len(ms))
+	}
+	if ms[0].Content != "SELECT 1;" {
+		t.Fatalf("unexpected content %q", ms[0].Content)
+	}
+}
+
+func TestUpsertMigration(t *testing.T) {
+	db := setupDBV1(t)
+
+	// Content is a CLOB, so make sure it holds more than a VARCHAR2
+	large := strings.Repeat("SELECT 1;\n", 1000)
+	err := db.UpsertMigration(ctx, migrate.Migration{
+		Filename: "1.sql",
+		Content:  large,
+		Checksum: "md5",
+	})
+	check(t, err)
+
+	err = db.UpsertMigration(ctx, migrate.Migration{
+		Filename: "3.sql",
+		Content:  "SELECT 3;",
+		Checksum: "md5",
+	})
+	check(t, err)
+
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(ms))
+	}
+	if ms[0].Content != large {
+		t.Fatal("expected large content to round trip")
+	}
+}
+
+func TestGetMetaCheckpoints(t *testing.T) {
+	db := setupDBV1(t)
+
+	mcs, err := db.GetMetaCheckpoints(ctx, checkpointFile)
+	check(t, err)
+	if len(mcs) != 1 {
+		t.Fatal("expected 1 checkpoint")
+	}
+}
+
+func TestUpgradeToV1Rerun(t *testing.T) {
+	db := setupDBV0(t)
+	migrations := []migrate.Migration{{
+		Filename: "1.sql",
+		Checksum: "md5",
+		Content:  "SELECT 1;",
+	}}
+	check(t, db.UpgradeToV1(ctx, migrations))
+
+	// DDL is committed as it runs, so a failed upgrade must be safe to
+	// retry from the start
+	check(t, db.UpgradeToV1(ctx, migrations))
+
+	v, err := db.CreateMetaVersionIfNotExists(ctx, 1)
+	check(t, err)
+	if v != 1 {
+		t.Fatalf("expected version 1, got %d", v)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) migrate.Store {
+		return newDB(t)
+	})
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newDB(t *testing.T) *DB {
+	db := createDBAndOpen(t)
+	return &DB{Store: sqlstore.New(db.DB, Dialect{})}
+}
+
+func parseEnv(filename string) error {
+	fi, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	scn := bufio.NewScanner(fi)
+	for i := 1; scn.Scan(); i++ {
+		line := scn.Text()
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("bad line %d: %s", i, line)
+		}
+		if err = os.Setenv(parts[0], parts[1]); err != nil {
+			return errors.Wrap(err, "set env")
+		}
+	}
+	if err = scn.Err(); err != nil {
+		return errors.Wrap(err, "scan")
+	}
+	return nil
+}
+
+// createDBAndOpen connects as the test user. Creating a database per test is
+// expensive in Oracle, so instead the meta tables are dropped before and
+// after each test.
+func createDBAndOpen(t *testing.T) *sqlx.DB {
+	user := os.Getenv("ORACLE_USER")
+	if user == "" {
+		panic("missing ORACLE_USER")
+	}
+	pass := os.Getenv("ORACLE_PASSWORD")
+	if pass == "" {
+		panic("missing ORACLE_PASSWORD")
+	}
+	host := os.Getenv("ORACLE_HOST")
+	if host == "" {
+		panic("missing ORACLE_HOST")
+	}
+	service := os.Getenv("ORACLE_SERVICE")
+	if service == "" {
+		panic("missing ORACLE_SERVICE")
+	}
+	hostname, portStr, ok := strings.Cut(host, ":")
+	if !ok {
+		panic("ORACLE_HOST must be host:port")
+	}
+	port, err := strconv.Atoi(portStr)
+	check(t, err)
+
+	db, err := sqlx.Open("oracle", go_ora.BuildUrl(hostname, port, service,
+		user, pass, nil))
+	check(t, err)
+	dropTables(t, db)
+	t.Cleanup(func() {
+		dropTables(t, db)
+		_ = db.Close()
+	})
+	return db
+}
+
+func dropTables(t *testing.T, db *sqlx.DB) {
+	for _, table := range []string{"meta", "metacheckpoints", "metaversion"} {
+		// Ignore ORA-00942, table or view does not exist
+		_, err := db.Exec(`DROP TABLE ` + table + ` PURGE`)
+		if err != nil && !isOracleErr(err, 942) {
+			check(t, err)
+		}
+	}
+}
+
+func setupDBV1(t *testing.T) *DB {
+	db := setupDBV0(t)
+	err := db.UpgradeToV1(ctx, []migrate.Migration{{
+		Filename: "1.sql",
+		Checksum: "md5",
+		Content:  "SELECT 1;",
+	}})
+	check(t, err)
+
+	q := `
+		INSERT INTO metacheckpoints (idx, filename, content, md5)
+		VALUES (:1, :2, :3, :4)`
+	_, err = db.DB.Exec(q, 0, checkpointFile, "SELECT 2;", "md5")
+	check(t, err)
+
+	return db
+}
+
+func setupDBV0(t *testing.T) *DB {
+	db := newDB(t)
+
+	q := `CREATE TABLE meta (
+		filename VARCHAR2(255) UNIQUE NOT NULL,
+		md5 VARCHAR2(255) UNIQUE NOT NULL,
+		createdat TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL
+	)`
+	_, err := db.DB.Exec(q)
+	check(t, err)
+
+	q = `CREATE TABLE metacheckpoints (
+		filename VARCHAR2(255) NOT NULL,
+		idx NUMBER(10) NOT NULL,
+		md5 VARCHAR2(255) NOT NULL,
+		createdat TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		PRIMARY KEY (filename, idx)
+	)`
+	_, err = db.DB.Exec(q)
+	check(t, err)
+
+	q = `INSERT INTO meta (filename, md5) VALUES (:1, :2)`
+	_, err = db.DB.Exec(q, "1.sql", "md5")
+	check(t, err)
+
+	return db
+}
@@ -0,0 +1,161 @@
+package migrate
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Ordering decides the order migration files run in. Less reports whether the
+// file named a runs before b. Two files neither of which runs before the other,
+// such as 17_a.sql and 0017_b.sql by NumericPrefix, are refused as
+// duplicates. Migrate sorts both the files and the migrations recorded in meta
+// by the same Ordering, so they're compared in the same order whatever order
+// the store returns them in.
+//
+// Each file's name starts with a number, whichever the Ordering. One which
+// accepts only some names, such as Timestamp, implements NameChecker.
+type Ordering interface {
+	Less(a, b string) bool
+}
+
+// NameChecker is implemented by an Ordering which refuses some names. New
+// reports the error from CheckName for each it refuses.
+type NameChecker interface {
+	CheckName(name string) error
+}
+
+// WithOrdering sets the order files run in, which is NumericPrefix by
+// default. Every run on a database should use the same one.
+func WithOrdering(o Ordering) Option {
+	return func(m *Migrate) { m.ordering = o }
+}
+
+// NumericPrefix orders files by the value of the number their names start
+// with, so 2.sql runs before 10.sql and 0002_x.sql before 0010_x.sql. It's
+// the default Ordering.
+type NumericPrefix struct{}
+
+func (NumericPrefix) Less(a, b string) bool {
+	return compareDigits(regexNum.FindString(a), regexNum.FindString(b)) < 0
+}
+
+// Timestamp orders files as NumericPrefix does, but refuses any not numbered
+// by a timestamp in TimestampFormat, such as 20240611153000_add_index.sql.
+type Timestamp struct{}
+
+func (Timestamp) Less(a, b string) bool { return NumericPrefix{}.Less(a, b) }
+
+func (Timestamp) CheckName(name string) error {
+	if !isTimestamp(regexNum.FindString(name)) {
+		return fmt.Errorf("%s must start with a timestamp like %s",
+			name, TimestampFormat)
+	}
+	return nil
+}
+
+// Lexicographic orders files by their names byte by byte, so 10.sql runs
+// before 2.sql. Names are typically zero-padded to the same width for it,
+// such as 0002.sql and 0010.sql.
+type Lexicographic struct{}
+
+func (Lexicographic) Less(a, b string) bool { return a < b }
+
+// order returns the Ordering set by WithOrdering, or the default.
+func (m *Migrate) order() Ordering {
+	if m.ordering == nil {
+		return NumericPrefix{}
+	}
+	return m.ordering
+}
+
+// sortMigrations sorts ms by the Migrate's Ordering of their base names, as
+// sortFiles sorts files. Stores sort them by SortMigrations, which ties are
+// left in.
+func (m *Migrate) sortMigrations(ms []Migration) {
+	o := m.order()
+	sort.SliceStable(ms, func(i, j int) bool {
+		return o.Less(path.Base(ms[i].Filename), path.Base(ms[j].Filename))
+	})
+}
+
+// CompareFilenames orders migration filenames as NumericPrefix runs them,
+// returning -1 if a comes first, 1 if b does, and 0 if they're equal. Runs of
+// digits compare by their value, however long, and the rest byte by byte, so
+// 2.sql comes before 10.sql, 0002_x.sql before 0010_x.sql, and V2__x.sql
+// before V10__x.sql. Names equal but for leading zeros compare by their bytes.
+//
+// Stores use it to sort meta, since SQL can't order by a numeric prefix the
+// same way in every database, or at all for names without one. Migrate sorts
+// what they return again by its Ordering.
+func CompareFilenames(a, b string) int {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if !isDigit(a[i]) || !isDigit(b[j]) {
+			if a[i] != b[j] {
+				if a[i] < b[j] {
+					return -1
+				}
+				return 1
+			}
+			i++
+			j++
+			continue
+		}
+		ai, bj := i, j
+		for i < len(a) && isDigit(a[i]) {
+			i++
+		}
+		for j < len(b) && isDigit(b[j]) {
+			j++
+		}
+		if c := compareDigits(a[ai:i], b[bj:j]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case i < len(a):
+		return 1
+	case j < len(b):
+		return -1
+	}
+	return strings.Compare(a, b)
+}
+
+// SortMigrations sorts ms by filename, as CompareFilenames orders them. Those
+// in subdirectories sort by their base names, as WithSubdirectories runs them.
+func SortMigrations(ms []Migration) {
+	sort.SliceStable(ms, func(i, j int) bool {
+		a, b := ms[i].Filename, ms[j].Filename
+		if c := CompareFilenames(path.Base(a), path.Base(b)); c != 0 {
+			return c < 0
+		}
+		return a < b
+	})
+}
+
+// compareDigits compares the numbers a and b, strings of digits, by value
+// without parsing them, so they may be any length.
+func compareDigits(a, b string) int {
+	a = trimZeros(a)
+	b = trimZeros(b)
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// trimZeros trims the leading zeros of the number s, leaving "0" for zero.
+func trimZeros(s string) string {
+	s = strings.TrimLeft(s, "0")
+	if s == "" {
+		return "0"
+	}
+	return s
+}
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
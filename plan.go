@@ -0,0 +1,203 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+// WithDryRun makes Migrate, Down, DownTo and DownFromStore fill p with what
+// they would run rather than running it. They read everything the run would,
+// including the checksums and checkpoints of each file, and report the same
+// errors, such as an *ErrChecksumMismatch, but neither run a statement nor
+// write to the database, so take no lock. Missing meta tables are read as
+// empty, and meta which needs an upgrade is reported as it is. ApplyOne,
+// Rerun, Repair, RehashChecksums and MigrateAll refuse it.
+func WithDryRun(p *Plan) Option {
+	return func(m *Migrate) { m.plan = p }
+}
+
+// Plan is what a dry run found would run, in order.
+type Plan struct {
+	// Direction is "up" for Migrate, or "down" for a rollback.
+	Direction string        `json:"direction"`
+	Files     []PlannedFile `json:"files"`
+}
+
+// PlannedFile is a migration a dry run found would run, or roll back.
+type PlannedFile struct {
+	Filename string `json:"filename"`
+
+	// Statements counts the statements which would run, of which files run
+	// as one batch, such as Go migrations, have one.
+	Statements int `json:"statements"`
+
+	// Mode is "multi", "no-split" or "go" for a file run as one batch, or
+	// "transaction" for one run in a transaction.
+	Mode string `json:"mode,omitempty"`
+
+	// Resume reports whether the file would resume after the Checkpoints
+	// statements an earlier attempt ran.
+	Resume      bool `json:"resume"`
+	Checkpoints int  `json:"checkpoints,omitempty"`
+
+	// Rerun reports whether the file is applied already, and would run
+	// again.
+	Rerun bool `json:"rerun,omitempty"`
+
+	// Source is where a rollback reads its down migration from: "file" or
+	// "store", or empty for a migration recorded as skipped, which runs
+	// nothing.
+	Source string `json:"source,omitempty"`
+}
+
+// String renders p as a table, one file a row.
+func (p *Plan) String() string {
+	if len(p.Files) == 0 {
+		if p.Direction == "down" {
+			return "nothing to roll back\n"
+		}
+		return "up to date\n"
+	}
+	var buf strings.Builder
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	last := "RESUME"
+	if p.Direction == "down" {
+		last = "SOURCE"
+	}
+	fmt.Fprintf(w, "FILE\tSTATEMENTS\tMODE\t%s\n", last)
+	for _, f := range p.Files {
+		mode := f.Mode
+		if mode == "" {
+			mode = "-"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", f.Filename, f.Statements, mode,
+			f.lastColumn(p.Direction))
+	}
+	_ = w.Flush()
+	return buf.String()
+}
+
+// lastColumn returns what f's row of a plan of direction ends with: where a
+// rollback reads it from, or where a migration resumes.
+func (f PlannedFile) lastColumn(direction string) string {
+	switch {
+	case direction == "down" && f.Source == "":
+		return "skipped"
+	case direction == "down":
+		return f.Source
+	case f.Rerun:
+		return "rerun"
+	case !f.Resume:
+		return "-"
+	case f.Checkpoints >= f.Statements:
+		return "every statement has run"
+	}
+	return "from " + statementAt(f.Checkpoints, 0)
+}
+
+// readMeta checks the version of the meta tables, as prepareMeta does without
+// creating or upgrading them, noting if they don't exist yet.
+func (m *Migrate) readMeta(ctx context.Context) error {
+	v, exists, err := m.db.GetMetaVersion(ctx)
+	switch {
+	case err != nil:
+		return errors.Wrap(err, "get meta version")
+	case !exists:
+		m.noMeta = true
+		return nil
+	case v > version:
+		return &ErrVersionTooNew{Have: v, Want: version}
+	case v < version && m.upgrade:
+		return fmt.Errorf("a dry run can't plan past an upgrade of meta: %w",
+			&ErrUpgradeRequired{Have: v, Want: version})
+	case v < version:
+		return &ErrUpgradeRequired{Have: v, Want: version}
+	}
+	if cl, ok := m.db.(ContentLimiter); ok {
+		m.maxContent, err = cl.MaxContentSize(ctx)
+		if err != nil {
+			return errors.Wrap(err, "max content size")
+		}
+	}
+	return nil
+}
+
+// refuseDryRun reports an error if it's a dry run, which what doesn't
+// support.
+func (m *Migrate) refuseDryRun(what string) error {
+	if m.plan != nil {
+		return fmt.Errorf("%s doesn't support a dry run", what)
+	}
+	return nil
+}
+
+// planUp fills the plan with the files Migrate would run.
+func (m *Migrate) planUp(ctx context.Context) error {
+	if err := m.reloadMigrations(ctx); err != nil {
+		return errors.Wrap(err, "reload migrations")
+	}
+	m.plan.Direction = "up"
+	m.plan.Files = nil
+	for _, f := range m.toRun() {
+		pf, err := m.planFile(ctx, f)
+		if err != nil {
+			return err
+		}
+		m.plan.Files = append(m.plan.Files, pf)
+	}
+	return nil
+}
+
+// planFile reads f as migrateFile would before running it, reporting the same
+// errors.
+func (m *Migrate) planFile(ctx context.Context, f *file) (PlannedFile, error) {
+	pf := PlannedFile{Filename: f.Info.Name(), Rerun: m.reruns[f.Info.Name()]}
+	byt, err := fs.ReadFile(m.fsys, f.fullpath)
+	if err != nil {
+		return pf, err
+	}
+	byt = normalizeLineEndings(byt)
+	if err = m.checkContentSize(f, byt); err != nil {
+		return pf, err
+	}
+	if goMigrationOf(f.Info) != nil {
+		pf.Mode, pf.Statements = "go", 1
+		return pf, nil
+	}
+	d, body, err := parseDirectives(byt)
+	if err != nil {
+		return pf, fmt.Errorf("%s: %w", f.Info.Name(), err)
+	}
+	if d.multi {
+		pf.Mode, pf.Statements = "multi", 1
+		return pf, m.checkMultiFile(ctx, f, body)
+	}
+	stmts, err := m.statementsOf(f, d, body)
+	if err != nil {
+		return pf, err
+	}
+	if d.noSplit {
+		pf.Mode = "no-split"
+	}
+	dirLines := lineOf(string(byt), len(byt)-len(body)) - 1
+	if m.inTransaction(d) {
+		pf.Mode, pf.Statements = "transaction", len(stmts)
+		if err = m.checkTransaction(f, stmts, dirLines); err != nil {
+			return pf, err
+		}
+		return pf, m.checkNoCheckpoints(ctx, f)
+	}
+	checkpoints, err := m.verifiedCheckpoints(ctx, f, stmts, dirLines)
+	if err != nil {
+		return pf, err
+	}
+	pf.Statements = len(stmts)
+	pf.Checkpoints = len(checkpoints)
+	pf.Resume = len(checkpoints) > 0
+	return pf, nil
+}
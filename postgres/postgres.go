@@ -1,168 +1,153 @@
 package postgres
 
 import (
-	"database/sql"
+	"context"
 	"fmt"
 	"strings"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	"github.com/thankful-ai/migrate"
+	"github.com/thankful-ai/migrate/sqlstore"
+)
+
+// errDuplicateTable is the SQLSTATE Postgres reports when creating a table
+// that already exists.
+const errDuplicateTable = pq.ErrorCode("42P07")
 
-	_ "github.com/lib/pq"
+// errUndefinedTable and errInvalidSchema are the SQLSTATEs Postgres reports
+// when selecting from a table, or a table in a schema, which doesn't exist.
+const (
+	errUndefinedTable = pq.ErrorCode("42P01")
+	errInvalidSchema  = pq.ErrorCode("3F000")
 )
 
 type DB struct {
 	connURL string
 
-	// Embed the sqlx DB struct
-	*sqlx.DB
+	// Embed the generic SQL store
+	*sqlstore.Store
 }
 
+// New prepares a connection to a Postgres database. sslMode is passed through
+// to the driver and may be one of disable, require, verify-ca or verify-full.
+// When sslMode is empty it defaults to verify-ca if sslKey is provided and
+// disable otherwise.
 func New(
 	user, pass, host, dbName string,
 	port int,
-	sslKey, sslCert, sslCA string,
-) *DB {
-	// The trailing space is important
-	url := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s ",
-		host, port, user, pass, dbName)
-	if sslKey == "" {
-		url += "sslmode=disable"
-	} else {
-		url += fmt.Sprintf(
-			"sslmode=verify-ca sslkey=%s sslcert=%s sslrootcert=%s",
-			sslKey, sslCert, sslCA)
+	sslMode, sslKey, sslCert, sslCA string,
+) (*DB, error) {
+	url, err := ConnURL(user, pass, host, dbName, port, sslMode, sslKey,
+		sslCert, sslCA)
+	if err != nil {
+		return nil, err
 	}
-	return &DB{connURL: url}
+	return &DB{connURL: url}, nil
 }
 
-func (db *DB) CreateMetaIfNotExists() error {
-	q := `CREATE TABLE IF NOT EXISTS meta (
-		filename TEXT UNIQUE NOT NULL,
-		md5 TEXT NOT NULL,
-		content TEXT NOT NULL,
-		createdat TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'utc')
-	)`
-	if _, err := db.Exec(q); err != nil {
-		return errors.Wrap(err, "create meta table")
+// ConnURL returns the key/value connection string for the arguments of New,
+// for stores of databases speaking the Postgres wire protocol.
+func ConnURL(
+	user, pass, host, dbName string,
+	port int,
+	sslMode, sslKey, sslCert, sslCA string,
+) (string, error) {
+	if sslMode == "" {
+		sslMode = "disable"
+		if sslKey != "" {
+			sslMode = "verify-ca"
+		}
 	}
-	return nil
-}
-
-func (db *DB) CreateMetaCheckpointsIfNotExists() error {
-	q := `CREATE TABLE IF NOT EXISTS metacheckpoints (
-		filename TEXT NOT NULL,
-		idx INTEGER NOT NULL,
-		md5 TEXT NOT NULL,
-		content TEXT NOT NULL,
-		createdat TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'utc'),
-		PRIMARY KEY (filename, idx)
-	)`
-	if _, err := db.Exec(q); err != nil {
-		return errors.Wrap(err, "create metacheckpoints table")
+	switch sslMode {
+	case "disable":
+		if sslKey != "" || sslCert != "" || sslCA != "" {
+			return "", errors.New("ssl files provided but ssl mode is disable")
+		}
+	case "require", "verify-ca", "verify-full":
+		if (sslKey == "") != (sslCert == "") {
+			return "", errors.New("ssl key and cert must be provided together")
+		}
+	default:
+		return "", fmt.Errorf("unknown ssl mode %q", sslMode)
 	}
-	return nil
-}
-
-func (db *DB) GetMigrations() ([]migrate.Migration, error) {
-	migrations := []migrate.Migration{}
-	q := `
-	SELECT filename, content, md5 AS checksum
-	FROM meta
-	ORDER BY substring(filename, '^\d+')::int`
-	err := db.Select(&migrations, q)
-	return migrations, err
 
+	// The trailing space is important
+	url := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s ",
+		quote(host), port, quote(user), quote(pass), quote(dbName))
+	url += "sslmode=" + sslMode
+	if sslKey != "" {
+		url += fmt.Sprintf(" sslkey=%s sslcert=%s", quote(sslKey),
+			quote(sslCert))
+	}
+	if sslCA != "" {
+		url += " sslrootcert=" + quote(sslCA)
+	}
+	return url, nil
 }
 
-func (db *DB) GetMetaCheckpoints(filename string) ([]string, error) {
-	checkpoints := []string{}
-	q := `SELECT md5 FROM metacheckpoints WHERE filename=$1 ORDER BY idx`
-	err := db.Select(&checkpoints, q, filename)
-	return checkpoints, err
+// quote a value for use in a key/value connection string, so passwords
+// containing spaces or quotes survive intact.
+func quote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `'`, `\'`)
+	return "'" + s + "'"
 }
 
-func (db *DB) UpsertMigration(filename, content, checksum string) error {
-	q := `
-		INSERT INTO meta (filename, content, md5) VALUES ($1, $2, $3)
-		ON CONFLICT (filename) DO UPDATE SET md5=$4, content=$5`
-	_, err := db.Exec(q, filename, content, checksum, checksum, content)
+func (db *DB) Open(ctx context.Context) error {
+	var err error
+	db.Store, err = sqlstore.Open("postgres", db.connURL, Dialect{})
 	return err
 }
 
-func (db *DB) InsertMetaCheckpoint(
-	filename, content, checksum string,
-	idx int,
-) error {
-	q := `
-		INSERT INTO metacheckpoints (filename, content, idx, md5)
-		VALUES ($1, $2, $3, $4)`
-	_, err := db.Exec(q, filename, content, idx, checksum)
-	return err
-}
+// Dialect describes Postgres' SQL to sqlstore.
+type Dialect struct{}
 
-func (db *DB) InsertMigration(filename, content, checksum string) error {
-	q := `INSERT INTO meta (filename, content, md5) VALUES ($1, $2, $3)`
-	_, err := db.Exec(q, filename, content, checksum)
-	return err
-}
+func (Dialect) BindType() int { return sqlx.DOLLAR }
 
-func (db *DB) DeleteMetaCheckpoints() error {
-	q := `DELETE FROM metacheckpoints`
-	_, err := db.Exec(q)
-	return err
+func (Dialect) Types() sqlstore.Types {
+	return sqlstore.Types{
+		String:     "TEXT",
+		Text:       "TEXT",
+		Integer:    "INTEGER",
+		BigInteger: "BIGINT",
+		Timestamp:  "TIMESTAMPTZ",
+		Now:        "now()",
+	}
 }
 
-func (db *DB) CreateMetaVersionIfNotExists(schemaVersion int) (int, error) {
-	created := true
-	q := `CREATE TABLE metaversion (
-		version INTEGER NOT NULL
-	)`
-	if _, err := db.Exec(q); err != nil {
-		// Check if the table already existed
-		if !strings.Contains(err.Error(), "already exists") {
-			return 0, errors.Wrap(err, "create metaversion table")
-		}
-		created = false
-	}
+func (Dialect) CreateTableIfNotExists(table string, defs []string) string {
+	return sqlstore.CreateTableIfNotExists(table, defs)
+}
 
-	var version int
-	q = `SELECT version FROM metaversion`
-	err := db.Get(&version, q)
-	switch {
-	case err == sql.ErrNoRows:
-		if !created {
-			schemaVersion = 0
-		}
-		q = `INSERT INTO metaversion (version) VALUES ($1)`
-		if _, err := db.Exec(q, schemaVersion); err != nil {
-			return 0, errors.Wrap(err, "insert version")
-		}
-		return schemaVersion, nil
-	case err != nil:
-		return 0, errors.Wrap(err, "get version")
-	}
-	return version, nil
+func (Dialect) IsTableExists(err error) bool {
+	return IsError(err, errDuplicateTable)
 }
 
-func (db *DB) Close() error { return db.DB.Close() }
+func (Dialect) IsTableMissing(err error) bool {
+	return IsError(err, errUndefinedTable, errInvalidSchema)
+}
 
-func (db *DB) Open() error {
-	var err error
-	db.DB, err = sqlx.Open("postgres", db.connURL)
-	if err != nil {
-		return errors.Wrap(err, "open db connection")
-	}
-	return nil
+func (Dialect) UpsertMigration(table string, cols []string) string {
+	return fmt.Sprintf(`
+		INSERT INTO %s (%s) VALUES (%s)
+		ON CONFLICT (filename)
+		DO UPDATE SET %s`, table, strings.Join(cols, ", "),
+		sqlstore.Placeholders(len(cols)),
+		sqlstore.JoinColumns(cols[1:], "%[1]s=excluded.%[1]s"))
 }
 
 // UpgradeToV1 migrates existing meta tables to the v1 format. Complete any
 // migrations before running this function; this will not succeed if have any
 // existing metacheckpoints.
-func (db *DB) UpgradeToV1(migrations []migrate.Migration) (err error) {
+func (Dialect) UpgradeToV1(
+	ctx context.Context,
+	db *sqlx.DB,
+	migrations []migrate.Migration,
+) (err error) {
 	// Begin Tx
-	tx, err := db.Beginx()
+	tx, err := db.BeginTxx(ctx, nil)
 	if err != nil {
 		return errors.Wrap(err, "begin tx")
 	}
@@ -176,7 +161,7 @@ func (db *DB) UpgradeToV1(migrations []migrate.Migration) (err error) {
 
 	// Remove the uniqueness constraint from md5
 	q := `ALTER TABLE meta DROP CONSTRAINT meta_md5_key`
-	if _, err = tx.Exec(q); err != nil {
+	if _, err = tx.ExecContext(ctx, q); err != nil {
 		err = errors.Wrap(err, "remove md5 unique")
 		return
 	}
@@ -184,19 +169,20 @@ func (db *DB) UpgradeToV1(migrations []migrate.Migration) (err error) {
 	// Add a content column to record the exact migration that ran
 	// alongside the md5, insert the appropriate data, then set not null
 	q = `ALTER TABLE meta ADD COLUMN content TEXT`
-	if _, err = tx.Exec(q); err != nil {
+	if _, err = tx.ExecContext(ctx, q); err != nil {
 		err = errors.Wrap(err, "add content column")
 		return
 	}
 	for _, m := range migrations {
 		q = `UPDATE meta SET content=$1 WHERE filename=$2`
-		if _, err = tx.Exec(q, m.Content, m.Filename); err != nil {
+		_, err = tx.ExecContext(ctx, q, m.Content, m.Filename)
+		if err != nil {
 			err = errors.Wrap(err, "update meta content")
 			return
 		}
 	}
 	q = `ALTER TABLE meta ALTER COLUMN content SET NOT NULL`
-	if _, err = tx.Exec(q); err != nil {
+	if _, err = tx.ExecContext(ctx, q); err != nil {
 		err = errors.Wrap(err, "update meta content not null")
 		return
 	}
@@ -205,26 +191,31 @@ func (db *DB) UpgradeToV1(migrations []migrate.Migration) (err error) {
 	q = `
 	ALTER TABLE metacheckpoints
 	ADD COLUMN IF NOT EXISTS content TEXT NOT NULL`
-	if _, err = tx.Exec(q); err != nil {
+	if _, err = tx.ExecContext(ctx, q); err != nil {
 		err = errors.Wrap(err, "add metacheckpoints content")
 		return
 	}
 
 	q = `
 	CREATE TABLE IF NOT EXISTS metaversion (version INTEGER NOT NULL)`
-	if _, err = tx.Exec(q); err != nil {
+	if _, err = tx.ExecContext(ctx, q); err != nil {
 		err = errors.Wrap(err, "create metaversion table")
 		return
 	}
-	q = `DELETE FROM metaversion`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "delete metaversion")
-		return
+	return sqlstore.SetVersion(ctx, tx, "metaversion", 0, 1)
+}
+
+// IsError reports whether err is a Postgres error with one of the given
+// SQLSTATE codes.
+func IsError(err error, codes ...pq.ErrorCode) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
 	}
-	q = `INSERT INTO metaversion (version) VALUES (1)`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "insert metaversion")
-		return
+	for _, c := range codes {
+		if pqErr.Code == c {
+			return true
+		}
 	}
-	return nil
+	return false
 }
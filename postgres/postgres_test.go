@@ -2,6 +2,7 @@ package postgres
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -9,11 +10,15 @@ import (
 	"testing"
 
 	"github.com/thankful-ai/migrate"
+	"github.com/thankful-ai/migrate/sqlstore"
+	"github.com/thankful-ai/migrate/sqlstore/storetest"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 	"github.com/pkg/errors"
 )
 
+var ctx = context.Background()
+
 const checkpointFile = "2.sql"
 
 func TestMain(m *testing.M) {
@@ -26,10 +31,91 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		sslMode string
+		sslKey  string
+		sslCert string
+		sslCA   string
+		want    string
+		wantErr bool
+	}{{
+		name: "default disable",
+		want: "sslmode=disable",
+	}, {
+		name:    "default verify-ca with key",
+		sslKey:  "key.pem",
+		sslCert: "cert.pem",
+		sslCA:   "ca.pem",
+		want:    "sslmode=verify-ca sslkey='key.pem' sslcert='cert.pem' sslrootcert='ca.pem'",
+	}, {
+		name:    "require without client certs",
+		sslMode: "require",
+		want:    "sslmode=require",
+	}, {
+		name:    "verify-full with ca",
+		sslMode: "verify-full",
+		sslCA:   "ca.pem",
+		want:    "sslmode=verify-full sslrootcert='ca.pem'",
+	}, {
+		name:    "key without cert",
+		sslMode: "verify-ca",
+		sslKey:  "key.pem",
+		wantErr: true,
+	}, {
+		name:    "files with disable",
+		sslMode: "disable",
+		sslCA:   "ca.pem",
+		wantErr: true,
+	}, {
+		name:    "unknown mode",
+		sslMode: "prefer-ish",
+		wantErr: true,
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db, err := New("user", "it's a secret", "localhost", "db",
+				5432, tc.sslMode, tc.sslKey, tc.sslCert, tc.sslCA)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			check(t, err)
+			prefix := `host='localhost' port=5432 user='user' password='it\'s a secret' dbname='db' `
+			if db.connURL != prefix+tc.want {
+				t.Fatalf("expected %q, got %q", prefix+tc.want,
+					db.connURL)
+			}
+		})
+	}
+}
+
+func TestCreateMetaVersionIfNotExists(t *testing.T) {
+	db := newDB(t)
+
+	// A fresh database starts at the requested version
+	v, err := db.CreateMetaVersionIfNotExists(ctx, 1)
+	check(t, err)
+	if v != 1 {
+		t.Fatalf("expected version 1, got %d", v)
+	}
+
+	// Calling again reports the stored version rather than failing on
+	// the existing table
+	v, err = db.CreateMetaVersionIfNotExists(ctx, 2)
+	check(t, err)
+	if v != 1 {
+		t.Fatalf("expected version 1, got %d", v)
+	}
+}
+
 func TestCreateMetaIfNotExists(t *testing.T) {
 	db := newDB(t)
 
-	err := db.CreateMetaIfNotExists()
+	err := db.CreateMetaIfNotExists(ctx)
 	check(t, err)
 
 	var tmp []int
@@ -40,7 +126,7 @@ func TestCreateMetaIfNotExists(t *testing.T) {
 func TestCreateMetaCheckpointsIfNotExists(t *testing.T) {
 	db := newDB(t)
 
-	err := db.CreateMetaCheckpointsIfNotExists()
+	err := db.CreateMetaCheckpointsIfNotExists(ctx)
 	check(t, err)
 
 	var tmp []int
@@ -51,7 +137,7 @@ func TestCreateMetaCheckpointsIfNotExists(t *testing.T) {
 func TestGetMigrations(t *testing.T) {
 	db := setupDBV1(t)
 
-	ms, err := db.GetMigrations()
+	ms, err := db.GetMigrations(ctx)
 	check(t, err)
 	if len(ms) != 1 {
 		t.Fatalf("expected 1 migration, got %d", len(ms))
@@ -61,7 +147,7 @@ func TestGetMigrations(t *testing.T) {
 func TestGetMetaCheckpoints(t *testing.T) {
 	db := setupDBV1(t)
 
-	mcs, err := db.GetMetaCheckpoints(checkpointFile)
+	mcs, err := db.GetMetaCheckpoints(ctx, checkpointFile)
 	check(t, err)
 	if len(mcs) != 1 {
 		t.Fatal("expected 1 checkpoint")
@@ -72,14 +158,22 @@ func TestUpsertMigration(t *testing.T) {
 	db := setupDBV1(t)
 
 	// Test update
-	err := db.UpsertMigration("1.sql", "SELECT 1;", "md5")
+	err := db.UpsertMigration(ctx, migrate.Migration{
+		Filename: "1.sql",
+		Content:  "SELECT 1;",
+		Checksum: "md5",
+	})
 	check(t, err)
 
 	// Test insert
-	err = db.UpsertMigration("3.sql", "SELECT 3;", "md5")
+	err = db.UpsertMigration(ctx, migrate.Migration{
+		Filename: "3.sql",
+		Content:  "SELECT 3;",
+		Checksum: "md5",
+	})
 	check(t, err)
 
-	ms, err := db.GetMigrations()
+	ms, err := db.GetMigrations(ctx)
 	check(t, err)
 	if len(ms) != 2 {
 		t.Fatalf("expected 2 migrations, got %d", len(ms))
@@ -89,10 +183,10 @@ func TestUpsertMigration(t *testing.T) {
 func TestInsertMetaCheckpoint(t *testing.T) {
 	db := setupDBV1(t)
 
-	err := db.InsertMetaCheckpoint(checkpointFile, "SELECT 3;", "md5", 1)
+	err := db.InsertMetaCheckpoint(ctx, checkpointFile, "SELECT 3;", "md5", 1)
 	check(t, err)
 
-	mcs, err := db.GetMetaCheckpoints(checkpointFile)
+	mcs, err := db.GetMetaCheckpoints(ctx, checkpointFile)
 	check(t, err)
 	if len(mcs) != 2 {
 		t.Fatal("expected 2 checkpoints")
@@ -102,10 +196,14 @@ func TestInsertMetaCheckpoint(t *testing.T) {
 func TestInsertMigration(t *testing.T) {
 	db := setupDBV1(t)
 
-	err := db.InsertMigration("3.sql", "SELECT 3;", "md5")
+	err := db.InsertMigration(ctx, migrate.Migration{
+		Filename: "3.sql",
+		Content:  "SELECT 3;",
+		Checksum: "md5",
+	})
 	check(t, err)
 
-	ms, err := db.GetMigrations()
+	ms, err := db.GetMigrations(ctx)
 	check(t, err)
 	if len(ms) != 2 {
 		t.Fatal("expected 2 migrations")
@@ -115,16 +213,22 @@ func TestInsertMigration(t *testing.T) {
 func TestDeleteMetaCheckpoints(t *testing.T) {
 	db := setupDBV1(t)
 
-	err := db.DeleteMetaCheckpoints()
+	err := db.DeleteMetaCheckpoints(ctx)
 	check(t, err)
 
-	mcs, err := db.GetMetaCheckpoints(checkpointFile)
+	mcs, err := db.GetMetaCheckpoints(ctx, checkpointFile)
 	check(t, err)
 	if len(mcs) != 0 {
 		t.Fatal("expected 0 checkpoints")
 	}
 }
 
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) migrate.Store {
+		return newDB(t)
+	})
+}
+
 func check(t *testing.T, err error) {
 	t.Helper()
 	if err != nil {
@@ -134,7 +238,7 @@ func check(t *testing.T, err error) {
 
 func newDB(t *testing.T) *DB {
 	db := createDBAndOpen(t)
-	return &DB{DB: db}
+	return &DB{Store: sqlstore.New(db.DB, Dialect{})}
 }
 
 func parseEnv(filename string) error {
@@ -227,7 +331,7 @@ func teardown(db *sqlx.DB) func() {
 
 func setupDBV1(t *testing.T) *DB {
 	db := setupDBV0(t)
-	err := db.UpgradeToV1([]migrate.Migration{{
+	err := db.UpgradeToV1(ctx, []migrate.Migration{{
 		Filename: "1.sql",
 		Checksum: "md5",
 		Content:  "SELECT 1;",
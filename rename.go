@@ -0,0 +1,135 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// WithAllowRename records an applied migration whose file was renamed, such as
+// 12.sql to 0012_create_orders.sql, by its new name rather than running it
+// again. A recorded migration no file has is matched to the one file which
+// isn't recorded and has exactly its checksum, so a file renamed and edited
+// isn't matched. A checksum shared by two such migrations or files is reported
+// rather than guessed. It needs a store implementing Renamer.
+func WithAllowRename() Option {
+	return func(m *Migrate) { m.allowRename = true }
+}
+
+// renameFiles records the applied migrations whose files were renamed by their
+// new names, with WithAllowRename.
+func (m *Migrate) renameFiles(ctx context.Context) error {
+	if !m.allowRename {
+		return nil
+	}
+	index := m.fileIndexes()
+	var orphans []Migration
+	recorded := make(map[string]bool, len(m.Migrations))
+	for _, mg := range m.Migrations {
+		recorded[mg.Filename] = true
+		_, ok := index[mg.Filename]
+		if !ok && (mg.Status == StatusApplied || mg.Status == StatusSkipped) {
+			orphans = append(orphans, mg)
+		}
+	}
+	if len(orphans) == 0 {
+		return nil
+	}
+
+	// Checksums are keyed by their algorithms, since the migrations may
+	// have been recorded with different ones
+	orphansByChecksum := map[string][]string{}
+	algos := map[string]bool{}
+	for _, mg := range orphans {
+		key := recordedAlgo(mg) + ":" + mg.Checksum
+		orphansByChecksum[key] = append(orphansByChecksum[key],
+			mg.Filename)
+		algos[recordedAlgo(mg)] = true
+	}
+	byChecksum := map[string][]*file{}
+	for _, f := range m.Files {
+		if recorded[f.Info.Name()] {
+			continue
+		}
+		for algo := range algos {
+			check, err := fileChecksum(m.fsys, f.fullpath, algo)
+			if err != nil {
+				return fmt.Errorf("checksum %s: %w", f.Info.Name(), err)
+			}
+			key := algo + ":" + check
+			byChecksum[key] = append(byChecksum[key], f)
+		}
+	}
+
+	var renames [][2]string
+	var ambiguous []string
+	reported := map[string]bool{}
+	for _, mg := range orphans {
+		key := recordedAlgo(mg) + ":" + mg.Checksum
+		files := byChecksum[key]
+		same := orphansByChecksum[key]
+		switch {
+		case len(files) == 0:
+		case len(files) == 1 && len(same) == 1:
+			renames = append(renames,
+				[2]string{mg.Filename, files[0].Info.Name()})
+		case !reported[key]:
+			reported[key] = true
+			names := make([]string, len(files))
+			for i, f := range files {
+				names[i] = f.Info.Name()
+			}
+			ambiguous = append(ambiguous, strings.Join(same, " or ")+
+				" to "+strings.Join(names, " or "))
+		}
+	}
+	if len(ambiguous) > 0 {
+		return fmt.Errorf("can't tell which files applied migrations were renamed to, since they have the same checksums: %s",
+			strings.Join(ambiguous, "; "))
+	}
+	if len(renames) == 0 {
+		return nil
+	}
+	r, ok := m.db.(Renamer)
+	if !ok {
+		return fmt.Errorf("%T can't record %s renamed to %s", m.db,
+			renames[0][0], renames[0][1])
+	}
+	names := make(map[string]string, len(renames))
+	for _, rn := range renames {
+		if err := m.renameMigration(ctx, r, rn[0], rn[1]); err != nil {
+			return fmt.Errorf("rename %s: %w", rn[0], err)
+		}
+		m.log.Printf("%s %s as %s, which it was renamed to\n",
+			m.recorded(), rn[0], rn[1])
+		names[rn[0]] = rn[1]
+	}
+	for i, mg := range m.Migrations {
+		if to, ok := names[mg.Filename]; ok {
+			m.Migrations[i].Filename = to
+		}
+	}
+	return nil
+}
+
+// renameMigration records the migration from as to, unless it's a dry run,
+// which only reports it.
+func (m *Migrate) renameMigration(
+	ctx context.Context,
+	r Renamer,
+	from, to string,
+) error {
+	if m.plan != nil {
+		return nil
+	}
+	return r.RenameMigration(ctx, from, to)
+}
+
+// recorded describes a migration recorded again in the log, which a dry run
+// only would be.
+func (m *Migrate) recorded() string {
+	if m.plan != nil {
+		return "would record"
+	}
+	return "recorded"
+}
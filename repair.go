@@ -0,0 +1,196 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+
+	"github.com/pkg/errors"
+)
+
+// WithForceRepair lets Repair record files which change more than the
+// comments and whitespace of the migrations recorded, once the database is
+// known to have what they now say.
+func WithForceRepair() Option {
+	return func(m *Migrate) { m.forceRepair = true }
+}
+
+// Repair records again the checksum and content of each applied migration
+// named in filenames, or of every one whose file no longer matches its
+// checksum if none are, from its file in dir, such as after fixing a typo in
+// one of its comments. It logs a diff of each migration's recorded content
+// against its file, and unless WithForceRepair is given, if any file changes
+// more than comments and whitespace, records none of them and reports an
+// *ErrRepairUnsafe. Each repair is recorded in metahistory
+// with StatementRepair. It reports how many migrations were repaired, and
+// needs the meta tables at the current version.
+func Repair(
+	ctx context.Context,
+	db Store,
+	log Logger,
+	dbt DBType,
+	dir string,
+	filenames []string,
+	opts ...Option,
+) (int, error) {
+	fsys, err := dirFS(dir)
+	if err != nil {
+		return 0, err
+	}
+	return RepairFS(ctx, db, log, dbt, fsys, filenames, opts...)
+}
+
+// RepairFS is Repair with the files at the root of fsys, as NewFS reads them.
+func RepairFS(
+	ctx context.Context,
+	db Store,
+	log Logger,
+	dbt DBType,
+	fsys fs.FS,
+	filenames []string,
+	opts ...Option,
+) (int, error) {
+	m, err := newMigrate(db, log, opts)
+	if err != nil {
+		return 0, err
+	}
+	if err = m.refuseDryRun("Repair"); err != nil {
+		return 0, err
+	}
+	if fsys, err = m.withIgnore(fsys); err != nil {
+		return 0, err
+	}
+	if m.fsys, err = m.withGoMigrations(migrationFS(fsys)); err != nil {
+		return 0, err
+	}
+	if m.Files, err = m.readFiles(m.fsys, dbt); err != nil {
+		return 0, errors.Wrap(err, "get migrations")
+	}
+	v, exists, err := db.GetMetaVersion(ctx)
+	switch {
+	case err != nil:
+		return 0, errors.Wrap(err, "get meta version")
+	case !exists:
+		if len(filenames) > 0 {
+			return 0, fmt.Errorf("%s isn't applied", filenames[0])
+		}
+		return 0, nil
+	case v > version:
+		return 0, &ErrVersionTooNew{Have: v, Want: version}
+	case v < version:
+		return 0, &ErrUpgradeRequired{Have: v, Want: version}
+	}
+
+	ctx, release, err := m.lock(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	m.createHistory(ctx)
+
+	ms, err := db.GetMigrations(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "get migrations")
+	}
+	normalizeFilenames(ms)
+	recorded := make(map[string]Migration, len(ms))
+	for _, mg := range ms {
+		if mg.Status == StatusApplied || mg.Status == StatusSkipped {
+			recorded[mg.Filename] = mg
+		}
+	}
+	index := m.fileIndexes()
+	named := len(filenames) > 0
+	if !named {
+		for _, mg := range ms {
+			if _, ok := recorded[mg.Filename]; ok {
+				filenames = append(filenames, mg.Filename)
+			}
+		}
+	}
+
+	// Every file is checked before any is recorded, so one refused leaves
+	// meta as it was
+	var repairs []repair
+	for _, name := range filenames {
+		mg, ok := recorded[name]
+		if !ok {
+			return 0, fmt.Errorf("%s isn't applied", name)
+		}
+		j, ok := index[name]
+		if !ok {
+			if !named {
+				continue
+			}
+			return 0, fmt.Errorf("%s has no file", name)
+		}
+		r, err := m.planRepair(mg, m.Files[j])
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case r != nil:
+			repairs = append(repairs, *r)
+		case named:
+			m.log.Printf("%s matches its checksum already\n", name)
+		}
+	}
+
+	var n int
+	for _, r := range repairs {
+		if err = m.recordAgain(ctx, r.f, r.byt); err != nil {
+			return n, err
+		}
+		m.log.Printf("repaired %s\n", r.mg.Filename)
+		n++
+	}
+	return n, nil
+}
+
+// repair is a migration to record again with the content of its file.
+type repair struct {
+	mg  Migration
+	f   *file
+	byt []byte
+}
+
+// planRepair returns the repair of mg from its file f, after logging their
+// diff, or nil if f matches mg already. It refuses one which changes more
+// than comments and whitespace, unless WithForceRepair was given.
+func (m *Migrate) planRepair(mg Migration, f *file) (*repair, error) {
+	raw, err := fs.ReadFile(m.fsys, f.fullpath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", mg.Filename)
+	}
+	match, legacy, err := recordedMatch(mg, raw)
+	if err != nil {
+		return nil, err
+	}
+	if match && !legacy {
+		return nil, nil
+	}
+	byt := normalizeLineEndings(raw)
+
+	content := normalizeLineEndings([]byte(mg.Content))
+	diff := changeDiff(mg.Filename, []byte(m.redactSQL(string(content))),
+		[]byte(m.redactSQL(string(byt))))
+	if diff != "" {
+		m.log.Printf("%s", diff)
+	}
+
+	// The recorded content shows what ran only if it has the recorded
+	// checksum
+	intact, _, err := recordedMatch(mg, []byte(mg.Content))
+	if err != nil {
+		return nil, err
+	}
+	cosmetic := intact && cosmeticForm(content) == cosmeticForm(byt)
+	if !cosmetic {
+		if !m.forceRepair {
+			return nil, &ErrRepairUnsafe{Filename: mg.Filename}
+		}
+		m.log.Printf("WARNING: forcing the repair of %s, which changed more than comments and whitespace\n",
+			mg.Filename)
+	}
+	return &repair{mg: mg, f: f, byt: byt}, nil
+}
@@ -0,0 +1,262 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ReversibleReport describes each migration VerifyReversible applied, rolled
+// back and applied again, in the order they were applied. It's filled in as
+// far as VerifyReversible got, so it's reported with an error too.
+type ReversibleReport struct {
+	Files []ReversibleFile `json:"files"`
+}
+
+// ReversibleFile is how long each step of VerifyReversible took for a
+// migration: applying it, rolling it back, and applying it again. A step which
+// didn't run is zero.
+type ReversibleFile struct {
+	Filename string        `json:"filename"`
+	Up       time.Duration `json:"up"`
+	Down     time.Duration `json:"down"`
+	UpAgain  time.Duration `json:"up_again"`
+}
+
+// VerifyReversible proves the pending migrations in dir can be rolled back, for
+// running in CI against a scratch database. It applies them, rolls back by
+// their down migrations those it applied, the latest first, then applies them
+// again, comparing meta after each step with what it was before. A step which
+// fails, meta which isn't as it was, or an apply which differs the second time,
+// such as by resuming from checkpoints or reporting other warnings, is an
+// error, an *ErrNotReversible if it's the down migration's doing. Every pending
+// migration needs a down migration, and none may be unfinished. It's refused
+// with WithProduction.
+func VerifyReversible(
+	ctx context.Context,
+	db Store,
+	log Logger,
+	dbt DBType,
+	dir string,
+	opts ...Option,
+) (*ReversibleReport, error) {
+	fsys, err := dirFS(dir)
+	if err != nil {
+		return nil, err
+	}
+	return VerifyReversibleFS(ctx, db, log, dbt, fsys, opts...)
+}
+
+// VerifyReversibleFS is VerifyReversible with the files at the root of fsys,
+// as NewFS reads them.
+func VerifyReversibleFS(
+	ctx context.Context,
+	db Store,
+	log Logger,
+	dbt DBType,
+	fsys fs.FS,
+	opts ...Option,
+) (*ReversibleReport, error) {
+	m, err := NewFS(ctx, db, log, dbt, fsys, "", opts...)
+	if err != nil {
+		return nil, err
+	}
+	if m.production {
+		return nil, errors.New("can't verify migrations are reversible in production")
+	}
+	if err = m.refuseDryRun("VerifyReversible"); err != nil {
+		return nil, err
+	}
+	report := &ReversibleReport{}
+	pending := m.toRun()
+	if len(pending) == 0 {
+		m.log.Println("no pending migrations to verify")
+		return report, nil
+	}
+
+	// Everything needed to roll back is checked before anything runs
+	var missing []string
+	for _, f := range pending {
+		report.Files = append(report.Files,
+			ReversibleFile{Filename: f.Info.Name()})
+		if f.downpath == "" || goMigrationOf(f.Info) != nil {
+			missing = append(missing, f.Info.Name())
+		}
+	}
+	if len(missing) > 0 {
+		return nil, &ErrDownMissing{Filenames: missing}
+	}
+	before, err := db.GetMigrations(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get migrations")
+	}
+	for _, mg := range before {
+		if mg.Status != StatusApplied && mg.Status != StatusSkipped {
+			return nil, fmt.Errorf("%s is %s, so the migrations can't be applied from the start",
+				mg.Filename, mg.Status)
+		}
+	}
+
+	m.log.Println("applying the pending migrations")
+	if _, err = m.Migrate(ctx); err != nil {
+		report.fill(m.Results, setUp)
+		return report, errors.Wrap(err, "up")
+	}
+	report.fill(m.Results, setUp)
+	applied, err := db.GetMigrations(ctx)
+	if err != nil {
+		return report, errors.Wrap(err, "get migrations")
+	}
+
+	m.log.Println("rolling back the migrations applied")
+	applying := make(map[string]bool, len(pending))
+	for _, f := range pending {
+		applying[f.Info.Name()] = true
+	}
+	_, err = m.down(ctx, func(ms []Migration) (int, error) {
+		if len(ms) < len(applying) {
+			return 0, fmt.Errorf("expected %d migrations applied, found %d",
+				len(applying), len(ms))
+		}
+		for _, mg := range ms[len(ms)-len(applying):] {
+			if !applying[mg.Filename] {
+				return 0, fmt.Errorf("%s was applied by another run", mg.Filename)
+			}
+		}
+		return len(applying), nil
+	}, m.downFromFile)
+	report.fill(m.rollbacks, setDown)
+	if err != nil {
+		return report, errors.Wrap(err, "down")
+	}
+	if err = m.checkRolledBack(ctx, before, pending); err != nil {
+		return report, err
+	}
+
+	m.log.Println("applying the migrations again")
+	again, err := NewFS(ctx, db, log, dbt, fsys, "", opts...)
+	if err != nil {
+		return report, errors.Wrap(err, "up again")
+	}
+	_, err = again.Migrate(ctx)
+	report.fill(again.Results, setUpAgain)
+	if n := len(again.Results); err != nil && n > 0 &&
+		!again.Results[n-1].Applied {
+		return report, &ErrNotReversible{
+			Filename: again.Results[n-1].Filename,
+			Reason:   "applying it again after rolling it back failed",
+			Err:      err,
+		}
+	}
+	if err != nil {
+		return report, errors.Wrap(err, "up again")
+	}
+	if err = checkSameApply(m.Results, again.Results); err != nil {
+		return report, err
+	}
+	reapplied, err := db.GetMigrations(ctx)
+	if err != nil {
+		return report, errors.Wrap(err, "get migrations")
+	}
+	if err = sameMeta(applied, reapplied); err != nil {
+		return report, fmt.Errorf("meta after applying again: %w", err)
+	}
+	m.log.Printf("verified %d migrations are reversible\n", len(pending))
+	return report, nil
+}
+
+// fill sets the duration of a step of each file of r, with set, from the
+// result with its name.
+func (r *ReversibleReport) fill(
+	results []FileResult,
+	set func(f *ReversibleFile, d time.Duration),
+) {
+	durations := make(map[string]time.Duration, len(results))
+	for _, res := range results {
+		durations[res.Filename] = res.Duration
+	}
+	for i := range r.Files {
+		if d, ok := durations[r.Files[i].Filename]; ok {
+			set(&r.Files[i], d)
+		}
+	}
+}
+
+func setUp(f *ReversibleFile, d time.Duration)      { f.Up = d }
+func setDown(f *ReversibleFile, d time.Duration)    { f.Down = d }
+func setUpAgain(f *ReversibleFile, d time.Duration) { f.UpAgain = d }
+
+// checkRolledBack reports an error unless meta is as it was, before, before
+// the pending files were applied, with none of their checkpoints left.
+func (m *Migrate) checkRolledBack(
+	ctx context.Context,
+	before []Migration,
+	pending []*file,
+) error {
+	after, err := m.db.GetMigrations(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get migrations")
+	}
+	if err = sameMeta(before, after); err != nil {
+		return fmt.Errorf("meta after rolling back: %w", err)
+	}
+	for _, f := range pending {
+		checkpoints, err := m.db.GetMetaCheckpoints(ctx, f.Info.Name())
+		if err != nil {
+			return errors.Wrap(err, "get checkpoints")
+		}
+		if len(checkpoints) > 0 {
+			return &ErrNotReversible{Filename: f.Info.Name(),
+				Reason: fmt.Sprintf("%d checkpoints were left after rolling it back",
+					len(checkpoints))}
+		}
+	}
+	return nil
+}
+
+// sameMeta reports an error unless a and b record the same migrations with
+// the same checksums and statuses.
+func sameMeta(a, b []Migration) error {
+	SortMigrations(a)
+	SortMigrations(b)
+	if len(a) != len(b) {
+		return fmt.Errorf("expected %d migrations, found %d", len(a), len(b))
+	}
+	for i := range a {
+		if a[i].Filename != b[i].Filename || a[i].Checksum != b[i].Checksum ||
+			a[i].Status != b[i].Status {
+			return fmt.Errorf("expected %s %s, found %s %s", a[i].Filename,
+				a[i].Status, b[i].Filename, b[i].Status)
+		}
+	}
+	return nil
+}
+
+// checkSameApply reports an *ErrNotReversible for a file which applied
+// differently the second time, again, than the first, first.
+func checkSameApply(first, again []FileResult) error {
+	results := make(map[string]FileResult, len(again))
+	for _, res := range again {
+		results[res.Filename] = res
+	}
+	for _, res := range first {
+		got, ok := results[res.Filename]
+		switch {
+		case !ok:
+			return &ErrNotReversible{Filename: res.Filename,
+				Reason: "it didn't run when applying it again"}
+		case got.Mode != res.Mode:
+			return &ErrNotReversible{Filename: res.Filename,
+				Reason: fmt.Sprintf("it ran as %q, then as %q", res.Mode,
+					got.Mode)}
+		case len(got.Warnings) != len(res.Warnings):
+			return &ErrNotReversible{Filename: res.Filename,
+				Reason: fmt.Sprintf("it reported %d warnings, then %d",
+					len(res.Warnings), len(got.Warnings))}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MetaSnapshot is the content of the meta tables, which marshals to JSON to
+// back up a database's migration history or seed another database with it.
+type MetaSnapshot struct {
+	// Version is the meta version of the tables the snapshot was taken
+	// from. Fields added in later versions are empty.
+	Version     int                 `json:"version"`
+	Migrations  []SnapshotMigration `json:"migrations"`
+	Checkpoints []Checkpoint        `json:"checkpoints"`
+}
+
+// SnapshotMigration is a row of meta.
+type SnapshotMigration struct {
+	Migration
+	CreatedAt time.Time `json:"createdat"`
+}
+
+// Checkpoint is a row of metacheckpoints, recording a statement which ran
+// from a file which hasn't finished.
+type Checkpoint struct {
+	Filename  string    `json:"filename"`
+	Index     int       `json:"idx"`
+	Checksum  string    `json:"md5"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"createdat"`
+}
+
+// MetaSnapshotter is implemented by stores which can read and replace the
+// whole of their meta tables, for ExportMeta and ImportMeta.
+type MetaSnapshotter interface {
+	// GetMetaSnapshot reads every row of meta and metacheckpoints.
+	// Version is left for ExportMeta to set.
+	GetMetaSnapshot(context.Context) (*MetaSnapshot, error)
+
+	// PutMetaSnapshot replaces the rows of meta and metacheckpoints with
+	// those in the snapshot, in one transaction if the database
+	// supports it.
+	PutMetaSnapshot(context.Context, *MetaSnapshot) error
+}
+
+// ExportMeta reads the meta tables of an open store, creating them if they
+// don't exist.
+func ExportMeta(ctx context.Context, db Store) (*MetaSnapshot, error) {
+	snapper, ok := db.(MetaSnapshotter)
+	if !ok {
+		return nil, fmt.Errorf("%T cannot export meta tables", db)
+	}
+	v, err := createMeta(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	snap, err := snapper.GetMetaSnapshot(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get meta snapshot")
+	}
+	snap.Version = v
+	return snap, nil
+}
+
+// ImportMeta replaces the meta tables of an open store with snap. The store's
+// tables must already be at the current meta version, to which older
+// snapshots are imported with their later fields empty.
+//
+// Unless overwrite is set, the store's history must be the same as the
+// snapshot's up to where either ends, and the store may not have
+// checkpoints which the snapshot doesn't, so that importing only adds to it.
+// Otherwise ImportMeta reports an *ErrHistoryDiverged.
+func ImportMeta(
+	ctx context.Context,
+	db Store,
+	snap *MetaSnapshot,
+	overwrite bool,
+) error {
+	snapper, ok := db.(MetaSnapshotter)
+	if !ok {
+		return fmt.Errorf("%T cannot import meta tables", db)
+	}
+	if snap.Version > version {
+		return &ErrVersionTooNew{Have: snap.Version, Want: version}
+	}
+	v, err := createMeta(ctx, db)
+	if err != nil {
+		return err
+	}
+	switch {
+	case v > version:
+		return &ErrVersionTooNew{Have: v, Want: version}
+	case v < version:
+		return &ErrUpgradeRequired{Have: v, Want: version}
+	}
+	if !overwrite {
+		existing, err := snapper.GetMetaSnapshot(ctx)
+		if err != nil {
+			return errors.Wrap(err, "get meta snapshot")
+		}
+		if err = checkDiverged(existing, snap); err != nil {
+			return err
+		}
+	}
+	if err = snapper.PutMetaSnapshot(ctx, snap); err != nil {
+		return errors.Wrap(err, "put meta snapshot")
+	}
+	return nil
+}
+
+// createMeta creates the meta tables if they don't exist, reporting their
+// version.
+func createMeta(ctx context.Context, db Store) (int, error) {
+	if err := db.CreateMetaIfNotExists(ctx); err != nil {
+		return 0, errors.Wrap(err, "create meta table")
+	}
+	if err := db.CreateMetaCheckpointsIfNotExists(ctx); err != nil {
+		return 0, errors.Wrap(err, "create meta checkpoints table")
+	}
+	v, err := db.CreateMetaVersionIfNotExists(ctx, version)
+	if err != nil {
+		return 0, errors.Wrap(err, "create meta version table")
+	}
+	return v, nil
+}
+
+// checkDiverged reports an *ErrHistoryDiverged unless importing snap into a
+// store holding existing only adds to its history.
+func checkDiverged(existing, snap *MetaSnapshot) error {
+	for i, mg := range existing.Migrations {
+		if i >= len(snap.Migrations) {
+			return &ErrHistoryDiverged{
+				Filename: mg.Filename,
+				Reason:   "isn't in the snapshot",
+			}
+		}
+		if got := snap.Migrations[i]; got.Filename != mg.Filename ||
+			!sameChecksum(got.Migration, mg.Migration) {
+			return &ErrHistoryDiverged{
+				Filename: mg.Filename,
+				Reason: fmt.Sprintf("is %s with checksum %s in the snapshot",
+					got.Filename, got.Checksum),
+			}
+		}
+	}
+	checkpoints := make(map[Checkpoint]bool, len(snap.Checkpoints))
+	for _, c := range snap.Checkpoints {
+		checkpoints[Checkpoint{Filename: c.Filename, Index: c.Index,
+			Checksum: c.Checksum}] = true
+	}
+	for _, c := range existing.Checkpoints {
+		key := Checkpoint{Filename: c.Filename, Index: c.Index,
+			Checksum: c.Checksum}
+		if !checkpoints[key] {
+			return &ErrHistoryDiverged{
+				Filename: c.Filename,
+				Reason: fmt.Sprintf("has checkpoint %d, which isn't in the snapshot",
+					c.Index),
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+// Package snowflake implements a migrate.Store for Snowflake. Snowflake has no
+// ON DUPLICATE KEY UPDATE, so migrations are upserted with MERGE, and it
+// commits every DDL statement on its own, so UpgradeToV1 runs as a series of
+// steps which are safe to re-run.
+//
+// Snowflake uppercases unquoted identifiers. The meta tables are created and
+// queried unquoted, so they resolve to META, METACHECKPOINTS and METAVERSION,
+// but columns read back into Go structs are aliased with quoted lowercase
+// names to match their db tags.
+package snowflake
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/snowflakedb/gosnowflake"
+	"github.com/thankful-ai/migrate"
+	"github.com/thankful-ai/migrate/sqlstore"
+)
+
+// errObjectExists is the error number Snowflake reports when creating an
+// object whose name is already taken.
+const errObjectExists = 2002
+
+// errObjectMissing is the error number Snowflake reports when selecting from a
+// table which doesn't exist, or which the role can't see.
+const errObjectMissing = 2003
+
+type DB struct {
+	cfg *gosnowflake.Config
+
+	// Embed the generic SQL store
+	*sqlstore.Store
+}
+
+// New prepares a connection to Snowflake from a gosnowflake DSN, such as
+// user:pass@account/db/schema?warehouse=wh. params are session parameters set
+// on every connection, such as QUERY_TAG to attribute migration queries, and
+// override any of the same name in the DSN.
+func New(dsn string, params map[string]string) (*DB, error) {
+	cfg, err := gosnowflake.ParseDSN(dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse dsn")
+	}
+	if cfg.Params == nil {
+		cfg.Params = map[string]*string{}
+	}
+	for k, v := range params {
+		// Session parameter names are case insensitive
+		for old := range cfg.Params {
+			if strings.EqualFold(old, k) {
+				delete(cfg.Params, old)
+			}
+		}
+		v := v
+		cfg.Params[k] = &v
+	}
+	return &DB{cfg: cfg}, nil
+}
+
+func (db *DB) Open(ctx context.Context) error {
+	c := gosnowflake.NewConnector(gosnowflake.SnowflakeDriver{}, *db.cfg)
+	db.Store = sqlstore.New(sql.OpenDB(c), Dialect{})
+	return nil
+}
+
+// regexImplicitCommit matches the start of a statement which Snowflake
+// commits the transaction in progress before running: DDL of any kind,
+// including of temporary tables, and transaction control.
+var regexImplicitCommit = regexp.MustCompile(`(?is)^` +
+	`(?:\s*/\*.*?\*/|\s*(?:--|//)[^\n]*\n)*\s*(` +
+	`create|alter|drop|undrop|truncate|comment|grant|revoke|` +
+	`begin|start\s+transaction|commit|rollback)\b`)
+
+// CommitsImplicitly reports whether Snowflake commits the transaction in
+// progress before running stmt, as it does for every DDL statement.
+func (db *DB) CommitsImplicitly(stmt string) bool {
+	return regexImplicitCommit.MatchString(strings.TrimSpace(stmt))
+}
+
+// Dialect describes Snowflake's SQL to sqlstore.
+type Dialect struct{}
+
+func (Dialect) BindType() int { return sqlx.QUESTION }
+
+func (Dialect) Types() sqlstore.Types {
+	return sqlstore.Types{
+		String:    "VARCHAR(255)",
+		Text:      "VARCHAR",
+		Integer:   "INTEGER",
+		Timestamp: "TIMESTAMP_LTZ",
+		Now:       "CURRENT_TIMESTAMP()",
+	}
+}
+
+func (Dialect) CreateTableIfNotExists(table string, defs []string) string {
+	return sqlstore.CreateTableIfNotExists(table, defs)
+}
+
+func (Dialect) IsTableExists(err error) bool {
+	var sfErr *gosnowflake.SnowflakeError
+	return errors.As(err, &sfErr) && sfErr.Number == errObjectExists
+}
+
+func (Dialect) IsTableMissing(err error) bool {
+	var sfErr *gosnowflake.SnowflakeError
+	return errors.As(err, &sfErr) && sfErr.Number == errObjectMissing
+}
+
+func (Dialect) UpsertMigration(table string, cols []string) string {
+	return fmt.Sprintf(`
+		MERGE INTO %s AS t
+		USING (SELECT %s) AS s
+		ON t.filename = s.filename
+		WHEN MATCHED THEN
+			UPDATE SET %s
+		WHEN NOT MATCHED THEN
+			INSERT (%s)
+			VALUES (%s)`, table, sqlstore.JoinColumns(cols, "? AS %s"),
+		sqlstore.JoinColumns(cols[1:], "%[1]s=s.%[1]s"),
+		strings.Join(cols, ", "), sqlstore.JoinColumns(cols, "s.%s"))
+}
+
+// UpgradeToV1 migrates existing meta tables to the v1 format. Complete any
+// migrations before running this function; this will not succeed if have any
+// existing metacheckpoints.
+//
+// Snowflake commits each DDL statement as it runs, so a failed upgrade can't
+// be rolled back. Instead each step is safe to re-run.
+func (Dialect) UpgradeToV1(
+	ctx context.Context,
+	db *sqlx.DB,
+	migrations []migrate.Migration,
+) error {
+	// Snowflake doesn't enforce the uniqueness constraint on md5, so
+	// unlike the other stores there's no need to remove it.
+
+	// Add a content column to record the exact migration that ran
+	// alongside the md5, insert the appropriate data, then set not null
+	q := `ALTER TABLE meta ADD COLUMN IF NOT EXISTS content VARCHAR`
+	if _, err := db.ExecContext(ctx, q); err != nil {
+		return errors.Wrap(err, "add content column")
+	}
+	for _, m := range migrations {
+		q = `UPDATE meta SET content=? WHERE filename=?`
+		_, err := db.ExecContext(ctx, q, m.Content, m.Filename)
+		if err != nil {
+			return errors.Wrap(err, "update meta content")
+		}
+	}
+	q = `ALTER TABLE meta ALTER COLUMN content SET NOT NULL`
+	if _, err := db.ExecContext(ctx, q); err != nil {
+		return errors.Wrap(err, "update meta content not null")
+	}
+
+	// Add the content column to metacheckpoints
+	q = `
+	ALTER TABLE metacheckpoints
+	ADD COLUMN IF NOT EXISTS content VARCHAR NOT NULL`
+	if _, err := db.ExecContext(ctx, q); err != nil {
+		return errors.Wrap(err, "add metacheckpoints content")
+	}
+
+	q = `CREATE TABLE IF NOT EXISTS metaversion (version INTEGER NOT NULL)`
+	if _, err := db.ExecContext(ctx, q); err != nil {
+		return errors.Wrap(err, "create metaversion table")
+	}
+
+	return sqlstore.SetVersion(ctx, db, "metaversion", 0, 1)
+}
+
+// QuoteIdentifier quotes a Snowflake identifier so that its case is
+// preserved, for use in migrations built from Go.
+func QuoteIdentifier(name string) string {
+	return fmt.Sprintf(`"%s"`, strings.ReplaceAll(name, `"`, `""`))
+}
@@ -0,0 +1,266 @@
+package snowflake
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/snowflakedb/gosnowflake"
+	"github.com/thankful-ai/migrate"
+	"github.com/thankful-ai/migrate/sqlstore/storetest"
+)
+
+var ctx = context.Background()
+
+const checkpointFile = "2.sql"
+
+func TestMain(m *testing.M) {
+	path := filepath.Join("..", "test.env")
+	err := parseEnv(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to parse %s: %s\n", path, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+func TestNew(t *testing.T) {
+	dsn := "user:pass@account/db/schema?warehouse=wh&query_tag=old"
+	db, err := New(dsn, map[string]string{"QUERY_TAG": "migrate"})
+	check(t, err)
+	if len(db.cfg.Params) != 1 {
+		t.Fatalf("expected 1 param, got %v", db.cfg.Params)
+	}
+	if v := db.cfg.Params["QUERY_TAG"]; v == nil || *v != "migrate" {
+		t.Fatalf("expected QUERY_TAG to be overridden, got %v", v)
+	}
+	if db.cfg.Warehouse != "wh" || db.cfg.Schema != "schema" {
+		t.Fatalf("unexpected config %+v", db.cfg)
+	}
+
+	if _, err = New("not a dsn", nil); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestCommitsImplicitly(t *testing.T) {
+	var db migrate.ImplicitCommitter = &DB{}
+	for stmt, want := range map[string]bool{
+		"CREATE TABLE users (id INTEGER)":                    true,
+		"create temporary table t (id integer)":              true,
+		"ALTER TABLE users ADD COLUMN email VARCHAR":         true,
+		"DROP TABLE IF EXISTS users":                         true,
+		"// why\nUNDROP TABLE users":                         true,
+		"GRANT SELECT ON TABLE users TO ROLE ro":             true,
+		"INSERT INTO users VALUES (1)":                       false,
+		"UPDATE users SET name = 'CREATE TABLE'":             false,
+		"MERGE INTO users USING new ON users.id = new.id":    false,
+		"INSERT INTO tables_created SELECT * FROM created_t": false,
+	} {
+		if got := db.CommitsImplicitly(stmt); got != want {
+			t.Errorf("%q: expected %t, got %t", stmt, want, got)
+		}
+	}
+}
+
+func TestQuoteIdentifier(t *testing.T) {
+	tests := map[string]string{
+		"meta":     `"meta"`,
+		`my"table`: `"my""table"`,
+	}
+	for in, want := range tests {
+		if got := QuoteIdentifier(in); got != want {
+			t.Errorf("QuoteIdentifier(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestIsTableExists(t *testing.T) {
+	err := errors.Wrap(&gosnowflake.SnowflakeError{
+		Number: errObjectExists,
+	}, "create")
+	if !(Dialect{}).IsTableExists(err) {
+		t.Fatal("expected table exists error")
+	}
+	if (Dialect{}).IsTableExists(errors.New("other")) {
+		t.Fatal("expected other error not to match")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) migrate.Store {
+		return newDB(t)
+	})
+}
+
+func TestCreateMetaVersionIfNotExists(t *testing.T) {
+	db := newDB(t)
+
+	v, err := db.CreateMetaVersionIfNotExists(ctx, 1)
+	check(t, err)
+	if v != 1 {
+		t.Fatalf("expected version 1, got %d", v)
+	}
+	v, err = db.CreateMetaVersionIfNotExists(ctx, 2)
+	check(t, err)
+	if v != 1 {
+		t.Fatalf("expected existing version 1, got %d", v)
+	}
+}
+
+func TestUpgradeToV1(t *testing.T) {
+	db := setupDBV0(t)
+
+	migrations := []migrate.Migration{{
+		Filename: "1.sql",
+		Checksum: "md5",
+		Content:  "SELECT 1;",
+	}}
+	check(t, db.UpgradeToV1(ctx, migrations))
+
+	// Each step is safe to re-run if a previous upgrade failed partway
+	check(t, db.UpgradeToV1(ctx, migrations))
+
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 1 || ms[0].Content != "SELECT 1;" {
+		t.Fatalf("unexpected migrations %+v", ms)
+	}
+	v, err := db.CreateMetaVersionIfNotExists(ctx, 1)
+	check(t, err)
+	if v != 1 {
+		t.Fatalf("expected version 1, got %d", v)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db := newDB(t)
+
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", `
+		CREATE TABLE users (id INTEGER NOT NULL);
+		INSERT INTO users (id) VALUES (1);`)
+	writeFile(t, dir, checkpointFile, `
+		ALTER TABLE users ADD COLUMN name VARCHAR;`)
+
+	m, err := migrate.New(ctx, db, testLogger{t}, migrate.DBTypeSnowflake, dir,
+		"")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(ms))
+	}
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Printf(s string, vs ...interface{}) { l.t.Logf(s, vs...) }
+func (l testLogger) Println(vs ...interface{})          { l.t.Log(vs...) }
+
+func writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+	check(t, err)
+}
+
+func parseEnv(filename string) error {
+	fi, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	scn := bufio.NewScanner(fi)
+	for i := 1; scn.Scan(); i++ {
+		line := scn.Text()
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("bad line %d: %s", i, line)
+		}
+		if err = os.Setenv(parts[0], parts[1]); err != nil {
+			return errors.Wrap(err, "set env")
+		}
+	}
+	if err = scn.Err(); err != nil {
+		return errors.Wrap(err, "scan")
+	}
+	return nil
+}
+
+// newDB creates a fresh schema for each test. There's no local Snowflake
+// emulator, so tests which need a connection are skipped unless
+// SNOWFLAKE_DSN is set.
+func newDB(t *testing.T) *DB {
+	dsn := os.Getenv("SNOWFLAKE_DSN")
+	if dsn == "" {
+		t.Skip("SNOWFLAKE_DSN not set")
+	}
+	cfg, err := gosnowflake.ParseDSN(dsn)
+	check(t, err)
+
+	schema := fmt.Sprintf("MIGRATE_TEST_%d", time.Now().UnixNano()%1e9)
+	conn := sql.OpenDB(gosnowflake.NewConnector(
+		gosnowflake.SnowflakeDriver{}, *cfg))
+	t.Cleanup(func() { conn.Close() })
+	_, err = conn.Exec("CREATE SCHEMA " + QuoteIdentifier(schema))
+	check(t, err)
+	t.Cleanup(func() {
+		_, _ = conn.Exec("DROP SCHEMA IF EXISTS " +
+			QuoteIdentifier(schema))
+	})
+
+	cfg.Schema = schema
+	db := &DB{cfg: cfg}
+	check(t, db.Open(ctx))
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func setupDBV0(t *testing.T) *DB {
+	db := newDB(t)
+
+	q := `CREATE TABLE meta (
+		filename VARCHAR(255) UNIQUE NOT NULL,
+		md5 VARCHAR(255) UNIQUE NOT NULL,
+		createdat TIMESTAMP_LTZ NOT NULL DEFAULT CURRENT_TIMESTAMP()
+	)`
+	_, err := db.DB.Exec(q)
+	check(t, err)
+
+	q = `CREATE TABLE metacheckpoints (
+		filename VARCHAR(255) NOT NULL,
+		idx INTEGER NOT NULL,
+		md5 VARCHAR(255) NOT NULL,
+		createdat TIMESTAMP_LTZ NOT NULL DEFAULT CURRENT_TIMESTAMP(),
+		PRIMARY KEY (filename, idx)
+	)`
+	_, err = db.DB.Exec(q)
+	check(t, err)
+
+	q = `INSERT INTO meta (filename, md5) VALUES (?, ?)`
+	_, err = db.DB.Exec(q, "1.sql", "md5")
+	check(t, err)
+
+	return db
+}
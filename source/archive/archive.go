@@ -0,0 +1,197 @@
+// Package archive reads migrations straight from a .zip or .tar.gz archive,
+// such as a deployment artifact, so it needn't be extracted first. FS
+// implements fs.FS for migrate.NewFS:
+//
+//	fsys, err := archive.Open("app-v1.42.0.tar.gz", "app/migrations")
+//	m, err := migrate.NewFS(ctx, db, log, dbt, fsys, "")
+//
+// The archive is read whole when it's opened, keeping only the .sql and
+// .sql.gz files under the prefix, so their content and checksums are just as
+// they'd be from the extracted directory. Entries are matched with or without
+// a leading "./", as tar often stores them. An archive with an entry which
+// would escape the directory it's extracted to, such as "../x.sql", is
+// rejected with ErrUnsafePath.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/thankful-ai/migrate/source/internal/objectfs"
+)
+
+// ErrUnsafePath is wrapped by the error opening an archive with an absolute
+// entry, or one with a ".." element.
+var ErrUnsafePath = errors.New("unsafe path")
+
+// FS is the migrations under a prefix of an archive.
+type FS struct {
+	fsys *objectfs.FS
+}
+
+// Open reads the .sql and .sql.gz files under prefix in the archive at
+// filename, choosing its format by the extension: .zip, or .tar.gz or .tgz. A
+// trailing slash on prefix is optional, and an empty prefix reads the whole
+// archive.
+func Open(filename, prefix string) (*FS, error) {
+	b := &archiveBucket{
+		prefix: objectfs.Prefix(strings.TrimPrefix(prefix, "./")),
+		files:  map[string][]byte{},
+	}
+	var err error
+	switch {
+	case strings.HasSuffix(filename, ".zip"):
+		err = b.readZip(filename)
+	case strings.HasSuffix(filename, ".tar.gz"),
+		strings.HasSuffix(filename, ".tgz"):
+		err = b.readTarGz(filename)
+	default:
+		return nil, fmt.Errorf("open %s: unknown archive format", filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", filename, err)
+	}
+	return &FS{fsys: objectfs.New(b)}, nil
+}
+
+// Open opens the file or directory at name.
+func (f *FS) Open(name string) (fs.File, error) { return f.fsys.Open(name) }
+
+// ReadDir lists the directory at name, sorted by name.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return f.fsys.ReadDir(name)
+}
+
+// Stat describes the file or directory at name.
+func (f *FS) Stat(name string) (fs.FileInfo, error) { return f.fsys.Stat(name) }
+
+// archiveBucket holds the .sql files read from an archive, by their paths
+// under prefix.
+type archiveBucket struct {
+	prefix string
+	files  map[string][]byte
+	objs   []objectfs.Object
+}
+
+func (b *archiveBucket) List() ([]objectfs.Object, error) { return b.objs, nil }
+
+func (b *archiveBucket) Open(name string) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(b.files[name])), nil
+}
+
+func (b *archiveBucket) readZip(filename string) error {
+	r, err := zip.OpenReader(filename)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		name, ok, err := b.name(f.Name, f.Mode().IsRegular())
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+		err = b.add(name, rc, f.Modified)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+func (b *archiveBucket) readTarGz(filename string) error {
+	fi, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+	gz, err := gzip.NewReader(fi)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	r := tar.NewReader(gz)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name, ok, err := b.name(hdr.Name, hdr.Typeflag == tar.TypeReg)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err = b.add(name, r, hdr.ModTime); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+}
+
+// name reports the path under the prefix of the archive entry called entry,
+// and whether it's a regular .sql or .sql.gz file under the prefix to keep. It
+// rejects entries which would be extracted outside the archive's directory,
+// whether kept or not.
+func (b *archiveBucket) name(entry string, regular bool) (string, bool, error) {
+	name := entry
+	for strings.HasPrefix(name, "./") {
+		name = strings.TrimPrefix(name, "./")
+	}
+	if strings.HasPrefix(name, "/") {
+		return "", false, fmt.Errorf("%w %q", ErrUnsafePath, entry)
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return "", false, fmt.Errorf("%w %q", ErrUnsafePath, entry)
+		}
+	}
+	if !regular || !(strings.HasSuffix(name, ".sql") ||
+		strings.HasSuffix(name, ".sql.gz")) ||
+		!strings.HasPrefix(name, b.prefix) {
+		return "", false, nil
+	}
+	name = strings.TrimPrefix(name, b.prefix)
+	if !fs.ValidPath(name) {
+		return "", false, fmt.Errorf("invalid path %q", entry)
+	}
+	return name, true, nil
+}
+
+// add keeps the content of the file at name, read from r.
+func (b *archiveBucket) add(name string, r io.Reader, modTime time.Time) error {
+	if _, ok := b.files[name]; ok {
+		return fmt.Errorf("%s appears twice", path.Join(b.prefix, name))
+	}
+	byt, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b.files[name] = byt
+	b.objs = append(b.objs, objectfs.Object{
+		Name:    name,
+		Size:    int64(len(byt)),
+		ModTime: modTime,
+	})
+	return nil
+}
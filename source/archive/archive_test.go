@@ -0,0 +1,202 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/thankful-ai/migrate"
+	"github.com/thankful-ai/migrate/sqlite"
+)
+
+var ctx = context.Background()
+
+// entry is a file in a test archive, or a directory if its name ends in "/".
+type entry struct {
+	name    string
+	content string
+}
+
+// writeArchive writes entries to an archive called name in a temporary
+// directory, in the format its extension names.
+func writeArchive(t *testing.T, name string, entries []entry) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), name)
+	fi, err := os.Create(filename)
+	check(t, err)
+	defer fi.Close()
+	if strings.HasSuffix(name, ".zip") {
+		w := zip.NewWriter(fi)
+		for _, e := range entries {
+			f, err := w.Create(e.name)
+			check(t, err)
+			_, err = f.Write([]byte(e.content))
+			check(t, err)
+		}
+		check(t, w.Close())
+		return filename
+	}
+	gz := gzip.NewWriter(fi)
+	w := tar.NewWriter(gz)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Mode:     0o644,
+			Size:     int64(len(e.content)),
+			ModTime:  time.Now(),
+			Typeflag: tar.TypeReg,
+		}
+		if strings.HasSuffix(e.name, "/") {
+			hdr.Mode, hdr.Typeflag = 0o755, tar.TypeDir
+		}
+		check(t, w.WriteHeader(hdr))
+		_, err = w.Write([]byte(e.content))
+		check(t, err)
+	}
+	check(t, w.Close())
+	check(t, gz.Close())
+	return filename
+}
+
+var testEntries = []entry{
+	{"./", ""},
+	{"./app/", ""},
+	{"./app/migrations/", ""},
+	{"./app/migrations/1.sql", "CREATE TABLE a (id INTEGER);"},
+	{"app/migrations/2.sql", "INSERT INTO a (id) VALUES (2);"},
+	{"./app/migrations/10.sql", "INSERT INTO a (id) VALUES (10);"},
+	{"app/migrations/mysql/2.sql", "INSERT INTO a (id) VALUES (20);"},
+	{"./app/migrations/README.md", "not a migration"},
+	{"./app/bin/server", "not a migration"},
+	{"./app/other.sql", "not under the prefix"},
+}
+
+func TestOpen(t *testing.T) {
+	t.Parallel()
+	for _, name := range []string{"app.zip", "app.tar.gz", "app.tgz"} {
+		filename := writeArchive(t, name, testEntries)
+		for _, prefix := range []string{"app/migrations", "./app/migrations/"} {
+			fsys, err := Open(filename, prefix)
+			check(t, err)
+			check(t, fstest.TestFS(fsys, "1.sql", "2.sql", "10.sql",
+				"mysql/2.sql"))
+			entries, err := fs.ReadDir(fsys, ".")
+			check(t, err)
+			var names []string
+			for _, e := range entries {
+				names = append(names, e.Name())
+			}
+			want := []string{"1.sql", "10.sql", "2.sql", "mysql"}
+			if !reflect.DeepEqual(names, want) {
+				t.Fatalf("%s: expected %v, got %v", name, want, names)
+			}
+		}
+	}
+
+	for _, bad := range []string{"../1.sql", "app/../../1.sql", "/1.sql",
+		"./../README.md"} {
+		for _, name := range []string{"bad.zip", "bad.tar.gz"} {
+			filename := writeArchive(t, name, []entry{
+				{"1.sql", "SELECT 1;"},
+				{bad, "SELECT 2;"},
+			})
+			_, err := Open(filename, "")
+			if !errors.Is(err, ErrUnsafePath) {
+				t.Fatalf("%s: expected %q rejected, got %v", name, bad,
+					err)
+			}
+		}
+	}
+
+	filename := writeArchive(t, "twice.tar.gz", []entry{
+		{"./1.sql", "SELECT 1;"},
+		{"1.sql", "SELECT 2;"},
+	})
+	if _, err := Open(filename, ""); err == nil ||
+		!strings.Contains(err.Error(), "1.sql appears twice") {
+		t.Fatalf("expected a duplicate error, got %v", err)
+	}
+	if _, err := Open("app.rar", ""); err == nil {
+		t.Fatal("expected an unknown format error")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	t.Parallel()
+
+	// The same files extracted to a directory
+	dir := t.TempDir()
+	for _, e := range testEntries {
+		name, ok := strings.CutPrefix(strings.TrimPrefix(e.name, "./"),
+			"app/migrations/")
+		if !ok || name == "" || strings.HasSuffix(name, "/") {
+			continue
+		}
+		check(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755))
+		check(t, os.WriteFile(filepath.Join(dir, name), []byte(e.content),
+			0o644))
+	}
+	migrations := func(t *testing.T, newM func(db migrate.Store) (
+		*migrate.Migrate, error)) []migrate.Migration {
+		db := sqlite.New(filepath.Join(t.TempDir(), "archive.db"))
+		check(t, db.Open(ctx))
+		defer db.Close()
+		m, err := newM(db)
+		check(t, err)
+		_, err = m.Migrate(ctx)
+		check(t, err)
+		ms, err := db.GetMigrations(ctx)
+		check(t, err)
+		for i := range ms {
+			ms[i] = migrate.Migration{
+				Filename: ms[i].Filename,
+				Checksum: ms[i].Checksum,
+				Content:  ms[i].Content,
+			}
+		}
+		return ms
+	}
+	want := migrations(t, func(db migrate.Store) (*migrate.Migrate, error) {
+		return migrate.New(ctx, db, testLogger{t}, migrate.DBTypeSQLite,
+			dir, "")
+	})
+	if len(want) != 3 {
+		t.Fatalf("expected 3 migrations, got %+v", want)
+	}
+	for _, name := range []string{"app.zip", "app.tar.gz"} {
+		filename := writeArchive(t, name, testEntries)
+		got := migrations(t, func(db migrate.Store) (*migrate.Migrate, error) {
+			fsys, err := Open(filename, "app/migrations")
+			if err != nil {
+				return nil, err
+			}
+			return migrate.NewFS(ctx, db, testLogger{t},
+				migrate.DBTypeSQLite, fsys, "")
+		})
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: expected %+v, got %+v", name, want, got)
+		}
+	}
+}
+
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Printf(s string, vs ...interface{}) { l.t.Logf(s, vs...) }
+func (l testLogger) Println(vs ...interface{})          { l.t.Log(vs...) }
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,145 @@
+// Package gcs reads migrations from the objects under a prefix of a Google
+// Cloud Storage bucket. FS implements fs.FS for migrate.NewFS, reusing the
+// credentials of an existing client, such as those from workload identity:
+//
+//	client, err := storage.NewClient(ctx)
+//	fsys := gcs.New(ctx, client, "builds", "app/v1.42.0/migrations")
+//	m, err := migrate.NewFS(ctx, db, log, dbt, fsys, "")
+//
+// As with the s3 package, objects are listed once and streamed when read, and
+// keys under the prefix are paths in the FS. The credentials need
+// storage.objects.list and storage.objects.get on the bucket.
+package gcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/thankful-ai/migrate/source/internal/objectfs"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// ErrAccessDenied is wrapped by the errors of an FS whose credentials lack
+// permission to list or read the migrations.
+var ErrAccessDenied = errors.New("access denied")
+
+// FS is the objects under a prefix of a bucket.
+type FS struct {
+	fsys *objectfs.FS
+
+	// client is closed by Close if Dial created it.
+	client *storage.Client
+}
+
+// New prepares to read the objects under prefix in bucket with client, which
+// the caller keeps and closes. A trailing slash on prefix is optional, and an
+// empty prefix reads the whole bucket. ctx bounds every request FS makes.
+func New(
+	ctx context.Context,
+	client *storage.Client,
+	bucket, prefix string,
+) *FS {
+	return &FS{fsys: objectfs.New(&gcsBucket{
+		ctx:    ctx,
+		bucket: client.Bucket(bucket),
+		name:   bucket,
+		prefix: objectfs.Prefix(prefix),
+	})}
+}
+
+// Dial is New with a client of its own, created with opts and the
+// application default credentials, which Close closes.
+func Dial(
+	ctx context.Context,
+	bucket, prefix string,
+	opts ...option.ClientOption,
+) (*FS, error) {
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("new storage client: %w", err)
+	}
+	f := New(ctx, client, bucket, prefix)
+	f.client = client
+	return f, nil
+}
+
+// Close closes the client created by Dial. It does nothing for an FS from
+// New.
+func (f *FS) Close() error {
+	if f.client == nil {
+		return nil
+	}
+	return f.client.Close()
+}
+
+// Open opens the object or directory at name. Reading an object streams it
+// from GCS.
+func (f *FS) Open(name string) (fs.File, error) { return f.fsys.Open(name) }
+
+// ReadDir lists the directory at name, sorted by name.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return f.fsys.ReadDir(name)
+}
+
+// Stat describes the object or directory at name without reading it.
+func (f *FS) Stat(name string) (fs.FileInfo, error) { return f.fsys.Stat(name) }
+
+// gcsBucket lists and reads the objects under prefix in bucket.
+type gcsBucket struct {
+	ctx    context.Context
+	bucket *storage.BucketHandle
+	name   string
+	prefix string
+}
+
+func (b *gcsBucket) List() ([]objectfs.Object, error) {
+	q := &storage.Query{Prefix: b.prefix}
+	err := q.SetAttrSelection([]string{"Name", "Size", "Updated"})
+	if err != nil {
+		return nil, err
+	}
+	var objs []objectfs.Object
+	it := b.bucket.Objects(b.ctx, q)
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return objs, nil
+		}
+		if err != nil {
+			return nil, b.wrap(err, "list", "storage.objects.list")
+		}
+		objs = append(objs, objectfs.Object{
+			Name:    strings.TrimPrefix(attrs.Name, b.prefix),
+			Size:    attrs.Size,
+			ModTime: attrs.Updated,
+		})
+	}
+}
+
+func (b *gcsBucket) Open(name string) (io.ReadCloser, error) {
+	r, err := b.bucket.Object(b.prefix + name).NewReader(b.ctx)
+	if err != nil {
+		return nil, b.wrap(err, "read", "storage.objects.get")
+	}
+	return r, nil
+}
+
+// wrap describes an error from op, adding ErrAccessDenied and the permission
+// needed if it was refused.
+func (b *gcsBucket) wrap(err error, op, permission string) error {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && (apiErr.Code == http.StatusForbidden ||
+		apiErr.Code == http.StatusUnauthorized) {
+		return fmt.Errorf("%s gs://%s/%s: %w, which needs %s: %w", op,
+			b.name, b.prefix, ErrAccessDenied, permission, err)
+	}
+	return fmt.Errorf("%s gs://%s/%s: %w", op, b.name, b.prefix, err)
+}
@@ -0,0 +1,119 @@
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/thankful-ai/migrate"
+	"github.com/thankful-ai/migrate/sqlite"
+)
+
+var ctx = context.Background()
+
+func TestFS(t *testing.T) {
+	t.Parallel()
+	client, bucket := setupBucket(t, map[string]string{
+		"app/v1/migrations/":            "",
+		"app/v1/migrations/1.sql":       "CREATE TABLE a (id INTEGER);",
+		"app/v1/migrations/2.sql":       "CREATE TABLE b (id INTEGER);",
+		"app/v1/migrations/10.sql":      "CREATE TABLE c (id INTEGER);",
+		"app/v1/migrations/mysql/2.sql": "CREATE TABLE b (id INT);",
+		"app/v2/migrations/1.sql":       "CREATE TABLE other (id INTEGER);",
+	})
+	for _, prefix := range []string{"app/v1/migrations", "app/v1/migrations/"} {
+		fsys := New(ctx, client, bucket, prefix)
+		check(t, fstest.TestFS(fsys, "1.sql", "2.sql", "10.sql",
+			"mysql/2.sql"))
+		byt, err := fs.ReadFile(fsys, "mysql/2.sql")
+		check(t, err)
+		if string(byt) != "CREATE TABLE b (id INT);" {
+			t.Fatalf("unexpected content %q", byt)
+		}
+	}
+
+	// The whole bucket
+	entries, err := fs.ReadDir(New(ctx, client, bucket, ""), "app")
+	check(t, err)
+	if len(entries) != 2 || entries[0].Name() != "v1" ||
+		!entries[0].IsDir() {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+
+	// A missing prefix is an empty directory
+	entries, err = fs.ReadDir(New(ctx, client, bucket, "missing"), ".")
+	check(t, err)
+	if len(entries) != 0 {
+		t.Fatalf("expected no entries, got %v", entries)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	t.Parallel()
+	client, bucket := setupBucket(t, map[string]string{
+		"migrations/1.sql":  "CREATE TABLE a (id INTEGER);",
+		"migrations/2.sql":  "INSERT INTO a (id) VALUES (2);",
+		"migrations/10.sql": "INSERT INTO a (id) VALUES (10);",
+		"migrations/notes":  "not a migration",
+	})
+	db := sqlite.New(filepath.Join(t.TempDir(), "gcs.db"))
+	check(t, db.Open(ctx))
+	defer db.Close()
+	m, err := migrate.NewFS(ctx, db, testLogger{t}, migrate.DBTypeSQLite,
+		New(ctx, client, bucket, "migrations/"), "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	var names []string
+	for _, r := range m.Results {
+		names = append(names, r.Filename)
+	}
+	if strings.Join(names, ",") != "1.sql,2.sql,10.sql" {
+		t.Fatalf("unexpected files applied %v", names)
+	}
+}
+
+// setupBucket creates a bucket for the test on the fake GCS server at
+// STORAGE_EMULATOR_HOST, holding objects.
+func setupBucket(
+	t *testing.T,
+	objects map[string]string,
+) (*storage.Client, string) {
+	t.Helper()
+	if os.Getenv("STORAGE_EMULATOR_HOST") == "" {
+		t.Skip("STORAGE_EMULATOR_HOST not set")
+	}
+	client, err := storage.NewClient(ctx)
+	check(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	bucket := strings.ToLower(fmt.Sprintf("migrate-%s-%d", t.Name(),
+		time.Now().UnixNano()))
+	check(t, client.Bucket(bucket).Create(ctx, "migrate-test", nil))
+	for name, content := range objects {
+		w := client.Bucket(bucket).Object(name).NewWriter(ctx)
+		_, err = w.Write([]byte(content))
+		check(t, err)
+		check(t, w.Close())
+	}
+	return client, bucket
+}
+
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Printf(s string, vs ...interface{}) { l.t.Logf(s, vs...) }
+func (l testLogger) Println(vs ...interface{})          { l.t.Log(vs...) }
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
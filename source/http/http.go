@@ -0,0 +1,259 @@
+// Package http reads migrations from an HTTPS endpoint, such as one serving
+// deploy hosts which have no credentials for artifact storage. The endpoint
+// serves a manifest, manifest.json, listing each migration with the SHA-256 of
+// its content:
+//
+//	{"files": [
+//		{"filename": "1_create_users.sql", "sha256": "9f86d0..."},
+//		{"filename": "mysql/2_add_email.sql", "sha256": "60303a..."}
+//	]}
+//
+// and each file at its filename under the same base URL. FS implements fs.FS
+// for migrate.NewFS:
+//
+//	fsys := http.New(ctx, "https://migrations.internal/app/v1.42.0/")
+//	m, err := migrate.NewFS(ctx, db, log, dbt, fsys, "")
+//
+// Every file is downloaded and checked against the manifest before any is
+// read, so a file which doesn't match aborts the run with an
+// *ErrHashMismatch before anything is migrated. The manifest itself is only
+// as trustworthy as the connection it's fetched over, so serve it over HTTPS,
+// using WithClient for mTLS.
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	nethttp "net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/thankful-ai/migrate/source/internal/objectfs"
+)
+
+// ManifestName is the name of the manifest under the base URL.
+const ManifestName = "manifest.json"
+
+// Manifest lists the migrations an endpoint serves.
+type Manifest struct {
+	Files []ManifestFile `json:"files"`
+}
+
+// ManifestFile is a migration listed in a Manifest. Filename is its path under
+// the base URL, and SHA256 the hex-encoded hash of its content.
+type ManifestFile struct {
+	Filename string `json:"filename"`
+	SHA256   string `json:"sha256"`
+}
+
+// ErrHashMismatch reports that a file downloaded from the endpoint doesn't
+// have the hash its manifest lists.
+type ErrHashMismatch struct {
+	Filename string
+	Want     string
+	Got      string
+}
+
+func (e *ErrHashMismatch) Error() string {
+	return fmt.Sprintf("%s has sha256 %s, but the manifest lists %s",
+		e.Filename, e.Got, e.Want)
+}
+
+// Option configures an FS.
+type Option func(*httpBucket)
+
+// WithClient sets the client FS makes requests with, such as one with a client
+// certificate for mTLS, replacing http.DefaultClient.
+func WithClient(client *nethttp.Client) Option {
+	return func(b *httpBucket) { b.client = client }
+}
+
+// WithCacheDir keeps the manifest, and the ETag it was served with, in dir, so
+// later runs fetch it with If-None-Match and reuse the cached copy while it's
+// unchanged. dir is created if it's missing.
+func WithCacheDir(dir string) Option {
+	return func(b *httpBucket) { b.cacheDir = dir }
+}
+
+// FS is the migrations served under a base URL.
+type FS struct {
+	fsys *objectfs.FS
+}
+
+// New prepares to read the migrations listed by the manifest under baseURL.
+// ctx bounds every request FS makes.
+func New(ctx context.Context, baseURL string, opts ...Option) *FS {
+	b := &httpBucket{
+		ctx:     ctx,
+		client:  nethttp.DefaultClient,
+		baseURL: baseURL,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return &FS{fsys: objectfs.New(b)}
+}
+
+// Open opens the file or directory at name.
+func (f *FS) Open(name string) (fs.File, error) { return f.fsys.Open(name) }
+
+// ReadDir lists the directory at name, sorted by name.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return f.fsys.ReadDir(name)
+}
+
+// Stat describes the file or directory at name.
+func (f *FS) Stat(name string) (fs.FileInfo, error) { return f.fsys.Stat(name) }
+
+// httpBucket downloads and verifies every file in the manifest when it's
+// listed, then serves them from memory.
+type httpBucket struct {
+	ctx      context.Context
+	client   *nethttp.Client
+	baseURL  string
+	cacheDir string
+
+	files map[string][]byte
+}
+
+func (b *httpBucket) List() ([]objectfs.Object, error) {
+	manifest, err := b.manifest()
+	if err != nil {
+		return nil, err
+	}
+	b.files = make(map[string][]byte, len(manifest.Files))
+	objs := make([]objectfs.Object, 0, len(manifest.Files))
+	for _, mf := range manifest.Files {
+		if !fs.ValidPath(mf.Filename) || mf.Filename == "." {
+			return nil, fmt.Errorf("manifest lists invalid filename %q",
+				mf.Filename)
+		}
+		if _, ok := b.files[mf.Filename]; ok {
+			return nil, fmt.Errorf("manifest lists %s twice", mf.Filename)
+		}
+		byt, _, err := b.get(mf.Filename, "")
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(byt)
+		if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got,
+			mf.SHA256) {
+			return nil, &ErrHashMismatch{
+				Filename: mf.Filename,
+				Want:     mf.SHA256,
+				Got:      got,
+			}
+		}
+		b.files[mf.Filename] = byt
+		objs = append(objs, objectfs.Object{
+			Name: mf.Filename,
+			Size: int64(len(byt)),
+		})
+	}
+	return objs, nil
+}
+
+func (b *httpBucket) Open(name string) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(b.files[name])), nil
+}
+
+// manifest fetches the manifest, or reads it from the cache if it's
+// unchanged.
+func (b *httpBucket) manifest() (*Manifest, error) {
+	var cached []byte
+	var etag string
+	if b.cacheDir != "" {
+		cached, etag = b.readCache()
+	}
+	byt, newETag, err := b.get(ManifestName, etag)
+	if err != nil {
+		return nil, err
+	}
+	if byt == nil {
+		byt = cached
+	} else if b.cacheDir != "" && newETag != "" {
+		if err = b.writeCache(byt, newETag); err != nil {
+			return nil, fmt.Errorf("cache manifest: %w", err)
+		}
+	}
+	var manifest Manifest
+	if err = json.Unmarshal(byt, &manifest); err != nil {
+		return nil, fmt.Errorf("parse manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+// get downloads name under the base URL, reporting its ETag. If etag is set,
+// it's sent as If-None-Match, and an unchanged file is reported as nil.
+func (b *httpBucket) get(name, etag string) ([]byte, string, error) {
+	u, err := url.JoinPath(b.baseURL, name)
+	if err != nil {
+		return nil, "", fmt.Errorf("url for %s: %w", name, err)
+	}
+	req, err := nethttp.NewRequestWithContext(b.ctx, nethttp.MethodGet, u,
+		nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("get %s: %w", name, err)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("get %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == nethttp.StatusNotModified && etag != "":
+		return nil, etag, nil
+	case resp.StatusCode != nethttp.StatusOK:
+		return nil, "", fmt.Errorf("get %s: %s", u, resp.Status)
+	}
+	byt, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("get %s: %w", name, err)
+	}
+	return byt, resp.Header.Get("ETag"), nil
+}
+
+// readCache reads the cached manifest and its ETag, or reports an empty ETag
+// if there's none, so the manifest is fetched again.
+func (b *httpBucket) readCache() ([]byte, string) {
+	etag, err := os.ReadFile(filepath.Join(b.cacheDir, "manifest.etag"))
+	if err != nil {
+		return nil, ""
+	}
+	byt, err := os.ReadFile(filepath.Join(b.cacheDir, ManifestName))
+	if err != nil {
+		return nil, ""
+	}
+	return byt, string(etag)
+}
+
+// writeCache caches the manifest with its ETag, writing the ETag last so it's
+// only sent for a manifest which was cached whole.
+func (b *httpBucket) writeCache(manifest []byte, etag string) error {
+	if err := os.MkdirAll(b.cacheDir, 0o755); err != nil {
+		return err
+	}
+	etagPath := filepath.Join(b.cacheDir, "manifest.etag")
+	err := os.Remove(etagPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(b.cacheDir, ManifestName), manifest,
+		0o644)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(etagPath, []byte(etag), 0o644)
+}
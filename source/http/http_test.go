@@ -0,0 +1,190 @@
+package http
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	nethttp "net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/thankful-ai/migrate"
+	"github.com/thankful-ai/migrate/sqlite"
+)
+
+var ctx = context.Background()
+
+// fakeServer serves files under /app/ with a manifest of their hashes, which
+// wrong overrides. It serves the manifest with an ETag, and counts the
+// requests for it which were unchanged.
+type fakeServer struct {
+	files map[string]string
+	wrong map[string]string
+
+	mu          sync.Mutex
+	notModified int
+}
+
+func (s *fakeServer) ServeHTTP(w nethttp.ResponseWriter, r *nethttp.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/app/")
+	if name != ManifestName {
+		content, ok := s.files[name]
+		if !ok {
+			nethttp.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(content))
+		return
+	}
+	var names []string
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var manifest Manifest
+	for _, name := range names {
+		sum := sha256.Sum256([]byte(s.files[name]))
+		hash := hex.EncodeToString(sum[:])
+		if h, ok := s.wrong[name]; ok {
+			hash = h
+		}
+		manifest.Files = append(manifest.Files,
+			ManifestFile{Filename: name, SHA256: hash})
+	}
+	byt, err := json.Marshal(manifest)
+	if err != nil {
+		nethttp.Error(w, err.Error(), nethttp.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(byt)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		s.mu.Lock()
+		s.notModified++
+		s.mu.Unlock()
+		w.WriteHeader(nethttp.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Write(byt)
+}
+
+func newFS(t *testing.T, s *fakeServer, opts ...Option) *FS {
+	srv := httptest.NewTLSServer(s)
+	t.Cleanup(srv.Close)
+	return New(ctx, srv.URL+"/app/",
+		append([]Option{WithClient(srv.Client())}, opts...)...)
+}
+
+func TestFS(t *testing.T) {
+	t.Parallel()
+	s := &fakeServer{files: map[string]string{
+		"1.sql":       "CREATE TABLE a (id INTEGER);",
+		"2.sql":       "CREATE TABLE b (id INTEGER);",
+		"mysql/2.sql": "CREATE TABLE b (id INT);",
+	}}
+	fsys := newFS(t, s)
+	check(t, fstest.TestFS(fsys, "1.sql", "2.sql", "mysql/2.sql"))
+	byt, err := fs.ReadFile(fsys, "mysql/2.sql")
+	check(t, err)
+	if string(byt) != "CREATE TABLE b (id INT);" {
+		t.Fatalf("unexpected content %q", byt)
+	}
+
+	s.files["3.sql"] = "CREATE TABLE c (id INTEGER);"
+	s.wrong = map[string]string{"3.sql": strings.Repeat("0", 64)}
+	_, err = fs.ReadDir(newFS(t, s), ".")
+	var mismatch *ErrHashMismatch
+	if !errors.As(err, &mismatch) || mismatch.Filename != "3.sql" {
+		t.Fatalf("expected a mismatch for 3.sql, got %v", err)
+	}
+
+	s.wrong = nil
+	s.files["../4.sql"] = "CREATE TABLE d (id INTEGER);"
+	_, err = fs.ReadDir(newFS(t, s), ".")
+	if err == nil || !strings.Contains(err.Error(), "invalid filename") {
+		t.Fatalf("expected an invalid filename, got %v", err)
+	}
+}
+
+func TestFSCache(t *testing.T) {
+	t.Parallel()
+	s := &fakeServer{files: map[string]string{
+		"1.sql": "CREATE TABLE a (id INTEGER);",
+	}}
+	dir := filepath.Join(t.TempDir(), "cache")
+	for i := 0; i < 2; i++ {
+		byt, err := fs.ReadFile(newFS(t, s, WithCacheDir(dir)), "1.sql")
+		check(t, err)
+		if string(byt) != s.files["1.sql"] {
+			t.Fatalf("unexpected content %q", byt)
+		}
+	}
+	if s.notModified != 1 {
+		t.Fatalf("expected the cached manifest reused once, got %d",
+			s.notModified)
+	}
+
+	// A changed manifest replaces the cached one
+	s.files["2.sql"] = "CREATE TABLE b (id INTEGER);"
+	_, err := fs.ReadFile(newFS(t, s, WithCacheDir(dir)), "2.sql")
+	check(t, err)
+	if s.notModified != 1 {
+		t.Fatalf("expected the changed manifest fetched, got %d",
+			s.notModified)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	t.Parallel()
+	s := &fakeServer{files: map[string]string{
+		"1.sql":  "CREATE TABLE a (id INTEGER);",
+		"2.sql":  "INSERT INTO a (id) VALUES (2);",
+		"10.sql": "INSERT INTO a (id) VALUES (10);",
+	}}
+	db := sqlite.New(filepath.Join(t.TempDir(), "http.db"))
+	check(t, db.Open(ctx))
+	defer db.Close()
+	m, err := migrate.NewFS(ctx, db, testLogger{t}, migrate.DBTypeSQLite,
+		newFS(t, s), "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	var names []string
+	for _, r := range m.Results {
+		names = append(names, r.Filename)
+	}
+	if strings.Join(names, ",") != "1.sql,2.sql,10.sql" {
+		t.Fatalf("unexpected files applied %v", names)
+	}
+
+	// A mismatch stops the run before anything is migrated
+	s.files["11.sql"] = "DROP TABLE a;"
+	s.wrong = map[string]string{"11.sql": strings.Repeat("0", 64)}
+	_, err = migrate.NewFS(ctx, db, testLogger{t}, migrate.DBTypeSQLite,
+		newFS(t, s), "")
+	var mismatch *ErrHashMismatch
+	if !errors.As(err, &mismatch) || mismatch.Filename != "11.sql" {
+		t.Fatalf("expected a mismatch for 11.sql, got %v", err)
+	}
+}
+
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Printf(s string, vs ...interface{}) { l.t.Logf(s, vs...) }
+func (l testLogger) Println(vs ...interface{})          { l.t.Log(vs...) }
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
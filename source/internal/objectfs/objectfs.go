@@ -0,0 +1,229 @@
+// Package objectfs serves the objects under a prefix of a bucket, such as in
+// S3 or GCS, as an fs.FS for the source packages.
+package objectfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Object describes an object listed from a bucket.
+type Object struct {
+	// Name is the object's key without the prefix.
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Bucket lists and reads the objects under a prefix.
+type Bucket interface {
+	// List lists every object under the prefix.
+	List() ([]Object, error)
+
+	// Open streams the content of the object called name.
+	Open(name string) (io.ReadCloser, error)
+}
+
+// Prefix normalizes a prefix given with or without a trailing slash to end in
+// one, unless it's empty, meaning the whole bucket.
+func Prefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return prefix
+}
+
+// FS is the objects of a Bucket.
+type FS struct {
+	bucket Bucket
+
+	listOnce sync.Once
+	listErr  error
+
+	// dirs holds the entries of each directory, sorted by name, and
+	// files the info of each object, by their paths in the FS.
+	dirs  map[string][]fs.DirEntry
+	files map[string]*info
+}
+
+// New serves the objects of bucket.
+func New(bucket Bucket) *FS {
+	return &FS{bucket: bucket}
+}
+
+// Open opens the object or directory at name. Reading an object streams it
+// from the bucket.
+func (f *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if err := f.list(); err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if entries, ok := f.dirs[name]; ok {
+		return &dir{info: dirInfo(name), entries: entries}, nil
+	}
+	fi, ok := f.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	body, err := f.bucket.Open(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &file{info: fi, body: body}, nil
+}
+
+// ReadDir lists the directory at name, sorted by name.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name,
+			Err: fs.ErrInvalid}
+	}
+	if err := f.list(); err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	entries, ok := f.dirs[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name,
+			Err: fs.ErrNotExist}
+	}
+	return append([]fs.DirEntry(nil), entries...), nil
+}
+
+// Stat describes the object or directory at name without reading it.
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	if err := f.list(); err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if _, ok := f.dirs[name]; ok {
+		return dirInfo(name), nil
+	}
+	if fi, ok := f.files[name]; ok {
+		return fi, nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+// list lists the bucket the first time it's called.
+func (f *FS) list() error {
+	f.listOnce.Do(func() {
+		objs, err := f.bucket.List()
+		if err != nil {
+			f.listErr = err
+			return
+		}
+		f.dirs = map[string][]fs.DirEntry{".": {}}
+		f.files = map[string]*info{}
+		for _, obj := range objs {
+			f.add(obj)
+		}
+		for _, entries := range f.dirs {
+			sort.Slice(entries, func(i, j int) bool {
+				return entries[i].Name() < entries[j].Name()
+			})
+		}
+	})
+	return f.listErr
+}
+
+// add records obj, and the directories holding it.
+func (f *FS) add(obj Object) {
+	// Skip the empty objects which consoles create to show folders, and
+	// keys which aren't valid paths, such as with "//" or ".."
+	if strings.HasSuffix(obj.Name, "/") || !fs.ValidPath(obj.Name) ||
+		obj.Name == "." {
+		return
+	}
+	fi := &info{
+		name:    path.Base(obj.Name),
+		size:    obj.Size,
+		modTime: obj.ModTime,
+	}
+	f.files[obj.Name] = fi
+	var entry fs.DirEntry = fi
+	for d := path.Dir(obj.Name); ; d = path.Dir(d) {
+		_, seen := f.dirs[d]
+		f.dirs[d] = append(f.dirs[d], entry)
+		if seen || d == "." {
+			return
+		}
+		entry = dirInfo(d)
+	}
+}
+
+// info describes an object or directory, as both fs.FileInfo and
+// fs.DirEntry.
+type info struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func dirInfo(name string) *info {
+	return &info{name: path.Base(name), dir: true}
+}
+
+func (i *info) Name() string       { return i.name }
+func (i *info) Size() int64        { return i.size }
+func (i *info) ModTime() time.Time { return i.modTime }
+func (i *info) IsDir() bool        { return i.dir }
+func (i *info) Sys() interface{}   { return nil }
+
+func (i *info) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+func (i *info) Type() fs.FileMode          { return i.Mode().Type() }
+func (i *info) Info() (fs.FileInfo, error) { return i, nil }
+
+// file is an object being read from the bucket.
+type file struct {
+	info *info
+	body io.ReadCloser
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *file) Read(b []byte) (int, error) { return f.body.Read(b) }
+func (f *file) Close() error               { return f.body.Close() }
+
+// dir is an open directory, listing its entries in turn.
+type dir struct {
+	info    *info
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *dir) Close() error               { return nil }
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name,
+		Err: errors.New("is a directory")}
+}
+
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(rest) {
+		rest = rest[:n]
+	}
+	d.offset += len(rest)
+	return append([]fs.DirEntry(nil), rest...), nil
+}
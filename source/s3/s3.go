@@ -0,0 +1,122 @@
+// Package s3 reads migrations from the objects under a prefix of an S3
+// bucket, such as those a build pipeline publishes, so the deploy job needs
+// no copy of the source tree. FS implements fs.FS for migrate.NewFS:
+//
+//	fsys := s3.New(ctx, cfg, "builds", "app/v1.42.0/migrations")
+//	m, err := migrate.NewFS(ctx, db, log, dbt, fsys, "")
+//
+// Objects are listed once, on first use, and each is streamed from S3 when
+// it's read. Keys under the prefix are paths in the FS, so an object at
+// app/v1.42.0/migrations/mysql/2.sql overrides 2.sql for MySQL, as a
+// subdirectory would. The credentials need s3:ListBucket on the bucket and
+// s3:GetObject on the objects.
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/thankful-ai/migrate/source/internal/objectfs"
+)
+
+// ErrAccessDenied is wrapped by the errors of an FS whose credentials lack
+// permission to list or read the migrations.
+var ErrAccessDenied = errors.New("access denied")
+
+// FS is the objects under a prefix of a bucket.
+type FS struct {
+	fsys *objectfs.FS
+}
+
+// New prepares to read the objects under prefix in bucket with an S3 client
+// made from cfg, as s3.NewFromConfig makes it with optFns. A trailing slash on
+// prefix is optional, and an empty prefix reads the whole bucket. ctx bounds
+// every request FS makes.
+func New(
+	ctx context.Context,
+	cfg aws.Config,
+	bucket, prefix string,
+	optFns ...func(*awss3.Options),
+) *FS {
+	return &FS{fsys: objectfs.New(&s3Bucket{
+		ctx:    ctx,
+		client: awss3.NewFromConfig(cfg, optFns...),
+		bucket: bucket,
+		prefix: objectfs.Prefix(prefix),
+	})}
+}
+
+// Open opens the object or directory at name. Reading an object streams it
+// from S3.
+func (f *FS) Open(name string) (fs.File, error) { return f.fsys.Open(name) }
+
+// ReadDir lists the directory at name, sorted by name.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return f.fsys.ReadDir(name)
+}
+
+// Stat describes the object or directory at name without reading it.
+func (f *FS) Stat(name string) (fs.FileInfo, error) { return f.fsys.Stat(name) }
+
+// s3Bucket lists and gets the objects under prefix in bucket.
+type s3Bucket struct {
+	ctx    context.Context
+	client *awss3.Client
+	bucket string
+	prefix string
+}
+
+// List lists the objects a page at a time.
+func (b *s3Bucket) List() ([]objectfs.Object, error) {
+	var objs []objectfs.Object
+	pages := awss3.NewListObjectsV2Paginator(b.client,
+		&awss3.ListObjectsV2Input{
+			Bucket: aws.String(b.bucket),
+			Prefix: aws.String(b.prefix),
+		})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(b.ctx)
+		if err != nil {
+			return nil, b.wrap(err, "list", "s3:ListBucket")
+		}
+		for _, obj := range page.Contents {
+			objs = append(objs, objectfs.Object{
+				Name: strings.TrimPrefix(aws.ToString(obj.Key),
+					b.prefix),
+				Size:    aws.ToInt64(obj.Size),
+				ModTime: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+	return objs, nil
+}
+
+func (b *s3Bucket) Open(name string) (io.ReadCloser, error) {
+	out, err := b.client.GetObject(b.ctx, &awss3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.prefix + name),
+	})
+	if err != nil {
+		return nil, b.wrap(err, "get", "s3:GetObject")
+	}
+	return out.Body, nil
+}
+
+// wrap describes an error from op, adding ErrAccessDenied and the permission
+// needed if it was refused.
+func (b *s3Bucket) wrap(err error, op, permission string) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "AccessDenied" ||
+		apiErr.ErrorCode() == "Forbidden") {
+		return fmt.Errorf("%s s3://%s/%s: %w, which needs %s: %w", op,
+			b.bucket, b.prefix, ErrAccessDenied, permission, err)
+	}
+	return fmt.Errorf("%s s3://%s/%s: %w", op, b.bucket, b.prefix, err)
+}
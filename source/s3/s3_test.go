@@ -0,0 +1,242 @@
+package s3
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/thankful-ai/migrate"
+	"github.com/thankful-ai/migrate/sqlite"
+)
+
+var ctx = context.Background()
+
+// pageSize is how many keys S3 lists at most in each page.
+const pageSize = 1000
+
+// fakeS3 serves the objects of one bucket over S3's REST API, listing them a
+// page at a time and refusing every request once denied is set. lists counts
+// the pages listed.
+type fakeS3 struct {
+	bucket  string
+	objects map[string]string
+	denied  bool
+
+	mu    sync.Mutex
+	lists int
+}
+
+type listResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []listObject
+}
+
+type listObject struct {
+	Key          string
+	LastModified string
+	Size         int
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.denied {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/"+s.bucket)
+	if key == "" || key == "/" {
+		s.list(w, r)
+		return
+	}
+	content, ok := s.objects[strings.TrimPrefix(key, "/")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `<Error><Code>NoSuchKey</Code></Error>`)
+		return
+	}
+	fmt.Fprint(w, content)
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.lists++
+	s.mu.Unlock()
+	prefix := r.URL.Query().Get("prefix")
+	var keys []string
+	for k := range s.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	start, _ := strconv.Atoi(r.URL.Query().Get("continuation-token"))
+	keys = keys[start:]
+	res := listResult{Name: s.bucket, Prefix: prefix, MaxKeys: pageSize}
+	if len(keys) > pageSize {
+		keys = keys[:pageSize]
+		res.IsTruncated = true
+		res.NextContinuationToken = strconv.Itoa(start + pageSize)
+	}
+	for _, k := range keys {
+		res.Contents = append(res.Contents, listObject{
+			Key:          k,
+			LastModified: "2024-01-02T03:04:05.000Z",
+			Size:         len(s.objects[k]),
+		})
+	}
+	res.KeyCount = len(res.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(res)
+}
+
+func newFS(t *testing.T, s *fakeS3, prefix string) *FS {
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	cfg := aws.Config{
+		Region:       "us-east-1",
+		Credentials:  aws.AnonymousCredentials{},
+		BaseEndpoint: aws.String(srv.URL),
+	}
+	return New(ctx, cfg, s.bucket, prefix, func(o *awss3.Options) {
+		o.UsePathStyle = true
+	})
+}
+
+func TestFS(t *testing.T) {
+	t.Parallel()
+	s := &fakeS3{bucket: "builds", objects: map[string]string{
+		"app/v1/migrations/":            "",
+		"app/v1/migrations/1.sql":       "CREATE TABLE a (id INTEGER);",
+		"app/v1/migrations/2.sql":       "CREATE TABLE b (id INTEGER);",
+		"app/v1/migrations/10.sql":      "CREATE TABLE c (id INTEGER);",
+		"app/v1/migrations/mysql/2.sql": "CREATE TABLE b (id INT);",
+		"app/v2/migrations/1.sql":       "CREATE TABLE other (id INTEGER);",
+	}}
+	for _, prefix := range []string{"app/v1/migrations", "app/v1/migrations/"} {
+		fsys := newFS(t, s, prefix)
+		check(t, fstest.TestFS(fsys, "1.sql", "2.sql", "10.sql",
+			"mysql/2.sql"))
+		byt, err := fs.ReadFile(fsys, "mysql/2.sql")
+		check(t, err)
+		if string(byt) != "CREATE TABLE b (id INT);" {
+			t.Fatalf("unexpected content %q", byt)
+		}
+		fi, err := fs.Stat(fsys, "10.sql")
+		check(t, err)
+		want := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		if fi.Size() != 28 || !fi.ModTime().Equal(want) {
+			t.Fatalf("unexpected info %d %s", fi.Size(), fi.ModTime())
+		}
+	}
+
+	// The whole bucket
+	fsys := newFS(t, s, "")
+	entries, err := fs.ReadDir(fsys, "app")
+	check(t, err)
+	if len(entries) != 2 || entries[0].Name() != "v1" ||
+		!entries[0].IsDir() {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+}
+
+func TestFSPages(t *testing.T) {
+	t.Parallel()
+	s := &fakeS3{bucket: "builds", objects: map[string]string{}}
+	for i := 1; i <= 2*pageSize+1; i++ {
+		s.objects[fmt.Sprintf("migrations/%d.sql", i)] = "SELECT 1;"
+	}
+	fsys := newFS(t, s, "migrations")
+	entries, err := fs.ReadDir(fsys, ".")
+	check(t, err)
+	if len(entries) != 2*pageSize+1 || s.lists != 3 {
+		t.Fatalf("expected %d files in 3 pages, got %d in %d",
+			2*pageSize+1, len(entries), s.lists)
+	}
+
+	// Objects are listed once
+	_, err = fs.ReadFile(fsys, "1.sql")
+	check(t, err)
+	if s.lists != 3 {
+		t.Fatalf("expected no more pages listed, got %d", s.lists)
+	}
+}
+
+func TestFSAccessDenied(t *testing.T) {
+	t.Parallel()
+	s := &fakeS3{bucket: "builds", denied: true}
+	_, err := fs.ReadDir(newFS(t, s, "migrations"), ".")
+	if !errors.Is(err, ErrAccessDenied) ||
+		!strings.Contains(err.Error(), "s3:ListBucket") {
+		t.Fatalf("expected access denied to list, got %v", err)
+	}
+
+	s = &fakeS3{bucket: "builds", objects: map[string]string{
+		"migrations/1.sql": "SELECT 1;",
+	}}
+	fsys := newFS(t, s, "migrations")
+	_, err = fs.ReadDir(fsys, ".")
+	check(t, err)
+	s.denied = true
+	_, err = fs.ReadFile(fsys, "1.sql")
+	if !errors.Is(err, ErrAccessDenied) ||
+		!strings.Contains(err.Error(), "s3:GetObject") {
+		t.Fatalf("expected access denied to get, got %v", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	t.Parallel()
+	s := &fakeS3{bucket: "builds", objects: map[string]string{
+		"migrations/1.sql":  "CREATE TABLE a (id INTEGER);",
+		"migrations/2.sql":  "INSERT INTO a (id) VALUES (2);",
+		"migrations/10.sql": "INSERT INTO a (id) VALUES (10);",
+		"migrations/notes":  "not a migration",
+	}}
+	db := sqlite.New(filepath.Join(t.TempDir(), "s3.db"))
+	check(t, db.Open(ctx))
+	defer db.Close()
+	m, err := migrate.NewFS(ctx, db, testLogger{t}, migrate.DBTypeSQLite,
+		newFS(t, s, "migrations"), "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	var names []string
+	for _, r := range m.Results {
+		names = append(names, r.Filename)
+	}
+	if strings.Join(names, ",") != "1.sql,2.sql,10.sql" {
+		t.Fatalf("unexpected files applied %v", names)
+	}
+}
+
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Printf(s string, vs ...interface{}) { l.t.Logf(s, vs...) }
+func (l testLogger) Println(vs ...interface{})          { l.t.Log(vs...) }
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,1049 @@
+// Package spanner implements a migrate.Store for Google Cloud Spanner.
+//
+// Spanner changes schemas through long-running operations rather than
+// ordinary statements, so DB sends DDL in migrations through the database
+// admin client and waits for each operation to finish before reporting
+// success. Only then does the runner record a checkpoint, so an interrupted
+// run resumes at the first statement whose operation did not complete. Every
+// other statement runs as DML in a read-write transaction.
+//
+// If an operation outlives the DDL timeout, Exec returns an error but Spanner
+// keeps applying the change in the background. Check the operation in the
+// console before re-running, since the schema change may since have completed.
+package spanner
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	database "cloud.google.com/go/spanner/admin/database/apiv1"
+	"cloud.google.com/go/spanner/admin/database/apiv1/databasepb"
+	"github.com/pkg/errors"
+	"github.com/thankful-ai/migrate"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+)
+
+// DefaultDDLTimeout is used when New is given a zero timeout.
+const DefaultDDLTimeout = 30 * time.Minute
+
+var ddlPrefix = regexp.MustCompile(`(?i)^\s*(CREATE|ALTER|DROP|GRANT|REVOKE|RENAME|ANALYZE)\b`)
+
+type DB struct {
+	name       string
+	ddlTimeout time.Duration
+	opts       []option.ClientOption
+
+	client *spanner.Client
+	admin  *database.DatabaseAdminClient
+
+	// version of the meta tables, which decides the columns of meta to
+	// use. Until it's reported, the tables are assumed to be as
+	// CreateMetaIfNotExists makes them.
+	version int
+}
+
+// latestVersion is the newest meta version DB supports, and the version of
+// the tables CreateMetaIfNotExists creates.
+const latestVersion = 6
+
+// New prepares a connection to the Spanner database identified by project,
+// instance and dbName. ddlTimeout bounds how long Exec waits for each schema
+// change to complete. Client options such as credentials are passed through
+// to both the data and admin clients. To use the Spanner emulator, set the
+// SPANNER_EMULATOR_HOST environment variable.
+func New(
+	project, instance, dbName string,
+	ddlTimeout time.Duration,
+	opts ...option.ClientOption,
+) *DB {
+	if ddlTimeout == 0 {
+		ddlTimeout = DefaultDDLTimeout
+	}
+	return &DB{
+		name: fmt.Sprintf("projects/%s/instances/%s/databases/%s",
+			project, instance, dbName),
+		ddlTimeout: ddlTimeout,
+		opts:       opts,
+		version:    latestVersion,
+	}
+}
+
+func (db *DB) Open(ctx context.Context) error {
+	var err error
+	db.client, err = spanner.NewClient(ctx, db.name, db.opts...)
+	if err != nil {
+		return errors.Wrap(err, "new client")
+	}
+	db.admin, err = database.NewDatabaseAdminClient(ctx, db.opts...)
+	if err != nil {
+		db.client.Close()
+		return errors.Wrap(err, "new admin client")
+	}
+	return nil
+}
+
+func (db *DB) Close() error {
+	db.client.Close()
+	return db.admin.Close()
+}
+
+// Exec a statement. DDL is applied as a schema change and Exec blocks until
+// the operation completes or the DDL timeout expires. Anything else runs as
+// DML, with args bound to the parameters @p1, @p2, and so on.
+func (db *DB) Exec(
+	ctx context.Context,
+	q string,
+	args ...interface{},
+) (sql.Result, error) {
+	if isDDL(q) {
+		if len(args) > 0 {
+			return nil, errors.New("ddl does not accept arguments")
+		}
+		if err := db.updateDDL(ctx, q); err != nil {
+			return nil, err
+		}
+		return result(0), nil
+	}
+
+	var rows int64
+	_, err := db.client.ReadWriteTransaction(ctx,
+		func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			var err error
+			rows, err = txn.Update(ctx, statement(q, args))
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return result(rows), nil
+}
+
+// updateDDL applies statements in a single schema change, waiting for the
+// long-running operation to finish.
+func (db *DB) updateDDL(ctx context.Context, statements ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, db.ddlTimeout)
+	defer cancel()
+
+	op, err := db.admin.UpdateDatabaseDdl(ctx,
+		&databasepb.UpdateDatabaseDdlRequest{
+			Database:   db.name,
+			Statements: statements,
+		})
+	if err != nil {
+		return errors.Wrap(err, "update database ddl")
+	}
+	if err = op.Wait(ctx); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("ddl still running after %s, check operation %s before retrying: %w",
+				db.ddlTimeout, op.Name(), err)
+		}
+		return errors.Wrap(err, "wait for ddl")
+	}
+	return nil
+}
+
+func (db *DB) CreateMetaIfNotExists(ctx context.Context) error {
+	q := `CREATE TABLE IF NOT EXISTS meta (
+		filename STRING(MAX) NOT NULL,
+		checksum STRING(MAX) NOT NULL,
+		content STRING(MAX) NOT NULL,
+		createdat TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp=true),
+		duration_ms INT64,
+		applied_by STRING(MAX),
+		tool_version STRING(MAX),
+		checksum_algo STRING(MAX) NOT NULL DEFAULT ("md5"),
+		status STRING(MAX) NOT NULL DEFAULT ("applied"),
+		down_content STRING(MAX),
+		error_text STRING(MAX),
+		app_version STRING(MAX),
+	) PRIMARY KEY (filename)`
+	if err := db.updateDDL(ctx, q); err != nil {
+		return errors.Wrap(err, "create meta table")
+	}
+	return nil
+}
+
+func (db *DB) CreateMetaCheckpointsIfNotExists(ctx context.Context) error {
+	q := `CREATE TABLE IF NOT EXISTS metacheckpoints (
+		filename STRING(MAX) NOT NULL,
+		idx INT64 NOT NULL,
+		md5 STRING(MAX) NOT NULL,
+		content STRING(MAX) NOT NULL,
+		createdat TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp=true),
+	) PRIMARY KEY (filename, idx)`
+	if err := db.updateDDL(ctx, q); err != nil {
+		return errors.Wrap(err, "create metacheckpoints table")
+	}
+	return nil
+}
+
+func (db *DB) CreateMetaHistoryIfNotExists(ctx context.Context) error {
+	q := `CREATE TABLE IF NOT EXISTS metahistory (
+		run_id STRING(MAX) NOT NULL,
+		filename STRING(MAX) NOT NULL,
+		idx INT64 NOT NULL,
+		started_at TIMESTAMP NOT NULL,
+		finished_at TIMESTAMP NOT NULL,
+		success BOOL NOT NULL,
+		error_text STRING(MAX),
+		host STRING(MAX),
+	) PRIMARY KEY (run_id, filename, idx, started_at)`
+	if err := db.updateDDL(ctx, q); err != nil {
+		return errors.Wrap(err, "create metahistory table")
+	}
+	return nil
+}
+
+func (db *DB) CreateMetaVersionIfNotExists(
+	ctx context.Context,
+	schemaVersion int,
+) (int, error) {
+	// Spanner has no error code specific to existing tables, so check the
+	// schema before creating it.
+	exists, err := db.tableExists(ctx, "metaversion")
+	if err != nil {
+		return 0, errors.Wrap(err, "check metaversion table")
+	}
+	if !exists {
+		q := `CREATE TABLE metaversion (
+			version INT64 NOT NULL,
+		) PRIMARY KEY (version)`
+		if err = db.updateDDL(ctx, q); err != nil {
+			return 0, errors.Wrap(err, "create metaversion table")
+		}
+	}
+
+	stmt := spanner.Statement{SQL: `SELECT version FROM metaversion`}
+	iter := db.client.Single().Query(ctx, stmt)
+	defer iter.Stop()
+	row, err := iter.Next()
+	switch {
+	case err == iterator.Done:
+		if exists {
+			schemaVersion = 0
+		}
+		_, err = db.client.Apply(ctx, []*spanner.Mutation{
+			spanner.Insert("metaversion", []string{"version"},
+				[]interface{}{int64(schemaVersion)}),
+		})
+		if err != nil {
+			return 0, errors.Wrap(err, "insert version")
+		}
+		db.version = schemaVersion
+		return schemaVersion, nil
+	case err != nil:
+		return 0, errors.Wrap(err, "get version")
+	}
+	var version int64
+	if err = row.Columns(&version); err != nil {
+		return 0, errors.Wrap(err, "scan version")
+	}
+	db.version = int(version)
+	return int(version), nil
+}
+
+func (db *DB) GetMetaVersion(ctx context.Context) (int, bool, error) {
+	exists, err := db.tableExists(ctx, "meta")
+	if err != nil || !exists {
+		return 0, false, errors.Wrap(err, "check meta table")
+	}
+	exists, err = db.tableExists(ctx, "metaversion")
+	if err != nil {
+		return 0, false, errors.Wrap(err, "check metaversion table")
+	}
+	var version int64
+	if exists {
+		stmt := spanner.Statement{SQL: `SELECT version FROM metaversion`}
+		iter := db.client.Single().Query(ctx, stmt)
+		defer iter.Stop()
+		row, err := iter.Next()
+		switch {
+		case err == iterator.Done:
+		case err != nil:
+			return 0, false, errors.Wrap(err, "get version")
+		default:
+			if err = row.Columns(&version); err != nil {
+				return 0, false, errors.Wrap(err, "scan version")
+			}
+		}
+	}
+	db.version = int(version)
+	return int(version), true, nil
+}
+
+func (db *DB) tableExists(ctx context.Context, name string) (bool, error) {
+	stmt := spanner.Statement{
+		SQL: `SELECT COUNT(*) FROM information_schema.tables
+			WHERE table_catalog = '' AND table_schema = ''
+			AND table_name = @name`,
+		Params: map[string]interface{}{"name": name},
+	}
+	iter := db.client.Single().Query(ctx, stmt)
+	defer iter.Stop()
+	row, err := iter.Next()
+	if err != nil {
+		return false, err
+	}
+	var n int64
+	if err = row.Columns(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// GetMigrations leaves out each migration's DownContent. See
+// GetMigrationWithDown.
+func (db *DB) GetMigrations(ctx context.Context) ([]migrate.Migration, error) {
+	ms, err := db.getMigrations(ctx, false, spanner.Statement{})
+	if err != nil {
+		return nil, err
+	}
+	migrate.SortMigrations(ms)
+	return ms, nil
+}
+
+func (db *DB) GetMigrationWithDown(
+	ctx context.Context,
+	filename string,
+) (migrate.Migration, error) {
+	ms, err := db.getMigrations(ctx, true, spanner.Statement{
+		SQL:    `WHERE filename = @filename`,
+		Params: map[string]interface{}{"filename": filename},
+	})
+	if err != nil {
+		return migrate.Migration{}, err
+	}
+	if len(ms) == 0 {
+		return migrate.Migration{}, fmt.Errorf("%s: %w", filename,
+			migrate.ErrMigrationNotFound)
+	}
+	return ms[0], nil
+}
+
+// getMigrations selects the metaColumns of meta rows, followed by the clauses
+// and params in rest.
+func (db *DB) getMigrations(
+	ctx context.Context,
+	withDown bool,
+	rest spanner.Statement,
+) ([]migrate.Migration, error) {
+	cols := strings.Join(db.metaColumns(withDown), ", ")
+	stmt := spanner.Statement{
+		SQL:    `SELECT ` + cols + ` FROM meta ` + rest.SQL,
+		Params: rest.Params,
+	}
+	iter := db.client.Single().Query(ctx, stmt)
+	defer iter.Stop()
+
+	migrations := []migrate.Migration{}
+	for {
+		row, err := iter.Next()
+		if err == iterator.Done {
+			return migrations, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var m migrate.Migration
+		dest := []interface{}{&m.Filename, &m.Content, &m.Checksum}
+		var durationMS spanner.NullInt64
+		var appliedBy, toolVersion, errText, appVersion spanner.NullString
+		var down spanner.NullString
+		if db.version >= 2 {
+			dest = append(dest, &durationMS, &appliedBy, &toolVersion)
+		}
+		m.ChecksumAlgo = migrate.ChecksumMD5
+		m.Status = migrate.StatusApplied
+		if db.version >= 3 {
+			dest = append(dest, &m.ChecksumAlgo, &m.Status)
+		}
+		if db.version >= 5 {
+			dest = append(dest, &errText)
+		}
+		if db.version >= 6 {
+			dest = append(dest, &appVersion)
+		}
+		if withDown && db.version >= 4 {
+			dest = append(dest, &down)
+		}
+		if err = row.Columns(dest...); err != nil {
+			return nil, errors.Wrap(err, "scan migration")
+		}
+		m.Duration = time.Duration(durationMS.Int64) * time.Millisecond
+		m.AppliedBy = appliedBy.StringVal
+		m.ToolVersion = toolVersion.StringVal
+		m.Error = errText.StringVal
+		m.AppVersion = appVersion.StringVal
+		m.DownContent = down.StringVal
+		migrations = append(migrations, m)
+	}
+}
+
+func (db *DB) GetMetaCheckpoints(
+	ctx context.Context,
+	filename string,
+) ([]string, error) {
+	return db.checkpointColumn(ctx, filename, "md5")
+}
+
+// GetMetaCheckpointContents reports the statements checkpointed for filename.
+// See migrate.CheckpointReader.
+func (db *DB) GetMetaCheckpointContents(
+	ctx context.Context,
+	filename string,
+) ([]string, error) {
+	return db.checkpointColumn(ctx, filename, "content")
+}
+
+// checkpointColumn reads the column col of each checkpoint of filename, in
+// order.
+func (db *DB) checkpointColumn(
+	ctx context.Context,
+	filename, col string,
+) ([]string, error) {
+	stmt := spanner.Statement{
+		SQL: `SELECT ` + col + ` FROM metacheckpoints
+			WHERE filename = @filename ORDER BY idx`,
+		Params: map[string]interface{}{"filename": filename},
+	}
+	iter := db.client.Single().Query(ctx, stmt)
+	defer iter.Stop()
+
+	checkpoints := []string{}
+	for {
+		row, err := iter.Next()
+		if err == iterator.Done {
+			return checkpoints, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var s string
+		if err = row.Columns(&s); err != nil {
+			return nil, errors.Wrap(err, "scan checkpoint")
+		}
+		checkpoints = append(checkpoints, s)
+	}
+}
+
+// metaColumns are the columns of meta in the store's version, in the order
+// getMigrations reads them. withDown includes down_content as the last column.
+func (db *DB) metaColumns(withDown bool) []string {
+	checksum := "md5"
+	if db.version >= 3 {
+		checksum = "checksum"
+	}
+	cols := []string{"filename", "content", checksum}
+	if db.version >= 2 {
+		cols = append(cols, "duration_ms", "applied_by", "tool_version")
+	}
+	if db.version >= 3 {
+		cols = append(cols, "checksum_algo", "status")
+	}
+	if db.version >= 5 {
+		cols = append(cols, "error_text")
+	}
+	if db.version >= 6 {
+		cols = append(cols, "app_version")
+	}
+	if withDown && db.version >= 4 {
+		cols = append(cols, "down_content")
+	}
+	return cols
+}
+
+// metaRow returns the columns and values of meta to write for m, including
+// the columns of later versions only once the meta tables have them.
+func (db *DB) metaRow(m migrate.Migration) ([]string, []interface{}) {
+	cols := append(db.metaColumns(true), "createdat")
+	vals := []interface{}{m.Filename, m.Content, m.Checksum}
+	if db.version >= 2 {
+		vals = append(vals, m.Duration.Milliseconds(), m.AppliedBy,
+			m.ToolVersion)
+	}
+	if db.version >= 3 {
+		if m.ChecksumAlgo == "" {
+			m.ChecksumAlgo = migrate.ChecksumMD5
+		}
+		if m.Status == "" {
+			m.Status = migrate.StatusApplied
+		}
+		vals = append(vals, m.ChecksumAlgo, m.Status)
+	}
+	if db.version >= 5 {
+		vals = append(vals, nullString(m.Error))
+	}
+	if db.version >= 6 {
+		vals = append(vals, nullString(m.AppVersion))
+	}
+	if db.version >= 4 {
+		vals = append(vals, nullString(m.DownContent))
+	}
+	return cols, append(vals, spanner.CommitTimestamp)
+}
+
+func (db *DB) UpsertMigration(ctx context.Context, m migrate.Migration) error {
+	cols, vals := db.metaRow(m)
+	_, err := db.client.Apply(ctx, []*spanner.Mutation{
+		spanner.InsertOrUpdate("meta", cols, vals),
+	})
+	return err
+}
+
+func (db *DB) InsertMigration(ctx context.Context, m migrate.Migration) error {
+	cols, vals := db.metaRow(m)
+	_, err := db.client.Apply(ctx, []*spanner.Mutation{
+		spanner.Insert("meta", cols, vals),
+	})
+	return err
+}
+
+func (db *DB) CreateMetaLockIfNotExists(ctx context.Context) error {
+	q := `CREATE TABLE IF NOT EXISTS metalock (
+		id INT64 NOT NULL,
+		holder STRING(MAX) NOT NULL,
+		hostname STRING(MAX),
+		pid INT64 NOT NULL,
+		filename STRING(MAX),
+		acquired_at TIMESTAMP NOT NULL,
+		heartbeat_at TIMESTAMP NOT NULL,
+	) PRIMARY KEY (id)`
+	if err := db.updateDDL(ctx, q); err != nil {
+		return errors.Wrap(err, "create metalock table")
+	}
+	return nil
+}
+
+// metaLockKey is the key of metalock's only row.
+var metaLockKey = spanner.Key{int64(1)}
+
+// AcquireMetaLock reads the lock and replaces it in one read-write
+// transaction, which Spanner aborts if another run changes the row first.
+func (db *DB) AcquireMetaLock(
+	ctx context.Context,
+	lock migrate.MetaLock,
+	staleBefore time.Time,
+) (bool, error) {
+	var acquired bool
+	_, err := db.client.ReadWriteTransaction(ctx,
+		func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			acquired = false
+			row, err := txn.ReadRow(ctx, "metalock", metaLockKey,
+				[]string{"holder", "heartbeat_at"})
+			switch {
+			case spanner.ErrCode(err) == codes.NotFound:
+			case err != nil:
+				return err
+			default:
+				var holder string
+				var heartbeat time.Time
+				if err = row.Columns(&holder, &heartbeat); err != nil {
+					return err
+				}
+				if holder != lock.Holder &&
+					!heartbeat.Before(staleBefore) {
+					return nil
+				}
+			}
+			acquired = true
+			return txn.BufferWrite([]*spanner.Mutation{
+				spanner.InsertOrUpdate("metalock", []string{
+					"id", "holder", "hostname", "pid", "filename",
+					"acquired_at", "heartbeat_at",
+				}, []interface{}{
+					int64(1), lock.Holder, nullString(lock.Hostname),
+					int64(lock.PID), nullString(lock.Filename),
+					lock.AcquiredAt, lock.HeartbeatAt,
+				}),
+			})
+		})
+	return acquired, err
+}
+
+func (db *DB) HeartbeatMetaLock(
+	ctx context.Context,
+	holder string,
+	at time.Time,
+) (bool, error) {
+	stmt := spanner.Statement{
+		SQL: `UPDATE metalock SET heartbeat_at = @at
+			WHERE holder = @holder`,
+		Params: map[string]interface{}{"at": at, "holder": holder},
+	}
+	var rows int64
+	_, err := db.client.ReadWriteTransaction(ctx,
+		func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			var err error
+			rows, err = txn.Update(ctx, stmt)
+			return err
+		})
+	return rows > 0, err
+}
+
+func (db *DB) ReleaseMetaLock(ctx context.Context, holder string) error {
+	stmt := spanner.Statement{
+		SQL:    `DELETE FROM metalock WHERE holder = @holder`,
+		Params: map[string]interface{}{"holder": holder},
+	}
+	_, err := db.client.ReadWriteTransaction(ctx,
+		func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			_, err := txn.Update(ctx, stmt)
+			return err
+		})
+	return err
+}
+
+func (db *DB) DeleteMetaLock(ctx context.Context) error {
+	_, err := db.client.Apply(ctx, []*spanner.Mutation{
+		spanner.Delete("metalock", spanner.AllKeys()),
+	})
+	return err
+}
+
+func (db *DB) GetMetaLock(ctx context.Context) (*migrate.MetaLock, error) {
+	row, err := db.client.Single().ReadRow(ctx, "metalock", metaLockKey,
+		[]string{"holder", "hostname", "pid", "filename", "acquired_at",
+			"heartbeat_at"})
+	switch {
+	case spanner.ErrCode(err) == codes.NotFound:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	var lock migrate.MetaLock
+	var hostname, filename spanner.NullString
+	var pid int64
+	err = row.Columns(&lock.Holder, &hostname, &pid, &filename,
+		&lock.AcquiredAt, &lock.HeartbeatAt)
+	if err != nil {
+		return nil, errors.Wrap(err, "scan lock")
+	}
+	lock.Hostname = hostname.StringVal
+	lock.PID = int(pid)
+	lock.Filename = filename.StringVal
+	return &lock, nil
+}
+
+func (db *DB) SetMetaLockFilename(
+	ctx context.Context,
+	holder, filename string,
+) error {
+	stmt := spanner.Statement{
+		SQL: `UPDATE metalock SET filename = @filename
+			WHERE holder = @holder`,
+		Params: map[string]interface{}{
+			"filename": nullString(filename),
+			"holder":   holder,
+		},
+	}
+	_, err := db.client.ReadWriteTransaction(ctx,
+		func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			_, err := txn.Update(ctx, stmt)
+			return err
+		})
+	return err
+}
+
+func (db *DB) InsertHistory(ctx context.Context, h migrate.History) error {
+	_, err := db.client.Apply(ctx, []*spanner.Mutation{
+		spanner.Insert("metahistory", []string{
+			"run_id", "filename", "idx", "started_at", "finished_at",
+			"success", "error_text", "host",
+		}, []interface{}{
+			h.RunID, h.Filename, int64(h.Statement), h.StartedAt,
+			h.FinishedAt, h.Success, nullString(h.Error), h.Host,
+		}),
+	})
+	return err
+}
+
+func (db *DB) GetHistory(
+	ctx context.Context,
+	filename string,
+	limit int,
+) ([]migrate.History, error) {
+	stmt := spanner.Statement{SQL: `SELECT run_id, filename, idx, started_at,
+		finished_at, success, error_text, host FROM metahistory`}
+	if filename != "" {
+		stmt.SQL += ` WHERE filename = @filename`
+		stmt.Params = map[string]interface{}{"filename": filename}
+	}
+	stmt.SQL += ` ORDER BY started_at DESC, idx DESC`
+	if limit > 0 {
+		stmt.SQL += fmt.Sprintf(` LIMIT %d`, limit)
+	}
+	iter := db.client.Single().Query(ctx, stmt)
+	defer iter.Stop()
+
+	history := []migrate.History{}
+	for {
+		row, err := iter.Next()
+		if err == iterator.Done {
+			return history, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var h migrate.History
+		var idx int64
+		var errText, host spanner.NullString
+		err = row.Columns(&h.RunID, &h.Filename, &idx, &h.StartedAt,
+			&h.FinishedAt, &h.Success, &errText, &host)
+		if err != nil {
+			return nil, errors.Wrap(err, "scan history")
+		}
+		h.Statement = int(idx)
+		h.Error = errText.StringVal
+		h.Host = host.StringVal
+		history = append(history, h)
+	}
+}
+
+func (db *DB) GetMetaSnapshot(
+	ctx context.Context,
+) (*migrate.MetaSnapshot, error) {
+	ms, err := db.getMigrations(ctx, true, spanner.Statement{})
+	if err != nil {
+		return nil, errors.Wrap(err, "get migrations")
+	}
+	migrate.SortMigrations(ms)
+	createdAt := map[string]time.Time{}
+	stmt := spanner.Statement{SQL: `SELECT filename, createdat FROM meta`}
+	err = db.client.Single().Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		var filename string
+		var t time.Time
+		if err := row.Columns(&filename, &t); err != nil {
+			return err
+		}
+		createdAt[filename] = t
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "get meta createdat")
+	}
+	snap := &migrate.MetaSnapshot{
+		Migrations:  make([]migrate.SnapshotMigration, len(ms)),
+		Checkpoints: []migrate.Checkpoint{},
+	}
+	for i, m := range ms {
+		snap.Migrations[i] = migrate.SnapshotMigration{
+			Migration: m,
+			CreatedAt: createdAt[m.Filename],
+		}
+	}
+
+	stmt = spanner.Statement{SQL: `SELECT filename, idx, md5, content,
+		createdat FROM metacheckpoints ORDER BY filename, idx`}
+	err = db.client.Single().Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		var c migrate.Checkpoint
+		var idx int64
+		err := row.Columns(&c.Filename, &idx, &c.Checksum, &c.Content,
+			&c.CreatedAt)
+		if err != nil {
+			return err
+		}
+		c.Index = int(idx)
+		snap.Checkpoints = append(snap.Checkpoints, c)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "get checkpoints")
+	}
+	return snap, nil
+}
+
+// PutMetaSnapshot replaces meta and metacheckpoints in one read-write
+// transaction. Rows without a createdat are recorded with the commit
+// timestamp.
+func (db *DB) PutMetaSnapshot(
+	ctx context.Context,
+	snap *migrate.MetaSnapshot,
+) error {
+	createdAt := func(t time.Time) interface{} {
+		if t.IsZero() {
+			return spanner.CommitTimestamp
+		}
+		return t
+	}
+	muts := []*spanner.Mutation{
+		spanner.Delete("meta", spanner.AllKeys()),
+		spanner.Delete("metacheckpoints", spanner.AllKeys()),
+	}
+	for _, m := range snap.Migrations {
+		cols, vals := db.metaRow(m.Migration)
+		vals[len(vals)-1] = createdAt(m.CreatedAt)
+		muts = append(muts, spanner.Insert("meta", cols, vals))
+	}
+	cols := []string{"filename", "content", "idx", "md5", "createdat"}
+	for _, c := range snap.Checkpoints {
+		muts = append(muts, spanner.Insert("metacheckpoints", cols,
+			[]interface{}{c.Filename, c.Content, int64(c.Index),
+				c.Checksum, createdAt(c.CreatedAt)}))
+	}
+	_, err := db.client.ReadWriteTransaction(ctx,
+		func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			return txn.BufferWrite(muts)
+		})
+	return err
+}
+
+func (db *DB) InsertMetaCheckpoint(
+	ctx context.Context,
+	filename, content, checksum string,
+	idx int,
+) error {
+	cols := []string{"filename", "content", "idx", "md5", "createdat"}
+	_, err := db.client.Apply(ctx, []*spanner.Mutation{
+		spanner.Insert("metacheckpoints", cols, []interface{}{
+			filename, content, int64(idx), checksum,
+			spanner.CommitTimestamp,
+		}),
+	})
+	return err
+}
+
+// DeleteMigration deletes the migration recorded as filename, and its
+// checkpoints, in one transaction.
+func (db *DB) DeleteMigration(ctx context.Context, filename string) error {
+	_, err := db.client.Apply(ctx, []*spanner.Mutation{
+		spanner.Delete("meta", spanner.Key{filename}),
+		spanner.Delete("metacheckpoints", spanner.Key{filename}.AsPrefix()),
+	})
+	return err
+}
+
+func (db *DB) DeleteMetaCheckpoints(ctx context.Context) error {
+	_, err := db.client.Apply(ctx, []*spanner.Mutation{
+		spanner.Delete("metacheckpoints", spanner.AllKeys()),
+	})
+	return err
+}
+
+// UpgradeToV1 records the v1 schema version. The Spanner store has always
+// created its meta tables in the v1 format, so there is nothing else to do.
+func (db *DB) UpgradeToV1(
+	ctx context.Context,
+	migrations []migrate.Migration,
+) error {
+	return db.SetMetaVersion(ctx, 0, 1)
+}
+
+// UpgradeToV2 adds the duration_ms, applied_by and tool_version columns to
+// meta. Columns which already exist are skipped, so the upgrade can run again
+// after failing partway through.
+func (db *DB) UpgradeToV2(ctx context.Context) error {
+	err := db.addMetaColumns(ctx,
+		"duration_ms INT64",
+		"applied_by STRING(MAX)",
+		"tool_version STRING(MAX)")
+	if err != nil {
+		return err
+	}
+	return db.SetMetaVersion(ctx, 1, 2)
+}
+
+// addMetaColumns adds the columns defined by defs to meta in one schema
+// change, skipping those which already exist.
+func (db *DB) addMetaColumns(ctx context.Context, defs ...string) error {
+	var ddl []string
+	for _, def := range defs {
+		name, _, _ := strings.Cut(def, " ")
+		exists, err := db.columnExists(ctx, "meta", name)
+		if err != nil {
+			return errors.Wrapf(err, "check %s column", name)
+		}
+		if !exists {
+			ddl = append(ddl, "ALTER TABLE meta ADD COLUMN "+def)
+		}
+	}
+	if len(ddl) == 0 {
+		return nil
+	}
+	if err := db.updateDDL(ctx, ddl...); err != nil {
+		return errors.Wrap(err, "add meta columns")
+	}
+	return nil
+}
+
+// UpgradeToV3 replaces meta's md5 column with checksum, and adds the
+// checksum_algo and status columns, which existing rows fill with their
+// defaults. Spanner can't rename columns, so checksum is added and backfilled
+// before md5 is dropped. Steps which are already done are skipped, so the
+// upgrade can run again after failing partway through.
+func (db *DB) UpgradeToV3(ctx context.Context) error {
+	exists := map[string]bool{}
+	for _, col := range []string{"md5", "checksum", "checksum_algo",
+		"status"} {
+		var err error
+		exists[col], err = db.columnExists(ctx, "meta", col)
+		if err != nil {
+			return errors.Wrapf(err, "check %s column", col)
+		}
+	}
+	if !exists["checksum"] {
+		q := `ALTER TABLE meta ADD COLUMN checksum STRING(MAX)`
+		if err := db.updateDDL(ctx, q); err != nil {
+			return errors.Wrap(err, "add checksum column")
+		}
+	}
+	if exists["md5"] {
+		q := `UPDATE meta SET checksum = md5 WHERE checksum IS NULL`
+		if _, err := db.Exec(ctx, q); err != nil {
+			return errors.Wrap(err, "copy md5 to checksum")
+		}
+		err := db.updateDDL(ctx,
+			`ALTER TABLE meta ALTER COLUMN checksum STRING(MAX) NOT NULL`,
+			`ALTER TABLE meta DROP COLUMN md5`)
+		if err != nil {
+			return errors.Wrap(err, "replace md5 column")
+		}
+	}
+	var ddl []string
+	if !exists["checksum_algo"] {
+		ddl = append(ddl, `ALTER TABLE meta ADD COLUMN checksum_algo
+			STRING(MAX) NOT NULL DEFAULT ("md5")`)
+	}
+	if !exists["status"] {
+		ddl = append(ddl, `ALTER TABLE meta ADD COLUMN status
+			STRING(MAX) NOT NULL DEFAULT ("applied")`)
+	}
+	if len(ddl) > 0 {
+		if err := db.updateDDL(ctx, ddl...); err != nil {
+			return errors.Wrap(err, "add meta columns")
+		}
+	}
+	return db.SetMetaVersion(ctx, 2, 3)
+}
+
+// UpgradeToV4 adds meta's down_content column. STRING(MAX) already holds
+// migrations of any size, so unlike sqlstore no content columns need widening.
+func (db *DB) UpgradeToV4(ctx context.Context) error {
+	if err := db.addMetaColumns(ctx, "down_content STRING(MAX)"); err != nil {
+		return err
+	}
+	return db.SetMetaVersion(ctx, 3, 4)
+}
+
+// UpgradeToV5 adds meta's error_text column.
+func (db *DB) UpgradeToV5(ctx context.Context) error {
+	if err := db.addMetaColumns(ctx, "error_text STRING(MAX)"); err != nil {
+		return err
+	}
+	return db.SetMetaVersion(ctx, 4, 5)
+}
+
+// UpgradeToV6 adds meta's app_version column.
+func (db *DB) UpgradeToV6(ctx context.Context) error {
+	if err := db.addMetaColumns(ctx, "app_version STRING(MAX)"); err != nil {
+		return err
+	}
+	return db.SetMetaVersion(ctx, 5, 6)
+}
+
+// SetMetaVersion replaces the row of metaversion in a read-write transaction,
+// since version is its primary key, so can't be updated in place. As in
+// sqlstore, a version already at to is left alone, and a missing row counts as
+// version 0.
+func (db *DB) SetMetaVersion(ctx context.Context, from, to int) error {
+	_, err := db.client.ReadWriteTransaction(ctx,
+		func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			stmt := spanner.Statement{SQL: `SELECT version FROM metaversion`}
+			iter := txn.Query(ctx, stmt)
+			defer iter.Stop()
+			row, err := iter.Next()
+			var version int64
+			switch {
+			case err == iterator.Done && from == 0:
+			case err == iterator.Done:
+				return &migrate.ErrVersionConflict{From: from, To: to}
+			case err != nil:
+				return err
+			default:
+				if err = row.Columns(&version); err != nil {
+					return err
+				}
+			}
+			switch int(version) {
+			case to:
+				return nil
+			case from:
+			default:
+				return &migrate.ErrVersionConflict{From: from, To: to}
+			}
+			return txn.BufferWrite([]*spanner.Mutation{
+				spanner.Delete("metaversion", spanner.AllKeys()),
+				spanner.Insert("metaversion", []string{"version"},
+					[]interface{}{int64(to)}),
+			})
+		})
+	var conflict *migrate.ErrVersionConflict
+	if errors.As(err, &conflict) {
+		return conflict
+	}
+	if err != nil {
+		return errors.Wrap(err, "update metaversion")
+	}
+	db.version = to
+	return nil
+}
+
+func (db *DB) columnExists(
+	ctx context.Context,
+	table, column string,
+) (bool, error) {
+	stmt := spanner.Statement{
+		SQL: `SELECT COUNT(*) FROM information_schema.columns
+			WHERE table_catalog = '' AND table_schema = ''
+			AND table_name = @table AND column_name = @column`,
+		Params: map[string]interface{}{"table": table, "column": column},
+	}
+	iter := db.client.Single().Query(ctx, stmt)
+	defer iter.Stop()
+	row, err := iter.Next()
+	if err != nil {
+		return false, err
+	}
+	var n int64
+	if err = row.Columns(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// nullString records an empty string as NULL.
+func nullString(s string) spanner.NullString {
+	return spanner.NullString{StringVal: s, Valid: s != ""}
+}
+
+// isDDL reports whether q is a schema change, which Spanner only accepts
+// through the admin API.
+func isDDL(q string) bool {
+	return ddlPrefix.MatchString(q)
+}
+
+// statement binds args to the positional parameters @p1, @p2, ...
+func statement(q string, args []interface{}) spanner.Statement {
+	stmt := spanner.Statement{SQL: q}
+	if len(args) > 0 {
+		stmt.Params = make(map[string]interface{}, len(args))
+		for i, a := range args {
+			stmt.Params[fmt.Sprintf("p%d", i+1)] = a
+		}
+	}
+	return stmt
+}
+
+type result int64
+
+func (r result) LastInsertId() (int64, error) {
+	return 0, errors.New("spanner does not support LastInsertId")
+}
+
+func (r result) RowsAffected() (int64, error) { return int64(r), nil }
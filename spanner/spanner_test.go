@@ -0,0 +1,312 @@
+package spanner
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	database "cloud.google.com/go/spanner/admin/database/apiv1"
+	"cloud.google.com/go/spanner/admin/database/apiv1/databasepb"
+	instance "cloud.google.com/go/spanner/admin/instance/apiv1"
+	"cloud.google.com/go/spanner/admin/instance/apiv1/instancepb"
+	"github.com/pkg/errors"
+	"github.com/thankful-ai/migrate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var ctx = context.Background()
+
+const checkpointFile = "2.sql"
+
+func TestMain(m *testing.M) {
+	path := filepath.Join("..", "test.env")
+	err := parseEnv(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to parse %s: %s\n", path, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+func TestIsDDL(t *testing.T) {
+	tests := map[string]bool{
+		"CREATE TABLE users (id INT64) PRIMARY KEY (id)":    true,
+		"\n\talter table users add column name STRING(MAX)": true,
+		"DROP INDEX users_by_name":                          true,
+		"INSERT INTO users (id) VALUES (1)":                 false,
+		"UPDATE users SET name = 'create' WHERE id = 1":     false,
+		"DELETE FROM users WHERE TRUE":                      false,
+		"CREATED_AT":                                        false,
+	}
+	for q, want := range tests {
+		if got := isDDL(q); got != want {
+			t.Errorf("isDDL(%q) = %t, want %t", q, got, want)
+		}
+	}
+}
+
+func TestStatement(t *testing.T) {
+	stmt := statement("UPDATE t SET a=@p1 WHERE b=@p2", []interface{}{1, "x"})
+	if len(stmt.Params) != 2 || stmt.Params["p1"] != 1 ||
+		stmt.Params["p2"] != "x" {
+		t.Fatalf("unexpected params %v", stmt.Params)
+	}
+	stmt = statement("DELETE FROM t WHERE TRUE", nil)
+	if stmt.Params != nil {
+		t.Fatalf("expected no params, got %v", stmt.Params)
+	}
+}
+
+func TestCreateMetaIfNotExists(t *testing.T) {
+	db := newDB(t)
+
+	err := db.CreateMetaIfNotExists(ctx)
+	check(t, err)
+
+	// Creating the tables is idempotent
+	err = db.CreateMetaIfNotExists(ctx)
+	check(t, err)
+
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 0 {
+		t.Fatalf("expected 0 migrations, got %d", len(ms))
+	}
+}
+
+func TestCreateMetaVersionIfNotExists(t *testing.T) {
+	db := newDB(t)
+
+	v, err := db.CreateMetaVersionIfNotExists(ctx, 1)
+	check(t, err)
+	if v != 1 {
+		t.Fatalf("expected version 1, got %d", v)
+	}
+	v, err = db.CreateMetaVersionIfNotExists(ctx, 2)
+	check(t, err)
+	if v != 1 {
+		t.Fatalf("expected version 1, got %d", v)
+	}
+}
+
+func TestUpsertMigration(t *testing.T) {
+	db := setupDB(t)
+
+	// Test update
+	err := db.UpsertMigration(ctx, migrate.Migration{
+		Filename: "1.sql",
+		Content:  "SELECT 1;",
+		Checksum: "md5",
+	})
+	check(t, err)
+
+	// Test insert
+	err = db.UpsertMigration(ctx, migrate.Migration{
+		Filename: "3.sql",
+		Content:  "SELECT 3;",
+		Checksum: "md5",
+	})
+	check(t, err)
+
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(ms))
+	}
+}
+
+func TestInsertMetaCheckpoint(t *testing.T) {
+	db := setupDB(t)
+
+	err := db.InsertMetaCheckpoint(ctx, checkpointFile, "SELECT 3;", "md5", 1)
+	check(t, err)
+
+	mcs, err := db.GetMetaCheckpoints(ctx, checkpointFile)
+	check(t, err)
+	if len(mcs) != 2 {
+		t.Fatal("expected 2 checkpoints")
+	}
+
+	err = db.DeleteMetaCheckpoints(ctx)
+	check(t, err)
+	mcs, err = db.GetMetaCheckpoints(ctx, checkpointFile)
+	check(t, err)
+	if len(mcs) != 0 {
+		t.Fatal("expected 0 checkpoints")
+	}
+}
+
+// TestMigrateResume applies a directory of DDL, fails partway through a
+// file, then resumes from the last completed schema change.
+func TestMigrateResume(t *testing.T) {
+	db := newDB(t)
+
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", `
+		CREATE TABLE users (id INT64 NOT NULL) PRIMARY KEY (id);
+		INSERT INTO users (id) VALUES (1);`)
+	writeFile(t, dir, "2.sql", `
+		ALTER TABLE users ADD COLUMN name STRING(MAX);
+		ALTER TABLE missing ADD COLUMN name STRING(MAX);`)
+
+	m, err := migrate.New(ctx, db, testLogger{t}, migrate.DBTypeSpanner, dir, "")
+	check(t, err)
+	if _, err = m.Migrate(ctx); err == nil {
+		t.Fatal("expected error")
+	}
+	mcs, err := db.GetMetaCheckpoints(ctx, "2.sql")
+	check(t, err)
+	if len(mcs) != 1 {
+		t.Fatalf("expected 1 checkpoint, got %d", len(mcs))
+	}
+
+	// Re-adding the name column would fail, so this only succeeds if the
+	// first statement is skipped on resume
+	writeFile(t, dir, "2.sql", `
+		ALTER TABLE users ADD COLUMN name STRING(MAX);
+		CREATE INDEX users_by_name ON users (name);`)
+	m, err = migrate.New(ctx, db, testLogger{t}, migrate.DBTypeSpanner, dir, "",
+		migrate.WithResume())
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(ms))
+	}
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Printf(s string, vs ...interface{}) { l.t.Logf(s, vs...) }
+func (l testLogger) Println(vs ...interface{})          { l.t.Log(vs...) }
+
+func writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+	check(t, err)
+}
+
+func parseEnv(filename string) error {
+	fi, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	scn := bufio.NewScanner(fi)
+	for i := 1; scn.Scan(); i++ {
+		line := scn.Text()
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("bad line %d: %s", i, line)
+		}
+		if err = os.Setenv(parts[0], parts[1]); err != nil {
+			return errors.Wrap(err, "set env")
+		}
+	}
+	if err = scn.Err(); err != nil {
+		return errors.Wrap(err, "scan")
+	}
+	return nil
+}
+
+// newDB creates a fresh database on the emulator for each test.
+func newDB(t *testing.T) *DB {
+	if os.Getenv("SPANNER_EMULATOR_HOST") == "" {
+		panic("missing SPANNER_EMULATOR_HOST")
+	}
+	project := os.Getenv("SPANNER_PROJECT")
+	if project == "" {
+		panic("missing SPANNER_PROJECT")
+	}
+	inst := os.Getenv("SPANNER_INSTANCE")
+	if inst == "" {
+		panic("missing SPANNER_INSTANCE")
+	}
+	ctx := context.Background()
+	createInstance(t, ctx, project, inst)
+
+	admin, err := database.NewDatabaseAdminClient(ctx)
+	check(t, err)
+	t.Cleanup(func() { admin.Close() })
+
+	dbName := fmt.Sprintf("migrate_test_%d", time.Now().UnixNano()%1e9)
+	op, err := admin.CreateDatabase(ctx, &databasepb.CreateDatabaseRequest{
+		Parent: fmt.Sprintf("projects/%s/instances/%s", project,
+			inst),
+		CreateStatement: fmt.Sprintf("CREATE DATABASE `%s`", dbName),
+	})
+	check(t, err)
+	_, err = op.Wait(ctx)
+	check(t, err)
+
+	db := New(project, inst, dbName, time.Minute)
+	check(t, db.Open(ctx))
+	t.Cleanup(func() {
+		_ = db.Close()
+		_ = admin.DropDatabase(ctx, &databasepb.DropDatabaseRequest{
+			Database: db.name,
+		})
+	})
+	return db
+}
+
+func createInstance(t *testing.T, ctx context.Context, project, inst string) {
+	admin, err := instance.NewInstanceAdminClient(ctx)
+	check(t, err)
+	defer admin.Close()
+
+	op, err := admin.CreateInstance(ctx, &instancepb.CreateInstanceRequest{
+		Parent:     "projects/" + project,
+		InstanceId: inst,
+		Instance: &instancepb.Instance{
+			Config: fmt.Sprintf("projects/%s/instanceConfigs/emulator-config",
+				project),
+			DisplayName: inst,
+			NodeCount:   1,
+		},
+	})
+	if status.Code(err) == codes.AlreadyExists {
+		return
+	}
+	check(t, err)
+	_, err = op.Wait(ctx)
+	check(t, err)
+}
+
+func setupDB(t *testing.T) *DB {
+	db := newDB(t)
+	check(t, db.CreateMetaIfNotExists(ctx))
+	check(t, db.CreateMetaCheckpointsIfNotExists(ctx))
+	_, err := db.CreateMetaVersionIfNotExists(ctx, 1)
+	check(t, err)
+
+	err = db.InsertMigration(ctx, migrate.Migration{
+		Filename: "1.sql",
+		Content:  "SELECT 1;",
+		Checksum: "md5",
+	})
+	check(t, err)
+	err = db.InsertMetaCheckpoint(ctx, checkpointFile, "SELECT 2;", "md5", 0)
+	check(t, err)
+	return db
+}
@@ -0,0 +1,144 @@
+package migrate
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Splitter splits the content of a migration file, after the directives it
+// starts with, into the statements Migrate runs one at a time, checkpointing
+// each. A checkpoint records a statement by its Index, so a Splitter must
+// split a file the same way each time for a failed migration to resume.
+type Splitter interface {
+	Split(content string) ([]Statement, error)
+}
+
+// Statement is a statement a Splitter found in a migration file.
+type Statement struct {
+	// SQL is the statement to run.
+	SQL string
+
+	// Line is the line of the content it starts on, counting from 1.
+	Line int
+
+	// Index is its place among the file's statements, counting from 0.
+	Index int
+
+	// timeout is set by a timeout directive before the statement.
+	timeout *time.Duration
+}
+
+// SplitterProvider is implemented by stores whose dialect splits migrations
+// into statements otherwise than DefaultSplitter does, such as SQL Server's
+// GO batches. WithSplitter overrides it.
+type SplitterProvider interface {
+	Splitter() Splitter
+}
+
+// WithSplitter sets how files are split into statements, rather than as the
+// store prefers, or DefaultSplitter for stores with no preference. Every run
+// on a database should split its files the same way.
+func WithSplitter(s Splitter) Option {
+	return func(m *Migrate) { m.splitter = s }
+}
+
+// DefaultSplitter splits files at semicolons outside quotes and comments, as
+// the mysql client does, reading DELIMITER lines, BEGIN ... END bodies of
+// stored programs and PostgreSQL functions, and timeout directives before
+// each statement. Its zero value reads quotes as MySQL does by default, with
+// backslashes escaping the next character in strings, which single and double
+// quotes delimit, while backticks quote identifiers.
+type DefaultSplitter struct {
+	// NoBackslashEscapes reads backslashes in strings as themselves, as
+	// MySQL's NO_BACKSLASH_ESCAPES SQL mode does, so 'C:\' ends at its
+	// second quote.
+	NoBackslashEscapes bool
+
+	// ANSIQuotes reads double quotes as quoting identifiers, as MySQL's
+	// ANSI_QUOTES SQL mode does, in which backslashes are themselves.
+	ANSIQuotes bool
+}
+
+func (s DefaultSplitter) Split(content string) ([]Statement, error) {
+	return splitStatementsQuoting([]byte(content), quoting{
+		noBackslashEscapes: s.NoBackslashEscapes,
+		ansiQuotes:         s.ANSIQuotes,
+	})
+}
+
+// SplitterForSQLMode returns the DefaultSplitter which reads quotes as MySQL
+// does in sqlMode, a comma-separated list of modes as @@sql_mode reports it,
+// reading NO_BACKSLASH_ESCAPES, and ANSI_QUOTES or ANSI, which includes it.
+func SplitterForSQLMode(sqlMode string) DefaultSplitter {
+	var s DefaultSplitter
+	for _, mode := range strings.Split(sqlMode, ",") {
+		switch strings.ToUpper(strings.TrimSpace(mode)) {
+		case "NO_BACKSLASH_ESCAPES":
+			s.NoBackslashEscapes = true
+		case "ANSI_QUOTES", "ANSI":
+			s.ANSIQuotes = true
+		}
+	}
+	return s
+}
+
+// regexGO matches a GO line, which ends a batch in SQL Server's tools.
+var regexGO = regexp.MustCompile(`(?im)^[ \t]*go[ \t]*(--[^\n]*)?$`)
+
+// SplitOnGO splits files into the batches between GO lines, as sqlcmd and
+// SQL Server Management Studio do, running each batch as one statement. A
+// file with no GO lines is split as DefaultSplitter splits it. It's the
+// splitter of the mssql store.
+type SplitOnGO struct{}
+
+func (SplitOnGO) Split(content string) ([]Statement, error) {
+	locs := regexGO.FindAllStringIndex(content, -1)
+	if len(locs) == 0 {
+		return DefaultSplitter{}.Split(content)
+	}
+	stmts := []Statement{}
+	start := 0
+	for _, loc := range append(locs, []int{len(content), len(content)}) {
+		batch := content[start:loc[0]]
+		trimmed := strings.TrimLeft(batch, " \t\n")
+		off := start + len(batch) - len(trimmed)
+		start = loc[1]
+		if !hasSQL(trimmed) {
+			continue
+		}
+		stmts = append(stmts, Statement{
+			SQL:   strings.TrimSpace(trimmed),
+			Line:  lineOf(content, off),
+			Index: len(stmts),
+		})
+	}
+	return stmts, nil
+}
+
+// split splits body, a file's content after its directives, by the Splitter
+// WithSplitter set, the store's, or DefaultSplitter, checking each statement
+// has its place in body as its Index.
+func (m *Migrate) split(body []byte) ([]Statement, error) {
+	s := m.splitter
+	if s == nil {
+		if sp, ok := m.db.(SplitterProvider); ok {
+			s = sp.Splitter()
+		}
+	}
+	if s == nil {
+		s = DefaultSplitter{}
+	}
+	stmts, err := s.Split(string(body))
+	if err != nil {
+		return nil, err
+	}
+	for i, stmt := range stmts {
+		if stmt.Index != i {
+			return nil, fmt.Errorf("statement %d has index %d", i,
+				stmt.Index)
+		}
+	}
+	return stmts, nil
+}
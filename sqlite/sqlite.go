@@ -1,150 +1,123 @@
+// Package sqlite implements a migrate.Store backed by SQLite, which is handy
+// for local development and tests where standing up a database server is
+// overkill. Both on-disk databases and ":memory:" are supported.
+//
+// SQLite accepts a much smaller dialect than MySQL or Postgres, so migrations
+// written against those servers won't always translate. In particular:
+//
+//   - ALTER TABLE only supports ADD COLUMN, RENAME TO and RENAME COLUMN;
+//     MODIFY COLUMN, DROP INDEX and ADD CONSTRAINT must be written as a
+//     create-copy-drop-rename of the table.
+//   - AUTO_INCREMENT is spelled AUTOINCREMENT and only applies to INTEGER
+//     PRIMARY KEY columns.
+//   - Table options such as ENGINE=InnoDB and DEFAULT CHARSET=utf8mb4 are
+//     syntax errors.
+//   - Column types are affinities rather than constraints, so VARCHAR(255)
+//     won't reject longer values and ENUM doesn't exist.
+//   - ON DUPLICATE KEY UPDATE is spelled ON CONFLICT (...) DO UPDATE.
+//   - DELIMITER and stored procedures are unsupported.
+//
+// SQLite allows only a single writer at a time. DB uses one connection for
+// all queries and sets a busy timeout so that other processes holding the
+// database briefly won't cause immediate SQLITE_BUSY failures.
 package sqlite
 
 import (
-	"database/sql"
+	"context"
+	"fmt"
 	"strings"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 	"github.com/thankful-ai/migrate"
+	"github.com/thankful-ai/migrate/sqlstore"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// busyTimeout in milliseconds to wait for locks held by other connections.
+const busyTimeout = 5000
+
 type DB struct {
 	filepath string
 
-	// Embed the sqlx DB struct
-	*sqlx.DB
+	// Embed the generic SQL store
+	*sqlstore.Store
 }
 
+// New prepares a connection to the SQLite database at dbFile, which may be a
+// path, a "file:" URI, or ":memory:" for a private in-memory database.
 func New(dbFile string) *DB {
 	return &DB{filepath: dbFile}
 }
 
-func (db *DB) CreateMetaIfNotExists() error {
-	q := `CREATE TABLE IF NOT EXISTS meta (
-		filename TEXT UNIQUE NOT NULL,
-		md5 TEXT NOT NULL,
-		content TEXT NOT NULL,
-		createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
-	)`
-	if _, err := db.Exec(q); err != nil {
-		return errors.Wrap(err, "create meta table")
+func (db *DB) Open(ctx context.Context) error {
+	sep := "?"
+	if strings.Contains(db.filepath, "?") {
+		sep = "&"
 	}
-	return nil
-}
+	dsn := fmt.Sprintf("%s%s_busy_timeout=%d", db.filepath, sep, busyTimeout)
 
-func (db *DB) CreateMetaCheckpointsIfNotExists() error {
-	q := `CREATE TABLE IF NOT EXISTS metacheckpoints (
-		filename TEXT NOT NULL,
-		content TEXT NOT NULL,
-		idx INTEGER NOT NULL,
-		md5 TEXT NOT NULL,
-		createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-		PRIMARY KEY (filename, idx)
-	)`
-	if _, err := db.Exec(q); err != nil {
-		return errors.Wrap(err, "create metacheckpoints table")
+	var err error
+	db.Store, err = sqlstore.Open("sqlite3", dsn, Dialect{})
+	if err != nil {
+		return err
 	}
-	return nil
-}
-
-func (db *DB) GetMigrations() ([]migrate.Migration, error) {
-	migrations := []migrate.Migration{}
-	q := `SELECT filename, content, md5 AS checksum FROM meta`
-	err := db.Select(&migrations, q)
-	return migrations, err
 
+	// SQLite only allows one writer, and every connection to an in-memory
+	// database sees its own empty database, so use exactly one connection
+	// and never let it expire.
+	db.SetMaxOpenConns(1)
+	db.SetConnMaxLifetime(0)
+	return nil
 }
 
-func (db *DB) GetMetaCheckpoints(filename string) ([]string, error) {
-	checkpoints := []string{}
-	q := `SELECT md5 FROM metacheckpoints WHERE filename=$1 ORDER BY idx`
-	err := db.Select(&checkpoints, q, filename)
-	return checkpoints, err
-}
+// Dialect describes SQLite's SQL to sqlstore.
+type Dialect struct{}
 
-func (db *DB) UpsertMigration(filename, content, checksum string) error {
-	q := `
-		INSERT INTO meta (filename, content, md5) VALUES ($1, $2, $3)
-		ON CONFLICT(filename) DO UPDATE SET md5=$4, content=$5`
-	_, err := db.Exec(q, filename, content, checksum, checksum, content)
-	return err
-}
+func (Dialect) BindType() int { return sqlx.DOLLAR }
 
-func (db *DB) InsertMetaCheckpoint(
-	filename, content, checksum string,
-	idx int,
-) error {
-	q := `
-		INSERT INTO metacheckpoints (filename, content, idx, md5)
-		VALUES ($1, $2, $3, $4)`
-	_, err := db.Exec(q, filename, content, idx, checksum)
-	return err
+func (Dialect) Types() sqlstore.Types {
+	return sqlstore.Types{
+		String:    "TEXT",
+		Text:      "TEXT",
+		Integer:   "INTEGER",
+		Timestamp: "TIMESTAMP",
+		Now:       "CURRENT_TIMESTAMP",
+	}
 }
 
-func (db *DB) InsertMigration(filename, content, checksum string) error {
-	q := `INSERT INTO meta (filename, content, md5) VALUES ($1, $2, $3)`
-	_, err := db.Exec(q, filename, content, checksum)
-	return err
+func (Dialect) CreateTableIfNotExists(table string, defs []string) string {
+	return sqlstore.CreateTableIfNotExists(table, defs)
 }
 
-func (db *DB) DeleteMetaCheckpoints() error {
-	q := `DELETE FROM metacheckpoints`
-	_, err := db.Exec(q)
-	return err
+func (Dialect) IsTableExists(err error) bool {
+	return strings.Contains(err.Error(), "already exists")
 }
 
-func (db *DB) CreateMetaVersionIfNotExists(schemaVersion int) (int, error) {
-	created := true
-	q := `CREATE TABLE metaversion (
-		version INTEGER NOT NULL
-	)`
-	if _, err := db.Exec(q); err != nil {
-		// Check if the table already existed
-		if !strings.Contains(err.Error(), "already exists") {
-			return 0, errors.Wrap(err, "create metaversion table")
-		}
-		created = false
-	}
-
-	var version int
-	q = `SELECT version FROM metaversion`
-	err := db.Get(&version, q)
-	switch {
-	case err == sql.ErrNoRows:
-		if !created {
-			schemaVersion = 0
-		}
-		q = `INSERT INTO metaversion (version) VALUES ($1)`
-		if _, err := db.Exec(q, schemaVersion); err != nil {
-			return 0, errors.Wrap(err, "insert version")
-		}
-		return schemaVersion, nil
-	case err != nil:
-		return 0, errors.Wrap(err, "get version")
-	}
-	return version, nil
+func (Dialect) IsTableMissing(err error) bool {
+	return strings.Contains(err.Error(), "no such table")
 }
 
-func (db *DB) Close() error { return db.DB.Close() }
-
-func (db *DB) Open() error {
-	var err error
-	db.DB, err = sqlx.Open("sqlite3", db.filepath)
-	if err != nil {
-		return errors.Wrap(err, "open db connection")
-	}
-	return nil
+func (Dialect) UpsertMigration(table string, cols []string) string {
+	return fmt.Sprintf(`
+		INSERT INTO %s (%s) VALUES (%s)
+		ON CONFLICT(filename)
+		DO UPDATE SET %s`, table, strings.Join(cols, ", "),
+		sqlstore.Placeholders(len(cols)),
+		sqlstore.JoinColumns(cols[1:], "%[1]s=excluded.%[1]s"))
 }
 
 // UpgradeToV1 migrates existing meta tables to the v1 format. Complete any
 // migrations before running this function; this will not succeed if have any
 // existing metacheckpoints.
-func (db *DB) UpgradeToV1(migrations []migrate.Migration) (err error) {
+func (Dialect) UpgradeToV1(
+	ctx context.Context,
+	db *sqlx.DB,
+	migrations []migrate.Migration,
+) (err error) {
 	// Begin Tx
-	tx, err := db.Beginx()
+	tx, err := db.BeginTxx(ctx, nil)
 	if err != nil {
 		return errors.Wrap(err, "begin tx")
 	}
@@ -163,20 +136,20 @@ func (db *DB) UpgradeToV1(migrations []migrate.Migration) (err error) {
 		md5 TEXT NOT NULL,
 		createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 	)`
-	if _, err = tx.Exec(q); err != nil {
+	if _, err = tx.ExecContext(ctx, q); err != nil {
 		err = errors.Wrap(err, "create metatmp")
 		return
 	}
 	q = `INSERT INTO metatmp SELECT filename, md5, createdat FROM meta`
-	if _, err = tx.Exec(q); err != nil {
+	if _, err = tx.ExecContext(ctx, q); err != nil {
 		err = errors.Wrap(err, "insert metatmp")
 	}
 	q = `DROP TABLE meta`
-	if _, err = tx.Exec(q); err != nil {
+	if _, err = tx.ExecContext(ctx, q); err != nil {
 		err = errors.Wrap(err, "drop meta")
 	}
 	q = `ALTER TABLE metatmp RENAME TO meta`
-	if _, err = tx.Exec(q); err != nil {
+	if _, err = tx.ExecContext(ctx, q); err != nil {
 		err = errors.Wrap(err, "rename metatmp 1")
 		return
 	}
@@ -184,13 +157,14 @@ func (db *DB) UpgradeToV1(migrations []migrate.Migration) (err error) {
 	// Add a content column to record the exact migration that ran
 	// alongside the md5, insert the appropriate data, then set not null
 	q = `ALTER TABLE meta ADD COLUMN content TEXT`
-	if _, err = tx.Exec(q); err != nil {
+	if _, err = tx.ExecContext(ctx, q); err != nil {
 		err = errors.Wrap(err, "add content column")
 		return
 	}
 	for _, m := range migrations {
 		q = `UPDATE meta SET content=$1 WHERE filename=$2`
-		if _, err = tx.Exec(q, m.Content, m.Filename); err != nil {
+		_, err = tx.ExecContext(ctx, q, m.Content, m.Filename)
+		if err != nil {
 			err = errors.Wrap(err, "update meta content")
 			return
 		}
@@ -204,23 +178,23 @@ func (db *DB) UpgradeToV1(migrations []migrate.Migration) (err error) {
 		md5 TEXT NOT NULL,
 		createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 	)`
-	if _, err = tx.Exec(q); err != nil {
+	if _, err = tx.ExecContext(ctx, q); err != nil {
 		err = errors.Wrap(err, "create metatmp")
 		return
 	}
 	q = `
 		INSERT INTO metatmp
 		SELECT filename, content, md5, createdat FROM meta`
-	if _, err = tx.Exec(q); err != nil {
+	if _, err = tx.ExecContext(ctx, q); err != nil {
 		err = errors.Wrap(err, "")
 	}
 	q = `DROP TABLE meta`
-	if _, err = tx.Exec(q); err != nil {
+	if _, err = tx.ExecContext(ctx, q); err != nil {
 		err = errors.Wrap(err, "drop meta")
 		return
 	}
 	q = `ALTER TABLE metatmp RENAME TO meta`
-	if _, err = tx.Exec(q); err != nil {
+	if _, err = tx.ExecContext(ctx, q); err != nil {
 		err = errors.Wrap(err, "rename metatmp 2")
 		return
 	}
@@ -234,41 +208,31 @@ func (db *DB) UpgradeToV1(migrations []migrate.Migration) (err error) {
 		createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
 		PRIMARY KEY (filename, idx)
 	)`
-	if _, err = tx.Exec(q); err != nil {
+	if _, err = tx.ExecContext(ctx, q); err != nil {
 		err = errors.Wrap(err, "create metacheckpointstmp")
 		return
 	}
 	q = `
 		INSERT INTO metacheckpointstmp
 		SELECT filename, md5, createdat FROM meta`
-	if _, err = tx.Exec(q); err != nil {
+	if _, err = tx.ExecContext(ctx, q); err != nil {
 		err = errors.Wrap(err, "insert metacheckpointstmp")
 	}
 	q = `DROP TABLE metacheckpoints`
-	if _, err = tx.Exec(q); err != nil {
+	if _, err = tx.ExecContext(ctx, q); err != nil {
 		err = errors.Wrap(err, "drop metacheckpoints")
 		return
 	}
 	q = `ALTER TABLE metacheckpointstmp RENAME TO metacheckpoints`
-	if _, err = tx.Exec(q); err != nil {
+	if _, err = tx.ExecContext(ctx, q); err != nil {
 		err = errors.Wrap(err, "rename metacheckpointstmp")
 		return
 	}
 
 	q = `CREATE TABLE IF NOT EXISTS metaversion (version INTEGER NOT NULL)`
-	if _, err = tx.Exec(q); err != nil {
+	if _, err = tx.ExecContext(ctx, q); err != nil {
 		err = errors.Wrap(err, "create metaversion table")
 		return
 	}
-	q = `DELETE FROM metaversion`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "delete metaversion")
-		return
-	}
-	q = `INSERT INTO metaversion (version) VALUES (1)`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "update metaversion")
-		return
-	}
-	return nil
+	return sqlstore.SetVersion(ctx, tx, "metaversion", 0, 1)
 }
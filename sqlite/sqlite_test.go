@@ -1,20 +1,32 @@
 package sqlite
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/thankful-ai/migrate"
+	"github.com/thankful-ai/migrate/sqlstore"
+	"github.com/thankful-ai/migrate/sqlstore/storetest"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+var ctx = context.Background()
+
 const checkpointFile = "2.sql"
 
 func TestCreateMetaIfNotExists(t *testing.T) {
 	t.Parallel()
 	db := newDB()
 
-	err := db.CreateMetaIfNotExists()
+	err := db.CreateMetaIfNotExists(ctx)
 	check(t, err)
 
 	var tmp []int
@@ -25,7 +37,7 @@ func TestCreateMetaIfNotExists(t *testing.T) {
 func TestCreateMetaCheckpointsIfNotExists(t *testing.T) {
 	t.Parallel()
 	db := newDB()
-	err := db.CreateMetaCheckpointsIfNotExists()
+	err := db.CreateMetaCheckpointsIfNotExists(ctx)
 	check(t, err)
 
 	var tmp []int
@@ -36,7 +48,7 @@ func TestCreateMetaCheckpointsIfNotExists(t *testing.T) {
 func TestGetMigrations(t *testing.T) {
 	t.Parallel()
 	db := setupDBV1(t)
-	ms, err := db.GetMigrations()
+	ms, err := db.GetMigrations(ctx)
 	check(t, err)
 	if len(ms) != 1 {
 		t.Fatal("expected 1 migration")
@@ -46,7 +58,7 @@ func TestGetMigrations(t *testing.T) {
 func TestGetMetaCheckpoints(t *testing.T) {
 	t.Parallel()
 	db := setupDBV1(t)
-	mcs, err := db.GetMetaCheckpoints(checkpointFile)
+	mcs, err := db.GetMetaCheckpoints(ctx, checkpointFile)
 	check(t, err)
 	if len(mcs) != 1 {
 		t.Fatal("expected 1 checkpoint")
@@ -58,14 +70,22 @@ func TestUpsertMigration(t *testing.T) {
 	db := setupDBV1(t)
 
 	// Test update
-	err := db.UpsertMigration("1.sql", "SELECT 1;", "md5")
+	err := db.UpsertMigration(ctx, migrate.Migration{
+		Filename: "1.sql",
+		Content:  "SELECT 1;",
+		Checksum: "md5",
+	})
 	check(t, err)
 
 	// Test insert
-	err = db.UpsertMigration("3.sql", "SELECT 3;", "md5")
+	err = db.UpsertMigration(ctx, migrate.Migration{
+		Filename: "3.sql",
+		Content:  "SELECT 3;",
+		Checksum: "md5",
+	})
 	check(t, err)
 
-	ms, err := db.GetMigrations()
+	ms, err := db.GetMigrations(ctx)
 	check(t, err)
 	if len(ms) != 2 {
 		t.Fatal("expected 2 migrations")
@@ -76,10 +96,10 @@ func TestInsertMetaCheckpoint(t *testing.T) {
 	t.Parallel()
 	db := setupDBV1(t)
 
-	err := db.InsertMetaCheckpoint(checkpointFile, "SELECT 3;", "md5", 1)
+	err := db.InsertMetaCheckpoint(ctx, checkpointFile, "SELECT 3;", "md5", 1)
 	check(t, err)
 
-	mcs, err := db.GetMetaCheckpoints(checkpointFile)
+	mcs, err := db.GetMetaCheckpoints(ctx, checkpointFile)
 	check(t, err)
 	if len(mcs) != 2 {
 		t.Fatal("expected 2 checkpoints")
@@ -90,10 +110,14 @@ func TestInsertMigration(t *testing.T) {
 	t.Parallel()
 	db := setupDBV1(t)
 
-	err := db.InsertMigration("3.sql", "SELECT 3;", "md5")
+	err := db.InsertMigration(ctx, migrate.Migration{
+		Filename: "3.sql",
+		Content:  "SELECT 3;",
+		Checksum: "md5",
+	})
 	check(t, err)
 
-	ms, err := db.GetMigrations()
+	ms, err := db.GetMigrations(ctx)
 	check(t, err)
 	if len(ms) != 2 {
 		t.Fatal("expected 2 migrations")
@@ -104,16 +128,729 @@ func TestDeleteMetaCheckpoints(t *testing.T) {
 	t.Parallel()
 	db := setupDBV1(t)
 
-	err := db.DeleteMetaCheckpoints()
+	err := db.DeleteMetaCheckpoints(ctx)
 	check(t, err)
 
-	mcs, err := db.GetMetaCheckpoints(checkpointFile)
+	mcs, err := db.GetMetaCheckpoints(ctx, checkpointFile)
 	check(t, err)
 	if len(mcs) != 0 {
 		t.Fatal("expected 0 checkpoints")
 	}
 }
 
+func TestMigrateMemory(t *testing.T) {
+	t.Parallel()
+	db := New(":memory:")
+	check(t, db.Open(ctx))
+	defer db.Close()
+
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", `
+		CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT NOT NULL);
+		INSERT INTO users (name) VALUES ('a');`)
+
+	m, err := migrate.New(ctx, db, testLogger{t}, migrate.DBTypeSQLite, dir, "")
+	check(t, err)
+	migrated, err := m.Migrate(ctx)
+	check(t, err)
+	if !migrated {
+		t.Fatal("expected migration")
+	}
+
+	// The migration is recorded and won't run a second time
+	m, err = migrate.New(ctx, db, testLogger{t}, migrate.DBTypeSQLite, dir, "")
+	check(t, err)
+	migrated, err = m.Migrate(ctx)
+	check(t, err)
+	if migrated {
+		t.Fatal("expected no migration")
+	}
+	assertCount(t, db, "users", 1)
+}
+
+func TestMigrateResumeFromCheckpoint(t *testing.T) {
+	t.Parallel()
+	db := New(":memory:")
+	check(t, db.Open(ctx))
+	defer db.Close()
+
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", `
+		CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT NOT NULL);`)
+	writeFile(t, dir, "2.sql", `
+		INSERT INTO users (name) VALUES ('a');
+		INSERT INTO missing (name) VALUES ('b');`)
+
+	m, err := migrate.New(ctx, db, testLogger{t}, migrate.DBTypeSQLite, dir, "")
+	check(t, err)
+	if _, err = m.Migrate(ctx); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// The first statement of 2.sql was checkpointed, and the file was
+	// recorded as failed
+	mcs, err := db.GetMetaCheckpoints(ctx, "2.sql")
+	check(t, err)
+	if len(mcs) != 1 {
+		t.Fatalf("expected 1 checkpoint, got %d", len(mcs))
+	}
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 2 || ms[1].Status != migrate.StatusFailed {
+		t.Fatalf("expected 2.sql to be failed, got %+v", ms)
+	}
+
+	// Fix the failing statement and resume. The checkpointed insert must not
+	// run again.
+	writeFile(t, dir, "2.sql", `
+		INSERT INTO users (name) VALUES ('a');
+		INSERT INTO users (name) VALUES ('b');`)
+	m, err = migrate.New(ctx, db, testLogger{t}, migrate.DBTypeSQLite, dir, "",
+		migrate.WithResume())
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	assertCount(t, db, "users", 2)
+
+	mcs, err = db.GetMetaCheckpoints(ctx, "2.sql")
+	check(t, err)
+	if len(mcs) != 0 {
+		t.Fatalf("expected 0 checkpoints, got %d", len(mcs))
+	}
+	ms, err = db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(ms))
+	}
+}
+
+func TestMigrateChangedCheckpoint(t *testing.T) {
+	t.Parallel()
+	db := New(":memory:")
+	check(t, db.Open(ctx))
+	defer db.Close()
+
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", `
+		CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT NOT NULL);
+		INSERT INTO missing (name) VALUES ('b');`)
+	m, err := migrate.New(ctx, db, testLogger{t}, migrate.DBTypeSQLite, dir, "")
+	check(t, err)
+	if _, err = m.Migrate(ctx); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// Editing an already-checkpointed statement is detected on resume
+	writeFile(t, dir, "1.sql", `
+		CREATE TABLE accounts (id INTEGER PRIMARY KEY);
+		INSERT INTO accounts (id) VALUES (1);`)
+	m, err = migrate.New(ctx, db, testLogger{t}, migrate.DBTypeSQLite, dir, "",
+		migrate.WithResume())
+	check(t, err)
+	if _, err = m.Migrate(ctx); err == nil {
+		t.Fatal("expected checkpoint error")
+	}
+}
+
+func TestMigrateCancel(t *testing.T) {
+	t.Parallel()
+	db := New(":memory:")
+	check(t, db.Open(ctx))
+	defer db.Close()
+
+	// The recursive query never ends, so it runs until cancelled
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", `
+		CREATE TABLE users (id INTEGER PRIMARY KEY);
+		WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c)
+		SELECT COUNT(*) FROM c;`)
+	m, err := migrate.New(ctx, db, testLogger{t}, migrate.DBTypeSQLite, dir,
+		"")
+	check(t, err)
+	cancelCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err = m.Migrate(cancelCtx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	mcs, err := db.GetMetaCheckpoints(ctx, "1.sql")
+	check(t, err)
+	if len(mcs) != 1 {
+		t.Fatalf("expected 1 checkpoint, got %d", len(mcs))
+	}
+
+	// Resume with the slow statement fixed. The table isn't created twice.
+	writeFile(t, dir, "1.sql", `
+		CREATE TABLE users (id INTEGER PRIMARY KEY);
+		INSERT INTO users (id) VALUES (1);`)
+	m, err = migrate.New(ctx, db, testLogger{t}, migrate.DBTypeSQLite, dir,
+		"")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	assertCount(t, db, "users", 1)
+}
+
+func TestMigrateMultiStatement(t *testing.T) {
+	t.Parallel()
+	db := New(":memory:")
+	check(t, db.Open(ctx))
+	defer db.Close()
+
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", `-- migrate:multi
+		CREATE TABLE IF NOT EXISTS users (id INTEGER PRIMARY KEY);
+		INSERT INTO missing (id) VALUES (1);`)
+	m, err := migrate.New(ctx, db, testLogger{t}, migrate.DBTypeSQLite, dir, "")
+	check(t, err)
+	if _, err = m.Migrate(ctx); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// A multi-statement file is all-or-nothing, so no checkpoints are
+	// saved and the whole file runs again on resume
+	mcs, err := db.GetMetaCheckpoints(ctx, "1.sql")
+	check(t, err)
+	if len(mcs) != 0 {
+		t.Fatalf("expected 0 checkpoints, got %d", len(mcs))
+	}
+
+	const content = `-- migrate:multi
+		CREATE TABLE IF NOT EXISTS users (id INTEGER PRIMARY KEY);
+		INSERT INTO users (id) VALUES (1);`
+	writeFile(t, dir, "1.sql", content)
+	m, err = migrate.New(ctx, db, testLogger{t}, migrate.DBTypeSQLite, dir, "",
+		migrate.WithResume())
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	assertCount(t, db, "users", 1)
+
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 1 || ms[0].Content != content {
+		t.Fatalf("expected full content to be recorded, got %+v", ms)
+	}
+}
+
+func TestMigrateGo(t *testing.T) {
+	t.Parallel()
+	db := New(":memory:")
+	check(t, db.Open(ctx))
+	defer db.Close()
+	var _ migrate.TxBeginner = db
+
+	fsys := migrate.MemorySource(map[string]string{
+		"1_users.sql": `CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT NOT NULL);`,
+		"10_seed.sql": `INSERT INTO users (name) VALUES ('c');`,
+	})
+	var calls int
+	backfill := func(fail bool) migrate.GoMigrationFunc {
+		return func(ctx context.Context, tx *sql.Tx) error {
+			calls++
+			_, err := tx.ExecContext(ctx,
+				`INSERT INTO users (name) VALUES ('a'), ('b')`)
+			if err != nil || fail {
+				return errors.Join(err, errors.New("backfill failed"))
+			}
+			return nil
+		}
+	}
+
+	// The Go migration runs between the files by its number, and its
+	// inserts are rolled back when it fails
+	m, err := migrate.NewFS(ctx, db, testLogger{t}, migrate.DBTypeSQLite,
+		fsys, "", migrate.WithGoMigration("0002_backfill", "v1",
+			backfill(true)))
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	if err == nil || !strings.Contains(err.Error(), "backfill failed") {
+		t.Fatalf("expected the go migration to fail, got %v", err)
+	}
+	assertCount(t, db, "users", 0)
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 2 || ms[1].Filename != "0002_backfill" ||
+		ms[1].Status != migrate.StatusFailed {
+		t.Fatalf("expected 0002_backfill to be failed, got %+v", ms)
+	}
+
+	// Resuming runs it again whole, then the files after it
+	m, err = migrate.NewFS(ctx, db, testLogger{t}, migrate.DBTypeSQLite,
+		fsys, "", migrate.WithResume(), migrate.WithGoMigration(
+			"0002_backfill", "v1", backfill(false)))
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	assertCount(t, db, "users", 3)
+	if calls != 2 {
+		t.Fatalf("expected 2 calls, got %d", calls)
+	}
+	ms, err = db.GetMigrations(ctx)
+	check(t, err)
+	var names []string
+	for _, mg := range ms {
+		names = append(names, mg.Filename)
+	}
+	if strings.Join(names, ",") != "1_users.sql,0002_backfill,10_seed.sql" ||
+		ms[1].Content != "v1" || ms[1].Status != migrate.StatusApplied {
+		t.Fatalf("unexpected migrations %+v", ms)
+	}
+
+	// It's applied, so doesn't run again, until its version changes
+	m, err = migrate.NewFS(ctx, db, testLogger{t}, migrate.DBTypeSQLite,
+		fsys, "", migrate.WithGoMigration("0002_backfill", "v1",
+			backfill(false)))
+	check(t, err)
+	migrated, err := m.Migrate(ctx)
+	check(t, err)
+	if migrated || calls != 2 {
+		t.Fatalf("expected no migration, got %d calls", calls)
+	}
+	_, err = migrate.NewFS(ctx, db, testLogger{t}, migrate.DBTypeSQLite,
+		fsys, "", migrate.WithGoMigration("0002_backfill", "v2",
+			backfill(false)))
+	var mismatch *migrate.ErrChecksumMismatch
+	if !errors.As(err, &mismatch) || mismatch.Filename != "0002_backfill" {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+	report, err := migrate.StatusFS(ctx, db, migrate.DBTypeSQLite, fsys,
+		migrate.WithGoMigration("0002_backfill", "v2", backfill(false)))
+	check(t, err)
+	if len(report.Mismatched) != 1 || report.Mismatched[0] != "0002_backfill" {
+		t.Fatalf("expected 0002_backfill mismatched, got %+v", report)
+	}
+}
+
+func TestMigrateDown(t *testing.T) {
+	t.Parallel()
+	db := New(":memory:")
+	check(t, db.Open(ctx))
+	defer db.Close()
+
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", `
+		CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT NOT NULL);`)
+	writeFile(t, dir, "1.down.sql", `DROP TABLE users;`)
+	writeFile(t, dir, "2.sql", `
+		CREATE TABLE posts (id INTEGER PRIMARY KEY);`)
+	writeFile(t, dir, "2.down.sql", `DROP TABLE posts;`)
+	writeFile(t, dir, "3.sql", `
+		INSERT INTO users (name) VALUES ('a');
+		INSERT INTO users (name) VALUES ('b');`)
+	writeFile(t, dir, "3.down.sql", `
+		DELETE FROM users WHERE name = 'b';
+		DELETE FROM users WHERE name = 'a';`)
+
+	migrateDir := func() {
+		m, err := migrate.New(ctx, db, testLogger{t}, migrate.DBTypeSQLite,
+			dir, "")
+		check(t, err)
+		_, err = m.Migrate(ctx)
+		check(t, err)
+	}
+	migrateDir()
+	assertCount(t, db, "users", 2)
+
+	n, err := migrate.Down(ctx, db, testLogger{t}, migrate.DBTypeSQLite, dir, 2)
+	check(t, err)
+	if n != 2 {
+		t.Fatalf("expected 2 rolled back, got %d", n)
+	}
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 1 || ms[0].Filename != "1.sql" {
+		t.Fatalf("expected only 1.sql applied, got %+v", ms)
+	}
+	assertCount(t, db, "users", 0)
+	if _, err = db.Exec(ctx, `SELECT 1 FROM posts`); err == nil {
+		t.Fatal("expected posts dropped")
+	}
+
+	// The migrations rolled back are applied again
+	migrateDir()
+	ms, err = db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 3 {
+		t.Fatalf("expected 3 migrations, got %d", len(ms))
+	}
+	assertCount(t, db, "users", 2)
+	assertCount(t, db, "posts", 0)
+}
+
+func TestMigrateDownFromStore(t *testing.T) {
+	t.Parallel()
+	db := New(":memory:")
+	check(t, db.Open(ctx))
+	defer db.Close()
+
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", `
+		CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT NOT NULL);`)
+	writeFile(t, dir, "1.down.sql", `DROP TABLE users;`)
+	writeFile(t, dir, "2.sql", `INSERT INTO users (name) VALUES ('a');`)
+	writeFile(t, dir, "2.down.sql", `DELETE FROM users;`)
+	m, err := migrate.New(ctx, db, testLogger{t}, migrate.DBTypeSQLite, dir, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+
+	// The directory is gone, so only the down migrations recorded can run
+	check(t, os.RemoveAll(dir))
+	n, err := migrate.DownFromStore(ctx, db, testLogger{t}, 1)
+	check(t, err)
+	if n != 1 {
+		t.Fatalf("expected 1 rolled back, got %d", n)
+	}
+	assertCount(t, db, "users", 0)
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 1 || ms[0].Filename != "1.sql" {
+		t.Fatalf("expected only 1.sql applied, got %+v", ms)
+	}
+}
+
+func TestMigrateRedo(t *testing.T) {
+	t.Parallel()
+	db := New(":memory:")
+	check(t, db.Open(ctx))
+	defer db.Close()
+
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", `
+		CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT NOT NULL);`)
+	writeFile(t, dir, "2.sql", `CREATE TABLE posts (id INTEGER PRIMARY KEY);`)
+	writeFile(t, dir, "2.down.sql", `DROP TABLE posts;`)
+	m, err := migrate.New(ctx, db, testLogger{t}, migrate.DBTypeSQLite, dir, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+
+	// Each edit of the latest migration is redone in place of the last
+	edits := []struct{ content, insert string }{{
+		content: `CREATE TABLE posts (id INTEGER PRIMARY KEY, title TEXT);`,
+		insert:  `INSERT INTO posts (title) VALUES ('a')`,
+	}, {
+		content: `CREATE TABLE posts (id INTEGER PRIMARY KEY, title TEXT, body TEXT);`,
+		insert:  `INSERT INTO posts (title, body) VALUES ('a', 'b')`,
+	}}
+	for _, edit := range edits {
+		writeFile(t, dir, "2.sql", edit.content)
+		check(t, migrate.Redo(ctx, db, testLogger{t}, migrate.DBTypeSQLite,
+			dir))
+		_, err = db.Exec(ctx, edit.insert)
+		check(t, err)
+		mg, err := db.GetMigrationWithDown(ctx, "2.sql")
+		check(t, err)
+		if mg.Content != edit.content {
+			t.Fatalf("expected the edited content recorded, got %q",
+				mg.Content)
+		}
+	}
+	assertCount(t, db, "posts", 1)
+}
+
+func TestVerifyReversible(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", `
+		CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT NOT NULL);`)
+	writeFile(t, dir, "2.sql", `CREATE TABLE posts (id INTEGER PRIMARY KEY);`)
+	writeFile(t, dir, "2.down.sql", `DROP TABLE posts;`)
+	writeFile(t, dir, "3.sql", `CREATE INDEX users_name ON users (name);`)
+	writeFile(t, dir, "3.down.sql", `-- forgot to drop the index
+		SELECT 1;`)
+	verify := func() (*migrate.ReversibleReport, error) {
+		db := New(":memory:")
+		check(t, db.Open(ctx))
+		t.Cleanup(func() { db.Close() })
+
+		// 1.sql is applied already, so isn't verified
+		_, err := db.Exec(ctx, `
+			CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT NOT NULL);`)
+		check(t, err)
+		_, err = migrate.New(ctx, db, testLogger{t}, migrate.DBTypeSQLite,
+			dir, "1.sql")
+		check(t, err)
+		return migrate.VerifyReversible(ctx, db, testLogger{t},
+			migrate.DBTypeSQLite, dir)
+	}
+
+	// The index left behind fails 3.sql when it's applied again
+	report, err := verify()
+	var irreversible *migrate.ErrNotReversible
+	if !errors.As(err, &irreversible) || irreversible.Filename != "3.sql" {
+		t.Fatalf("expected 3.sql irreversible, got %v", err)
+	}
+	if len(report.Files) != 2 || report.Files[1].Up == 0 ||
+		report.Files[1].Down == 0 {
+		t.Fatalf("expected 3.sql applied and rolled back, got %+v",
+			report.Files)
+	}
+
+	writeFile(t, dir, "3.down.sql", `DROP INDEX users_name;`)
+	report, err = verify()
+	check(t, err)
+	for _, f := range report.Files {
+		if f.Up == 0 || f.Down == 0 || f.UpAgain == 0 {
+			t.Fatalf("expected every step timed, got %+v", report.Files)
+		}
+	}
+}
+
+func TestUpgradeToV2(t *testing.T) {
+	t.Parallel()
+	db := setupDBV1(t)
+
+	// Rerunning the upgrade skips the columns it has already added
+	check(t, db.UpgradeToV2(ctx))
+	check(t, db.UpgradeToV2(ctx))
+
+	check(t, db.InsertMigration(ctx, migrate.Migration{
+		Filename:    "2.sql",
+		Content:     "SELECT 2;",
+		Checksum:    "md5",
+		Duration:    time.Second,
+		AppliedBy:   "deploy@ci",
+		ToolVersion: migrate.ToolVersion,
+	}))
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(ms))
+	}
+	if ms[0].AppliedBy != "" || ms[0].Duration != 0 {
+		t.Fatalf("expected no metadata before v2, got %+v", ms[0])
+	}
+	if ms[1].AppliedBy != "deploy@ci" || ms[1].Duration != time.Second {
+		t.Fatalf("expected metadata to be recorded, got %+v", ms[1])
+	}
+}
+
+func TestUpgradeToV3(t *testing.T) {
+	t.Parallel()
+	db := setupDBV1(t)
+	check(t, db.UpgradeToV2(ctx))
+	check(t, db.UpgradeToV3(ctx))
+
+	// Rerunning the upgrade finds md5 already renamed
+	check(t, db.UpgradeToV3(ctx))
+
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 1 || ms[0].Checksum != "md5" ||
+		ms[0].ChecksumAlgo != migrate.ChecksumMD5 ||
+		ms[0].Status != migrate.StatusApplied {
+		t.Fatalf("expected the existing row to be backfilled, got %+v", ms)
+	}
+	check(t, db.UpsertMigration(ctx, migrate.Migration{
+		Filename: "2.sql",
+		Content:  "SELECT 2;",
+		Checksum: "md5",
+		Status:   migrate.StatusSkipped,
+	}))
+	var status string
+	err = db.DB.Get(&status, `SELECT status FROM meta WHERE filename = '2.sql'`)
+	check(t, err)
+	if status != migrate.StatusSkipped {
+		t.Fatalf("expected skipped, got %s", status)
+	}
+}
+
+func TestUpgradeToV4(t *testing.T) {
+	t.Parallel()
+	db := setupDBV1(t)
+	check(t, db.UpgradeToV2(ctx))
+	check(t, db.UpgradeToV3(ctx))
+	check(t, db.UpgradeToV4(ctx))
+
+	// Rerunning the upgrade finds down_content already added
+	check(t, db.UpgradeToV4(ctx))
+
+	got, err := db.GetMigrationWithDown(ctx, "1.sql")
+	check(t, err)
+	if got.DownContent != "" {
+		t.Fatalf("expected no down content, got %q", got.DownContent)
+	}
+	check(t, db.UpsertMigration(ctx, migrate.Migration{
+		Filename:    "1.sql",
+		Content:     "SELECT 1;",
+		Checksum:    "md5",
+		DownContent: "SELECT 0;",
+	}))
+	got, err = db.GetMigrationWithDown(ctx, "1.sql")
+	check(t, err)
+	if got.DownContent != "SELECT 0;" {
+		t.Fatalf("expected the down content, got %q", got.DownContent)
+	}
+}
+
+func TestUpgradeToV5(t *testing.T) {
+	t.Parallel()
+	db := setupDBV1(t)
+	check(t, db.UpgradeToV2(ctx))
+	check(t, db.UpgradeToV3(ctx))
+	check(t, db.UpgradeToV4(ctx))
+	check(t, db.UpgradeToV5(ctx))
+
+	// Rerunning the upgrade finds error_text already added
+	check(t, db.UpgradeToV5(ctx))
+
+	check(t, db.UpsertMigration(ctx, migrate.Migration{
+		Filename: "1.sql",
+		Content:  "SELECT 1;",
+		Checksum: "md5",
+		Status:   migrate.StatusFailed,
+		Error:    "syntax error",
+	}))
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 1 || ms[0].Status != migrate.StatusFailed ||
+		ms[0].Error != "syntax error" {
+		t.Fatalf("expected the failure to be recorded, got %+v", ms)
+	}
+}
+
+func TestUpgradeToV6(t *testing.T) {
+	t.Parallel()
+	db := setupDBV1(t)
+	check(t, db.UpgradeToV2(ctx))
+	check(t, db.UpgradeToV3(ctx))
+	check(t, db.UpgradeToV4(ctx))
+	check(t, db.UpgradeToV5(ctx))
+	check(t, db.UpgradeToV6(ctx))
+
+	// Rerunning the upgrade finds app_version already added
+	check(t, db.UpgradeToV6(ctx))
+
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 1 || ms[0].AppVersion != "" {
+		t.Fatalf("expected no app version on the existing row, got %+v", ms)
+	}
+	check(t, db.UpsertMigration(ctx, migrate.Migration{
+		Filename:   "1.sql",
+		Content:    "SELECT 1;",
+		Checksum:   "md5",
+		AppVersion: "v1.42.0",
+	}))
+	ms, err = db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 1 || ms[0].AppVersion != "v1.42.0" {
+		t.Fatalf("expected the app version to be recorded, got %+v", ms)
+	}
+}
+
+func TestExportImportMeta(t *testing.T) {
+	t.Parallel()
+	src := New(":memory:")
+	check(t, src.Open(ctx))
+	defer src.Close()
+
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", `
+		CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT NOT NULL);`)
+	writeFile(t, dir, "2.sql", `
+		INSERT INTO users (name) VALUES ('a');
+		INSERT INTO missing (name) VALUES ('b');`)
+	m, err := migrate.New(ctx, src, testLogger{t}, migrate.DBTypeSQLite, dir, "")
+	check(t, err)
+	if _, err = m.Migrate(ctx); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// The snapshot survives a trip through JSON
+	snap, err := migrate.ExportMeta(ctx, src)
+	check(t, err)
+	byt, err := json.Marshal(snap)
+	check(t, err)
+	var got migrate.MetaSnapshot
+	check(t, json.Unmarshal(byt, &got))
+
+	// Seed a fresh database already holding the schema
+	dst := New(":memory:")
+	check(t, dst.Open(ctx))
+	defer dst.Close()
+	_, err = dst.DB.Exec(`
+		CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT NOT NULL);
+		INSERT INTO users (name) VALUES ('a');`)
+	check(t, err)
+	check(t, migrate.ImportMeta(ctx, dst, &got, false))
+
+	mcs, err := dst.GetMetaCheckpoints(ctx, "2.sql")
+	check(t, err)
+	if len(mcs) != 1 {
+		t.Fatalf("expected 1 checkpoint, got %d", len(mcs))
+	}
+
+	// 1.sql is applied and 2.sql resumes after its checkpoint
+	writeFile(t, dir, "2.sql", `
+		INSERT INTO users (name) VALUES ('a');
+		INSERT INTO users (name) VALUES ('b');`)
+	m, err = migrate.New(ctx, dst, testLogger{t}, migrate.DBTypeSQLite, dir, "",
+		migrate.WithResume())
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	assertCount(t, dst, "users", 2)
+
+	// A normal run now sees everything as applied
+	m, err = migrate.New(ctx, dst, testLogger{t}, migrate.DBTypeSQLite, dir, "")
+	check(t, err)
+	migrated, err := m.Migrate(ctx)
+	check(t, err)
+	if migrated {
+		t.Fatal("expected no migration")
+	}
+}
+
+func TestImportMetaDiverged(t *testing.T) {
+	t.Parallel()
+	db := New(":memory:")
+	check(t, db.Open(ctx))
+	defer db.Close()
+
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", `SELECT 1;`)
+	m, err := migrate.New(ctx, db, testLogger{t}, migrate.DBTypeSQLite, dir, "")
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+
+	snap := &migrate.MetaSnapshot{
+		Migrations: []migrate.SnapshotMigration{{
+			Migration: migrate.Migration{
+				Filename: "1.sql",
+				Checksum: "other",
+				Content:  "SELECT 2;",
+				Status:   migrate.StatusApplied,
+			},
+		}},
+	}
+	err = migrate.ImportMeta(ctx, db, snap, false)
+	var diverged *migrate.ErrHistoryDiverged
+	if !errors.As(err, &diverged) || diverged.Filename != "1.sql" {
+		t.Fatalf("expected history diverged error, got %v", err)
+	}
+
+	// Overwriting replaces the history
+	check(t, migrate.ImportMeta(ctx, db, snap, true))
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 1 || ms[0].Checksum != "other" {
+		t.Fatalf("expected imported migration, got %+v", ms)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	t.Parallel()
+	storetest.Run(t, func(t *testing.T) migrate.Store {
+		db := newDB()
+		db.SetMaxOpenConns(1)
+		return db
+	})
+}
+
 func check(t *testing.T, err error) {
 	t.Helper()
 	if err != nil {
@@ -128,12 +865,12 @@ func newDB() *DB {
 	if err != nil {
 		panic(err)
 	}
-	return &DB{DB: db}
+	return &DB{Store: sqlstore.New(db.DB, Dialect{})}
 }
 
 func setupDBV1(t *testing.T) *DB {
 	db := setupDBV0(t)
-	err := db.UpgradeToV1([]migrate.Migration{{
+	err := db.UpgradeToV1(ctx, []migrate.Migration{{
 		Filename: "1.sql",
 		Checksum: "md5",
 		Content:  "SELECT 1;",
@@ -176,3 +913,138 @@ func setupDBV0(t *testing.T) *DB {
 
 	return db
 }
+
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Printf(s string, vs ...interface{}) { l.t.Logf(s, vs...) }
+func (l testLogger) Println(vs ...interface{})          { l.t.Log(vs...) }
+
+func writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+	check(t, err)
+}
+
+func assertCount(t *testing.T, db *DB, table string, want int) {
+	t.Helper()
+	var got int
+	err := db.Get(&got, `SELECT COUNT(*) FROM `+table)
+	check(t, err)
+	if got != want {
+		t.Fatalf("expected %d rows in %s, got %d", want, table, got)
+	}
+}
+
+func TestMigrateConcurrently(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "race.db")
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", `CREATE TABLE runs (name TEXT NOT NULL);`)
+	writeFile(t, dir, "2.sql", `INSERT INTO runs (name) VALUES ('2');`)
+	writeFile(t, dir, "3.sql", `INSERT INTO runs (name) VALUES ('3');`)
+
+	// Both runs decide every file is pending before either takes the
+	// lock
+	runs := make([]*migrate.Migrate, 2)
+	for i := range runs {
+		db := New(path)
+		check(t, db.Open(ctx))
+		defer db.Close()
+		m, err := migrate.New(ctx, db, testLogger{t},
+			migrate.DBTypeSQLite, dir, "",
+			migrate.WithLockWait(10*time.Second, 10*time.Millisecond))
+		check(t, err)
+		if len(m.Migrations) != 0 {
+			t.Fatalf("expected nothing applied, got %d", len(m.Migrations))
+		}
+		runs[i] = m
+	}
+
+	start := make(chan struct{})
+	type result struct {
+		migrated bool
+		err      error
+	}
+	results := make(chan result, len(runs))
+	for _, m := range runs {
+		go func(m *migrate.Migrate) {
+			<-start
+			migrated, err := m.Migrate(ctx)
+			results <- result{migrated, err}
+		}(m)
+	}
+	close(start)
+	var migrated int
+	for range runs {
+		r := <-results
+		check(t, r.err)
+		if r.migrated {
+			migrated++
+		}
+	}
+	if migrated != 1 {
+		t.Fatalf("expected exactly one run to migrate, got %d", migrated)
+	}
+
+	db := New(path)
+	check(t, db.Open(ctx))
+	defer db.Close()
+	assertCount(t, db, "runs", 2)
+	assertCount(t, db, "meta", 3)
+}
+
+func TestMigrateTransaction(t *testing.T) {
+	t.Parallel()
+	db := New(":memory:")
+	check(t, db.Open(ctx))
+	defer db.Close()
+
+	dir := t.TempDir()
+	writeFile(t, dir, "1.sql", `-- migrate:transaction
+		CREATE TABLE users (id INTEGER PRIMARY KEY);
+		INSERT INTO users (id) VALUES (1);
+		INSERT INTO missing (id) VALUES (1);`)
+	m, err := migrate.New(ctx, db, testLogger{t}, migrate.DBTypeSQLite, dir, "",
+		migrate.WithVerboseHistory())
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	var failed *migrate.ErrStatementFailed
+	if !errors.As(err, &failed) || failed.Index != 2 {
+		t.Fatalf("expected statement 3 to fail, got %v", err)
+	}
+
+	// The statements before it were rolled back, so there's nothing to
+	// resume from
+	var tables int
+	check(t, db.Get(&tables,
+		`SELECT COUNT(*) FROM sqlite_master WHERE name = 'users'`))
+	if tables != 0 {
+		t.Fatal("expected the users table rolled back")
+	}
+	mcs, err := db.GetMetaCheckpoints(ctx, "1.sql")
+	check(t, err)
+	if len(mcs) != 0 {
+		t.Fatalf("expected no checkpoints, got %v", mcs)
+	}
+
+	// Fixed, it runs again whole
+	writeFile(t, dir, "1.sql", `-- migrate:transaction
+		CREATE TABLE users (id INTEGER PRIMARY KEY);
+		INSERT INTO users (id) VALUES (1);
+		INSERT INTO users (id) VALUES (2);`)
+	writeFile(t, dir, "2.sql", `INSERT INTO users (id) VALUES (3);`)
+	m, err = migrate.New(ctx, db, testLogger{t}, migrate.DBTypeSQLite, dir, "",
+		migrate.WithResume(), migrate.WithTransactions())
+	check(t, err)
+	_, err = m.Migrate(ctx)
+	check(t, err)
+	assertCount(t, db, "users", 3)
+	if m.Results[0].Mode != "transaction" || m.Results[1].Mode != "transaction" {
+		t.Fatalf("expected both files run in transactions, got %+v", m.Results)
+	}
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 2 || ms[0].Status != migrate.StatusApplied {
+		t.Fatalf("expected both files applied, got %+v", ms)
+	}
+}
@@ -0,0 +1,130 @@
+package sqlstore
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thankful-ai/migrate"
+)
+
+// GetMetaSnapshot reads meta's createdat separately from the columns
+// getMigrations reads, since it's only needed here.
+func (s *Store) GetMetaSnapshot(
+	ctx context.Context,
+) (*migrate.MetaSnapshot, error) {
+	ms, err := s.getMigrations(ctx, true, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "get migrations")
+	}
+	migrate.SortMigrations(ms)
+	var created []struct {
+		Filename  string    `db:"filename"`
+		CreatedAt time.Time `db:"createdat"`
+	}
+	t := s.tables()
+	q := `SELECT filename, createdat FROM ` + t.Meta
+	err = s.retry(ctx, func() error {
+		created = created[:0]
+		return s.SelectContext(ctx, &created, q)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "get meta createdat")
+	}
+	createdAt := make(map[string]time.Time, len(created))
+	for _, c := range created {
+		createdAt[c.Filename] = c.CreatedAt
+	}
+	snap := &migrate.MetaSnapshot{
+		Migrations: make([]migrate.SnapshotMigration, len(ms)),
+	}
+	for i, m := range ms {
+		snap.Migrations[i] = migrate.SnapshotMigration{
+			Migration: m,
+			CreatedAt: createdAt[m.Filename],
+		}
+	}
+
+	q = `SELECT filename, idx, md5, content, createdat FROM ` +
+		t.Checkpoints + ` ORDER BY filename, idx`
+	err = s.retry(ctx, func() error {
+		snap.Checkpoints = []migrate.Checkpoint{}
+		rows, err := s.QueryContext(ctx, q)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var c migrate.Checkpoint
+			err = rows.Scan(&c.Filename, &c.Index, &c.Checksum,
+				&c.Content, &c.CreatedAt)
+			if err != nil {
+				return err
+			}
+			snap.Checkpoints = append(snap.Checkpoints, c)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "get checkpoints")
+	}
+	return snap, nil
+}
+
+// PutMetaSnapshot replaces meta and metacheckpoints in a transaction. Rows
+// without a createdat are recorded as created now.
+func (s *Store) PutMetaSnapshot(
+	ctx context.Context,
+	snap *migrate.MetaSnapshot,
+) (err error) {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	t := s.tables()
+	if _, err = tx.ExecContext(ctx, `DELETE FROM `+t.Meta); err != nil {
+		return errors.Wrap(err, "delete meta")
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM `+t.Checkpoints)
+	if err != nil {
+		return errors.Wrap(err, "delete checkpoints")
+	}
+
+	now := time.Now().UTC()
+	orNow := func(t time.Time) time.Time {
+		if t.IsZero() {
+			return now
+		}
+		return t
+	}
+	cols := append(s.metaColumns(true), "createdat")
+	q := s.rebind(`INSERT INTO ` + t.Meta + ` (` + strings.Join(cols, ", ") +
+		`) VALUES (` + Placeholders(len(cols)) + `)`)
+	for _, m := range snap.Migrations {
+		vals := append(s.metaValues(m.Migration), orNow(m.CreatedAt))
+		if _, err = tx.ExecContext(ctx, q, vals...); err != nil {
+			return errors.Wrapf(err, "insert %s", m.Filename)
+		}
+	}
+	q = s.rebind(`
+		INSERT INTO ` + t.Checkpoints + `
+		(filename, idx, md5, content, createdat) VALUES (?, ?, ?, ?, ?)`)
+	for _, c := range snap.Checkpoints {
+		_, err = tx.ExecContext(ctx, q, c.Filename, c.Index, c.Checksum,
+			c.Content, orNow(c.CreatedAt))
+		if err != nil {
+			return errors.Wrapf(err, "insert checkpoint %s %d", c.Filename,
+				c.Index)
+		}
+	}
+	return nil
+}
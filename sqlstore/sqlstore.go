@@ -0,0 +1,1120 @@
+// Package sqlstore implements migrate.Store on top of database/sql. The
+// statements it issues are shared across databases, and a Dialect describes
+// the handful of places where their SQL differs: placeholders, column types,
+// upserts, and detecting that a table already exists.
+//
+// The mysql, postgres, cockroach, mssql, oracle, snowflake and sqlite packages
+// are each a Dialect plus the logic to build a connection string. To support
+// another database, implement a Dialect and wrap a *sql.DB with New.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/thankful-ai/migrate"
+)
+
+// Dialect describes how a database's SQL differs from the statements Store
+// issues. Queries returned by a Dialect use ? placeholders, which Store
+// rebinds to the dialect's BindType.
+type Dialect interface {
+	// BindType reports the placeholder style of the database, one of
+	// sqlx.QUESTION, sqlx.DOLLAR, sqlx.NAMED or sqlx.AT.
+	BindType() int
+
+	// Types used to create the meta tables.
+	Types() Types
+
+	// CreateTableIfNotExists returns a statement creating table with the
+	// given column and constraint definitions, doing nothing if the table
+	// already exists.
+	CreateTableIfNotExists(table string, defs []string) string
+
+	// IsTableExists reports whether err is the database's error for
+	// creating a table that already exists.
+	IsTableExists(err error) bool
+
+	// UpsertMigration returns a statement inserting a row of cols into
+	// table, or updating the other columns of the row with the same
+	// filename, which is always cols[0]. The statement takes a ?
+	// placeholder for each column, such as from Placeholders.
+	UpsertMigration(table string, cols []string) string
+
+	// UpgradeToV1 migrates existing meta tables to the v1 format. See
+	// migrate.Store.
+	UpgradeToV1(ctx context.Context, db *sqlx.DB,
+		migrations []migrate.Migration) error
+}
+
+// MissingTableChecker is implemented by dialects which recognize the
+// database's error for selecting from a table which doesn't exist. Store's
+// GetMetaVersion needs it to report that the meta tables don't exist without
+// creating them, and otherwise reports the error.
+type MissingTableChecker interface {
+	IsTableMissing(err error) bool
+}
+
+// Retrier is implemented by dialects whose databases ask clients to retry a
+// statement, such as after a serialization failure. Store runs every query
+// it issues itself through Retry, which gives up once ctx is done.
+type Retrier interface {
+	Retry(ctx context.Context, fn func() error) error
+}
+
+// ColumnAdder is implemented by dialects which don't add columns with ALTER
+// TABLE ... ADD COLUMN, such as SQL Server.
+type ColumnAdder interface {
+	// AddColumn returns a statement adding the column def to table.
+	AddColumn(table, def string) string
+}
+
+// ColumnRenamer is implemented by dialects which don't rename columns with
+// ALTER TABLE ... RENAME COLUMN, such as SQL Server.
+type ColumnRenamer interface {
+	// RenameColumn returns a statement renaming column from in table to
+	// to. def is the column's full definition under its new name, for
+	// databases which restate it.
+	RenameColumn(table, from, to, def string) string
+}
+
+// ColumnModifier is implemented by dialects whose Types.Text was once smaller,
+// such as MySQL's TEXT. Store uses it to widen the content columns of existing
+// meta tables when upgrading them.
+type ColumnModifier interface {
+	// ModifyColumn returns a statement changing a column of table to def,
+	// which starts with the column's name.
+	ModifyColumn(table, def string) string
+}
+
+// TableNamer is implemented by dialects which keep the meta tables under other
+// names than DefaultTables, such as to track several histories in one
+// database. Their UpsertMigration and UpgradeToV1 must use the same names.
+type TableNamer interface {
+	Tables() Tables
+}
+
+// Tables are the names of the meta tables, as SQL statements refer to them.
+// They're interpolated into statements, so must be quoted as the database
+// requires and contain only names checked with ValidateIdentifier.
+type Tables struct {
+	Meta, Checkpoints, Version, History, Lock string
+}
+
+// DefaultTables are the names of the meta tables unless a Dialect implements
+// TableNamer.
+var DefaultTables = Tables{
+	Meta:        "meta",
+	Checkpoints: "metacheckpoints",
+	Version:     "metaversion",
+	History:     "metahistory",
+	Lock:        "metalock",
+}
+
+// ValidateIdentifier reports an error unless name contains only ASCII
+// letters, digits and underscores, so it's safe to interpolate into SQL.
+func ValidateIdentifier(name string) error {
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') &&
+			(r < '0' || r > '9') && r != '_' {
+			return fmt.Errorf("invalid identifier %q: only letters, digits and underscores are allowed", name)
+		}
+	}
+	return nil
+}
+
+// Rebinder is implemented by dialects whose placeholders sqlx can't produce,
+// such as Oracle's :1. Store calls Rebind instead of sqlx.Rebind, and ignores
+// BindType.
+type Rebinder interface {
+	Rebind(q string) string
+}
+
+// Types are the column types a Dialect uses for the meta tables.
+type Types struct {
+	// String holds short, indexable values such as filenames and
+	// checksums.
+	String string
+
+	// Text holds the content of migrations, which may be large.
+	Text string
+
+	Integer string
+
+	// BigInteger holds 64-bit integers, defaulting to Integer if empty.
+	BigInteger string
+
+	// Timestamp defaults to Now, the database's current time.
+	Timestamp string
+	Now       string
+}
+
+// PoolConfig tunes the connection pool of a Store. Zero values leave the
+// database/sql defaults in place.
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
+// SingleConnection runs every statement on one session, so session state
+// such as SET statements in a migration carries over to the statements after
+// it.
+var SingleConnection = PoolConfig{MaxOpenConns: 1, MaxIdleConns: 1}
+
+// Apply the pool settings to db.
+func (p PoolConfig) Apply(db *sql.DB) {
+	if p.MaxOpenConns != 0 {
+		db.SetMaxOpenConns(p.MaxOpenConns)
+	}
+	if p.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(p.MaxIdleConns)
+	}
+	if p.ConnMaxLifetime != 0 {
+		db.SetConnMaxLifetime(p.ConnMaxLifetime)
+	}
+	if p.ConnMaxIdleTime != 0 {
+		db.SetConnMaxIdleTime(p.ConnMaxIdleTime)
+	}
+}
+
+// latestVersion is the newest meta version Store supports, and the version of
+// the tables CreateMetaIfNotExists creates.
+const latestVersion = 6
+
+// Store implements migrate.Store for any database with a Dialect.
+type Store struct {
+	dialect Dialect
+
+	// version of the meta tables, which decides the columns of meta to
+	// use. Until CreateMetaVersionIfNotExists or an upgrade reports it,
+	// the tables are assumed to be as CreateMetaIfNotExists makes them.
+	version int
+
+	// Embed the sqlx DB struct
+	*sqlx.DB
+}
+
+// New wraps an open database connection. The caller owns db, but may close it
+// through Store.Close.
+func New(db *sql.DB, d Dialect) *Store {
+	return &Store{dialect: d, version: latestVersion, DB: sqlx.NewDb(db, "")}
+}
+
+// Open a database connection with the given driver and data source name.
+func Open(driverName, dsn string, d Dialect) (*Store, error) {
+	db, err := sqlx.Open(driverName, dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "open db connection")
+	}
+	return &Store{dialect: d, version: latestVersion, DB: db}, nil
+}
+
+// Open does nothing, since Store is always constructed with an open
+// connection.
+func (s *Store) Open(ctx context.Context) error { return nil }
+
+func (s *Store) Close() error { return s.DB.Close() }
+
+// Exec a statement exactly as written. Unlike the queries Store issues
+// internally, q is not rebound, so migrations must use the database's native
+// placeholders. Nor is it retried through the dialect's Retry, since Migrate
+// decides which statements of a migration are safe to run again.
+func (s *Store) Exec(
+	ctx context.Context,
+	q string,
+	args ...interface{},
+) (sql.Result, error) {
+	return s.DB.ExecContext(ctx, q, args...)
+}
+
+// exec runs a statement Store issues itself, retrying it through the
+// dialect's Retry.
+func (s *Store) exec(
+	ctx context.Context,
+	q string,
+	args ...interface{},
+) (sql.Result, error) {
+	var res sql.Result
+	err := s.retry(ctx, func() error {
+		var err error
+		res, err = s.DB.ExecContext(ctx, q, args...)
+		return err
+	})
+	return res, err
+}
+
+func (s *Store) CreateMetaIfNotExists(ctx context.Context) error {
+	t := s.dialect.Types()
+	defs := []string{
+		"filename " + t.String + " UNIQUE NOT NULL",
+		checksumColumn(t),
+		"content " + t.Text + " NOT NULL",
+		"createdat " + t.Timestamp + " DEFAULT " + t.Now + " NOT NULL",
+	}
+	defs = append(defs, v2Columns(t)...)
+	defs = append(defs, v3Columns(t)...)
+	defs = append(defs, v4Columns(t)...)
+	defs = append(defs, v5Columns(t)...)
+	defs = append(defs, v6Columns(t)...)
+	q := s.dialect.CreateTableIfNotExists(s.tables().Meta, defs)
+	if _, err := s.exec(ctx, q); err != nil {
+		return errors.Wrap(err, "create meta table")
+	}
+	return nil
+}
+
+func (s *Store) CreateMetaCheckpointsIfNotExists(ctx context.Context) error {
+	t := s.dialect.Types()
+	q := s.dialect.CreateTableIfNotExists(s.tables().Checkpoints, []string{
+		"filename " + t.String + " NOT NULL",
+		"idx " + t.Integer + " NOT NULL",
+		"md5 " + t.String + " NOT NULL",
+		"content " + t.Text + " NOT NULL",
+		"createdat " + t.Timestamp + " DEFAULT " + t.Now + " NOT NULL",
+		"PRIMARY KEY (filename, idx)",
+	})
+	if _, err := s.exec(ctx, q); err != nil {
+		return errors.Wrap(err, "create metacheckpoints table")
+	}
+	return nil
+}
+
+// CreateMetaHistoryIfNotExists creates metahistory. success is an integer
+// rather than a boolean, which not every database has.
+func (s *Store) CreateMetaHistoryIfNotExists(ctx context.Context) error {
+	t := s.dialect.Types()
+	q := s.dialect.CreateTableIfNotExists(s.tables().History, []string{
+		"run_id " + t.String + " NOT NULL",
+		"filename " + t.String + " NOT NULL",
+		"idx " + t.Integer + " NOT NULL",
+		"started_at " + t.Timestamp + " NOT NULL",
+		"finished_at " + t.Timestamp + " NOT NULL",
+		"success " + t.Integer + " NOT NULL",
+		"error_text " + t.Text,
+		"host " + t.String,
+	})
+	if _, err := s.exec(ctx, q); err != nil {
+		return errors.Wrap(err, "create metahistory table")
+	}
+	return nil
+}
+
+func (s *Store) CreateMetaVersionIfNotExists(
+	ctx context.Context,
+	schemaVersion int,
+) (int, error) {
+	created := true
+	t := s.tables()
+	q := fmt.Sprintf(`CREATE TABLE %s (
+		version %s NOT NULL
+	)`, t.Version, s.dialect.Types().Integer)
+	if _, err := s.exec(ctx, q); err != nil {
+		// Check if the table already existed
+		if !s.dialect.IsTableExists(err) {
+			return 0, errors.Wrap(err, "create metaversion table")
+		}
+		created = false
+	}
+
+	var version int
+	q = `SELECT version FROM ` + t.Version
+	err := s.retry(ctx, func() error { return s.GetContext(ctx, &version, q) })
+	switch {
+	case err == sql.ErrNoRows:
+		if !created {
+			schemaVersion = 0
+		}
+		q = s.rebind(`INSERT INTO ` + t.Version +
+			` (version) VALUES (?)`)
+		if _, err := s.exec(ctx, q, schemaVersion); err != nil {
+			return 0, errors.Wrap(err, "insert version")
+		}
+		s.version = schemaVersion
+		return schemaVersion, nil
+	case err != nil:
+		return 0, errors.Wrap(err, "get version")
+	}
+	s.version = version
+	return version, nil
+}
+
+// GetMetaVersion probes for the meta tables by selecting no rows from them,
+// since not every database has an information_schema.
+func (s *Store) GetMetaVersion(ctx context.Context) (int, bool, error) {
+	t := s.tables()
+	exists, err := s.tableExists(ctx, t.Meta)
+	if err != nil || !exists {
+		return 0, false, errors.Wrap(err, "check meta table")
+	}
+	exists, err = s.tableExists(ctx, t.Version)
+	if err != nil {
+		return 0, false, errors.Wrap(err, "check metaversion table")
+	}
+	var version int
+	if exists {
+		q := `SELECT version FROM ` + t.Version
+		err = s.retry(ctx, func() error {
+			return s.GetContext(ctx, &version, q)
+		})
+		if err != nil && err != sql.ErrNoRows {
+			return 0, false, errors.Wrap(err, "get version")
+		}
+	}
+	s.version = version
+	return version, true, nil
+}
+
+// tableExists reports whether table exists, if the dialect is a
+// MissingTableChecker.
+func (s *Store) tableExists(ctx context.Context, table string) (bool, error) {
+	err := s.retry(ctx, func() error {
+		rows, err := s.QueryContext(ctx, `SELECT 1 FROM `+table+` WHERE 1=0`)
+		if err != nil {
+			return err
+		}
+		return rows.Close()
+	})
+	if c, ok := s.dialect.(MissingTableChecker); ok && err != nil &&
+		c.IsTableMissing(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetMigrations leaves out each migration's DownContent, which may be large.
+// See GetMigrationWithDown. Migrations are sorted by migrate.SortMigrations,
+// which orders them as the files are run.
+func (s *Store) GetMigrations(
+	ctx context.Context,
+) ([]migrate.Migration, error) {
+	ms, err := s.getMigrations(ctx, false, "")
+	if err != nil {
+		return nil, err
+	}
+	migrate.SortMigrations(ms)
+	return ms, nil
+}
+
+// GetMigrationWithDown reports the migration recorded for filename, including
+// the content of its down migration if it had one.
+func (s *Store) GetMigrationWithDown(
+	ctx context.Context,
+	filename string,
+) (migrate.Migration, error) {
+	ms, err := s.getMigrations(ctx, true, ` WHERE filename=?`, filename)
+	if err != nil {
+		return migrate.Migration{}, err
+	}
+	if len(ms) == 0 {
+		return migrate.Migration{}, fmt.Errorf("%s: %w", filename,
+			migrate.ErrMigrationNotFound)
+	}
+	return ms[0], nil
+}
+
+// getMigrations selects the metaColumns of meta rows, followed by the
+// clauses in rest. Columns are scanned by position rather than name, since
+// some databases, such as Oracle, report column names uppercased. Migrations
+// recorded before meta version 3 are reported as applied with md5.
+func (s *Store) getMigrations(
+	ctx context.Context,
+	withDown bool,
+	rest string,
+	args ...interface{},
+) ([]migrate.Migration, error) {
+	q := s.rebind(`SELECT ` + strings.Join(s.metaColumns(withDown), ", ") +
+		` FROM ` + s.tables().Meta + rest)
+	var migrations []migrate.Migration
+	err := s.retry(ctx, func() error {
+		migrations = []migrate.Migration{}
+		rows, err := s.QueryContext(ctx, q, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var m migrate.Migration
+			dest := []interface{}{&m.Filename, &m.Content, &m.Checksum}
+			var durationMS sql.NullInt64
+			var appliedBy, toolVersion, errText, appVersion sql.NullString
+			var down sql.NullString
+			if s.version >= 2 {
+				dest = append(dest, &durationMS, &appliedBy,
+					&toolVersion)
+			}
+			m.ChecksumAlgo = migrate.ChecksumMD5
+			m.Status = migrate.StatusApplied
+			if s.version >= 3 {
+				dest = append(dest, &m.ChecksumAlgo, &m.Status)
+			}
+			if s.version >= 5 {
+				dest = append(dest, &errText)
+			}
+			if s.version >= 6 {
+				dest = append(dest, &appVersion)
+			}
+			if withDown && s.version >= 4 {
+				dest = append(dest, &down)
+			}
+			if err = rows.Scan(dest...); err != nil {
+				return err
+			}
+			m.Duration = time.Duration(durationMS.Int64) *
+				time.Millisecond
+			m.AppliedBy = appliedBy.String
+			m.ToolVersion = toolVersion.String
+			m.Error = errText.String
+			m.AppVersion = appVersion.String
+			m.DownContent = down.String
+			migrations = append(migrations, m)
+		}
+		return rows.Err()
+	})
+	return migrations, err
+}
+
+// metaColumns are the columns of meta in the store's version, in the order
+// getMigrations reads them and metaValues returns their values. withDown
+// includes down_content as the last column, which metaValues always has a
+// value for.
+func (s *Store) metaColumns(withDown bool) []string {
+	checksum := "md5"
+	if s.version >= 3 {
+		checksum = "checksum"
+	}
+	cols := []string{"filename", "content", checksum}
+	if s.version >= 2 {
+		cols = append(cols, "duration_ms", "applied_by", "tool_version")
+	}
+	if s.version >= 3 {
+		cols = append(cols, "checksum_algo", "status")
+	}
+	if s.version >= 5 {
+		cols = append(cols, "error_text")
+	}
+	if s.version >= 6 {
+		cols = append(cols, "app_version")
+	}
+	if withDown && s.version >= 4 {
+		cols = append(cols, "down_content")
+	}
+	return cols
+}
+
+// metaValues are the values of metaColumns for m. An unset algorithm or
+// status is recorded as md5 and applied, as migrations were before meta
+// version 3.
+func (s *Store) metaValues(m migrate.Migration) []interface{} {
+	vals := []interface{}{m.Filename, m.Content, m.Checksum}
+	if s.version >= 2 {
+		vals = append(vals, m.Duration.Milliseconds(), m.AppliedBy,
+			m.ToolVersion)
+	}
+	if s.version >= 3 {
+		if m.ChecksumAlgo == "" {
+			m.ChecksumAlgo = migrate.ChecksumMD5
+		}
+		if m.Status == "" {
+			m.Status = migrate.StatusApplied
+		}
+		vals = append(vals, m.ChecksumAlgo, m.Status)
+	}
+	if s.version >= 5 {
+		vals = append(vals, nullIfEmpty(m.Error))
+	}
+	if s.version >= 6 {
+		vals = append(vals, nullIfEmpty(m.AppVersion))
+	}
+	if s.version >= 4 {
+		vals = append(vals, nullIfEmpty(m.DownContent))
+	}
+	return vals
+}
+
+// nullIfEmpty records an empty string as NULL.
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func (s *Store) GetMetaCheckpoints(
+	ctx context.Context,
+	filename string,
+) ([]string, error) {
+	q := s.rebind(`SELECT md5 FROM ` + s.tables().Checkpoints +
+		` WHERE filename=? ORDER BY idx`)
+	var checkpoints []string
+	err := s.retry(ctx, func() error {
+		checkpoints = []string{}
+		return s.SelectContext(ctx, &checkpoints, q, filename)
+	})
+	return checkpoints, err
+}
+
+// GetMetaCheckpointContents reports the statements checkpointed for filename.
+// See migrate.CheckpointReader.
+func (s *Store) GetMetaCheckpointContents(
+	ctx context.Context,
+	filename string,
+) ([]string, error) {
+	q := s.rebind(`SELECT content FROM ` + s.tables().Checkpoints +
+		` WHERE filename=? ORDER BY idx`)
+	var contents []string
+	err := s.retry(ctx, func() error {
+		contents = []string{}
+		return s.SelectContext(ctx, &contents, q, filename)
+	})
+	return contents, err
+}
+
+func (s *Store) UpsertMigration(
+	ctx context.Context,
+	m migrate.Migration,
+) error {
+	q := s.rebind(s.dialect.UpsertMigration(s.tables().Meta,
+		s.metaColumns(true)))
+	_, err := s.exec(ctx, q, s.metaValues(m)...)
+	return err
+}
+
+func (s *Store) InsertMetaCheckpoint(
+	ctx context.Context,
+	filename, content, checksum string,
+	idx int,
+) error {
+	q := s.rebind(`
+		INSERT INTO ` + s.tables().Checkpoints + `
+		(filename, content, idx, md5) VALUES (?, ?, ?, ?)`)
+	_, err := s.exec(ctx, q, filename, content, idx, checksum)
+	return err
+}
+
+func (s *Store) InsertMigration(
+	ctx context.Context,
+	m migrate.Migration,
+) error {
+	cols := s.metaColumns(true)
+	q := s.rebind(`INSERT INTO ` + s.tables().Meta + ` (` +
+		strings.Join(cols, ", ") + `) VALUES (` + Placeholders(len(cols)) +
+		`)`)
+	_, err := s.exec(ctx, q, s.metaValues(m)...)
+	return err
+}
+
+func (s *Store) InsertHistory(ctx context.Context, h migrate.History) error {
+	var success int
+	if h.Success {
+		success = 1
+	}
+	q := s.rebind(`
+		INSERT INTO ` + s.tables().History + `
+		(run_id, filename, idx, started_at, finished_at, success,
+		error_text, host) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	_, err := s.exec(ctx, q, h.RunID, h.Filename, h.Statement, h.StartedAt,
+		h.FinishedAt, success, nullIfEmpty(h.Error), h.Host)
+	return err
+}
+
+// GetHistory stops reading rows once it has limit of them, rather than
+// limiting the query, since databases disagree on how to write LIMIT.
+func (s *Store) GetHistory(
+	ctx context.Context,
+	filename string,
+	limit int,
+) ([]migrate.History, error) {
+	q := `
+		SELECT run_id, filename, idx, started_at, finished_at, success,
+		error_text, host FROM ` + s.tables().History
+	var args []interface{}
+	if filename != "" {
+		q += ` WHERE filename=?`
+		args = append(args, filename)
+	}
+	q = s.rebind(q + ` ORDER BY started_at DESC, idx DESC`)
+	var history []migrate.History
+	err := s.retry(ctx, func() error {
+		history = []migrate.History{}
+		rows, err := s.QueryContext(ctx, q, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() && (limit <= 0 || len(history) < limit) {
+			var h migrate.History
+			var success int
+			var errText, host sql.NullString
+			err = rows.Scan(&h.RunID, &h.Filename, &h.Statement,
+				&h.StartedAt, &h.FinishedAt, &success, &errText, &host)
+			if err != nil {
+				return err
+			}
+			h.Success = success != 0
+			h.Error = errText.String
+			h.Host = host.String
+			history = append(history, h)
+		}
+		return rows.Err()
+	})
+	return history, err
+}
+
+// CreateMetaLockIfNotExists creates metalock. id is always 1, so the primary
+// key keeps the table to one lock.
+func (s *Store) CreateMetaLockIfNotExists(ctx context.Context) error {
+	t := s.dialect.Types()
+	q := s.dialect.CreateTableIfNotExists(s.tables().Lock, []string{
+		"id " + t.Integer + " PRIMARY KEY",
+		"holder " + t.String + " NOT NULL",
+		"hostname " + t.String,
+		"pid " + t.Integer + " NOT NULL",
+		"filename " + t.String,
+		"acquired_at " + t.Timestamp + " NOT NULL",
+		"heartbeat_at " + t.Timestamp + " NOT NULL",
+	})
+	if _, err := s.exec(ctx, q); err != nil {
+		return errors.Wrap(err, "create metalock table")
+	}
+	return nil
+}
+
+// AcquireMetaLock deletes a stale lock, then inserts lock, which the primary
+// key refuses if another run holds the lock. Databases report that
+// differently, so rather than recognize their errors, a failed insert reads
+// back the holder, and reports false if it's another run. If the holder
+// released the lock in between, the insert is tried once more.
+func (s *Store) AcquireMetaLock(
+	ctx context.Context,
+	lock migrate.MetaLock,
+	staleBefore time.Time,
+) (bool, error) {
+	t := s.tables()
+	q := s.rebind(`DELETE FROM ` + t.Lock + ` WHERE heartbeat_at < ?`)
+	if _, err := s.exec(ctx, q, staleBefore); err != nil {
+		return false, errors.Wrap(err, "delete stale lock")
+	}
+	q = s.rebind(`
+		INSERT INTO ` + t.Lock + `
+		(id, holder, hostname, pid, filename, acquired_at, heartbeat_at)
+		VALUES (1, ?, ?, ?, ?, ?, ?)`)
+	sel := `SELECT holder FROM ` + t.Lock
+	for attempt := 0; ; attempt++ {
+		_, insertErr := s.exec(ctx, q, lock.Holder,
+			nullIfEmpty(lock.Hostname), lock.PID,
+			nullIfEmpty(lock.Filename), lock.AcquiredAt, lock.HeartbeatAt)
+		if insertErr == nil {
+			return true, nil
+		}
+		var holder string
+		err := s.retry(ctx, func() error {
+			return s.GetContext(ctx, &holder, sel)
+		})
+		switch {
+		case err == sql.ErrNoRows && attempt == 0:
+			continue
+		case err != nil:
+			return false, errors.Wrap(insertErr, "insert lock")
+		}
+		return holder == lock.Holder, nil
+	}
+}
+
+func (s *Store) HeartbeatMetaLock(
+	ctx context.Context,
+	holder string,
+	at time.Time,
+) (bool, error) {
+	q := s.rebind(`UPDATE ` + s.tables().Lock +
+		` SET heartbeat_at=? WHERE holder=?`)
+	res, err := s.exec(ctx, q, at, holder)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "rows affected")
+	}
+	return n > 0, nil
+}
+
+func (s *Store) ReleaseMetaLock(ctx context.Context, holder string) error {
+	q := s.rebind(`DELETE FROM ` + s.tables().Lock + ` WHERE holder=?`)
+	_, err := s.exec(ctx, q, holder)
+	return err
+}
+
+func (s *Store) DeleteMetaLock(ctx context.Context) error {
+	_, err := s.exec(ctx, `DELETE FROM `+s.tables().Lock)
+	return err
+}
+
+func (s *Store) GetMetaLock(ctx context.Context) (*migrate.MetaLock, error) {
+	q := `SELECT holder, hostname, pid, filename, acquired_at, heartbeat_at
+		FROM ` + s.tables().Lock
+	var lock migrate.MetaLock
+	var hostname, filename sql.NullString
+	err := s.retry(ctx, func() error {
+		return s.QueryRowContext(ctx, q).Scan(&lock.Holder, &hostname,
+			&lock.PID, &filename, &lock.AcquiredAt, &lock.HeartbeatAt)
+	})
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	lock.Hostname = hostname.String
+	lock.Filename = filename.String
+	return &lock, nil
+}
+
+func (s *Store) SetMetaLockFilename(
+	ctx context.Context,
+	holder, filename string,
+) error {
+	q := s.rebind(`UPDATE ` + s.tables().Lock +
+		` SET filename=? WHERE holder=?`)
+	_, err := s.exec(ctx, q, nullIfEmpty(filename), holder)
+	return err
+}
+
+// RenameMigration records the migration recorded as from, and its checkpoints,
+// as to. See migrate.Renamer.
+func (s *Store) RenameMigration(ctx context.Context, from, to string) error {
+	t := s.tables()
+	for _, table := range []string{t.Meta, t.Checkpoints} {
+		q := s.rebind(`UPDATE ` + table + ` SET filename=? WHERE filename=?`)
+		if _, err := s.exec(ctx, q, to, from); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteMigration deletes the migration recorded as filename, and its
+// checkpoints. See migrate.Store.
+func (s *Store) DeleteMigration(ctx context.Context, filename string) error {
+	t := s.tables()
+	for _, table := range []string{t.Meta, t.Checkpoints} {
+		q := s.rebind(`DELETE FROM ` + table + ` WHERE filename=?`)
+		if _, err := s.exec(ctx, q, filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) DeleteMetaCheckpoints(ctx context.Context) error {
+	q := `DELETE FROM ` + s.tables().Checkpoints
+	_, err := s.exec(ctx, q)
+	return err
+}
+
+func (s *Store) UpgradeToV1(
+	ctx context.Context,
+	migrations []migrate.Migration,
+) error {
+	if err := s.dialect.UpgradeToV1(ctx, s.DB, migrations); err != nil {
+		return err
+	}
+	s.version = 1
+	return nil
+}
+
+// UpgradeToV2 adds the v2 columns to meta. Each column is added only if it's
+// missing, so the upgrade can run again after failing partway through.
+func (s *Store) UpgradeToV2(ctx context.Context) error {
+	if err := s.addMetaColumns(ctx, v2Columns(s.dialect.Types())); err != nil {
+		return err
+	}
+	return s.SetMetaVersion(ctx, 1, 2)
+}
+
+// addMetaColumns adds the columns defined by defs to meta, skipping those
+// which already exist.
+func (s *Store) addMetaColumns(ctx context.Context, defs []string) error {
+	meta := s.tables().Meta
+	existing, err := s.columns(ctx, meta)
+	if err != nil {
+		return errors.Wrap(err, "get meta columns")
+	}
+	for _, def := range defs {
+		name, _, _ := strings.Cut(def, " ")
+		if existing[name] {
+			continue
+		}
+		if _, err = s.exec(ctx, s.addColumn(meta, def)); err != nil {
+			return errors.Wrapf(err, "add %s column", name)
+		}
+	}
+	return nil
+}
+
+// UpgradeToV3 renames meta's md5 column to checksum, and adds the
+// checksum_algo and status columns, which existing rows fill with their
+// defaults. Each change is skipped if it's already made, so the upgrade can
+// run again after failing partway through.
+func (s *Store) UpgradeToV3(ctx context.Context) error {
+	meta := s.tables().Meta
+	existing, err := s.columns(ctx, meta)
+	if err != nil {
+		return errors.Wrap(err, "get meta columns")
+	}
+	t := s.dialect.Types()
+	if existing["md5"] && !existing["checksum"] {
+		q := s.renameColumn(meta, "md5", "checksum", checksumColumn(t))
+		if _, err = s.exec(ctx, q); err != nil {
+			return errors.Wrap(err, "rename md5 to checksum")
+		}
+	}
+	for _, def := range v3Columns(t) {
+		name, _, _ := strings.Cut(def, " ")
+		if existing[name] {
+			continue
+		}
+		if _, err = s.exec(ctx, s.addColumn(meta, def)); err != nil {
+			return errors.Wrapf(err, "add %s column", name)
+		}
+	}
+	return s.SetMetaVersion(ctx, 2, 3)
+}
+
+// UpgradeToV4 adds meta's down_content column. Dialects implementing
+// ColumnModifier have the content columns of meta and metacheckpoints widened
+// to Types.Text as well. Each step is safe to repeat, so the upgrade can run
+// again after failing partway through.
+func (s *Store) UpgradeToV4(ctx context.Context) error {
+	t := s.dialect.Types()
+	if err := s.addMetaColumns(ctx, v4Columns(t)); err != nil {
+		return err
+	}
+	if mod, ok := s.dialect.(ColumnModifier); ok {
+		tables := s.tables()
+		def := "content " + t.Text + " NOT NULL"
+		for _, table := range []string{tables.Meta, tables.Checkpoints} {
+			_, err := s.exec(ctx, mod.ModifyColumn(table, def))
+			if err != nil {
+				return errors.Wrapf(err, "widen %s content", table)
+			}
+		}
+	}
+	return s.SetMetaVersion(ctx, 3, 4)
+}
+
+// v4Columns are the definitions of the columns added to meta in v4.
+func v4Columns(t Types) []string {
+	return []string{"down_content " + t.Text}
+}
+
+// UpgradeToV5 adds meta's error_text column, recording why a failed
+// migration failed. It's skipped if the column exists, so the upgrade can run
+// again after failing partway through.
+func (s *Store) UpgradeToV5(ctx context.Context) error {
+	if err := s.addMetaColumns(ctx, v5Columns(s.dialect.Types())); err != nil {
+		return err
+	}
+	return s.SetMetaVersion(ctx, 4, 5)
+}
+
+// v5Columns are the definitions of the columns added to meta in v5.
+func v5Columns(t Types) []string {
+	return []string{"error_text " + t.Text}
+}
+
+// UpgradeToV6 adds meta's app_version column, recording the release of the
+// application which applied each migration. It's skipped if the column
+// exists, so the upgrade can run again after failing partway through.
+func (s *Store) UpgradeToV6(ctx context.Context) error {
+	if err := s.addMetaColumns(ctx, v6Columns(s.dialect.Types())); err != nil {
+		return err
+	}
+	return s.SetMetaVersion(ctx, 5, 6)
+}
+
+// v6Columns are the definitions of the columns added to meta in v6.
+func v6Columns(t Types) []string {
+	return []string{"app_version " + t.String}
+}
+
+func checksumColumn(t Types) string {
+	return "checksum " + t.String + " NOT NULL"
+}
+
+// v3Columns are the definitions of the columns added to meta in v3.
+func v3Columns(t Types) []string {
+	return []string{
+		fmt.Sprintf("checksum_algo %s DEFAULT '%s' NOT NULL", t.String,
+			migrate.ChecksumMD5),
+		fmt.Sprintf("status %s DEFAULT '%s' NOT NULL", t.String,
+			migrate.StatusApplied),
+	}
+}
+
+func (s *Store) renameColumn(table, from, to, def string) string {
+	if r, ok := s.dialect.(ColumnRenamer); ok {
+		return r.RenameColumn(table, from, to, def)
+	}
+	return fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s", table, from,
+		to)
+}
+
+// v2Columns are the definitions of the columns added to meta in v2. They're
+// nullable, since migrations applied before v2 have no values for them.
+func v2Columns(t Types) []string {
+	bigInt := t.BigInteger
+	if bigInt == "" {
+		bigInt = t.Integer
+	}
+	return []string{
+		"duration_ms " + bigInt,
+		"applied_by " + t.String,
+		"tool_version " + t.String,
+	}
+}
+
+// columns reports the lowercased names of the columns in table.
+func (s *Store) columns(
+	ctx context.Context,
+	table string,
+) (map[string]bool, error) {
+	var cols []string
+	err := s.retry(ctx, func() error {
+		rows, err := s.QueryContext(ctx, `SELECT * FROM `+table+` WHERE 1=0`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		cols, err = rows.Columns()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]bool, len(cols))
+	for _, c := range cols {
+		existing[strings.ToLower(c)] = true
+	}
+	return existing, nil
+}
+
+func (s *Store) addColumn(table, def string) string {
+	if a, ok := s.dialect.(ColumnAdder); ok {
+		return a.AddColumn(table, def)
+	}
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", table, def)
+}
+
+func (s *Store) SetMetaVersion(ctx context.Context, from, to int) error {
+	err := s.retry(ctx, func() error {
+		return SetVersion(ctx, s.DB, s.tables().Version, from, to)
+	})
+	if err != nil {
+		return err
+	}
+	s.version = to
+	return nil
+}
+
+// Execer runs statements, as *sql.DB, *sql.Tx and their sqlx wrappers do.
+type Execer interface {
+	ExecContext(ctx context.Context, q string, args ...interface{}) (
+		sql.Result, error)
+	QueryRowContext(ctx context.Context, q string,
+		args ...interface{}) *sql.Row
+}
+
+// SetVersion changes the version in table, the metaversion table, from from
+// to to, reporting a *migrate.ErrVersionConflict if it's no longer from.
+// Dialects use it to record version 1 in UpgradeToV1 with their transaction.
+// A version already at to is left as it is, so an upgrade can run again, and a
+// table without a row, as meta tables from before metaversion have, counts as
+// version 0.
+func SetVersion(
+	ctx context.Context,
+	ex Execer,
+	table string,
+	from, to int,
+) error {
+	q := fmt.Sprintf(`UPDATE %s SET version=%d WHERE version=%d`, table, to,
+		from)
+	res, err := ex.ExecContext(ctx, q)
+	if err != nil {
+		return errors.Wrap(err, "update metaversion")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "rows affected")
+	}
+	if n > 0 {
+		return nil
+	}
+	var version int
+	err = ex.QueryRowContext(ctx, `SELECT version FROM `+table).
+		Scan(&version)
+	switch {
+	case err == sql.ErrNoRows && from == 0:
+		q = fmt.Sprintf(`INSERT INTO %s (version) VALUES (%d)`, table, to)
+		if _, err = ex.ExecContext(ctx, q); err != nil {
+			return errors.Wrap(err, "insert metaversion")
+		}
+		return nil
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return errors.Wrap(err, "get version")
+	case version == to:
+		return nil
+	}
+	return &migrate.ErrVersionConflict{From: from, To: to}
+}
+
+// Placeholders returns n ? placeholders separated by commas.
+func Placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// JoinColumns formats each of cols with format, such as "%[1]s=excluded.%[1]s",
+// and joins them with commas. Dialects use it to build UpsertMigration.
+func JoinColumns(cols []string, format string) string {
+	parts := make([]string, len(cols))
+	for i, c := range cols {
+		parts[i] = fmt.Sprintf(format, c)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// CreateTableIfNotExists is the standard CREATE TABLE IF NOT EXISTS
+// statement, which dialects supporting it can return from their own
+// CreateTableIfNotExists.
+func CreateTableIfNotExists(table string, defs []string) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n\t%s\n)", table,
+		strings.Join(defs, ",\n\t"))
+}
+
+func (s *Store) tables() Tables {
+	if n, ok := s.dialect.(TableNamer); ok {
+		return n.Tables()
+	}
+	return DefaultTables
+}
+
+func (s *Store) rebind(q string) string {
+	if r, ok := s.dialect.(Rebinder); ok {
+		return r.Rebind(q)
+	}
+	return sqlx.Rebind(s.dialect.BindType(), q)
+}
+
+func (s *Store) retry(ctx context.Context, fn func() error) error {
+	if r, ok := s.dialect.(Retrier); ok {
+		return r.Retry(ctx, fn)
+	}
+	return fn()
+}
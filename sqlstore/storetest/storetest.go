@@ -0,0 +1,578 @@
+// Package storetest is a conformance suite for migrate.Store implementations.
+// Each store's tests call Run with a function returning a fresh, empty
+// database, so that every backend is held to the same behavior.
+package storetest
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thankful-ai/migrate"
+)
+
+var ctx = context.Background()
+
+// Run the conformance suite. newStore must return an open store backed by an
+// empty database, and is called once per subtest.
+func Run(t *testing.T, newStore func(t *testing.T) migrate.Store) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, migrate.Store)
+	}{
+		{"CreateTablesTwice", testCreateTablesTwice},
+		{"MetaVersion", testMetaVersion},
+		{"GetMetaVersion", testGetMetaVersion},
+		{"SetMetaVersion", testSetMetaVersion},
+		{"MigrationsOrder", testMigrationsOrder},
+		{"UpsertMigration", testUpsertMigration},
+		{"MigrationMetadata", testMigrationMetadata},
+		{"LargeMigration", testLargeMigration},
+		{"MetaCheckpoints", testMetaCheckpoints},
+		{"RenameMigration", testRenameMigration},
+		{"DeleteMigration", testDeleteMigration},
+		{"History", testHistory},
+		{"MetaSnapshot", testMetaSnapshot},
+		{"MetaLock", testMetaLock},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fn(t, newStore(t))
+		})
+	}
+}
+
+func testCreateTablesTwice(t *testing.T, db migrate.Store) {
+	for i := 0; i < 2; i++ {
+		createTables(t, db)
+	}
+}
+
+func testMetaVersion(t *testing.T, db migrate.Store) {
+	v, err := db.CreateMetaVersionIfNotExists(ctx, 1)
+	check(t, err)
+	if v != 1 {
+		t.Fatalf("expected version 1 on a new db, got %d", v)
+	}
+	v, err = db.CreateMetaVersionIfNotExists(ctx, 2)
+	check(t, err)
+	if v != 1 {
+		t.Fatalf("expected existing version 1, got %d", v)
+	}
+}
+
+func testGetMetaVersion(t *testing.T, db migrate.Store) {
+	v, exists, err := db.GetMetaVersion(ctx)
+	check(t, err)
+	if exists || v != 0 {
+		t.Fatalf("expected no meta tables on a new db, got version %d", v)
+	}
+
+	// Probing doesn't create the tables
+	_, exists, err = db.GetMetaVersion(ctx)
+	check(t, err)
+	if exists {
+		t.Fatal("expected GetMetaVersion not to create the meta tables")
+	}
+
+	check(t, db.CreateMetaIfNotExists(ctx))
+	v, exists, err = db.GetMetaVersion(ctx)
+	check(t, err)
+	if !exists || v != 0 {
+		t.Fatalf("expected version 0 without metaversion, got %d, %t", v,
+			exists)
+	}
+	_, err = db.CreateMetaVersionIfNotExists(ctx, 3)
+	check(t, err)
+	v, exists, err = db.GetMetaVersion(ctx)
+	check(t, err)
+	if !exists || v != 3 {
+		t.Fatalf("expected version 3, got %d, %t", v, exists)
+	}
+}
+
+func testSetMetaVersion(t *testing.T, db migrate.Store) {
+	_, err := db.CreateMetaVersionIfNotExists(ctx, 1)
+	check(t, err)
+	check(t, db.SetMetaVersion(ctx, 1, 2))
+
+	// Another run already moved the version on from 1
+	err = db.SetMetaVersion(ctx, 1, 3)
+	var conflict *migrate.ErrVersionConflict
+	if !errors.As(err, &conflict) || conflict.From != 1 || conflict.To != 3 {
+		t.Fatalf("expected a version conflict, got %v", err)
+	}
+	v, err := db.CreateMetaVersionIfNotExists(ctx, 1)
+	check(t, err)
+	if v != 2 {
+		t.Fatalf("expected the conflict to leave version 2, got %d", v)
+	}
+
+	// Setting the version it already has is allowed, so an upgrade can
+	// run again
+	check(t, db.SetMetaVersion(ctx, 1, 2))
+}
+
+func testMigrationsOrder(t *testing.T, db migrate.Store) {
+	createTables(t, db)
+
+	// Insert out of order, and such that sorting lexically would put 10
+	// before 2, or casting the prefix to an integer would overflow or tie
+	for _, name := range []string{"10.sql", "V10__add_posts.sql",
+		"20250101000000_z.sql", "0012_b.sql", "2021-06-02_seed.sql",
+		"2.sql", "V2__add_users.sql", "20240611153001_y.sql",
+		"2021-12-01_more.sql", "0100_c.sql", "1_init.sql",
+		"20240611153000_x.sql", "0011_a.sql", "2021-06-01_init.sql"} {
+		check(t, db.InsertMigration(ctx, migrate.Migration{
+			Filename: name,
+			Content:  "SELECT 1;",
+			Checksum: "md5-" + name,
+		}))
+	}
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	want := []string{"1_init.sql", "2.sql", "10.sql", "0011_a.sql",
+		"0012_b.sql", "0100_c.sql", "2021-06-01_init.sql",
+		"2021-06-02_seed.sql", "2021-12-01_more.sql",
+		"20240611153000_x.sql", "20240611153001_y.sql",
+		"20250101000000_z.sql", "V2__add_users.sql", "V10__add_posts.sql"}
+	if len(ms) != len(want) {
+		t.Fatalf("expected %d migrations, got %d", len(want), len(ms))
+	}
+	for i, m := range ms {
+		if m.Filename != want[i] {
+			t.Fatalf("expected %s at %d, got %s", want[i], i,
+				m.Filename)
+		}
+		if m.Checksum != "md5-"+m.Filename {
+			t.Fatalf("bad checksum for %s: %s", m.Filename,
+				m.Checksum)
+		}
+	}
+}
+
+func testUpsertMigration(t *testing.T, db migrate.Store) {
+	createTables(t, db)
+
+	upsert := func(filename, content, checksum string) {
+		t.Helper()
+		check(t, db.UpsertMigration(ctx, migrate.Migration{
+			Filename: filename,
+			Content:  content,
+			Checksum: checksum,
+		}))
+	}
+	upsert("1.sql", "SELECT 1;", "a")
+	upsert("1.sql", "SELECT 2;", "b")
+	upsert("2.sql", "SELECT 3;", "c")
+
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(ms))
+	}
+	if ms[0].Content != "SELECT 2;" || ms[0].Checksum != "b" {
+		t.Fatalf("expected 1.sql to be updated, got %+v", ms[0])
+	}
+}
+
+func testMigrationMetadata(t *testing.T, db migrate.Store) {
+	createTables(t, db)
+	_, err := db.CreateMetaVersionIfNotExists(ctx, 6)
+	check(t, err)
+
+	// The upgrades change nothing on tables which are already current,
+	// and those before the current version report a conflict rather than
+	// lower it
+	for _, upgrade := range []func(context.Context) error{
+		db.UpgradeToV3, db.UpgradeToV4, db.UpgradeToV5,
+	} {
+		var conflict *migrate.ErrVersionConflict
+		if err = upgrade(ctx); !errors.As(err, &conflict) {
+			t.Fatalf("expected a version conflict, got %v", err)
+		}
+	}
+	check(t, db.UpgradeToV6(ctx))
+	v, err := db.CreateMetaVersionIfNotExists(ctx, 6)
+	check(t, err)
+	if v != 6 {
+		t.Fatalf("expected the upgrades to leave version 6, got %d", v)
+	}
+
+	want := migrate.Migration{
+		Filename:     "1.sql",
+		Content:      "SELECT 1;",
+		Checksum:     "a",
+		Duration:     1500 * time.Millisecond,
+		AppliedBy:    "deploy@ci",
+		ToolVersion:  "v1.2.3",
+		ChecksumAlgo: migrate.ChecksumMD5,
+		Status:       migrate.StatusFailed,
+		Error:        "syntax error",
+		AppVersion:   "v1.42.0",
+		DownContent:  "SELECT 0;",
+	}
+	check(t, db.InsertMigration(ctx, want))
+	got, err := db.GetMigrationWithDown(ctx, want.Filename)
+	check(t, err)
+	if got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+
+	// GetMigrations leaves out the down migration
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	withoutDown := want
+	withoutDown.DownContent = ""
+	if len(ms) != 1 || ms[0] != withoutDown {
+		t.Fatalf("expected %+v, got %+v", withoutDown, ms)
+	}
+
+	_, err = db.GetMigrationWithDown(ctx, "2.sql")
+	if !errors.Is(err, migrate.ErrMigrationNotFound) {
+		t.Fatalf("expected migration not found, got %v", err)
+	}
+
+	want.Checksum = "b"
+	want.AppliedBy = "other@ci"
+	want.Status = migrate.StatusApplied
+	want.Error = ""
+	want.DownContent = ""
+	check(t, db.UpsertMigration(ctx, want))
+	got, err = db.GetMigrationWithDown(ctx, want.Filename)
+	check(t, err)
+	if got != want {
+		t.Fatalf("expected upserted %+v, got %+v", want, got)
+	}
+}
+
+// testLargeMigration records a migration larger than MySQL's TEXT columns can
+// hold.
+func testLargeMigration(t *testing.T, db migrate.Store) {
+	createTables(t, db)
+
+	content := "INSERT INTO a VALUES ('" + strings.Repeat("x", 1<<20) + "');"
+	checksum := fmt.Sprintf("%x", md5.Sum([]byte(content)))
+	check(t, db.InsertMigration(ctx, migrate.Migration{
+		Filename: "1.sql",
+		Content:  content,
+		Checksum: checksum,
+	}))
+	check(t, db.InsertMetaCheckpoint(ctx, "2.sql", content, checksum, 0))
+
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 1 || ms[0].Content != content {
+		t.Fatal("expected the content to be returned intact")
+	}
+	got := fmt.Sprintf("%x", md5.Sum([]byte(ms[0].Content)))
+	if got != ms[0].Checksum {
+		t.Fatalf("expected checksum %s to match %s", ms[0].Checksum, got)
+	}
+}
+
+func testMetaCheckpoints(t *testing.T, db migrate.Store) {
+	createTables(t, db)
+
+	const filename = "1.sql"
+	check(t, db.InsertMetaCheckpoint(ctx, filename, "SELECT 2;", "b", 1))
+	check(t, db.InsertMetaCheckpoint(ctx, filename, "SELECT 1;", "a", 0))
+	check(t, db.InsertMetaCheckpoint(ctx, "2.sql", "SELECT 3;", "c", 0))
+
+	mcs, err := db.GetMetaCheckpoints(ctx, filename)
+	check(t, err)
+	if len(mcs) != 2 || mcs[0] != "a" || mcs[1] != "b" {
+		t.Fatalf("expected checkpoints [a b], got %v", mcs)
+	}
+	if cr, ok := db.(migrate.CheckpointReader); ok {
+		contents, err := cr.GetMetaCheckpointContents(ctx, filename)
+		check(t, err)
+		if len(contents) != 2 || contents[0] != "SELECT 1;" ||
+			contents[1] != "SELECT 2;" {
+			t.Fatalf("expected the checkpoints' statements, got %q",
+				contents)
+		}
+	}
+
+	check(t, db.DeleteMetaCheckpoints(ctx))
+	mcs, err = db.GetMetaCheckpoints(ctx, filename)
+	check(t, err)
+	if len(mcs) != 0 {
+		t.Fatalf("expected 0 checkpoints, got %d", len(mcs))
+	}
+}
+
+func testRenameMigration(t *testing.T, db migrate.Store) {
+	r, ok := db.(migrate.Renamer)
+	if !ok {
+		t.Skipf("%T can't rename migrations", db)
+	}
+	createTables(t, db)
+
+	for _, name := range []string{"1.sql", "2.sql"} {
+		check(t, db.InsertMigration(ctx, migrate.Migration{
+			Filename: name,
+			Content:  "SELECT 1;",
+			Checksum: "md5-" + name,
+		}))
+	}
+	check(t, db.InsertMetaCheckpoint(ctx, "1.sql", "SELECT 1;", "a", 0))
+	check(t, r.RenameMigration(ctx, "1.sql", "2023/1.sql"))
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 2 || ms[0].Filename != "2023/1.sql" ||
+		ms[0].Checksum != "md5-1.sql" || ms[1].Filename != "2.sql" {
+		t.Fatalf("expected 1.sql renamed, got %+v", ms)
+	}
+	mcs, err := db.GetMetaCheckpoints(ctx, "2023/1.sql")
+	check(t, err)
+	if len(mcs) != 1 || mcs[0] != "a" {
+		t.Fatalf("expected the checkpoint renamed, got %v", mcs)
+	}
+}
+
+func testDeleteMigration(t *testing.T, db migrate.Store) {
+	createTables(t, db)
+
+	for _, name := range []string{"1.sql", "2.sql"} {
+		check(t, db.InsertMigration(ctx, migrate.Migration{
+			Filename: name,
+			Content:  "SELECT 1;",
+			Checksum: "md5-" + name,
+		}))
+		check(t, db.InsertMetaCheckpoint(ctx, name, "SELECT 1;", "a", 0))
+	}
+	check(t, db.DeleteMigration(ctx, "2.sql"))
+	ms, err := db.GetMigrations(ctx)
+	check(t, err)
+	if len(ms) != 1 || ms[0].Filename != "1.sql" {
+		t.Fatalf("expected only 1.sql left, got %+v", ms)
+	}
+	mcs, err := db.GetMetaCheckpoints(ctx, "2.sql")
+	check(t, err)
+	if len(mcs) != 0 {
+		t.Fatalf("expected the checkpoints of 2.sql deleted, got %v", mcs)
+	}
+	mcs, err = db.GetMetaCheckpoints(ctx, "1.sql")
+	check(t, err)
+	if len(mcs) != 1 {
+		t.Fatalf("expected the checkpoint of 1.sql kept, got %v", mcs)
+	}
+
+	// Deleting a migration which isn't recorded does nothing
+	check(t, db.DeleteMigration(ctx, "2.sql"))
+}
+
+func testHistory(t *testing.T, db migrate.Store) {
+	createTables(t, db)
+
+	// Databases store timestamps to at least microseconds
+	start := time.Date(2024, 1, 2, 3, 4, 5, 6000, time.UTC)
+	failed := migrate.History{
+		RunID:      "run-1",
+		Filename:   "1.sql",
+		Statement:  -1,
+		StartedAt:  start,
+		FinishedAt: start.Add(time.Second),
+		Error:      "syntax error",
+		Host:       "ci-1",
+	}
+	applied := failed
+	applied.RunID = "run-2"
+	applied.StartedAt = start.Add(time.Minute)
+	applied.FinishedAt = start.Add(2 * time.Minute)
+	applied.Success = true
+	applied.Error = ""
+	other := applied
+	other.Filename = "2.sql"
+	other.StartedAt = start.Add(3 * time.Minute)
+	for _, h := range []migrate.History{failed, applied, other} {
+		check(t, db.InsertHistory(ctx, h))
+	}
+
+	history, err := db.GetHistory(ctx, "1.sql", 0)
+	check(t, err)
+	if len(history) != 2 {
+		t.Fatalf("expected 2 entries for 1.sql, got %+v", history)
+	}
+	for i, want := range []migrate.History{applied, failed} {
+		got := history[i]
+		if !got.StartedAt.Equal(want.StartedAt) ||
+			!got.FinishedAt.Equal(want.FinishedAt) {
+			t.Fatalf("expected times %v and %v, got %v and %v",
+				want.StartedAt, want.FinishedAt, got.StartedAt,
+				got.FinishedAt)
+		}
+		got.StartedAt, got.FinishedAt = want.StartedAt, want.FinishedAt
+		if got != want {
+			t.Fatalf("expected %+v, got %+v", want, got)
+		}
+	}
+
+	history, err = db.GetHistory(ctx, "", 1)
+	check(t, err)
+	if len(history) != 1 || history[0].Filename != "2.sql" {
+		t.Fatalf("expected only the latest entry, got %+v", history)
+	}
+}
+
+func testMetaSnapshot(t *testing.T, db migrate.Store) {
+	createTables(t, db)
+	snapper, ok := db.(migrate.MetaSnapshotter)
+	if !ok {
+		t.Skipf("%T doesn't implement MetaSnapshotter", db)
+	}
+	check(t, db.InsertMigration(ctx, migrate.Migration{
+		Filename: "1.sql",
+		Content:  "SELECT 1;",
+		Checksum: "a",
+	}))
+	check(t, db.InsertMetaCheckpoint(ctx, "2.sql", "SELECT 2;", "b", 0))
+
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	want := &migrate.MetaSnapshot{
+		Migrations: []migrate.SnapshotMigration{{
+			Migration: migrate.Migration{
+				Filename:     "1.sql",
+				Content:      "SELECT 1;",
+				Checksum:     "c",
+				ChecksumAlgo: migrate.ChecksumMD5,
+				Status:       migrate.StatusApplied,
+				DownContent:  "SELECT 0;",
+			},
+			CreatedAt: created,
+		}, {
+			Migration: migrate.Migration{
+				Filename:     "10.sql",
+				Content:      "SELECT 10;",
+				Checksum:     "d",
+				ChecksumAlgo: migrate.ChecksumSHA256,
+				Status:       migrate.StatusApplied,
+			},
+			CreatedAt: created,
+		}},
+		Checkpoints: []migrate.Checkpoint{{
+			Filename:  "11.sql",
+			Index:     0,
+			Checksum:  "e",
+			Content:   "SELECT 11;",
+			CreatedAt: created,
+		}},
+	}
+	check(t, snapper.PutMetaSnapshot(ctx, want))
+
+	// The snapshot replaces what was there before
+	got, err := snapper.GetMetaSnapshot(ctx)
+	check(t, err)
+	if len(got.Migrations) != len(want.Migrations) ||
+		len(got.Checkpoints) != len(want.Checkpoints) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+	for i, m := range got.Migrations {
+		if m.Migration != want.Migrations[i].Migration ||
+			!m.CreatedAt.Equal(created) {
+			t.Fatalf("expected %+v, got %+v", want.Migrations[i], m)
+		}
+	}
+	c := got.Checkpoints[0]
+	if c.Filename != "11.sql" || c.Checksum != "e" ||
+		c.Content != "SELECT 11;" || !c.CreatedAt.Equal(created) {
+		t.Fatalf("expected %+v, got %+v", want.Checkpoints[0], c)
+	}
+}
+
+func testMetaLock(t *testing.T, db migrate.Store) {
+	createTables(t, db)
+	now := time.Date(2024, 1, 2, 3, 4, 5, 6000, time.UTC)
+	first := migrate.MetaLock{
+		Holder:      "run-1",
+		Hostname:    "ci-1",
+		PID:         42,
+		AcquiredAt:  now,
+		HeartbeatAt: now,
+	}
+	second := first
+	second.Holder = "run-2"
+	acquire := func(lock migrate.MetaLock, staleBefore time.Time) bool {
+		t.Helper()
+		ok, err := db.AcquireMetaLock(ctx, lock, staleBefore)
+		check(t, err)
+		return ok
+	}
+
+	if !acquire(first, now.Add(-time.Minute)) {
+		t.Fatal("expected to acquire the lock")
+	}
+	if acquire(second, now.Add(-time.Minute)) {
+		t.Fatal("expected the lock to be held")
+	}
+	held, err := db.HeartbeatMetaLock(ctx, "run-1", now.Add(time.Second))
+	check(t, err)
+	if !held {
+		t.Fatal("expected run-1 to hold the lock")
+	}
+	held, err = db.HeartbeatMetaLock(ctx, "run-2", now.Add(time.Second))
+	check(t, err)
+	if held {
+		t.Fatal("expected run-2 not to hold the lock")
+	}
+
+	// Only the holder records the file it's applying
+	check(t, db.SetMetaLockFilename(ctx, "run-1", "1.sql"))
+	check(t, db.SetMetaLockFilename(ctx, "run-2", "2.sql"))
+	lock, err := db.GetMetaLock(ctx)
+	check(t, err)
+	if lock == nil || lock.Holder != "run-1" || lock.Hostname != "ci-1" ||
+		lock.PID != 42 || lock.Filename != "1.sql" ||
+		!lock.HeartbeatAt.Equal(now.Add(time.Second)) {
+		t.Fatalf("unexpected lock %+v", lock)
+	}
+
+	// A lock with no heartbeat since staleBefore is taken over, after
+	// which its holder's heartbeats and release do nothing
+	if !acquire(second, now.Add(time.Minute)) {
+		t.Fatal("expected to take over the stale lock")
+	}
+	held, err = db.HeartbeatMetaLock(ctx, "run-1", now.Add(2*time.Second))
+	check(t, err)
+	if held {
+		t.Fatal("expected run-1 to have lost the lock")
+	}
+	check(t, db.ReleaseMetaLock(ctx, "run-1"))
+	if acquire(first, now.Add(-time.Minute)) {
+		t.Fatal("expected run-2 to still hold the lock")
+	}
+
+	check(t, db.ReleaseMetaLock(ctx, "run-2"))
+	if !acquire(first, now.Add(-time.Minute)) {
+		t.Fatal("expected to acquire the released lock")
+	}
+	check(t, db.DeleteMetaLock(ctx))
+	lock, err = db.GetMetaLock(ctx)
+	check(t, err)
+	if lock != nil {
+		t.Fatalf("expected no lock, got %+v", lock)
+	}
+	if !acquire(second, now.Add(-time.Minute)) {
+		t.Fatal("expected to acquire the deleted lock")
+	}
+}
+
+func createTables(t *testing.T, db migrate.Store) {
+	t.Helper()
+	check(t, db.CreateMetaIfNotExists(ctx))
+	check(t, db.CreateMetaCheckpointsIfNotExists(ctx))
+	check(t, db.CreateMetaHistoryIfNotExists(ctx))
+	check(t, db.CreateMetaLockIfNotExists(ctx))
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
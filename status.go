@@ -0,0 +1,212 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+
+	"github.com/pkg/errors"
+)
+
+// StatusReport compares the files in a migrations directory with the meta
+// tables, as Status reports it.
+type StatusReport struct {
+	// Initialized reports whether the meta tables exist. If they don't,
+	// every file is pending.
+	Initialized bool `json:"initialized"`
+
+	// Version is the meta version of the tables.
+	Version int `json:"version"`
+
+	// Applied are the files recorded as applied or skipped, and Pending
+	// those which haven't been, in the order they run.
+	Applied []string `json:"applied"`
+	Pending []string `json:"pending"`
+
+	// Unfinished is the one of Pending whose last run failed or was
+	// interrupted, so it resumes from its checkpoints, or empty.
+	Unfinished string `json:"unfinished,omitempty"`
+
+	// OutOfOrder are the files of Pending which sort before the last
+	// applied, such as one merged late, which Migrate refuses to run
+	// without WithAllowOutOfOrder.
+	OutOfOrder []string `json:"out_of_order,omitempty"`
+
+	// Mismatched are the applied files whose checksum no longer matches
+	// the one recorded when they ran, and Missing are recorded migrations
+	// whose file no longer exists. Migrate refuses to run while either
+	// has any.
+	Mismatched []string `json:"mismatched,omitempty"`
+	Missing    []string `json:"missing,omitempty"`
+
+	// Ignored are the files and directories of the migrations directory
+	// which .migrateignore or WithIgnore leave out, so a pattern matching
+	// too much or too little can be found.
+	Ignored []string `json:"ignored,omitempty"`
+
+	// LockingDisabled reports that Status was given WithoutLocking, so
+	// runs with the same options take no lock.
+	LockingDisabled bool `json:"locking_disabled,omitempty"`
+}
+
+func (r *StatusReport) String() string {
+	s := fmt.Sprintf("%d files applied, %d pending", len(r.Applied),
+		len(r.Pending))
+	if !r.Initialized {
+		s = fmt.Sprintf("uninitialized, %d files pending", len(r.Pending))
+	}
+	if r.Unfinished != "" {
+		s += ", " + r.Unfinished + " unfinished"
+	}
+	if len(r.OutOfOrder) > 0 {
+		s += fmt.Sprintf(", %d out of order", len(r.OutOfOrder))
+	}
+	if len(r.Mismatched) > 0 {
+		s += fmt.Sprintf(", %d checksums mismatched", len(r.Mismatched))
+	}
+	if len(r.Missing) > 0 {
+		s += fmt.Sprintf(", %d files missing", len(r.Missing))
+	}
+	if r.LockingDisabled {
+		s += ", locking disabled"
+	}
+	return s
+}
+
+// UpToDate reports whether every file is applied and matches its checksum.
+func (r *StatusReport) UpToDate() bool {
+	return r.Initialized && len(r.Pending) == 0 &&
+		len(r.Mismatched) == 0 && len(r.Missing) == 0
+}
+
+// Status compares the files in dir with the meta tables of an open store
+// without writing to the database: it never creates the meta tables, upgrades
+// them or takes the lock, so it works on a read-only connection such as to a
+// replica. Files another run is applying are reported as pending until it
+// records them. Of opts, only WithoutLocking, which the report notes, and
+// WithoutMixedNumbering and WithGapPolicy's GapsRefused have an effect.
+func Status(
+	ctx context.Context,
+	db Store,
+	dbt DBType,
+	dir string,
+	opts ...Option,
+) (*StatusReport, error) {
+	fsys, err := dirFS(dir)
+	if err != nil {
+		return nil, err
+	}
+	return StatusFS(ctx, db, dbt, fsys, opts...)
+}
+
+// StatusFS is Status with the files at the root of fsys, as NewFS reads them.
+func StatusFS(
+	ctx context.Context,
+	db Store,
+	dbt DBType,
+	fsys fs.FS,
+	opts ...Option,
+) (*StatusReport, error) {
+	conf := &Migrate{}
+	for _, opt := range opts {
+		opt(conf)
+	}
+	ig, err := conf.withIgnore(fsys)
+	if err != nil {
+		return nil, err
+	}
+	fsys, err = conf.withGoMigrations(migrationFS(ig))
+	if err != nil {
+		return nil, err
+	}
+	files, err := conf.readFiles(fsys, dbt)
+	if err != nil {
+		return nil, errors.Wrap(err, "get migrations")
+	}
+	if err = sortFiles(files, conf.order()); err != nil {
+		return nil, errors.Wrap(err, "sort")
+	}
+	if err = conf.checkNumbering(files); err != nil {
+		return nil, err
+	}
+	v, exists, err := db.GetMetaVersion(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get meta version")
+	}
+	report := &StatusReport{
+		Initialized: exists,
+		Version:     v,
+		Applied:     []string{},
+		Pending:     []string{},
+		Ignored:     ignoredFiles(ig),
+
+		LockingDisabled: conf.noLock,
+	}
+	if !exists {
+		for _, f := range files {
+			report.Pending = append(report.Pending, f.Info.Name())
+		}
+		return report, nil
+	}
+	if v > version {
+		return nil, &ErrVersionTooNew{Have: v, Want: version}
+	}
+
+	ms, err := db.GetMigrations(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get migrations")
+	}
+	normalizeFilenames(ms)
+	ms = conf.withoutOtherEnvs(ms)
+	done := ms[:0]
+	for _, mg := range ms {
+		if mg.Status == StatusFailed || mg.Status == StatusInProgress ||
+			mg.Status == StatusRollbackFailed {
+			report.Unfinished = mg.Filename
+			continue
+		}
+		done = append(done, mg)
+	}
+	ms = done
+	conf.sortMigrations(ms)
+	byName := make(map[string]*file, len(files))
+	for _, f := range files {
+		byName[f.Info.Name()] = f
+	}
+	applied := make(map[string]bool, len(ms))
+	for _, mg := range ms {
+		f, ok := byName[mg.Filename]
+		if !ok {
+			report.Missing = append(report.Missing, mg.Filename)
+			continue
+		}
+		applied[mg.Filename] = true
+		report.Applied = append(report.Applied, mg.Filename)
+		match, err := checksumMatches(fsys, f.fullpath, mg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "checksum %s", mg.Filename)
+		}
+		if !match {
+			report.Mismatched = append(report.Mismatched, mg.Filename)
+		}
+	}
+	for _, f := range files {
+		if !applied[f.Info.Name()] {
+			report.Pending = append(report.Pending, f.Info.Name())
+		}
+	}
+	report.OutOfOrder, _ = outOfOrder(files, ms)
+	return report, nil
+}
+
+// checksumMatches reports whether the file at name in fsys has the checksum
+// mg was recorded with, by the algorithm it was recorded with, as
+// recordedMatch reports.
+func checksumMatches(fsys fs.FS, name string, mg Migration) (bool, error) {
+	byt, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return false, err
+	}
+	match, _, err := recordedMatch(mg, byt)
+	return match, err
+}
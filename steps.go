@@ -0,0 +1,76 @@
+package migrate
+
+import (
+	"context"
+	"io/fs"
+)
+
+// Steps applies at most the next n pending migrations in dir, in order, as
+// Migrate does, such as to apply one at a time during peak hours, then logs
+// how many it applied and which are left pending. A file resuming from the
+// checkpoints of an earlier attempt counts as one step. A negative n rolls
+// back the last -n applied migrations instead, as Down does, and zero applies
+// none. It reports how many migrations were applied, or rolled back.
+func Steps(
+	ctx context.Context,
+	db Store,
+	log Logger,
+	dbt DBType,
+	dir string,
+	n int,
+	opts ...Option,
+) (int, error) {
+	fsys, err := dirFS(dir)
+	if err != nil {
+		return 0, err
+	}
+	return StepsFS(ctx, db, log, dbt, fsys, n, opts...)
+}
+
+// StepsFS is Steps with the files at the root of fsys, as NewFS reads them.
+func StepsFS(
+	ctx context.Context,
+	db Store,
+	log Logger,
+	dbt DBType,
+	fsys fs.FS,
+	n int,
+	opts ...Option,
+) (int, error) {
+	if n < 0 {
+		return DownFS(ctx, db, log, dbt, fsys, -n, opts...)
+	}
+	opts = append(opts[:len(opts):len(opts)], func(m *Migrate) {
+		m.steps, m.limitSteps = n, true
+	})
+	m, err := NewFS(ctx, db, log, dbt, fsys, "", opts...)
+	if err != nil {
+		return 0, err
+	}
+	_, err = m.Migrate(ctx)
+	return m.applied(), err
+}
+
+// applied counts the files of Results which were applied.
+func (m *Migrate) applied() int {
+	var n int
+	for _, res := range m.Results {
+		if res.Applied {
+			n++
+		}
+	}
+	return n
+}
+
+// logSteps logs how many migrations Steps applied, and left, those it left
+// pending.
+func (m *Migrate) logSteps(left []*file) {
+	if !m.limitSteps {
+		return
+	}
+	m.log.Printf("applied %d of at most %d migrations, leaving %d pending\n",
+		m.applied(), m.steps, len(left))
+	for _, f := range left {
+		m.log.Printf("  %s\n", f.Info.Name())
+	}
+}
@@ -1,26 +1,261 @@
 package migrate
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"time"
 )
 
+// Store records migration state in the database being migrated. Every method
+// but Close takes a context, which cancels the work in progress, such as a
+// long-running ALTER in Exec.
 type Store interface {
-	Open() error
+	Open(context.Context) error
 	Close() error
-	Exec(string, ...interface{}) (sql.Result, error)
+	Exec(context.Context, string, ...interface{}) (sql.Result, error)
 
 	// CreateMetaversionIfNotExists and report the current version.
-	CreateMetaVersionIfNotExists(schemaVersion int) (int, error)
-	CreateMetaIfNotExists() error
-	CreateMetaCheckpointsIfNotExists() error
+	CreateMetaVersionIfNotExists(ctx context.Context,
+		schemaVersion int) (int, error)
+	CreateMetaIfNotExists(context.Context) error
+	CreateMetaCheckpointsIfNotExists(context.Context) error
 
-	GetMigrations() ([]Migration, error)
-	InsertMigration(filename, content, checksum string) error
-	UpsertMigration(filename, content, checksum string) error
+	// GetMetaVersion reports the version of the meta tables, as
+	// CreateMetaVersionIfNotExists does, without creating or writing to
+	// them, so it's safe on a read-only connection. exists is false if
+	// the meta table doesn't exist. A meta table without a version is
+	// reported as version 0.
+	GetMetaVersion(context.Context) (version int, exists bool, err error)
 
-	GetMetaCheckpoints(string) ([]string, error)
-	InsertMetaCheckpoint(filename, content, checksum string, idx int) error
-	DeleteMetaCheckpoints() error
+	// GetMigrations, InsertMigration and UpsertMigration include the
+	// fields of Migration added in later meta versions only once the meta
+	// tables are upgraded to them. GetMigrations returns them sorted by
+	// SortMigrations, in the order the files run, rather than the order
+	// they were applied in.
+	GetMigrations(context.Context) ([]Migration, error)
+	InsertMigration(context.Context, Migration) error
+	UpsertMigration(context.Context, Migration) error
 
-	UpgradeToV1([]Migration) error
+	GetMetaCheckpoints(context.Context, string) ([]string, error)
+	InsertMetaCheckpoint(ctx context.Context,
+		filename, content, checksum string, idx int) error
+	DeleteMetaCheckpoints(context.Context) error
+
+	// SetMetaVersion changes the version of the meta tables from from to
+	// to, reporting an *ErrVersionConflict if it's neither. Each
+	// UpgradeToVn records its version with it, so never lowers the version
+	// of tables already upgraded past it.
+	SetMetaVersion(ctx context.Context, from, to int) error
+
+	// UpgradeToV1 expects metaversion to hold version 0, as
+	// CreateMetaVersionIfNotExists leaves it for meta tables which predate
+	// it.
+	UpgradeToV1(context.Context, []Migration) error
+
+	// UpgradeToV2 adds the columns recording each migration's duration,
+	// who applied it and with which version of migrate. It's safe to run
+	// again after failing partway through.
+	UpgradeToV2(context.Context) error
+
+	// UpgradeToV3 renames meta's md5 column to checksum, and adds columns
+	// recording the checksum's algorithm and the migration's status. It's
+	// safe to run again after failing partway through.
+	UpgradeToV3(context.Context) error
+
+	// UpgradeToV4 adds a column recording each migration's down
+	// migration, widening the content columns where the database's text
+	// type was too small for them. It's safe to run again after failing
+	// partway through.
+	UpgradeToV4(context.Context) error
+
+	// UpgradeToV5 adds a column recording why a failed migration failed.
+	// It's safe to run again after failing partway through.
+	UpgradeToV5(context.Context) error
+
+	// UpgradeToV6 adds a column recording the release of the application
+	// which applied each migration. It's safe to run again after failing
+	// partway through.
+	UpgradeToV6(context.Context) error
+
+	// GetMigrationWithDown reports the migration recorded for a filename,
+	// including its DownContent, or an error wrapping
+	// ErrMigrationNotFound.
+	GetMigrationWithDown(ctx context.Context, filename string) (Migration,
+		error)
+
+	// DeleteMigration deletes the migration recorded for a filename, and
+	// its checkpoints, once Down has rolled it back. Deleting one which
+	// isn't recorded isn't an error.
+	DeleteMigration(ctx context.Context, filename string) error
+
+	// CreateMetaHistoryIfNotExists creates the append-only metahistory
+	// table, to which InsertHistory adds an entry for each attempt to run
+	// a migration.
+	CreateMetaHistoryIfNotExists(context.Context) error
+	InsertHistory(context.Context, History) error
+
+	// GetHistory reports up to limit entries for filename, most recent
+	// first. An empty filename reports entries for every file, and a limit
+	// of zero or less reports every entry.
+	GetHistory(ctx context.Context, filename string, limit int) (
+		[]History, error)
+
+	// CreateMetaLockIfNotExists creates the metalock table, which holds
+	// at most one MetaLock.
+	CreateMetaLockIfNotExists(context.Context) error
+
+	// AcquireMetaLock records lock unless another is held whose heartbeat
+	// is at or after staleBefore, first replacing one whose heartbeat is
+	// older, and reports whether it did. It must be safe against
+	// concurrent calls from other processes.
+	AcquireMetaLock(ctx context.Context, lock MetaLock,
+		staleBefore time.Time) (bool, error)
+
+	// HeartbeatMetaLock sets the heartbeat of holder's lock, reporting
+	// false if holder no longer holds it.
+	HeartbeatMetaLock(ctx context.Context, holder string,
+		at time.Time) (bool, error)
+
+	// ReleaseMetaLock deletes holder's lock, if holder still holds it.
+	ReleaseMetaLock(ctx context.Context, holder string) error
+
+	// DeleteMetaLock deletes the lock, whoever holds it.
+	DeleteMetaLock(context.Context) error
+
+	// GetMetaLock reports the lock, or nil if none is held.
+	GetMetaLock(context.Context) (*MetaLock, error)
+
+	// SetMetaLockFilename records the file holder is applying, doing
+	// nothing if holder no longer holds the lock.
+	SetMetaLockFilename(ctx context.Context, holder, filename string) error
+}
+
+// RetryChecker is implemented by stores which recognize transient errors,
+// such as deadlocks, after which a statement is likely to succeed if run
+// again. Migrate retries statements which fail with them.
+type RetryChecker interface {
+	IsRetryable(error) bool
+}
+
+// Reconnecter is implemented by stores which can replace a lost connection
+// without releasing everything Close does. Migrate closes and opens other
+// stores again.
+type Reconnecter interface {
+	Reconnect(context.Context) error
+}
+
+// QueryKiller is implemented by stores which can stop the statement Exec last
+// ran with a deadline on the server. Cancelling a statement's context may
+// only close its connection, which some databases don't notice until the
+// statement finishes.
+type QueryKiller interface {
+	KillQuery(context.Context) error
+}
+
+// ContentLimiter is implemented by stores whose content columns hold a limited
+// number of bytes, such as MySQL's TEXT types. Migrate refuses to run a file
+// larger than the limit, rather than have it truncated or rejected once it has
+// run.
+type ContentLimiter interface {
+	// MaxContentSize reports the most bytes of a migration's content the
+	// meta tables can store, or zero if there's no limit.
+	MaxContentSize(context.Context) (int64, error)
+}
+
+// Renamer is implemented by stores which can change the filename a migration
+// is recorded with, as WithRenameMoved does for a file moved to another
+// subdirectory. Its checkpoints move with it, and its history keeps the old
+// name.
+type Renamer interface {
+	RenameMigration(ctx context.Context, from, to string) error
+}
+
+// CheckpointReader is implemented by stores which can report the statements
+// checkpointed for a file, as well as their checksums. Migrate shows the
+// statement which ran when one was edited before the file was resumed.
+type CheckpointReader interface {
+	// GetMetaCheckpointContents reports the content of each checkpoint of
+	// filename, in the order GetMetaCheckpoints reports their checksums.
+	GetMetaCheckpointContents(ctx context.Context, filename string) (
+		[]string, error)
+}
+
+// TxBeginner is implemented by stores which can begin a transaction, as those
+// using database/sql do. Go migrations run in one.
+type TxBeginner interface {
+	BeginTx(context.Context, *sql.TxOptions) (*sql.Tx, error)
+}
+
+// ImplicitCommitter is implemented by stores whose databases commit the
+// transaction in progress before some statements, such as MySQL before most
+// DDL. Migrate refuses to run a file with any of them in a transaction,
+// reporting an *ErrImplicitCommit, rather than let only part of it roll back.
+type ImplicitCommitter interface {
+	CommitsImplicitly(stmt string) bool
+}
+
+// Warning is a warning the database reported for a statement which
+// succeeded, such as MySQL's warnings for truncated data.
+type Warning struct {
+	// Statement is the index of the statement in its file, and Line the
+	// line of the file it starts on, which Migrate sets.
+	Statement int `json:"statement"`
+	Line      int `json:"line,omitempty"`
+
+	Level   string `json:"level"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// WarningReporter is implemented by stores which can report the warnings from
+// the last statement Exec ran.
+type WarningReporter interface {
+	Warnings() []Warning
+}
+
+// MultiStatementChecker is implemented by stores whose connections may refuse
+// several statements in one Exec, such as MySQL's unless multiStatements is
+// set. Migrate refuses to run a file which needs it, one starting with
+// "-- migrate:multi" or "-- migrate:no-split", on a connection without it.
+type MultiStatementChecker interface {
+	// MultiStatements reports whether one Exec may run several statements.
+	MultiStatements() bool
+}
+
+// Backoff between attempts to open the store in WaitForStore, which doubles up
+// to the maximum.
+const (
+	waitBackoff    = 250 * time.Millisecond
+	waitBackoffMax = 5 * time.Second
+)
+
+// WaitForStore opens db, trying again with exponential backoff for up to
+// timeout while the database can't be reached, such as while it starts
+// alongside migrate. Only errors wrapping ErrConnectionFailed are retried, so
+// a wrong password fails at once.
+func WaitForStore(
+	ctx context.Context,
+	db Store,
+	log Logger,
+	timeout time.Duration,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	backoff := waitBackoff
+	for attempt := 1; ; attempt++ {
+		err := db.Open(ctx)
+		if err == nil || !errors.Is(err, ErrConnectionFailed) {
+			return err
+		}
+		log.Printf("attempt %d to open the database failed, retrying in %s: %s\n",
+			attempt, backoff, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up after %s: %w", timeout, err)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, waitBackoffMax)
+	}
 }
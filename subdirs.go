@@ -0,0 +1,162 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// dbTypes are the names of the subdirectories holding overrides for a
+// database, which WithSubdirectories doesn't read as migrations.
+var dbTypes = map[DBType]bool{
+	DBTypeMySQL:     true,
+	DBTypeMariaDB:   true,
+	DBTypeTiDB:      true,
+	DBTypePostgres:  true,
+	DBTypeCockroach: true,
+	DBTypeMSSQL:     true,
+	DBTypeSpanner:   true,
+	DBTypeSnowflake: true,
+	DBTypeOracle:    true,
+	DBTypeSQLite:    true,
+}
+
+// WithSubdirectories reads migrations from subdirectories as well, such as to
+// group them by year: 2023/0001_init.sql and 2024/0042_add_index.sql. They're
+// recorded in meta by their paths, and run in order of their base names by
+// the Ordering, whichever directory they're in, so no two may have the same
+// base name. A subdirectory named for a DBType holds overrides, as in the top
+// directory, rather than migrations.
+func WithSubdirectories() Option {
+	return func(m *Migrate) { m.subdirs = true }
+}
+
+// WithRenameMoved records a migration moved to another subdirectory after it
+// was applied, found by its base name and checksum, by its new path. Without
+// it, New reports an error naming the move, rather than running the migration
+// again. It needs a store implementing Renamer.
+func WithRenameMoved() Option {
+	return func(m *Migrate) { m.renameMoved = true }
+}
+
+// readFiles reads the migration files in fsys, with their overrides for dbt,
+// and those in subdirectories with WithSubdirectories, without those for
+// another environment.
+func (m *Migrate) readFiles(fsys fs.FS, dbt DBType) ([]*file, error) {
+	if !m.subdirs {
+		files, err := readDir(fsys, ".", dbt)
+		if err != nil {
+			return nil, err
+		}
+		return m.forEnvironment(files)
+	}
+	files, err := readTree(fsys, ".", dbt)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no sql migration files found (might be the wrong -dir)")
+	}
+	byBase := make(map[string]string, len(files))
+	for _, f := range files {
+		base := path.Base(f.Info.Name())
+		if other, ok := byBase[base]; ok {
+			return nil, fmt.Errorf("%s and %s have the same name",
+				other, f.Info.Name())
+		}
+		byBase[base] = f.Info.Name()
+	}
+	if err = checkNames(files); err != nil {
+		return nil, err
+	}
+	return m.forEnvironment(files)
+}
+
+// readTree reads the migration files in dir and its subdirectories, other
+// than those holding overrides, named by their paths under dir.
+func readTree(fsys fs.FS, dir string, dbt DBType) ([]*file, error) {
+	files, err := readDirFiles(fsys, dir, dbt)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := readDirInfo(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+	for _, fi := range infos {
+		if !fi.IsDir() || dbTypes[DBType(fi.Name())] ||
+			strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		sub, err := readTree(fsys, path.Join(dir, fi.Name()), dbt)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range sub {
+			f.Info = namedInfo{FileInfo: f.Info,
+				name: path.Join(norm.NFC.String(fi.Name()), f.Info.Name())}
+		}
+		files = append(files, sub...)
+	}
+	return files, nil
+}
+
+// renameMovedFiles finds the migrations recorded by a path which no file has,
+// whose file was moved to another subdirectory: the only file with the same
+// base name, and the same checksum, which isn't recorded already. With
+// WithRenameMoved, they're recorded by their new paths. Otherwise the moves
+// are reported as an error.
+func (m *Migrate) renameMovedFiles(ctx context.Context) error {
+	recorded := make(map[string]bool, len(m.Migrations))
+	for _, mg := range m.Migrations {
+		recorded[mg.Filename] = true
+	}
+	byBase := map[string]*file{}
+	for _, f := range m.Files {
+		if !recorded[f.Info.Name()] {
+			byBase[path.Base(f.Info.Name())] = f
+		}
+	}
+	index := m.fileIndexes()
+	var moves []string
+	for i := range m.Migrations {
+		mg := &m.Migrations[i]
+		f := byBase[path.Base(mg.Filename)]
+		if _, ok := index[mg.Filename]; ok || f == nil {
+			continue
+		}
+		match, err := checksumMatches(m.fsys, f.fullpath, *mg)
+		if err != nil {
+			return fmt.Errorf("checksum %s: %w", f.Info.Name(), err)
+		}
+		if !match {
+			continue
+		}
+		if !m.renameMoved {
+			moves = append(moves, mg.Filename+" to "+f.Info.Name())
+			continue
+		}
+		r, ok := m.db.(Renamer)
+		if !ok {
+			return fmt.Errorf("%T can't record %s moved to %s", m.db,
+				mg.Filename, f.Info.Name())
+		}
+		if err = m.renameMigration(ctx, r, mg.Filename, f.Info.Name()); err != nil {
+			return fmt.Errorf("rename %s: %w", mg.Filename, err)
+		}
+		m.log.Printf("%s %s as %s, where it moved\n", m.recorded(),
+			mg.Filename, f.Info.Name())
+		mg.Filename = f.Info.Name()
+		delete(byBase, path.Base(f.Info.Name()))
+	}
+	if len(moves) > 0 {
+		return fmt.Errorf("applied migrations were moved: %s. rerun with -rename-moved or migrate.WithRenameMoved to record their new paths",
+			strings.Join(moves, ", "))
+	}
+	return nil
+}
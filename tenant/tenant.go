@@ -0,0 +1,161 @@
+// Package tenant applies the same migrations to every tenant of a database
+// which keeps each tenant in its own MySQL schema, such as tenant_123 and
+// tenant_456. Each schema keeps its own meta tables, so tenants are migrated,
+// locked and resumed independently.
+//
+// Tenants are listed explicitly or discovered with a query, such as:
+//
+//	SELECT schema_name FROM information_schema.schemata
+//	WHERE schema_name LIKE 'tenant\_%'
+//
+// Migrate runs them through migrate.MigrateAll, so its report names each
+// tenant, and Failed lists those to run again.
+package tenant
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	gomysql "github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+	"github.com/thankful-ai/migrate"
+	"github.com/thankful-ai/migrate/mysql"
+)
+
+// Discover lists tenants with query, which selects one column of schema names,
+// in the order it returns them.
+func Discover(ctx context.Context, db *sql.DB, query string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "query tenants")
+	}
+	defer rows.Close()
+	var tenants []string
+	for rows.Next() {
+		var t string
+		if err = rows.Scan(&t); err != nil {
+			return nil, errors.Wrap(err, "scan tenant")
+		}
+		tenants = append(tenants, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "query tenants")
+	}
+	return tenants, nil
+}
+
+// MySQL returns a function which prepares a store for a tenant's schema from
+// cfg, as mysql.NewFromConfig does, with the schema as its database.
+func MySQL(
+	cfg *gomysql.Config,
+	files *mysql.TLSFiles,
+) func(schema string) (migrate.Store, error) {
+	return func(schema string) (migrate.Store, error) {
+		cfg := cfg.Clone()
+		cfg.DBName = schema
+		return mysql.NewFromConfig(cfg, files)
+	}
+}
+
+// Migrate runs the migrations in dir against each of tenants, with a store
+// from newStore for each, as migrate.MigrateAll does with opts. If canary is
+// set, that tenant is migrated first, and the others only if it succeeds.
+//
+// The report names each tenant, in the order of tenants. To resume after a
+// failure, run Migrate again with those from Failed.
+func Migrate(
+	ctx context.Context,
+	tenants []string,
+	newStore func(tenant string) (migrate.Store, error),
+	log migrate.Logger,
+	dbt migrate.DBType,
+	dir, canary string,
+	opts ...migrate.Option,
+) (*migrate.MultiReport, error) {
+	seen := make(map[string]bool, len(tenants))
+	stores := make([]migrate.Store, len(tenants))
+	for i, t := range tenants {
+		if seen[t] {
+			return nil, fmt.Errorf("tenant %s is listed twice", t)
+		}
+		seen[t] = true
+		db, err := newStore(t)
+		if err != nil {
+			return nil, errors.Wrapf(err, "tenant %s", t)
+		}
+		stores[i] = db
+	}
+	if canary == "" {
+		return migrate.MigrateAll(ctx, stores, log, dbt, dir,
+			append(opts, migrate.WithStoreNames(tenants))...)
+	}
+	if !seen[canary] {
+		return nil, fmt.Errorf("canary %s is not a tenant", canary)
+	}
+
+	// Migrate the canary on its own, then the rest, and put their reports
+	// back in the order of tenants
+	var rest []migrate.Store
+	var restNames []string
+	var canaryStore migrate.Store
+	for i, t := range tenants {
+		if t == canary {
+			canaryStore = stores[i]
+			continue
+		}
+		rest = append(rest, stores[i])
+		restNames = append(restNames, t)
+	}
+	log.Printf("migrating canary %s\n", canary)
+	canaryReport, err := migrate.MigrateAll(ctx,
+		[]migrate.Store{canaryStore}, log, dbt, dir,
+		append(opts, migrate.WithStoreNames([]string{canary}))...)
+	if canaryReport == nil {
+		return nil, err
+	}
+	report := &migrate.MultiReport{
+		Stores: make([]migrate.StoreReport, 0, len(tenants)),
+	}
+	var restReport *migrate.MultiReport
+	if err != nil {
+		err = fmt.Errorf("canary failed, so no other tenant was migrated: %w",
+			err)
+		restReport = &migrate.MultiReport{}
+		for i, t := range restNames {
+			restReport.Stores = append(restReport.Stores,
+				migrate.StoreReport{Index: i, Name: t, Skipped: true})
+		}
+	} else {
+		restReport, err = migrate.MigrateAll(ctx, rest, log, dbt, dir,
+			append(opts, migrate.WithStoreNames(restNames))...)
+		if restReport == nil {
+			return nil, err
+		}
+	}
+	j := 0
+	for i, t := range tenants {
+		var s migrate.StoreReport
+		if t == canary {
+			s = canaryReport.Stores[0]
+		} else {
+			s = restReport.Stores[j]
+			j++
+		}
+		s.Index = i
+		report.Stores = append(report.Stores, s)
+	}
+	return report, err
+}
+
+// Failed lists the tenants in report which failed or were skipped, so weren't
+// fully migrated. report may have been read back from JSON.
+func Failed(report *migrate.MultiReport) []string {
+	var failed []string
+	for _, s := range report.Stores {
+		if s.Failed() || s.Skipped {
+			failed = append(failed, s.Name)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,151 @@
+package tenant
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/thankful-ai/migrate"
+	"github.com/thankful-ai/migrate/sqlite"
+)
+
+var ctx = context.Background()
+
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Printf(s string, vs ...interface{}) { l.t.Logf(s, vs...) }
+func (l testLogger) Println(vs ...interface{})          { l.t.Log(vs...) }
+
+// sqliteTenants keeps each tenant in its own SQLite file in dir.
+func sqliteTenants(dir string) func(string) (migrate.Store, error) {
+	return func(tenant string) (migrate.Store, error) {
+		return sqlite.New(filepath.Join(dir, tenant+".db")), nil
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	t.Parallel()
+	dbDir, dir := t.TempDir(), t.TempDir()
+	writeFile(t, dir, "1.sql", `CREATE TABLE t (id INTEGER);`)
+	writeFile(t, dir, "2.sql", `INSERT INTO t (id) VALUES (1);`)
+
+	tenants := []string{"tenant_1", "tenant_2", "tenant_3"}
+	report, err := Migrate(ctx, tenants, sqliteTenants(dbDir), testLogger{t},
+		migrate.DBTypeSQLite, dir, "", migrate.WithConcurrency(2))
+	check(t, err)
+	for i, s := range report.Stores {
+		if s.Name != tenants[i] || s.Status() != "ok" || len(s.Files) != 2 {
+			t.Fatalf("unexpected report for %s: %+v", tenants[i], s)
+		}
+	}
+	if failed := Failed(report); len(failed) != 0 {
+		t.Fatalf("expected no failures, got %v", failed)
+	}
+}
+
+func TestMigrateCanary(t *testing.T) {
+	t.Parallel()
+	dbDir, dir := t.TempDir(), t.TempDir()
+	writeFile(t, dir, "1.sql", `CREATE TABLE t (id INTEGER);`)
+	writeFile(t, dir, "2.sql", `INSERT INTO missing (id) VALUES (1);`)
+
+	tenants := []string{"tenant_1", "tenant_2", "tenant_3"}
+	report, err := Migrate(ctx, tenants, sqliteTenants(dbDir), testLogger{t},
+		migrate.DBTypeSQLite, dir, "tenant_2")
+	if err == nil {
+		t.Fatal("expected the canary to fail")
+	}
+	want := []string{"skipped", "failed", "skipped"}
+	for i, s := range report.Stores {
+		if s.Index != i || s.Name != tenants[i] || s.Status() != want[i] {
+			t.Fatalf("unexpected report for %s: %+v", tenants[i], s)
+		}
+	}
+	for _, tenant := range []string{"tenant_1", "tenant_3"} {
+		_, err = os.Stat(filepath.Join(dbDir, tenant+".db"))
+		if !os.IsNotExist(err) {
+			t.Fatalf("expected %s untouched: %v", tenant, err)
+		}
+	}
+
+	_, err = Migrate(ctx, tenants, sqliteTenants(dbDir), testLogger{t},
+		migrate.DBTypeSQLite, dir, "tenant_4")
+	if err == nil {
+		t.Fatal("expected an error for a canary which isn't a tenant")
+	}
+}
+
+func TestMigrateResume(t *testing.T) {
+	t.Parallel()
+	dbDir, dir := t.TempDir(), t.TempDir()
+	writeFile(t, dir, "1.sql", `CREATE TABLE t (id INTEGER);`)
+
+	// tenant_2 already has the table, so it fails
+	db, err := sqlx.Open("sqlite3", filepath.Join(dbDir, "tenant_2.db"))
+	check(t, err)
+	_, err = db.Exec(`CREATE TABLE t (id INTEGER)`)
+	check(t, err)
+
+	tenants := []string{"tenant_1", "tenant_2", "tenant_3"}
+	report, err := Migrate(ctx, tenants, sqliteTenants(dbDir), testLogger{t},
+		migrate.DBTypeSQLite, dir, "", migrate.WithContinueOnError())
+	if err == nil {
+		t.Fatal("expected tenant_2 to fail")
+	}
+
+	// Resume from the report as saved to a file
+	var buf bytes.Buffer
+	check(t, json.NewEncoder(&buf).Encode(report))
+	var saved migrate.MultiReport
+	check(t, json.NewDecoder(&buf).Decode(&saved))
+	failed := Failed(&saved)
+	if !reflect.DeepEqual(failed, []string{"tenant_2"}) {
+		t.Fatalf("expected tenant_2 to fail, got %v", failed)
+	}
+
+	_, err = db.Exec(`DROP TABLE t`)
+	check(t, err)
+	check(t, db.Close())
+	report, err = Migrate(ctx, failed, sqliteTenants(dbDir), testLogger{t},
+		migrate.DBTypeSQLite, dir, "", migrate.WithResume())
+	check(t, err)
+	if len(report.Stores) != 1 || len(report.Stores[0].Files) != 1 {
+		t.Fatalf("expected only tenant_2 migrated, got %+v", report.Stores)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	t.Parallel()
+	db, err := sqlx.Open("sqlite3", ":memory:")
+	check(t, err)
+	defer db.Close()
+	_, err = db.Exec(`CREATE TABLE schemata (schema_name TEXT);
+		INSERT INTO schemata VALUES ('tenant_1'), ('other'), ('tenant_2');`)
+	check(t, err)
+
+	tenants, err := Discover(ctx, db.DB, `SELECT schema_name FROM schemata
+		WHERE schema_name LIKE 'tenant\_%' ESCAPE '\' ORDER BY schema_name`)
+	check(t, err)
+	if !reflect.DeepEqual(tenants, []string{"tenant_1", "tenant_2"}) {
+		t.Fatalf("unexpected tenants %v", tenants)
+	}
+}
+
+func writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+	check(t, err)
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
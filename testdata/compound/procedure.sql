@@ -0,0 +1,30 @@
+CREATE TABLE batches (id INT PRIMARY KEY, status VARCHAR(16));
+
+-- Fills batches in groups, retrying each group a few times
+CREATE PROCEDURE fill_batches(IN total INT)
+BEGIN
+  DECLARE i INT DEFAULT 0;
+  DECLARE tries INT;
+  outer_loop: WHILE i < total DO
+    SET tries = 0;
+    retry: LOOP
+      SET tries = tries + 1;
+      BEGIN
+        DECLARE CONTINUE HANDLER FOR SQLEXCEPTION SET tries = tries + 1;
+        INSERT INTO batches VALUES (i, CASE WHEN i % 2 = 0 THEN 'even' ELSE 'odd' END);
+      END;
+      IF tries >= 3 THEN
+        LEAVE retry;
+      END IF;
+      REPEAT
+        SET tries = tries + 1;
+      UNTIL tries >= 3 END REPEAT;
+    END LOOP retry;
+    CASE
+      WHEN i > 100 THEN LEAVE outer_loop;
+      ELSE SET i = i + 1;
+    END CASE;
+  END WHILE outer_loop;
+END;
+
+CALL fill_batches(10);
@@ -0,0 +1,24 @@
+CREATE TABLE accounts (id INT PRIMARY KEY, balance INT, status VARCHAR(16));
+
+CREATE TRIGGER accounts_status BEFORE UPDATE ON accounts
+FOR EACH ROW
+BEGIN
+  IF NEW.balance < 0 THEN
+    SET NEW.status = 'overdrawn';
+  ELSEIF NEW.balance = 0 THEN
+    SET NEW.status = 'empty';
+  ELSE
+    SET NEW.status = 'open';
+  END IF;
+END;
+
+CREATE DEFINER=`admin`@`%` EVENT purge_closed
+ON SCHEDULE EVERY 1 DAY
+DO BEGIN
+  DELETE FROM accounts WHERE status = 'closed';
+END;
+
+CREATE TRIGGER accounts_touch BEFORE INSERT ON accounts
+FOR EACH ROW SET NEW.status = 'open';
+
+UPDATE accounts SET balance = balance;
@@ -0,0 +1,13 @@
+DELIMITER $$
+CREATE PROCEDURE archive_orders(IN cutoff DATE)
+BEGIN
+  DECLARE done INT DEFAULT 0;
+  IF cutoff < CURDATE() THEN
+    BEGIN
+      INSERT INTO orders_archive SELECT * FROM orders WHERE placed < cutoff;
+      DELETE FROM orders WHERE placed < cutoff;
+    END;
+  END IF;
+  SELECT 'archived; done' AS result;
+END$$
+DELIMITER ;
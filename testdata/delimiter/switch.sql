@@ -0,0 +1,25 @@
+CREATE TABLE counters (name VARCHAR(32) PRIMARY KEY, n INT);
+INSERT INTO counters VALUES ('orders', 0);
+
+delimiter //
+CREATE TRIGGER orders_count AFTER INSERT ON orders
+FOR EACH ROW
+BEGIN
+  UPDATE counters SET n = n + 1 WHERE name = 'orders';
+END//
+CREATE FUNCTION order_count() RETURNS INT
+READS SQL DATA
+BEGIN
+  RETURN (SELECT n FROM counters WHERE name = 'orders');
+END//
+delimiter ;
+
+INSERT INTO counters VALUES ('users', 0);
+
+DELIMITER ;;
+CREATE PROCEDURE reset_counters()
+BEGIN
+  UPDATE counters SET n = 0;
+END;;
+DELIMITER ;
+SELECT order_count();
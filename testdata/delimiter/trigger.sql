@@ -0,0 +1,13 @@
+CREATE TABLE users (
+  id INT PRIMARY KEY,
+  updated_at DATETIME
+);
+
+-- Keep updated_at current
+DELIMITER //
+CREATE TRIGGER users_updated BEFORE UPDATE ON users
+FOR EACH ROW
+BEGIN
+  SET NEW.updated_at = NOW();
+END //
+DELIMITER ;
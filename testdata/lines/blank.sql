@@ -0,0 +1,15 @@
+
+
+CREATE TABLE a (id INT);
+
+
+
+CREATE TABLE b (id INT); CREATE TABLE c (id INT);
+	
+  SELECT 'boom';
+INSERT INTO a
+VALUES
+
+  (1);
+
+
@@ -0,0 +1,20 @@
+-- Adds the accounts tables.
+--
+-- Each statement below follows a comment, which isn't counted as its
+-- first line unless it's sent with it.
+
+/* The accounts themselves */
+CREATE TABLE accounts (
+  id INT PRIMARY KEY,
+  name TEXT -- shown to people; unique
+);
+
+-- Names are unique
+CREATE UNIQUE INDEX accounts_name ON accounts (name);
+# A MySQL comment
+SELECT 'boom';
+/* inline */ INSERT INTO accounts VALUES (1, 'a; b');
+-- The last statement
+INSERT INTO accounts VALUES (2, '-- c');
+
+-- A trailing comment
@@ -0,0 +1,9 @@
+-- migrate:no-retry
+-- migrate:timeout 1m
+
+-- The directives take lines of their own
+CREATE TABLE d (id INT);
+SELECT 'boom';
+
+-- migrate:timeout off
+UPDATE d SET id = 2;
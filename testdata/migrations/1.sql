@@ -0,0 +1 @@
+CREATE TABLE a (id INT);
@@ -0,0 +1 @@
+CREATE TABLE d (id BIGINT);
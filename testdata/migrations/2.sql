@@ -0,0 +1,3 @@
+CREATE TABLE b (id INT);
+UPDATE b SET id = 1;
+CREATE TABLE c (id INT);
@@ -0,0 +1 @@
+CREATE TABLE e (id INT);
@@ -0,0 +1,212 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// WithTransactions runs the statements of every file in one transaction, as
+// if each started with the "-- migrate:transaction" directive, other than
+// multi files, which run as one batch, and Go migrations, which run in their
+// own. A file fails without any of its statements taking effect, so it writes
+// no checkpoints, and runs again whole.
+func WithTransactions() Option {
+	return func(m *Migrate) { m.transactions = true }
+}
+
+// inTransaction reports whether a file with the directives d runs in a
+// transaction.
+func (m *Migrate) inTransaction(d directives) bool {
+	return d.transaction || m.transactions && !d.multi
+}
+
+// checkTransaction reports an error unless f's statements, stmts, whose lines
+// are counted after the dirLines lines of its directives, can run in one
+// transaction: the store must be a TxBeginner, and none of the statements may
+// commit it implicitly.
+func (m *Migrate) checkTransaction(
+	f *file,
+	stmts []Statement,
+	dirLines int,
+) error {
+	if ic, ok := m.db.(ImplicitCommitter); ok {
+		var commits []Statement
+		for _, stmt := range stmts {
+			if ic.CommitsImplicitly(stmt.SQL) {
+				stmt.Line += dirLines
+				commits = append(commits, stmt)
+			}
+		}
+		if len(commits) > 0 {
+			return &ErrImplicitCommit{Filename: f.Info.Name(),
+				Statements: commits}
+		}
+	}
+	if _, ok := m.db.(TxBeginner); !ok {
+		return fmt.Errorf("%s: %T can't run a file in a transaction",
+			f.Info.Name(), m.db)
+	}
+	if m.strictWarnings {
+		return fmt.Errorf("%s: warnings aren't read in a transaction, so it can't run with strict warnings",
+			f.Info.Name())
+	}
+	return nil
+}
+
+// checkTransactionFiles reports the first error checkTransactionFile reports
+// for files, so that a file which can't run in its transaction is refused
+// before any of those ahead of it run.
+func (m *Migrate) checkTransactionFiles(files []*file) error {
+	for _, f := range files {
+		byt, err := fs.ReadFile(m.fsys, f.fullpath)
+		if err != nil {
+			return err
+		}
+		err = m.checkTransactionFile(f, normalizeLineEndings(byt))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTransactionFile reports the error checkTransaction does if f, whose
+// content is byt, runs in a transaction. Errors reading its statements are
+// left for when it runs, as are Go migrations, which run in their own.
+func (m *Migrate) checkTransactionFile(f *file, byt []byte) error {
+	if goMigrationOf(f.Info) != nil {
+		return nil
+	}
+	d, body, err := parseDirectives(byt)
+	if err != nil || !m.inTransaction(d) {
+		return nil
+	}
+	stmts, err := m.statementsOf(f, d, body)
+	if err != nil {
+		return nil
+	}
+	dirLines := lineOf(string(byt), len(byt)-len(body)) - 1
+	return m.checkTransaction(f, stmts, dirLines)
+}
+
+// checkNoCheckpoints reports an error if f, which runs in a transaction, has
+// checkpoints of an earlier run which wasn't.
+func (m *Migrate) checkNoCheckpoints(ctx context.Context, f *file) error {
+	if m.noMeta {
+		return nil
+	}
+	checkpoints, err := m.db.GetMetaCheckpoints(ctx, f.Info.Name())
+	if err != nil {
+		return errors.Wrap(err, "get checkpoints")
+	}
+	if len(checkpoints) > 0 {
+		return fmt.Errorf("%s runs in a transaction, but has %d checkpoints of an earlier run which wasn't: clear them once what they ran is undone",
+			f.Info.Name(), len(checkpoints))
+	}
+	return nil
+}
+
+// runTransaction runs f's statements, stmts, in one transaction, rolling it
+// back if any fails. dirLines is the lines of f's directives, d.
+func (m *Migrate) runTransaction(
+	ctx context.Context,
+	f *file,
+	d directives,
+	stmts []Statement,
+	dirLines int,
+) error {
+	if err := m.checkTransaction(f, stmts, dirLines); err != nil {
+		return err
+	}
+	if len(stmts) == 0 {
+		return nil
+	}
+	m.log.Println(">", transactionDirective, f.Info.Name())
+	tx, err := m.db.(TxBeginner).BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%s: begin: %w", f.Info.Name(), err)
+	}
+
+	// Statements are recorded in metahistory once the transaction ends, as
+	// the store may have no other connection to record them with until then
+	type attempt struct {
+		i     int
+		start time.Time
+		err   error
+	}
+	var attempts []attempt
+	defer func() {
+		for _, a := range attempts {
+			m.recordHistory(ctx, f, a.i, a.start, a.err)
+		}
+	}()
+	for i, stmt := range stmts {
+		line := dirLines + stmt.Line
+		if m.stopped() {
+			_ = tx.Rollback()
+			return fmt.Errorf("%s: %w", f.Info.Name(), ErrStopped)
+		}
+		m.log.Printf("> %s: %s\n", statementAt(i, line), m.shortSQL(stmt.SQL))
+		timeout := m.statementTimeout
+		if d.timeout != nil {
+			timeout = *d.timeout
+		}
+		if stmt.timeout != nil {
+			timeout = *stmt.timeout
+		}
+		stmtStart := time.Now()
+		err = execTx(ctx, tx, stmt.SQL, timeout)
+		if m.verboseHistory {
+			attempts = append(attempts, attempt{i, stmtStart, err})
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			if ctx.Err() != nil {
+				return fmt.Errorf("%s: %w", f.Info.Name(), ctx.Err())
+			}
+			m.log.Println("failed on", m.redactSQL(stmt.SQL))
+			m.log.Printf("rolled back the transaction of %s\n", f.Info.Name())
+			return m.statementErr(f, i, line, stmt.SQL, err)
+		}
+	}
+
+	// A commit which fails may have committed all the same, such as if the
+	// connection was lost before the database replied
+	if err = tx.Commit(); err != nil {
+		last := len(stmts) - 1
+		return &ErrOutcomeUnknown{
+			Filename:  f.Info.Name(),
+			Statement: last,
+			Line:      dirLines + stmts[last].Line,
+			Err:       fmt.Errorf("commit: %w", err),
+		}
+	}
+	return nil
+}
+
+// execTx runs cmd in tx, limited to timeout if it's non-zero.
+func execTx(
+	ctx context.Context,
+	tx *sql.Tx,
+	cmd string,
+	timeout time.Duration,
+) error {
+	if timeout == 0 {
+		_, err := tx.ExecContext(ctx, cmd)
+		return err
+	}
+	stmtCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	_, err := tx.ExecContext(stmtCtx, cmd)
+	if err != nil && ctx.Err() == nil &&
+		errors.Is(stmtCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("exceeded its %s timeout: %w", timeout,
+			context.DeadlineExceeded)
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// WithUpTo makes Migrate apply the pending files only up to and including
+// target, such as a known-good point of a staged rollout, leaving those after
+// it pending. New reports an error if target isn't one of the files, or if
+// it's applied already while a file before it is pending. Once Migrate is
+// done, it logs the files it left pending.
+func WithUpTo(target string) Option {
+	return func(m *Migrate) { m.upTo = norm.NFC.String(target) }
+}
+
+// UpTo applies the pending migrations in dir up to and including target, as
+// New and Migrate do with WithUpTo, leaving those after it pending. It
+// reports whether any migration ran.
+func UpTo(
+	ctx context.Context,
+	db Store,
+	log Logger,
+	dbt DBType,
+	dir string,
+	target string,
+	opts ...Option,
+) (bool, error) {
+	fsys, err := dirFS(dir)
+	if err != nil {
+		return false, err
+	}
+	return UpToFS(ctx, db, log, dbt, fsys, target, opts...)
+}
+
+// UpToFS is UpTo with the files at the root of fsys, as NewFS reads them.
+func UpToFS(
+	ctx context.Context,
+	db Store,
+	log Logger,
+	dbt DBType,
+	fsys fs.FS,
+	target string,
+	opts ...Option,
+) (bool, error) {
+	opts = append(opts[:len(opts):len(opts)], WithUpTo(target))
+	m, err := NewFS(ctx, db, log, dbt, fsys, "", opts...)
+	if err != nil {
+		return false, err
+	}
+	return m.Migrate(ctx)
+}
+
+// checkUpTo reports an error if the target of WithUpTo isn't a file, or is
+// applied while a file before it is pending, which applying up to it would
+// leave out.
+func (m *Migrate) checkUpTo() error {
+	if m.upTo == "" {
+		return nil
+	}
+	idx, ok := m.fileIndexes()[m.upTo]
+	if !ok {
+		return fmt.Errorf("%s isn't a migration in the directory", m.upTo)
+	}
+	pending := map[string]bool{}
+	for _, f := range m.pending() {
+		pending[f.Info.Name()] = true
+	}
+	if pending[m.upTo] {
+		return nil
+	}
+	for _, f := range m.Files[:idx] {
+		if pending[f.Info.Name()] {
+			return fmt.Errorf("%s is applied already, but %s before it is pending",
+				m.upTo, f.Info.Name())
+		}
+	}
+	return nil
+}
+
+// upToTarget returns the first of pending, up to and including the target of
+// WithUpTo.
+func (m *Migrate) upToTarget(pending []*file) []*file {
+	idx, ok := m.fileIndexes()[m.upTo]
+	if !ok {
+		return nil
+	}
+	last := m.Files[idx]
+	for i, f := range pending {
+		if f == last {
+			return pending[:i+1]
+		}
+	}
+
+	// The target is applied, so only the files before it would run, of
+	// which checkUpTo found none pending
+	return nil
+}
+
+// logLeftPending logs left, the files WithUpTo left pending after its target.
+func (m *Migrate) logLeftPending(left []*file) {
+	if m.upTo == "" {
+		return
+	}
+	if len(left) == 0 {
+		m.log.Printf("no migrations are pending after %s\n", m.upTo)
+		return
+	}
+	m.log.Printf("left %d migrations pending after %s:\n", len(left), m.upTo)
+	for _, f := range left {
+		m.log.Printf("  %s\n", f.Info.Name())
+	}
+}
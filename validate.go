@@ -0,0 +1,117 @@
+package migrate
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// GapPolicy is what New and Validate do about a gap between sequence numbers,
+// such as 0016_x.sql followed by 0018_y.sql, which may be a migration lost in a
+// merge, or intended, such as after squashing. Timestamps have gaps by design,
+// so they're never checked.
+type GapPolicy int
+
+const (
+	// GapsAllowed ignores gaps, as by default.
+	GapsAllowed GapPolicy = iota
+
+	// GapsWarn logs each gap.
+	GapsWarn
+
+	// GapsRefused reports an error for a gap.
+	GapsRefused
+)
+
+// WithGapPolicy sets what to do about gaps in the numbering of migrations.
+func WithGapPolicy(p GapPolicy) Option {
+	return func(m *Migrate) { m.gaps = p }
+}
+
+// Validate checks the migrations in dir, as New does before running any, but
+// without a database, such as in CI: that each is numbered once, and
+// optionally that there are no gaps in the numbering, per WithGapPolicy, or
+// mix of sequence numbers and timestamps, per WithoutMixedNumbering. Gaps
+// under GapsWarn are logged with StdLogger.
+func Validate(dir string, opts ...Option) error {
+	fsys, err := dirFS(dir)
+	if err != nil {
+		return err
+	}
+	return ValidateFS(fsys, opts...)
+}
+
+// ValidateFS is Validate with the files at the root of fsys, as for NewFS.
+func ValidateFS(fsys fs.FS, opts ...Option) error {
+	conf := &Migrate{log: StdLogger{}}
+	for _, opt := range opts {
+		opt(conf)
+	}
+	fsys, err := conf.withIgnore(fsys)
+	if err != nil {
+		return err
+	}
+	fsys, err = conf.withGoMigrations(migrationFS(fsys))
+	if err != nil {
+		return err
+	}
+
+	// Overrides for a database replace files of the same names, so
+	// they're numbered as the main directory is
+	files, err := conf.readFiles(fsys, "")
+	if err != nil {
+		return errors.Wrap(err, "get migrations")
+	}
+	if err = sortFiles(files, conf.order()); err != nil {
+		return errors.Wrap(err, "sort")
+	}
+	return conf.checkNumbering(files)
+}
+
+// checkGaps reports gaps between the sequence numbers of files, sorted,
+// according to m.gaps.
+func (m *Migrate) checkGaps(files []*file) error {
+	if m.gaps == GapsAllowed {
+		return nil
+	}
+	var prev *file
+	var prevNum string
+	for _, f := range files {
+		num := regexNum.FindString(path.Base(f.Info.Name()))
+		if isTimestamp(num) {
+			continue
+		}
+		if prev != nil {
+			next := nextNumber(prevNum)
+			if compareDigits(num, next) != 0 {
+				err := fmt.Errorf("gap in numbering: %s is followed by %s, expected %s next",
+					prev.Info.Name(), f.Info.Name(), next)
+				if m.gaps == GapsRefused {
+					return err
+				}
+				if m.log != nil {
+					m.log.Println("WARNING:", err)
+				}
+			}
+		}
+		prev, prevNum = f, num
+	}
+	return nil
+}
+
+// nextNumber returns the number after num, a string of digits, padded to the
+// same width, such as 0018 after 0017.
+func nextNumber(num string) string {
+	byt := []byte(num)
+	for i := len(byt) - 1; i >= 0; i-- {
+		if byt[i] < '9' {
+			byt[i]++
+			return string(byt)
+		}
+		byt[i] = '0'
+	}
+	return "1" + strings.Repeat("0", len(byt))
+}
@@ -0,0 +1,218 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+
+	"github.com/pkg/errors"
+)
+
+// VerifyReport is what Verify found comparing meta with the migration files,
+// such as before a deploy. It marshals to JSON for CI.
+type VerifyReport struct {
+	// Matched are the applied migrations whose files match their
+	// checksums, and Modified those whose files don't.
+	Matched  []string       `json:"matched"`
+	Modified []ModifiedFile `json:"modified,omitempty"`
+
+	// MissingOnDisk are migrations recorded in meta which no file has, and
+	// MissingInDB files which aren't recorded, so are pending.
+	MissingOnDisk []string `json:"missing_on_disk,omitempty"`
+	MissingInDB   []string `json:"missing_in_db,omitempty"`
+
+	// PartiallyApplied are the migrations which ran some statements but
+	// haven't finished, leaving checkpoints.
+	PartiallyApplied []PartialMigration `json:"partially_applied,omitempty"`
+
+	// OK reports that no migration is modified or partially applied.
+	OK bool `json:"ok"`
+}
+
+// ModifiedFile is an applied migration whose file no longer matches the
+// checksum recorded when it ran.
+type ModifiedFile struct {
+	Filename string `json:"filename"`
+
+	// Algo is the algorithm the migration was checksummed with, Stored its
+	// checksum in meta, and Computed the file's.
+	Algo     string `json:"algo"`
+	Stored   string `json:"stored"`
+	Computed string `json:"computed"`
+
+	// Policy is the ModifiedPolicy under which Migrate continued past the
+	// migration, or empty in a VerifyReport.
+	Policy string `json:"policy,omitempty"`
+}
+
+// PartialMigration is a migration with checkpoints for the statements which
+// ran before it failed or was interrupted.
+type PartialMigration struct {
+	Filename string `json:"filename"`
+
+	// Status is the migration's status in meta, or empty if it isn't
+	// recorded, as before meta version 3.
+	Status string `json:"status,omitempty"`
+
+	// Checkpoints is how many of its statements ran.
+	Checkpoints int `json:"checkpoints"`
+}
+
+func (r *VerifyReport) String() string {
+	s := fmt.Sprintf("%d matched, %d modified, %d missing on disk, %d pending, %d partially applied",
+		len(r.Matched), len(r.Modified), len(r.MissingOnDisk),
+		len(r.MissingInDB), len(r.PartiallyApplied))
+	if !r.OK {
+		s += ": not ok"
+	}
+	return s
+}
+
+// Verify compares the migrations recorded in db with the files in dir, as New
+// would read them, without writing to db, reporting every migration whose
+// file was modified or is missing, every file not yet applied, and every
+// migration partially applied.
+func Verify(
+	ctx context.Context,
+	db Store,
+	dbt DBType,
+	dir string,
+	opts ...Option,
+) (*VerifyReport, error) {
+	fsys, err := dirFS(dir)
+	if err != nil {
+		return nil, err
+	}
+	return VerifyFS(ctx, db, dbt, fsys, opts...)
+}
+
+// VerifyFS is Verify with the files at the root of fsys, as NewFS reads them.
+func VerifyFS(
+	ctx context.Context,
+	db Store,
+	dbt DBType,
+	fsys fs.FS,
+	opts ...Option,
+) (*VerifyReport, error) {
+	conf := &Migrate{}
+	for _, opt := range opts {
+		opt(conf)
+	}
+	fsys, err := conf.withIgnore(fsys)
+	if err != nil {
+		return nil, err
+	}
+	if fsys, err = conf.withGoMigrations(migrationFS(fsys)); err != nil {
+		return nil, err
+	}
+	files, err := conf.readFiles(fsys, dbt)
+	if err != nil {
+		return nil, errors.Wrap(err, "get migrations")
+	}
+	if err = sortFiles(files, conf.order()); err != nil {
+		return nil, errors.Wrap(err, "sort")
+	}
+	report := &VerifyReport{Matched: []string{}, OK: true}
+	v, exists, err := db.GetMetaVersion(ctx)
+	switch {
+	case err != nil:
+		return nil, errors.Wrap(err, "get meta version")
+	case !exists:
+		for _, f := range files {
+			report.MissingInDB = append(report.MissingInDB, f.Info.Name())
+		}
+		return report, nil
+	case v > version:
+		return nil, &ErrVersionTooNew{Have: v, Want: version}
+	}
+
+	ms, err := db.GetMigrations(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get migrations")
+	}
+	normalizeFilenames(ms)
+	ms = conf.withoutOtherEnvs(ms)
+	conf.sortMigrations(ms)
+	byName := make(map[string]*file, len(files))
+	for _, f := range files {
+		byName[f.Info.Name()] = f
+	}
+	applied := make(map[string]bool, len(ms))
+	unfinished := map[string]string{}
+	for _, mg := range ms {
+		f, ok := byName[mg.Filename]
+		switch {
+		case !ok:
+			report.MissingOnDisk = append(report.MissingOnDisk,
+				mg.Filename)
+			continue
+		case mg.Status == StatusFailed || mg.Status == StatusInProgress ||
+			mg.Status == StatusRollbackFailed:
+			// Unfinished migrations are pending, and may have been
+			// edited to fix them, so their checksums aren't checked
+			unfinished[mg.Filename] = mg.Status
+			continue
+		}
+		applied[mg.Filename] = true
+		byt, err := fs.ReadFile(fsys, f.fullpath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read %s", mg.Filename)
+		}
+		match, _, err := recordedMatch(mg, byt)
+		if err != nil {
+			return nil, errors.Wrapf(err, "checksum %s", mg.Filename)
+		}
+		if match {
+			report.Matched = append(report.Matched, mg.Filename)
+			continue
+		}
+		check, err := fileChecksumOf(recordedAlgo(mg), byt)
+		if err != nil {
+			return nil, err
+		}
+		report.Modified = append(report.Modified, ModifiedFile{
+			Filename: mg.Filename,
+			Algo:     recordedAlgo(mg),
+			Stored:   mg.Checksum,
+			Computed: check,
+		})
+	}
+
+	// Pending files may have checkpoints, whether they're recorded as
+	// unfinished or, before meta version 3, not recorded at all
+	for _, f := range files {
+		name := f.Info.Name()
+		if applied[name] {
+			continue
+		}
+		report.MissingInDB = append(report.MissingInDB, name)
+		err = report.addPartial(ctx, db, name, unfinished[name])
+		if err != nil {
+			return nil, err
+		}
+	}
+	report.OK = len(report.Modified) == 0 &&
+		len(report.PartiallyApplied) == 0
+	return report, nil
+}
+
+// addPartial adds the migration called filename, with status, to the report's
+// PartiallyApplied if it has checkpoints in db.
+func (r *VerifyReport) addPartial(
+	ctx context.Context,
+	db Store,
+	filename, status string,
+) error {
+	checkpoints, err := db.GetMetaCheckpoints(ctx, filename)
+	if err != nil {
+		return errors.Wrapf(err, "get checkpoints for %s", filename)
+	}
+	if len(checkpoints) > 0 {
+		r.PartiallyApplied = append(r.PartiallyApplied, PartialMigration{
+			Filename:    filename,
+			Status:      status,
+			Checkpoints: len(checkpoints),
+		})
+	}
+	return nil
+}